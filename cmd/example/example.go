@@ -17,48 +17,439 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"github.com/yaacov/gokitty/pkg/middleware"
 	"github.com/yaacov/gokitty/pkg/mux"
 )
 
+// newRouter returns a router, using an in-memory store.
 func newRouter() *mux.Router {
-	// Create a new handler.
-	h := newHandler()
+	return newStoreRouter(newMemoryStore())
+}
+
+// newStoreRouter returns a router, using store.
+func newStoreRouter(store Store) *mux.Router {
+	return newHandlerRouter(newHandler(store))
+}
 
+// apiVersion is the path prefix of the versioned API routes.
+const apiVersion = "/v1"
+
+// newHandlerRouter returns a router, using the handlers of h.
+//
+// API routes are registered under "/v1", and under their legacy unprefixed
+// paths, that are deprecated, unless h disables legacy paths, they read and
+// write JSON, or YAML, except raw value routes. Requests are traced using
+// the tracer of h, spans are named by the route template. If h injects
+// faults, they are injected into API requests, and are set using
+// "/debug/faults".
+func newHandlerRouter(h *Handler) *mux.Router {
 	// Create a new router.
 	r := mux.Router{
-		NotFoundHandler: notFound,
+		NotFoundHandler:         traced(h.tracer, middleware.UnmatchedRoute, notFound),
+		MethodNotAllowedHandler: traced(h.tracer, middleware.UnmatchedRoute, methodNotAllowed),
+		ErrorEncoder:            encodeRouterErr,
+		RecoverHandler:          recovered,
+		AutoOptions:             true,
+		AutoHead:                true,
+	}
+	v1 := r.PathPrefix(apiVersion)
+	h.registerRoutes(func(method, path string, handle func(http.ResponseWriter, *http.Request)) {
+		if h.faults != nil {
+			handle = h.faults.inject(method, path, handle)
+		}
+		if !rawRoute(path) {
+			handle = negotiate(handle)
+		}
+		v1.MustHandleFunc(method, path, traced(h.tracer, apiVersion+path, handle))
+		if !h.disableLegacy {
+			r.MustHandleFunc(method, path, traced(h.tracer, path, deprecated(handle)))
+		}
+	})
+
+	// Register health probes, that are not versioned, the store is ready
+	// once it is created.
+	health := middleware.Health()
+	health.AddReadinessCheck("store", func(ctx context.Context) error {
+		if h.store == nil {
+			return errors.New("store is not initialized")
+		}
+		return nil
+	})
+	if h.prober != nil {
+		health.AddReadinessCheck("store-probe", h.prober.check)
+	}
+	health.AddReadinessCheck("drain", func(ctx context.Context) error {
+		if h.drainer.Draining() {
+			return errors.New("server is shutting down")
+		}
+		return nil
+	})
+	r.HandleFunc("GET", "/livez", traced(h.tracer, "/livez", health.Live().ServeHTTP))
+	r.HandleFunc("GET", "/readyz", traced(h.tracer, "/readyz", health.Ready().ServeHTTP))
+
+	// Register the web UI, that is not versioned either.
+	r.HandleFunc("GET", "/ui", traced(h.tracer, "/ui", getUI))
+	r.HandleFunc("GET", "/ui/:file", traced(h.tracer, "/ui/:file", getUI))
+
+	// Register the fault injection routes, that are not versioned, changing
+	// faults requires the write token, or a token granting write access to
+	// all the namespaces.
+	if h.faults != nil {
+		r.HandleFunc("GET", "/debug/faults", traced(h.tracer, "/debug/faults", h.getFaults))
+		r.HandleFunc("PUT", "/debug/faults", traced(h.tracer, "/debug/faults", h.authorizeAll(true, h.putFaults)))
+		r.HandleFunc("DELETE", "/debug/faults", traced(h.tracer, "/debug/faults", h.authorizeAll(true, h.deleteFaults)))
 	}
-	r.HandleFunc("GET", "/val", h.getVal)
-	r.HandleFunc("GET", "/val/:key", h.getVal)
-	r.HandleFunc("POST", "/val", h.postVal)
-	r.HandleFunc("PUT", "/val/:key", h.putVal)
-	r.HandleFunc("DELETE", "/val/:key", h.deleteVal)
 
 	return &r
 }
 
+// registerRoutes registers the API routes of h using handle, paths are
+// relative to the API version.
+func (h Handler) registerRoutes(handle func(method, path string, handler func(http.ResponseWriter, *http.Request))) {
+	// Mutation routes are rate limited, require a token granting write
+	// access, or the write token, if they are enabled, are rejected while
+	// the store is unhealthy, and are audited. Other routes require a token
+	// granting read access, if tokens are enabled.
+	write := func(handle func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+		return h.limitWrites(h.authorize(true, h.requireHealthyStore(h.audited(handle))))
+	}
+	read := func(handle func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+		return h.authorize(false, handle)
+	}
+
+	handle("GET", "/val", read(h.getVal))
+	handle("GET", "/val/:key", read(h.getVal))
+	handle("HEAD", "/val", read(h.headVal))
+	handle("HEAD", "/val/:key", read(h.headVal))
+	handle("POST", "/val", write(h.postVal))
+	handle("PUT", "/val/:key", write(h.putVal))
+	handle("PATCH", "/val/:key", write(h.patchVal))
+	handle("POST", "/val/:key/incr", write(h.incrVal))
+	handle("POST", "/val/:key/cas", write(h.casVal))
+	handle("POST", "/val/:key/push", write(h.pushVal))
+	handle("POST", "/val/:key/pop", write(h.popVal))
+	handle("GET", "/val/:key/len", read(h.lenVal))
+	handle("GET", "/val/:key/meta", read(h.getMeta))
+	handle("GET", "/raw/:key", read(h.getRaw))
+	handle("PUT", "/raw/:key", write(h.putRaw))
+	handle("DELETE", "/val/:key", write(h.deleteVal))
+	handle("DELETE", "/val", write(h.clearVals))
+	handle("POST", "/val/delete", write(h.deleteVals))
+	handle("POST", "/val/query", read(h.queryVals))
+	handle("POST", "/txn", write(h.postTxn))
+	handle("GET", "/export", read(h.getExport))
+	handle("GET", "/val/:key/history", read(h.getHistory))
+	handle("GET", "/val/:key/watch", read(h.watch))
+	handle("GET", "/watch", read(h.watch))
+	if h.softDelete {
+		handle("GET", "/trash", read(h.getTrash))
+		handle("POST", "/trash/:key/restore", write(h.restoreTrashed))
+		handle("DELETE", "/trash/:key", write(h.deleteTrashed))
+	}
+	handle("GET", "/stats", h.authorizeAll(false, h.getStats))
+	handle("GET", "/audit", h.authorizeAll(true, h.getAudit))
+	if h.webhooks != nil {
+		handle("GET", "/webhooks", h.authorizeAll(true, h.getWebhooks))
+		handle("POST", "/webhooks", h.authorizeAll(true, h.postWebhook))
+		handle("GET", "/webhooks/:id", h.authorizeAll(true, h.getWebhook))
+		handle("DELETE", "/webhooks/:id", h.authorizeAll(true, h.deleteWebhook))
+		handle("GET", "/webhooks/:id/deliveries", h.authorizeAll(true, h.getWebhookDeliveries))
+	}
+
+	// Register namespaced routes, /val routes use the default namespace.
+	handle("GET", "/ns", h.authorizeAll(false, h.getNamespaces))
+	handle("DELETE", "/ns/:namespace", write(h.deleteNamespace))
+	handle("GET", "/ns/:namespace/val", read(h.inNamespace(Handler.getVal)))
+	handle("GET", "/ns/:namespace/val/:key", read(h.inNamespace(Handler.getVal)))
+	handle("HEAD", "/ns/:namespace/val", read(h.inNamespace(Handler.headVal)))
+	handle("HEAD", "/ns/:namespace/val/:key", read(h.inNamespace(Handler.headVal)))
+	handle("GET", "/ns/:namespace/val/:key/history", read(h.inNamespace(Handler.getHistory)))
+	handle("GET", "/ns/:namespace/val/:key/meta", read(h.inNamespace(Handler.getMeta)))
+	handle("PUT", "/ns/:namespace/val/:key", write(h.inNamespace(Handler.putVal)))
+	handle("DELETE", "/ns/:namespace/val/:key", write(h.inNamespace(Handler.deleteVal)))
+	handle("GET", "/ns/:namespace/raw/:key", read(h.inNamespace(Handler.getRaw)))
+	handle("GET", "/ns/:namespace/export", read(h.inNamespace(Handler.getExport)))
+	handle("PUT", "/ns/:namespace/raw/:key", write(h.inNamespace(Handler.putRaw)))
+	handle("POST", "/ns/:namespace/txn", write(h.inNamespace(Handler.postTxn)))
+	if h.softDelete {
+		handle("GET", "/ns/:namespace/trash", read(h.inNamespace(Handler.getTrash)))
+		handle("POST", "/ns/:namespace/trash/:key/restore", write(h.inNamespace(Handler.restoreTrashed)))
+		handle("DELETE", "/ns/:namespace/trash/:key", write(h.inNamespace(Handler.deleteTrashed)))
+	}
+}
+
+// deprecated returns a handler calling handle, marking responses of legacy
+// paths deprecated, with a link to the versioned path.
+func deprecated(handle func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		successor := apiVersion + r.URL.EscapedPath()
+		if r.URL.RawQuery != "" {
+			successor += "?" + r.URL.RawQuery
+		}
+
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+successor+">; rel=\"successor-version\"")
+		handle(w, r)
+	}
+}
+
 func main() {
-	// Create a logging middleware, it's warm and fuzzy, prrr...
+	// Run as a client of a running server, e.g. "example ctl get kitty".
+	if len(os.Args) > 1 && os.Args[1] == clientCommand {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		code := runClient(ctx, os.Args[2:], os.LookupEnv, os.Stdin, os.Stdout, os.Stderr)
+		stop()
+		os.Exit(code)
+	}
+
+	c, err := parseConfig(os.Args[1:], os.LookupEnv)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create a logger, it's warm and fuzzy, prrr...
 	logger := log.New(os.Stdout, "kitty: ", log.LstdFlags)
-	loggingMiddleware := logging(logger)
+	logger.Println("config:", c)
+
+	// Serve plaintext on addr, or TLS, or plaintext and TLS on tls-addr.
+	var ln, tlsLn net.Listener
+	switch {
+	case c.TLSCert == "":
+		ln, err = net.Listen("tcp", c.Addr)
+	case c.TLSAddr == "":
+		tlsLn, err = net.Listen("tcp", c.Addr)
+	default:
+		if ln, err = net.Listen("tcp", c.Addr); err == nil {
+			tlsLn, err = net.Listen("tcp", c.TLSAddr)
+		}
+	}
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	// Serve until we get a SIGINT or SIGTERM.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err = run(ctx, c, ln, tlsLn, logger)
+	stop()
+	if err != nil {
+		logger.Fatal(err)
+	}
+}
+
+// openStore creates the store of a config, persistent stores are returned
+// with their closer.
+func openStore(c *config) (Store, io.Closer, error) {
+	switch {
+	case c.Bolt != "":
+		boltStore, err := newBoltStore(c.Bolt)
+		if err != nil {
+			return nil, nil, err
+		}
+		return boltStore, boltStore, nil
+	case c.File != "":
+		fileStore := newFileStoreWAL(c.File, c.SnapshotInterval, c.WAL, time.Now)
+		return fileStore, fileStore, nil
+	case c.MemoryMaxKeys > 0:
+		// The bound, and the recency of keys, are of the whole store.
+		return newStoreWithLimit(c.MemoryMaxKeys, c.EvictionPolicy), nil, nil
+	case c.MemoryShards > 1:
+		return newShardedStore(c.MemoryShards), nil, nil
+	}
+
+	return newMemoryStore(), nil, nil
+}
+
+// run serves plaintext on ln, and TLS on tlsLn, both are optional, until
+// ctx is done, then shuts down gracefully, in-flight requests are drained,
+// background goroutines are stopped and the store is closed, it fails if the
+// shutdown timeout expired first.
+func run(ctx context.Context, c *config, ln, tlsLn net.Listener, logger *log.Logger) error {
+	var tlsConfig *tls.Config
+	var auditFile *os.File
+	var tokens *tokenFile
+	var schemas *schemaRegistry
+	var hooks []webhook
+	var seeded, skipped int
+	store, closer, err := openStore(c)
+	if err == nil && c.Seed != "" {
+		seeded, skipped, err = seedStore(store, c.Seed, c.SeedOverwrite, c.Limits)
+	}
+	if err == nil && c.Tokens != "" {
+		tokens, err = loadTokenFile(c.Tokens, c.WriteToken)
+	}
+	if err == nil && len(c.Schemas) > 0 {
+		schemas, err = loadSchemas(c.Schemas)
+	}
+	if err == nil && c.Webhooks.Workers > 0 {
+		hooks, err = loadWebhooks(newWebhookStore(store))
+	}
+	if err == nil && tlsLn != nil {
+		tlsConfig, err = newTLSConfig(c.TLSCert, c.TLSKey, c.TLSClientCA)
+	}
+	if err == nil && c.AuditFile != "" {
+		auditFile, err = os.OpenFile(c.AuditFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	}
+	if err != nil {
+		for _, l := range []net.Listener{ln, tlsLn} {
+			if l != nil {
+				l.Close()
+			}
+		}
+		if closer != nil {
+			closer.Close()
+		}
+		return err
+	}
+
+	if c.Seed != "" {
+		logger.Printf("Seeded %d keys from %s, kept %d keys that exist", seeded, c.Seed, skipped)
+	}
+
+	// Remove expired keys in the background.
+	trashRetention := time.Duration(0)
+	if c.SoftDelete {
+		trashRetention = c.TrashRetention
+	}
+	janitor := startJanitor(store, c.SweepInterval, trashRetention, logger)
 
 	// Register our routes.
-	router := newRouter()
+	h := newHandler(store)
+	h.limits = c.Limits
+	h.schemas = schemas
+	h.writeToken = c.WriteToken
+	h.tokens = tokens
+	h.disableLegacy = c.DisableLegacy
+	h.softDelete = c.SoftDelete
+	h.hub.keys = newKeyHistory(c.History, c.HistoryMaxKeys)
+	if c.Trace {
+		h.tracer = newLogTracer(logger, time.Now)
+	}
+	switch {
+	case auditFile != nil:
+		h.audit = newAuditLog(c.AuditSize, auditFile)
+	case c.AuditSize > 0:
+		h.audit = newAuditLog(c.AuditSize, nil)
+	}
+	if c.WriteRate > 0 {
+		h.writeLimit = newWriteLimit(c.WriteRate, c.WriteBurst, time.Now)
+	}
+	if c.DebugFaults {
+		h.faults = newFaultInjector()
+	}
+	if c.Webhooks.Workers > 0 {
+		startWebhooks(h, hooks, c.Webhooks)
+	}
 
-	// Serve on port 8080.
-	s := &http.Server{
-		Addr:           ":8080",
-		Handler:        loggingMiddleware(router),
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
-		MaxHeaderBytes: 1 << 20,
+	// Probe the health of persistent stores in the background.
+	if c.ProbeInterval > 0 && closer != nil {
+		h.prober = newStoreProber(store, c.ProbeInterval, c.ProbeThreshold, time.Now)
+		h.prober.start(logger)
+	}
+	// Reload tokens on SIGHUP, requests in flight keep their tokens.
+	if tokens != nil {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer func() {
+			signal.Stop(hup)
+			close(hup)
+		}()
+		go tokens.reloadOn(hup, logger)
+	}
+	var handler http.Handler = newHandlerRouter(h)
+	if c.MaxBodyBytes > 0 {
+		handler = middleware.MaxBytes(c.MaxBodyBytes)(handler)
+	}
+	handler = middleware.RealIP(c.TrustedProxies)(handler)
+	handler = logging(logger, c.LogFormat, time.Now)(handler)
+
+	// Plaintext and TLS listeners serve the same router, using a server
+	// each, ServeTLS negotiates HTTP/2.
+	newServer := func() *http.Server {
+		return &http.Server{
+			Handler:        h.drainer.Middleware()(handler),
+			ReadTimeout:    c.ReadTimeout,
+			WriteTimeout:   c.WriteTimeout,
+			IdleTimeout:    c.IdleTimeout,
+			MaxHeaderBytes: c.MaxHeaderBytes,
+			TLSConfig:      tlsConfig,
+		}
+	}
+	var servers []*http.Server
+	serveErr := make(chan error, 2)
+	if ln != nil {
+		s := newServer()
+		servers = append(servers, s)
+		logger.Printf("Kitty key value server is starting on %s ( try: /v1/val ) ...", ln.Addr())
+		go func() { serveErr <- s.Serve(ln) }()
+	}
+	if tlsLn != nil {
+		s := newServer()
+		servers = append(servers, s)
+		logger.Printf("Kitty key value server is starting with TLS on %s ...", tlsLn.Addr())
+		go func() { serveErr <- s.ServeTLS(tlsLn, "", "") }()
+	}
+
+	var errs []error
+	select {
+	case <-ctx.Done():
+		// Drain in-flight requests, then shut down the servers, readiness
+		// checks fail once draining starts.
+		logger.Println("Kitty is going to sleep ...")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), c.ShutdownTimeout)
+		defer cancel()
+
+		// Watch streams never complete, close them before draining.
+		h.hub.Close()
+		if err := h.drainer.Shutdown(shutdownCtx); err != nil {
+			errs = append(errs, fmt.Errorf("draining requests: %w", err))
+		}
+		for _, s := range servers {
+			if err := s.Shutdown(shutdownCtx); err != nil {
+				errs = append(errs, fmt.Errorf("shutting down the server: %w", err))
+			}
+		}
+	case err := <-serveErr:
+		h.hub.Close()
+		for _, s := range servers {
+			s.Close()
+		}
+		errs = append(errs, err)
+	}
+
+	janitor.Stop()
+	if h.prober != nil {
+		h.prober.Stop()
+	}
+	if h.webhooks != nil {
+		h.webhooks.Close()
+	}
+	if closer != nil {
+		if err := closer.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing the store: %w", err))
+		}
+	}
+	if auditFile != nil {
+		if err := auditFile.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing the audit file: %w", err))
+		}
 	}
 
-	logger.Println("Kitty key value server is starting ( try: http://localhost:8080/val ) ...")
-	logger.Fatal(s.ListenAndServe())
+	return errors.Join(errs...)
 }
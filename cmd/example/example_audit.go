@@ -0,0 +1,193 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package main
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/yaacov/gokitty/pkg/middleware"
+	"github.com/yaacov/gokitty/pkg/mux"
+)
+
+// defaultAuditLimit is the number of audit entries of a GET "/audit" request
+// without a limit.
+const defaultAuditLimit = 100
+
+// auditEntry is a mutation request, recorded by the audit log.
+//
+// The old and new revisions are the watch revisions before and after the
+// request, they are equal if nothing changed, and concurrent mutations may
+// fall between them.
+type auditEntry struct {
+	Time        time.Time `json:"time"`
+	ClientIP    string    `json:"client_ip"`
+	Principal   string    `json:"principal,omitempty"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	Namespace   string    `json:"namespace,omitempty"`
+	Key         string    `json:"key,omitempty"`
+	Status      int       `json:"status"`
+	OldRevision uint64    `json:"old_revision"`
+	NewRevision uint64    `json:"new_revision"`
+}
+
+// auditLog keeps the last entries in a ring buffer, and optionally appends
+// every entry to a writer, as a JSON line, it is safe for concurrent use.
+type auditLog struct {
+	// Guards all the fields.
+	mu sync.Mutex
+
+	// Ring buffer of the last entries, next is the index of the next entry,
+	// and n is the number of entries.
+	entries []auditEntry
+	next    int
+	n       int
+
+	// Optional writer of all the entries, e.g. an append-only file.
+	w io.Writer
+}
+
+// newAuditLog returns an audit log keeping size entries, and appending them
+// to w, if it is not nil.
+func newAuditLog(size int, w io.Writer) *auditLog {
+	return &auditLog{entries: make([]auditEntry, size), w: w}
+}
+
+// record adds an entry, failing to write it is logged.
+func (a *auditLog) record(e auditEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.entries) > 0 {
+		a.entries[a.next] = e
+		a.next = (a.next + 1) % len(a.entries)
+		if a.n < len(a.entries) {
+			a.n++
+		}
+	}
+
+	if a.w != nil {
+		data, _ := json.Marshal(e)
+		if _, err := a.w.Write(append(data, '\n')); err != nil {
+			log.Printf("warning: can't write audit entry: %v", err)
+		}
+	}
+}
+
+// last returns up to limit of the last entries, newest first.
+func (a *auditLog) last(limit int) []auditEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if limit > a.n {
+		limit = a.n
+	}
+	entries := make([]auditEntry, limit)
+	for i := range entries {
+		entries[i] = a.entries[(a.next-1-i+len(a.entries))%len(a.entries)]
+	}
+
+	return entries
+}
+
+// audited returns a handler calling handle, and recording the request in
+// the audit log, if it is enabled.
+func (h Handler) audited(handle func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	if h.audit == nil {
+		return handle
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		e := auditEntry{
+			Time:        h.hub.now().UTC(),
+			ClientIP:    middleware.ClientIP(r),
+			Method:      r.Method,
+			Path:        r.URL.Path,
+			OldRevision: h.hub.revision(),
+		}
+		e.Principal = principalName(r)
+		e.Namespace, _ = mux.Var(r, "namespace")
+		e.Key, _ = mux.Var(r, "key")
+
+		sw := &statusWriter{ResponseWriter: w}
+		handle(sw, r)
+
+		e.Status = sw.status()
+		e.NewRevision = h.hub.revision()
+		h.audit.record(e)
+	}
+}
+
+// getAudit handles GET "/audit" requests, writing the last entries of the
+// audit log, newest first, up to the "limit" query parameter.
+func (h Handler) getAudit(w http.ResponseWriter, r *http.Request) {
+	if h.audit == nil {
+		writeErr(w, http.StatusNotFound, "audit log is disabled")
+		return
+	}
+
+	limit := defaultAuditLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			writeErr(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = n
+	}
+
+	writeJSON(w, map[string][]auditEntry{"entries": h.audit.last(limit)})
+}
+
+// limitWrites returns a handler calling handle, limiting the rate of
+// mutations of each client IP, if the write rate is set.
+func (h Handler) limitWrites(handle func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	if h.writeLimit == nil {
+		return handle
+	}
+
+	return h.writeLimit(http.HandlerFunc(handle)).ServeHTTP
+}
+
+// newWriteLimit returns a middleware limiting each client IP to rate
+// mutations per second, and bursts of burst mutations.
+func newWriteLimit(rate float64, burst int, now func() time.Time) func(http.Handler) http.Handler {
+	return middleware.RateLimit(middleware.RateLimitOptions{
+		Rate:    rate,
+		Burst:   burst,
+		Limited: writeRateLimited,
+		Now:     now,
+	})
+}
+
+// Write a rate limited error, with the seconds until the next mutation is
+// allowed.
+func writeRateLimited(w http.ResponseWriter, r *http.Request, retry time.Duration) {
+	seconds := int64((retry + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	writeErrCode(w, http.StatusTooManyRequests, errCodeRateLimited, "too many requests")
+}
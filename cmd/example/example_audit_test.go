@@ -0,0 +1,160 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yaacov/gokitty/pkg/middleware"
+)
+
+// serveFrom serves a request sent from a remote address, with optional
+// headers.
+func serveFrom(handler http.Handler, method, path, body, remoteAddr string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.RemoteAddr = remoteAddr
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	return rr
+}
+
+func TestAudit(t *testing.T) {
+	var file bytes.Buffer
+	clock := &fakeClock{now: time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)}
+	h := newHandler(newMemoryStore())
+	h.hub.now = clock.Now
+	h.audit = newAuditLog(3, &file)
+	handler := middleware.RealIP([]string{"192.0.2.1"})(newHandlerRouter(h))
+
+	proxied := map[string]string{"X-Forwarded-For": "198.51.100.7"}
+	serveFrom(handler, "PUT", "/v1/val/kitty", "\"cat\"", "192.0.2.9:1234", nil)
+	serveFrom(handler, "PUT", "/v1/val/kitty", "\"cat\"", "192.0.2.1:1234", proxied)
+	serveFrom(handler, "GET", "/v1/val/kitty", "", "192.0.2.9:1234", nil)
+	serveFrom(handler, "PUT", "/v1/ns/cats/val/tom", "1", "192.0.2.9:1234", nil)
+	serveFrom(handler, "DELETE", "/val/kitty", "", "192.0.2.1:1234", proxied)
+
+	// Check the last entries are served newest first, reads are not
+	// audited, and no-op mutations keep the revision.
+	rr := serveFrom(handler, "GET", "/v1/audit?limit=2", "", "192.0.2.9:1234", nil)
+	var got struct {
+		Entries []auditEntry `json:"entries"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	expected := []auditEntry{
+		{clock.Now(), "198.51.100.7", "", "DELETE", "/val/kitty", "", "kitty", http.StatusOK, 2, 3},
+		{clock.Now(), "192.0.2.9", "", "PUT", "/v1/ns/cats/val/tom", "cats", "tom", http.StatusCreated, 1, 2},
+	}
+	if len(got.Entries) != len(expected) {
+		t.Fatalf("got entries %+v want %+v", got.Entries, expected)
+	}
+	for i, e := range expected {
+		if g := got.Entries[i]; !g.Time.Equal(e.Time) || g.ClientIP != e.ClientIP || g.Method != e.Method ||
+			g.Path != e.Path || g.Namespace != e.Namespace || g.Key != e.Key || g.Status != e.Status ||
+			g.OldRevision != e.OldRevision || g.NewRevision != e.NewRevision {
+			t.Errorf("entry %d: got %+v want %+v", i, g, e)
+		}
+	}
+
+	// Check the ring buffer keeps the last entries, and the file has all
+	// the entries.
+	rr = serveFrom(handler, "GET", "/v1/audit", "", "192.0.2.9:1234", nil)
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil || len(got.Entries) != 3 {
+		t.Errorf("got entries %+v, %v want 3 entries", got.Entries, err)
+	}
+	if got.Entries[2].Status != http.StatusNotModified || got.Entries[2].OldRevision != got.Entries[2].NewRevision {
+		t.Errorf("no-op PUT: got %+v", got.Entries[2])
+	}
+	if lines := strings.Split(strings.TrimSpace(file.String()), "\n"); len(lines) != 4 {
+		t.Errorf("got file lines %q want 4 lines", lines)
+	}
+
+	// Check invalid limits fail.
+	if rr := serveFrom(handler, "GET", "/v1/audit?limit=0", "", "192.0.2.9:1234", nil); rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid limit: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestAuditDisabled(t *testing.T) {
+	handler := newRouter()
+
+	// Check the audit log is not served when it is disabled.
+	if rr := serve(t, handler, "GET", "/v1/audit", "", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestAuditWriteToken(t *testing.T) {
+	h := newHandler(newMemoryStore())
+	h.audit = newAuditLog(10, nil)
+	h.writeToken = "s3cret"
+	handler := newHandlerRouter(h)
+
+	// Check the audit log requires the write token, and rejected mutations
+	// are not audited.
+	serve(t, handler, "PUT", "/v1/val/kitty", "\"cat\"", "")
+	if rr := serve(t, handler, "GET", "/v1/audit", "", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+	rr := serveAuth(t, handler, "GET", "/v1/audit", "", "Bearer s3cret")
+	if rr.Code != http.StatusOK || rr.Body.String() != "{\"entries\":[]}" {
+		t.Errorf("got %v %s want no entries", rr.Code, rr.Body.String())
+	}
+}
+
+func TestWriteRateLimit(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	h := newHandler(newMemoryStore())
+	h.writeLimit = newWriteLimit(1, 2, clock.Now)
+	handler := newHandlerRouter(h)
+
+	// Check a burst of mutations is allowed, and the next is limited.
+	for i := 0; i < 2; i++ {
+		if rr := serveFrom(handler, "POST", "/v1/val/visits/incr", "", "192.0.2.9:1234", nil); rr.Code != http.StatusOK {
+			t.Fatalf("mutation %d: got %v want %v", i, rr.Code, http.StatusOK)
+		}
+	}
+	rr := serveFrom(handler, "PUT", "/v1/val/kitty", "\"cat\"", "192.0.2.9:1234", nil)
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "1" ||
+		rr.Body.String() != "{\"error\":{\"code\":\"rate_limited\",\"message\":\"too many requests\"}}" {
+		t.Errorf("got %v %v %s want a rate limited error", rr.Code, rr.Header(), rr.Body.String())
+	}
+
+	// Check reads, and mutations of other clients, are not limited.
+	if rr := serveFrom(handler, "GET", "/v1/val/visits", "", "192.0.2.9:1234", nil); rr.Code != http.StatusOK {
+		t.Errorf("read: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if rr := serveFrom(handler, "DELETE", "/v1/val/visits", "", "192.0.2.10:1234", nil); rr.Code != http.StatusOK {
+		t.Errorf("other client: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	// Check mutations are allowed again at the rate.
+	clock.Add(time.Second)
+	if rr := serveFrom(handler, "PUT", "/v1/val/kitty", "\"cat\"", "192.0.2.9:1234", nil); rr.Code != http.StatusCreated {
+		t.Errorf("after a second: got %v want %v", rr.Code, http.StatusCreated)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+
+	"github.com/yaacov/gokitty/pkg/middleware"
+)
+
+// errWrongToken is returned when a bearer token is not the write token.
+var errWrongToken = errors.New("wrong write token")
+
+// requireWriteToken returns a handler calling handle for requests with
+// the write token of h as a bearer token, comparing tokens in constant
+// time, if the write token is not set, handle is returned.
+//
+// Example:
+//
+//	r.HandleFunc("PUT", "/val/:key", h.requireWriteToken(h.putVal))
+func (h Handler) requireWriteToken(handle func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	if h.writeToken == "" {
+		return handle
+	}
+
+	token := []byte(h.writeToken)
+	verify := func(s string) (map[string]interface{}, error) {
+		if subtle.ConstantTimeCompare([]byte(s), token) != 1 {
+			return nil, errWrongToken
+		}
+		return nil, nil
+	}
+	auth := middleware.BearerAuth(verify, middleware.BearerAuthOptions{
+		Unauthorized: writeUnauthorized,
+	})
+
+	return auth(http.HandlerFunc(handle)).ServeHTTP
+}
+
+// Write an unauthorized error, without the rejected token.
+func writeUnauthorized(w http.ResponseWriter, r *http.Request, err error) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	writeErrCode(w, http.StatusUnauthorized, errCodeUnauthorized, err.Error())
+}
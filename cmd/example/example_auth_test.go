@@ -0,0 +1,134 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yaacov/gokitty/pkg/middleware"
+)
+
+// serveAuth serves a request with an optional Authorization header.
+func serveAuth(t *testing.T, handler http.Handler, method, path, body, authorization string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	return rr
+}
+
+func TestWriteToken(t *testing.T) {
+	h := newHandler(newMemoryStore())
+	h.writeToken = "s3cret"
+	handler := newHandlerRouter(h)
+
+	tests := []struct {
+		name          string
+		method        string
+		path          string
+		body          string
+		authorization string
+		status        int
+	}{
+		{"missing header", "PUT", "/val/kitty", "1", "", http.StatusUnauthorized},
+		{"wrong token", "PUT", "/val/kitty", "1", "Bearer kitty", http.StatusUnauthorized},
+		{"wrong scheme", "PUT", "/val/kitty", "1", "Basic s3cret", http.StatusUnauthorized},
+		{"token prefix", "PUT", "/val/kitty", "1", "Bearer s3c", http.StatusUnauthorized},
+		{"correct token", "PUT", "/val/kitty", "1", "Bearer s3cret", http.StatusCreated},
+		{"get is open", "GET", "/val/kitty", "", "", http.StatusOK},
+		{"query is open", "POST", "/val/query", "{\"keys\": [\"kitty\"]}", "", http.StatusOK},
+		{"post", "POST", "/val", "{\"a\": 1}", "", http.StatusUnauthorized},
+		{"patch", "PATCH", "/val/kitty", "2", "", http.StatusUnauthorized},
+		{"incr", "POST", "/val/kitty/incr", "", "", http.StatusUnauthorized},
+		{"cas", "POST", "/val/kitty/cas", "{\"old\": 1, \"new\": 2}", "", http.StatusUnauthorized},
+		{"delete", "DELETE", "/val/kitty", "", "", http.StatusUnauthorized},
+		{"clear", "DELETE", "/val?confirm=true", "", "", http.StatusUnauthorized},
+		{"bulk delete", "POST", "/val/delete", "[\"kitty\"]", "", http.StatusUnauthorized},
+		{"namespace put", "PUT", "/ns/cats/val/kitty", "1", "", http.StatusUnauthorized},
+		{"namespace delete", "DELETE", "/ns/cats", "", "", http.StatusUnauthorized},
+		{"delete with token", "DELETE", "/val/kitty", "", "Bearer s3cret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		rr := serveAuth(t, handler, tt.method, tt.path, tt.body, tt.authorization)
+
+		// Check the status code is what we expect.
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				tt.name, status, tt.status)
+		}
+
+		// Check rejected requests get a JSON error.
+		if tt.status == http.StatusUnauthorized {
+			if !strings.Contains(rr.Body.String(), "\"code\":\"unauthorized\"") {
+				t.Errorf("%s: handler returned unexpected body: %v", tt.name, rr.Body.String())
+			}
+			if rr.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("%s: handler returned no WWW-Authenticate header", tt.name)
+			}
+		}
+	}
+}
+
+func TestWriteTokenUnset(t *testing.T) {
+	handler := newRouter()
+
+	// Check mutations are open without a write token.
+	for i, authorization := range []string{"", "Bearer kitty"} {
+		rr := serveAuth(t, handler, "PUT", "/val/kitty", fmt.Sprint(i), authorization)
+		if rr.Code != http.StatusCreated && rr.Code != http.StatusOK {
+			t.Errorf("%q: handler returned wrong status code: got %v", authorization, rr.Code)
+		}
+	}
+}
+
+func TestWriteTokenNotLogged(t *testing.T) {
+	c, err := quietConfig([]string{"-write-token", "s3cret"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHandler(newMemoryStore())
+	h.writeToken = c.WriteToken
+
+	var out bytes.Buffer
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	for _, format := range []middleware.Format{middleware.TextFormat, middleware.JSONFormat} {
+		handler := logging(log.New(&out, "", 0), format, clock.Now)(newHandlerRouter(h))
+		serveAuth(t, handler, "PUT", "/val/kitty", "1", "Bearer s3cret")
+		serveAuth(t, handler, "PUT", "/val/kitty", "1", "Bearer wrong")
+	}
+	out.WriteString(c.String())
+
+	// Check the request logs, and the printed config, have no token.
+	if strings.Contains(out.String(), "s3cret") || strings.Contains(out.String(), "wrong") {
+		t.Errorf("logs have the token: %s", out.String())
+	}
+	if !strings.Contains(out.String(), "write-token=REDACTED") {
+		t.Errorf("config has no redacted write-token: %s", c)
+	}
+}
@@ -0,0 +1,402 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// clientCommand is the first argument that runs the example as a client of
+// a running server, e.g. "example ctl get kitty".
+const clientCommand = "ctl"
+
+// importBatchKeys is the maximum number of keys imported in one request.
+const importBatchKeys = 500
+
+// client is a client of the API of the example server.
+type client struct {
+	// Base URL of the server, e.g. "http://localhost:8080".
+	server string
+
+	// Bearer token of mutation requests, if any.
+	token string
+
+	http *http.Client
+}
+
+// clientError is an error response of the server.
+type clientError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *clientError) Error() string {
+	return e.Message
+}
+
+// do sends a request to path, relative to the API version, and decodes
+// a JSON response into out, if out is not nil.
+//
+// Error responses are returned as a *clientError with the server's error
+// message.
+func (c *client) do(ctx context.Context, method, path string, body []byte, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.server, "/")+apiVersion+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", jsonContentType)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return responseError(resp)
+	}
+	if out == nil || resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// responseError returns the error of an error response, responses that
+// are not an error of the API, e.g. of a proxy, have the status as their
+// message.
+func responseError(resp *http.Response) error {
+	var e apiError
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if json.Unmarshal(data, &e) != nil || e.Error.Message == "" {
+		e.Error = apiErrorBody{Message: resp.Status}
+	}
+	return &clientError{Status: resp.StatusCode, Code: e.Error.Code, Message: e.Error.Message}
+}
+
+// valPath returns the path of a key.
+func valPath(key string) string {
+	return "/val/" + url.PathEscape(key)
+}
+
+// get returns the value of a key.
+func (c *client) get(ctx context.Context, key string) (json.RawMessage, error) {
+	var m map[string]json.RawMessage
+	if err := c.do(ctx, "GET", valPath(key), nil, &m); err != nil {
+		return nil, err
+	}
+	return m[key], nil
+}
+
+// set creates or modifies the value of a key.
+func (c *client) set(ctx context.Context, key string, value json.RawMessage) error {
+	return c.do(ctx, "PUT", valPath(key), value, nil)
+}
+
+// delete deletes a key.
+func (c *client) delete(ctx context.Context, key string) error {
+	return c.do(ctx, "DELETE", valPath(key), nil, nil)
+}
+
+// list returns the values of the keys starting with prefix, getting them
+// page by page.
+func (c *client) list(ctx context.Context, prefix string) (map[string]json.RawMessage, error) {
+	vals := make(map[string]json.RawMessage)
+	q := url.Values{"limit": {strconv.Itoa(maxPageLimit)}}
+	if prefix != "" {
+		q.Set("prefix", prefix)
+	}
+	for {
+		var p page
+		if err := c.do(ctx, "GET", "/val?"+q.Encode(), nil, &p); err != nil {
+			return nil, err
+		}
+		for k, v := range p.Items {
+			vals[k] = v
+		}
+		if p.NextCursor == "" {
+			return vals, nil
+		}
+		q.Set("cursor", p.NextCursor)
+	}
+}
+
+// importValues creates or modifies the values of many keys, in batches of
+// importBatchKeys keys, batches are not imported atomically.
+func (c *client) importValues(ctx context.Context, vals map[string]json.RawMessage) error {
+	keys := make([]string, 0, len(vals))
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for len(keys) > 0 {
+		n := min(len(keys), importBatchKeys)
+		batch := make(map[string]json.RawMessage, n)
+		for _, k := range keys[:n] {
+			batch[k] = vals[k]
+		}
+		keys = keys[n:]
+
+		body, err := json.Marshal(batch)
+		if err != nil {
+			return err
+		}
+		if err := c.do(ctx, "POST", "/val", body, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watch calls fn with the changes of the keys starting with prefix, after
+// revision since, if since is not empty, until ctx is done, the stream ends
+// or fn fails.
+func (c *client) watch(ctx context.Context, prefix, since string, fn func(event) error) error {
+	path := "/watch"
+	if since != "" {
+		path += "?since=" + url.QueryEscape(since)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(c.server, "/")+apiVersion+path, nil)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return responseError(resp)
+	}
+
+	// Streams are newline delimited JSON, the server does not filter keys
+	// by prefix.
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		var e event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return err
+		}
+		if !strings.HasPrefix(e.Key, prefix) {
+			continue
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return scanner.Err()
+}
+
+// parseValue returns the JSON value of a command line argument, arguments
+// that are not valid JSON are strings, e.g. cat is "cat", and 9 is 9.
+func parseValue(arg string) json.RawMessage {
+	if json.Valid([]byte(arg)) {
+		return compactJSON(json.RawMessage(arg))
+	}
+	v, _ := json.Marshal(arg)
+	return v
+}
+
+// formatValue returns a value as text, strings without their quotes, and
+// missing values, e.g. of deleted events, as an empty string.
+func formatValue(v json.RawMessage) string {
+	if len(v) == 0 {
+		return ""
+	}
+	var s string
+	if json.Unmarshal(v, &s) == nil {
+		return s
+	}
+	return string(v)
+}
+
+// runClient runs the client command line args, e.g. "get kitty", writing
+// results to stdout and errors to stderr, and returns the exit code, 1 on
+// errors and 2 on usage errors.
+//
+// The server and write token flags can be set by the KITTY_SERVER and
+// KITTY_WRITE_TOKEN environment variables.
+func runClient(ctx context.Context, args []string, lookupEnv func(string) (string, bool), stdin io.Reader, stdout, stderr io.Writer) int {
+	c := client{server: "http://localhost:8080", http: http.DefaultClient}
+	if s, ok := lookupEnv(envName("server")); ok {
+		c.server = s
+	}
+	if s, ok := lookupEnv(envName("write-token")); ok {
+		c.token = s
+	}
+	var asJSON bool
+
+	fs := flag.NewFlagSet(clientCommand, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&c.server, "server", c.server, "base `URL` of the server")
+	fs.StringVar(&c.token, "write-token", c.token, "bearer `token` of mutation requests")
+	fs.BoolVar(&asJSON, "json", false, "print machine-readable JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s [flags] get|set|delete|list|watch|export|import, flags override KITTY_ environment variables, e.g. KITTY_SERVER:\n", fs.Name())
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	err := runClientCommand(ctx, &c, fs.Arg(0), fs.Args()[1:], asJSON, stdin, stdout, stderr)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if _, ok := err.(usageError); ok {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "kitty:", err)
+		return 1
+	}
+	return 0
+}
+
+// usageError is an error in the command line of a client command.
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+// runClientCommand runs a client command with its args.
+func runClientCommand(ctx context.Context, c *client, cmd string, args []string, asJSON bool, stdin io.Reader, stdout, stderr io.Writer) error {
+	var prefix, since string
+
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	nargs := 0
+	switch cmd {
+	case "get", "delete":
+		nargs = 1
+	case "set":
+		nargs = 2
+	case "list", "export":
+		fs.StringVar(&prefix, "prefix", "", "only keys starting with `prefix`")
+	case "watch":
+		fs.StringVar(&prefix, "prefix", "", "only keys starting with `prefix`")
+		fs.StringVar(&since, "since", "", "replay the changes after `revision`")
+	case "import":
+	default:
+		return usageError(fmt.Sprintf("unknown command %q", cmd))
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if cmd == "import" && fs.NArg() > 1 || cmd != "import" && fs.NArg() != nargs {
+		return usageError(fmt.Sprintf("wrong number of arguments of %s", cmd))
+	}
+
+	switch cmd {
+	case "get":
+		v, err := c.get(ctx, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		if asJSON {
+			fmt.Fprintf(stdout, "%s\n", v)
+		} else {
+			fmt.Fprintln(stdout, formatValue(v))
+		}
+	case "set":
+		return c.set(ctx, fs.Arg(0), parseValue(fs.Arg(1)))
+	case "delete":
+		return c.delete(ctx, fs.Arg(0))
+	case "list":
+		vals, err := c.list(ctx, prefix)
+		if err != nil {
+			return err
+		}
+		if asJSON {
+			return json.NewEncoder(stdout).Encode(vals)
+		}
+		keys := make([]string, 0, len(vals))
+		for k := range vals {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(stdout, "%s\t%s\n", k, formatValue(vals[k]))
+		}
+	case "watch":
+		return c.watch(ctx, prefix, since, func(e event) error {
+			if asJSON {
+				return json.NewEncoder(stdout).Encode(e)
+			}
+			_, err := fmt.Fprintf(stdout, "%d\t%s\t%s\t%s\n", e.Revision, e.Type, e.Key, formatValue(e.Value))
+			return err
+		})
+	case "export":
+		// Exports are always JSON, so they can be imported.
+		vals, err := c.list(ctx, prefix)
+		if err != nil {
+			return err
+		}
+		return json.NewEncoder(stdout).Encode(vals)
+	case "import":
+		// Import a file, or stdin, written by export.
+		r := stdin
+		if fs.NArg() == 1 {
+			f, err := os.Open(fs.Arg(0))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		var vals map[string]json.RawMessage
+		if err := json.NewDecoder(r).Decode(&vals); err != nil {
+			return fmt.Errorf("can't read values: %v", err)
+		}
+		return c.importValues(ctx, vals)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// runCtl runs a client command line, returning its exit code, stdout and
+// stderr.
+func runCtl(t *testing.T, env map[string]string, stdin string, args ...string) (int, string, string) {
+	t.Helper()
+
+	lookupEnv := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+	var stdout, stderr bytes.Buffer
+	code := runClient(context.Background(), args, lookupEnv, strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestClient(t *testing.T) {
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		args   []string
+		code   int
+		stdout string
+		stderr string
+	}{
+		{"set string", []string{"set", "kitty", "cat"}, 0, "", ""},
+		{"set json", []string{"set", "tom", `{"lives":9}`}, 0, "", ""},
+		{"set escaped key", []string{"set", "app1/a", "1"}, 0, "", ""},
+		{"set unchanged", []string{"set", "kitty", "cat"}, 0, "", ""},
+		{"get string", []string{"get", "kitty"}, 0, "cat\n", ""},
+		{"get string json", []string{"-json", "get", "kitty"}, 0, "\"cat\"\n", ""},
+		{"get escaped key", []string{"get", "app1/a"}, 0, "1\n", ""},
+		{"get missing", []string{"get", "gorilla"}, 1, "", "kitty: can't find key gorilla\n"},
+		{"list", []string{"list"}, 0, "app1/a\t1\nkitty\tcat\ntom\t{\"lives\":9}\n", ""},
+		{"list prefix", []string{"list", "-prefix", "app1/"}, 0, "app1/a\t1\n", ""},
+		{"list json", []string{"--json", "list"}, 0, "{\"app1/a\":1,\"kitty\":\"cat\",\"tom\":{\"lives\":9}}\n", ""},
+		{"delete", []string{"delete", "kitty"}, 0, "", ""},
+		{"delete missing", []string{"delete", "kitty"}, 1, "", "kitty: can't find key kitty\n"},
+		{"unknown command", []string{"pet", "kitty"}, 2, "", "unknown command \"pet\"\n"},
+		{"wrong arguments", []string{"get"}, 2, "", "wrong number of arguments of get\n"},
+	}
+
+	for _, tt := range tests {
+		code, stdout, stderr := runCtl(t, nil, "", append([]string{"-server", server.URL}, tt.args...)...)
+
+		// Check the exit code and the output are what we expect.
+		if code != tt.code || stdout != tt.stdout || stderr != tt.stderr {
+			t.Errorf("%s: got %d, %q, %q want %d, %q, %q", tt.name, code, stdout, stderr, tt.code, tt.stdout, tt.stderr)
+		}
+	}
+}
+
+func TestClientWriteToken(t *testing.T) {
+	h := newHandler(newMemoryStore())
+	h.writeToken = "s3cret"
+	server := httptest.NewServer(newHandlerRouter(h))
+	defer server.Close()
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		code int
+	}{
+		{"missing token", nil, []string{"set", "kitty", "cat"}, 1},
+		{"token flag", nil, []string{"-write-token", "s3cret", "set", "kitty", "cat"}, 0},
+		{"token env", map[string]string{"KITTY_WRITE_TOKEN": "s3cret"}, []string{"delete", "kitty"}, 0},
+		{"flag overrides env", map[string]string{"KITTY_WRITE_TOKEN": "s3cret"}, []string{"-write-token", "kitty", "set", "kitty", "cat"}, 1},
+	}
+
+	for _, tt := range tests {
+		env := map[string]string{"KITTY_SERVER": server.URL}
+		for k, v := range tt.env {
+			env[k] = v
+		}
+
+		// Check mutations are authorized using the token.
+		if code, _, stderr := runCtl(t, env, "", tt.args...); code != tt.code {
+			t.Errorf("%s: got exit code %d, %q want %d", tt.name, code, stderr, tt.code)
+		}
+	}
+}
+
+func TestClientExportImport(t *testing.T) {
+	from := httptest.NewServer(newRouter())
+	defer from.Close()
+	to := httptest.NewServer(newRouter())
+	defer to.Close()
+
+	// Export more keys than an import batch.
+	vals := make(map[string]json.RawMessage)
+	for i := 0; i <= importBatchKeys; i++ {
+		vals[fmt.Sprintf("key-%04d", i)] = json.RawMessage(strconv.Itoa(i))
+	}
+	c := &client{server: from.URL, http: http.DefaultClient}
+	if err := c.importValues(context.Background(), vals); err != nil {
+		t.Fatal(err)
+	}
+	code, exported, stderr := runCtl(t, nil, "", "-server", from.URL, "export")
+	if code != 0 {
+		t.Fatalf("export: got exit code %d, %q", code, stderr)
+	}
+
+	// Check importing an export, from stdin or a file, copies the values.
+	path := filepath.Join(t.TempDir(), "kitty.json")
+	if err := os.WriteFile(path, []byte(exported), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{{"import"}, {"import", path}} {
+		if code, _, stderr := runCtl(t, nil, exported, append([]string{"-server", to.URL}, args...)...); code != 0 {
+			t.Fatalf("%v: got exit code %d, %q", args, code, stderr)
+		}
+		_, got, _ := runCtl(t, nil, "", "-server", to.URL, "export")
+		if got != exported {
+			t.Errorf("%v: imported values differ from the exported values", args)
+		}
+	}
+
+	// Check invalid imports fail.
+	if code, _, stderr := runCtl(t, nil, "[1, 2]", "-server", to.URL, "import"); code != 1 || !strings.HasPrefix(stderr, "kitty: can't read values:") {
+		t.Errorf("invalid import: got exit code %d, %q", code, stderr)
+	}
+}
+
+func TestClientWatch(t *testing.T) {
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+
+	c := &client{server: server.URL, http: http.DefaultClient}
+	ctx := context.Background()
+	c.set(ctx, "app1/a", json.RawMessage(`1`))
+	c.set(ctx, "app2/a", json.RawMessage(`2`))
+	c.delete(ctx, "app1/a")
+
+	// Check replayed events are filtered by prefix.
+	errDone := errors.New("done")
+	var got []string
+	err := c.watch(ctx, "app1/", "0", func(e event) error {
+		got = append(got, fmt.Sprintf("%d %s %s %s", e.Revision, e.Type, e.Key, formatValue(e.Value)))
+		if len(got) == 2 {
+			return errDone
+		}
+		return nil
+	})
+	if err != errDone {
+		t.Fatal(err)
+	}
+	if want := "[1 created app1/a 1 3 deleted app1/a ]"; fmt.Sprint(got) != want {
+		t.Errorf("unexpected events: got %v want %v", got, want)
+	}
+
+	// Check watch errors are reported.
+	if err := c.watch(ctx, "", "kitty", nil); err == nil || err.Error() != "invalid since kitty" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
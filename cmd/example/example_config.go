@@ -0,0 +1,392 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yaacov/gokitty/pkg/middleware"
+)
+
+// config is the configuration of the example server.
+//
+// Every flag can be set by an environment variable, "KITTY_" and the flag
+// name in upper case, with underscores, e.g. KITTY_ADDR for -addr, flags
+// override environment variables, that override defaults.
+type config struct {
+	// Address to listen on, and an optional port overriding its port.
+	Addr string
+	Port int
+
+	// TLS certificate and key files, an optional client CA file requiring
+	// client certificates, and an optional address serving TLS, while Addr
+	// serves plaintext.
+	TLSCert     string
+	TLSKey      string
+	TLSClientCA string
+	TLSAddr     string
+
+	// Server timeouts and sizes.
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+	IdleTimeout    time.Duration
+	MaxHeaderBytes int
+	MaxBodyBytes   int64
+
+	// Request log format, and logging a span of every request.
+	LogFormat middleware.Format
+	Trace     bool
+
+	// Store backend, a bbolt database, a JSON file, o/w an in-memory store,
+	// optionally bounded, unbounded stores are sharded.
+	Bolt             string
+	File             string
+	SnapshotInterval time.Duration
+	WAL              walOptions
+	MemoryMaxKeys    int
+	EvictionPolicy   EvictionPolicy
+	MemoryShards     int
+
+	// Seed the store on startup from an export file, or a directory of
+	// files, keys that exist are kept unless SeedOverwrite.
+	Seed          string
+	SeedOverwrite bool
+
+	// Revisions kept of each key, and the maximum number of keys with
+	// a history.
+	History        int
+	HistoryMaxKeys int
+
+	// Remove expired keys every SweepInterval.
+	SweepInterval time.Duration
+
+	// Move deleted keys to the trash, and remove them from the trash once
+	// they were trashed for TrashRetention, zero keeps them.
+	SoftDelete     bool
+	TrashRetention time.Duration
+
+	// Probe persistent stores every ProbeInterval, zero disables probes,
+	// mutations are rejected once probes failed for ProbeThreshold.
+	ProbeInterval  time.Duration
+	ProbeThreshold time.Duration
+
+	// Maximum duration of draining requests on shutdown.
+	ShutdownTimeout time.Duration
+
+	// Bounds the keys and values.
+	Limits Limits
+
+	// Schema files of key prefixes, as "prefix=file".
+	Schemas []string
+
+	// Bearer token of mutation requests, if empty mutations are open.
+	WriteToken string
+
+	// Optional JSON, or YAML, file of tokens granting access to namespaces.
+	Tokens string
+
+	// Serve the API only under /v1, without the legacy unprefixed paths.
+	DisableLegacy bool
+
+	// Audit log of mutations, the number of entries kept in memory, and an
+	// optional file the entries are appended to.
+	AuditSize int
+	AuditFile string
+
+	// Delivery of changes to webhooks, disabled if there are no workers.
+	Webhooks webhookOptions
+
+	// Mutations per second, and burst of mutations, of each client IP,
+	// a zero rate is unlimited.
+	WriteRate  float64
+	WriteBurst int
+
+	// Proxies trusted to forward the client IP.
+	TrustedProxies []string
+
+	// Serve "/debug/faults", injecting latency, errors and dropped
+	// connections into API requests.
+	DebugFaults bool
+
+	// Holds the flags, for printing.
+	flags *flag.FlagSet
+}
+
+// envName returns the environment variable of a flag, e.g. KITTY_ADDR.
+func envName(flagName string) string {
+	return "KITTY_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// parseConfig parses command line arguments, using lookupEnv for flags
+// missing from the command line, invalid values fail.
+func parseConfig(args []string, lookupEnv func(string) (string, bool)) (*config, error) {
+	return parseConfigOutput(args, lookupEnv, os.Stderr)
+}
+
+// parseConfigOutput parses a config, writing usage and errors to out.
+func parseConfigOutput(args []string, lookupEnv func(string) (string, bool), out io.Writer) (*config, error) {
+	c := config{Limits: defaultLimits()}
+	var logFormat, evictionPolicy, keyPattern, trustedProxies string
+
+	fs := flag.NewFlagSet("example", flag.ContinueOnError)
+	fs.SetOutput(out)
+	fs.StringVar(&c.Addr, "addr", ":8080", "`address` to listen on")
+	fs.IntVar(&c.Port, "port", 0, "`port` to listen on, overrides the port of addr")
+	fs.StringVar(&c.TLSCert, "tls-cert", "", "serve TLS using a certificate `file`, and tls-key")
+	fs.StringVar(&c.TLSKey, "tls-key", "", "private key `file` of tls-cert")
+	fs.StringVar(&c.TLSClientCA, "tls-client-ca", "", "require client certificates signed by a CA certificates `file`")
+	fs.StringVar(&c.TLSAddr, "tls-addr", "", "serve TLS on `address`, and plaintext on addr, o/w addr serves TLS")
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", 10*time.Second, "maximum `duration` for reading requests")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", 10*time.Second, "maximum `duration` for writing responses, watch streams are not limited")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", time.Minute, "maximum `duration` to wait for the next request of keep-alive connections")
+	fs.IntVar(&c.MaxHeaderBytes, "max-header-bytes", 1<<20, "maximum size of request headers in `bytes`")
+	fs.Int64Var(&c.MaxBodyBytes, "max-body-bytes", 4<<20, "maximum size of request bodies in `bytes`, 0 is unlimited")
+	fs.StringVar(&logFormat, "log-format", "text", "request log `format`, text or json")
+	fs.BoolVar(&c.Trace, "trace", false, "log a span of every request, named by its route, a child of its traceparent header")
+	fs.StringVar(&c.File, "file", "", "persist values to a JSON `file`, o/w values are kept in memory")
+	fs.DurationVar(&c.SnapshotInterval, "snapshot-interval", 0, "write the file periodically, o/w write every change")
+	fs.BoolVar(&c.WAL.Enabled, "wal", false, "append changes of file to a write-ahead log, snapshots compact the log")
+	fs.BoolVar(&c.WAL.Sync, "wal-sync", true, "fsync the write-ahead log after every change")
+	fs.Int64Var(&c.WAL.CompactBytes, "wal-compact-bytes", defaultWALCompactBytes, "write a snapshot when the write-ahead log reaches `bytes`, 0 compacts only every snapshot-interval")
+	fs.StringVar(&c.Bolt, "bolt", "", "persist values to a bbolt database `file`")
+	fs.IntVar(&c.MemoryMaxKeys, "memory-max-keys", 0, "bound the in-memory store to `n` keys, 0 is unbounded, a bounded store is not sharded, and can't be used with memory-shards")
+	fs.StringVar(&evictionPolicy, "eviction-policy", "lru", "what a full in-memory store does, lru evicts keys, reject fails new keys")
+	fs.IntVar(&c.MemoryShards, "memory-shards", defaultMemoryShards, "spread the keys of an unbounded in-memory store over `n` shards, locked separately, 1 is a single lock, can't be used with memory-max-keys")
+	fs.StringVar(&c.Seed, "seed", "", "store the values of an export `file`, or of the files of a directory, keyed by their paths, on startup")
+	fs.BoolVar(&c.SeedOverwrite, "seed-overwrite", false, "replace the values of keys that exist when seeding, o/w they are kept")
+	fs.IntVar(&c.History, "history", defaultHistoryRevisions, "keep the last `n` revisions of each key, 0 disables the history")
+	fs.IntVar(&c.HistoryMaxKeys, "history-max-keys", defaultHistoryMaxKeys, "keep the history of up to `n` keys, dropping the least recently changed, 0 is unbounded")
+	fs.DurationVar(&c.SweepInterval, "sweep-interval", time.Minute, "remove expired keys every `interval`")
+	fs.BoolVar(&c.SoftDelete, "soft-delete", false, "move keys deleted by DELETE /val/:key to the trash, where they can be restored")
+	fs.DurationVar(&c.TrashRetention, "trash-retention", 7*24*time.Hour, "remove keys from the trash once they were trashed for `duration`, 0 keeps them")
+	fs.DurationVar(&c.ProbeInterval, "probe-interval", 5*time.Second, "write, read and delete a probe key of a file or bolt store every `interval`, 0 disables probes")
+	fs.DurationVar(&c.ProbeThreshold, "probe-threshold", 15*time.Second, "reject mutations, and fail readiness, once store probes failed for `duration`")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", 30*time.Second, "maximum `duration` of draining requests on shutdown")
+	fs.StringVar(&c.WriteToken, "write-token", "", "require `token` as a bearer token of mutation requests, o/w mutations are open")
+	fs.StringVar(&c.Tokens, "tokens", "", "require tokens granting read or read-write access to namespaces, listed in a JSON or YAML `file`, reloaded on SIGHUP")
+	fs.BoolVar(&c.DisableLegacy, "disable-legacy", false, "serve the API only under /v1, o/w legacy unprefixed paths are also served")
+	fs.IntVar(&c.AuditSize, "audit-size", 0, "keep the last `n` mutations in the audit log, 0 disables the audit log unless audit-file is set")
+	fs.StringVar(&c.AuditFile, "audit-file", "", "append the audit log of mutations to a `file`, as JSON lines")
+	fs.IntVar(&c.Webhooks.Workers, "webhook-workers", defaultWebhookWorkers, "deliver changes to up to `n` webhooks at once, 0 disables webhooks")
+	fs.IntVar(&c.Webhooks.Queue, "webhook-queue", defaultWebhookQueue, "queue up to `n` changes for each webhook, later changes are dropped")
+	fs.IntVar(&c.Webhooks.Attempts, "webhook-attempts", defaultWebhookAttempts, "attempt to deliver a change to a webhook up to `n` times")
+	fs.DurationVar(&c.Webhooks.Backoff, "webhook-backoff", defaultWebhookBackoff, "wait `interval` after a failed webhook delivery, doubling after every attempt")
+	fs.DurationVar(&c.Webhooks.Timeout, "webhook-timeout", defaultWebhookTimeout, "timeout of webhook requests")
+	fs.Float64Var(&c.WriteRate, "write-rate", 0, "maximum `mutations` per second of each client IP, 0 is unlimited")
+	fs.IntVar(&c.WriteBurst, "write-burst", 10, "maximum burst of `mutations` of each client IP, when write-rate is set")
+	fs.BoolVar(&c.DebugFaults, "debug-faults", false, "serve /debug/faults, that injects latency, errors and dropped connections into API requests, for testing clients")
+	fs.StringVar(&trustedProxies, "trusted-proxies", "", "comma separated `addresses` and CIDR ranges of proxies trusted to forward the client IP")
+	fs.IntVar(&c.Limits.MaxKeyLength, "max-key-length", c.Limits.MaxKeyLength, "maximum key length in `bytes`, 0 is unlimited")
+	fs.StringVar(&keyPattern, "key-pattern", "", "`regexp` keys must match, control characters are always rejected")
+	fs.IntVar(&c.Limits.MaxValueBytes, "max-value-bytes", c.Limits.MaxValueBytes, "maximum value size in `bytes`, 0 is unlimited")
+	fs.IntVar(&c.Limits.MaxKeys, "max-keys", c.Limits.MaxKeys, "maximum number of `keys`, 0 is unlimited")
+	fs.Var((*listFlag)(&c.Schemas), "schema", "values of keys under a prefix must match a JSON schema file, as `prefix=file`, repeated or comma separated")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s, flags override KITTY_ environment variables, e.g. KITTY_ADDR:\n", fs.Name())
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// Set flags missing from the command line using environment variables.
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		s, ok := lookupEnv(envName(f.Name))
+		if set[f.Name] || !ok || err != nil {
+			return
+		}
+		if e := fs.Set(f.Name, s); e != nil {
+			err = fmt.Errorf("invalid %s %q: %v", envName(f.Name), s, e)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.flags = fs
+
+	if trustedProxies != "" {
+		c.TrustedProxies = strings.Split(trustedProxies, ",")
+	}
+	if err := c.parse(logFormat, evictionPolicy, keyPattern); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// parse parses and checks the values that are not plain flags.
+func (c *config) parse(logFormat, evictionPolicy, keyPattern string) error {
+	var err error
+	if c.LogFormat, err = parseLogFormat(logFormat); err != nil {
+		return err
+	}
+	if c.EvictionPolicy, err = parseEvictionPolicy(evictionPolicy); err != nil {
+		return err
+	}
+	if keyPattern != "" {
+		if c.Limits.KeyPattern, err = regexp.Compile(keyPattern); err != nil {
+			return fmt.Errorf("invalid key-pattern %q: %v", keyPattern, err)
+		}
+	}
+	if err := c.Limits.validate(); err != nil {
+		return err
+	}
+
+	if c.Port < 0 || c.Port > 65535 {
+		return fmt.Errorf("invalid port %d", c.Port)
+	}
+	if c.Port != 0 {
+		host, _, err := net.SplitHostPort(c.Addr)
+		if err != nil {
+			return fmt.Errorf("invalid addr %q: %v", c.Addr, err)
+		}
+		c.Addr = net.JoinHostPort(host, strconv.Itoa(c.Port))
+	}
+
+	for name, d := range map[string]time.Duration{
+		"read-timeout":      c.ReadTimeout,
+		"write-timeout":     c.WriteTimeout,
+		"idle-timeout":      c.IdleTimeout,
+		"snapshot-interval": c.SnapshotInterval,
+		"sweep-interval":    c.SweepInterval,
+		"trash-retention":   c.TrashRetention,
+		"probe-interval":    c.ProbeInterval,
+		"probe-threshold":   c.ProbeThreshold,
+		"webhook-backoff":   c.Webhooks.Backoff,
+		"webhook-timeout":   c.Webhooks.Timeout,
+		"shutdown-timeout":  c.ShutdownTimeout,
+	} {
+		if d < 0 {
+			return fmt.Errorf("invalid %s %v, durations can't be negative", name, d)
+		}
+	}
+	for name, n := range map[string]int64{
+		"max-header-bytes":  int64(c.MaxHeaderBytes),
+		"max-body-bytes":    c.MaxBodyBytes,
+		"memory-max-keys":   int64(c.MemoryMaxKeys),
+		"memory-shards":     int64(c.MemoryShards),
+		"webhook-workers":   int64(c.Webhooks.Workers),
+		"webhook-queue":     int64(c.Webhooks.Queue),
+		"webhook-attempts":  int64(c.Webhooks.Attempts),
+		"wal-compact-bytes": c.WAL.CompactBytes,
+		"history":           int64(c.History),
+		"history-max-keys":  int64(c.HistoryMaxKeys),
+		"audit-size":        int64(c.AuditSize),
+		"write-burst":       int64(c.WriteBurst),
+	} {
+		if n < 0 {
+			return fmt.Errorf("invalid %s %d, sizes can't be negative", name, n)
+		}
+	}
+	if c.Webhooks.Workers > 0 && (c.Webhooks.Queue == 0 || c.Webhooks.Attempts == 0) {
+		return fmt.Errorf("webhook-queue and webhook-attempts must be positive when webhooks are enabled")
+	}
+	if c.WriteRate < 0 {
+		return fmt.Errorf("invalid write-rate %v, rates can't be negative", c.WriteRate)
+	}
+	for _, proxy := range c.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			return fmt.Errorf("invalid trusted-proxies %q, want addresses and CIDR ranges", proxy)
+		}
+	}
+
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return fmt.Errorf("tls-cert and tls-key must be used together")
+	}
+	if c.TLSCert == "" && (c.TLSClientCA != "" || c.TLSAddr != "") {
+		return fmt.Errorf("tls-client-ca and tls-addr require tls-cert and tls-key")
+	}
+
+	if c.File != "" && c.Bolt != "" {
+		return fmt.Errorf("file and bolt can't be used together, use one store")
+	}
+
+	// A bounded store has a single lock, its bound and recency are of the
+	// whole store, so it can't be sharded.
+	shardsSet := false
+	c.flags.Visit(func(f *flag.Flag) { shardsSet = shardsSet || f.Name == "memory-shards" })
+	if c.MemoryMaxKeys > 0 && shardsSet && c.MemoryShards != 1 {
+		return fmt.Errorf("memory-max-keys and memory-shards can't be used together, bounded stores are not sharded")
+	}
+	if c.WAL.Enabled && c.File == "" {
+		return fmt.Errorf("wal requires file")
+	}
+	if c.SeedOverwrite && c.Seed == "" {
+		return fmt.Errorf("seed-overwrite requires seed")
+	}
+
+	prefixes := make(map[string]bool, len(c.Schemas))
+	for _, spec := range c.Schemas {
+		prefix, file, ok := strings.Cut(spec, "=")
+		if !ok || file == "" {
+			return fmt.Errorf("invalid schema %q, want prefix=file", spec)
+		}
+		if prefixes[prefix] {
+			return fmt.Errorf("invalid schema %q, prefix %q has more than one schema", spec, prefix)
+		}
+		prefixes[prefix] = true
+	}
+
+	return nil
+}
+
+// listFlag is a flag that can be repeated, each value may be a comma
+// separated list, e.g. in an environment variable.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	if l == nil {
+		return ""
+	}
+
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, strings.Split(s, ",")...)
+
+	return nil
+}
+
+// secretFlags are flags with values that are never printed.
+var secretFlags = map[string]bool{"write-token": true}
+
+// String returns the flags and their values, e.g. "addr=:8080 bolt=",
+// secret values are redacted.
+func (c *config) String() string {
+	var values []string
+	c.flags.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if secretFlags[f.Name] && value != "" {
+			value = "REDACTED"
+		}
+		values = append(values, fmt.Sprintf("%s=%s", f.Name, value))
+	})
+
+	return strings.Join(values, " ")
+}
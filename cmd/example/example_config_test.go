@@ -0,0 +1,127 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yaacov/gokitty/pkg/middleware"
+)
+
+// env returns a lookupEnv function using a map of environment variables.
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		s, ok := vars[name]
+		return s, ok
+	}
+}
+
+// quietConfig parses a config without writing usage on errors.
+func quietConfig(args []string, vars map[string]string) (*config, error) {
+	return parseConfigOutput(args, env(vars), io.Discard)
+}
+
+func TestConfigDefaults(t *testing.T) {
+	c, err := quietConfig(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Check the defaults are what we expect.
+	if c.Addr != ":8080" || c.ReadTimeout != 10*time.Second || c.LogFormat != middleware.TextFormat ||
+		c.EvictionPolicy != EvictLRU || c.Limits.MaxKeys != defaultMaxKeys || c.Limits.KeyPattern != nil {
+		t.Errorf("parseConfig: got %+v", c)
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	vars := map[string]string{
+		"KITTY_ADDR":           "127.0.0.1:9090",
+		"KITTY_READ_TIMEOUT":   "5s",
+		"KITTY_LOG_FORMAT":     "json",
+		"KITTY_MAX_KEY_LENGTH": "10",
+		"KITTY_KEY_PATTERN":    "^[a-z]+$",
+		"KITTY_MAX_KEYS":       "0",
+	}
+	c, err := quietConfig([]string{"-read-timeout", "1s", "-max-keys", "5", "-port", "7070"}, vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Check flags override environment variables, that override defaults.
+	if c.ReadTimeout != time.Second || c.Limits.MaxKeys != 5 {
+		t.Errorf("parseConfig: flags did not override the environment: got %+v", c)
+	}
+	if c.LogFormat != middleware.JSONFormat || c.Limits.MaxKeyLength != 10 ||
+		c.Limits.KeyPattern.String() != "^[a-z]+$" {
+		t.Errorf("parseConfig: environment did not override defaults: got %+v", c)
+	}
+	if c.WriteTimeout != 10*time.Second || c.Limits.MaxValueBytes != defaultMaxValueBytes {
+		t.Errorf("parseConfig: got %+v want default timeouts and sizes", c)
+	}
+	if c.Addr != "127.0.0.1:7070" {
+		t.Errorf("parseConfig: got addr %v want 127.0.0.1:7070", c.Addr)
+	}
+
+	// Check the config is printed with the values in use.
+	if s := c.String(); !strings.Contains(s, "read-timeout=1s") || !strings.Contains(s, "log-format=json") {
+		t.Errorf("String: got %v", s)
+	}
+}
+
+func TestConfigInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		vars map[string]string
+	}{
+		{"invalid env", nil, map[string]string{"KITTY_MAX_VALUE_BYTES": "1MB"}},
+		{"invalid env duration", nil, map[string]string{"KITTY_IDLE_TIMEOUT": "forever"}},
+		{"invalid flag", []string{"-max-keys", "many"}, nil},
+		{"unknown flag", []string{"-kitty"}, nil},
+		{"negative limit", []string{"-max-keys", "-1"}, nil},
+		{"negative timeout", nil, map[string]string{"KITTY_WRITE_TIMEOUT": "-1s"}},
+		{"negative body size", []string{"-max-body-bytes", "-1"}, nil},
+		{"invalid port", []string{"-port", "70000"}, nil},
+		{"invalid log format", []string{"-log-format", "xml"}, nil},
+		{"invalid eviction policy", nil, map[string]string{"KITTY_EVICTION_POLICY": "random"}},
+		{"invalid key pattern", []string{"-key-pattern", "["}, nil},
+		{"two stores", []string{"-file", "kitty.json", "-bolt", "kitty.db"}, nil},
+		{"negative write rate", []string{"-write-rate", "-1"}, nil},
+		{"negative audit size", nil, map[string]string{"KITTY_AUDIT_SIZE": "-1"}},
+		{"negative probe threshold", []string{"-probe-threshold", "-1s"}, nil},
+		{"invalid trusted proxy", []string{"-trusted-proxies", "10.0.0.0/8,lb"}, nil},
+		{"seed overwrite without seed", []string{"-seed-overwrite"}, nil},
+		{"negative trash retention", []string{"-trash-retention", "-1h"}, nil},
+		{"schema without a file", []string{"-schema", "features/"}, nil},
+		{"two schemas of a prefix", nil, map[string]string{"KITTY_SCHEMA": "a/=a.json,a/=b.json"}},
+		{"negative memory shards", []string{"-memory-shards", "-1"}, nil},
+		{"sharded bounded store", []string{"-memory-max-keys", "10", "-memory-shards", "4"}, nil},
+		{"sharded bounded store env", []string{"-memory-max-keys", "10"}, map[string]string{"KITTY_MEMORY_SHARDS": "4"}},
+		{"negative webhook workers", []string{"-webhook-workers", "-1"}, nil},
+		{"webhooks without attempts", nil, map[string]string{"KITTY_WEBHOOK_ATTEMPTS": "0"}},
+	}
+
+	// Check invalid values fail, even when they are overridden.
+	for _, tt := range tests {
+		if _, err := quietConfig(tt.args, tt.vars); err == nil {
+			t.Errorf("%s: parseConfig got no error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// revisionHeader holds the store revision of an export.
+const revisionHeader = "X-Kitty-Revision"
+
+// exportAttempts is the number of times an export reads the values, until
+// they did not change while they were read.
+const exportAttempts = 5
+
+// exportWithTrash is an export with the trashed keys.
+type exportWithTrash struct {
+	Values map[string]json.RawMessage `json:"values"`
+	Trash  []TrashedKey               `json:"trash"`
+}
+
+// getExport handles GET "/export" requests, writing all the key value pairs
+// as one JSON object, in key order, with the store revision they were read
+// at in the X-Kitty-Revision header, and in the ETag.
+//
+// With "include_trash=true", the export is a JSON object, with the key
+// value pairs in its "values" member, and the trashed keys in its "trash"
+// member.
+//
+// Exports of a revision are the same bytes, so single range requests, e.g.
+// "Range: bytes=1024-", resume interrupted downloads, clients resuming with
+// an "If-Range" header of the ETag get the whole export if the revision
+// changed.
+func (h Handler) getExport(w http.ResponseWriter, r *http.Request) {
+	includeTrash := false
+	if s := r.URL.Query().Get("include_trash"); s != "" {
+		var err error
+		if includeTrash, err = strconv.ParseBool(s); err != nil {
+			writeErr(w, http.StatusBadRequest, "include_trash must be true or false")
+			return
+		}
+	}
+
+	for range exportAttempts {
+		rev, err := h.store.Revision()
+		if err != nil {
+			writeStoreErr(w, err)
+			return
+		}
+		vals, err := h.store.List()
+		if err != nil {
+			writeStoreErr(w, err)
+			return
+		}
+		var export interface{} = vals
+		etag := revisionETag(rev)
+		if includeTrash {
+			trashed, err := h.store.ListTrash("")
+			if err != nil {
+				writeStoreErr(w, err)
+				return
+			}
+			export = exportWithTrash{Values: vals, Trash: trashed}
+			etag = fmt.Sprintf("\"rev-%d-trash\"", rev)
+		}
+
+		// Values that changed while they were read are not the values of
+		// a revision.
+		after, err := h.store.Revision()
+		if err != nil {
+			writeStoreErr(w, err)
+			return
+		}
+		if after != rev {
+			continue
+		}
+
+		data, err := json.Marshal(export)
+		if err != nil {
+			writeErr(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", jsonContentType)
+		w.Header().Set("ETag", etag)
+		w.Header().Set(revisionHeader, strconv.FormatUint(rev, 10))
+		serveContent(w, r, time.Time{}, bytes.NewReader(data))
+		return
+	}
+
+	w.Header().Set("Retry-After", "1")
+	writeErr(w, http.StatusServiceUnavailable, "values changed while they were exported, retry later")
+}
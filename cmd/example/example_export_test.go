@@ -0,0 +1,164 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// serveRange serves a GET request, of an optional byte range, with an
+// optional If-Range header, using handler.
+func serveRange(handler http.Handler, path, byteRange, ifRange string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", path, nil)
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+	}
+	if ifRange != "" {
+		req.Header.Set("If-Range", ifRange)
+	}
+
+	return serveRequest(handler, req)
+}
+
+// testRanges checks a resource fetched in two ranged requests is the
+// resource fetched in one request, and returns the resource.
+func testRanges(t *testing.T, handler http.Handler, path string) []byte {
+	t.Helper()
+
+	full := serveRange(handler, path, "", "")
+	if full.Code != http.StatusOK {
+		t.Fatalf("%s: wrong status code: got %v want %v", path, full.Code, http.StatusOK)
+	}
+	data := full.Body.Bytes()
+	if full.Header().Get("Accept-Ranges") != "bytes" {
+		t.Errorf("%s: missing Accept-Ranges header", path)
+	}
+
+	mid := len(data) / 3
+	var parts []byte
+	for _, tt := range []struct {
+		byteRange    string
+		contentRange string
+	}{
+		{fmt.Sprintf("bytes=0-%d", mid-1), fmt.Sprintf("bytes 0-%d/%d", mid-1, len(data))},
+		{fmt.Sprintf("bytes=%d-", mid), fmt.Sprintf("bytes %d-%d/%d", mid, len(data)-1, len(data))},
+	} {
+		rr := serveRange(handler, path, tt.byteRange, "")
+
+		// Check the part is what we expect.
+		if rr.Code != http.StatusPartialContent {
+			t.Errorf("%s %s: wrong status code: got %v want %v", path, tt.byteRange, rr.Code, http.StatusPartialContent)
+		}
+		if cr := rr.Header().Get("Content-Range"); cr != tt.contentRange {
+			t.Errorf("%s %s: wrong Content-Range: got %s want %s", path, tt.byteRange, cr, tt.contentRange)
+		}
+		parts = append(parts, rr.Body.Bytes()...)
+	}
+	if !bytes.Equal(parts, data) {
+		t.Errorf("%s: ranges differ from the whole resource", path)
+	}
+
+	// Check unsatisfiable ranges fail.
+	rr := serveRange(handler, path, fmt.Sprintf("bytes=%d-", len(data)), "")
+	if rr.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("%s: wrong status code: got %v want %v", path, rr.Code, http.StatusRequestedRangeNotSatisfiable)
+	}
+	if cr := rr.Header().Get("Content-Range"); cr != fmt.Sprintf("bytes */%d", len(data)) {
+		t.Errorf("%s: wrong Content-Range: got %s", path, cr)
+	}
+
+	return data
+}
+
+func TestExportRanges(t *testing.T) {
+	h := newHandler(newMemoryStore())
+	handler := newHandlerRouter(h)
+	serve(t, handler, "POST", "/v1/val", "{\"kitty\": \"cat\", \"tom\": {\"lives\": 9}, \"a<b\": [1, 2, 3]}", "")
+	serve(t, handler, "PUT", "/v1/ns/cats/val/kitty", "\"tiger\"", "")
+
+	data := testRanges(t, handler, "/v1/export")
+	if string(data) != "{\"a\\u003cb\":[1,2,3],\"kitty\":\"cat\",\"tom\":{\"lives\":9}}" {
+		t.Errorf("unexpected export: %s", data)
+	}
+
+	// Check the revision of the export is reported.
+	rr := serveRange(handler, "/v1/export", "", "")
+	rev, _ := h.store.Revision()
+	etag := rr.Header().Get("ETag")
+	if rr.Header().Get(revisionHeader) != strconv.FormatUint(rev, 10) || etag != revisionETag(rev) {
+		t.Errorf("wrong revision: got %s, %s want %d", rr.Header().Get(revisionHeader), etag, rev)
+	}
+	if data := testRanges(t, handler, "/v1/ns/cats/export"); string(data) != "{\"kitty\":\"tiger\"}" {
+		t.Errorf("unexpected namespace export: %s", data)
+	}
+
+	// Check resuming after a change, with the ETag of the previous
+	// revision, gets the whole export.
+	serve(t, handler, "DELETE", "/v1/val/tom", "", "")
+	rr = serveRange(handler, "/v1/export", "bytes=10-", etag)
+	if rr.Code != http.StatusOK || rr.Header().Get("ETag") == etag {
+		t.Errorf("resume after a change: got %v, %s want %v, a new revision", rr.Code, rr.Header().Get("ETag"), http.StatusOK)
+	}
+	if rr := serveRange(handler, "/v1/export", "bytes=10-", rr.Header().Get("ETag")); rr.Code != http.StatusPartialContent {
+		t.Errorf("resume: wrong status code: got %v want %v", rr.Code, http.StatusPartialContent)
+	}
+}
+
+// changingStore is a store that changes while its values are read.
+type changingStore struct {
+	Store
+	rev uint64
+}
+
+func (s *changingStore) Revision() (uint64, error) {
+	return atomic.AddUint64(&s.rev, 1), nil
+}
+
+func TestExportChanging(t *testing.T) {
+	handler := newStoreRouter(&changingStore{Store: newMemoryStore()})
+
+	// Check exports of values that keep changing fail.
+	rr := serve(t, handler, "GET", "/v1/export", "", "")
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") != "1" {
+		t.Errorf("wrong status code: got %v, %q want %v", rr.Code, rr.Header().Get("Retry-After"), http.StatusServiceUnavailable)
+	}
+}
+
+func TestRawRanges(t *testing.T) {
+	handler := newRouter()
+
+	data := make([]byte, 10000)
+	rand.New(rand.NewSource(2)).Read(data)
+	req, _ := http.NewRequest("PUT", "/v1/raw/blob", bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/pdf")
+	serveRequest(handler, req)
+
+	// Check ranges of raw values have their content type.
+	if got := testRanges(t, handler, "/v1/raw/blob"); !bytes.Equal(got, data) {
+		t.Errorf("raw value differs from the stored bytes")
+	}
+	rr := serveRange(handler, "/v1/raw/blob", "bytes=100-199", "")
+	if rr.Header().Get("Content-Type") != "application/pdf" || rr.Header().Get("Content-Length") != strconv.Itoa(100) {
+		t.Errorf("unexpected headers: %v", rr.Header())
+	}
+}
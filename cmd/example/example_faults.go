@@ -0,0 +1,200 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Fault is a fault injected into the requests of API routes, e.g. to test
+// clients against a slow or failing server.
+//
+// Requests matching Method and Route, empty matches any method or route,
+// are delayed by Latency, and a random duration up to Jitter, then
+// ErrorPercent percent of them get a 500 response, and DropPercent percent
+// of them have their connection dropped.
+type Fault struct {
+	// Method and route template, relative to the API version, e.g.
+	// "/val/:key", of the faulty requests.
+	Method string `json:"method,omitempty"`
+	Route  string `json:"route,omitempty"`
+
+	// Fixed and random latency, e.g. "100ms".
+	Latency faultDuration `json:"latency,omitempty"`
+	Jitter  faultDuration `json:"jitter,omitempty"`
+
+	// Percentages of requests failing with a 500 response, and of requests
+	// having their connection dropped.
+	ErrorPercent float64 `json:"error_percent,omitempty"`
+	DropPercent  float64 `json:"drop_percent,omitempty"`
+}
+
+// faultDuration is a duration, written in JSON as a string, e.g. "1.5s".
+type faultDuration time.Duration
+
+func (d faultDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *faultDuration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("durations must be strings, e.g. \"100ms\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = faultDuration(v)
+	return nil
+}
+
+// validate checks a fault is valid.
+func (f Fault) validate() error {
+	switch {
+	case f.Route != "" && !strings.HasPrefix(f.Route, "/"):
+		return fmt.Errorf("route %q must start with /", f.Route)
+	case f.Latency < 0 || f.Jitter < 0:
+		return fmt.Errorf("latency and jitter can't be negative")
+	case f.ErrorPercent < 0 || f.ErrorPercent > 100 || f.DropPercent < 0 || f.DropPercent > 100:
+		return fmt.Errorf("error_percent and drop_percent must be between 0 and 100")
+	}
+	return nil
+}
+
+// matches returns true if the fault applies to requests of a route.
+func (f Fault) matches(method, route string) bool {
+	return (f.Method == "" || strings.EqualFold(f.Method, method)) && (f.Route == "" || f.Route == route)
+}
+
+// faultInjector injects faults into requests, its faults are swapped
+// atomically, so they can change while requests are served.
+type faultInjector struct {
+	faults atomic.Pointer[[]Fault]
+
+	// Returns a random number in [0, 100).
+	percent func() float64
+}
+
+func newFaultInjector() *faultInjector {
+	return &faultInjector{
+		percent: func() float64 { return rand.Float64() * 100 },
+	}
+}
+
+// set replaces the faults, an empty list injects no faults.
+func (fi *faultInjector) set(faults []Fault) {
+	if faults == nil {
+		faults = []Fault{}
+	}
+	fi.faults.Store(&faults)
+}
+
+// get returns the faults.
+func (fi *faultInjector) get() []Fault {
+	if faults := fi.faults.Load(); faults != nil {
+		return *faults
+	}
+	return []Fault{}
+}
+
+// inject returns a handler injecting the first fault matching the method
+// and route template of handle, if any, into its requests.
+func (fi *faultInjector) inject(method, route string, handle func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var fault *Fault
+		for _, f := range fi.get() {
+			if f.matches(method, route) {
+				fault = &f
+				break
+			}
+		}
+		if fault == nil {
+			handle(w, r)
+			return
+		}
+
+		delay := time.Duration(fault.Latency)
+		if fault.Jitter > 0 {
+			delay += time.Duration(fi.percent() / 100 * float64(fault.Jitter))
+		}
+		if delay > 0 {
+			t := time.NewTimer(delay)
+			select {
+			case <-t.C:
+			case <-r.Context().Done():
+				t.Stop()
+				return
+			}
+		}
+
+		// The server closes the connection of aborted handlers.
+		if fault.DropPercent > 0 && fi.percent() < fault.DropPercent {
+			panic(http.ErrAbortHandler)
+		}
+		if fault.ErrorPercent > 0 && fi.percent() < fault.ErrorPercent {
+			writeErrCode(w, http.StatusInternalServerError, errCodeInjectedFault, "injected fault")
+			return
+		}
+		handle(w, r)
+	}
+}
+
+// faultList is the body of GET and PUT "/debug/faults" requests.
+type faultList struct {
+	Faults []Fault `json:"faults"`
+}
+
+// getFaults handles GET "/debug/faults" requests, writing the injected
+// faults.
+func (h Handler) getFaults(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, faultList{Faults: h.faults.get()})
+}
+
+// putFaults handles PUT "/debug/faults" requests, replacing the injected
+// faults, e.g. {"faults": [{"method": "PUT", "route": "/val/:key",
+// "error_percent": 100}]}.
+func (h Handler) putFaults(w http.ResponseWriter, r *http.Request) {
+	var l faultList
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&l); err != nil {
+		writeErrCode(w, http.StatusBadRequest, errCodeBadJSON, err.Error())
+		return
+	}
+	for i, f := range l.Faults {
+		if err := f.validate(); err != nil {
+			writeErr(w, http.StatusBadRequest, fmt.Sprintf("fault %d: %v", i, err))
+			return
+		}
+	}
+	h.faults.set(l.Faults)
+	writeJSON(w, faultList{Faults: h.faults.get()})
+}
+
+// deleteFaults handles DELETE "/debug/faults" requests, removing the
+// injected faults.
+func (h Handler) deleteFaults(w http.ResponseWriter, r *http.Request) {
+	h.faults.set(nil)
+	w.WriteHeader(http.StatusNoContent)
+}
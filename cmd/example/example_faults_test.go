@@ -0,0 +1,181 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFaults(t *testing.T) {
+	h := newHandler(newMemoryStore())
+	h.faults = newFaultInjector()
+	handler := newHandlerRouter(h)
+	serve(t, handler, "PUT", "/v1/val/kitty", "\"cat\"", "")
+
+	type request struct {
+		method string
+		path   string
+		body   string
+		status int
+	}
+	tests := []struct {
+		name     string
+		faults   []Fault
+		requests []request
+	}{
+		{
+			"errors of PUT /val/:key",
+			[]Fault{{Method: "PUT", Route: "/val/:key", ErrorPercent: 100}},
+			[]request{
+				{"PUT", "/v1/val/kitty", "\"tiger\"", http.StatusInternalServerError},
+				{"PUT", "/val/kitty", "\"tiger\"", http.StatusInternalServerError},
+				{"GET", "/v1/val/kitty", "", http.StatusOK},
+				{"POST", "/v1/val", "{\"tom\": 1}", http.StatusCreated},
+			},
+		},
+		{
+			"errors of any method",
+			[]Fault{{Route: "/val/:key", ErrorPercent: 100}},
+			[]request{
+				{"GET", "/v1/val/kitty", "", http.StatusInternalServerError},
+				{"GET", "/v1/val", "", http.StatusOK},
+			},
+		},
+		{
+			"no errors",
+			[]Fault{{Method: "PUT", Route: "/val/:key", ErrorPercent: 0}},
+			[]request{
+				{"PUT", "/v1/val/kitty", "\"tiger\"", http.StatusOK},
+			},
+		},
+		{
+			"first matching fault",
+			[]Fault{{Method: "GET", Latency: faultDuration(time.Millisecond)}, {ErrorPercent: 100}},
+			[]request{
+				{"GET", "/v1/val/kitty", "", http.StatusOK},
+				{"DELETE", "/v1/val/kitty", "", http.StatusInternalServerError},
+			},
+		},
+		{
+			"removed faults",
+			nil,
+			[]request{
+				{"DELETE", "/v1/val/kitty", "", http.StatusOK},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		// Faults change without restarting the server.
+		h.faults.set(tt.faults)
+
+		for _, req := range tt.requests {
+			rr := serve(t, handler, req.method, req.path, req.body, "")
+
+			// Check the status is what we expect.
+			if rr.Code != req.status {
+				t.Errorf("%s: %s %s: wrong status code: got %v want %v", tt.name, req.method, req.path, rr.Code, req.status)
+			}
+			if rr.Code == http.StatusInternalServerError && rr.Body.String() != "{\"error\":{\"code\":\"injected_fault\",\"message\":\"injected fault\"}}" {
+				t.Errorf("%s: %s %s: unexpected body: %s", tt.name, req.method, req.path, rr.Body.String())
+			}
+		}
+	}
+}
+
+func TestFaultsLatency(t *testing.T) {
+	h := newHandler(newMemoryStore())
+	h.faults = newFaultInjector()
+	h.faults.percent = func() float64 { return 50 }
+	h.faults.set([]Fault{{Route: "/val", Latency: faultDuration(20 * time.Millisecond), Jitter: faultDuration(20 * time.Millisecond)}})
+	handler := newHandlerRouter(h)
+
+	// Check requests are delayed by the latency, and half the jitter.
+	start := time.Now()
+	if rr := serve(t, handler, "GET", "/v1/val", "", ""); rr.Code != http.StatusOK {
+		t.Errorf("wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if d := time.Since(start); d < 30*time.Millisecond {
+		t.Errorf("request was not delayed: got %v want at least 30ms", d)
+	}
+}
+
+func TestFaultsDrop(t *testing.T) {
+	h := newHandler(newMemoryStore())
+	h.faults = newFaultInjector()
+	h.faults.set([]Fault{{Method: "GET", DropPercent: 100}})
+	server := httptest.NewServer(newHandlerRouter(h))
+	defer server.Close()
+
+	// Check the connection is dropped without a response.
+	resp, err := http.Get(server.URL + "/v1/val")
+	if err == nil {
+		resp.Body.Close()
+		t.Fatalf("expected a dropped connection, got %v", resp.Status)
+	}
+}
+
+func TestFaultsRoutes(t *testing.T) {
+	h := newHandler(newMemoryStore())
+	h.faults = newFaultInjector()
+	h.writeToken = "s3cret"
+	handler := newHandlerRouter(h)
+
+	tests := []struct {
+		name          string
+		method        string
+		body          string
+		authorization string
+		status        int
+		expected      string
+	}{
+		{"no faults", "GET", "", "", http.StatusOK, "{\"faults\":[]}"},
+		{"unauthorized", "PUT", "{\"faults\": []}", "", http.StatusUnauthorized, ""},
+		{"bad json", "PUT", "{\"faults\": [{\"latency\": 5}]}", "Bearer s3cret", http.StatusBadRequest, ""},
+		{"bad duration", "PUT", "{\"faults\": [{\"latency\": \"5 minutes\"}]}", "Bearer s3cret", http.StatusBadRequest, ""},
+		{"bad route", "PUT", "{\"faults\": [{\"route\": \"val\"}]}", "Bearer s3cret", http.StatusBadRequest,
+			"{\"error\":{\"code\":\"bad_request\",\"message\":\"fault 0: route \\\"val\\\" must start with /\"}}"},
+		{"bad percent", "PUT", "{\"faults\": [{\"error_percent\": 101}]}", "Bearer s3cret", http.StatusBadRequest,
+			"{\"error\":{\"code\":\"bad_request\",\"message\":\"fault 0: error_percent and drop_percent must be between 0 and 100\"}}"},
+		{"set", "PUT", "{\"faults\": [{\"method\": \"PUT\", \"route\": \"/val/:key\", \"latency\": \"1.5s\", \"error_percent\": 10}]}", "Bearer s3cret", http.StatusOK,
+			"{\"faults\":[{\"method\":\"PUT\",\"route\":\"/val/:key\",\"latency\":\"1.5s\",\"error_percent\":10}]}"},
+		{"get", "GET", "", "", http.StatusOK,
+			"{\"faults\":[{\"method\":\"PUT\",\"route\":\"/val/:key\",\"latency\":\"1.5s\",\"error_percent\":10}]}"},
+		{"delete", "DELETE", "", "Bearer s3cret", http.StatusNoContent, ""},
+		{"deleted", "GET", "", "", http.StatusOK, "{\"faults\":[]}"},
+	}
+
+	for _, tt := range tests {
+		rr := serveAuth(t, handler, tt.method, "/debug/faults", tt.body, tt.authorization)
+
+		// Check the status and the body are what we expect.
+		if rr.Code != tt.status {
+			t.Errorf("%s: wrong status code: got %v want %v", tt.name, rr.Code, tt.status)
+		}
+		if tt.expected != "" && strings.TrimSpace(rr.Body.String()) != tt.expected {
+			t.Errorf("%s: unexpected body: got %s want %s", tt.name, rr.Body.String(), tt.expected)
+		}
+	}
+
+	// Check the routes are not served unless faults are enabled.
+	if rr := serve(t, newRouter(), "GET", "/debug/faults", "", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
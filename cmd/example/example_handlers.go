@@ -17,36 +17,273 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
+	"math"
 	"net/http"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/yaacov/gokitty/pkg/middleware"
 	"github.com/yaacov/gokitty/pkg/mux"
 )
 
 // Handler handle http requests.
 type Handler struct {
-	store *Store
+	store Store
+
+	// The namespace of store, empty for the default namespace.
+	namespace string
+
+	// The store of all the namespaces.
+	root Store
+
+	// Broadcasts changes to watchers.
+	hub *hub
+
+	// Delivers changes to webhooks, nil if disabled.
+	webhooks *webhookDispatcher
+
+	// Bounds the keys and values.
+	limits Limits
+
+	// Schemas of the values of key prefixes, nil if none.
+	schemas *schemaRegistry
+
+	// Drains in-flight requests on shutdown.
+	drainer *middleware.Drainer
+
+	// Start time of the handler, for the uptime.
+	started time.Time
+
+	// Bearer token of mutation requests, if empty mutations are open.
+	writeToken string
+
+	// Tokens granting access to namespaces, nil if disabled.
+	tokens *tokenFile
+
+	// Serve the API only under /v1, without the legacy unprefixed paths.
+	disableLegacy bool
+
+	// Move deleted keys to the trash, and serve the trash routes.
+	softDelete bool
+
+	// Starts a span of every request.
+	tracer Tracer
+
+	// Records mutations, and limits their rate for each client IP, nil if
+	// disabled.
+	audit      *auditLog
+	writeLimit func(http.Handler) http.Handler
+
+	// Probes the health of the store, nil if disabled.
+	prober *storeProber
+
+	// Injects faults into API requests, nil if disabled.
+	faults *faultInjector
 }
 
-func newHandler() *Handler {
+func newHandler(store Store) *Handler {
+	counted := newCountingStore(store)
 	h := Handler{
-		store: newStore(),
+		store:   newDefaultNamespaceStore(counted),
+		root:    counted,
+		hub:     newHub(defaultWatchHistory),
+		limits:  defaultLimits(),
+		drainer: middleware.Drain(),
+		started: time.Now(),
+		tracer:  nopTracer{},
+	}
+
+	// Watchers of bounded stores see keys evicted to make room.
+	if s, ok := store.(*MemoryStore); ok {
+		s.OnEvict(func(k string) {
+			namespace, key := splitNamespaceKey(k)
+			h.hub.publish(namespace, eventEvicted, key, nil)
+		})
 	}
 
 	return &h
 }
 
-// Write an error.
+// jsonContentType is the Content-Type of JSON responses.
+const jsonContentType = "application/json"
+
+// Machine-readable error codes, clients can check the code of an error
+// instead of its message.
+const (
+	// Errors of requests.
+	errCodeBadRequest          = "bad_request"
+	errCodeBadJSON             = "bad_json"
+	errCodeBadYAML             = "bad_yaml"
+	errCodeTooLarge            = "too_large"
+	errCodeSchemaViolation     = "schema_violation"
+	errCodeNotFound            = "not_found"
+	errCodeMethodNotAllowed    = "method_not_allowed"
+	errCodeRangeNotSatisfiable = "range_not_satisfiable"
+	errCodePreconditionFailed  = "precondition_failed"
+
+	// Errors of keys and values.
+	errCodeKeyNotFound       = "key_not_found"
+	errCodeFieldNotFound     = "field_not_found"
+	errCodeKeyExists         = "key_exists"
+	errCodeRawValue          = "raw_value"
+	errCodeConflict          = "conflict"
+	errCodeCheckFailed       = "check_failed"
+	errCodeRevisionCompacted = "revision_compacted"
+	errCodeStoreFull         = "store_full"
+	errCodeStoreUnavailable  = "store_unavailable"
+
+	// Errors of access.
+	errCodeUnauthorized = "unauthorized"
+	errCodeForbidden    = "forbidden"
+	errCodeRateLimited  = "rate_limited"
+
+	// Errors of the server.
+	errCodeInternal      = "internal"
+	errCodeUnavailable   = "unavailable"
+	errCodeInjectedFault = "injected_fault"
+)
+
+// statusErrCodes are the error codes of errors written without a code, by
+// their status code.
+var statusErrCodes = map[int]string{
+	http.StatusBadRequest:                   errCodeBadRequest,
+	http.StatusUnauthorized:                 errCodeUnauthorized,
+	http.StatusForbidden:                    errCodeForbidden,
+	http.StatusNotFound:                     errCodeNotFound,
+	http.StatusMethodNotAllowed:             errCodeMethodNotAllowed,
+	http.StatusConflict:                     errCodeConflict,
+	http.StatusPreconditionFailed:           errCodePreconditionFailed,
+	http.StatusRequestEntityTooLarge:        errCodeTooLarge,
+	http.StatusRequestURITooLong:            errCodeTooLarge,
+	http.StatusRequestedRangeNotSatisfiable: errCodeRangeNotSatisfiable,
+	http.StatusTooManyRequests:              errCodeRateLimited,
+	http.StatusServiceUnavailable:           errCodeUnavailable,
+	http.StatusInsufficientStorage:          errCodeStoreFull,
+}
+
+// statusErrCode returns the error code of a status code.
+func statusErrCode(code int) string {
+	if errCode, ok := statusErrCodes[code]; ok {
+		return errCode
+	}
+	if code < http.StatusInternalServerError {
+		return errCodeBadRequest
+	}
+
+	return errCodeInternal
+}
+
+// apiError is the body of error responses, e.g.
+// {"error":{"code":"key_not_found","message":"can't find key kitty"}}.
+type apiError struct {
+	Error apiErrorBody `json:"error"`
+}
+
+// apiErrorBody is an error, its machine-readable code, its message, and
+// optional details, e.g. the current value of a key.
+type apiErrorBody struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// Write an error, with the error code of its status code.
 func writeErr(w http.ResponseWriter, code int, message string) {
+	writeErrDetails(w, code, statusErrCode(code), message, nil)
+}
+
+// Write an error with a machine-readable error code.
+func writeErrCode(w http.ResponseWriter, code int, errCode, message string) {
+	writeErrDetails(w, code, errCode, message, nil)
+}
+
+// Write an error with a machine-readable error code, and details, if not
+// nil.
+func writeErrDetails(w http.ResponseWriter, code int, errCode, message string, details interface{}) {
+	j, err := json.Marshal(apiError{apiErrorBody{Code: errCode, Message: message, Details: details}})
+	if err != nil {
+		j, _ = json.Marshal(apiError{apiErrorBody{Code: errCodeInternal, Message: err.Error()}})
+		code = http.StatusInternalServerError
+	}
+
+	w.Header().Set("Content-Type", jsonContentType)
 	w.WriteHeader(code)
-	io.WriteString(w, fmt.Sprintf("{\"error\":\"%s\"}", message))
+	w.Write(j)
+}
+
+// Write a store backend error.
+func writeStoreErr(w http.ResponseWriter, err error) {
+	if err == errReservedKey {
+		writeErr(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err == errStoreFull {
+		writeErrCode(w, http.StatusInsufficientStorage, errCodeStoreFull, err.Error())
+		return
+	}
+	writeErr(w, http.StatusInternalServerError, fmt.Sprintf("store error: %v", err))
 }
 
 // Write a key missing error.
 func writeKeyErr(w http.ResponseWriter, key string) {
-	writeErr(w, http.StatusNotFound, fmt.Sprintf("can't find key %s", key))
+	writeErrCode(w, http.StatusNotFound, errCodeKeyNotFound, fmt.Sprintf("can't find key %s", key))
+}
+
+// publish sends a change of a key in the namespace of h to watchers.
+func (h Handler) publish(typ, key string, value json.RawMessage) {
+	h.hub.publish(h.namespace, typ, key, value)
+}
+
+// serveContent serves content using http.ServeContent, that handles range
+// and conditional requests, writing its errors, e.g. 416 Range Not
+// Satisfiable, as API errors.
+func serveContent(w http.ResponseWriter, r *http.Request, modtime time.Time, content io.ReadSeeker) {
+	cw := &contentErrWriter{ResponseWriter: w}
+	http.ServeContent(cw, r, "", modtime, content)
+	if cw.code == 0 {
+		return
+	}
+
+	message := strings.TrimSpace(cw.message.String())
+	if message == "" {
+		message = strings.ToLower(http.StatusText(cw.code))
+	}
+	w.Header().Del("X-Content-Type-Options")
+	writeErr(w, cw.code, message)
+}
+
+// contentErrWriter holds the error responses of http.ServeContent, that
+// are plain text, other responses are written.
+type contentErrWriter struct {
+	http.ResponseWriter
+
+	code    int
+	message bytes.Buffer
+}
+
+func (w *contentErrWriter) WriteHeader(code int) {
+	if code >= http.StatusBadRequest {
+		w.code = code
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *contentErrWriter) Write(b []byte) (int, error) {
+	if w.code != 0 {
+		return w.message.Write(b)
+	}
+
+	return w.ResponseWriter.Write(b)
 }
 
 // notFound handles no found requests.
@@ -54,127 +291,1043 @@ func notFound(w http.ResponseWriter, r *http.Request) {
 	writeErr(w, http.StatusNotFound, "not found")
 }
 
-// Write a map[string]interface{} to response writer, or fail.
-func writeMap(w http.ResponseWriter, m map[string]interface{}) {
-	j, err := json.Marshal(m)
+// methodNotAllowed handles requests to routes that do not allow the method.
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	allowed, _ := mux.AllowedMethods(r)
+	writeErr(w, http.StatusMethodNotAllowed,
+		fmt.Sprintf("method %s not allowed, allowed methods: %s", r.Method, strings.Join(allowed, ", ")))
+}
+
+// encodeRouterErr writes the errors of the router itself, e.g. a route
+// with a nil handler, logging server errors.
+func encodeRouterErr(w http.ResponseWriter, r *http.Request, code int, err error) {
+	if code >= http.StatusInternalServerError {
+		log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+	}
+	writeErr(w, code, err.Error())
+}
+
+// recovered handles panics of handlers, logging the panic and its stack,
+// and writing a 500 error.
+func recovered(w http.ResponseWriter, r *http.Request, v interface{}) {
+	log.Printf("panic serving %s %s: %v\n%s", r.Method, r.URL.Path, v, debug.Stack())
+	writeErr(w, http.StatusInternalServerError, "internal server error")
+}
+
+// Write a map[string]json.RawMessage to response writer, or fail.
+func writeMap(w http.ResponseWriter, m map[string]json.RawMessage) {
+	writeJSONStatus(w, http.StatusOK, m)
+}
+
+// ttlHeader holds the remaining time to live of a key, in seconds.
+const ttlHeader = "X-Kitty-TTL"
+
+// parseTTL returns the time to live in the "ttl" query parameter, e.g.
+// "?ttl=30s", or zero if it is missing.
+func parseTTL(r *http.Request) (time.Duration, error) {
+	s := r.URL.Query().Get("ttl")
+	if s == "" {
+		return 0, nil
+	}
+
+	ttl, err := time.ParseDuration(s)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("invalid ttl %s", s)
+	}
+
+	return ttl, nil
+}
+
+// Set the remaining time to live header, rounded up to whole seconds.
+func setTTLHeader(w http.ResponseWriter, ttl time.Duration) {
+	w.Header().Set(ttlHeader, strconv.FormatInt(int64(math.Ceil(ttl.Seconds())), 10))
+}
+
+// Write a JSON value to response writer, or fail.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	writeJSONStatus(w, http.StatusOK, v)
+}
+
+// Write a JSON value to response writer with a status code, or fail, the
+// status code is written once the value is encoded.
+func writeJSONStatus(w http.ResponseWriter, code int, v interface{}) {
+	j, err := json.Marshal(v)
 	if err != nil {
-		writeErr(w, http.StatusBadRequest, err.Error())
+		writeErr(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	io.WriteString(w, string(j))
+
+	w.Header().Set("Content-Type", jsonContentType)
+	w.WriteHeader(code)
+	w.Write(j)
+}
+
+// revisionETag returns the strong ETag of all the key value pairs at
+// a store revision.
+func revisionETag(rev uint64) string {
+	return fmt.Sprintf("\"rev-%d\"", rev)
+}
+
+// notModified checks if a request If-None-Match header matches etag, using
+// the weak comparison, e.g. "If-None-Match: W/"abc", "def"" matches "abc".
+func notModified(r *http.Request, etag string) bool {
+	for _, header := range r.Header.Values("If-None-Match") {
+		for _, tag := range strings.Split(header, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Set the ETag header, and write a 304 Not Modified response if the request
+// already has this ETag, reporting if the response was written.
+func writeNotModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	if !notModified(r, etag) {
+		return false
+	}
+
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// Set the ETag header of all the key value pairs, after a change.
+func (h Handler) setRevisionETag(w http.ResponseWriter) error {
+	rev, err := h.store.Revision()
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", revisionETag(rev))
+
+	return nil
 }
 
-// getVal handles GET "/val" and GET "/val/:key" requests.
+// compactJSON returns a valid JSON value without insignificant white space,
+// so values are stored, compared and written in one form.
+func compactJSON(v json.RawMessage) json.RawMessage {
+	var b bytes.Buffer
+	if err := json.Compact(&b, v); err != nil {
+		return v
+	}
+
+	return b.Bytes()
+}
+
+// getVal handles GET "/val" and GET "/val/:key" requests, an optional "rev"
+// query parameter gets a revision from the history of a key, e.g.
+// GET "/val/:key?rev=42", and an optional "field" or "pointer" query
+// parameter gets just a part of a value, e.g. GET "/val/:key?field=a.b".
+//
+// Responses have an ETag, the hash of a value, or the store revision for
+// all the values, requests with a matching If-None-Match header get a 304
+// Not Modified response without a body.
 func (h Handler) getVal(w http.ResponseWriter, r *http.Request) {
-	var m map[string]interface{}
+	var m map[string]json.RawMessage
 
 	// Retrieve the ":key" route parameter.
 	key, ok := mux.Var(r, "key")
 
+	// Parse the part of a value to get, if any.
+	var pointer jsonPointer
+	var selector string
 	if ok {
+		var err error
+		pointer, selector, err = selectedPointer(r.URL.Query())
+		if err != nil {
+			writeErr(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	if rev := r.URL.Query().Get("rev"); ok && rev != "" {
+		// Get one value by key at a revision:
+		if selector != "" {
+			writeErr(w, http.StatusBadRequest, "rev can't be used with field or pointer")
+			return
+		}
+		h.getRevision(w, key, rev)
+		return
+	} else if ok {
 		// Get one value by key:
-		val, ok := h.store.get(key)
+		val, etag, ok, err := h.store.GetWithETag(key)
+		if err != nil {
+			writeStoreErr(w, err)
+			return
+		}
 		if ok {
-			m = map[string]interface{}{key: val}
+			m = map[string]json.RawMessage{key: val}
+
+			// Report the remaining time to live of expiring keys.
+			ttl, ok, err := h.store.TTL(key)
+			if err != nil {
+				writeStoreErr(w, err)
+				return
+			}
+			if ok {
+				setTTLHeader(w, ttl)
+			}
+
+			// Raw values are not JSON, they are served by GET "/raw/:key".
+			metas, err := h.store.Meta([]string{key})
+			if err != nil {
+				writeStoreErr(w, err)
+				return
+			}
+			if metas[key].ContentType != "" {
+				writeRawErr(w, key)
+				return
+			}
+
+			// Get just a part of the value, its ETag is the hash of the part.
+			if selector != "" {
+				val, err = pointer.resolve(val)
+				if err != nil {
+					writeFieldErr(w, key, selector, err)
+					return
+				}
+				etag = valueETag(val)
+			}
+			if writeKeyNotModified(w, r, metas[key], etag) {
+				return
+			}
+			if selector != "" {
+				writeJSON(w, val)
+				return
+			}
 		} else {
 			// We do not have this key in our store.
 			writeKeyErr(w, key)
 			return
 		}
+	} else if q := r.URL.Query(); q.Has("limit") || q.Has("cursor") || q.Has("prefix") || q.Has("meta") {
+		// Get one page of values:
+		h.listPage(w, r)
+		return
 	} else {
-		// Get all values:
-		m = h.store.list()
+		// Get all values, reading the revision first, so it is never newer
+		// than the values.
+		rev, err := h.store.Revision()
+		if err != nil {
+			writeStoreErr(w, err)
+			return
+		}
+		if writeNotModified(w, r, revisionETag(rev)) {
+			return
+		}
+
+		m, err = h.store.List()
+		if err != nil {
+			writeStoreErr(w, err)
+			return
+		}
 	}
 
 	writeMap(w, m)
 }
 
-// postVal handles POST "/val" requests.
-func (h Handler) postVal(w http.ResponseWriter, r *http.Request) {
-	var data map[string]interface{}
+// countHeader holds the number of keys of HEAD "/val" responses.
+const countHeader = "X-Kitty-Count"
+
+// headVal handles HEAD "/val" and HEAD "/val/:key" requests, writing the
+// headers of the GET response, without a body.
+//
+// Responses of a key have the Content-Length of the GET response, computed
+// from the size of the value, responses of all the values have the number
+// of keys in the X-Kitty-Count header.
+func (h Handler) headVal(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the ":key" route parameter.
+	key, ok := mux.Var(r, "key")
+
+	if !ok {
+		// Read the revision first, so it is never newer than the count.
+		rev, err := h.store.Revision()
+		if err != nil {
+			writeStoreErr(w, err)
+			return
+		}
+		n, err := h.store.Len()
+		if err != nil {
+			writeStoreErr(w, err)
+			return
+		}
+		w.Header().Set(countHeader, strconv.Itoa(n))
+		if writeNotModified(w, r, revisionETag(rev)) {
+			return
+		}
+
+		w.Header().Set("Content-Type", jsonContentType)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	pointer, selector, err := selectedPointer(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	val, etag, ok, err := h.store.GetWithETag(key)
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", jsonContentType)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	ttl, ok, err := h.store.TTL(key)
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+	if ok {
+		setTTLHeader(w, ttl)
+	}
+	metas, err := h.store.Meta([]string{key})
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+	if metas[key].ContentType != "" {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	n := mapLength(key, val)
+	if selector != "" {
+		val, err = pointer.resolve(val)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		etag = valueETag(val)
+		j, _ := json.Marshal(val)
+		n = len(j)
+	}
+	if writeKeyNotModified(w, r, metas[key], etag) {
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(n))
+	w.WriteHeader(http.StatusOK)
+}
+
+// mapLength returns the length of the JSON object of one compact key value
+// pair, as written by writeMap, without marshaling the value, writeMap
+// escapes HTML characters, and line and paragraph separators, of values.
+func mapLength(key string, v json.RawMessage) int {
+	k, _ := json.Marshal(key)
+	n := len(k) + len(v) + len(`{:}`)
+
+	// Escaped as \u003c, \u003e, \u0026, \u2028 and \u2029.
+	for _, c := range []string{"<", ">", "&"} {
+		n += 5 * bytes.Count(v, []byte(c))
+	}
+	for _, c := range []string{"\u2028", "\u2029"} {
+		n += 3 * bytes.Count(v, []byte(c))
+	}
+
+	return n
+}
+
+// Page sizes of GET "/val" pages.
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// page is a page of key value pairs, their metadata, if requested, and the
+// cursor of the next page.
+type page struct {
+	Items      map[string]json.RawMessage `json:"items"`
+	Meta       map[string]KeyMeta         `json:"meta,omitempty"`
+	NextCursor string                     `json:"next_cursor,omitempty"`
+}
+
+// listPage handles GET "/val" requests with "limit", "cursor", "prefix" or
+// "meta" query parameters, writing a page of key value pairs in key order,
+// and with "meta=true", the metadata of the keys.
+//
+// The "next_cursor" of a page is passed as the "cursor" of the next page,
+// it is missing on the last page.
+func (h Handler) listPage(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	withMeta := false
+	if s := q.Get("meta"); s != "" {
+		var err error
+		if withMeta, err = strconv.ParseBool(s); err != nil {
+			writeErr(w, http.StatusBadRequest, "meta must be true or false")
+			return
+		}
+	}
+
+	limit := defaultPageLimit
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxPageLimit {
+			writeErr(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxPageLimit))
+			return
+		}
+		limit = n
+	}
+
+	// Cursors are opaque to clients, they encode the last key of a page.
+	cursor, err := base64.RawURLEncoding.DecodeString(q.Get("cursor"))
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, "invalid cursor")
+		return
+	}
+
+	rev, err := h.store.Revision()
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+	if writeNotModified(w, r, revisionETag(rev)) {
+		return
+	}
+
+	items, next, err := h.store.ListPage(q.Get("prefix"), string(cursor), limit)
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+
+	p := page{Items: items}
+	if withMeta {
+		if p.Meta, err = h.pageMeta(items); err != nil {
+			writeStoreErr(w, err)
+			return
+		}
+	}
+	if next != "" {
+		p.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(next))
+	}
+	writeJSON(w, p)
+}
+
+// maxQueryKeys is the maximum number of keys of a POST "/val/query" request.
+const maxQueryKeys = 1000
+
+// queryResult is the response of a POST "/val/query" request.
+type queryResult struct {
+	Found   map[string]json.RawMessage `json:"found"`
+	Missing []string                   `json:"missing"`
+}
+
+// queryVals handles POST "/val/query" requests, with a JSON body
+// {"keys": ["a", "b"]}, writing the values of the keys, and the missing
+// keys, in request order.
+func (h Handler) queryVals(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Keys []string `json:"keys"`
+	}
 
 	decoder := json.NewDecoder(r.Body)
 	decoder.DisallowUnknownFields()
 
 	// Read body data as json.
-	err := decoder.Decode(&data)
+	err := decoder.Decode(&body)
+	if err != nil {
+		writeErrCode(w, http.StatusBadRequest, errCodeBadJSON, err.Error())
+		return
+	}
+	if len(body.Keys) > maxQueryKeys {
+		writeErr(w, http.StatusBadRequest, fmt.Sprintf("too many keys, at most %d keys can be queried", maxQueryKeys))
+		return
+	}
+
+	found, err := h.store.GetMany(body.Keys)
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+
+	result := queryResult{Found: found, Missing: []string{}}
+	seen := make(map[string]bool, len(body.Keys))
+	for _, k := range body.Keys {
+		if _, ok := found[k]; !ok && !seen[k] {
+			result.Missing = append(result.Missing, k)
+		}
+		seen[k] = true
+	}
+
+	writeJSON(w, result)
+}
+
+// postVal handles POST "/val" requests, with an optional "ttl" query
+// parameter applied to all the keys.
+func (h Handler) postVal(w http.ResponseWriter, r *http.Request) {
+	var data map[string]json.RawMessage
+
+	ttl, err := parseTTL(r)
 	if err != nil {
 		writeErr(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	// Read body data as json.
+	err = decoder.Decode(&data)
+	if err != nil {
+		writeErrCode(w, http.StatusBadRequest, errCodeBadJSON, err.Error())
+		return
+	}
+	// Check the keys in order, so the first invalid key is reported.
+	keys := make([]string, 0, len(data))
+	for k, v := range data {
+		data[k] = compactJSON(v)
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := h.limits.checkValue(k, data[k]); err != nil {
+			writeLimitErr(w, err)
+			return
+		}
+		if err := h.schemas.check(k, data[k]); err != nil {
+			writeLimitErr(w, err)
+			return
+		}
+	}
+
 	// Check for newly created keys.
+	created := 0
+	existed := make(map[string]bool, len(data))
 	for k := range data {
-		if _, ok := h.store.get(k); !ok {
-			w.WriteHeader(http.StatusCreated)
-			break
+		_, ok, err := h.store.Get(k)
+		if err != nil {
+			writeStoreErr(w, err)
+			return
+		}
+		existed[k] = ok
+		if !ok {
+			created++
 		}
 	}
+	if err := h.checkNewKeys(created); err != nil {
+		writeLimitErr(w, err)
+		return
+	}
+	if ttl > 0 {
+		setTTLHeader(w, ttl)
+	}
 
 	// Create or modify multiple key value pairs.
 	for k, v := range data {
-		h.store.upsert(k, v)
+		if err := h.store.UpsertTTL(k, v, ttl); err != nil {
+			writeStoreErr(w, err)
+			return
+		}
+		if existed[k] {
+			h.publish(eventUpdated, k, v)
+		} else {
+			h.publish(eventCreated, k, v)
+		}
+	}
+	if err := h.setRevisionETag(w); err != nil {
+		writeStoreErr(w, err)
+		return
 	}
 
-	// Write response as json.
-	writeMap(w, data)
+	// Write response as json, with 201 Created if we created a key.
+	code := http.StatusOK
+	if created > 0 {
+		code = http.StatusCreated
+	}
+	writeJSONStatus(w, code, data)
 }
 
-// postVal handles PUT "/val/:key" requests.
+// putVal handles PUT "/val/:key" requests, with an optional "ttl" query
+// parameter, e.g. PUT "/val/:key?ttl=30s", keys stored without a ttl never
+// expire.
 func (h Handler) putVal(w http.ResponseWriter, r *http.Request) {
-	var data interface{}
+	var data json.RawMessage
+
+	ttl, err := parseTTL(r)
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	decoder := json.NewDecoder(r.Body)
 	decoder.DisallowUnknownFields()
 
 	// Read body data as json.
-	err := decoder.Decode(&data)
+	err = decoder.Decode(&data)
 	if err != nil {
-		writeErr(w, http.StatusBadRequest, err.Error())
+		writeErrCode(w, http.StatusBadRequest, errCodeBadJSON, err.Error())
 		return
 	}
+	data = compactJSON(data)
 
 	// Retrieve the ":key" route parameter.
 	key, ok := mux.Var(r, "key")
 	if !ok {
 		writeErr(w, http.StatusInternalServerError, "can't get key")
+		return
+	}
+	if err := h.limits.checkValue(key, data); err != nil {
+		writeLimitErr(w, err)
+		return
+	}
+	if err := h.schemas.check(key, data); err != nil {
+		writeLimitErr(w, err)
+		return
 	}
 
 	// Check if this is a new key.
-	if val, ok := h.store.get(key); ok {
+	val, ok, err := h.store.Get(key)
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+	if !ok {
+		if err := h.checkNewKeys(1); err != nil {
+			writeLimitErr(w, err)
+			return
+		}
+	}
+	if ttl > 0 {
+		setTTLHeader(w, ttl)
+	}
+	w.Header().Set("ETag", valueETag(data))
+	if ok {
+		// Check if the key expires, storing it changes its time to live.
+		_, expires, err := h.store.TTL(key)
+		if err != nil {
+			writeStoreErr(w, err)
+			return
+		}
+
 		// We are modifying an existing value.
-		if val == data {
-			// Value does not require change.
+		if bytes.Equal(val, data) && ttl == 0 && !expires {
+			// Value does not require change, 304 responses have no body.
 			w.WriteHeader(http.StatusNotModified)
-			writeMap(w, map[string]interface{}{key: data})
 			return
 		}
-	} else {
-		// We are creating a new key value pair.
-		w.WriteHeader(http.StatusCreated)
 	}
 
 	// Create or modify key value pair.
-	h.store.upsert(key, data)
+	if err := h.store.UpsertTTL(key, data, ttl); err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+	code := http.StatusOK
+	if ok {
+		h.publish(eventUpdated, key, data)
+	} else {
+		// We created a new key value pair.
+		h.publish(eventCreated, key, data)
+		code = http.StatusCreated
+	}
+
+	// Write response as json.
+	writeJSONStatus(w, code, map[string]json.RawMessage{key: data})
+}
+
+// patchVal handles PATCH "/val/:key" requests, applying a JSON Merge Patch
+// (RFC 7386) to the value, keys keep their time to live.
+func (h Handler) patchVal(w http.ResponseWriter, r *http.Request) {
+	var patch json.RawMessage
+
+	// Read body data as json.
+	err := json.NewDecoder(r.Body).Decode(&patch)
+	if err != nil {
+		writeErrCode(w, http.StatusBadRequest, errCodeBadJSON, err.Error())
+		return
+	}
+
+	// Retrieve the ":key" route parameter.
+	key, ok := mux.Var(r, "key")
+	if !ok {
+		writeErr(w, http.StatusInternalServerError, "can't get key")
+		return
+	}
+
+	// Get the value to patch.
+	val, ok, err := h.store.Get(key)
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+
+	// Swap the patched value, if the value changed since it was read, patch
+	// the current value again. The key keeps its time to live.
+	var data json.RawMessage
+	for swapped := false; !swapped; {
+		if !ok {
+			writeKeyErr(w, key)
+			return
+		}
+
+		data, err = mergePatch(val, patch)
+		if err != nil {
+			writeErr(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := h.limits.checkValueSize(data); err != nil {
+			writeLimitErr(w, err)
+			return
+		}
+
+		// Check the patched value, patches may be valid only with the value.
+		if err := h.schemas.check(key, data); err != nil {
+			writeLimitErr(w, err)
+			return
+		}
+
+		val, swapped, ok, err = h.store.CompareAndSwap(key, val, data)
+		if err != nil {
+			writeStoreErr(w, err)
+			return
+		}
+	}
+	h.publish(eventUpdated, key, data)
+
+	ttl, _, err := h.store.TTL(key)
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+	if ttl > 0 {
+		setTTLHeader(w, ttl)
+	}
+	w.Header().Set("ETag", valueETag(data))
+
+	// Write response as json.
+	writeMap(w, map[string]json.RawMessage{key: data})
+}
+
+// incrVal handles POST "/val/:key/incr" requests, adding the integer in an
+// optional JSON body, e.g. {"by": -5}, or 1, to the value atomically, keys
+// are created at 0 first, and keep their time to live.
+func (h Handler) incrVal(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		By *json.Number `json:"by"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	decoder.UseNumber()
+
+	// Read body data as json, an empty body increments by 1.
+	err := decoder.Decode(&body)
+	if err != nil && err != io.EOF {
+		writeErrCode(w, http.StatusBadRequest, errCodeBadJSON, err.Error())
+		return
+	}
+	delta := int64(1)
+	if body.By != nil {
+		delta, err = strconv.ParseInt(body.By.String(), 10, 64)
+		if err != nil {
+			writeErr(w, http.StatusBadRequest, fmt.Sprintf("by must be a 64-bit integer, got %s", body.By))
+			return
+		}
+	}
+
+	// Retrieve the ":key" route parameter.
+	key, ok := mux.Var(r, "key")
+	if !ok {
+		writeErr(w, http.StatusInternalServerError, "can't get key")
+		return
+	}
+
+	if err := h.limits.checkKey(key); err != nil {
+		writeLimitErr(w, err)
+		return
+	}
+
+	// Check if this is a new key, for reporting the change.
+	_, ok, err = h.store.Get(key)
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+	if !ok {
+		if err := h.checkNewKeys(1); err != nil {
+			writeLimitErr(w, err)
+			return
+		}
+	}
+
+	n, err := h.store.Incr(key, delta)
+	if err == errNotInteger || err == errOverflow {
+		writeErr(w, http.StatusConflict, fmt.Sprintf("can't increment key %s: %v", key, err))
+		return
+	}
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+
+	data := json.RawMessage(strconv.FormatInt(n, 10))
+	if ok {
+		h.publish(eventUpdated, key, data)
+	} else {
+		h.publish(eventCreated, key, data)
+	}
+	w.Header().Set("ETag", valueETag(data))
+
+	// Write response as json.
+	writeMap(w, map[string]json.RawMessage{key: data})
+}
+
+// casConflict is the error details of a compare and swap that did not
+// swap, the current value, missing if the key is missing.
+type casConflict struct {
+	Current json.RawMessage `json:"current,omitempty"`
+}
+
+// casVal handles POST "/val/:key/cas" requests, with a JSON body
+// {"old": <value>, "new": <value>}, replacing the value with "new" if it
+// equals "old", or if "old" is missing or null, and the key is missing.
+//
+// If the value does not match, it writes a 409 with the current value,
+// missing if the key is missing.
+func (h Handler) casVal(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Old json.RawMessage `json:"old"`
+		New json.RawMessage `json:"new"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	// Read body data as json.
+	err := decoder.Decode(&body)
+	if err != nil {
+		writeErrCode(w, http.StatusBadRequest, errCodeBadJSON, err.Error())
+		return
+	}
+	if body.New == nil {
+		writeErr(w, http.StatusBadRequest, "new is required")
+		return
+	}
+	old := body.Old
+	if string(old) == "null" {
+		old = nil
+	}
+	if old != nil {
+		old = compactJSON(old)
+	}
+	data := compactJSON(body.New)
+
+	// Retrieve the ":key" route parameter.
+	key, ok := mux.Var(r, "key")
+	if !ok {
+		writeErr(w, http.StatusInternalServerError, "can't get key")
+		return
+	}
+	if err := h.limits.checkValue(key, data); err != nil {
+		writeLimitErr(w, err)
+		return
+	}
+	if err := h.schemas.check(key, data); err != nil {
+		writeLimitErr(w, err)
+		return
+	}
+	if old == nil {
+		if err := h.checkNewKeys(1); err != nil {
+			writeLimitErr(w, err)
+			return
+		}
+	}
+
+	val, swapped, _, err := h.store.CompareAndSwap(key, old, data)
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+	if !swapped {
+		msg := fmt.Sprintf("value of key %s does not match old", key)
+		if old == nil {
+			msg = fmt.Sprintf("key %s already exists", key)
+		}
+		var details interface{}
+		if val != nil {
+			details = casConflict{Current: val}
+		}
+		writeErrDetails(w, http.StatusConflict, errCodeConflict, msg, details)
+		return
+	}
+
+	if old != nil {
+		h.publish(eventUpdated, key, data)
+	} else {
+		h.publish(eventCreated, key, data)
+	}
+	w.Header().Set("ETag", valueETag(data))
 
 	// Write response as json.
-	writeMap(w, map[string]interface{}{key: data})
+	writeMap(w, map[string]json.RawMessage{key: data})
 }
 
-// deleteVal handles DELETE "/val/:key" requests.
+// deleteVal handles DELETE "/val/:key" requests, with soft deletes the key
+// is moved to the trash.
 func (h Handler) deleteVal(w http.ResponseWriter, r *http.Request) {
 	// Retrieve the ":key" route parameter.
 	key, ok := mux.Var(r, "key")
 	if !ok {
 		writeErr(w, http.StatusInternalServerError, "can't get key")
+		return
 	}
 
 	// Get one value by key:
-	val, ok := h.store.get(key)
-	if ok {
-		h.store.delete(key)
-		writeMap(w, map[string]interface{}{key: val})
+	val, ok, err := h.store.Get(key)
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+	if !ok {
+		writeKeyErr(w, key)
+		return
+	}
+
+	// Soft deletes move the key to the trash.
+	if h.softDelete {
+		ok, err = h.store.Trash(key)
 	} else {
+		ok, err = h.store.Delete(key)
+	}
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+	if !ok {
+		// The key was deleted by a concurrent request.
 		writeKeyErr(w, key)
+		return
+	}
+	h.publish(eventDeleted, key, nil)
+	if err := h.setRevisionETag(w); err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+	writeMap(w, map[string]json.RawMessage{key: val})
+}
+
+// maxDeletedKeys is the maximum number of keys listed in the response of
+// a DELETE "/val?prefix=<prefix>" request.
+const maxDeletedKeys = 1000
+
+// prefixDeleteResult is the response of a DELETE "/val?prefix=<prefix>"
+// request, the number of deleted keys, and the first deleted keys, in key
+// order, truncated is true if some deleted keys are not listed.
+type prefixDeleteResult struct {
+	Deleted   int      `json:"deleted"`
+	Keys      []string `json:"keys"`
+	Truncated bool     `json:"truncated,omitempty"`
+}
+
+// clearVals handles DELETE "/val?confirm=true" requests, removing all the
+// keys, and writing their number, or with a "prefix" query parameter, e.g.
+// DELETE "/val?prefix=app1/&confirm=true", removing the keys with the prefix
+// atomically, and writing their number and the deleted keys.
+func (h Handler) clearVals(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	if r.URL.Query().Get("confirm") != "true" {
+		if prefix != "" {
+			writeErr(w, http.StatusBadRequest, "deleting keys with a prefix requires confirm=true")
+			return
+		}
+		writeErr(w, http.StatusBadRequest, "deleting all keys requires confirm=true")
+		return
+	}
+	if prefix != "" {
+		h.deletePrefix(w, prefix)
+		return
+	}
+
+	// List the keys to report their deletion, keys created while clearing
+	// are deleted without a report.
+	vals, err := h.store.List()
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+
+	n, err := h.store.Clear()
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+	for k := range vals {
+		h.publish(eventDeleted, k, nil)
+	}
+	if err := h.setRevisionETag(w); err != nil {
+		writeStoreErr(w, err)
+		return
 	}
+
+	writeJSON(w, map[string]int{"deleted": n})
+}
+
+// deletePrefix removes the keys with a prefix, and writes their number and
+// the first deleted keys.
+func (h Handler) deletePrefix(w http.ResponseWriter, prefix string) {
+	deleted, err := h.store.DeletePrefix(prefix)
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+	for _, k := range deleted {
+		h.publish(eventDeleted, k, nil)
+	}
+	if err := h.setRevisionETag(w); err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+
+	result := prefixDeleteResult{Deleted: len(deleted), Keys: deleted}
+	if len(deleted) > maxDeletedKeys {
+		result.Keys = deleted[:maxDeletedKeys]
+		result.Truncated = true
+	}
+	writeJSON(w, result)
+}
+
+// deleteVals handles POST "/val/delete" requests, removing a JSON array of
+// keys atomically, and writing the result of each key, "deleted" or
+// "not found".
+func (h Handler) deleteVals(w http.ResponseWriter, r *http.Request) {
+	var keys []string
+
+	decoder := json.NewDecoder(r.Body)
+
+	// Read body data as json.
+	err := decoder.Decode(&keys)
+	if err != nil {
+		writeErrCode(w, http.StatusBadRequest, errCodeBadJSON, err.Error())
+		return
+	}
+
+	deleted, err := h.store.DeleteKeys(keys)
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+	if err := h.setRevisionETag(w); err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+
+	results := make(map[string]string, len(keys))
+	for i, k := range keys {
+		if deleted[i] {
+			results[k] = "deleted"
+			h.publish(eventDeleted, k, nil)
+		} else if _, ok := results[k]; !ok {
+			results[k] = "not found"
+		}
+	}
+
+	writeJSON(w, results)
 }
@@ -0,0 +1,182 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/yaacov/gokitty/pkg/mux"
+)
+
+// Default bounds of the key history.
+const (
+	defaultHistoryRevisions = 5
+	defaultHistoryMaxKeys   = 10000
+)
+
+// revision is a recorded change of a key, deletions are recorded as
+// tombstones, without a value.
+type revision struct {
+	Revision uint64          `json:"revision"`
+	Time     time.Time       `json:"time"`
+	Type     string          `json:"type"`
+	Value    json.RawMessage `json:"value,omitempty"`
+	Deleted  bool            `json:"deleted,omitempty"`
+}
+
+// historyKey is a key of a namespace.
+type historyKey struct {
+	namespace, key string
+}
+
+// keyHistory keeps the last revisions of each key, it is guarded by the
+// hub recording it, so revisions are the revisions of watch events.
+//
+// Memory is bounded, each key keeps up to perKey revisions, and up to
+// maxKeys keys have a history, the history of the key changed least
+// recently is dropped first, a zero maxKeys is unbounded. Keys that expire
+// are not changes, their history is kept until it is dropped.
+type keyHistory struct {
+	perKey  int
+	maxKeys int
+
+	// Revisions of each key, oldest first, and the keys ordered by their
+	// last change, least recent first.
+	revisions map[historyKey][]revision
+	order     *list.List
+	elems     map[historyKey]*list.Element
+}
+
+func newKeyHistory(perKey, maxKeys int) *keyHistory {
+	k := keyHistory{
+		perKey:    perKey,
+		maxKeys:   maxKeys,
+		revisions: make(map[historyKey][]revision),
+		order:     list.New(),
+		elems:     make(map[historyKey]*list.Element),
+	}
+
+	return &k
+}
+
+// record adds a revision of the key of an event.
+func (k *keyHistory) record(e event, at time.Time) {
+	if k.perKey <= 0 {
+		return
+	}
+
+	hk := historyKey{namespace: e.Namespace, key: e.Key}
+	deleted := e.Type == eventDeleted || e.Type == eventEvicted
+	r := revision{Revision: e.Revision, Time: at, Type: e.Type, Value: e.Value, Deleted: deleted}
+
+	revs := k.revisions[hk]
+	if len(revs) < k.perKey {
+		revs = append(revs, r)
+	} else {
+		// Shift in place, so the slice never grows past perKey.
+		copy(revs, revs[1:])
+		revs[len(revs)-1] = r
+	}
+	k.revisions[hk] = revs
+
+	if elem, ok := k.elems[hk]; ok {
+		k.order.MoveToBack(elem)
+		return
+	}
+	k.elems[hk] = k.order.PushBack(hk)
+
+	if k.maxKeys > 0 && len(k.elems) > k.maxKeys {
+		oldest := k.order.Remove(k.order.Front()).(historyKey)
+		delete(k.elems, oldest)
+		delete(k.revisions, oldest)
+	}
+}
+
+// get returns a copy of the revisions of a key, newest first.
+func (k *keyHistory) get(namespace, key string) []revision {
+	revs := k.revisions[historyKey{namespace: namespace, key: key}]
+
+	newest := make([]revision, len(revs))
+	for i, r := range revs {
+		newest[len(revs)-1-i] = r
+	}
+
+	return newest
+}
+
+// keyRevisions returns the revisions of a key of a namespace, newest first.
+func (h *hub) keyRevisions(namespace, key string) []revision {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.keys.get(namespace, key)
+}
+
+// keyHistoryResponse is the response of GET "/val/:key/history" requests.
+type keyHistoryResponse struct {
+	Key       string     `json:"key"`
+	Revisions []revision `json:"revisions"`
+}
+
+// getHistory handles GET "/val/:key/history" requests, writing the last
+// revisions of a key, newest first, including deletions.
+func (h Handler) getHistory(w http.ResponseWriter, r *http.Request) {
+	key, ok := mux.Var(r, "key")
+	if !ok {
+		writeErr(w, http.StatusInternalServerError, "can't get key")
+		return
+	}
+
+	revs := h.hub.keyRevisions(h.namespace, key)
+	if len(revs) == 0 {
+		writeErrCode(w, http.StatusNotFound, errCodeKeyNotFound, fmt.Sprintf("can't find history of key %s", key))
+		return
+	}
+
+	writeJSON(w, keyHistoryResponse{Key: key, Revisions: revs})
+}
+
+// getRevision handles GET "/val/:key?rev=<n>" requests, writing the value
+// of a key at a revision of its history.
+func (h Handler) getRevision(w http.ResponseWriter, key, rev string) {
+	n, err := strconv.ParseUint(rev, 10, 64)
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, fmt.Sprintf("invalid rev %s", rev))
+		return
+	}
+
+	for _, r := range h.hub.keyRevisions(h.namespace, key) {
+		if r.Revision != n {
+			continue
+		}
+		if r.Deleted {
+			writeErrCode(w, http.StatusNotFound, errCodeKeyNotFound,
+				fmt.Sprintf("key %s was %s at revision %d", key, r.Type, n))
+			return
+		}
+
+		w.Header().Set("ETag", valueETag(r.Value))
+		writeMap(w, map[string]json.RawMessage{key: r.Value})
+		return
+	}
+
+	writeErrCode(w, http.StatusNotFound, errCodeKeyNotFound, fmt.Sprintf("can't find revision %d of key %s", n, key))
+}
@@ -0,0 +1,195 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestKeyHistory(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	h := newHandler(newMemoryStore())
+	h.hub.now = clock.Now
+	handler := newHandlerRouter(h)
+
+	for _, req := range []struct{ method, path, body string }{
+		{"PUT", "/v1/val/kitty", "\"cat\""},
+		{"PUT", "/v1/val/gorilla", "1"},
+		{"PATCH", "/v1/val/kitty", "{\"name\": \"tom\"}"},
+		{"DELETE", "/v1/val/kitty", ""},
+		{"POST", "/v1/val/kitty/cas", "{\"new\": \"tiger\"}"},
+	} {
+		clock.Add(time.Second)
+		serve(t, handler, req.method, req.path, req.body, "")
+	}
+
+	// Check the history is newest first, with a tombstone of the deletion.
+	rr := serve(t, handler, "GET", "/v1/val/kitty/history", "", "")
+	expected := "{\"key\":\"kitty\",\"revisions\":[" +
+		"{\"revision\":5,\"time\":\"1970-01-01T00:00:05Z\",\"type\":\"created\",\"value\":\"tiger\"}," +
+		"{\"revision\":4,\"time\":\"1970-01-01T00:00:04Z\",\"type\":\"deleted\",\"deleted\":true}," +
+		"{\"revision\":3,\"time\":\"1970-01-01T00:00:03Z\",\"type\":\"updated\",\"value\":{\"name\":\"tom\"}}," +
+		"{\"revision\":1,\"time\":\"1970-01-01T00:00:01Z\",\"type\":\"created\",\"value\":\"cat\"}]}"
+	if rr.Code != http.StatusOK || rr.Body.String() != expected {
+		t.Errorf("history returned unexpected response: got %v %v want %v",
+			rr.Code, rr.Body.String(), expected)
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		status   int
+		expected string
+	}{
+		{"old revision", "/v1/val/kitty?rev=1", http.StatusOK, "{\"kitty\":\"cat\"}"},
+		{"current revision", "/v1/val/kitty?rev=5", http.StatusOK, "{\"kitty\":\"tiger\"}"},
+		{"tombstone", "/v1/val/kitty?rev=4", http.StatusNotFound,
+			"{\"error\":{\"code\":\"key_not_found\",\"message\":\"key kitty was deleted at revision 4\"}}"},
+		{"revision of another key", "/v1/val/kitty?rev=2", http.StatusNotFound,
+			"{\"error\":{\"code\":\"key_not_found\",\"message\":\"can't find revision 2 of key kitty\"}}"},
+		{"invalid revision", "/v1/val/kitty?rev=last", http.StatusBadRequest,
+			"{\"error\":{\"code\":\"bad_request\",\"message\":\"invalid rev last\"}}"},
+		{"missing history", "/v1/val/dog/history", http.StatusNotFound,
+			"{\"error\":{\"code\":\"key_not_found\",\"message\":\"can't find history of key dog\"}}"},
+	}
+	for _, tt := range tests {
+		rr := serve(t, handler, "GET", tt.path, "", "")
+
+		// Check the status code is what we expect.
+		if rr.Code != tt.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				tt.name, rr.Code, tt.status)
+		}
+
+		// Check the response body is what we expect.
+		if rr.Body.String() != tt.expected {
+			t.Errorf("%s: handler returned unexpected body: got %v want %v",
+				tt.name, rr.Body.String(), tt.expected)
+		}
+	}
+}
+
+func TestKeyHistoryPerKeyBound(t *testing.T) {
+	h := newHandler(newMemoryStore())
+	handler := newHandlerRouter(h)
+
+	for i := 1; i <= 2*defaultHistoryRevisions; i++ {
+		serve(t, handler, "PUT", "/v1/val/kitty", fmt.Sprint(i), "")
+	}
+
+	// Check only the last revisions are kept.
+	var got keyHistoryResponse
+	rr := serve(t, handler, "GET", "/v1/val/kitty/history", "", "")
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Revisions) != defaultHistoryRevisions {
+		t.Fatalf("history returned %d revisions want %d", len(got.Revisions), defaultHistoryRevisions)
+	}
+	for i, r := range got.Revisions {
+		want := uint64(2*defaultHistoryRevisions - i)
+		if r.Revision != want || string(r.Value) != fmt.Sprint(want) {
+			t.Errorf("history returned unexpected revision: got %+v want %d", r, want)
+		}
+	}
+}
+
+func TestKeyHistoryMaxKeys(t *testing.T) {
+	k := newKeyHistory(2, 2)
+	for i, key := range []string{"a", "b", "a", "c"} {
+		k.record(event{Type: eventUpdated, Key: key, Revision: uint64(i + 1)}, time.Unix(0, 0))
+	}
+
+	// Check the history of the key changed least recently is dropped.
+	for key, want := range map[string]int{"a": 2, "b": 0, "c": 1} {
+		if got := k.get("", key); len(got) != want {
+			t.Errorf("get %s: got %d revisions want %d", key, len(got), want)
+		}
+	}
+
+	// Check a disabled history records nothing.
+	k = newKeyHistory(0, 2)
+	k.record(event{Type: eventUpdated, Key: "a", Revision: 1}, time.Unix(0, 0))
+	if got := k.get("", "a"); len(got) != 0 {
+		t.Errorf("get of a disabled history: got %v", got)
+	}
+}
+
+func TestKeyHistoryTTL(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	store := newMemoryStore()
+	store.now = clock.Now
+	handler := newStoreRouter(store)
+
+	serve(t, handler, "PUT", "/v1/val/kitty?ttl=1s", "\"cat\"", "")
+	clock.Add(time.Minute)
+	store.DeleteExpired()
+
+	// Check expired keys are missing, and keep their history, expiry is not
+	// a revision.
+	if rr := serve(t, handler, "GET", "/v1/val/kitty", "", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("get of an expired key: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+	rr := serve(t, handler, "GET", "/v1/val/kitty?rev=1", "", "")
+	if rr.Code != http.StatusOK || rr.Body.String() != "{\"kitty\":\"cat\"}" {
+		t.Errorf("get of a revision of an expired key: got %v %v", rr.Code, rr.Body.String())
+	}
+}
+
+func TestKeyHistoryWatchRevisions(t *testing.T) {
+	h := newHandler(newMemoryStore())
+	handler := newHandlerRouter(h)
+
+	serve(t, handler, "POST", "/v1/val", "{\"kitty\": 1, \"gorilla\": 2}", "")
+	serve(t, handler, "PUT", "/v1/ns/cats/val/kitty", "3", "")
+	serve(t, handler, "POST", "/v1/val/kitty/incr", "", "")
+	serve(t, handler, "DELETE", "/v1/val?confirm=true", "", "")
+
+	// Check the history has the revisions of the watch events.
+	w, events, err := h.hub.subscribe("", "kitty", 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.hub.unsubscribe(w)
+
+	var got keyHistoryResponse
+	rr := serve(t, handler, "GET", "/v1/val/kitty/history", "", "")
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Revisions) != len(events) {
+		t.Fatalf("history returned %d revisions want %d", len(got.Revisions), len(events))
+	}
+	for i, e := range events {
+		r := got.Revisions[len(events)-1-i]
+		if r.Revision != e.Revision || r.Type != e.Type {
+			t.Errorf("history returned revision %+v of event %+v", r, e)
+		}
+	}
+
+	// Check namespaces have their own history.
+	rr = serve(t, handler, "GET", "/v1/ns/cats/val/kitty/history", "", "")
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Revisions) != 1 || string(got.Revisions[0].Value) != "3" {
+		t.Errorf("namespace history returned unexpected revisions: %+v", got.Revisions)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package main
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// janitor removes expired keys, and keys trashed for longer than the trash
+// retention, from a store periodically.
+type janitor struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startJanitor starts sweeping expired keys every interval, and trashed keys
+// if the trash retention is positive.
+func startJanitor(store Store, interval, trashRetention time.Duration, logger *log.Logger) *janitor {
+	j := janitor{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(j.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-j.stop:
+				return
+			case <-ticker.C:
+				if _, err := store.DeleteExpired(); err != nil {
+					logger.Println("can't remove expired keys:", err)
+				}
+				if trashRetention > 0 {
+					if _, err := store.PurgeTrash(trashRetention); err != nil {
+						logger.Println("can't purge trashed keys:", err)
+					}
+				}
+			}
+		}
+	}()
+
+	return &j
+}
+
+// Stop stops sweeping, and waits for a running sweep to complete.
+func (j *janitor) Stop() {
+	close(j.stop)
+	<-j.done
+}
@@ -0,0 +1,88 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestJanitor(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	store := newMemoryStore()
+	store.now = clock.Now
+	store.UpsertTTL("kitty", json.RawMessage(`"cat"`), time.Second)
+
+	j := startJanitor(store, time.Millisecond, 0, log.New(io.Discard, "", 0))
+	clock.Add(time.Second)
+
+	// Check the janitor removes the expired key.
+	deadline := time.Now().Add(time.Second)
+	for {
+		store.mu.RLock()
+		_, ok := store.vals["kitty"]
+		store.mu.RUnlock()
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("janitor did not remove the expired key")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Check the janitor stops.
+	stopped := make(chan struct{})
+	go func() {
+		j.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("janitor did not stop")
+	}
+}
+
+func TestJanitorPurgesTrash(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	store := newMemoryStore()
+	store.now = clock.Now
+	for _, k := range []string{"old", "new"} {
+		store.Upsert(k, json.RawMessage(`"cat"`))
+		store.Trash(k)
+		clock.Add(time.Hour)
+	}
+
+	j := startJanitor(store, time.Millisecond, 90*time.Minute, log.New(io.Discard, "", 0))
+	defer j.Stop()
+
+	// Check the janitor purges the keys trashed before the retention.
+	deadline := time.Now().Add(time.Second)
+	for {
+		trashed, _ := store.ListTrash("")
+		if len(trashed) == 1 && trashed[0].Key == "new" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("janitor did not purge the trash: %+v", trashed)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package main
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Default limits.
+const (
+	defaultMaxKeyLength  = 256
+	defaultMaxValueBytes = 1 << 20
+	defaultMaxKeys       = 1000000
+)
+
+// Limits bound the keys and values accepted by the handlers, zero values
+// are unlimited.
+type Limits struct {
+	// MaxKeyLength is the maximum length of keys, in bytes.
+	MaxKeyLength int
+
+	// KeyPattern, if not nil, must match keys. Keys with control characters,
+	// or that are not valid UTF-8, are always rejected.
+	KeyPattern *regexp.Regexp
+
+	// MaxValueBytes is the maximum size of compact JSON values, in bytes.
+	MaxValueBytes int
+
+	// MaxKeys is the maximum number of keys in the store, of all the
+	// namespaces. It is checked before creating keys, so concurrent
+	// requests may exceed it slightly.
+	MaxKeys int
+}
+
+func defaultLimits() Limits {
+	l := Limits{
+		MaxKeyLength:  defaultMaxKeyLength,
+		MaxValueBytes: defaultMaxValueBytes,
+		MaxKeys:       defaultMaxKeys,
+	}
+
+	return l
+}
+
+// limitError is a violated limit, and the status code of its response.
+type limitError struct {
+	code int
+	msg  string
+}
+
+func (e *limitError) Error() string {
+	return e.msg
+}
+
+// checkKey checks a key is valid.
+func (l Limits) checkKey(key string) error {
+	if key == "" {
+		return &limitError{http.StatusBadRequest, "key can't be empty"}
+	}
+	if l.MaxKeyLength > 0 && len(key) > l.MaxKeyLength {
+		return &limitError{http.StatusBadRequest, fmt.Sprintf(
+			"key is %d bytes long, longer than the max-key-length limit of %d bytes", len(key), l.MaxKeyLength)}
+	}
+	if !utf8.ValidString(key) {
+		return &limitError{http.StatusBadRequest, "key is not valid UTF-8"}
+	}
+	for _, c := range key {
+		if unicode.IsControl(c) {
+			return &limitError{http.StatusBadRequest, fmt.Sprintf("key has a control character %U", c)}
+		}
+	}
+	if l.KeyPattern != nil && !l.KeyPattern.MatchString(key) {
+		return &limitError{http.StatusBadRequest, fmt.Sprintf(
+			"key does not match the key-pattern limit %s", l.KeyPattern)}
+	}
+
+	return nil
+}
+
+// checkValue checks a key and its compact JSON value are valid.
+func (l Limits) checkValue(key string, v json.RawMessage) error {
+	if err := l.checkKey(key); err != nil {
+		return err
+	}
+
+	return l.checkValueSize(v)
+}
+
+// checkValueSize checks the size of a compact JSON value.
+func (l Limits) checkValueSize(v json.RawMessage) error {
+	if l.MaxValueBytes > 0 && len(v) > l.MaxValueBytes {
+		return &limitError{http.StatusRequestEntityTooLarge, fmt.Sprintf(
+			"value is %d bytes, larger than the max-value-bytes limit of %d bytes", len(v), l.MaxValueBytes)}
+	}
+
+	return nil
+}
+
+// checkNewKeys checks n keys can be created without exceeding the maximum
+// number of keys.
+func (h Handler) checkNewKeys(n int) error {
+	if n == 0 || h.limits.MaxKeys <= 0 {
+		return nil
+	}
+
+	count, err := h.root.Len()
+	if err != nil {
+		return err
+	}
+	if count+n > h.limits.MaxKeys {
+		return &limitError{http.StatusBadRequest, fmt.Sprintf(
+			"store has %d keys, creating %d keys exceeds the max-keys limit of %d keys", count, n, h.limits.MaxKeys)}
+	}
+
+	return nil
+}
+
+// Write a violated limit error, a schema error, or a store backend error.
+func writeLimitErr(w http.ResponseWriter, err error) {
+	switch e := err.(type) {
+	case *limitError:
+		writeErr(w, e.code, e.msg)
+		return
+	case *schemaError:
+		writeSchemaErr(w, e)
+		return
+	}
+	writeStoreErr(w, err)
+}
+
+// validate checks the limits are not negative.
+func (l Limits) validate() error {
+	for name, n := range map[string]int{
+		"max-key-length":  l.MaxKeyLength,
+		"max-value-bytes": l.MaxValueBytes,
+		"max-keys":        l.MaxKeys,
+	} {
+		if n < 0 {
+			return fmt.Errorf("invalid %s %d, limits can't be negative", name, n)
+		}
+	}
+
+	return nil
+}
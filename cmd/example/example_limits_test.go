@@ -0,0 +1,88 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+)
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		status   int
+		expected string
+	}{
+		{"longest key", "PUT", "/val/abcde", "1", http.StatusCreated, "{\"abcde\":1}"},
+		{"key too long", "PUT", "/val/abcdef", "1", http.StatusBadRequest,
+			"{\"error\":{\"code\":\"bad_request\",\"message\":\"key is 6 bytes long, longer than the max-key-length limit of 5 bytes\"}}"},
+		{"largest value", "PUT", "/val/a", "\"12345678\"", http.StatusCreated, "{\"a\":\"12345678\"}"},
+		{"value too large", "PUT", "/val/a", "\"123456789\"", http.StatusRequestEntityTooLarge,
+			"{\"error\":{\"code\":\"too_large\",\"message\":\"value is 11 bytes, larger than the max-value-bytes limit of 10 bytes\"}}"},
+		{"compact value", "PUT", "/val/a", "[1, 2, 3, 4]", http.StatusOK, "{\"a\":[1,2,3,4]}"},
+		{"control character", "PUT", "/val/a%0Ab", "1", http.StatusBadRequest,
+			"{\"error\":{\"code\":\"bad_request\",\"message\":\"key has a control character U+000A\"}}"},
+		{"key pattern", "PUT", "/val/A", "1", http.StatusBadRequest,
+			"{\"error\":{\"code\":\"bad_request\",\"message\":\"key does not match the key-pattern limit ^[a-z0-9]+$\"}}"},
+		{"empty key", "POST", "/val", "{\"\": 1}", http.StatusBadRequest,
+			"{\"error\":{\"code\":\"bad_request\",\"message\":\"key can't be empty\"}}"},
+		{"first invalid key", "POST", "/val", "{\"b\": 1, \"abcdefg\": 1, \"B\": 1}", http.StatusBadRequest,
+			"{\"error\":{\"code\":\"bad_request\",\"message\":\"key does not match the key-pattern limit ^[a-z0-9]+$\"}}"},
+		{"too many new keys", "POST", "/val", "{\"a\": 1, \"b\": 2, \"c\": 3}", http.StatusBadRequest,
+			"{\"error\":{\"code\":\"bad_request\",\"message\":\"store has 2 keys, creating 2 keys exceeds the max-keys limit of 3 keys\"}}"},
+		{"last key", "POST", "/val", "{\"a\": 1, \"b\": 2}", http.StatusCreated, "{\"a\":1,\"b\":2}"},
+		{"one key too many", "PUT", "/val/c", "1", http.StatusBadRequest,
+			"{\"error\":{\"code\":\"bad_request\",\"message\":\"store has 3 keys, creating 1 keys exceeds the max-keys limit of 3 keys\"}}"},
+		{"incr one key too many", "POST", "/val/c/incr", "", http.StatusBadRequest,
+			"{\"error\":{\"code\":\"bad_request\",\"message\":\"store has 3 keys, creating 1 keys exceeds the max-keys limit of 3 keys\"}}"},
+		{"cas one key too many", "POST", "/val/c/cas", "{\"new\": 1}", http.StatusBadRequest,
+			"{\"error\":{\"code\":\"bad_request\",\"message\":\"store has 3 keys, creating 1 keys exceeds the max-keys limit of 3 keys\"}}"},
+		{"modify at max keys", "PUT", "/val/b", "3", http.StatusOK, "{\"b\":3}"},
+		{"patch too large", "PATCH", "/val/b", "{\"x\": 1234567}", http.StatusRequestEntityTooLarge,
+			"{\"error\":{\"code\":\"too_large\",\"message\":\"value is 13 bytes, larger than the max-value-bytes limit of 10 bytes\"}}"},
+		{"namespaced key too long", "PUT", "/ns/n/val/abcdef", "1", http.StatusBadRequest,
+			"{\"error\":{\"code\":\"bad_request\",\"message\":\"key is 6 bytes long, longer than the max-key-length limit of 5 bytes\"}}"},
+	}
+
+	h := newHandler(newMemoryStore())
+	h.limits = Limits{
+		MaxKeyLength:  5,
+		KeyPattern:    regexp.MustCompile(`^[a-z0-9]+$`),
+		MaxValueBytes: 10,
+		MaxKeys:       3,
+	}
+	handler := newHandlerRouter(h)
+
+	for _, tt := range tests {
+		rr := serve(t, handler, tt.method, tt.path, tt.body, "")
+
+		// Check the status code is what we expect.
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				tt.name, status, tt.status)
+		}
+
+		// Check the response body is what we expect.
+		if rr.Body.String() != tt.expected {
+			t.Errorf("%s: handler returned unexpected body: got %v want %v",
+				tt.name, rr.Body.String(), tt.expected)
+		}
+	}
+}
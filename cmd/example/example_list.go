@@ -0,0 +1,229 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/yaacov/gokitty/pkg/mux"
+)
+
+// errNotArray is returned by Push and Pop when a value is not an array.
+var errNotArray = errors.New("value is not an array")
+
+// arrayElements returns the elements of a JSON array value, a nil value is
+// an empty array, elements keep their JSON as is.
+func arrayElements(v json.RawMessage) ([]json.RawMessage, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	// Values are compact JSON, and null unmarshals into a nil slice.
+	var elems []json.RawMessage
+	if len(v) == 0 || v[0] != '[' || json.Unmarshal(v, &elems) != nil {
+		return nil, errNotArray
+	}
+
+	return elems, nil
+}
+
+// pushValue appends an element to a JSON array value, a nil value is an
+// empty array, and returns the new array.
+func pushValue(v, element json.RawMessage) (json.RawMessage, error) {
+	elems, err := arrayElements(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(append(elems, element))
+}
+
+// popValue removes the first, or the last, element of a JSON array value,
+// and returns the new array, and the element, ok is false if the array is
+// empty.
+func popValue(v json.RawMessage, front bool) (rest, element json.RawMessage, ok bool, err error) {
+	elems, err := arrayElements(v)
+	if err != nil || len(elems) == 0 {
+		return v, nil, false, err
+	}
+
+	if front {
+		element, elems = elems[0], elems[1:]
+	} else {
+		element, elems = elems[len(elems)-1], elems[:len(elems)-1]
+	}
+	rest, err = json.Marshal(elems)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if len(elems) == 0 {
+		// Marshal writes an empty slice as null.
+		rest = json.RawMessage("[]")
+	}
+
+	return rest, element, true, nil
+}
+
+// Write an error of a value that is not an array.
+func writeNotArrayErr(w http.ResponseWriter, key string) {
+	writeErr(w, http.StatusConflict, fmt.Sprintf("key %s: %v", key, errNotArray))
+}
+
+// pushVal handles POST "/val/:key/push" requests, appending the JSON body
+// to the array value atomically, keys are created as an empty array first,
+// and keep their time to live, it writes the new length.
+//
+// The max-value-bytes limit is checked before pushing, concurrent pushes
+// may exceed it by their elements.
+func (h Handler) pushVal(w http.ResponseWriter, r *http.Request) {
+	var element json.RawMessage
+
+	// Read body data as json.
+	if err := json.NewDecoder(r.Body).Decode(&element); err != nil {
+		writeErrCode(w, http.StatusBadRequest, errCodeBadJSON, err.Error())
+		return
+	}
+	element = compactJSON(element)
+
+	// Retrieve the ":key" route parameter.
+	key, ok := mux.Var(r, "key")
+	if !ok {
+		writeErr(w, http.StatusInternalServerError, "can't get key")
+		return
+	}
+
+	if err := h.limits.checkValue(key, element); err != nil {
+		writeLimitErr(w, err)
+		return
+	}
+
+	// Check if this is a new key, for reporting the change, and the size
+	// of the array after the push.
+	cur, ok, err := h.store.Get(key)
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+	if pushed, err := pushValue(cur, element); err == nil {
+		if err := h.limits.checkValueSize(pushed); err != nil {
+			writeLimitErr(w, err)
+			return
+		}
+	}
+	if !ok {
+		if err := h.checkNewKeys(1); err != nil {
+			writeLimitErr(w, err)
+			return
+		}
+	}
+
+	v, err := h.store.Push(key, element)
+	if err == errNotArray {
+		writeNotArrayErr(w, key)
+		return
+	}
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+
+	elems, _ := arrayElements(v)
+	if ok {
+		h.publish(eventUpdated, key, v)
+	} else {
+		h.publish(eventCreated, key, v)
+	}
+	w.Header().Set("ETag", valueETag(v))
+
+	// Write response as json.
+	writeJSON(w, map[string]int{key: len(elems)})
+}
+
+// popVal handles POST "/val/:key/pop" requests, removing the first, or the
+// last, element of the array value atomically, and writing it, an optional
+// "side" query parameter, "front" or "back", selects the element, the
+// default is the front.
+func (h Handler) popVal(w http.ResponseWriter, r *http.Request) {
+	front := true
+	switch side := r.URL.Query().Get("side"); side {
+	case "", "front":
+	case "back":
+		front = false
+	default:
+		writeErr(w, http.StatusBadRequest, fmt.Sprintf("invalid side %s, want front or back", side))
+		return
+	}
+
+	// Retrieve the ":key" route parameter.
+	key, ok := mux.Var(r, "key")
+	if !ok {
+		writeErr(w, http.StatusInternalServerError, "can't get key")
+		return
+	}
+
+	element, v, ok, err := h.store.Pop(key, front)
+	if err == errNotArray {
+		writeNotArrayErr(w, key)
+		return
+	}
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+	if v == nil {
+		writeKeyErr(w, key)
+		return
+	}
+	if !ok {
+		writeErr(w, http.StatusNotFound, fmt.Sprintf("array of key %s is empty", key))
+		return
+	}
+	h.publish(eventUpdated, key, v)
+
+	// Write response as json.
+	writeMap(w, map[string]json.RawMessage{key: element})
+}
+
+// lenVal handles GET "/val/:key/len" requests, writing the length of the
+// array value.
+func (h Handler) lenVal(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the ":key" route parameter.
+	key, ok := mux.Var(r, "key")
+	if !ok {
+		writeErr(w, http.StatusInternalServerError, "can't get key")
+		return
+	}
+
+	v, ok, err := h.store.Get(key)
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+	if !ok {
+		writeKeyErr(w, key)
+		return
+	}
+	elems, err := arrayElements(v)
+	if err != nil {
+		writeNotArrayErr(w, key)
+		return
+	}
+
+	writeJSON(w, map[string]int{key: len(elems)})
+}
@@ -0,0 +1,212 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestPushPop(t *testing.T) {
+	h := newHandler(newMemoryStore())
+	handler := newHandlerRouter(h)
+	serve(t, handler, "PUT", "/val/kitty", "\"cat\"", "")
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		status   int
+		expected string
+	}{
+		{"push creates an array", "POST", "/val/queue/push", "{\"a\": [1, 2]}", http.StatusOK,
+			"{\"queue\":1}"},
+		{"push a large number", "POST", "/val/queue/push", "12345678901234567890", http.StatusOK,
+			"{\"queue\":2}"},
+		{"push null", "POST", "/val/queue/push", "null", http.StatusOK, "{\"queue\":3}"},
+		{"push a string", "POST", "/val/queue/push", "\"last\"", http.StatusOK, "{\"queue\":4}"},
+		{"len", "GET", "/val/queue/len", "", http.StatusOK, "{\"queue\":4}"},
+		{"get", "GET", "/val/queue", "", http.StatusOK,
+			"{\"queue\":[{\"a\":[1,2]},12345678901234567890,null,\"last\"]}"},
+		{"pop the front", "POST", "/val/queue/pop", "", http.StatusOK, "{\"queue\":{\"a\":[1,2]}}"},
+		{"pop the back", "POST", "/val/queue/pop?side=back", "", http.StatusOK, "{\"queue\":\"last\"}"},
+		{"pop null", "POST", "/val/queue/pop?side=back", "", http.StatusOK, "{\"queue\":null}"},
+		{"pop a large number", "POST", "/val/queue/pop?side=front", "", http.StatusOK,
+			"{\"queue\":12345678901234567890}"},
+		{"pop empty", "POST", "/val/queue/pop", "", http.StatusNotFound,
+			"{\"error\":{\"code\":\"not_found\",\"message\":\"array of key queue is empty\"}}"},
+		{"get empty", "GET", "/val/queue", "", http.StatusOK, "{\"queue\":[]}"},
+		{"pop missing", "POST", "/val/gorilla/pop", "", http.StatusNotFound,
+			"{\"error\":{\"code\":\"key_not_found\",\"message\":\"can't find key gorilla\"}}"},
+		{"len missing", "GET", "/val/gorilla/len", "", http.StatusNotFound,
+			"{\"error\":{\"code\":\"key_not_found\",\"message\":\"can't find key gorilla\"}}"},
+		{"push not an array", "POST", "/val/kitty/push", "1", http.StatusConflict,
+			"{\"error\":{\"code\":\"conflict\",\"message\":\"key kitty: value is not an array\"}}"},
+		{"pop not an array", "POST", "/val/kitty/pop", "", http.StatusConflict,
+			"{\"error\":{\"code\":\"conflict\",\"message\":\"key kitty: value is not an array\"}}"},
+		{"len not an array", "GET", "/val/kitty/len", "", http.StatusConflict,
+			"{\"error\":{\"code\":\"conflict\",\"message\":\"key kitty: value is not an array\"}}"},
+		{"invalid side", "POST", "/val/queue/pop?side=middle", "", http.StatusBadRequest,
+			"{\"error\":{\"code\":\"bad_request\",\"message\":\"invalid side middle, want front or back\"}}"},
+		{"bad json", "POST", "/val/queue/push", "[", http.StatusBadRequest,
+			"{\"error\":{\"code\":\"bad_json\",\"message\":\"unexpected EOF\"}}"},
+	}
+	for _, tt := range tests {
+		rr := serve(t, handler, tt.method, tt.path, tt.body, "")
+
+		// Check the status code is what we expect.
+		if rr.Code != tt.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				tt.name, rr.Code, tt.status)
+		}
+
+		// Check the response body is what we expect.
+		if rr.Body.String() != tt.expected {
+			t.Errorf("%s: handler returned unexpected body: got %v want %v",
+				tt.name, rr.Body.String(), tt.expected)
+		}
+	}
+
+	// Check pushes and pops are published with the array after the change.
+	w, events, err := h.hub.subscribe("", "queue", 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.hub.unsubscribe(w)
+	expected := []string{
+		"{\"type\":\"created\",\"key\":\"queue\",\"value\":[{\"a\":[1,2]}],\"revision\":2}",
+		"{\"type\":\"updated\",\"key\":\"queue\",\"value\":[{\"a\":[1,2]},12345678901234567890],\"revision\":3}",
+	}
+	if len(events) != 8 {
+		t.Fatalf("watch returned %d events want 8", len(events))
+	}
+	for i, want := range expected {
+		if e, _ := json.Marshal(events[i]); string(e) != want {
+			t.Errorf("watch returned unexpected event: got %s want %s", e, want)
+		}
+	}
+	if e, _ := json.Marshal(events[7]); string(e) != "{\"type\":\"updated\",\"key\":\"queue\",\"value\":[],\"revision\":9}" {
+		t.Errorf("watch returned unexpected last event: %s", e)
+	}
+}
+
+func TestPushLimits(t *testing.T) {
+	h := newHandler(newMemoryStore())
+	h.limits.MaxValueBytes = 11
+	handler := newHandlerRouter(h)
+
+	// Check pushes fail when the array would exceed the value size limit.
+	for i, status := range []int{http.StatusOK, http.StatusOK, http.StatusRequestEntityTooLarge} {
+		rr := serve(t, handler, "POST", "/val/queue/push", "1234", "")
+		if rr.Code != status {
+			t.Errorf("push %d: handler returned wrong status code: got %v want %v", i, rr.Code, status)
+		}
+	}
+}
+
+func TestArrayValues(t *testing.T) {
+	for _, v := range []string{"null", "{}", "1", "\"[1]\""} {
+		if _, err := pushValue(json.RawMessage(v), json.RawMessage("1")); err != errNotArray {
+			t.Errorf("pushValue of %s: got %v want errNotArray", v, err)
+		}
+		if _, _, _, err := popValue(json.RawMessage(v), true); err != errNotArray {
+			t.Errorf("popValue of %s: got %v want errNotArray", v, err)
+		}
+	}
+
+	if _, _, ok, err := popValue(nil, true); ok || err != nil {
+		t.Errorf("popValue of a missing value: got %v, %v want not ok", ok, err)
+	}
+	rest, element, ok, err := popValue(json.RawMessage(`[1.50,"a"]`), true)
+	if !ok || err != nil || string(element) != "1.50" || string(rest) != `["a"]` {
+		t.Errorf("popValue: got %s, %s, %v, %v want 1.50 and [\"a\"]", rest, element, ok, err)
+	}
+}
+
+// testConcurrentPushPop checks parallel pushes and pops of a store never
+// lose or duplicate an element.
+func testConcurrentPushPop(t *testing.T, store Store) {
+	handler := newStoreRouter(store)
+
+	const pushers, pops, pushes = 8, 20, 25
+	var mu sync.Mutex
+	popped := make(map[string]int)
+
+	var wg sync.WaitGroup
+	for i := 0; i < pushers; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < pushes; j++ {
+				rr := serve(t, handler, "POST", "/val/queue/push", fmt.Sprint(i*pushes+j), "")
+				if rr.Code != http.StatusOK {
+					t.Errorf("push returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+				}
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+
+			// Pop from both sides, retrying while the queue is empty.
+			side := []string{"front", "back"}[i%2]
+			for n := 0; n < pops; {
+				rr := serve(t, handler, "POST", "/val/queue/pop?side="+side, "", "")
+				if rr.Code == http.StatusNotFound {
+					continue
+				}
+
+				var m map[string]json.RawMessage
+				if err := json.Unmarshal(rr.Body.Bytes(), &m); err != nil || rr.Code != http.StatusOK {
+					t.Errorf("pop returned %v %s", rr.Code, rr.Body.String())
+					return
+				}
+				mu.Lock()
+				popped[string(m["queue"])]++
+				mu.Unlock()
+				n++
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Check every pushed element was popped, or is left, exactly once.
+	v, _, _ := store.Get("queue")
+	left, err := arrayElements(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range left {
+		popped[string(e)]++
+	}
+	if len(left) != pushers*(pushes-pops) || len(popped) != pushers*pushes {
+		t.Errorf("got %d elements left, and %d distinct elements want %d and %d",
+			len(left), len(popped), pushers*(pushes-pops), pushers*pushes)
+	}
+	for e, n := range popped {
+		if n != 1 {
+			t.Errorf("element %s was seen %d times", e, n)
+		}
+	}
+}
+
+func TestMemoryStoreConcurrentPushPop(t *testing.T) {
+	testConcurrentPushPop(t, newMemoryStore())
+}
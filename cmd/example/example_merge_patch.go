@@ -0,0 +1,70 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package main
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// mergePatch applies a JSON Merge Patch (RFC 7386) to a JSON document, and
+// returns the compact patched document.
+//
+// Objects are merged recursively, null members of the patch remove members
+// of the document, and other patch values replace the document.
+func mergePatch(doc, patch json.RawMessage) (json.RawMessage, error) {
+	var d, p interface{}
+	if err := unmarshalNumbers(doc, &d); err != nil {
+		return nil, err
+	}
+	if err := unmarshalNumbers(patch, &p); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(mergeValues(d, p))
+}
+
+// mergeValues merges a decoded patch into a decoded document.
+func mergeValues(doc, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	d, ok := doc.(map[string]interface{})
+	if !ok {
+		d = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(d, k)
+			continue
+		}
+		d[k] = mergeValues(d[k], v)
+	}
+
+	return d
+}
+
+// unmarshalNumbers decodes JSON, keeping numbers as json.Number, so numbers
+// are not rounded to float64.
+func unmarshalNumbers(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	return decoder.Decode(v)
+}
@@ -0,0 +1,92 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package main
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/yaacov/gokitty/pkg/mux"
+)
+
+// getMeta handles GET "/val/:key/meta" requests, writing the times a key was
+// created and last modified.
+func (h Handler) getMeta(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the ":key" route parameter.
+	key, ok := mux.Var(r, "key")
+	if !ok {
+		writeErr(w, http.StatusInternalServerError, "can't get key")
+		return
+	}
+
+	metas, err := h.store.Meta([]string{key})
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+	m, ok := metas[key]
+	if !ok {
+		writeKeyErr(w, key)
+		return
+	}
+
+	writeJSON(w, map[string]KeyMeta{key: m})
+}
+
+// writeKeyNotModified sets the ETag, and the Last-Modified header of a key,
+// and writes a 304 Not Modified response if the request already has this
+// ETag, or, without an If-None-Match header, if the key was not modified
+// since its If-Modified-Since header, reporting if the response was written.
+func writeKeyNotModified(w http.ResponseWriter, r *http.Request, m KeyMeta, etag string) bool {
+	// Keys without metadata have no Last-Modified header.
+	modified := m.UpdatedAt
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	if r.Header.Get("If-None-Match") != "" || !notModifiedSince(r, modified) {
+		return writeNotModified(w, r, etag)
+	}
+
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// notModifiedSince checks if a request If-Modified-Since header is not
+// before modified, HTTP dates have a precision of a second.
+func notModifiedSince(r *http.Request, modified time.Time) bool {
+	if modified.IsZero() || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+
+	return !modified.Truncate(time.Second).After(since)
+}
+
+// pageMeta returns the metadata of the keys of a page of key value pairs.
+func (h Handler) pageMeta(items map[string]json.RawMessage) (map[string]KeyMeta, error) {
+	keys := make([]string, 0, len(items))
+	for k := range items {
+		keys = append(keys, k)
+	}
+
+	return h.store.Meta(keys)
+}
@@ -0,0 +1,230 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// epochMeta is the JSON metadata of a key written at the Unix epoch.
+const epochMeta = `{"created_at":"1970-01-01T00:00:00Z","updated_at":"1970-01-01T00:00:00Z"}`
+
+// epochClock returns a clock at the Unix epoch.
+func epochClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0)}
+}
+
+func TestMeta(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)}
+	store := newMemoryStore()
+	store.now = clock.Now
+	handler := newStoreRouter(store)
+
+	created := clock.Now()
+	serve(t, handler, "PUT", "/val/kitty", "\"cat\"", "")
+	clock.Add(time.Minute)
+
+	// Check no-op PUTs keep the modification time.
+	if rr := serve(t, handler, "PUT", "/val/kitty", "\"cat\"", ""); rr.Code != http.StatusNotModified {
+		t.Errorf("no-op PUT: got %v want %v", rr.Code, http.StatusNotModified)
+	}
+	expected := "{\"kitty\":{\"created_at\":\"2019-01-02T03:04:05Z\",\"updated_at\":\"2019-01-02T03:04:05Z\"}}"
+	if rr := serve(t, handler, "GET", "/val/kitty/meta", "", ""); rr.Body.String() != expected {
+		t.Errorf("meta: got %s want %s", rr.Body.String(), expected)
+	}
+
+	// Check changes keep the creation time.
+	updated := clock.Now()
+	serve(t, handler, "PUT", "/val/kitty", "\"tiger\"", "")
+	clock.Add(time.Minute)
+	expected = "{\"kitty\":{\"created_at\":\"2019-01-02T03:04:05Z\",\"updated_at\":\"2019-01-02T03:05:05Z\"}}"
+	if rr := serve(t, handler, "GET", "/val/kitty/meta", "", ""); rr.Body.String() != expected {
+		t.Errorf("meta: got %s want %s", rr.Body.String(), expected)
+	}
+
+	// Check GET and HEAD responses have the modification time.
+	for _, method := range []string{"GET", "HEAD"} {
+		rr := serve(t, handler, method, "/val/kitty", "", "")
+		if got := rr.Header().Get("Last-Modified"); got != updated.Format(http.TimeFormat) {
+			t.Errorf("%s: got Last-Modified %q want %q", method, got, updated.Format(http.TimeFormat))
+		}
+	}
+
+	// Check If-Modified-Since requests, If-None-Match takes precedence.
+	tests := []struct {
+		name        string
+		since       time.Time
+		ifNoneMatch string
+		status      int
+	}{
+		{"not modified", updated, "", http.StatusNotModified},
+		{"not modified later", updated.Add(time.Hour), "", http.StatusNotModified},
+		{"modified", created, "", http.StatusOK},
+		{"etag precedence", updated, "\"dog\"", http.StatusOK},
+	}
+	for _, tt := range tests {
+		for _, method := range []string{"GET", "HEAD"} {
+			req, err := http.NewRequest(method, "/val/kitty", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("If-Modified-Since", tt.since.Format(http.TimeFormat))
+			if tt.ifNoneMatch != "" {
+				req.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != tt.status {
+				t.Errorf("%s %s: got %v want %v", tt.name, method, rr.Code, tt.status)
+			}
+			if rr.Code == http.StatusNotModified && rr.Body.Len() != 0 {
+				t.Errorf("%s %s: 304 response has a body", tt.name, method)
+			}
+		}
+	}
+
+	// Check keys created again are new keys, and missing keys have no
+	// metadata.
+	serve(t, handler, "DELETE", "/val/kitty", "", "")
+	serve(t, handler, "PUT", "/val/kitty", "\"cat\"", "")
+	expected = "{\"kitty\":{\"created_at\":\"2019-01-02T03:06:05Z\",\"updated_at\":\"2019-01-02T03:06:05Z\"}}"
+	if rr := serve(t, handler, "GET", "/val/kitty/meta", "", ""); rr.Body.String() != expected {
+		t.Errorf("meta: got %s want %s", rr.Body.String(), expected)
+	}
+	if rr := serve(t, handler, "GET", "/val/dog/meta", "", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("missing key: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	// Check namespaced keys have metadata.
+	serve(t, handler, "PUT", "/ns/cats/val/tom", "1", "")
+	if rr := serve(t, handler, "GET", "/ns/cats/val/tom/meta", "", ""); !strings.HasPrefix(rr.Body.String(), "{\"tom\":{\"created_at\"") {
+		t.Errorf("namespace meta: got %s", rr.Body.String())
+	}
+}
+
+func TestListMeta(t *testing.T) {
+	store := newMemoryStore()
+	store.now = epochClock().Now
+	handler := newStoreRouter(store)
+	serve(t, handler, "PUT", "/val/kitty", "\"cat\"", "")
+	serve(t, handler, "PUT", "/val/tom", "1", "")
+
+	tests := []struct {
+		path     string
+		status   int
+		expected string
+	}{
+		{"/val?meta=true&limit=1", http.StatusOK,
+			"{\"items\":{\"kitty\":\"cat\"},\"meta\":{\"kitty\":" + epochMeta + "},\"next_cursor\":\"a2l0dHk\"}"},
+		{"/val?meta=true", http.StatusOK,
+			"{\"items\":{\"kitty\":\"cat\",\"tom\":1},\"meta\":{\"kitty\":" + epochMeta + ",\"tom\":" + epochMeta + "}}"},
+		{"/val?meta=false", http.StatusOK, "{\"items\":{\"kitty\":\"cat\",\"tom\":1}}"},
+		{"/val?meta=purr", http.StatusBadRequest, "{\"error\":{\"code\":\"bad_request\",\"message\":\"meta must be true or false\"}}"},
+	}
+
+	for _, tt := range tests {
+		rr := serve(t, handler, "GET", tt.path, "", "")
+
+		// Check the status code and body are what we expect.
+		if rr.Code != tt.status || strings.TrimSpace(rr.Body.String()) != tt.expected {
+			t.Errorf("%s: got %v %s want %v %s", tt.path, rr.Code, rr.Body.String(), tt.status, tt.expected)
+		}
+	}
+}
+
+func TestStoreMeta(t *testing.T) {
+	quietLogs(t)
+
+	dir := t.TempDir()
+	stores := []struct {
+		name   string
+		open   func(clock *fakeClock) Store
+		closer func(s Store)
+	}{
+		{"memory", func(clock *fakeClock) Store {
+			s := newMemoryStore()
+			s.now = clock.Now
+			return s
+		}, nil},
+		{"file", func(clock *fakeClock) Store {
+			return newFileStoreWithClock(filepath.Join(dir, "kitty.json"), 0, clock.Now)
+		}, func(s Store) { s.(*FileStore).Close() }},
+		{"wal", func(clock *fakeClock) Store {
+			return walStore(filepath.Join(dir, "kitty-wal.json"), clock.Now)
+		}, func(s Store) {
+			// Leave the log open, as a crash does, so it is replayed.
+		}},
+		{"bolt", func(clock *fakeClock) Store {
+			s := openBoltStore(t, filepath.Join(dir, "kitty.db"))
+			s.now = clock.Now
+			return s
+		}, func(s Store) { s.(*BoltStore).Close() }},
+	}
+
+	for _, tt := range stores {
+		clock := epochClock()
+		s := tt.open(clock)
+		s.UpsertTTL("expiring", json.RawMessage(`1`), time.Second)
+		s.Upsert("kitty", json.RawMessage(`"cat"`))
+		clock.Add(time.Minute)
+		s.Incr("visits", 1)
+		s.Upsert("kitty", json.RawMessage(`"tiger"`))
+
+		// Check writes keep the creation time, and expired keys are
+		// created again.
+		s.Upsert("expiring", json.RawMessage(`2`))
+		epoch, minute := time.Unix(0, 0).UTC(), time.Unix(60, 0).UTC()
+		expected := map[string]KeyMeta{
+			"kitty":    {CreatedAt: epoch, UpdatedAt: minute},
+			"visits":   {CreatedAt: minute, UpdatedAt: minute},
+			"expiring": {CreatedAt: minute, UpdatedAt: minute},
+		}
+		metas, err := s.Meta([]string{"kitty", "visits", "expiring", "dog"})
+		if err != nil || len(metas) != len(expected) {
+			t.Fatalf("%s: got %v, %v want %v", tt.name, metas, err, expected)
+		}
+		for k, m := range expected {
+			if !metas[k].CreatedAt.Equal(m.CreatedAt) || !metas[k].UpdatedAt.Equal(m.UpdatedAt) {
+				t.Errorf("%s: %s: got %v want %v", tt.name, k, metas[k], m)
+			}
+		}
+
+		// Check persistent stores keep the metadata after a restart.
+		if tt.closer == nil {
+			continue
+		}
+		tt.closer(s)
+		clock.Add(time.Hour)
+		s = tt.open(clock)
+		metas, err = s.Meta([]string{"kitty"})
+		if err != nil || !metas["kitty"].CreatedAt.Equal(epoch) || !metas["kitty"].UpdatedAt.Equal(minute) {
+			t.Errorf("%s: after a restart: got %v, %v", tt.name, metas, err)
+		}
+
+		// Check deleted keys have no metadata.
+		s.Delete("kitty")
+		if metas, _ := s.Meta([]string{"kitty"}); len(metas) != 0 {
+			t.Errorf("%s: deleted key: got %v", tt.name, metas)
+		}
+		tt.closer(s)
+	}
+}
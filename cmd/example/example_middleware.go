@@ -17,16 +17,40 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"net/http"
+	"time"
+
+	"github.com/yaacov/gokitty/pkg/middleware"
 )
 
-// logging middleware.
-func logging(logger *log.Logger) func(http.Handler) http.Handler {
+// parseLogFormat parses a log format name, "text" or "json".
+func parseLogFormat(name string) (middleware.Format, error) {
+	switch name {
+	case "text":
+		return middleware.TextFormat, nil
+	case "json":
+		return middleware.JSONFormat, nil
+	}
+
+	return 0, fmt.Errorf("invalid log-format %q, want text or json", name)
+}
+
+// logging middleware, logs requests with their status, size, latency, route
+// and request ID, JSON lines are written without the logger prefix.
+func logging(logger *log.Logger, format middleware.Format, now func() time.Time) func(http.Handler) http.Handler {
+	if format == middleware.JSONFormat {
+		logger = log.New(logger.Writer(), "", 0)
+	}
+	logRequests := middleware.Logger(middleware.LoggerOptions{
+		Logger: logger,
+		Format: format,
+		Now:    now,
+	})
+	assignIDs := middleware.AssignRequestID(middleware.RequestIDOptions{})
+
 	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			logger.Println(r.Method, r.URL.Path, r.RemoteAddr, r.UserAgent())
-			next.ServeHTTP(w, r)
-		})
+		return logRequests(assignIDs(next))
 	}
 }
@@ -0,0 +1,79 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yaacov/gokitty/pkg/middleware"
+)
+
+func TestLogging(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   middleware.Format
+		expected string
+	}{
+		{"text", middleware.TextFormat,
+			"kitty: PUT /val/kitty 201 15 1.5ms /val/:key kitty-1 192.0.2.1:1234 kitty-test\n"},
+		{"json", middleware.JSONFormat,
+			"{\"ts\":\"2019-01-02T03:04:05Z\",\"level\":\"info\",\"method\":\"PUT\",\"path\":\"/val/kitty\"," +
+				"\"route\":\"/val/:key\",\"request_id\":\"kitty-1\",\"status\":201,\"bytes\":15," +
+				"\"duration_ms\":1.5,\"remote\":\"192.0.2.1:1234\",\"user_agent\":\"kitty-test\"}\n"},
+	}
+
+	for _, tt := range tests {
+		clock := &fakeClock{now: time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)}
+		router := newRouter()
+		slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			clock.Add(1500 * time.Microsecond)
+			router.ServeHTTP(w, r)
+		})
+
+		var out bytes.Buffer
+		handler := logging(log.New(&out, "kitty: ", 0), tt.format, clock.Now)(slow)
+
+		req, err := http.NewRequest("PUT", "/val/kitty", strings.NewReader("\"cat\""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("User-Agent", "kitty-test")
+		req.Header.Set(middleware.DefaultRequestIDHeader, "kitty-1")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		// Check the log line is what we expect.
+		if out.String() != tt.expected {
+			t.Errorf("%s: logging wrote unexpected line: got %q want %q",
+				tt.name, out.String(), tt.expected)
+		}
+	}
+}
+
+func TestParseLogFormat(t *testing.T) {
+	if format, err := parseLogFormat("json"); format != middleware.JSONFormat || err != nil {
+		t.Errorf("parseLogFormat(json): got %v, %v", format, err)
+	}
+	if _, err := parseLogFormat("xml"); err == nil {
+		t.Errorf("parseLogFormat(xml): got no error")
+	}
+}
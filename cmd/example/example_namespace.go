@@ -0,0 +1,714 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package main
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/yaacov/gokitty/pkg/mux"
+)
+
+// Namespaces are stored in the store of the default namespace, as compound
+// keys, "\x00ns/" + url.PathEscape(namespace) + "/" + key.
+//
+// The escaped namespace has no "/", so a namespace prefix never matches
+// keys of another namespace, and keys of the default namespace can't start
+// with a NUL character, so they never match keys of namespaces.
+const namespaceKeyPrefix = "\x00ns/"
+
+// namespacesEnd is greater than all the keys of namespaces.
+const namespacesEnd = "\x00ns0"
+
+// errReservedKey is returned when writing a key of the default namespace
+// that starts with a NUL character.
+var errReservedKey = errors.New("keys can't start with a NUL character")
+
+// namespacePrefix returns the prefix of the keys of a namespace.
+func namespacePrefix(namespace string) string {
+	return namespaceKeyPrefix + url.PathEscape(namespace) + "/"
+}
+
+// reservedKey checks if a key of the default namespace is reserved for
+// namespaces.
+func reservedKey(k string) bool {
+	return strings.HasPrefix(k, "\x00")
+}
+
+// splitNamespaceKey returns the namespace and the key of a key of the
+// default namespace store, keys that are not compound keys are keys of
+// the default namespace.
+func splitNamespaceKey(k string) (string, string) {
+	if !strings.HasPrefix(k, namespaceKeyPrefix) {
+		return "", k
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(k, namespaceKeyPrefix), "/", 2)
+	namespace, err := url.PathUnescape(parts[0])
+	if err != nil || len(parts) != 2 {
+		return "", k
+	}
+
+	return namespace, parts[1]
+}
+
+// namespaceStore is the Store of one namespace, the keys of the namespace
+// are the keys of the parent store with the namespace prefix.
+//
+// The revision is the revision of the parent store, it changes when any
+// namespace changes.
+type namespaceStore struct {
+	parent Store
+	prefix string
+}
+
+func newNamespaceStore(parent Store, namespace string) *namespaceStore {
+	s := namespaceStore{
+		parent: parent,
+		prefix: namespacePrefix(namespace),
+	}
+
+	return &s
+}
+
+// Get returns the value of a key.
+func (s *namespaceStore) Get(k string) (json.RawMessage, bool, error) {
+	return s.parent.Get(s.prefix + k)
+}
+
+// GetWithETag returns the value of a key, and its ETag.
+func (s *namespaceStore) GetWithETag(k string) (json.RawMessage, string, bool, error) {
+	return s.parent.GetWithETag(s.prefix + k)
+}
+
+// GetMany returns the values of keys that are not missing.
+func (s *namespaceStore) GetMany(keys []string) (map[string]json.RawMessage, error) {
+	vals, err := s.parent.GetMany(s.keys(keys))
+	if err != nil {
+		return nil, err
+	}
+
+	return s.trim(vals), nil
+}
+
+// Meta returns the metadata of keys that are not missing.
+func (s *namespaceStore) Meta(keys []string) (map[string]KeyMeta, error) {
+	metas, err := s.parent.Meta(s.keys(keys))
+	if err != nil {
+		return nil, err
+	}
+
+	trimmed := make(map[string]KeyMeta, len(metas))
+	for k, m := range metas {
+		trimmed[strings.TrimPrefix(k, s.prefix)] = m
+	}
+
+	return trimmed, nil
+}
+
+// Len returns the number of keys of the namespace.
+func (s *namespaceStore) Len() (int, error) {
+	vals, _, err := s.parent.ListPage(s.prefix, "", 0)
+
+	return len(vals), err
+}
+
+// List returns a copy of the key value pairs.
+func (s *namespaceStore) List() (map[string]json.RawMessage, error) {
+	vals, _, err := s.parent.ListPage(s.prefix, "", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.trim(vals), nil
+}
+
+// ListPage returns a page of key value pairs with a prefix.
+func (s *namespaceStore) ListPage(prefix, cursor string, limit int) (map[string]json.RawMessage, string, error) {
+	if cursor != "" {
+		cursor = s.prefix + cursor
+	}
+
+	page, next, err := s.parent.ListPage(s.prefix+prefix, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return s.trim(page), strings.TrimPrefix(next, s.prefix), nil
+}
+
+// Upsert creates or modifies a key value pair, that never expires.
+func (s *namespaceStore) Upsert(k string, v json.RawMessage) error {
+	return s.parent.Upsert(s.prefix+k, v)
+}
+
+// UpsertTTL creates or modifies a key value pair, that expires after ttl.
+func (s *namespaceStore) UpsertTTL(k string, v json.RawMessage, ttl time.Duration) error {
+	return s.parent.UpsertTTL(s.prefix+k, v, ttl)
+}
+
+// UpsertRaw creates or modifies a key with a raw value.
+func (s *namespaceStore) UpsertRaw(k string, data []byte, contentType string, ttl time.Duration) error {
+	return s.parent.UpsertRaw(s.prefix+k, data, contentType, ttl)
+}
+
+// TTL returns the remaining time to live of a key.
+func (s *namespaceStore) TTL(k string) (time.Duration, bool, error) {
+	return s.parent.TTL(s.prefix + k)
+}
+
+// Delete removes a key.
+func (s *namespaceStore) Delete(k string) (bool, error) {
+	return s.parent.Delete(s.prefix + k)
+}
+
+// DeleteKeys removes keys atomically.
+func (s *namespaceStore) DeleteKeys(keys []string) ([]bool, error) {
+	return s.parent.DeleteKeys(s.keys(keys))
+}
+
+// DeletePrefix removes the keys with a prefix atomically.
+func (s *namespaceStore) DeletePrefix(prefix string) ([]string, error) {
+	deleted, err := s.parent.DeletePrefix(s.prefix + prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, k := range deleted {
+		deleted[i] = strings.TrimPrefix(k, s.prefix)
+	}
+
+	return deleted, nil
+}
+
+// Clear removes all the keys of the namespace atomically.
+func (s *namespaceStore) Clear() (int, error) {
+	deleted, err := s.parent.DeletePrefix(s.prefix)
+
+	return len(deleted), err
+}
+
+// DeleteExpired removes expired keys, of all the namespaces.
+func (s *namespaceStore) DeleteExpired() (int, error) {
+	return s.parent.DeleteExpired()
+}
+
+// Incr adds delta to the integer value of a key atomically.
+func (s *namespaceStore) Incr(k string, delta int64) (int64, error) {
+	return s.parent.Incr(s.prefix+k, delta)
+}
+
+// CompareAndSwap replaces the value of a key atomically, if it equals old.
+func (s *namespaceStore) CompareAndSwap(k string, old, replacement json.RawMessage) (json.RawMessage, bool, bool, error) {
+	return s.parent.CompareAndSwap(s.prefix+k, old, replacement)
+}
+
+// Push appends an element to the array value of a key atomically.
+func (s *namespaceStore) Push(k string, element json.RawMessage) (json.RawMessage, error) {
+	return s.parent.Push(s.prefix+k, element)
+}
+
+// Pop removes the first, or the last, element of the array value of a key
+// atomically.
+func (s *namespaceStore) Pop(k string, front bool) (json.RawMessage, json.RawMessage, bool, error) {
+	return s.parent.Pop(s.prefix+k, front)
+}
+
+// Txn applies a transaction atomically, if all its checks pass.
+func (s *namespaceStore) Txn(ops []TxnOp) (int, json.RawMessage, []bool, error) {
+	prefixed := make([]TxnOp, len(ops))
+	for i, op := range ops {
+		prefixed[i] = TxnOp{Op: op.Op, Key: s.prefix + op.Key, Value: op.Value}
+	}
+
+	return s.parent.Txn(prefixed)
+}
+
+// Trash moves a key to the trash.
+func (s *namespaceStore) Trash(k string) (bool, error) {
+	return s.parent.Trash(s.prefix + k)
+}
+
+// ListTrash returns the trashed keys with a prefix, in key order.
+func (s *namespaceStore) ListTrash(prefix string) ([]TrashedKey, error) {
+	trashed, err := s.parent.ListTrash(s.prefix + prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range trashed {
+		trashed[i].Key = strings.TrimPrefix(trashed[i].Key, s.prefix)
+	}
+
+	return trashed, nil
+}
+
+// Restore moves a key from the trash back.
+func (s *namespaceStore) Restore(k string) (json.RawMessage, bool, error) {
+	return s.parent.Restore(s.prefix + k)
+}
+
+// DeleteTrashed removes a key from the trash.
+func (s *namespaceStore) DeleteTrashed(k string) (bool, error) {
+	return s.parent.DeleteTrashed(s.prefix + k)
+}
+
+// PurgeTrash removes the keys trashed more than retention ago, of all the
+// namespaces.
+func (s *namespaceStore) PurgeTrash(retention time.Duration) (int, error) {
+	return s.parent.PurgeTrash(retention)
+}
+
+// Stats returns the statistics of the parent store, of all the namespaces.
+func (s *namespaceStore) Stats() (StoreStats, error) {
+	return s.parent.Stats()
+}
+
+// Revision returns the revision of the parent store.
+func (s *namespaceStore) Revision() (uint64, error) {
+	return s.parent.Revision()
+}
+
+// keys returns the keys with the namespace prefix.
+func (s *namespaceStore) keys(keys []string) []string {
+	prefixed := make([]string, len(keys))
+	for i, k := range keys {
+		prefixed[i] = s.prefix + k
+	}
+
+	return prefixed
+}
+
+// trim returns key value pairs without the namespace prefix.
+func (s *namespaceStore) trim(vals map[string]json.RawMessage) map[string]json.RawMessage {
+	trimmed := make(map[string]json.RawMessage, len(vals))
+	for k, v := range vals {
+		trimmed[strings.TrimPrefix(k, s.prefix)] = v
+	}
+
+	return trimmed
+}
+
+// defaultNamespaceStore is the Store of the default namespace, it hides
+// the keys of namespaces, and rejects keys reserved for namespaces.
+type defaultNamespaceStore struct {
+	Store
+}
+
+func newDefaultNamespaceStore(store Store) *defaultNamespaceStore {
+	return &defaultNamespaceStore{Store: store}
+}
+
+// Get returns the value of a key, reserved keys are missing.
+func (s *defaultNamespaceStore) Get(k string) (json.RawMessage, bool, error) {
+	if reservedKey(k) {
+		return nil, false, nil
+	}
+
+	return s.Store.Get(k)
+}
+
+// GetWithETag returns the value of a key, and its ETag, reserved keys are
+// missing.
+func (s *defaultNamespaceStore) GetWithETag(k string) (json.RawMessage, string, bool, error) {
+	if reservedKey(k) {
+		return nil, "", false, nil
+	}
+
+	return s.Store.GetWithETag(k)
+}
+
+// GetMany returns the values of keys that are not missing.
+func (s *defaultNamespaceStore) GetMany(keys []string) (map[string]json.RawMessage, error) {
+	vals, err := s.Store.GetMany(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	for k := range vals {
+		if reservedKey(k) {
+			delete(vals, k)
+		}
+	}
+
+	return vals, nil
+}
+
+// Meta returns the metadata of keys that are not missing, reserved keys
+// are missing.
+func (s *defaultNamespaceStore) Meta(keys []string) (map[string]KeyMeta, error) {
+	metas, err := s.Store.Meta(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	for k := range metas {
+		if reservedKey(k) {
+			delete(metas, k)
+		}
+	}
+
+	return metas, nil
+}
+
+// Len returns the number of keys, without namespaces.
+func (s *defaultNamespaceStore) Len() (int, error) {
+	vals, err := s.List()
+
+	return len(vals), err
+}
+
+// List returns a copy of the key value pairs, without namespaces.
+func (s *defaultNamespaceStore) List() (map[string]json.RawMessage, error) {
+	vals, err := s.Store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	for k := range vals {
+		if reservedKey(k) {
+			delete(vals, k)
+		}
+	}
+
+	return vals, nil
+}
+
+// ListPage returns a page of key value pairs with a prefix, starting after
+// the keys of namespaces, that sort first.
+func (s *defaultNamespaceStore) ListPage(prefix, cursor string, limit int) (map[string]json.RawMessage, string, error) {
+	if reservedKey(prefix) {
+		return map[string]json.RawMessage{}, "", nil
+	}
+	if cursor < namespacesEnd {
+		cursor = namespacesEnd
+	}
+
+	return s.Store.ListPage(prefix, cursor, limit)
+}
+
+// Upsert creates or modifies a key value pair, that never expires.
+func (s *defaultNamespaceStore) Upsert(k string, v json.RawMessage) error {
+	if reservedKey(k) {
+		return errReservedKey
+	}
+
+	return s.Store.Upsert(k, v)
+}
+
+// UpsertTTL creates or modifies a key value pair, that expires after ttl.
+func (s *defaultNamespaceStore) UpsertTTL(k string, v json.RawMessage, ttl time.Duration) error {
+	if reservedKey(k) {
+		return errReservedKey
+	}
+
+	return s.Store.UpsertTTL(k, v, ttl)
+}
+
+// UpsertRaw creates or modifies a key with a raw value, that is not
+// reserved.
+func (s *defaultNamespaceStore) UpsertRaw(k string, data []byte, contentType string, ttl time.Duration) error {
+	if reservedKey(k) {
+		return errReservedKey
+	}
+
+	return s.Store.UpsertRaw(k, data, contentType, ttl)
+}
+
+// TTL returns the remaining time to live of a key.
+func (s *defaultNamespaceStore) TTL(k string) (time.Duration, bool, error) {
+	if reservedKey(k) {
+		return 0, false, nil
+	}
+
+	return s.Store.TTL(k)
+}
+
+// Delete removes a key, reserved keys are missing.
+func (s *defaultNamespaceStore) Delete(k string) (bool, error) {
+	if reservedKey(k) {
+		return false, nil
+	}
+
+	return s.Store.Delete(k)
+}
+
+// DeleteKeys removes keys atomically, reserved keys are missing.
+func (s *defaultNamespaceStore) DeleteKeys(keys []string) ([]bool, error) {
+	allowed := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if !reservedKey(k) {
+			allowed = append(allowed, k)
+		}
+	}
+
+	deleted, err := s.Store.DeleteKeys(allowed)
+	if err != nil {
+		return nil, err
+	}
+
+	// Report reserved keys as missing.
+	result := make([]bool, len(keys))
+	j := 0
+	for i, k := range keys {
+		if !reservedKey(k) {
+			result[i] = deleted[j]
+			j++
+		}
+	}
+
+	return result, nil
+}
+
+// DeletePrefix removes the keys with a prefix atomically, reserved keys are
+// missing.
+//
+// Keys of namespaces have the empty prefix, so the keys of the default
+// namespace are listed, then deleted atomically, keys created in between
+// are not removed.
+func (s *defaultNamespaceStore) DeletePrefix(prefix string) ([]string, error) {
+	if reservedKey(prefix) {
+		return []string{}, nil
+	}
+	if prefix != "" {
+		return s.Store.DeletePrefix(prefix)
+	}
+
+	vals, _, err := s.ListPage("", "", 0)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(vals))
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	deleted, err := s.Store.DeleteKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+	removed := make([]string, 0, len(keys))
+	for i, ok := range deleted {
+		if ok {
+			removed = append(removed, keys[i])
+		}
+	}
+
+	return removed, nil
+}
+
+// Clear removes all the keys of the default namespace.
+func (s *defaultNamespaceStore) Clear() (int, error) {
+	deleted, err := s.DeletePrefix("")
+
+	return len(deleted), err
+}
+
+// Incr adds delta to the integer value of a key atomically.
+func (s *defaultNamespaceStore) Incr(k string, delta int64) (int64, error) {
+	if reservedKey(k) {
+		return 0, errReservedKey
+	}
+
+	return s.Store.Incr(k, delta)
+}
+
+// Push appends an element to the array value of a key atomically.
+func (s *defaultNamespaceStore) Push(k string, element json.RawMessage) (json.RawMessage, error) {
+	if reservedKey(k) {
+		return nil, errReservedKey
+	}
+
+	return s.Store.Push(k, element)
+}
+
+// Pop removes the first, or the last, element of the array value of a key
+// atomically.
+func (s *defaultNamespaceStore) Pop(k string, front bool) (json.RawMessage, json.RawMessage, bool, error) {
+	if reservedKey(k) {
+		return nil, nil, false, errReservedKey
+	}
+
+	return s.Store.Pop(k, front)
+}
+
+// CompareAndSwap replaces the value of a key atomically, if it equals old.
+func (s *defaultNamespaceStore) CompareAndSwap(k string, old, replacement json.RawMessage) (json.RawMessage, bool, bool, error) {
+	if reservedKey(k) {
+		return nil, false, false, errReservedKey
+	}
+
+	return s.Store.CompareAndSwap(k, old, replacement)
+}
+
+// Txn applies a transaction atomically, if all its checks pass, it fails
+// if a key is reserved.
+func (s *defaultNamespaceStore) Txn(ops []TxnOp) (int, json.RawMessage, []bool, error) {
+	for _, op := range ops {
+		if reservedKey(op.Key) {
+			return -1, nil, nil, errReservedKey
+		}
+	}
+
+	return s.Store.Txn(ops)
+}
+
+// Trash moves a key to the trash, reserved keys are missing.
+func (s *defaultNamespaceStore) Trash(k string) (bool, error) {
+	if reservedKey(k) {
+		return false, nil
+	}
+
+	return s.Store.Trash(k)
+}
+
+// ListTrash returns the trashed keys with a prefix, in key order, without
+// the trashed keys of namespaces.
+func (s *defaultNamespaceStore) ListTrash(prefix string) ([]TrashedKey, error) {
+	if reservedKey(prefix) {
+		return []TrashedKey{}, nil
+	}
+
+	trashed, err := s.Store.ListTrash(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := trashed[:0]
+	for _, t := range trashed {
+		if !reservedKey(t.Key) {
+			allowed = append(allowed, t)
+		}
+	}
+
+	return allowed, nil
+}
+
+// Restore moves a key from the trash back, reserved keys are not in the
+// trash.
+func (s *defaultNamespaceStore) Restore(k string) (json.RawMessage, bool, error) {
+	if reservedKey(k) {
+		return nil, false, nil
+	}
+
+	return s.Store.Restore(k)
+}
+
+// DeleteTrashed removes a key from the trash, reserved keys are not in the
+// trash.
+func (s *defaultNamespaceStore) DeleteTrashed(k string) (bool, error) {
+	if reservedKey(k) {
+		return false, nil
+	}
+
+	return s.Store.DeleteTrashed(k)
+}
+
+// listNamespaces returns the sorted names of namespaces that have keys.
+func listNamespaces(store Store) ([]string, error) {
+	vals, _, err := store.ListPage(namespaceKeyPrefix, "", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	namespaces := []string{}
+	for k := range vals {
+		escaped := strings.SplitN(strings.TrimPrefix(k, namespaceKeyPrefix), "/", 2)[0]
+		namespace, err := url.PathUnescape(escaped)
+		if err != nil || seen[namespace] {
+			continue
+		}
+		seen[namespace] = true
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+
+	return namespaces, nil
+}
+
+// inNamespace returns a handler calling handle with the store of the
+// namespace in the ":namespace" route parameter.
+//
+// Example:
+//
+//	r.HandleFunc("GET", "/ns/:namespace/val/:key", h.inNamespace(Handler.getVal))
+func (h Handler) inNamespace(handle func(Handler, http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		namespace, ok := mux.Var(r, "namespace")
+		if !ok {
+			writeErr(w, http.StatusInternalServerError, "can't get namespace")
+			return
+		}
+
+		h.store = newNamespaceStore(h.root, namespace)
+		h.namespace = namespace
+		handle(h, w, r)
+	}
+}
+
+// getNamespaces handles GET "/ns" requests, writing the names of namespaces
+// that have keys.
+func (h Handler) getNamespaces(w http.ResponseWriter, r *http.Request) {
+	namespaces, err := listNamespaces(h.root)
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+
+	writeJSON(w, map[string][]string{"namespaces": namespaces})
+}
+
+// deleteNamespace handles DELETE "/ns/:namespace" requests, removing all
+// the keys of a namespace, and writing their number.
+func (h Handler) deleteNamespace(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the ":namespace" route parameter.
+	namespace, ok := mux.Var(r, "namespace")
+	if !ok {
+		writeErr(w, http.StatusInternalServerError, "can't get namespace")
+		return
+	}
+
+	store := newNamespaceStore(h.root, namespace)
+	vals, err := store.List()
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+	if len(vals) == 0 {
+		writeErr(w, http.StatusNotFound, fmt.Sprintf("can't find namespace %s", namespace))
+		return
+	}
+
+	n, err := store.Clear()
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+	for k := range vals {
+		h.hub.publish(namespace, eventDeleted, k, nil)
+	}
+
+	writeJSON(w, map[string]int{"deleted": n})
+}
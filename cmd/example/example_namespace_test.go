@@ -0,0 +1,134 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNamespaces(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		status   int
+		expected string
+	}{
+		{"put default", "PUT", "/val/config", "\"default\"", http.StatusCreated, "{\"config\":\"default\"}"},
+		{"put a", "PUT", "/ns/a/val/config", "\"a\"", http.StatusCreated, "{\"config\":\"a\"}"},
+		{"put b", "PUT", "/ns/b/val/config", "\"b\"", http.StatusCreated, "{\"config\":\"b\"}"},
+		{"put b again", "PUT", "/ns/b/val/other", "1", http.StatusCreated, "{\"other\":1}"},
+		{"put escaped", "PUT", "/ns/a%2Fb/val/config", "\"a/b\"", http.StatusCreated, "{\"config\":\"a/b\"}"},
+		{"get default", "GET", "/val/config", "", http.StatusOK, "{\"config\":\"default\"}"},
+		{"get a", "GET", "/ns/a/val/config", "", http.StatusOK, "{\"config\":\"a\"}"},
+		{"get b", "GET", "/ns/b/val/config", "", http.StatusOK, "{\"config\":\"b\"}"},
+		{"get escaped", "GET", "/ns/a%2Fb/val/config", "", http.StatusOK, "{\"config\":\"a/b\"}"},
+		{"get missing", "GET", "/ns/a/val/other", "", http.StatusNotFound,
+			"{\"error\":{\"code\":\"key_not_found\",\"message\":\"can't find key other\"}}"},
+		{"list default", "GET", "/val", "", http.StatusOK, "{\"config\":\"default\"}"},
+		{"list b", "GET", "/ns/b/val", "", http.StatusOK, "{\"config\":\"b\",\"other\":1}"},
+		{"page default", "GET", "/val?limit=10", "", http.StatusOK, "{\"items\":{\"config\":\"default\"}}"},
+		{"page b", "GET", "/ns/b/val?limit=1", "", http.StatusOK,
+			"{\"items\":{\"config\":\"b\"},\"next_cursor\":\"Y29uZmln\"}"},
+		{"next page b", "GET", "/ns/b/val?limit=1&cursor=Y29uZmln", "", http.StatusOK,
+			"{\"items\":{\"other\":1}}"},
+		{"list namespaces", "GET", "/ns", "", http.StatusOK, "{\"namespaces\":[\"a\",\"a/b\",\"b\"]}"},
+		{"reserved key", "PUT", "/val/%00ns%2Fa%2Fconfig", "1", http.StatusBadRequest,
+			"{\"error\":{\"code\":\"bad_request\",\"message\":\"key has a control character U+0000\"}}"},
+		{"get reserved key", "GET", "/val/%00ns%2Fa%2Fconfig", "", http.StatusNotFound,
+			"{\"error\":{\"code\":\"key_not_found\",\"message\":\"can't find key \\u0000ns/a/config\"}}"},
+		{"delete a key", "DELETE", "/ns/b/val/other", "", http.StatusOK, "{\"other\":1}"},
+		{"delete namespace", "DELETE", "/ns/a", "", http.StatusOK, "{\"deleted\":1}"},
+		{"delete missing namespace", "DELETE", "/ns/a", "", http.StatusNotFound,
+			"{\"error\":{\"code\":\"not_found\",\"message\":\"can't find namespace a\"}}"},
+		{"deleted namespace", "GET", "/ns/a/val", "", http.StatusOK, "{}"},
+		{"clear default", "DELETE", "/val?confirm=true", "", http.StatusOK, "{\"deleted\":1}"},
+		{"cleared default", "GET", "/val", "", http.StatusOK, "{}"},
+		{"left namespaces", "GET", "/ns", "", http.StatusOK, "{\"namespaces\":[\"a/b\",\"b\"]}"},
+		{"left b", "GET", "/ns/b/val/config", "", http.StatusOK, "{\"config\":\"b\"}"},
+	}
+
+	handler := newRouter()
+	for _, tt := range tests {
+		rr := serve(t, handler, tt.method, tt.path, tt.body, "")
+
+		// Check the status code is what we expect.
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				tt.name, status, tt.status)
+		}
+
+		// Check the response body is what we expect.
+		if rr.Body.String() != tt.expected {
+			t.Errorf("%s: handler returned unexpected body: got %q want %q",
+				tt.name, rr.Body.String(), tt.expected)
+		}
+	}
+}
+
+func TestNamespaceStore(t *testing.T) {
+	store := newMemoryStore()
+	a := newNamespaceStore(store, "a")
+	ab := newNamespaceStore(store, "a/b")
+	def := newDefaultNamespaceStore(store)
+
+	// Check identical keys of namespaces never collide.
+	for i, s := range []Store{def, a, ab} {
+		s.Upsert("b/k", []byte{'0' + byte(i)})
+	}
+	for i, s := range []Store{def, a, ab} {
+		if v, ok, _ := s.Get("b/k"); !ok || string(v) != string([]byte{'0' + byte(i)}) {
+			t.Errorf("Get of store %d: got %s, %v want %d", i, v, ok, i)
+		}
+		if vals, _ := s.List(); len(vals) != 1 {
+			t.Errorf("List of store %d: got %v want one key", i, vals)
+		}
+	}
+
+	// Check batch operations stay in their namespace.
+	if deleted, _ := a.DeleteKeys([]string{"b/k", "k"}); !deleted[0] || deleted[1] {
+		t.Errorf("DeleteKeys: got %v want [true false]", deleted)
+	}
+	if vals, _ := ab.GetMany([]string{"b/k"}); len(vals) != 1 {
+		t.Errorf("GetMany: got %v want b/k", vals)
+	}
+	if n, _ := def.Clear(); n != 1 {
+		t.Errorf("Clear: got %v want 1", n)
+	}
+	if namespaces, _ := listNamespaces(store); len(namespaces) != 1 || namespaces[0] != "a/b" {
+		t.Errorf("listNamespaces: got %v want [a/b]", namespaces)
+	}
+}
+
+func TestSplitNamespaceKey(t *testing.T) {
+	tests := []struct {
+		key       string
+		namespace string
+		want      string
+	}{
+		{"kitty", "", "kitty"},
+		{namespacePrefix("cats") + "kitty", "cats", "kitty"},
+		{namespacePrefix("a/b") + "b/k", "a/b", "b/k"},
+		{namespaceKeyPrefix + "%zz/k", "", namespaceKeyPrefix + "%zz/k"},
+	}
+	for _, tt := range tests {
+		if namespace, key := splitNamespaceKey(tt.key); namespace != tt.namespace || key != tt.want {
+			t.Errorf("splitNamespaceKey(%q): got %q, %q want %q, %q", tt.key, namespace, key, tt.namespace, tt.want)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// jsonPointer is a JSON pointer, RFC 6901, as its unescaped reference
+// tokens, e.g. "/spec/replicas" is ["spec", "replicas"]. The empty pointer
+// refers to the whole value.
+type jsonPointer []string
+
+// parseJSONPointer parses a JSON pointer, e.g. "/spec/replicas", in
+// reference tokens "~1" is "/" and "~0" is "~".
+func parseJSONPointer(s string) (jsonPointer, error) {
+	if s == "" {
+		return jsonPointer{}, nil
+	}
+	if !strings.HasPrefix(s, "/") {
+		return nil, fmt.Errorf("invalid pointer %s, pointers start with /", s)
+	}
+
+	tokens := strings.Split(s[1:], "/")
+	for i, token := range tokens {
+		for j := 0; j < len(token); j++ {
+			if token[j] != '~' {
+				continue
+			}
+			if j+1 == len(token) || (token[j+1] != '0' && token[j+1] != '1') {
+				return nil, fmt.Errorf("invalid pointer %s, ~ must be escaped as ~0", s)
+			}
+			j++
+		}
+
+		// Unescape ~1 first, so "~01" is "~1".
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+
+	return tokens, nil
+}
+
+// parseFieldPath parses a dot separated path, e.g. "spec.replicas", or
+// "items.0.name", names with dots escape them with a backslash, e.g.
+// "labels.app\.kubernetes\.io/name", and backslashes with a backslash.
+func parseFieldPath(s string) (jsonPointer, error) {
+	var p jsonPointer
+	var token strings.Builder
+	escaped := false
+	for _, c := range s {
+		switch {
+		case escaped:
+			if c != '.' && c != '\\' {
+				return nil, fmt.Errorf("invalid field %s, only . and \\ can be escaped", s)
+			}
+			token.WriteRune(c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '.':
+			p = append(p, token.String())
+			token.Reset()
+		default:
+			token.WriteRune(c)
+		}
+	}
+	if escaped {
+		return nil, fmt.Errorf("invalid field %s, it ends with an escape", s)
+	}
+	p = append(p, token.String())
+
+	for _, token := range p {
+		if token == "" {
+			return nil, fmt.Errorf("invalid field %s, names can't be empty", s)
+		}
+	}
+
+	return p, nil
+}
+
+// String returns the pointer, with "~" and "/" of reference tokens escaped.
+func (p jsonPointer) String() string {
+	var b strings.Builder
+	for _, token := range p {
+		b.WriteByte('/')
+		b.WriteString(strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1"))
+	}
+
+	return b.String()
+}
+
+// pointerError is the error of a pointer that does not resolve, the value
+// the pointer resolved to, before the failing reference token, and why the
+// token does not resolve.
+type pointerError struct {
+	resolved jsonPointer
+	reason   string
+}
+
+func (e *pointerError) Error() string {
+	if len(e.resolved) == 0 {
+		return "the value " + e.reason
+	}
+
+	return strconv.Quote(e.resolved.String()) + " " + e.reason
+}
+
+// resolve returns the part of a JSON value the pointer refers to, members
+// of objects are referred to by name, and elements of arrays by index. It
+// fails with a *pointerError if a reference token does not resolve.
+//
+// The value is not modified, the returned value is a copy.
+func (p jsonPointer) resolve(v json.RawMessage) (json.RawMessage, error) {
+	v = bytes.TrimSpace(v)
+	for i, token := range p {
+		if len(v) == 0 {
+			return nil, errors.New("empty value")
+		}
+
+		switch v[0] {
+		case '{':
+			var members map[string]json.RawMessage
+			if err := json.Unmarshal(v, &members); err != nil {
+				return nil, err
+			}
+			member, ok := members[token]
+			if !ok {
+				return nil, &pointerError{p[:i], fmt.Sprintf("has no member %q", token)}
+			}
+			v = member
+		case '[':
+			var elements []json.RawMessage
+			if err := json.Unmarshal(v, &elements); err != nil {
+				return nil, err
+			}
+			n, ok := arrayIndex(token)
+			if !ok {
+				return nil, &pointerError{p[:i], fmt.Sprintf("is an array, %q is not an index", token)}
+			}
+			if n >= len(elements) {
+				return nil, &pointerError{p[:i], fmt.Sprintf("has %d elements, index %d is out of range", len(elements), n)}
+			}
+			v = elements[n]
+		default:
+			return nil, &pointerError{p[:i], fmt.Sprintf("is %s, not an object or an array, it has no %q", jsonKind(v), token)}
+		}
+	}
+
+	return append(json.RawMessage(nil), v...), nil
+}
+
+// arrayIndex parses an array index reference token, a decimal number
+// without leading zeros.
+func arrayIndex(token string) (int, bool) {
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, false
+	}
+	for _, c := range token {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+	}
+	n, err := strconv.Atoi(token)
+
+	return n, err == nil
+}
+
+// jsonKind returns the kind of a JSON value that is not an object or an
+// array, e.g. "a string".
+func jsonKind(v json.RawMessage) string {
+	switch v[0] {
+	case '"':
+		return "a string"
+	case 't', 'f':
+		return "a boolean"
+	case 'n':
+		return "null"
+	}
+
+	return "a number"
+}
+
+// selectedPointer returns the pointer of the part of a value selected by
+// a "field" query parameter, a dot separated path, or a "pointer" query
+// parameter, a JSON pointer, and the selector, e.g. "field spec.replicas",
+// the selector is empty if the request selects the whole value.
+func selectedPointer(q url.Values) (jsonPointer, string, error) {
+	switch {
+	case q.Has("field") && q.Has("pointer"):
+		return nil, "", errors.New("field and pointer can't be used together")
+	case q.Has("field"):
+		p, err := parseFieldPath(q.Get("field"))
+		return p, "field " + q.Get("field"), err
+	case q.Has("pointer"):
+		p, err := parseJSONPointer(q.Get("pointer"))
+		return p, "pointer " + q.Get("pointer"), err
+	}
+
+	return nil, "", nil
+}
+
+// writeFieldErr writes the error of a part of a value that does not
+// resolve, e.g. "can't find field spec.replicas of key kitty: the value has
+// no member "spec"".
+func writeFieldErr(w http.ResponseWriter, key, selector string, err error) {
+	var pointerErr *pointerError
+	if !errors.As(err, &pointerErr) {
+		writeErr(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeErrCode(w, http.StatusNotFound, errCodeFieldNotFound, fmt.Sprintf("can't find %s of key %s: %v", selector, key, err))
+}
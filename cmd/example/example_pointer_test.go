@@ -0,0 +1,251 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// rfc6901Doc is the example document of RFC 6901.
+const rfc6901Doc = `{"foo":["bar","baz"],"":0,"a/b":1,"c%d":2,"e^f":3,"g|h":4,"i\\j":5,"k\"l":6," ":7,"m~n":8}`
+
+func TestJSONPointerResolve(t *testing.T) {
+	tests := []struct {
+		pointer  string
+		expected string
+	}{
+		{"", rfc6901Doc},
+		{"/foo", `["bar","baz"]`},
+		{"/foo/0", `"bar"`},
+		{"/", `0`},
+		{"/a~1b", `1`},
+		{"/c%d", `2`},
+		{"/e^f", `3`},
+		{"/g|h", `4`},
+		{"/i\\j", `5`},
+		{"/k\"l", `6`},
+		{"/ ", `7`},
+		{"/m~0n", `8`},
+	}
+
+	for _, tt := range tests {
+		p, err := parseJSONPointer(tt.pointer)
+		if err != nil {
+			t.Errorf("%q: parseJSONPointer: %v", tt.pointer, err)
+			continue
+		}
+
+		// Check the pointer resolves to the value we expect, and prints back.
+		v, err := p.resolve(json.RawMessage(rfc6901Doc))
+		if err != nil || string(v) != tt.expected {
+			t.Errorf("%q: resolve: got %s, %v want %s", tt.pointer, v, err, tt.expected)
+		}
+		if p.String() != tt.pointer {
+			t.Errorf("%q: String: got %q", tt.pointer, p.String())
+		}
+	}
+}
+
+func TestJSONPointerEscaping(t *testing.T) {
+	tests := []struct {
+		pointer  string
+		expected []string
+	}{
+		{"/~01", []string{"~1"}},
+		{"/~10", []string{"/0"}},
+		{"/~0~1/~1~0", []string{"~/", "/~"}},
+		{"/a//b/", []string{"a", "", "b", ""}},
+	}
+
+	for _, tt := range tests {
+		// Check "~1" is unescaped before "~0", and tokens may be empty.
+		p, err := parseJSONPointer(tt.pointer)
+		if err != nil || len(p) != len(tt.expected) {
+			t.Errorf("%q: got %q, %v want %q", tt.pointer, p, err, tt.expected)
+			continue
+		}
+		for i := range p {
+			if p[i] != tt.expected[i] {
+				t.Errorf("%q: got %q want %q", tt.pointer, p, tt.expected)
+			}
+		}
+		if p.String() != tt.pointer {
+			t.Errorf("%q: String: got %q", tt.pointer, p.String())
+		}
+	}
+
+	// Check malformed pointers are errors.
+	for _, s := range []string{"foo", "/~", "/a~2", "/~~0"} {
+		if p, err := parseJSONPointer(s); err == nil {
+			t.Errorf("%q: expected an error, got %q", s, p)
+		}
+	}
+}
+
+func TestJSONPointerErrors(t *testing.T) {
+	v := json.RawMessage(`{"spec":{"replicas":3,"ports":[80,443],"name":"tom"}}`)
+
+	tests := []struct {
+		pointer  string
+		expected string
+	}{
+		{"/status", `the value has no member "status"`},
+		{"/spec/image", `"/spec" has no member "image"`},
+		{"/spec/ports/2", `"/spec/ports" has 2 elements, index 2 is out of range`},
+		{"/spec/ports/01", `"/spec/ports" is an array, "01" is not an index`},
+		{"/spec/ports/-", `"/spec/ports" is an array, "-" is not an index`},
+		{"/spec/name/first", `"/spec/name" is a string, not an object or an array, it has no "first"`},
+		{"/spec/replicas/0", `"/spec/replicas" is a number, not an object or an array, it has no "0"`},
+	}
+
+	for _, tt := range tests {
+		p, _ := parseJSONPointer(tt.pointer)
+
+		// Check the error tells where the pointer stops resolving.
+		_, err := p.resolve(v)
+		if _, ok := err.(*pointerError); !ok || err.Error() != tt.expected {
+			t.Errorf("%q: got %v want %s", tt.pointer, err, tt.expected)
+		}
+	}
+}
+
+func TestParseFieldPath(t *testing.T) {
+	tests := []struct {
+		field    string
+		expected string
+	}{
+		{"spec", "/spec"},
+		{"spec.replicas", "/spec/replicas"},
+		{"items.0.name", "/items/0/name"},
+		{`labels.app\.kubernetes\.io/name`, "/labels/app.kubernetes.io~1name"},
+		{`a\\.b`, `/a\/b`},
+		{"m~n", "/m~0n"},
+	}
+
+	for _, tt := range tests {
+		// Check the path is the pointer we expect.
+		p, err := parseFieldPath(tt.field)
+		if err != nil || p.String() != tt.expected {
+			t.Errorf("%q: got %q, %v want %q", tt.field, p.String(), err, tt.expected)
+		}
+	}
+
+	// Check malformed paths are errors.
+	for _, s := range []string{"", "a..b", ".a", "a.", `a\`, `a\b`} {
+		if p, err := parseFieldPath(s); err == nil {
+			t.Errorf("%q: expected an error, got %q", s, p)
+		}
+	}
+}
+
+func TestGetField(t *testing.T) {
+	handler := newRouter()
+	serve(t, handler, "PUT", "/val/deploy", `{"spec":{"replicas":3,"ports":[80,443],"labels":{"app.io/name":"kitty"}}}`, "")
+	serve(t, handler, "PUT", "/ns/cats/val/tom", `{"lives":9}`, "")
+	serve(t, handler, "PUT", "/raw/blob", "<b>", "")
+
+	tests := []struct {
+		name     string
+		path     string
+		status   int
+		expected string
+	}{
+		{"field", "/val/deploy?field=spec.replicas", http.StatusOK, `3`},
+		{"object", "/val/deploy?field=spec", http.StatusOK, `{"replicas":3,"ports":[80,443],"labels":{"app.io/name":"kitty"}}`},
+		{"index", "/val/deploy?field=spec.ports.1", http.StatusOK, `443`},
+		{"escaped dots", `/val/deploy?field=spec.labels.app%5C.io%2Fname`, http.StatusOK, `"kitty"`},
+		{"pointer", "/val/deploy?pointer=/spec/labels/app.io~1name", http.StatusOK, `"kitty"`},
+		{"whole value pointer", "/val/deploy?pointer=", http.StatusOK, `{"spec":{"replicas":3,"ports":[80,443],"labels":{"app.io/name":"kitty"}}}`},
+		{"namespace", "/ns/cats/val/tom?field=lives", http.StatusOK, `9`},
+		{"missing member", "/val/deploy?field=spec.image", http.StatusNotFound,
+			`{"error":{"code":"field_not_found","message":"can't find field spec.image of key deploy: \"/spec\" has no member \"image\""}}`},
+		{"out of range", "/val/deploy?pointer=/spec/ports/2", http.StatusNotFound,
+			`{"error":{"code":"field_not_found","message":"can't find pointer /spec/ports/2 of key deploy: \"/spec/ports\" has 2 elements, index 2 is out of range"}}`},
+		{"missing key", "/val/missing?field=spec", http.StatusNotFound, ""},
+		{"raw value", "/val/blob?field=spec", http.StatusConflict, ""},
+		{"bad field", "/val/deploy?field=spec..replicas", http.StatusBadRequest, ""},
+		{"bad pointer", "/val/deploy?pointer=spec", http.StatusBadRequest, ""},
+		{"field and pointer", "/val/deploy?field=spec&pointer=/spec", http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		rr := serve(t, handler, "GET", tt.path, "", "")
+
+		// Check the status and the body are what we expect.
+		if rr.Code != tt.status {
+			t.Errorf("%s: wrong status code: got %v want %v, %s", tt.name, rr.Code, tt.status, rr.Body.String())
+		}
+		if tt.expected != "" && rr.Body.String() != tt.expected {
+			t.Errorf("%s: unexpected body: got %s want %s", tt.name, rr.Body.String(), tt.expected)
+		}
+
+		// Check HEAD requests agree with GET requests.
+		head := serve(t, handler, "HEAD", tt.path, "", "")
+		if head.Code != tt.status {
+			t.Errorf("%s: wrong HEAD status code: got %v want %v", tt.name, head.Code, tt.status)
+		}
+		if n := strconv.Itoa(rr.Body.Len()); tt.status == http.StatusOK && head.Header().Get("Content-Length") != n {
+			t.Errorf("%s: wrong HEAD Content-Length: got %s want %s", tt.name, head.Header().Get("Content-Length"), n)
+		}
+		if head.Header().Get("ETag") != rr.Header().Get("ETag") {
+			t.Errorf("%s: wrong HEAD ETag: got %s want %s", tt.name, head.Header().Get("ETag"), rr.Header().Get("ETag"))
+		}
+	}
+
+	// Check fields of revisions are not supported.
+	if rr := serve(t, handler, "GET", "/val/deploy?field=spec&rev=1", "", ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("wrong status code with a revision: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	// Check selecting a field does not change the stored value.
+	if rr := serve(t, handler, "GET", "/val/deploy", "", ""); rr.Body.String() !=
+		`{"deploy":{"spec":{"replicas":3,"ports":[80,443],"labels":{"app.io/name":"kitty"}}}}` {
+		t.Errorf("stored value changed: %s", rr.Body.String())
+	}
+}
+
+func TestGetFieldETag(t *testing.T) {
+	handler := newRouter()
+	serve(t, handler, "PUT", "/val/deploy", `{"spec":{"replicas":3},"status":{"ready":1}}`, "")
+
+	// Check the ETag of a field is the ETag of the field's value.
+	rr := serve(t, handler, "GET", "/val/deploy?field=spec.replicas", "", "")
+	etag := rr.Header().Get("ETag")
+	if etag != valueETag(json.RawMessage(`3`)) {
+		t.Errorf("wrong ETag: got %s want %s", etag, valueETag(json.RawMessage(`3`)))
+	}
+	if whole := serve(t, handler, "GET", "/val/deploy", "", "").Header().Get("ETag"); whole == etag {
+		t.Errorf("the ETag of a field is the ETag of the whole value")
+	}
+	if rr := serve(t, handler, "GET", "/val/deploy?field=spec.replicas", "", etag); rr.Code != http.StatusNotModified {
+		t.Errorf("wrong status code: got %v want %v", rr.Code, http.StatusNotModified)
+	}
+
+	// Check changing another field keeps the ETag of the field.
+	serve(t, handler, "PUT", "/val/deploy", `{"spec":{"replicas":3},"status":{"ready":3}}`, "")
+	if rr := serve(t, handler, "GET", "/val/deploy?field=spec.replicas", "", etag); rr.Code != http.StatusNotModified {
+		t.Errorf("wrong status code: got %v want %v", rr.Code, http.StatusNotModified)
+	}
+
+	// Check changing the field changes its ETag.
+	serve(t, handler, "PUT", "/val/deploy", `{"spec":{"replicas":5},"status":{"ready":3}}`, "")
+	if rr := serve(t, handler, "GET", "/val/deploy?field=spec.replicas", "", etag); rr.Code != http.StatusOK || rr.Body.String() != `5` {
+		t.Errorf("unexpected response: %v, %s", rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// probeKey is the key written by the store prober, keys starting with
+// a NUL character are reserved, so clients never read or write it.
+const probeKey = "\x00probe"
+
+// storeProber probes a store periodically, writing, reading and deleting
+// the probe key. The store is unhealthy once probes failed for longer than
+// the threshold, until a probe succeeds. It is safe for concurrent use.
+type storeProber struct {
+	store     Store
+	interval  time.Duration
+	threshold time.Duration
+	now       func() time.Time
+
+	// Guards lastErr, latency and failingSince.
+	mu sync.Mutex
+
+	// The error of the last probe, nil if it succeeded, and its latency.
+	lastErr error
+	latency time.Duration
+
+	// Start time of the first failed probe, zero while probes succeed.
+	failingSince time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newStoreProber(store Store, interval, threshold time.Duration, now func() time.Time) *storeProber {
+	p := storeProber{
+		store:     store,
+		interval:  interval,
+		threshold: threshold,
+		now:       now,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	return &p
+}
+
+// start probes the store now, and every interval, until Stop, failed probes
+// are logged.
+func (p *storeProber) start(logger *log.Logger) {
+	go func() {
+		defer close(p.done)
+
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+
+		for {
+			if err := p.probe(); err != nil {
+				logger.Println("store probe failed:", err)
+			}
+
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop stops probing, and waits for a running probe to complete.
+func (p *storeProber) Stop() {
+	close(p.stop)
+	<-p.done
+}
+
+// probe writes, reads and deletes the probe key, and records the result.
+func (p *storeProber) probe() error {
+	start := p.now()
+	err := probeStore(p.store, start)
+	latency := p.now().Sub(start)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.lastErr = err
+	p.latency = latency
+	switch {
+	case err == nil:
+		p.failingSince = time.Time{}
+	case p.failingSince.IsZero():
+		p.failingSince = start
+	}
+
+	return err
+}
+
+// probeStore writes the time to the probe key, reads it back, and deletes
+// the key.
+func probeStore(store Store, now time.Time) error {
+	v := json.RawMessage(strconv.FormatInt(now.UnixNano(), 10))
+	if err := store.Upsert(probeKey, v); err != nil {
+		return fmt.Errorf("can't write: %v", err)
+	}
+
+	got, ok, err := store.Get(probeKey)
+	if err != nil {
+		return fmt.Errorf("can't read: %v", err)
+	}
+	if !ok || string(got) != string(v) {
+		return fmt.Errorf("read %s, after writing %s", got, v)
+	}
+
+	if _, err := store.Delete(probeKey); err != nil {
+		return fmt.Errorf("can't delete: %v", err)
+	}
+
+	return nil
+}
+
+// unhealthy returns an error if probes failed for longer than the
+// threshold, o/w nil.
+func (p *storeProber) unhealthy() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.lastErr == nil {
+		return nil
+	}
+	failing := p.now().Sub(p.failingSince)
+	if failing < p.threshold {
+		return nil
+	}
+
+	return fmt.Errorf("store is failing for %v: %v", failing.Round(time.Millisecond), p.lastErr)
+}
+
+// check is a readiness check, failing while the store is unhealthy.
+func (p *storeProber) check(ctx context.Context) error {
+	return p.unhealthy()
+}
+
+// probeStats are the results of the store probes.
+type probeStats struct {
+	Healthy        bool    `json:"healthy"`
+	LastError      string  `json:"last_error,omitempty"`
+	LatencySeconds float64 `json:"latency_seconds"`
+	FailingSeconds float64 `json:"failing_seconds,omitempty"`
+}
+
+// stats returns the results of the probes.
+func (p *storeProber) stats() *probeStats {
+	unhealthy := p.unhealthy()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := probeStats{Healthy: unhealthy == nil, LatencySeconds: p.latency.Seconds()}
+	if p.lastErr != nil {
+		stats.LastError = p.lastErr.Error()
+		stats.FailingSeconds = p.now().Sub(p.failingSince).Seconds()
+	}
+
+	return &stats
+}
+
+// requireHealthyStore wraps a mutation handler, rejecting mutations with
+// a 503, and a Retry-After of the probe interval, while the store is
+// unhealthy, reads are served as long as the store answers them.
+func (h Handler) requireHealthyStore(handle func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	if h.prober == nil {
+		return handle
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := h.prober.unhealthy(); err != nil {
+			seconds := int64((h.prober.interval + time.Second - 1) / time.Second)
+			if seconds < 1 {
+				seconds = 1
+			}
+			w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+			writeErrCode(w, http.StatusServiceUnavailable, errCodeStoreUnavailable, err.Error())
+			return
+		}
+
+		handle(w, r)
+	}
+}
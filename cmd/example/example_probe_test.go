@@ -0,0 +1,146 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// brokenStore is a Store whose writes fail while it is broken.
+type brokenStore struct {
+	Store
+	broken int32
+}
+
+func (s *brokenStore) Upsert(key string, value json.RawMessage) error {
+	if atomic.LoadInt32(&s.broken) == 1 {
+		return errors.New("no space left on device")
+	}
+
+	return s.Store.Upsert(key, value)
+}
+
+func (s *brokenStore) setBroken(broken bool) {
+	if broken {
+		atomic.StoreInt32(&s.broken, 1)
+	} else {
+		atomic.StoreInt32(&s.broken, 0)
+	}
+}
+
+func TestStoreProber(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	store := &brokenStore{Store: newMemoryStore()}
+	h := newHandler(store)
+	h.prober = newStoreProber(store, 2*time.Second, 10*time.Second, clock.Now)
+	handler := newHandlerRouter(h)
+
+	tests := []struct {
+		name    string
+		broken  bool
+		elapsed time.Duration
+		status  int
+		ready   int
+	}{
+		{"healthy", false, 0, http.StatusOK, http.StatusOK},
+		{"failing", true, 5 * time.Second, http.StatusOK, http.StatusOK},
+		{"failing past the threshold", true, 5 * time.Second, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+		{"recovered", false, time.Second, http.StatusOK, http.StatusOK},
+		{"failing again", true, 5 * time.Second, http.StatusOK, http.StatusOK},
+	}
+
+	for i, tt := range tests {
+		store.setBroken(tt.broken)
+		if err := h.prober.probe(); (err != nil) != tt.broken {
+			t.Errorf("%s: probe returned %v", tt.name, err)
+		}
+		clock.Add(tt.elapsed)
+		store.setBroken(false)
+
+		// Check mutations are rejected while the store is unhealthy.
+		rr := serve(t, handler, "PUT", "/v1/val/kitty", strconv.Itoa(i), "")
+		if rr.Code != tt.status && !(tt.status == http.StatusOK && rr.Code == http.StatusCreated) {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tt.name, rr.Code, tt.status)
+		}
+		if tt.status == http.StatusServiceUnavailable {
+			if got := rr.Header().Get("Retry-After"); got != "2" {
+				t.Errorf("%s: wrong Retry-After: got %q want 2", tt.name, got)
+			}
+			want := `{"error":{"code":"store_unavailable","message":"store is failing for 10s: can't write: no space left on device"}}`
+			if rr.Body.String() != want {
+				t.Errorf("%s: handler returned unexpected body: got %v want %v", tt.name, rr.Body.String(), want)
+			}
+		}
+
+		// Check reads are served, and readiness follows the health.
+		if rr := serve(t, handler, "GET", "/v1/val", "", ""); rr.Code != http.StatusOK {
+			t.Errorf("%s: read returned %v", tt.name, rr.Code)
+		}
+		if rr := serve(t, handler, "GET", "/readyz", "", ""); rr.Code != tt.ready {
+			t.Errorf("%s: readyz returned %v want %v: %s", tt.name, rr.Code, tt.ready, rr.Body.String())
+		}
+	}
+
+	// Check the probe key is deleted, and never listed.
+	if _, ok, _ := store.Get(probeKey); ok {
+		t.Errorf("probe key was left in the store")
+	}
+	if rr := serve(t, handler, "GET", "/v1/val", "", ""); strings.Contains(rr.Body.String(), "probe") {
+		t.Errorf("probe key was listed: %s", rr.Body.String())
+	}
+}
+
+func TestStoreProberStats(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	h := newHandler(newMemoryStore())
+	h.prober = newStoreProber(failingStore{}, time.Second, 0, clock.Now)
+	h.prober.probe()
+	clock.Add(3 * time.Second)
+
+	// Check stats have the last error, and how long probes are failing.
+	var stats serverStats
+	rr := serve(t, newHandlerRouter(h), "GET", "/v1/stats", "", "")
+	if err := json.Unmarshal(rr.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if p := stats.Probe; p == nil || p.Healthy || p.LastError != "can't write: backend is down" || p.FailingSeconds != 3 {
+		t.Errorf("unexpected probe stats: %+v", p)
+	}
+}
+
+func TestStoreProberStop(t *testing.T) {
+	p := newStoreProber(failingStore{}, time.Millisecond, 0, time.Now)
+	p.start(log.New(io.Discard, "", 0))
+
+	// Check probes run in the background, and stop.
+	deadline := time.Now().Add(time.Second)
+	for p.unhealthy() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("store was not probed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	p.Stop()
+}
@@ -0,0 +1,205 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/yaacov/gokitty/pkg/mux"
+)
+
+// defaultRawContentType is the content type of raw values stored without
+// a Content-Type header.
+const defaultRawContentType = "application/octet-stream"
+
+// rawRoute returns true if a route reads or writes bytes as is, raw values
+// or exports, that are not converted to, or from, YAML, and may be ranged.
+func rawRoute(path string) bool {
+	return strings.HasSuffix(path, "/raw/:key") || strings.HasSuffix(path, "/export")
+}
+
+// writeRawErr writes the error of a JSON request of a raw value.
+func writeRawErr(w http.ResponseWriter, key string) {
+	writeErrCode(w, http.StatusConflict, errCodeRawValue, fmt.Sprintf("key %s has a raw value, get it using /raw/%s", key, key))
+}
+
+// rawInfo describes a raw value.
+type rawInfo struct {
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+}
+
+// putRaw handles PUT "/raw/:key" requests, storing the request body as is,
+// with its Content-Type, e.g. an image, with an optional "ttl" query
+// parameter.
+//
+// Raw values are served by GET "/raw/:key", JSON routes refuse to get them,
+// pages of values, and watch events, have them as the JSON string of their
+// base64 encoding.
+func (h Handler) putRaw(w http.ResponseWriter, r *http.Request) {
+	ttl, err := parseTTL(r)
+	if err != nil {
+		writeErr(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Retrieve the ":key" route parameter.
+	key, ok := mux.Var(r, "key")
+	if !ok {
+		writeErr(w, http.StatusInternalServerError, "can't get key")
+		return
+	}
+	if err := h.limits.checkKey(key); err != nil {
+		writeLimitErr(w, err)
+		return
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = defaultRawContentType
+	} else if _, _, err := mime.ParseMediaType(contentType); err != nil {
+		writeErr(w, http.StatusBadRequest, fmt.Sprintf("invalid Content-Type %q", contentType))
+		return
+	}
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeErr(w, http.StatusRequestEntityTooLarge, err.Error())
+			return
+		}
+		writeErr(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := h.limits.checkValueSize(data); err != nil {
+		writeLimitErr(w, err)
+		return
+	}
+
+	// Check if this is a new key.
+	v := rawValue(data)
+	_, etag, ok, err := h.store.GetWithETag(key)
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+	if !ok {
+		if err := h.checkNewKeys(1); err != nil {
+			writeLimitErr(w, err)
+			return
+		}
+	}
+	if ttl > 0 {
+		setTTLHeader(w, ttl)
+	}
+	w.Header().Set("ETag", valueETag(v))
+	if ok && etag == valueETag(v) && ttl == 0 {
+		metas, err := h.store.Meta([]string{key})
+		if err != nil {
+			writeStoreErr(w, err)
+			return
+		}
+		_, expires, err := h.store.TTL(key)
+		if err != nil {
+			writeStoreErr(w, err)
+			return
+		}
+
+		// Value does not require change, 304 responses have no body.
+		if metas[key].ContentType == contentType && !expires {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	// Create or modify the raw value.
+	if err := h.store.UpsertRaw(key, data, contentType, ttl); err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+	code := http.StatusOK
+	if ok {
+		h.publish(eventUpdated, key, v)
+	} else {
+		h.publish(eventCreated, key, v)
+		code = http.StatusCreated
+	}
+
+	writeJSONStatus(w, code, map[string]rawInfo{key: {ContentType: contentType, Size: len(data)}})
+}
+
+// getRaw handles GET "/raw/:key" requests, writing a raw value as is, with
+// its Content-Type, JSON values are written as JSON.
+//
+// Responses have the ETag of the value, requests with a matching
+// If-None-Match header get a 304 Not Modified response without a body, and
+// single range requests, e.g. "Range: bytes=0-1023", get a part of large
+// values.
+func (h Handler) getRaw(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the ":key" route parameter.
+	key, ok := mux.Var(r, "key")
+	if !ok {
+		writeErr(w, http.StatusInternalServerError, "can't get key")
+		return
+	}
+
+	val, etag, ok, err := h.store.GetWithETag(key)
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+	if !ok {
+		writeKeyErr(w, key)
+		return
+	}
+	ttl, ok, err := h.store.TTL(key)
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+	if ok {
+		setTTLHeader(w, ttl)
+	}
+	metas, err := h.store.Meta([]string{key})
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+
+	// Decode raw values into a new slice, val may be the stored value.
+	data, contentType := []byte(val), jsonContentType
+	if metas[key].ContentType != "" {
+		data = nil
+		if err := json.Unmarshal(val, &data); err != nil {
+			writeErr(w, http.StatusInternalServerError, fmt.Sprintf("can't decode raw value: %v", err))
+			return
+		}
+		contentType = metas[key].ContentType
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	serveContent(w, r, metas[key].UpdatedAt, bytes.NewReader(data))
+}
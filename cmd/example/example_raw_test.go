@@ -0,0 +1,203 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveRequest serves req using handler.
+func serveRequest(handler http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	return rr
+}
+
+// testUpsertRaw checks a store keeps the content type of raw values.
+func testUpsertRaw(t *testing.T, s Store) {
+	t.Helper()
+
+	if err := s.UpsertRaw("blob", []byte{0, 1, 2, 0xff}, "image/png", 0); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok, err := s.Get("blob"); !ok || err != nil || string(v) != `"AAEC/w=="` {
+		t.Errorf("Get: got %s, %v, %v want \"AAEC/w==\"", v, ok, err)
+	}
+	if metas, err := s.Meta([]string{"blob"}); err != nil || metas["blob"].ContentType != "image/png" {
+		t.Errorf("Meta: got %+v, %v want content type image/png", metas, err)
+	}
+
+	// Check raw values expire.
+	if err := s.UpsertRaw("short", []byte("tom"), "text/plain", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := s.TTL("short"); !ok {
+		t.Errorf("raw value does not expire")
+	}
+
+	// Check a JSON value replaces the raw value, and its content type.
+	s.Upsert("short", json.RawMessage(`1`))
+	if metas, _ := s.Meta([]string{"short"}); metas["short"].ContentType != "" {
+		t.Errorf("JSON value has a content type: %+v", metas["short"])
+	}
+	if _, ok, _ := s.TTL("short"); ok {
+		t.Errorf("JSON value expires")
+	}
+}
+
+func TestMemoryStoreUpsertRaw(t *testing.T) {
+	testUpsertRaw(t, newMemoryStore())
+}
+
+func TestRaw(t *testing.T) {
+	handler := newRouter()
+
+	// A few kilobytes of random bytes.
+	data := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	req, _ := http.NewRequest("PUT", "/v1/raw/blob", bytes.NewReader(data))
+	req.Header.Set("Content-Type", "image/png")
+	rr := serveRequest(handler, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("PUT: wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+	if rr.Body.String() != "{\"blob\":{\"content_type\":\"image/png\",\"size\":4096}}" {
+		t.Errorf("PUT: unexpected body: %s", rr.Body.String())
+	}
+	etag := rr.Header().Get("ETag")
+
+	// Check the value is returned bit for bit, with its content type.
+	rr = serve(t, handler, "GET", "/v1/raw/blob", "", "")
+	if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), data) {
+		t.Fatalf("GET: got %v, %d bytes, want the stored bytes", rr.Code, rr.Body.Len())
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "image/png" {
+		t.Errorf("GET: wrong Content-Type: got %s want image/png", ct)
+	}
+	if cl := rr.Header().Get("Content-Length"); cl != "4096" {
+		t.Errorf("GET: wrong Content-Length: got %s want 4096", cl)
+	}
+	if rr.Header().Get("ETag") != etag {
+		t.Errorf("GET: wrong ETag: got %s want %s", rr.Header().Get("ETag"), etag)
+	}
+
+	// Check getting the value again does not change it.
+	if rr := serve(t, handler, "GET", "/v1/raw/blob", "", ""); !bytes.Equal(rr.Body.Bytes(), data) {
+		t.Errorf("GET again: got %d bytes, want the stored bytes", rr.Body.Len())
+	}
+
+	// Check unchanged values are not modified.
+	if rr := serve(t, handler, "GET", "/v1/raw/blob", "", etag); rr.Code != http.StatusNotModified {
+		t.Errorf("GET If-None-Match: wrong status code: got %v want %v %s", rr.Code, http.StatusNotModified, rr.Body.String())
+	}
+	req, _ = http.NewRequest("PUT", "/v1/raw/blob", bytes.NewReader(data))
+	req.Header.Set("Content-Type", "image/png")
+	if rr := serveRequest(handler, req); rr.Code != http.StatusNotModified {
+		t.Errorf("PUT unchanged: wrong status code: got %v want %v", rr.Code, http.StatusNotModified)
+	}
+
+	// Check JSON routes refuse to get the raw value.
+	rr = serve(t, handler, "GET", "/v1/val/blob", "", "")
+	if rr.Code != http.StatusConflict || !strings.Contains(rr.Body.String(), "\"code\":\"raw_value\"") {
+		t.Errorf("GET JSON: got %v, %s want %v", rr.Code, rr.Body.String(), http.StatusConflict)
+	}
+	if rr := serve(t, handler, "HEAD", "/v1/val/blob", "", ""); rr.Code != http.StatusConflict {
+		t.Errorf("HEAD JSON: wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+	}
+	if rr := serve(t, handler, "GET", "/v1/val/blob/meta", "", ""); !strings.Contains(rr.Body.String(), "\"content_type\":\"image/png\"") {
+		t.Errorf("GET meta: unexpected body: %s", rr.Body.String())
+	}
+
+	// Check a JSON value replaces the raw value, and is served as JSON.
+	serve(t, handler, "PUT", "/v1/val/blob", "{\"lives\": 9}", "")
+	rr = serve(t, handler, "GET", "/v1/raw/blob", "", "")
+	if rr.Body.String() != "{\"lives\":9}" || rr.Header().Get("Content-Type") != jsonContentType {
+		t.Errorf("GET JSON value: got %s, %s", rr.Header().Get("Content-Type"), rr.Body.String())
+	}
+	if rr := serve(t, handler, "GET", "/v1/val/blob", "", ""); rr.Code != http.StatusOK {
+		t.Errorf("GET JSON: wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+}
+
+func TestRawRequests(t *testing.T) {
+	h := newHandler(newMemoryStore())
+	h.limits.MaxValueBytes = 16
+	handler := newHandlerRouter(h)
+
+	tests := []struct {
+		name        string
+		path        string
+		body        string
+		contentType string
+		status      int
+		getType     string
+	}{
+		{"no content type", "/v1/raw/a", "kitty", "", http.StatusCreated, "application/octet-stream"},
+		{"yaml is not converted", "/v1/raw/b", "lives: 9", "application/yaml", http.StatusCreated, "application/yaml"},
+		{"namespace", "/v1/ns/cats/raw/c", "tom", "text/plain; charset=utf-8", http.StatusCreated, "text/plain; charset=utf-8"},
+		{"content type change", "/v1/raw/a", "kitty", "text/plain", http.StatusOK, "text/plain"},
+		{"too large", "/v1/raw/d", strings.Repeat("a", 17), "", http.StatusRequestEntityTooLarge, ""},
+		{"bad content type", "/v1/raw/d", "a", "text/", http.StatusBadRequest, ""},
+		{"reserved key", "/v1/raw/%00probe", "a", "", http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("PUT", tt.path, strings.NewReader(tt.body))
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		rr := serveRequest(handler, req)
+
+		// Check the status is what we expect.
+		if rr.Code != tt.status {
+			t.Errorf("%s: wrong status code: got %v want %v, %s", tt.name, rr.Code, tt.status, rr.Body.String())
+			continue
+		}
+		if tt.getType == "" {
+			continue
+		}
+
+		// Check the value is returned as is, with its content type.
+		rr = serve(t, handler, "GET", tt.path, "", "")
+		if rr.Body.String() != tt.body || rr.Header().Get("Content-Type") != tt.getType {
+			t.Errorf("%s: GET: got %q, %q want %q, %q", tt.name, rr.Header().Get("Content-Type"), rr.Body.String(), tt.getType, tt.body)
+		}
+	}
+
+	// Check missing keys are not found.
+	if rr := serve(t, handler, "GET", "/v1/raw/missing", "", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+
+	// Check the size limit counts the raw bytes, not their base64 encoding.
+	req, _ := http.NewRequest("PUT", "/v1/raw/e", strings.NewReader(strings.Repeat("a", 16)))
+	if rr := serveRequest(handler, req); rr.Code != http.StatusCreated {
+		t.Errorf("wrong status code: got %v want %v", rr.Code, http.StatusCreated)
+	}
+	if rr := serve(t, handler, "GET", "/v1/raw/e", "", ""); rr.Header().Get("Content-Length") != strconv.Itoa(16) {
+		t.Errorf("wrong Content-Length: got %s want 16", rr.Header().Get("Content-Length"))
+	}
+}
@@ -0,0 +1,355 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Schema is a JSON Schema subset, values of keys under a prefix must match
+// the schema of the prefix. The supported keywords are type, properties,
+// required, items, enum and numeric ranges, annotations are ignored, and
+// other keywords are rejected.
+type Schema struct {
+	// Type is the type of values, or a list of types, e.g. "object" or
+	// ["string", "null"].
+	Type schemaTypes `json:"type,omitempty"`
+
+	// Properties are the schemas of object members, and Required are
+	// members that must exist.
+	Properties map[string]*Schema `json:"properties,omitempty"`
+	Required   []string           `json:"required,omitempty"`
+
+	// Items is the schema of array elements.
+	Items *Schema `json:"items,omitempty"`
+
+	// Enum lists the values allowed.
+	Enum []json.RawMessage `json:"enum,omitempty"`
+
+	// Numeric ranges, inclusive and exclusive.
+	Minimum          *float64 `json:"minimum,omitempty"`
+	Maximum          *float64 `json:"maximum,omitempty"`
+	ExclusiveMinimum *float64 `json:"exclusiveMinimum,omitempty"`
+	ExclusiveMaximum *float64 `json:"exclusiveMaximum,omitempty"`
+
+	// Annotations.
+	SchemaURI   string `json:"$schema,omitempty"`
+	ID          string `json:"$id,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+
+	// Holds the decoded Enum values.
+	enum []interface{}
+}
+
+// Types of schemas.
+var schemaTypeNames = map[string]string{
+	"object":  "an object",
+	"array":   "an array",
+	"string":  "a string",
+	"number":  "a number",
+	"integer": "an integer",
+	"boolean": "a boolean",
+	"null":    "null",
+}
+
+// schemaTypes is the type keyword of a schema, a type or a list of types.
+type schemaTypes []string
+
+// UnmarshalJSON decodes a type, or a list of types.
+func (t *schemaTypes) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*t = schemaTypes{name}
+		return nil
+	}
+
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return errors.New("type must be a string or a list of strings")
+	}
+	*t = names
+
+	return nil
+}
+
+// String returns the types, e.g. "a string or null".
+func (t schemaTypes) String() string {
+	names := make([]string, len(t))
+	for i, name := range t {
+		names[i] = schemaTypeNames[name]
+	}
+
+	return strings.Join(names, " or ")
+}
+
+// match returns true if a decoded value is one of the types.
+func (t schemaTypes) match(v interface{}) bool {
+	for _, name := range t {
+		if name == valueType(v) || (name == "number" && valueType(v) == "integer") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// valueType returns the type of a value decoded using json.Number, numbers
+// without a fraction are integers, e.g. 1 and 1.0.
+func valueType(v interface{}) string {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case json.Number:
+		if f, err := v.Float64(); err == nil && f == float64(int64(f)) {
+			return "integer"
+		}
+		return "number"
+	case bool:
+		return "boolean"
+	}
+
+	return "null"
+}
+
+// check checks the schema, and its subschemas, are valid, and decodes
+// their enums.
+func (s *Schema) check() error {
+	for _, name := range s.Type {
+		if _, ok := schemaTypeNames[name]; !ok {
+			return fmt.Errorf("invalid type %q", name)
+		}
+	}
+	if s.Enum != nil && len(s.Enum) == 0 {
+		return errors.New("enum can't be empty")
+	}
+	if s.Enum != nil {
+		s.enum = make([]interface{}, len(s.Enum))
+	}
+	for i, v := range s.Enum {
+		if err := unmarshalNumbers(v, &s.enum[i]); err != nil {
+			return fmt.Errorf("invalid enum: %v", err)
+		}
+	}
+
+	for name, p := range s.Properties {
+		if p == nil {
+			return fmt.Errorf("properties: %s: schema can't be null", name)
+		}
+		if err := p.check(); err != nil {
+			return fmt.Errorf("properties: %s: %v", name, err)
+		}
+	}
+	if s.Items != nil {
+		if err := s.Items.check(); err != nil {
+			return fmt.Errorf("items: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// schemaViolation is a part of a value that does not match its schema, at
+// a JSON pointer.
+type schemaViolation struct {
+	Pointer string `json:"pointer"`
+	Message string `json:"message"`
+}
+
+// validate appends the violations of a value decoded using json.Number,
+// at pointer p, to violations.
+func (s *Schema) validate(v interface{}, p jsonPointer, violations []schemaViolation) []schemaViolation {
+	violation := func(format string, a ...interface{}) {
+		violations = append(violations, schemaViolation{p.String(), fmt.Sprintf(format, a...)})
+	}
+
+	if len(s.Type) > 0 && !s.Type.match(v) {
+		violation("must be %s, got %s", s.Type, schemaTypeNames[valueType(v)])
+		return violations
+	}
+	if s.enum != nil && !s.enumContains(v) {
+		enum, _ := json.Marshal(s.Enum)
+		violation("must be one of %s", enum)
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				violations = append(violations, schemaViolation{append(p[:len(p):len(p)], name).String(), "is required"})
+			}
+		}
+
+		names := make([]string, 0, len(s.Properties))
+		for name := range s.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if member, ok := v[name]; ok {
+				violations = s.Properties[name].validate(member, append(p[:len(p):len(p)], name), violations)
+			}
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, element := range v {
+				violations = s.Items.validate(element, append(p[:len(p):len(p)], strconv.Itoa(i)), violations)
+			}
+		}
+	case json.Number:
+		f, _ := v.Float64()
+		switch {
+		case s.Minimum != nil && f < *s.Minimum:
+			violation("must be at least %s, got %s", formatFloat(*s.Minimum), v)
+		case s.ExclusiveMinimum != nil && f <= *s.ExclusiveMinimum:
+			violation("must be greater than %s, got %s", formatFloat(*s.ExclusiveMinimum), v)
+		case s.Maximum != nil && f > *s.Maximum:
+			violation("must be at most %s, got %s", formatFloat(*s.Maximum), v)
+		case s.ExclusiveMaximum != nil && f >= *s.ExclusiveMaximum:
+			violation("must be less than %s, got %s", formatFloat(*s.ExclusiveMaximum), v)
+		}
+	}
+
+	return violations
+}
+
+// enumContains returns true if a decoded value equals a value of the enum.
+func (s *Schema) enumContains(v interface{}) bool {
+	for _, e := range s.enum {
+		if equalValues(e, v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// formatFloat formats a schema number, e.g. 0.5.
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// loadSchema reads a schema file.
+func loadSchema(name string) (*Schema, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("can't read schema: %v", err)
+	}
+
+	var s Schema
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&s); err != nil {
+		return nil, fmt.Errorf("can't parse schema %s: %v", name, err)
+	}
+	if err := s.check(); err != nil {
+		return nil, fmt.Errorf("invalid schema %s: %v", name, err)
+	}
+
+	return &s, nil
+}
+
+// schemaPrefix is the schema of the values of keys under a prefix.
+type schemaPrefix struct {
+	prefix string
+	schema *Schema
+}
+
+// schemaRegistry holds the schemas of key prefixes, a key is checked by the
+// schema of its longest prefix, in every namespace. A nil registry checks
+// nothing.
+type schemaRegistry struct {
+	// Sorted longest prefix first.
+	prefixes []schemaPrefix
+}
+
+// loadSchemas reads the schema files of prefixes, given as "prefix=file".
+func loadSchemas(specs []string) (*schemaRegistry, error) {
+	r := &schemaRegistry{}
+	for _, spec := range specs {
+		prefix, file, _ := strings.Cut(spec, "=")
+		s, err := loadSchema(file)
+		if err != nil {
+			return nil, err
+		}
+		r.prefixes = append(r.prefixes, schemaPrefix{prefix, s})
+	}
+	sort.SliceStable(r.prefixes, func(i, j int) bool {
+		return len(r.prefixes[i].prefix) > len(r.prefixes[j].prefix)
+	})
+
+	return r, nil
+}
+
+// schemaError is a value that does not match the schema of its key.
+type schemaError struct {
+	key        string
+	prefix     string
+	violations []schemaViolation
+}
+
+func (e *schemaError) Error() string {
+	return fmt.Sprintf("value of key %s does not match the schema of prefix %q", e.key, e.prefix)
+}
+
+// check checks the compact JSON value of a key matches the schema of the
+// key, if any, failing with a *schemaError.
+func (r *schemaRegistry) check(key string, v json.RawMessage) error {
+	if r == nil {
+		return nil
+	}
+
+	for _, p := range r.prefixes {
+		if !strings.HasPrefix(key, p.prefix) {
+			continue
+		}
+
+		var decoded interface{}
+		if err := unmarshalNumbers(v, &decoded); err != nil {
+			return err
+		}
+		if violations := p.schema.validate(decoded, jsonPointer{}, nil); len(violations) > 0 {
+			return &schemaError{key, p.prefix, violations}
+		}
+		return nil
+	}
+
+	return nil
+}
+
+// schemaErrorDetails is the error details of values that do not match
+// their schema.
+type schemaErrorDetails struct {
+	Violations []schemaViolation `json:"violations"`
+}
+
+// Write a schema error.
+func writeSchemaErr(w http.ResponseWriter, e *schemaError) {
+	writeErrDetails(w, http.StatusUnprocessableEntity, errCodeSchemaViolation, e.Error(),
+		schemaErrorDetails{Violations: e.violations})
+}
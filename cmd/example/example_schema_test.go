@@ -0,0 +1,252 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// featureSchema is the schema of feature flags.
+const featureSchema = `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "title": "feature flag",
+  "type": "object",
+  "required": ["enabled", "rollout"],
+  "properties": {
+    "enabled": {"type": "boolean"},
+    "rollout": {"type": "number", "minimum": 0, "maximum": 100},
+    "stage": {"enum": ["alpha", "beta", "ga"]}
+  }
+}`
+
+// testSchemas returns a registry of schemas of prefixes, given as
+// prefix and schema pairs.
+func testSchemas(t *testing.T, prefixSchemas ...string) *schemaRegistry {
+	t.Helper()
+
+	dir := t.TempDir()
+	var specs []string
+	for i := 0; i < len(prefixSchemas); i += 2 {
+		path := writeTokens(t, dir, fmt.Sprintf("schema%d.json", i), prefixSchemas[i+1])
+		specs = append(specs, prefixSchemas[i]+"="+path)
+	}
+	r, err := loadSchemas(specs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+// violations returns the violations of a value, as "pointer: message".
+func violations(t *testing.T, r *schemaRegistry, key, value string) string {
+	t.Helper()
+
+	err := r.check(key, json.RawMessage(value))
+	if err == nil {
+		return ""
+	}
+	e, ok := err.(*schemaError)
+	if !ok {
+		t.Fatalf("check %s: unexpected error %v", value, err)
+	}
+
+	var s []string
+	for _, v := range e.violations {
+		s = append(s, v.Pointer+": "+v.Message)
+	}
+
+	return strings.Join(s, "; ")
+}
+
+func TestSchemaKeywords(t *testing.T) {
+	tests := []struct {
+		name     string
+		schema   string
+		value    string
+		expected string
+	}{
+		{"type", `{"type": "string"}`, `"cat"`, ""},
+		{"wrong type", `{"type": "string"}`, `1`, ": must be a string, got an integer"},
+		{"types", `{"type": ["string", "null"]}`, `null`, ""},
+		{"wrong types", `{"type": ["string", "null"]}`, `{}`, ": must be a string or null, got an object"},
+		{"integer", `{"type": "integer"}`, `1.0`, ""},
+		{"not an integer", `{"type": "integer"}`, `1.5`, ": must be an integer, got a number"},
+		{"integer is a number", `{"type": "number"}`, `1`, ""},
+		{"boolean", `{"type": "boolean"}`, `"true"`, ": must be a boolean, got a string"},
+		{"array", `{"type": "array"}`, `[1]`, ""},
+		{"required", `{"required": ["a", "b"]}`, `{"a": 1, "b": null}`, ""},
+		{"missing required", `{"required": ["a", "b"]}`, `{"c": 1}`, "/a: is required; /b: is required"},
+		{"required of a non object", `{"required": ["a"]}`, `1`, ""},
+		{"properties", `{"properties": {"a": {"type": "string"}}}`, `{"a": "x", "b": 1}`, ""},
+		{"wrong property", `{"properties": {"a/b": {"type": "string"}, "c": {"type": "integer"}}}`, `{"a/b": 1, "c": "x"}`,
+			"/a~1b: must be a string, got an integer; /c: must be an integer, got a string"},
+		{"nested property", `{"properties": {"spec": {"required": ["replicas"]}}}`, `{"spec": {}}`, "/spec/replicas: is required"},
+		{"items", `{"items": {"type": "integer"}}`, `[1, 2]`, ""},
+		{"wrong items", `{"items": {"type": "integer"}}`, `[1, "2", 3, null]`,
+			"/1: must be an integer, got a string; /3: must be an integer, got null"},
+		{"enum", `{"enum": ["a", 1, {"b": [true]}]}`, `{"b": [true]}`, ""},
+		{"enum number", `{"enum": [1]}`, `1.0`, ""},
+		{"not in enum", `{"enum": ["a", 1]}`, `"b"`, `: must be one of ["a",1]`},
+		{"minimum", `{"minimum": 0}`, `0`, ""},
+		{"below minimum", `{"minimum": 0}`, `-0.5`, ": must be at least 0, got -0.5"},
+		{"maximum", `{"maximum": 100}`, `100`, ""},
+		{"above maximum", `{"maximum": 100}`, `101`, ": must be at most 100, got 101"},
+		{"exclusive minimum", `{"exclusiveMinimum": 0}`, `0`, ": must be greater than 0, got 0"},
+		{"exclusive maximum", `{"exclusiveMaximum": 1.5}`, `1.5`, ": must be less than 1.5, got 1.5"},
+		{"range of a non number", `{"minimum": 0}`, `"-1"`, ""},
+		{"empty schema", `{}`, `[{"any": "thing"}]`, ""},
+	}
+
+	for _, tt := range tests {
+		r := testSchemas(t, "", tt.schema)
+
+		// Check the violations are what we expect.
+		if got := violations(t, r, "kitty", tt.value); got != tt.expected {
+			t.Errorf("%s: got %q want %q", tt.name, got, tt.expected)
+		}
+	}
+}
+
+func TestSchemaPrefixes(t *testing.T) {
+	r := testSchemas(t, "features/", featureSchema, "features/legacy/", `{"type": "boolean"}`)
+
+	tests := []struct {
+		key      string
+		value    string
+		expected string
+	}{
+		{"features/dark", `{"enabled": true, "rollout": 50, "stage": "beta"}`, ""},
+		{"features/dark", `{"enabled": "yes", "rollout": 150, "stage": "rc"}`,
+			`/enabled: must be a boolean, got a string; /rollout: must be at most 100, got 150; /stage: must be one of ["alpha","beta","ga"]`},
+		{"features/dark", `{"enabled": true}`, "/rollout: is required"},
+		{"features/legacy/old", `true`, ""},
+		{"features/legacy/old", `{"enabled": true, "rollout": 50}`, ": must be a boolean, got an object"},
+		{"feature", `1`, ""},
+		{"kitty", `{"enabled": "yes"}`, ""},
+	}
+
+	for _, tt := range tests {
+		// Check keys are checked by the schema of their longest prefix, and
+		// keys outside the prefixes pass untouched.
+		if got := violations(t, r, tt.key, tt.value); got != tt.expected {
+			t.Errorf("%s %s: got %q want %q", tt.key, tt.value, got, tt.expected)
+		}
+	}
+
+	// Check a nil registry checks nothing.
+	var none *schemaRegistry
+	if err := none.check("features/dark", json.RawMessage(`1`)); err != nil {
+		t.Errorf("nil registry: got %v", err)
+	}
+}
+
+func TestLoadSchemaInvalid(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name   string
+		schema string
+	}{
+		{"not json", `{"type": `},
+		{"unsupported keyword", `{"pattern": "^a"}`},
+		{"misspelled keyword", `{"requried": ["a"]}`},
+		{"invalid type", `{"type": "float"}`},
+		{"invalid nested type", `{"properties": {"a": {"items": {"type": "map"}}}}`},
+		{"type not a string", `{"type": 1}`},
+		{"empty enum", `{"enum": []}`},
+		{"null property", `{"properties": {"a": null}}`},
+	}
+
+	for _, tt := range tests {
+		// Check invalid schemas fail to load.
+		path := writeTokens(t, dir, "schema.json", tt.schema)
+		if _, err := loadSchemas([]string{"a/=" + path}); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+
+	if _, err := loadSchemas([]string{"a/=" + dir + "/missing.json"}); err == nil {
+		t.Errorf("missing file: expected an error")
+	}
+}
+
+func TestSchemaHandlers(t *testing.T) {
+	h := newHandler(newMemoryStore())
+	h.schemas = testSchemas(t, "features/", featureSchema)
+	handler := newHandlerRouter(h)
+	serve(t, handler, "PUT", "/v1/val/features%2Fdark", `{"enabled": false, "rollout": 0}`, "")
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		status   int
+		expected string
+	}{
+		{"put", "PUT", "/v1/val/features%2Fnew", `{"enabled": true, "rollout": 10}`, http.StatusCreated, ""},
+		{"put invalid", "PUT", "/v1/val/features%2Fnew", `{"enabled": true}`, http.StatusUnprocessableEntity,
+			`{"error":{"code":"schema_violation","message":"value of key features/new does not match the schema of prefix \"features/\"",` +
+				`"details":{"violations":[{"pointer":"/rollout","message":"is required"}]}}}`},
+		{"put outside the prefixes", "PUT", "/v1/val/kitty", `{"enabled": "yes"}`, http.StatusCreated, ""},
+		{"put in a namespace", "PUT", "/v1/ns/cats/val/features%2Fnew", `{"rollout": -1}`, http.StatusUnprocessableEntity, ""},
+		{"post invalid", "POST", "/v1/val", `{"kitty": 1, "features/a": {"enabled": true, "rollout": 1}, "features/b": 1}`,
+			http.StatusUnprocessableEntity, ""},
+		{"patch", "PATCH", "/v1/val/features%2Fdark", `{"rollout": 20}`, http.StatusOK, ""},
+		{"patch invalid result", "PATCH", "/v1/val/features%2Fdark", `{"enabled": null}`, http.StatusUnprocessableEntity,
+			`{"error":{"code":"schema_violation","message":"value of key features/dark does not match the schema of prefix \"features/\"",` +
+				`"details":{"violations":[{"pointer":"/enabled","message":"is required"}]}}}`},
+		{"cas invalid", "POST", "/v1/val/features%2Fdark/cas", `{"old": {"enabled": false, "rollout": 20}, "new": 1}`,
+			http.StatusUnprocessableEntity, ""},
+		{"txn invalid", "POST", "/v1/txn", `{"ops": [{"op": "put", "key": "features/dark", "value": {"enabled": 1, "rollout": 1}}]}`,
+			http.StatusUnprocessableEntity, ""},
+	}
+
+	for _, tt := range tests {
+		rr := serve(t, handler, tt.method, tt.path, tt.body, "")
+
+		// Check the status and the body are what we expect.
+		if rr.Code != tt.status {
+			t.Errorf("%s: wrong status code: got %v want %v, %s", tt.name, rr.Code, tt.status, rr.Body.String())
+		}
+		if tt.expected != "" && rr.Body.String() != tt.expected {
+			t.Errorf("%s: unexpected body: got %s want %s", tt.name, rr.Body.String(), tt.expected)
+		}
+	}
+
+	// Check rejected values were not stored.
+	got := serve(t, handler, "GET", "/v1/val", "", "").Body.String()
+	if got != `{"features/dark":{"enabled":false,"rollout":20},"features/new":{"enabled":true,"rollout":10},"kitty":{"enabled":"yes"}}` {
+		t.Errorf("unexpected values: %s", got)
+	}
+}
+
+func TestConfigSchemas(t *testing.T) {
+	c, err := quietConfig([]string{"-schema", "a/=a.json", "-schema", "b/=b.json,c/=c.json"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Check the flag can be repeated, and lists schemas.
+	if fmt.Sprint(c.Schemas) != "[a/=a.json b/=b.json c/=c.json]" {
+		t.Errorf("unexpected schemas: %v", c.Schemas)
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// seedEntry is a key value pair of a seed, with a JSON value, or a raw
+// value and its content type.
+type seedEntry struct {
+	key         string
+	value       json.RawMessage
+	data        []byte
+	contentType string
+}
+
+// readSeed reads the key value pairs of a seed, an export file, e.g.
+// {"kitty": "cat"}, or a directory, where each file is a key named after
+// its path relative to the directory, e.g. "app1/config". Files ending
+// with ".json" have JSON values, and are named without the extension,
+// other files have raw values, with the content type of their extension,
+// hidden files are skipped.
+//
+// All the entries are checked before any is stored, the error of an
+// invalid seed lists all the invalid entries.
+func readSeed(name string, limits Limits) ([]seedEntry, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, fmt.Errorf("can't seed the store: %v", err)
+	}
+
+	var entries []seedEntry
+	var problems []string
+	if info.IsDir() {
+		entries, problems, err = readSeedDir(name)
+	} else {
+		entries, err = readSeedFile(name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't seed the store from %s: %v", name, err)
+	}
+
+	keys := map[string]bool{}
+	for _, e := range entries {
+		switch {
+		case keys[e.key]:
+			problems = append(problems, fmt.Sprintf("%s: duplicate key", e.key))
+		case e.value != nil:
+			if err := limits.checkValue(e.key, e.value); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", e.key, err))
+			}
+		default:
+			if err := limits.checkKey(e.key); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", e.key, err))
+			} else if err := limits.checkValueSize(rawValue(e.data)); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", e.key, err))
+			}
+		}
+		keys[e.key] = true
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("can't seed the store from %s, %d invalid entries: %s",
+			name, len(problems), strings.Join(problems, "; "))
+	}
+
+	return entries, nil
+}
+
+// readSeedFile reads the key value pairs of an export file, in key order.
+func readSeedFile(name string) ([]seedEntry, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var vals map[string]json.RawMessage
+	if err := json.Unmarshal(data, &vals); err != nil {
+		return nil, fmt.Errorf("want a JSON object of key value pairs: %v", err)
+	}
+
+	entries := make([]seedEntry, 0, len(vals))
+	for k, v := range vals {
+		entries = append(entries, seedEntry{key: k, value: compactJSON(v)})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+
+	return entries, nil
+}
+
+// readSeedDir reads the key value pairs of the files of a directory, in
+// path order, and lists the files that are not valid JSON values.
+func readSeedDir(dir string) ([]seedEntry, []string, error) {
+	var entries []seedEntry
+	var problems []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && p != dir {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+
+		if strings.HasSuffix(key, ".json") {
+			key = strings.TrimSuffix(key, ".json")
+			var v json.RawMessage
+			if err := json.Unmarshal(data, &v); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", rel, err))
+				return nil
+			}
+			entries = append(entries, seedEntry{key: key, value: compactJSON(v)})
+			return nil
+		}
+
+		contentType := mime.TypeByExtension(path.Ext(key))
+		if contentType == "" {
+			contentType = defaultRawContentType
+		}
+		entries = append(entries, seedEntry{key: key, data: data, contentType: contentType})
+		return nil
+	})
+
+	return entries, problems, err
+}
+
+// seedStore stores the key value pairs of a seed in the default namespace
+// of a store, keys that exist are skipped, unless overwrite, it returns the
+// number of stored and of skipped keys.
+func seedStore(store Store, name string, overwrite bool, limits Limits) (int, int, error) {
+	entries, err := readSeed(name, limits)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	s := newDefaultNamespaceStore(store)
+	var seed []seedEntry
+	var skipped, created int
+	for _, e := range entries {
+		_, ok, err := s.Get(e.key)
+		if err != nil {
+			return 0, 0, err
+		}
+		if ok && !overwrite {
+			skipped++
+			continue
+		}
+		if !ok {
+			created++
+		}
+		seed = append(seed, e)
+	}
+
+	if limits.MaxKeys > 0 && created > 0 {
+		count, err := store.Len()
+		if err != nil {
+			return 0, 0, err
+		}
+		if count+created > limits.MaxKeys {
+			return 0, 0, fmt.Errorf("can't seed the store from %s, store has %d keys, creating %d keys exceeds the max-keys limit of %d keys",
+				name, count, created, limits.MaxKeys)
+		}
+	}
+
+	for _, e := range seed {
+		if e.value != nil {
+			err = s.Upsert(e.key, e.value)
+		} else {
+			err = s.UpsertRaw(e.key, e.data, e.contentType, 0)
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("can't seed key %s: %w", e.key, err)
+		}
+	}
+
+	return len(seed), skipped, nil
+}
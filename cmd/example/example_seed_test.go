@@ -0,0 +1,286 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeSeedFiles writes files, named by their slash separated paths,
+// under dir.
+func writeSeedFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for name, data := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSeedFile(t *testing.T) {
+	dir := t.TempDir()
+	writeSeedFiles(t, dir, map[string]string{
+		"kitty.json": `{"kitty": "cat", "tom": {"lives": 9}, "app1/a": [1, 2]}`,
+	})
+
+	s := newMemoryStore()
+	seeded, skipped, err := seedStore(s, filepath.Join(dir, "kitty.json"), false, defaultLimits())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Check the values of the export are stored.
+	if seeded != 3 || skipped != 0 {
+		t.Errorf("wrong number of keys: got %d seeded, %d skipped want 3, 0", seeded, skipped)
+	}
+	if got := listValues(t, s); fmt.Sprint(got) != `map[app1/a:[1,2] kitty:"cat" tom:{"lives":9}]` {
+		t.Errorf("unexpected values: %v", got)
+	}
+}
+
+func TestSeedExport(t *testing.T) {
+	h := newHandler(newMemoryStore())
+	handler := newHandlerRouter(h)
+	serve(t, handler, "PUT", "/v1/val/kitty", `"cat"`, "")
+	serve(t, handler, "PUT", "/v1/val/tom", `{"lives": 9}`, "")
+
+	// Check an export seeds a store with the same values.
+	path := filepath.Join(t.TempDir(), "export.json")
+	rr := serve(t, handler, "GET", "/v1/export", "", "")
+	if err := os.WriteFile(path, rr.Body.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s := newMemoryStore()
+	if _, _, err := seedStore(s, path, false, defaultLimits()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := listValues(t, s), listValues(t, h.store); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("unexpected values: got %v want %v", got, want)
+	}
+}
+
+func TestSeedDir(t *testing.T) {
+	dir := t.TempDir()
+	writeSeedFiles(t, dir, map[string]string{
+		"kitty.json":            `"cat"`,
+		"app1/config.json":      "{\n  \"debug\": true\n}\n",
+		"app1/logo.png":         "\x89PNG",
+		"app1/notes":            "meow",
+		".hidden.json":          `1`,
+		".git/config":           "[core]",
+		"app2/.cache/data.json": `2`,
+	})
+
+	s := newMemoryStore()
+	seeded, skipped, err := seedStore(s, dir, false, defaultLimits())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Check each file is a key named after its path, and hidden files are
+	// skipped.
+	if seeded != 4 || skipped != 0 {
+		t.Errorf("wrong number of keys: got %d seeded, %d skipped want 4, 0", seeded, skipped)
+	}
+	if got := listValues(t, s); fmt.Sprint(got) != `map[app1/config:{"debug":true} app1/logo.png:"iVBORw==" app1/notes:"bWVvdw==" kitty:"cat"]` {
+		t.Errorf("unexpected values: %v", got)
+	}
+
+	// Check files that are not JSON are raw values, with the content type
+	// of their extension.
+	metas, err := s.Meta([]string{"app1/logo.png", "app1/notes", "kitty"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, contentType := range map[string]string{
+		"app1/logo.png": "image/png",
+		"app1/notes":    defaultRawContentType,
+		"kitty":         "",
+	} {
+		if metas[key].ContentType != contentType {
+			t.Errorf("%s: wrong content type: got %q want %q", key, metas[key].ContentType, contentType)
+		}
+	}
+}
+
+func TestSeedOverwrite(t *testing.T) {
+	quietLogs(t)
+
+	dir := t.TempDir()
+	writeSeedFiles(t, dir, map[string]string{
+		"seed/kitty.json": `"cat"`,
+		"seed/tom.json":   `"cat"`,
+	})
+	seed := filepath.Join(dir, "seed")
+	path := filepath.Join(dir, "kitty.db")
+
+	tests := []struct {
+		name      string
+		overwrite bool
+		seeded    int
+		skipped   int
+		expected  string
+	}{
+		{"first run", false, 2, 0, `map[kitty:"cat" tom:"cat"]`},
+		{"keep changed keys", false, 0, 2, `map[kitty:"tiger" tom:"cat"]`},
+		{"overwrite", true, 2, 0, `map[kitty:"cat" tom:"cat"]`},
+	}
+
+	for _, tt := range tests {
+		s := openBoltStore(t, path)
+		seeded, skipped, err := seedStore(s, seed, tt.overwrite, defaultLimits())
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		// Check keys that exist are kept, unless overwritten.
+		if seeded != tt.seeded || skipped != tt.skipped {
+			t.Errorf("%s: wrong number of keys: got %d seeded, %d skipped want %d, %d",
+				tt.name, seeded, skipped, tt.seeded, tt.skipped)
+		}
+		if got := listValues(t, s); fmt.Sprint(got) != tt.expected {
+			t.Errorf("%s: unexpected values: %v", tt.name, got)
+		}
+
+		// Change a seeded key before the next run.
+		s.Upsert("kitty", []byte(`"tiger"`))
+		s.Close()
+	}
+}
+
+func TestSeedInvalid(t *testing.T) {
+	dir := t.TempDir()
+	writeSeedFiles(t, dir, map[string]string{
+		"dir/good.json":      `"cat"`,
+		"dir/bad.json":       `{"kitty": `,
+		"dir/empty.json":     ``,
+		"dir/big.json":       `"` + strings.Repeat("a", 100) + `"`,
+		"dir/dup":            "raw",
+		"dir/dup.json":       `1`,
+		"not-an-object.json": `["cat"]`,
+		"bad-key.json":       `{"` + strings.Repeat("k", 300) + `": 1}`,
+	})
+	limits := defaultLimits()
+	limits.MaxValueBytes = 64
+
+	tests := []struct {
+		name     string
+		path     string
+		expected []string
+	}{
+		{"invalid files", "dir", []string{
+			"4 invalid entries",
+			"bad.json: unexpected end of JSON input",
+			"empty.json: unexpected end of JSON input",
+			"big: value is 102 bytes",
+			"dup: duplicate key",
+		}},
+		{"not an object", "not-an-object.json", []string{"want a JSON object of key value pairs"}},
+		{"invalid key", "bad-key.json", []string{"1 invalid entries", "max-key-length"}},
+		{"missing", "missing", []string{"no such file or directory"}},
+	}
+
+	for _, tt := range tests {
+		s := newMemoryStore()
+		_, _, err := seedStore(s, filepath.Join(dir, tt.path), false, limits)
+
+		// Check the error lists all the invalid entries, and nothing is
+		// stored.
+		if err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+			continue
+		}
+		for _, want := range tt.expected {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: error %q does not contain %q", tt.name, err, want)
+			}
+		}
+		if n, _ := s.Len(); n != 0 {
+			t.Errorf("%s: %d keys were stored", tt.name, n)
+		}
+	}
+}
+
+func TestSeedMaxKeys(t *testing.T) {
+	dir := t.TempDir()
+	writeSeedFiles(t, dir, map[string]string{"kitty.json": `{"a": 1, "b": 2, "c": 3}`})
+	limits := defaultLimits()
+	limits.MaxKeys = 3
+
+	s := newMemoryStore()
+	s.Upsert("a", []byte(`1`))
+	s.Upsert("z", []byte(`1`))
+
+	// Check seeding fails if new keys exceed the max-keys limit, keys that
+	// exist do not count.
+	if _, _, err := seedStore(s, filepath.Join(dir, "kitty.json"), false, limits); err == nil || !strings.Contains(err.Error(), "max-keys") {
+		t.Errorf("expected a max-keys error, got %v", err)
+	}
+	limits.MaxKeys = 4
+	if _, _, err := seedStore(s, filepath.Join(dir, "kitty.json"), false, limits); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunSeed(t *testing.T) {
+	dir := t.TempDir()
+	writeSeedFiles(t, dir, map[string]string{
+		"good/kitty.json": `"cat"`,
+		"bad/kitty.json":  `"ca`,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Check an invalid seed fails the startup.
+	_, done := startRun(t, ctx, "-seed", filepath.Join(dir, "bad"))
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "kitty.json") {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not fail")
+	}
+
+	// Check the seeded values are served.
+	url, done := startRun(t, ctx, "-seed", filepath.Join(dir, "good"))
+	resp, err := http.Get(url + "/v1/val/kitty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != `{"kitty":"cat"}` {
+		t.Errorf("unexpected body: %s", body)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,284 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// countingStore is a Store counting operations, the counters are updated
+// atomically, without locking.
+type countingStore struct {
+	Store
+
+	// Operation counters, accessed atomically.
+	gets, hits, misses, upserts, deletes uint64
+}
+
+func newCountingStore(store Store) *countingStore {
+	return &countingStore{Store: store}
+}
+
+// read counts a read of a key.
+func (s *countingStore) read(ok bool) {
+	atomic.AddUint64(&s.gets, 1)
+	if ok {
+		atomic.AddUint64(&s.hits, 1)
+	} else {
+		atomic.AddUint64(&s.misses, 1)
+	}
+}
+
+// Get returns the value of a key.
+func (s *countingStore) Get(k string) (json.RawMessage, bool, error) {
+	v, ok, err := s.Store.Get(k)
+	if err == nil {
+		s.read(ok)
+	}
+
+	return v, ok, err
+}
+
+// GetWithETag returns the value of a key, and its ETag.
+func (s *countingStore) GetWithETag(k string) (json.RawMessage, string, bool, error) {
+	v, etag, ok, err := s.Store.GetWithETag(k)
+	if err == nil {
+		s.read(ok)
+	}
+
+	return v, etag, ok, err
+}
+
+// GetMany returns the values of keys that are not missing.
+func (s *countingStore) GetMany(keys []string) (map[string]json.RawMessage, error) {
+	vals, err := s.Store.GetMany(keys)
+	if err == nil {
+		for _, k := range keys {
+			_, ok := vals[k]
+			s.read(ok)
+		}
+	}
+
+	return vals, err
+}
+
+// Upsert creates or modifies a key value pair, that never expires.
+func (s *countingStore) Upsert(k string, v json.RawMessage) error {
+	err := s.Store.Upsert(k, v)
+	if err == nil {
+		atomic.AddUint64(&s.upserts, 1)
+	}
+
+	return err
+}
+
+// UpsertTTL creates or modifies a key value pair, that expires after ttl.
+func (s *countingStore) UpsertTTL(k string, v json.RawMessage, ttl time.Duration) error {
+	err := s.Store.UpsertTTL(k, v, ttl)
+	if err == nil {
+		atomic.AddUint64(&s.upserts, 1)
+	}
+
+	return err
+}
+
+// UpsertRaw creates or modifies a key with a raw value.
+func (s *countingStore) UpsertRaw(k string, data []byte, contentType string, ttl time.Duration) error {
+	err := s.Store.UpsertRaw(k, data, contentType, ttl)
+	if err == nil {
+		atomic.AddUint64(&s.upserts, 1)
+	}
+
+	return err
+}
+
+// Incr adds delta to the integer value of a key atomically.
+func (s *countingStore) Incr(k string, delta int64) (int64, error) {
+	n, err := s.Store.Incr(k, delta)
+	if err == nil {
+		atomic.AddUint64(&s.upserts, 1)
+	}
+
+	return n, err
+}
+
+// CompareAndSwap replaces the value of a key atomically, if it equals old.
+func (s *countingStore) CompareAndSwap(k string, old, replacement json.RawMessage) (json.RawMessage, bool, bool, error) {
+	v, swapped, ok, err := s.Store.CompareAndSwap(k, old, replacement)
+	if swapped {
+		atomic.AddUint64(&s.upserts, 1)
+	}
+
+	return v, swapped, ok, err
+}
+
+// Push appends an element to the array value of a key atomically.
+func (s *countingStore) Push(k string, element json.RawMessage) (json.RawMessage, error) {
+	v, err := s.Store.Push(k, element)
+	if err == nil {
+		atomic.AddUint64(&s.upserts, 1)
+	}
+
+	return v, err
+}
+
+// Pop removes the first, or the last, element of the array value of a key
+// atomically.
+func (s *countingStore) Pop(k string, front bool) (json.RawMessage, json.RawMessage, bool, error) {
+	element, v, ok, err := s.Store.Pop(k, front)
+	if ok {
+		atomic.AddUint64(&s.upserts, 1)
+	}
+
+	return element, v, ok, err
+}
+
+// Txn applies a transaction atomically, if all its checks pass.
+func (s *countingStore) Txn(ops []TxnOp) (int, json.RawMessage, []bool, error) {
+	failed, current, existed, err := s.Store.Txn(ops)
+	if err != nil || failed >= 0 {
+		return failed, current, existed, err
+	}
+
+	for i, op := range ops {
+		switch {
+		case op.Op == TxnPut:
+			atomic.AddUint64(&s.upserts, 1)
+		case op.Op == TxnDelete && existed[i]:
+			atomic.AddUint64(&s.deletes, 1)
+		}
+	}
+
+	return failed, current, existed, err
+}
+
+// Delete removes a key.
+func (s *countingStore) Delete(k string) (bool, error) {
+	ok, err := s.Store.Delete(k)
+	if ok {
+		atomic.AddUint64(&s.deletes, 1)
+	}
+
+	return ok, err
+}
+
+// DeleteKeys removes keys atomically.
+func (s *countingStore) DeleteKeys(keys []string) ([]bool, error) {
+	deleted, err := s.Store.DeleteKeys(keys)
+	for _, ok := range deleted {
+		if ok {
+			atomic.AddUint64(&s.deletes, 1)
+		}
+	}
+
+	return deleted, err
+}
+
+// Trash moves a key to the trash.
+func (s *countingStore) Trash(k string) (bool, error) {
+	ok, err := s.Store.Trash(k)
+	if ok {
+		atomic.AddUint64(&s.deletes, 1)
+	}
+
+	return ok, err
+}
+
+// Restore moves a key from the trash back.
+func (s *countingStore) Restore(k string) (json.RawMessage, bool, error) {
+	v, ok, err := s.Store.Restore(k)
+	if ok {
+		atomic.AddUint64(&s.upserts, 1)
+	}
+
+	return v, ok, err
+}
+
+// DeletePrefix removes the keys with a prefix atomically.
+func (s *countingStore) DeletePrefix(prefix string) ([]string, error) {
+	deleted, err := s.Store.DeletePrefix(prefix)
+	atomic.AddUint64(&s.deletes, uint64(len(deleted)))
+
+	return deleted, err
+}
+
+// Clear removes all the keys.
+func (s *countingStore) Clear() (int, error) {
+	n, err := s.Store.Clear()
+	atomic.AddUint64(&s.deletes, uint64(n))
+
+	return n, err
+}
+
+// Stats returns the statistics of the store, with the operation counters.
+func (s *countingStore) Stats() (StoreStats, error) {
+	stats, err := s.Store.Stats()
+	if err != nil {
+		return stats, err
+	}
+
+	stats.Gets = atomic.LoadUint64(&s.gets)
+	stats.Hits = atomic.LoadUint64(&s.hits)
+	stats.Misses = atomic.LoadUint64(&s.misses)
+	stats.Upserts = atomic.LoadUint64(&s.upserts)
+	stats.Deletes = atomic.LoadUint64(&s.deletes)
+
+	return stats, nil
+}
+
+// runtimeStats are statistics of the Go runtime.
+type runtimeStats struct {
+	Goroutines     int    `json:"goroutines"`
+	HeapInuseBytes uint64 `json:"heap_inuse_bytes"`
+}
+
+// serverStats is the response of GET "/stats" requests.
+type serverStats struct {
+	Store         StoreStats   `json:"store"`
+	UptimeSeconds float64      `json:"uptime_seconds"`
+	Runtime       runtimeStats `json:"runtime"`
+	Probe         *probeStats  `json:"probe,omitempty"`
+}
+
+// getStats handles GET "/stats" requests, writing the statistics of the
+// store, of all the namespaces, and of the server.
+func (h Handler) getStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.root.Stats()
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	resp := serverStats{
+		Store:         stats,
+		UptimeSeconds: time.Since(h.started).Seconds(),
+		Runtime: runtimeStats{
+			Goroutines:     runtime.NumGoroutine(),
+			HeapInuseBytes: mem.HeapInuse,
+		},
+	}
+	if h.prober != nil {
+		resp.Probe = h.prober.stats()
+	}
+	writeJSON(w, resp)
+}
@@ -0,0 +1,124 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testStoreStats performs a known sequence of operations, and checks the
+// statistics of store.
+func testStoreStats(t *testing.T, store Store) {
+	s := newCountingStore(store)
+
+	s.Upsert("a", json.RawMessage(`"cat"`))
+	s.UpsertTTL("b", json.RawMessage(`1`), time.Minute)
+	s.Get("a")
+	s.Get("x")
+	s.GetWithETag("b")
+	s.GetMany([]string{"a", "x", "b"})
+	s.Incr("c", 5)
+	s.CompareAndSwap("c", json.RawMessage(`5`), json.RawMessage(`6`))
+	s.CompareAndSwap("c", json.RawMessage(`7`), json.RawMessage(`8`))
+	s.Delete("a")
+	s.Delete("a")
+	s.DeleteKeys([]string{"b", "x"})
+	s.Clear()
+	s.Upsert("d", json.RawMessage(`[1,2]`))
+
+	// Check the counters are what we expect.
+	stats, err := s.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := StoreStats{Keys: 1, ValueBytes: 5, Gets: 6, Hits: 4, Misses: 2, Upserts: 5, Deletes: 3}
+	if stats != expected {
+		t.Errorf("Stats: got %+v want %+v", stats, expected)
+	}
+}
+
+func TestMemoryStoreStats(t *testing.T) {
+	testStoreStats(t, newMemoryStore())
+}
+
+func TestFileStoreStats(t *testing.T) {
+	quietLogs(t)
+
+	s := newFileStore(filepath.Join(t.TempDir(), "kitty.json"), 0)
+	defer s.Close()
+
+	testStoreStats(t, s)
+}
+
+func TestBoltStoreStats(t *testing.T) {
+	s := openBoltStore(t, filepath.Join(t.TempDir(), "kitty.db"))
+	defer s.Close()
+
+	testStoreStats(t, s)
+}
+
+func TestMemoryStoreStatsEvictions(t *testing.T) {
+	s := newStoreWithLimit(2, EvictLRU)
+
+	s.Upsert("a", json.RawMessage(`"cat"`))
+	s.Upsert("a", json.RawMessage(`1`))
+	s.Upsert("b", json.RawMessage(`22`))
+	s.Upsert("c", json.RawMessage(`333`))
+
+	// Check modified and evicted values are not counted.
+	stats, _ := s.Stats()
+	expected := StoreStats{Keys: 2, ValueBytes: 5, Evictions: 1}
+	if stats != expected {
+		t.Errorf("Stats: got %+v want %+v", stats, expected)
+	}
+}
+
+func TestStats(t *testing.T) {
+	handler := newRouter()
+	serve(t, handler, "PUT", "/val/kitty", "\"cat\"", "")
+	serve(t, handler, "PUT", "/ns/cats/val/tiger", "1", "")
+	serve(t, handler, "GET", "/val/kitty", "", "")
+
+	rr := serve(t, handler, "GET", "/stats", "", "")
+
+	// Check the status code is what we expect.
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+
+	// Check the statistics include all the namespaces, and the runtime.
+	var stats serverStats
+	if err := json.Unmarshal(rr.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("handler returned invalid JSON %s: %v", rr.Body.String(), err)
+	}
+	if stats.Store.Keys != 2 || stats.Store.Upserts != 2 || stats.Store.Hits != 1 {
+		t.Errorf("handler returned unexpected store statistics: %+v", stats.Store)
+	}
+	if stats.UptimeSeconds <= 0 || stats.Runtime.Goroutines == 0 || stats.Runtime.HeapInuseBytes == 0 {
+		t.Errorf("handler returned unexpected server statistics: %+v", stats)
+	}
+
+	// Check store errors fail.
+	if rr := serve(t, newStoreRouter(failingStore{}), "GET", "/stats", "", ""); rr.Code != http.StatusInternalServerError {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			rr.Code, http.StatusInternalServerError)
+	}
+}
@@ -16,34 +16,344 @@
 // Package main
 package main
 
-// Store holds the key value pairs.
-type Store struct {
-	// key value store.
-	vals map[string]interface{}
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/big"
+	"strconv"
+	"time"
+)
+
+// Errors of Incr.
+var (
+	errNotInteger = errors.New("value is not an integer")
+	errOverflow   = errors.New("value overflows a 64-bit integer")
+)
+
+// errKeyExists is returned when restoring a trashed key that has a value.
+var errKeyExists = errors.New("key exists")
+
+// Store holds the key value pairs, values are JSON values.
+//
+// Keys may expire, expired keys are treated as missing, and are removed by
+// Get, or by DeleteExpired. Implementations must be safe for concurrent use.
+type Store interface {
+	// Get returns the value of a key, ok is false if the key is missing.
+	Get(key string) (value json.RawMessage, ok bool, err error)
+
+	// GetWithETag returns the value of a key, and its ETag, ok is false if
+	// the key is missing.
+	GetWithETag(key string) (value json.RawMessage, etag string, ok bool, err error)
+
+	// GetMany returns the values of keys that are not missing.
+	GetMany(keys []string) (map[string]json.RawMessage, error)
+
+	// Meta returns the metadata of keys that are not missing.
+	Meta(keys []string) (map[string]KeyMeta, error)
+
+	// Len returns the number of keys, keys that expired may be counted
+	// until they are removed.
+	Len() (int, error)
+
+	// List returns a copy of all the key value pairs.
+	List() (map[string]json.RawMessage, error)
+
+	// ListPage returns up to limit key value pairs with a prefix, in key
+	// order, starting after the cursor key, a zero limit is unlimited.
+	// The next cursor is the last returned key, or empty if there are no
+	// more keys.
+	ListPage(prefix, cursor string, limit int) (page map[string]json.RawMessage, next string, err error)
+
+	// Upsert creates or modifies a key value pair, that never expires.
+	Upsert(key string, value json.RawMessage) error
+
+	// UpsertTTL creates or modifies a key value pair, that expires after ttl.
+	UpsertTTL(key string, value json.RawMessage, ttl time.Duration) error
+
+	// UpsertRaw creates or modifies a key with a raw value, that is not
+	// JSON, and its content type, that expires after ttl, if ttl is
+	// positive. Raw values are stored as the JSON string of their base64
+	// encoding, see rawValue, other changes of the key make it a JSON value.
+	UpsertRaw(key string, data []byte, contentType string, ttl time.Duration) error
+
+	// TTL returns the remaining time to live of a key, ok is false if the
+	// key is missing or never expires.
+	TTL(key string) (ttl time.Duration, ok bool, err error)
+
+	// Delete removes a key, ok is false if the key was missing.
+	Delete(key string) (ok bool, err error)
+
+	// DeleteKeys removes keys atomically, deleted[i] is false if keys[i]
+	// was missing.
+	DeleteKeys(keys []string) (deleted []bool, err error)
+
+	// DeletePrefix removes the keys with a prefix atomically, and returns
+	// the removed keys, in key order.
+	DeletePrefix(prefix string) (deleted []string, err error)
+
+	// Clear removes all the keys, and returns their number.
+	Clear() (int, error)
+
+	// DeleteExpired removes expired keys, and returns their number.
+	DeleteExpired() (int, error)
+
+	// Incr adds delta to the integer value of a key atomically, and returns
+	// the new value, a missing key is created at 0 first. Keys keep their
+	// time to live. It returns errNotInteger if the value is not an
+	// integer, and errOverflow if the result overflows.
+	Incr(key string, delta int64) (int64, error)
+
+	// CompareAndSwap atomically replaces the value of a key with
+	// replacement, if its value equals old, or if old is nil, and the key
+	// is missing. It returns the value after the call, ok is false if there
+	// is no value. Keys keep their time to live.
+	CompareAndSwap(key string, old, replacement json.RawMessage) (value json.RawMessage, swapped, ok bool, err error)
+
+	// Push appends an element to the JSON array value of a key atomically,
+	// and returns the new array, a missing key is created as an empty array
+	// first. Keys keep their time to live. It returns errNotArray if the
+	// value is not an array.
+	Push(key string, element json.RawMessage) (value json.RawMessage, err error)
+
+	// Pop removes the first element, or the last, of the JSON array value
+	// of a key atomically, and returns it, and the array after the pop, or
+	// a nil array if the key is missing, ok is false if there is no
+	// element. Keys keep their time to live. It returns errNotArray if the
+	// value is not an array.
+	Pop(key string, front bool) (element, value json.RawMessage, ok bool, err error)
+
+	// Txn evaluates the checks of a transaction, and if all of them pass,
+	// applies its puts and deletes atomically, in order, put values never
+	// expire. It returns the index of the first failed check, or -1, and
+	// the current value of its key, existed[i] is true if the key of
+	// ops[i] had a value before ops[i] was applied.
+	Txn(ops []TxnOp) (failed int, current json.RawMessage, existed []bool, err error)
+
+	// Trash moves a key to the trash, with its value and metadata,
+	// replacing a trashed key with the same name, ok is false if the key
+	// was missing. Trashed keys are missing, and never expire.
+	Trash(key string) (ok bool, err error)
+
+	// ListTrash returns the trashed keys with a prefix, in key order.
+	ListTrash(prefix string) ([]TrashedKey, error)
+
+	// Restore moves a key from the trash back, with its value, its
+	// creation time, and the content type of raw values, restored keys
+	// never expire. It returns the value, ok is false if the key is not in
+	// the trash, and errKeyExists if the key has a value.
+	Restore(key string) (value json.RawMessage, ok bool, err error)
+
+	// DeleteTrashed removes a key from the trash, ok is false if the key
+	// is not in the trash.
+	DeleteTrashed(key string) (ok bool, err error)
+
+	// PurgeTrash removes the keys trashed more than retention ago, and
+	// returns their number.
+	PurgeTrash(retention time.Duration) (int, error)
+
+	// Revision returns a number that changes on every change of the key
+	// value pairs, including keys that expired, and of the trash. A
+	// revision read before reading values is never newer than the values.
+	Revision() (uint64, error)
+
+	// Stats returns statistics of the store, fields the store can't report
+	// are zero.
+	Stats() (StoreStats, error)
+}
+
+// KeyMeta is the metadata of a key, the times it was created, and last
+// modified, keys created again after they were deleted, or expired, are new
+// keys.
+//
+// Keys written by stores that did not record metadata have zero times.
+type KeyMeta struct {
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// The content type of a raw value, empty for JSON values.
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// touched returns the metadata of a key modified at now, created at now if
+// the key is new, modified keys have JSON values.
+func (m KeyMeta) touched(now time.Time, created bool) KeyMeta {
+	now = now.UTC()
+	if created {
+		m.CreatedAt = now
+	}
+	m.UpdatedAt = now
+	m.ContentType = ""
+
+	return m
+}
+
+// TrashedKey is a key in the trash, its value, its metadata, and the time
+// it was moved to the trash.
+type TrashedKey struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+	KeyMeta
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// rawValue returns the stored value of raw data, the JSON string of its
+// base64 encoding.
+func rawValue(data []byte) json.RawMessage {
+	v, _ := json.Marshal(data)
+	return v
+}
+
+// Operations of a transaction.
+const (
+	TxnPut    = "put"
+	TxnDelete = "delete"
+	TxnCheck  = "check"
+)
+
+// TxnOp is an operation of a transaction, a put sets the value of a key,
+// a delete removes a key, and a check passes if the value of a key equals
+// the value, or if the value is nil, and the key is missing.
+type TxnOp struct {
+	Op    string          `json:"op"`
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// StoreStats are statistics of a store.
+type StoreStats struct {
+	// Keys is the number of keys, as reported by Len.
+	Keys int `json:"keys"`
+
+	// ValueBytes is the total size of the values.
+	ValueBytes int64 `json:"value_bytes"`
+
+	// Operation counters, gets count every key read, and hits and misses
+	// count found and missing keys, upserts count written values, and
+	// deletes count deleted keys.
+	Gets    uint64 `json:"gets"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+	Upserts uint64 `json:"upserts"`
+	Deletes uint64 `json:"deletes"`
+
+	// Evictions is the number of keys evicted by a bounded store.
+	Evictions uint64 `json:"evictions"`
+}
+
+// valueETag returns the strong ETag of a value, a hash of its compact JSON.
+func valueETag(v json.RawMessage) string {
+	sum := sha256.Sum256(v)
+
+	return "\"" + hex.EncodeToString(sum[:16]) + "\""
+}
+
+// incrValue adds delta to an integer JSON value, a nil value is 0, and
+// returns the new value, as JSON, and as an integer.
+func incrValue(v json.RawMessage, delta int64) (json.RawMessage, int64, error) {
+	var n int64
+	if v != nil {
+		// Decode numbers as json.Number, so 64-bit integers don't lose
+		// precision as float64.
+		var num interface{}
+		d := json.NewDecoder(bytes.NewReader(v))
+		d.UseNumber()
+		if err := d.Decode(&num); err != nil {
+			return nil, 0, errNotInteger
+		}
+		jn, ok := num.(json.Number)
+		if !ok {
+			return nil, 0, errNotInteger
+		}
+
+		var err error
+		n, err = strconv.ParseInt(jn.String(), 10, 64)
+		if err != nil {
+			return nil, 0, errNotInteger
+		}
+	}
+
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return nil, 0, errOverflow
+	}
+	n += delta
+
+	return json.RawMessage(strconv.FormatInt(n, 10)), n, nil
 }
 
-func newStore() *Store {
-	s := Store{
-		vals: make(map[string]interface{}),
+// swapValue checks if a compare and swap of the value of a key, cur, ok,
+// replaces it with replacement, and returns the value after the swap.
+func swapValue(cur json.RawMessage, ok bool, old, replacement json.RawMessage) (json.RawMessage, bool) {
+	if valueMatches(cur, ok, old) {
+		return replacement, true
 	}
 
-	return &s
+	return cur, false
 }
 
-func (s Store) list() map[string]interface{} {
-	return s.vals
+// valueMatches checks if the value of a key, cur, ok, equals expected, or
+// if expected is nil, and the key is missing.
+func valueMatches(cur json.RawMessage, ok bool, expected json.RawMessage) bool {
+	return expected == nil && !ok || expected != nil && ok && jsonEqual(cur, expected)
 }
 
-func (s Store) get(k string) (interface{}, bool) {
-	val, ok := s.vals[k]
+// jsonEqual checks if two JSON values are deeply equal, ignoring the order
+// of object members, and comparing numbers by value, e.g. 1 equals 1.0.
+func jsonEqual(a, b json.RawMessage) bool {
+	var x, y interface{}
+	if unmarshalNumbers(a, &x) != nil || unmarshalNumbers(b, &y) != nil {
+		return false
+	}
 
-	return val, ok
+	return equalValues(x, y)
 }
 
-func (s *Store) upsert(k string, v interface{}) {
-	s.vals[k] = v
+// equalValues checks if two decoded JSON values are deeply equal.
+func equalValues(a, b interface{}) bool {
+	switch x := a.(type) {
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k, v := range x {
+			w, ok := y[k]
+			if !ok || !equalValues(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !equalValues(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		y, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+
+		// Compare exact rationals, so large numbers are not rounded.
+		r, ok1 := new(big.Rat).SetString(x.String())
+		q, ok2 := new(big.Rat).SetString(y.String())
+		return ok1 && ok2 && r.Cmp(q) == 0
+	default:
+		return a == b
+	}
 }
 
-func (s *Store) delete(k string) {
-	delete(s.vals, k)
+// initialRevision returns the revision of a new store, revisions start at
+// the current time, so a restarted store doesn't repeat old revisions.
+func initialRevision() uint64 {
+	return uint64(time.Now().UnixNano())
 }
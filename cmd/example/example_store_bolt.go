@@ -0,0 +1,909 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package main
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltBucket is the bucket holding the values.
+var boltBucket = []byte("vals")
+
+// boltETagsBucket is the bucket holding the ETags of the values.
+var boltETagsBucket = []byte("etags")
+
+// boltExpiresBucket is the bucket holding the expiry times of keys with
+// a TTL, as big endian Unix nanoseconds.
+var boltExpiresBucket = []byte("expires")
+
+// boltMetaBucket is the bucket holding the creation and modification times
+// of keys, as big endian Unix nanoseconds.
+var boltMetaBucket = []byte("meta")
+
+// boltBuckets are the buckets of the keys.
+var boltBuckets = [][]byte{boltBucket, boltETagsBucket, boltExpiresBucket, boltMetaBucket}
+
+// boltTrashBucket is the bucket holding the trashed keys, as JSON
+// TrashedKey objects, it is not one of the buckets of the keys, so clearing
+// the keys keeps the trash.
+var boltTrashBucket = []byte("trash")
+
+// BoltStore is a Store persisted to a bbolt database, it is safe for
+// concurrent use.
+//
+// Every change is committed in its own transaction, bbolt serializes
+// writers, and readers run concurrently.
+type BoltStore struct {
+	db *bolt.DB
+
+	// Revision of the key value pairs, incremented after every committed
+	// change, accessed atomically.
+	rev uint64
+
+	// Returns the current time, replaced in tests.
+	now func() time.Time
+}
+
+// newBoltStore opens, or creates, the bbolt database at path.
+func newBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range boltBuckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		_, err := tx.CreateBucketIfNotExists(boltTrashBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{db: db, rev: initialRevision(), now: time.Now}, nil
+}
+
+// Get returns the value of a key, and removes it if it expired.
+func (s *BoltStore) Get(k string) (json.RawMessage, bool, error) {
+	val, _, ok, err := s.GetWithETag(k)
+
+	return val, ok, err
+}
+
+// GetWithETag returns the value of a key, and its stored ETag, and removes
+// the key if it expired.
+func (s *BoltStore) GetWithETag(k string) (json.RawMessage, string, bool, error) {
+	var val json.RawMessage
+	etag := ""
+	expired := false
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if boltExpired(tx, []byte(k), s.now()) {
+			expired = true
+			return nil
+		}
+
+		// Values are only valid during the transaction, copy them.
+		if v := tx.Bucket(boltBucket).Get([]byte(k)); v != nil {
+			val = append(json.RawMessage(nil), v...)
+			etag = string(tx.Bucket(boltETagsBucket).Get([]byte(k)))
+		}
+		return nil
+	})
+	if err != nil || !expired {
+		// Databases created before ETags were stored have values
+		// without an ETag.
+		if val != nil && etag == "" {
+			etag = valueETag(val)
+		}
+		return val, etag, val != nil, err
+	}
+
+	err = s.update(func(tx *bolt.Tx) error {
+		if boltExpired(tx, []byte(k), s.now()) {
+			return boltDelete(tx, []byte(k))
+		}
+		return nil
+	})
+
+	return nil, "", false, err
+}
+
+// GetMany returns the values of keys that are not missing, in one
+// transaction.
+func (s *BoltStore) GetMany(keys []string) (map[string]json.RawMessage, error) {
+	vals := make(map[string]json.RawMessage, len(keys))
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		now := s.now()
+		b := tx.Bucket(boltBucket)
+		for _, k := range keys {
+			if v := b.Get([]byte(k)); v != nil && !boltExpired(tx, []byte(k), now) {
+				vals[k] = append(json.RawMessage(nil), v...)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return vals, nil
+}
+
+// Meta returns the metadata of keys that are not missing, in one
+// transaction.
+func (s *BoltStore) Meta(keys []string) (map[string]KeyMeta, error) {
+	metas := make(map[string]KeyMeta, len(keys))
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		now := s.now()
+		for _, k := range keys {
+			if tx.Bucket(boltBucket).Get([]byte(k)) != nil && !boltExpired(tx, []byte(k), now) {
+				metas[k] = boltMeta(tx, []byte(k))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return metas, nil
+}
+
+// Len returns the number of keys, from the bucket statistics.
+func (s *BoltStore) Len() (int, error) {
+	n := 0
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(boltBucket).Stats().KeyN
+		return nil
+	})
+
+	return n, err
+}
+
+// Stats returns the number of keys, and the size of the values, iterating
+// the bucket.
+func (s *BoltStore) Stats() (StoreStats, error) {
+	var stats StoreStats
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBucket)
+		stats.Keys = b.Stats().KeyN
+		return b.ForEach(func(k, v []byte) error {
+			stats.ValueBytes += int64(len(v))
+			return nil
+		})
+	})
+
+	return stats, err
+}
+
+// List returns a copy of the key value pairs, iterating the bucket with
+// a cursor.
+func (s *BoltStore) List() (map[string]json.RawMessage, error) {
+	vals := make(map[string]json.RawMessage)
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		now := s.now()
+		c := tx.Bucket(boltBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if !boltExpired(tx, k, now) {
+				vals[string(k)] = append(json.RawMessage(nil), v...)
+			}
+		}
+		return nil
+	})
+
+	return vals, err
+}
+
+// ListPage returns a page of key value pairs with a prefix, seeking the
+// bucket cursor, which iterates keys in byte order.
+func (s *BoltStore) ListPage(prefix, cursor string, limit int) (map[string]json.RawMessage, string, error) {
+	page := make(map[string]json.RawMessage)
+	next := ""
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		now := s.now()
+		p := []byte(prefix)
+
+		// Start at the first key with the prefix, after the cursor key.
+		start := p
+		if cursor > prefix {
+			start = []byte(cursor)
+		}
+
+		c := tx.Bucket(boltBucket).Cursor()
+		last := ""
+		for k, v := c.Seek(start); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			if string(k) == cursor || boltExpired(tx, k, now) {
+				continue
+			}
+			if limit > 0 && len(page) == limit {
+				next = last
+				break
+			}
+			page[string(k)] = append(json.RawMessage(nil), v...)
+			last = string(k)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return page, next, nil
+}
+
+// Upsert creates or modifies a key value pair, that never expires.
+func (s *BoltStore) Upsert(k string, v json.RawMessage) error {
+	return s.update(func(tx *bolt.Tx) error {
+		if err := boltPut(tx, []byte(k), v, s.now()); err != nil {
+			return err
+		}
+		return tx.Bucket(boltExpiresBucket).Delete([]byte(k))
+	})
+}
+
+// UpsertTTL creates or modifies a key value pair, that expires after ttl.
+func (s *BoltStore) UpsertTTL(k string, v json.RawMessage, ttl time.Duration) error {
+	if ttl <= 0 {
+		return s.Upsert(k, v)
+	}
+
+	expires := make([]byte, 8)
+	binary.BigEndian.PutUint64(expires, uint64(s.now().Add(ttl).UnixNano()))
+
+	return s.update(func(tx *bolt.Tx) error {
+		if err := boltPut(tx, []byte(k), v, s.now()); err != nil {
+			return err
+		}
+		return tx.Bucket(boltExpiresBucket).Put([]byte(k), expires)
+	})
+}
+
+// UpsertRaw creates or modifies a key with a raw value, and its content
+// type, that expires after ttl, if ttl is positive.
+func (s *BoltStore) UpsertRaw(k string, data []byte, contentType string, ttl time.Duration) error {
+	return s.update(func(tx *bolt.Tx) error {
+		if err := boltPut(tx, []byte(k), rawValue(data), s.now()); err != nil {
+			return err
+		}
+		if err := boltSetContentType(tx, []byte(k), contentType); err != nil {
+			return err
+		}
+		if ttl <= 0 {
+			return tx.Bucket(boltExpiresBucket).Delete([]byte(k))
+		}
+
+		expires := make([]byte, 8)
+		binary.BigEndian.PutUint64(expires, uint64(s.now().Add(ttl).UnixNano()))
+		return tx.Bucket(boltExpiresBucket).Put([]byte(k), expires)
+	})
+}
+
+// TTL returns the remaining time to live of a key.
+func (s *BoltStore) TTL(k string) (time.Duration, bool, error) {
+	var ttl time.Duration
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if expires, ok := boltExpiry(tx, []byte(k)); ok {
+			ttl = expires.Sub(s.now())
+		}
+		return nil
+	})
+	if err != nil || ttl <= 0 {
+		return 0, false, err
+	}
+
+	return ttl, true, nil
+}
+
+// Delete removes a key.
+func (s *BoltStore) Delete(k string) (bool, error) {
+	ok := false
+
+	err := s.update(func(tx *bolt.Tx) error {
+		ok = tx.Bucket(boltBucket).Get([]byte(k)) != nil && !boltExpired(tx, []byte(k), s.now())
+		return boltDelete(tx, []byte(k))
+	})
+
+	return ok, err
+}
+
+// DeleteKeys removes keys in one transaction.
+func (s *BoltStore) DeleteKeys(keys []string) ([]bool, error) {
+	deleted := make([]bool, len(keys))
+
+	err := s.update(func(tx *bolt.Tx) error {
+		now := s.now()
+		for i, k := range keys {
+			deleted[i] = tx.Bucket(boltBucket).Get([]byte(k)) != nil && !boltExpired(tx, []byte(k), now)
+			if err := boltDelete(tx, []byte(k)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return deleted, nil
+}
+
+// DeletePrefix removes the keys with a prefix in one transaction, seeking
+// the bucket cursor to the first key with the prefix.
+func (s *BoltStore) DeletePrefix(prefix string) ([]string, error) {
+	deleted := []string{}
+
+	err := s.update(func(tx *bolt.Tx) error {
+		// Collect the keys first, a bucket must not be modified while
+		// iterating it.
+		var matching [][]byte
+		p := []byte(prefix)
+		c := tx.Bucket(boltBucket).Cursor()
+		for k, _ := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, _ = c.Next() {
+			matching = append(matching, append([]byte(nil), k...))
+		}
+
+		now := s.now()
+		for _, k := range matching {
+			if !boltExpired(tx, k, now) {
+				deleted = append(deleted, string(k))
+			}
+			if err := boltDelete(tx, k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return deleted, nil
+}
+
+// Clear removes all the keys, recreating the buckets.
+func (s *BoltStore) Clear() (int, error) {
+	n := 0
+
+	err := s.update(func(tx *bolt.Tx) error {
+		now := s.now()
+		c := tx.Bucket(boltBucket).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if !boltExpired(tx, k, now) {
+				n++
+			}
+		}
+
+		for _, name := range boltBuckets {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// DeleteExpired removes expired keys.
+func (s *BoltStore) DeleteExpired() (int, error) {
+	n := 0
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		// Collect the keys first, a bucket must not be modified while
+		// iterating it.
+		var expired [][]byte
+		now := s.now()
+		c := tx.Bucket(boltExpiresBucket).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if boltExpired(tx, k, now) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+		}
+
+		for _, k := range expired {
+			if err := boltDelete(tx, k); err != nil {
+				return err
+			}
+		}
+		n = len(expired)
+		return nil
+	})
+
+	// Sweeps that find no expired keys don't change the revision.
+	if err == nil && n > 0 {
+		atomic.AddUint64(&s.rev, 1)
+	}
+
+	return n, err
+}
+
+// Incr adds delta to the integer value of a key in one transaction.
+func (s *BoltStore) Incr(k string, delta int64) (int64, error) {
+	var n int64
+
+	err := s.update(func(tx *bolt.Tx) error {
+		if boltExpired(tx, []byte(k), s.now()) {
+			if err := boltDelete(tx, []byte(k)); err != nil {
+				return err
+			}
+		}
+
+		v, next, err := incrValue(tx.Bucket(boltBucket).Get([]byte(k)), delta)
+		if err != nil {
+			return err
+		}
+		n = next
+		return boltPut(tx, []byte(k), v, s.now())
+	})
+
+	return n, err
+}
+
+// CompareAndSwap replaces the value of a key in one transaction, if it
+// equals old.
+func (s *BoltStore) CompareAndSwap(k string, old, replacement json.RawMessage) (json.RawMessage, bool, bool, error) {
+	var v json.RawMessage
+	swapped, ok := false, false
+
+	err := s.update(func(tx *bolt.Tx) error {
+		if boltExpired(tx, []byte(k), s.now()) {
+			if err := boltDelete(tx, []byte(k)); err != nil {
+				return err
+			}
+		}
+
+		cur := tx.Bucket(boltBucket).Get([]byte(k))
+		ok = cur != nil
+		v, swapped = swapValue(cur, ok, old, replacement)
+
+		// Values are only valid during the transaction, copy them.
+		v = append(json.RawMessage(nil), v...)
+		if !swapped {
+			return nil
+		}
+		ok = true
+		return boltPut(tx, []byte(k), v, s.now())
+	})
+	if err != nil {
+		return nil, false, false, err
+	}
+
+	return v, swapped, ok, nil
+}
+
+// Push appends an element to the array value of a key in one transaction.
+func (s *BoltStore) Push(k string, element json.RawMessage) (json.RawMessage, error) {
+	var v json.RawMessage
+
+	err := s.update(func(tx *bolt.Tx) error {
+		if boltExpired(tx, []byte(k), s.now()) {
+			if err := boltDelete(tx, []byte(k)); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		v, err = pushValue(tx.Bucket(boltBucket).Get([]byte(k)), element)
+		if err != nil {
+			return err
+		}
+		return boltPut(tx, []byte(k), v, s.now())
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// Pop removes the first, or the last, element of the array value of a key
+// in one transaction.
+func (s *BoltStore) Pop(k string, front bool) (json.RawMessage, json.RawMessage, bool, error) {
+	var v, element json.RawMessage
+	ok := false
+
+	err := s.update(func(tx *bolt.Tx) error {
+		if boltExpired(tx, []byte(k), s.now()) {
+			if err := boltDelete(tx, []byte(k)); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		v, element, ok, err = popValue(tx.Bucket(boltBucket).Get([]byte(k)), front)
+		if err != nil {
+			return err
+		}
+
+		// Values are only valid during the transaction, copy them.
+		if v != nil {
+			v = append(json.RawMessage(nil), v...)
+		}
+		if !ok {
+			return nil
+		}
+		element = append(json.RawMessage(nil), element...)
+		return boltPut(tx, []byte(k), v, s.now())
+	})
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	return element, v, ok, nil
+}
+
+// errBoltCheckFailed rolls back the bolt transaction of a transaction with
+// a failed check.
+var errBoltCheckFailed = errors.New("check failed")
+
+// Txn evaluates the checks of a transaction, and applies its puts and
+// deletes, in one bolt transaction, a failed check rolls it back.
+func (s *BoltStore) Txn(ops []TxnOp) (int, json.RawMessage, []bool, error) {
+	failed := -1
+	var current json.RawMessage
+	existed := make([]bool, len(ops))
+
+	err := s.update(func(tx *bolt.Tx) error {
+		now := s.now()
+		b := tx.Bucket(boltBucket)
+		for _, op := range ops {
+			if boltExpired(tx, []byte(op.Key), now) {
+				if err := boltDelete(tx, []byte(op.Key)); err != nil {
+					return err
+				}
+			}
+		}
+
+		for i, op := range ops {
+			if op.Op != TxnCheck {
+				continue
+			}
+			cur := b.Get([]byte(op.Key))
+			if !valueMatches(cur, cur != nil, op.Value) {
+				// Values are only valid during the transaction, copy them.
+				failed = i
+				if cur != nil {
+					current = append(json.RawMessage(nil), cur...)
+				}
+				return errBoltCheckFailed
+			}
+		}
+
+		for i, op := range ops {
+			existed[i] = b.Get([]byte(op.Key)) != nil
+			var err error
+			switch op.Op {
+			case TxnPut:
+				if err = boltPut(tx, []byte(op.Key), op.Value, now); err == nil {
+					err = tx.Bucket(boltExpiresBucket).Delete([]byte(op.Key))
+				}
+			case TxnDelete:
+				err = boltDelete(tx, []byte(op.Key))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == errBoltCheckFailed {
+		return failed, current, nil, nil
+	}
+	if err != nil {
+		return -1, nil, nil, err
+	}
+
+	return -1, nil, existed, nil
+}
+
+// Trash moves a key to the trash in one transaction.
+func (s *BoltStore) Trash(k string) (bool, error) {
+	ok := false
+
+	err := s.update(func(tx *bolt.Tx) error {
+		now := s.now()
+		v := tx.Bucket(boltBucket).Get([]byte(k))
+		if v != nil && !boltExpired(tx, []byte(k), now) {
+			data, err := json.Marshal(TrashedKey{
+				Key:       k,
+				Value:     v,
+				KeyMeta:   boltMeta(tx, []byte(k)),
+				DeletedAt: now.UTC(),
+			})
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket(boltTrashBucket).Put([]byte(k), data); err != nil {
+				return err
+			}
+			ok = true
+		}
+		return boltDelete(tx, []byte(k))
+	})
+
+	return ok, err
+}
+
+// ListTrash returns the trashed keys with a prefix, seeking the trash
+// bucket cursor.
+func (s *BoltStore) ListTrash(prefix string) ([]TrashedKey, error) {
+	trashed := []TrashedKey{}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		p := []byte(prefix)
+		c := tx.Bucket(boltTrashBucket).Cursor()
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			var t TrashedKey
+			if err := json.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			trashed = append(trashed, t)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return trashed, nil
+}
+
+// Restore moves a key from the trash back in one transaction.
+func (s *BoltStore) Restore(k string) (json.RawMessage, bool, error) {
+	var t TrashedKey
+	ok := false
+
+	err := s.update(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltTrashBucket).Get([]byte(k))
+		if data == nil {
+			return nil
+		}
+		if err := json.Unmarshal(data, &t); err != nil {
+			return err
+		}
+
+		now := s.now()
+		if tx.Bucket(boltBucket).Get([]byte(k)) != nil {
+			if !boltExpired(tx, []byte(k), now) {
+				return errKeyExists
+			}
+			if err := boltDelete(tx, []byte(k)); err != nil {
+				return err
+			}
+		}
+
+		// Keys trashed without metadata are created now.
+		m := KeyMeta{}.touched(now, true)
+		if !t.CreatedAt.IsZero() {
+			m.CreatedAt = t.CreatedAt
+		}
+		m.ContentType = t.ContentType
+		if err := boltPutMeta(tx, []byte(k), t.Value, m); err != nil {
+			return err
+		}
+		ok = true
+		return tx.Bucket(boltTrashBucket).Delete([]byte(k))
+	})
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	return t.Value, true, nil
+}
+
+// DeleteTrashed removes a key from the trash.
+func (s *BoltStore) DeleteTrashed(k string) (bool, error) {
+	ok := false
+
+	err := s.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltTrashBucket)
+		ok = b.Get([]byte(k)) != nil
+		return b.Delete([]byte(k))
+	})
+
+	return ok, err
+}
+
+// PurgeTrash removes the keys trashed more than retention ago.
+func (s *BoltStore) PurgeTrash(retention time.Duration) (int, error) {
+	n := 0
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		// Collect the keys first, a bucket must not be modified while
+		// iterating it.
+		var purged [][]byte
+		before := s.now().Add(-retention)
+		b := tx.Bucket(boltTrashBucket)
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var t TrashedKey
+			if err := json.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			if t.DeletedAt.Before(before) {
+				purged = append(purged, append([]byte(nil), k...))
+			}
+		}
+
+		for _, k := range purged {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(purged)
+		return nil
+	})
+
+	// Sweeps that find no keys to purge don't change the revision.
+	if err == nil && n > 0 {
+		atomic.AddUint64(&s.rev, 1)
+	}
+
+	return n, err
+}
+
+// Revision returns the revision of the key value pairs, removing expired
+// keys first, so keys that expired change the revision.
+func (s *BoltStore) Revision() (uint64, error) {
+	rev := atomic.LoadUint64(&s.rev)
+	expired := false
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		now := s.now()
+		c := tx.Bucket(boltExpiresBucket).Cursor()
+		for k, _ := c.First(); k != nil && !expired; k, _ = c.Next() {
+			expired = boltExpired(tx, k, now)
+		}
+		return nil
+	})
+	if err != nil || !expired {
+		return rev, err
+	}
+
+	if _, err := s.DeleteExpired(); err != nil {
+		return 0, err
+	}
+
+	return atomic.LoadUint64(&s.rev), nil
+}
+
+// update runs fn in a read-write transaction, and increments the revision
+// once the transaction is committed, so readers never see a revision newer
+// than the values.
+func (s *BoltStore) update(fn func(tx *bolt.Tx) error) error {
+	if err := s.db.Update(fn); err != nil {
+		return err
+	}
+	atomic.AddUint64(&s.rev, 1)
+
+	return nil
+}
+
+// Close closes the database.
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// boltExpiry returns the expiry time of a key, ok is false if it never
+// expires.
+func boltExpiry(tx *bolt.Tx, k []byte) (time.Time, bool) {
+	v := tx.Bucket(boltExpiresBucket).Get(k)
+	if len(v) != 8 {
+		return time.Time{}, false
+	}
+
+	return time.Unix(0, int64(binary.BigEndian.Uint64(v))), true
+}
+
+// boltExpired checks if a key expired.
+func boltExpired(tx *bolt.Tx, k []byte, now time.Time) bool {
+	expires, ok := boltExpiry(tx, k)
+
+	return ok && !now.Before(expires)
+}
+
+// boltMeta returns the metadata of a key, zero times if it has none.
+//
+// Metadata is the creation and modification times, followed by the content
+// type of raw values.
+func boltMeta(tx *bolt.Tx, k []byte) KeyMeta {
+	var m KeyMeta
+	if v := tx.Bucket(boltMetaBucket).Get(k); len(v) >= 16 {
+		m.CreatedAt = time.Unix(0, int64(binary.BigEndian.Uint64(v[:8]))).UTC()
+		m.UpdatedAt = time.Unix(0, int64(binary.BigEndian.Uint64(v[8:16]))).UTC()
+		m.ContentType = string(v[16:])
+	}
+
+	return m
+}
+
+// boltSetContentType sets the content type of the raw value of a key, that
+// has metadata.
+func boltSetContentType(tx *bolt.Tx, k []byte, contentType string) error {
+	b := tx.Bucket(boltMetaBucket)
+	meta := b.Get(k)
+	if len(meta) < 16 {
+		return nil
+	}
+
+	return b.Put(k, append(append([]byte(nil), meta[:16]...), contentType...))
+}
+
+// boltPut sets the value of a key, its ETag and its metadata, modified at
+// now, keys that expired are created again.
+func boltPut(tx *bolt.Tx, k []byte, v json.RawMessage, now time.Time) error {
+	created := tx.Bucket(boltBucket).Get(k) == nil || boltExpired(tx, k, now)
+
+	return boltPutMeta(tx, k, v, boltMeta(tx, k).touched(now, created))
+}
+
+// boltPutMeta sets the value of a key, its ETag and its metadata.
+func boltPutMeta(tx *bolt.Tx, k []byte, v json.RawMessage, m KeyMeta) error {
+	meta := make([]byte, 16, 16+len(m.ContentType))
+	binary.BigEndian.PutUint64(meta[:8], uint64(m.CreatedAt.UnixNano()))
+	binary.BigEndian.PutUint64(meta[8:], uint64(m.UpdatedAt.UnixNano()))
+	meta = append(meta, m.ContentType...)
+	if err := tx.Bucket(boltMetaBucket).Put(k, meta); err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltETagsBucket).Put(k, []byte(valueETag(v))); err != nil {
+		return err
+	}
+
+	return tx.Bucket(boltBucket).Put(k, v)
+}
+
+// boltDelete removes a key, its ETag, its expiry time and its metadata.
+func boltDelete(tx *bolt.Tx, k []byte) error {
+	if err := tx.Bucket(boltExpiresBucket).Delete(k); err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltMetaBucket).Delete(k); err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltETagsBucket).Delete(k); err != nil {
+		return err
+	}
+
+	return tx.Bucket(boltBucket).Delete(k)
+}
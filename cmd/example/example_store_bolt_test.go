@@ -0,0 +1,363 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// openBoltStore opens a bbolt store in a temporary directory.
+func openBoltStore(t testing.TB, path string) *BoltStore {
+	s, err := newBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestBoltStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kitty.db")
+	s := openBoltStore(t, path)
+
+	if _, ok, err := s.Get("kitty"); ok || err != nil {
+		t.Errorf("Get of a missing key: got %v, %v", ok, err)
+	}
+	for k, v := range map[string]string{"kitty": `"cat"`, "città/ü 1": `[1,2]`, "gone": `0`} {
+		if err := s.Upsert(k, json.RawMessage(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ok, err := s.Delete("gone"); !ok || err != nil {
+		t.Errorf("Delete: got %v, %v", ok, err)
+	}
+	if ok, err := s.Delete("gone"); ok || err != nil {
+		t.Errorf("Delete of a missing key: got %v, %v", ok, err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Check the values survive a restart.
+	s = openBoltStore(t, path)
+	defer s.Close()
+
+	vals, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vals) != 2 || string(vals["kitty"]) != `"cat"` || string(vals["città/ü 1"]) != `[1,2]` {
+		t.Errorf("List: got %v", vals)
+	}
+	if val, ok, err := s.Get("kitty"); !ok || err != nil || string(val) != `"cat"` {
+		t.Errorf("Get: got %s, %v, %v", val, ok, err)
+	}
+}
+
+func TestBoltStoreConcurrentRequests(t *testing.T) {
+	s := openBoltStore(t, filepath.Join(t.TempDir(), "kitty.db"))
+	defer s.Close()
+	handler := newStoreRouter(s)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			key := fmt.Sprintf("kitty%d", i%5)
+			requests := []struct {
+				method string
+				path   string
+				body   string
+			}{
+				{"PUT", "/val/" + key, fmt.Sprintf("%d", i)},
+				{"GET", "/val", ""},
+				{"GET", "/val/" + key, ""},
+				{"POST", "/val", fmt.Sprintf("{\"%s\": %d}", key, i)},
+				{"DELETE", "/val/" + key, ""},
+			}
+
+			for _, tt := range requests {
+				req, err := http.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, req)
+
+				// Check the server did not fail.
+				if rr.Code >= http.StatusInternalServerError {
+					t.Errorf("%s %s: handler returned status code %v: %s",
+						tt.method, tt.path, rr.Code, rr.Body.String())
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// benchmarkPUT benchmarks the PUT handler using store.
+func benchmarkPUT(b *testing.B, store Store) {
+	handler := newStoreRouter(store)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req, err := http.NewRequest("PUT", fmt.Sprintf("/val/kitty%d", i%1000),
+			strings.NewReader(fmt.Sprintf("{\"n\":%d}", i)))
+		if err != nil {
+			b.Fatal(err)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
+
+func BenchmarkPUTMemoryStore(b *testing.B) {
+	benchmarkPUT(b, newMemoryStore())
+}
+
+func BenchmarkPUTBoltStore(b *testing.B) {
+	s := openBoltStore(b, filepath.Join(b.TempDir(), "kitty.db"))
+	defer s.Close()
+
+	benchmarkPUT(b, s)
+}
+
+func TestBoltStoreTTL(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	path := filepath.Join(t.TempDir(), "kitty.db")
+	s := openBoltStore(t, path)
+	s.now = clock.Now
+
+	s.UpsertTTL("short", json.RawMessage(`1`), time.Second)
+	s.UpsertTTL("long", json.RawMessage(`2`), time.Minute)
+	s.UpsertTTL("cleared", json.RawMessage(`3`), time.Second)
+	s.Upsert("cleared", json.RawMessage(`3`))
+	s.Close()
+
+	// Check expiry times survive a restart.
+	s = openBoltStore(t, path)
+	defer s.Close()
+	s.now = clock.Now
+	clock.Add(time.Second)
+
+	if ttl, ok, _ := s.TTL("long"); !ok || ttl != 59*time.Second {
+		t.Errorf("TTL: got %v, %v want 59s", ttl, ok)
+	}
+	if vals, _ := s.List(); len(vals) != 2 {
+		t.Errorf("List: got %v, want long and cleared", vals)
+	}
+	if _, ok, _ := s.Get("short"); ok {
+		t.Errorf("Get of an expired key: got ok")
+	}
+	if ok, _ := s.Delete("short"); ok {
+		t.Errorf("Delete of an expired key: got ok")
+	}
+
+	clock.Add(time.Minute)
+	if n, err := s.DeleteExpired(); n != 1 || err != nil {
+		t.Errorf("DeleteExpired: got %v, %v want 1", n, err)
+	}
+	if vals, _ := s.List(); len(vals) != 1 || string(vals["cleared"]) != `3` {
+		t.Errorf("List: got %v, want cleared", vals)
+	}
+}
+
+func TestBoltStoreBulkDelete(t *testing.T) {
+	s := openBoltStore(t, filepath.Join(t.TempDir(), "kitty.db"))
+	defer s.Close()
+
+	for _, k := range []string{"a", "b", "c"} {
+		s.Upsert(k, json.RawMessage(`1`))
+	}
+
+	deleted, err := s.DeleteKeys([]string{"a", "missing", "b"})
+	if err != nil || len(deleted) != 3 || !deleted[0] || deleted[1] || !deleted[2] {
+		t.Errorf("DeleteKeys: got %v, %v want [true false true]", deleted, err)
+	}
+	if n, err := s.Clear(); n != 1 || err != nil {
+		t.Errorf("Clear: got %v, %v want 1", n, err)
+	}
+
+	// Check the store works after clearing it.
+	if err := s.Upsert("d", json.RawMessage(`1`)); err != nil {
+		t.Errorf("Upsert after Clear: %v", err)
+	}
+	if vals, _ := s.List(); len(vals) != 1 {
+		t.Errorf("List: got %v want d", vals)
+	}
+}
+
+func TestBoltStoreListPage(t *testing.T) {
+	s := openBoltStore(t, filepath.Join(t.TempDir(), "kitty.db"))
+	defer s.Close()
+
+	testListPage(t, s)
+}
+
+func TestBoltStoreETags(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	s := openBoltStore(t, filepath.Join(t.TempDir(), "kitty.db"))
+	defer s.Close()
+	s.now = clock.Now
+
+	rev, _ := s.Revision()
+	s.UpsertTTL("kitty", json.RawMessage(`"cat"`), time.Minute)
+	_, etag, ok, err := s.GetWithETag("kitty")
+	if !ok || err != nil || etag != valueETag(json.RawMessage(`"cat"`)) {
+		t.Errorf("GetWithETag: got %v, %v, %v want the ETag of cat", etag, ok, err)
+	}
+
+	// Check changes, and keys that expired, change the revision.
+	for _, change := range []func(){
+		func() {}, // kitty was stored.
+		func() { s.Upsert("gorilla", json.RawMessage(`1`)) },
+		func() { clock.Add(time.Hour) },
+		func() { s.Delete("gorilla") },
+	} {
+		change()
+		got, err := s.Revision()
+		if err != nil || got == rev {
+			t.Errorf("Revision: got %v, %v want a new revision", got, err)
+		}
+		rev = got
+	}
+
+	// Check sweeps without expired keys keep the revision.
+	s.DeleteExpired()
+	if got, _ := s.Revision(); got != rev {
+		t.Errorf("Revision after an empty sweep: got %v want %v", got, rev)
+	}
+	if _, etag, ok, _ := s.GetWithETag("kitty"); ok || etag != "" {
+		t.Errorf("GetWithETag of an expired key: got %v, %v want missing", etag, ok)
+	}
+}
+
+func TestBoltStoreDeletePrefix(t *testing.T) {
+	s := openBoltStore(t, filepath.Join(t.TempDir(), "kitty.db"))
+	defer s.Close()
+
+	testDeletePrefix(t, s)
+}
+
+func TestBoltStoreConcurrentIncr(t *testing.T) {
+	s := openBoltStore(t, filepath.Join(t.TempDir(), "kitty.db"))
+	defer s.Close()
+
+	testConcurrentIncr(t, s)
+}
+
+func TestBoltStoreConcurrentCAS(t *testing.T) {
+	s := openBoltStore(t, filepath.Join(t.TempDir(), "kitty.db"))
+	defer s.Close()
+
+	testConcurrentCAS(t, s)
+}
+
+func TestBoltStoreConcurrentPushPop(t *testing.T) {
+	s := openBoltStore(t, filepath.Join(t.TempDir(), "kitty.db"))
+	defer s.Close()
+
+	testConcurrentPushPop(t, s)
+}
+
+func TestBoltStoreTxn(t *testing.T) {
+	s := openBoltStore(t, filepath.Join(t.TempDir(), "kitty.db"))
+	defer s.Close()
+
+	testStoreTxn(t, s)
+
+	// Check a failed check rolls back the bolt transaction.
+	rev, _ := s.Revision()
+	failed, _, _, err := s.Txn([]TxnOp{{Op: TxnPut, Key: "a", Value: json.RawMessage(`1`)}, {Op: TxnCheck, Key: "tom"}})
+	if failed != 1 || err != nil {
+		t.Errorf("Txn: got %v, %v want 1", failed, err)
+	}
+	if after, _ := s.Revision(); after != rev {
+		t.Errorf("a failed transaction changed the revision: got %d want %d", after, rev)
+	}
+}
+
+func TestBoltStoreConcurrentTxn(t *testing.T) {
+	s := openBoltStore(t, filepath.Join(t.TempDir(), "kitty.db"))
+	defer s.Close()
+
+	testConcurrentTxn(t, s)
+}
+
+func TestBoltStoreGetMany(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	s := openBoltStore(t, filepath.Join(t.TempDir(), "kitty.db"))
+	defer s.Close()
+	s.now = clock.Now
+
+	s.Upsert("kitty", json.RawMessage(`{"lives":9}`))
+	s.UpsertTTL("expiring", json.RawMessage(`1`), time.Second)
+	clock.Add(time.Minute)
+
+	vals, err := s.GetMany([]string{"kitty", "expiring", "gorilla", "kitty"})
+	if err != nil || len(vals) != 1 || string(vals["kitty"]) != `{"lives":9}` {
+		t.Errorf("GetMany: got %v, %v want kitty", vals, err)
+	}
+}
+
+func TestBoltStoreUpsertRaw(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kitty.db")
+	s := openBoltStore(t, path)
+	testUpsertRaw(t, s)
+	s.Close()
+
+	// Check the content type survives a restart.
+	s = openBoltStore(t, path)
+	defer s.Close()
+	if metas, _ := s.Meta([]string{"blob"}); metas["blob"].ContentType != "image/png" {
+		t.Errorf("unexpected metadata after a restart: %+v", metas["blob"])
+	}
+}
+
+func TestBoltStoreTrash(t *testing.T) {
+	clock := epochClock()
+	path := filepath.Join(t.TempDir(), "kitty.db")
+	s := openBoltStore(t, path)
+	s.now = clock.Now
+	testTrash(t, s, clock)
+
+	// Check clearing the keys keeps the trash.
+	s.Upsert("tom", json.RawMessage(`"cat"`))
+	s.Trash("tom")
+	s.Upsert("kitty", json.RawMessage(`"cat"`))
+	s.Clear()
+	s.Close()
+
+	// Check the trash survives a restart.
+	s = openBoltStore(t, path)
+	defer s.Close()
+	if got := listTrash(t, s); got != `[tom="cat"]` {
+		t.Errorf("unexpected trash after a restart: %s", got)
+	}
+	if v, ok, err := s.Restore("tom"); !ok || err != nil || string(v) != `"cat"` {
+		t.Errorf("Restore: got %s, %v, %v want \"cat\"", v, ok, err)
+	}
+}
@@ -0,0 +1,590 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package main
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// FileStore is a Store persisted to a JSON file, it is safe for concurrent
+// use.
+//
+// The file holds a JSON object, with the key value pairs in its "values"
+// member, the expiry times of keys with a TTL in its "expires" member, and
+// the creation and modification times of keys in its "meta" member, and the
+// trashed keys in its "trash" member.
+//
+// With a zero snapshot interval every change is written through, o/w the
+// values are written periodically if they changed, and on Close. Files are
+// written to a temporary file, and renamed over the JSON file, so a crash
+// never leaves a partially written file.
+//
+// With a write-ahead log, every change is appended to the log, a file with
+// a ".wal" suffix, as a JSON line, and snapshots of the values, written
+// periodically, when the log is large, and on Close, compact the log.
+// Loading replays the log records newer than the snapshot revision.
+type FileStore struct {
+	// Values are served from memory.
+	mem *MemoryStore
+
+	path     string
+	interval time.Duration
+
+	// Guards writes, dirty and the write-ahead log.
+	mu    sync.Mutex
+	dirty bool
+
+	// The write-ahead log, opened on the first append, its size, and the
+	// revision of its last record.
+	wal      walOptions
+	log      *os.File
+	logBytes int64
+	walRev   uint64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// fileSnapshot is the content of a store file, with the revision of the
+// last write-ahead log record it includes.
+type fileSnapshot struct {
+	Values   map[string]json.RawMessage `json:"values"`
+	Expires  map[string]time.Time       `json:"expires,omitempty"`
+	Meta     map[string]KeyMeta         `json:"meta,omitempty"`
+	Trash    []TrashedKey               `json:"trash,omitempty"`
+	Revision uint64                     `json:"revision,omitempty"`
+}
+
+// newFileStore returns a store persisted to path, loading its values.
+//
+// A missing file is created on the first write, a corrupted file is renamed
+// with a ".corrupt" suffix, and in both cases the store starts empty with a
+// warning.
+func newFileStore(path string, interval time.Duration) *FileStore {
+	return newFileStoreWithClock(path, interval, time.Now)
+}
+
+// newFileStoreWithClock returns a store persisted to path, using a clock
+// for expiry times.
+func newFileStoreWithClock(path string, interval time.Duration, now func() time.Time) *FileStore {
+	return newFileStoreWAL(path, interval, walOptions{}, now)
+}
+
+// newFileStoreWAL returns a store persisted to path, using a write-ahead
+// log if it is enabled.
+//
+// The log of a previous run is replayed, even if the log is disabled, and
+// then compacted.
+func newFileStoreWAL(path string, interval time.Duration, wal walOptions, now func() time.Time) *FileStore {
+	s := FileStore{
+		mem:      newMemoryStore(),
+		path:     path,
+		interval: interval,
+		wal:      wal,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	s.mem.now = now
+	s.load()
+
+	if interval > 0 {
+		go s.snapshots()
+	} else {
+		close(s.done)
+	}
+
+	return &s
+}
+
+// load reads the values from the file, and replays the write-ahead log.
+func (s *FileStore) load() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap := s.loadSnapshot()
+	s.walRev = snap.Revision
+	if n := s.replayLocked(snap.Revision); n > 0 && !s.wal.Enabled {
+		// Compact the log of a previous run, so it is not replayed again.
+		s.dirty = true
+		if err := s.writeLocked(); err != nil {
+			log.Printf("warning: can't write store file %s: %v", s.path, err)
+		}
+	}
+}
+
+// loadSnapshot reads the values from the file.
+func (s *FileStore) loadSnapshot() fileSnapshot {
+	var snap fileSnapshot
+
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		log.Printf("warning: store file %s does not exist, starting empty", s.path)
+		return snap
+	}
+	if err != nil {
+		log.Printf("warning: can't read store file %s, starting empty: %v", s.path, err)
+		return snap
+	}
+
+	if err := json.Unmarshal(data, &snap); err != nil {
+		backup := s.path + ".corrupt"
+		log.Printf("warning: store file %s is corrupted, moving it to %s and starting empty: %v",
+			s.path, backup, err)
+		os.Rename(s.path, backup)
+		return fileSnapshot{}
+	}
+
+	// Keys of files written without metadata have zero times.
+	now := s.mem.now()
+	for k, v := range snap.Values {
+		if expires, ok := snap.Expires[k]; ok {
+			if ttl := expires.Sub(now); ttl > 0 {
+				s.mem.UpsertTTL(k, compactJSON(v), ttl)
+			}
+		} else {
+			s.mem.Upsert(k, compactJSON(v))
+		}
+		s.mem.restoreMeta(k, snap.Meta[k])
+	}
+	s.mem.restoreTrash(snap.Trash)
+
+	return snap
+}
+
+// Get returns the value of a key.
+func (s *FileStore) Get(k string) (json.RawMessage, bool, error) {
+	return s.mem.Get(k)
+}
+
+// GetWithETag returns the value of a key, and its ETag.
+func (s *FileStore) GetWithETag(k string) (json.RawMessage, string, bool, error) {
+	return s.mem.GetWithETag(k)
+}
+
+// GetMany returns the values of keys that are not missing.
+func (s *FileStore) GetMany(keys []string) (map[string]json.RawMessage, error) {
+	return s.mem.GetMany(keys)
+}
+
+// Meta returns the metadata of keys that are not missing.
+func (s *FileStore) Meta(keys []string) (map[string]KeyMeta, error) {
+	return s.mem.Meta(keys)
+}
+
+// Len returns the number of keys.
+func (s *FileStore) Len() (int, error) {
+	return s.mem.Len()
+}
+
+// Stats returns the number of keys, and the size of the values.
+func (s *FileStore) Stats() (StoreStats, error) {
+	return s.mem.Stats()
+}
+
+// List returns a copy of the key value pairs.
+func (s *FileStore) List() (map[string]json.RawMessage, error) {
+	return s.mem.List()
+}
+
+// ListPage returns a page of key value pairs with a prefix.
+func (s *FileStore) ListPage(prefix, cursor string, limit int) (map[string]json.RawMessage, string, error) {
+	return s.mem.ListPage(prefix, cursor, limit)
+}
+
+// Upsert creates or modifies a key value pair, and persists it.
+func (s *FileStore) Upsert(k string, v json.RawMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.mem.Upsert(k, v); err != nil {
+		return err
+	}
+
+	return s.changedLocked(s.setRecord(k, v))
+}
+
+// UpsertTTL creates or modifies a key value pair, that expires after ttl,
+// and persists it.
+func (s *FileStore) UpsertTTL(k string, v json.RawMessage, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.mem.UpsertTTL(k, v, ttl); err != nil {
+		return err
+	}
+
+	return s.changedLocked(s.setRecord(k, v))
+}
+
+// UpsertRaw creates or modifies a key with a raw value, and its content
+// type, and persists the change.
+func (s *FileStore) UpsertRaw(k string, data []byte, contentType string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.mem.UpsertRaw(k, data, contentType, ttl); err != nil {
+		return err
+	}
+
+	return s.changedLocked(s.setRecord(k, rawValue(data)))
+}
+
+// TTL returns the remaining time to live of a key.
+func (s *FileStore) TTL(k string) (time.Duration, bool, error) {
+	return s.mem.TTL(k)
+}
+
+// DeleteExpired removes expired keys, and persists the change.
+func (s *FileStore) DeleteExpired() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Expired keys are not logged, replaying the log drops them.
+	n, _ := s.mem.DeleteExpired()
+	if n == 0 {
+		return 0, nil
+	}
+
+	return n, s.changedLocked()
+}
+
+// Delete removes a key, and persists the change.
+func (s *FileStore) Delete(k string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ok, _ := s.mem.Delete(k)
+	if !ok {
+		return false, nil
+	}
+
+	return true, s.changedLocked(walRecord{Op: walDelete, Key: k})
+}
+
+// DeleteKeys removes keys atomically, and persists the change.
+func (s *FileStore) DeleteKeys(keys []string) ([]bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted, _ := s.mem.DeleteKeys(keys)
+	var removed []string
+	for i, ok := range deleted {
+		if ok {
+			removed = append(removed, keys[i])
+		}
+	}
+	if len(removed) == 0 {
+		return deleted, nil
+	}
+
+	return deleted, s.changedLocked(walRecord{Op: walDelete, Keys: removed})
+}
+
+// DeletePrefix removes the keys with a prefix atomically, and persists the
+// change.
+func (s *FileStore) DeletePrefix(prefix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted, _ := s.mem.DeletePrefix(prefix)
+	if len(deleted) == 0 {
+		return deleted, nil
+	}
+
+	return deleted, s.changedLocked(walRecord{Op: walDelete, Keys: deleted})
+}
+
+// Clear removes all the keys, and persists the change.
+func (s *FileStore) Clear() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, _ := s.mem.Clear()
+
+	return n, s.changedLocked(walRecord{Op: walClear})
+}
+
+// Incr adds delta to the integer value of a key atomically, and persists
+// the change.
+func (s *FileStore) Incr(k string, delta int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, err := s.mem.Incr(k, delta)
+	if err != nil {
+		return 0, err
+	}
+
+	return n, s.changedLocked(s.setRecord(k, json.RawMessage(strconv.FormatInt(n, 10))))
+}
+
+// CompareAndSwap replaces the value of a key atomically, if it equals old,
+// and persists the change.
+func (s *FileStore) CompareAndSwap(k string, old, replacement json.RawMessage) (json.RawMessage, bool, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, swapped, ok, _ := s.mem.CompareAndSwap(k, old, replacement)
+	if !swapped {
+		return v, false, ok, nil
+	}
+
+	return v, true, true, s.changedLocked(s.setRecord(k, v))
+}
+
+// Push appends an element to the array value of a key atomically, and
+// persists the change.
+func (s *FileStore) Push(k string, element json.RawMessage) (json.RawMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, err := s.mem.Push(k, element)
+	if err != nil {
+		return nil, err
+	}
+
+	return v, s.changedLocked(s.setRecord(k, v))
+}
+
+// Pop removes the first, or the last, element of the array value of a key
+// atomically, and persists the change.
+func (s *FileStore) Pop(k string, front bool) (json.RawMessage, json.RawMessage, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	element, v, ok, err := s.mem.Pop(k, front)
+	if err != nil || !ok {
+		return element, v, ok, err
+	}
+
+	return element, v, true, s.changedLocked(s.setRecord(k, v))
+}
+
+// Txn evaluates the checks of a transaction, and applies its puts and
+// deletes atomically, and persists the change, as one write-ahead log
+// record, so a torn record never applies a transaction in part.
+func (s *FileStore) Txn(ops []TxnOp) (int, json.RawMessage, []bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	failed, current, existed, err := s.mem.Txn(ops)
+	if err != nil || failed >= 0 {
+		return failed, current, existed, err
+	}
+
+	var records []walRecord
+	for i, op := range ops {
+		switch {
+		case op.Op == TxnPut:
+			records = append(records, s.setRecord(op.Key, op.Value))
+		case op.Op == TxnDelete && existed[i]:
+			records = append(records, walRecord{Op: walDelete, Key: op.Key})
+		}
+	}
+	if len(records) == 0 {
+		return -1, nil, existed, nil
+	}
+
+	return -1, nil, existed, s.changedLocked(walRecord{Op: walTxn, Records: records})
+}
+
+// Trash moves a key to the trash, and persists the change.
+func (s *FileStore) Trash(k string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.mem.now().UTC()
+	if !s.mem.trashAt(k, now) {
+		return false, nil
+	}
+
+	return true, s.changedLocked(walRecord{Op: walTrash, Key: k, DeletedAt: &now})
+}
+
+// ListTrash returns the trashed keys with a prefix, in key order.
+func (s *FileStore) ListTrash(prefix string) ([]TrashedKey, error) {
+	return s.mem.ListTrash(prefix)
+}
+
+// Restore moves a key from the trash back, and persists the change, as one
+// write-ahead log record.
+func (s *FileStore) Restore(k string) (json.RawMessage, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok, err := s.mem.Restore(k)
+	if err != nil || !ok {
+		return nil, ok, err
+	}
+
+	records := []walRecord{s.setRecord(k, v), {Op: walPurge, Key: k}}
+
+	return v, true, s.changedLocked(walRecord{Op: walTxn, Records: records})
+}
+
+// DeleteTrashed removes a key from the trash, and persists the change.
+func (s *FileStore) DeleteTrashed(k string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ok, _ := s.mem.DeleteTrashed(k)
+	if !ok {
+		return false, nil
+	}
+
+	return true, s.changedLocked(walRecord{Op: walPurge, Key: k})
+}
+
+// PurgeTrash removes the keys trashed more than retention ago, and persists
+// the change.
+func (s *FileStore) PurgeTrash(retention time.Duration) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	purged := s.mem.purgeTrash(s.mem.now().Add(-retention))
+	if len(purged) == 0 {
+		return 0, nil
+	}
+
+	return len(purged), s.changedLocked(walRecord{Op: walPurge, Keys: purged})
+}
+
+// Revision returns the revision of the key value pairs, it is not persisted,
+// restarted stores start a new revision.
+func (s *FileStore) Revision() (uint64, error) {
+	return s.mem.Revision()
+}
+
+// Close stops periodic snapshots, writes unsaved changes, and closes the
+// write-ahead log.
+func (s *FileStore) Close() error {
+	if s.interval > 0 {
+		close(s.stop)
+		<-s.done
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	if s.dirty {
+		err = s.writeLocked()
+	}
+	if s.log != nil {
+		if e := s.log.Close(); err == nil {
+			err = e
+		}
+		s.log = nil
+	}
+
+	return err
+}
+
+// changedLocked appends the records of a change to the write-ahead log,
+// writes the values through, or marks them for the next snapshot.
+func (s *FileStore) changedLocked(records ...walRecord) error {
+	s.dirty = true
+	if s.wal.Enabled {
+		if err := s.appendLocked(records); err != nil {
+			return err
+		}
+		if s.wal.CompactBytes > 0 && s.logBytes >= s.wal.CompactBytes {
+			return s.writeLocked()
+		}
+		return nil
+	}
+	if s.interval > 0 {
+		return nil
+	}
+
+	return s.writeLocked()
+}
+
+// snapshots writes changed values every interval, until the store is closed.
+func (s *FileStore) snapshots() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			if s.dirty {
+				if err := s.writeLocked(); err != nil {
+					log.Printf("warning: can't write store file %s: %v", s.path, err)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// writeLocked writes the values to a temporary file, renames it over the
+// store file, and empties the write-ahead log, that the file includes.
+func (s *FileStore) writeLocked() error {
+	vals, expires, metas := s.mem.snapshot()
+	snap := fileSnapshot{Values: vals, Expires: expires, Meta: metas, Trash: s.mem.trashSnapshot()}
+	if s.wal.Enabled {
+		snap.Revision = s.walRev
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("can't replace store file: %v", err)
+	}
+
+	// A crash before the log is emptied replays only records newer than
+	// the snapshot revision.
+	if err := s.truncateLogLocked(); err != nil {
+		return err
+	}
+
+	s.dirty = false
+
+	return nil
+}
@@ -0,0 +1,349 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// quietLogs discards log output for the duration of a test.
+func quietLogs(t *testing.T) {
+	w := log.Writer()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(w) })
+}
+
+func TestFileStoreRestart(t *testing.T) {
+	quietLogs(t)
+
+	tests := []struct {
+		name     string
+		interval time.Duration
+	}{
+		{"write through", 0},
+		{"snapshots", time.Hour},
+	}
+
+	vals := map[string]string{
+		"kitty":       `"cat"`,
+		"città/ü 1":   `{"a":[1,2]}`,
+		"a/b/c":       `12345678901234567890`,
+		"喵":           `null`,
+		"deleted/key": `true`,
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "store.json")
+
+		s := newFileStore(path, tt.interval)
+		for k, v := range vals {
+			if err := s.Upsert(k, json.RawMessage(v)); err != nil {
+				t.Fatalf("%s: Upsert: %v", tt.name, err)
+			}
+		}
+		if ok, err := s.Delete("deleted/key"); !ok || err != nil {
+			t.Fatalf("%s: Delete: %v, %v", tt.name, ok, err)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatalf("%s: Close: %v", tt.name, err)
+		}
+
+		// Check the values survive a restart.
+		s = newFileStore(path, tt.interval)
+		got, err := s.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(vals)-1 {
+			t.Errorf("%s: wrong number of values: got %d want %d", tt.name, len(got), len(vals)-1)
+		}
+		for k, v := range vals {
+			if k == "deleted/key" {
+				continue
+			}
+			if string(got[k]) != v {
+				t.Errorf("%s: wrong value of %q: got %s want %s", tt.name, k, got[k], v)
+			}
+		}
+		s.Close()
+	}
+}
+
+func TestFileStoreWriteThrough(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+
+	quietLogs(t)
+
+	s := newFileStoreWithClock(path, 0, epochClock().Now)
+	s.Upsert("kitty", json.RawMessage(`"cat"`))
+
+	// Check the change was written without closing the store.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"values":{"kitty":"cat"},"meta":{"kitty":`+epochMeta+`}}` {
+		t.Errorf("unexpected file content: %s", data)
+	}
+
+	// Check no temporary files are left behind.
+	files, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "*"))
+	if len(files) != 1 {
+		t.Errorf("unexpected files: %v", files)
+	}
+}
+
+func TestFileStorePeriodicSnapshots(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+
+	quietLogs(t)
+
+	s := newFileStoreWithClock(path, 5*time.Millisecond, epochClock().Now)
+	defer s.Close()
+	s.Upsert("kitty", json.RawMessage(`"cat"`))
+
+	// Check a snapshot is written without closing the store.
+	deadline := time.Now().Add(time.Second)
+	for {
+		data, _ := os.ReadFile(path)
+		if string(data) == `{"values":{"kitty":"cat"},"meta":{"kitty":`+epochMeta+`}}` {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no snapshot was written, file content: %s", data)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFileStoreBadFiles(t *testing.T) {
+	quietLogs(t)
+
+	dir := t.TempDir()
+	corrupt := filepath.Join(dir, "corrupt.json")
+	if err := os.WriteFile(corrupt, []byte(`{"kitty": "ca`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+	}{
+		{"missing", filepath.Join(dir, "missing.json")},
+		{"corrupt", corrupt},
+	}
+
+	for _, tt := range tests {
+		// Check the store starts empty, and works.
+		s := newFileStore(tt.path, 0)
+		if vals, err := s.List(); err != nil || len(vals) != 0 {
+			t.Errorf("%s: expected an empty store, got %v, %v", tt.name, vals, err)
+		}
+		if err := s.Upsert("kitty", json.RawMessage(`"cat"`)); err != nil {
+			t.Errorf("%s: Upsert: %v", tt.name, err)
+		}
+		s.Close()
+	}
+
+	// Check the corrupted file was kept.
+	if _, err := os.Stat(corrupt + ".corrupt"); err != nil {
+		t.Errorf("corrupted file was not kept: %v", err)
+	}
+}
+
+func TestFileStoreTTL(t *testing.T) {
+	quietLogs(t)
+
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	path := filepath.Join(t.TempDir(), "store.json")
+	s := newFileStoreWithClock(path, 0, clock.Now)
+	s.UpsertTTL("short", json.RawMessage(`1`), time.Second)
+	s.UpsertTTL("long", json.RawMessage(`2`), time.Minute)
+	s.Close()
+
+	// Check expiry times survive a restart, and expired keys are dropped.
+	clock.Add(2 * time.Second)
+	s = newFileStoreWithClock(path, 0, clock.Now)
+	defer s.Close()
+	if _, ok, _ := s.Get("short"); ok {
+		t.Errorf("expired key was loaded")
+	}
+	if ttl, ok, _ := s.TTL("long"); !ok || ttl != 58*time.Second {
+		t.Errorf("TTL: got %v, %v want 58s", ttl, ok)
+	}
+
+	// Check removing expired keys is persisted.
+	clock.Add(time.Minute)
+	if n, err := s.DeleteExpired(); n != 1 || err != nil {
+		t.Errorf("DeleteExpired: got %v, %v want 1", n, err)
+	}
+	data, _ := os.ReadFile(path)
+	if string(data) != `{"values":{}}` {
+		t.Errorf("unexpected file content: %s", data)
+	}
+}
+
+func TestFileStoreBulkDelete(t *testing.T) {
+	quietLogs(t)
+
+	path := filepath.Join(t.TempDir(), "store.json")
+	s := newFileStoreWithClock(path, 0, epochClock().Now)
+	for _, k := range []string{"a", "b", "c"} {
+		s.Upsert(k, json.RawMessage(`1`))
+	}
+
+	deleted, err := s.DeleteKeys([]string{"a", "missing"})
+	if err != nil || len(deleted) != 2 || !deleted[0] || deleted[1] {
+		t.Errorf("DeleteKeys: got %v, %v want [true false]", deleted, err)
+	}
+	data, _ := os.ReadFile(path)
+	if string(data) != `{"values":{"b":1,"c":1},"meta":{"b":`+epochMeta+`,"c":`+epochMeta+`}}` {
+		t.Errorf("unexpected file content: %s", data)
+	}
+
+	if n, err := s.Clear(); n != 2 || err != nil {
+		t.Errorf("Clear: got %v, %v want 2", n, err)
+	}
+	data, _ = os.ReadFile(path)
+	if string(data) != `{"values":{}}` {
+		t.Errorf("unexpected file content: %s", data)
+	}
+}
+
+func TestFileStoreListPage(t *testing.T) {
+	quietLogs(t)
+
+	s := newFileStore(filepath.Join(t.TempDir(), "kitty.json"), 0)
+	defer s.Close()
+
+	testListPage(t, s)
+}
+
+func TestFileStoreDeletePrefix(t *testing.T) {
+	quietLogs(t)
+
+	path := filepath.Join(t.TempDir(), "kitty.json")
+	s := newFileStore(path, 0)
+	testDeletePrefix(t, s)
+	s.Upsert("app1/a", json.RawMessage(`1`))
+	s.Upsert("app2/a", json.RawMessage(`2`))
+	s.DeletePrefix("app1/")
+	s.Close()
+
+	// Check the deletion survives a restart.
+	s = newFileStore(path, 0)
+	defer s.Close()
+	if got := listValues(t, s); fmt.Sprint(got) != "map[app2/a:2]" {
+		t.Errorf("unexpected values after a restart: %v", got)
+	}
+}
+
+func TestFileStoreConcurrentIncr(t *testing.T) {
+	quietLogs(t)
+
+	s := newFileStore(filepath.Join(t.TempDir(), "kitty.json"), 0)
+	defer s.Close()
+
+	testConcurrentIncr(t, s)
+}
+
+func TestFileStoreConcurrentCAS(t *testing.T) {
+	quietLogs(t)
+
+	s := newFileStore(filepath.Join(t.TempDir(), "kitty.json"), 0)
+	defer s.Close()
+
+	testConcurrentCAS(t, s)
+}
+
+func TestFileStoreConcurrentPushPop(t *testing.T) {
+	quietLogs(t)
+
+	s := newFileStore(filepath.Join(t.TempDir(), "kitty.json"), 0)
+	defer s.Close()
+
+	testConcurrentPushPop(t, s)
+}
+
+func TestFileStoreTxn(t *testing.T) {
+	quietLogs(t)
+
+	path := filepath.Join(t.TempDir(), "kitty.json")
+	s := newFileStore(path, 0)
+	testStoreTxn(t, s)
+	s.Close()
+
+	// Check the transaction survives a restart.
+	s = newFileStore(path, 0)
+	defer s.Close()
+	if got := listValues(t, s); fmt.Sprint(got) != `map[gorilla:3 tom:"cat"]` {
+		t.Errorf("unexpected values after a restart: %v", got)
+	}
+}
+
+func TestFileStoreConcurrentTxn(t *testing.T) {
+	quietLogs(t)
+
+	s := newFileStore(filepath.Join(t.TempDir(), "kitty.json"), 0)
+	defer s.Close()
+
+	testConcurrentTxn(t, s)
+}
+
+func TestFileStoreUpsertRaw(t *testing.T) {
+	quietLogs(t)
+
+	path := filepath.Join(t.TempDir(), "kitty.json")
+	s := newFileStore(path, 0)
+	testUpsertRaw(t, s)
+	s.Close()
+
+	// Check the content type survives a restart.
+	s = newFileStore(path, 0)
+	defer s.Close()
+	if metas, _ := s.Meta([]string{"blob"}); metas["blob"].ContentType != "image/png" {
+		t.Errorf("unexpected metadata after a restart: %+v", metas["blob"])
+	}
+}
+
+func TestFileStoreTrash(t *testing.T) {
+	quietLogs(t)
+
+	clock := epochClock()
+	path := filepath.Join(t.TempDir(), "kitty.json")
+	s := newFileStoreWithClock(path, 0, clock.Now)
+	testTrash(t, s, clock)
+	s.Upsert("tom", json.RawMessage(`"cat"`))
+	s.Trash("tom")
+	s.Close()
+
+	// Check the trash survives a restart.
+	s = newFileStoreWithClock(path, 0, clock.Now)
+	defer s.Close()
+	if got := listTrash(t, s); got != `[tom="cat"]` {
+		t.Errorf("unexpected trash after a restart: %s", got)
+	}
+	if _, ok, _ := s.Get("tom"); ok {
+		t.Errorf("trashed key was loaded")
+	}
+}
@@ -0,0 +1,1007 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package main
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EvictionPolicy decides what a MemoryStore with a bound on the number of
+// keys does when creating a key in a full store.
+type EvictionPolicy int
+
+const (
+	// EvictLRU removes the least recently used key, keys are used when
+	// they are read by Get, GetWithETag or GetMany, or written.
+	EvictLRU EvictionPolicy = iota
+
+	// RejectNew fails creating keys with errStoreFull.
+	RejectNew
+)
+
+// parseEvictionPolicy parses an eviction policy name, "lru" or "reject".
+func parseEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch name {
+	case "lru":
+		return EvictLRU, nil
+	case "reject":
+		return RejectNew, nil
+	}
+
+	return 0, fmt.Errorf("invalid eviction-policy %q, want lru or reject", name)
+}
+
+// errStoreFull is returned when creating a key in a full store.
+var errStoreFull = errors.New("store is full")
+
+// MemoryStore is an in-memory Store, it is safe for concurrent use.
+type MemoryStore struct {
+	// Guards vals, keys, etags, expires, metas, trash, rev, lru, elems and
+	// onEvict.
+	mu sync.RWMutex
+
+	// key value store, values are compact JSON.
+	vals map[string]json.RawMessage
+
+	// The keys of vals, sorted, an index of the keys with a prefix.
+	keys []string
+
+	// ETags of the values.
+	etags map[string]string
+
+	// Expiry times of keys with a TTL.
+	expires map[string]time.Time
+
+	// Creation and modification times of the keys.
+	metas map[string]KeyMeta
+
+	// Keys in the trash.
+	trash map[string]TrashedKey
+
+	// Revision of the key value pairs, incremented on every change.
+	rev uint64
+
+	// Total size of the values.
+	valueBytes int64
+
+	// Maximum number of keys, zero is unlimited.
+	maxKeys int
+	policy  EvictionPolicy
+
+	// Keys by recency of use, the front is the most recently used, and
+	// the list elements of keys, nil if the policy is not EvictLRU.
+	lru   *list.List
+	elems map[string]*list.Element
+
+	// Number of evicted keys, accessed atomically.
+	evictions uint64
+
+	// Called with evicted keys, while holding the lock.
+	onEvict func(key string)
+
+	// Returns the current time, replaced in tests.
+	now func() time.Time
+}
+
+func newMemoryStore() *MemoryStore {
+	s := MemoryStore{
+		vals:    make(map[string]json.RawMessage),
+		etags:   make(map[string]string),
+		expires: make(map[string]time.Time),
+		metas:   make(map[string]KeyMeta),
+		trash:   make(map[string]TrashedKey),
+		rev:     initialRevision(),
+		now:     time.Now,
+	}
+
+	return &s
+}
+
+// newStoreWithLimit returns an in-memory store with at most maxKeys keys,
+// creating keys in a full store evicts the least recently used key, or
+// fails, depending on the policy.
+func newStoreWithLimit(maxKeys int, policy EvictionPolicy) *MemoryStore {
+	s := newMemoryStore()
+	s.maxKeys = maxKeys
+	s.policy = policy
+	if maxKeys > 0 && policy == EvictLRU {
+		s.lru = list.New()
+		s.elems = make(map[string]*list.Element)
+	}
+
+	return s
+}
+
+// OnEvict sets a function called with evicted keys, it is called while
+// holding the store lock, and must not use the store.
+func (s *MemoryStore) OnEvict(fn func(key string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.onEvict = fn
+}
+
+// Evictions returns the number of evicted keys.
+func (s *MemoryStore) Evictions() uint64 {
+	return atomic.LoadUint64(&s.evictions)
+}
+
+// Get returns the value of a key, and removes it if it expired.
+func (s *MemoryStore) Get(k string) (json.RawMessage, bool, error) {
+	val, _, ok, err := s.GetWithETag(k)
+
+	return val, ok, err
+}
+
+// GetWithETag returns the value of a key, and its cached ETag, and removes
+// the key if it expired.
+func (s *MemoryStore) GetWithETag(k string) (json.RawMessage, string, bool, error) {
+	if s.lru != nil {
+		return s.getAndTouch(k)
+	}
+
+	s.mu.RLock()
+	val, ok := s.vals[k]
+	etag := s.etags[k]
+	expired := s.expiredLocked(k, s.now())
+	s.mu.RUnlock()
+
+	if expired {
+		s.mu.Lock()
+		if s.expiredLocked(k, s.now()) {
+			s.deleteLocked(k)
+		}
+		s.mu.Unlock()
+		return nil, "", false, nil
+	}
+
+	return val, etag, ok, nil
+}
+
+// getAndTouch returns the value of a key, and its cached ETag, and marks
+// the key as recently used.
+func (s *MemoryStore) getAndTouch(k string) (json.RawMessage, string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.expiredLocked(k, s.now()) {
+		s.deleteLocked(k)
+		return nil, "", false, nil
+	}
+
+	val, ok := s.vals[k]
+	if ok {
+		s.touchLocked(k)
+	}
+
+	return val, s.etags[k], ok, nil
+}
+
+// GetMany returns the values of keys that are not missing.
+func (s *MemoryStore) GetMany(keys []string) (map[string]json.RawMessage, error) {
+	// Reads change the recency of keys.
+	if s.lru != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	} else {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+	}
+
+	now := s.now()
+	vals := make(map[string]json.RawMessage, len(keys))
+	for _, k := range keys {
+		if v, ok := s.vals[k]; ok && !s.expiredLocked(k, now) {
+			vals[k] = v
+			if s.lru != nil {
+				s.touchLocked(k)
+			}
+		}
+	}
+
+	return vals, nil
+}
+
+// Meta returns the metadata of keys that are not missing, reading metadata
+// does not change the recency of keys.
+func (s *MemoryStore) Meta(keys []string) (map[string]KeyMeta, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := s.now()
+	metas := make(map[string]KeyMeta, len(keys))
+	for _, k := range keys {
+		if _, ok := s.vals[k]; ok && !s.expiredLocked(k, now) {
+			metas[k] = s.metas[k]
+		}
+	}
+
+	return metas, nil
+}
+
+// Len returns the number of keys.
+func (s *MemoryStore) Len() (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.vals), nil
+}
+
+// Stats returns the number of keys, the size of the values, and the
+// number of evicted keys.
+func (s *MemoryStore) Stats() (StoreStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := StoreStats{
+		Keys:       len(s.vals),
+		ValueBytes: s.valueBytes,
+		Evictions:  s.Evictions(),
+	}
+
+	return stats, nil
+}
+
+// List returns a copy of the key value pairs.
+func (s *MemoryStore) List() (map[string]json.RawMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	vals := make(map[string]json.RawMessage, len(s.vals))
+	s.listLocked(vals, s.now())
+
+	return vals, nil
+}
+
+// listLocked adds the key value pairs that did not expire to vals.
+func (s *MemoryStore) listLocked(vals map[string]json.RawMessage, now time.Time) {
+	for k, v := range s.vals {
+		if !s.expiredLocked(k, now) {
+			vals[k] = v
+		}
+	}
+}
+
+// ListPage returns a page of key value pairs with a prefix, searching the
+// sorted keys for the first key of the page.
+func (s *MemoryStore) ListPage(prefix, cursor string, limit int) (map[string]json.RawMessage, string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// Collect one more key than the limit, to know if there is a next page.
+	keys := s.pageKeysLocked(prefix, cursor, limit, s.now())
+	next := ""
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+		next = keys[limit-1]
+	}
+
+	page := make(map[string]json.RawMessage, len(keys))
+	for _, k := range keys {
+		page[k] = s.vals[k]
+	}
+
+	return page, next, nil
+}
+
+// pageKeysLocked returns the sorted keys with a prefix after cursor, that
+// did not expire, up to one more key than a positive limit.
+func (s *MemoryStore) pageKeysLocked(prefix, cursor string, limit int, now time.Time) []string {
+	start, end := s.prefixRangeLocked(prefix)
+	if cursor >= prefix {
+		start += sort.Search(end-start, func(i int) bool { return s.keys[start+i] > cursor })
+	}
+
+	keys := make([]string, 0)
+	for _, k := range s.keys[start:end] {
+		if limit > 0 && len(keys) > limit {
+			break
+		}
+		if !s.expiredLocked(k, now) {
+			keys = append(keys, k)
+		}
+	}
+
+	return keys
+}
+
+// Upsert creates or modifies a key value pair, that never expires.
+func (s *MemoryStore) Upsert(k string, v json.RawMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.setLocked(k, v); err != nil {
+		return err
+	}
+	delete(s.expires, k)
+
+	return nil
+}
+
+// UpsertTTL creates or modifies a key value pair, that expires after ttl.
+func (s *MemoryStore) UpsertTTL(k string, v json.RawMessage, ttl time.Duration) error {
+	if ttl <= 0 {
+		return s.Upsert(k, v)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.setLocked(k, v); err != nil {
+		return err
+	}
+	s.expires[k] = s.now().Add(ttl)
+
+	return nil
+}
+
+// UpsertRaw creates or modifies a key with a raw value, and its content
+// type, that expires after ttl, if ttl is positive.
+func (s *MemoryStore) UpsertRaw(k string, data []byte, contentType string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.setLocked(k, rawValue(data)); err != nil {
+		return err
+	}
+	m := s.metas[k]
+	m.ContentType = contentType
+	s.metas[k] = m
+	if ttl > 0 {
+		s.expires[k] = s.now().Add(ttl)
+	} else {
+		delete(s.expires, k)
+	}
+
+	return nil
+}
+
+// TTL returns the remaining time to live of a key.
+func (s *MemoryStore) TTL(k string) (time.Duration, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	expires, ok := s.expires[k]
+	if !ok {
+		return 0, false, nil
+	}
+
+	ttl := expires.Sub(s.now())
+	if ttl <= 0 {
+		return 0, false, nil
+	}
+
+	return ttl, true, nil
+}
+
+// Delete removes a key.
+func (s *MemoryStore) Delete(k string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.removeLocked(k, s.now()), nil
+}
+
+// DeleteKeys removes keys atomically.
+func (s *MemoryStore) DeleteKeys(keys []string) ([]bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	deleted := make([]bool, len(keys))
+	for i, k := range keys {
+		deleted[i] = s.removeLocked(k, now)
+	}
+
+	return deleted, nil
+}
+
+// DeletePrefix removes the keys with a prefix atomically, removing their
+// range of the sorted keys at once.
+func (s *MemoryStore) DeletePrefix(prefix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.deletePrefixLocked(prefix, s.now()), nil
+}
+
+// deletePrefixLocked removes the keys with a prefix, and returns the keys
+// that did not expire, sorted.
+func (s *MemoryStore) deletePrefixLocked(prefix string, now time.Time) []string {
+	start, end := s.prefixRangeLocked(prefix)
+	matching := append([]string(nil), s.keys[start:end]...)
+	s.keys = append(s.keys[:start], s.keys[end:]...)
+
+	deleted := make([]string, 0, len(matching))
+	for _, k := range matching {
+		if !s.expiredLocked(k, now) {
+			deleted = append(deleted, k)
+		}
+		s.deleteLocked(k)
+	}
+
+	return deleted
+}
+
+// Clear removes all the keys.
+func (s *MemoryStore) Clear() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.clearLocked(s.now()), nil
+}
+
+// clearLocked removes all the keys, and returns the number of keys that
+// did not expire.
+func (s *MemoryStore) clearLocked(now time.Time) int {
+	n := 0
+	for k := range s.vals {
+		if !s.expiredLocked(k, now) {
+			n++
+		}
+	}
+	s.vals = make(map[string]json.RawMessage)
+	s.keys = nil
+	s.etags = make(map[string]string)
+	s.expires = make(map[string]time.Time)
+	s.metas = make(map[string]KeyMeta)
+	s.valueBytes = 0
+	if s.lru != nil {
+		s.lru.Init()
+		s.elems = make(map[string]*list.Element)
+	}
+	s.rev++
+
+	return n
+}
+
+// DeleteExpired removes expired keys.
+func (s *MemoryStore) DeleteExpired() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	now := s.now()
+	for k := range s.expires {
+		if s.expiredLocked(k, now) {
+			s.deleteLocked(k)
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// Incr adds delta to the integer value of a key atomically.
+func (s *MemoryStore) Incr(k string, delta int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.expiredLocked(k, s.now()) {
+		s.deleteLocked(k)
+	}
+
+	v, n, err := incrValue(s.vals[k], delta)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.setLocked(k, v); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// CompareAndSwap replaces the value of a key atomically, if it equals old.
+func (s *MemoryStore) CompareAndSwap(k string, old, replacement json.RawMessage) (json.RawMessage, bool, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.expiredLocked(k, s.now()) {
+		s.deleteLocked(k)
+	}
+
+	cur, ok := s.vals[k]
+	v, swapped := swapValue(cur, ok, old, replacement)
+	if swapped {
+		if err := s.setLocked(k, v); err != nil {
+			return nil, false, false, err
+		}
+	}
+
+	return v, swapped, ok || swapped, nil
+}
+
+// Push appends an element to the array value of a key atomically.
+func (s *MemoryStore) Push(k string, element json.RawMessage) (json.RawMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.expiredLocked(k, s.now()) {
+		s.deleteLocked(k)
+	}
+
+	v, err := pushValue(s.vals[k], element)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.setLocked(k, v); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// Pop removes the first, or the last, element of the array value of a key
+// atomically.
+func (s *MemoryStore) Pop(k string, front bool) (json.RawMessage, json.RawMessage, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.expiredLocked(k, s.now()) {
+		s.deleteLocked(k)
+	}
+
+	v, element, ok, err := popValue(s.vals[k], front)
+	if err != nil || !ok {
+		return nil, v, false, err
+	}
+	if err := s.setLocked(k, v); err != nil {
+		return nil, nil, false, err
+	}
+
+	return element, v, true, nil
+}
+
+// Txn evaluates the checks of a transaction, and applies its puts and
+// deletes, under the lock.
+func (s *MemoryStore) Txn(ops []TxnOp) (int, json.RawMessage, []bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	for _, op := range ops {
+		if s.expiredLocked(op.Key, now) {
+			s.deleteLocked(op.Key)
+		}
+	}
+
+	for i, op := range ops {
+		if op.Op != TxnCheck {
+			continue
+		}
+		if cur, ok := s.vals[op.Key]; !valueMatches(cur, ok, op.Value) {
+			return i, cur, nil, nil
+		}
+	}
+
+	// Check for room first, a transaction is never applied in part.
+	if !s.txnFitsLocked(ops) {
+		return -1, nil, nil, errStoreFull
+	}
+
+	// Compute which keys existed before each operation, and mark the keys
+	// of the transaction as recently used, evictions making room for created
+	// keys must not evict them.
+	existed := make([]bool, len(ops))
+	exists := make(map[string]bool, len(ops))
+	for i, op := range ops {
+		ok, seen := exists[op.Key]
+		if !seen {
+			_, ok = s.vals[op.Key]
+			if ok && s.lru != nil {
+				s.touchLocked(op.Key)
+			}
+		}
+		existed[i] = ok
+
+		switch op.Op {
+		case TxnPut:
+			ok = true
+		case TxnDelete:
+			ok = false
+		}
+		exists[op.Key] = ok
+	}
+
+	for _, op := range ops {
+		switch op.Op {
+		case TxnPut:
+			s.setLocked(op.Key, op.Value)
+			delete(s.expires, op.Key)
+		case TxnDelete:
+			s.deleteLocked(op.Key)
+		}
+	}
+
+	return -1, nil, existed, nil
+}
+
+// txnFitsLocked checks if the keys created by a transaction fit a store
+// with a bound on the number of keys, evictions make room for them, but
+// must not evict keys of the transaction.
+func (s *MemoryStore) txnFitsLocked(ops []TxnOp) bool {
+	if s.maxKeys <= 0 {
+		return true
+	}
+
+	// Count all the keys, or, if keys are evicted, the keys of the
+	// transaction.
+	n := 0
+	if s.lru == nil {
+		n = len(s.vals)
+	}
+	exists := make(map[string]bool, len(ops))
+	for _, op := range ops {
+		ok, seen := exists[op.Key]
+		if !seen {
+			_, ok = s.vals[op.Key]
+			if ok && s.lru != nil {
+				n++
+			}
+		}
+
+		switch op.Op {
+		case TxnPut:
+			if !ok {
+				if n >= s.maxKeys {
+					return false
+				}
+				n++
+			}
+			ok = true
+		case TxnDelete:
+			if ok {
+				n--
+			}
+			ok = false
+		}
+		exists[op.Key] = ok
+	}
+
+	return true
+}
+
+// Trash moves a key to the trash, trashed now.
+func (s *MemoryStore) Trash(k string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.trashLocked(k, s.now()), nil
+}
+
+// trashAt moves a key to the trash, trashed at a time.
+func (s *MemoryStore) trashAt(k string, deletedAt time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.trashLocked(k, deletedAt)
+}
+
+// trashLocked moves a key to the trash, expired keys are removed.
+func (s *MemoryStore) trashLocked(k string, deletedAt time.Time) bool {
+	v, ok := s.vals[k]
+	if !ok || s.expiredLocked(k, s.now()) {
+		s.deleteLocked(k)
+		return false
+	}
+
+	s.trash[k] = TrashedKey{Key: k, Value: v, KeyMeta: s.metas[k], DeletedAt: deletedAt.UTC()}
+	s.deleteLocked(k)
+
+	return true
+}
+
+// ListTrash returns the trashed keys with a prefix, in key order.
+func (s *MemoryStore) ListTrash(prefix string) ([]TrashedKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	trashed := []TrashedKey{}
+	for k, t := range s.trash {
+		if strings.HasPrefix(k, prefix) {
+			trashed = append(trashed, t)
+		}
+	}
+	sort.Slice(trashed, func(i, j int) bool { return trashed[i].Key < trashed[j].Key })
+
+	return trashed, nil
+}
+
+// Restore moves a key from the trash back.
+func (s *MemoryStore) Restore(k string) (json.RawMessage, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.trash[k]
+	if !ok {
+		return nil, false, nil
+	}
+	if s.expiredLocked(k, s.now()) {
+		s.deleteLocked(k)
+	}
+	if _, exists := s.vals[k]; exists {
+		return nil, false, errKeyExists
+	}
+
+	if err := s.setLocked(k, t.Value); err != nil {
+		return nil, false, err
+	}
+	// Keys trashed without metadata are created now.
+	m := s.metas[k]
+	if !t.CreatedAt.IsZero() {
+		m.CreatedAt = t.CreatedAt
+	}
+	m.ContentType = t.ContentType
+	s.metas[k] = m
+	delete(s.trash, k)
+
+	return t.Value, true, nil
+}
+
+// DeleteTrashed removes a key from the trash.
+func (s *MemoryStore) DeleteTrashed(k string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.trash[k]; !ok {
+		return false, nil
+	}
+	delete(s.trash, k)
+	s.rev++
+
+	return true, nil
+}
+
+// PurgeTrash removes the keys trashed more than retention ago.
+func (s *MemoryStore) PurgeTrash(retention time.Duration) (int, error) {
+	return len(s.purgeTrash(s.now().Add(-retention))), nil
+}
+
+// purgeTrash removes the keys trashed before a time, and returns them.
+func (s *MemoryStore) purgeTrash(before time.Time) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var purged []string
+	for k, t := range s.trash {
+		if t.DeletedAt.Before(before) {
+			purged = append(purged, k)
+			delete(s.trash, k)
+		}
+	}
+	if len(purged) > 0 {
+		sort.Strings(purged)
+		s.rev++
+	}
+
+	return purged
+}
+
+// Revision returns the revision of the key value pairs, removing expired
+// keys first, so keys that expired change the revision.
+func (s *MemoryStore) Revision() (uint64, error) {
+	s.mu.RLock()
+	rev := s.rev
+	expired := false
+	now := s.now()
+	for k := range s.expires {
+		if s.expiredLocked(k, now) {
+			expired = true
+			break
+		}
+	}
+	s.mu.RUnlock()
+
+	if !expired {
+		return rev, nil
+	}
+
+	s.DeleteExpired()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.rev, nil
+}
+
+// snapshot returns copies of the values, the expiry times, and the
+// metadata, of keys that did not expire, zero metadata is omitted.
+func (s *MemoryStore) snapshot() (map[string]json.RawMessage, map[string]time.Time, map[string]KeyMeta) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := s.now()
+	vals := make(map[string]json.RawMessage, len(s.vals))
+	expires := make(map[string]time.Time, len(s.expires))
+	metas := make(map[string]KeyMeta, len(s.metas))
+	for k, v := range s.vals {
+		if s.expiredLocked(k, now) {
+			continue
+		}
+		vals[k] = v
+		if t, ok := s.expires[k]; ok {
+			expires[k] = t
+		}
+		if m, ok := s.metas[k]; ok && !m.UpdatedAt.IsZero() {
+			metas[k] = m
+		}
+	}
+
+	return vals, expires, metas
+}
+
+// trashSnapshot returns the trashed keys, in key order.
+func (s *MemoryStore) trashSnapshot() []TrashedKey {
+	trashed, _ := s.ListTrash("")
+	if len(trashed) == 0 {
+		return nil
+	}
+
+	return trashed
+}
+
+// restoreTrash adds the trashed keys of a previous run to the trash.
+func (s *MemoryStore) restoreTrash(trashed []TrashedKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, t := range trashed {
+		s.trash[t.Key] = t
+	}
+}
+
+// meta returns the metadata of a key, ok is false if the key is missing.
+func (s *MemoryStore) meta(k string) (KeyMeta, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	m, ok := s.metas[k]
+
+	return m, ok
+}
+
+// restoreMeta sets the metadata of a loaded key, keeping the times it was
+// created and modified by a previous run.
+func (s *MemoryStore) restoreMeta(k string, m KeyMeta) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.vals[k]; ok {
+		s.metas[k] = m
+	}
+}
+
+// expiry returns the expiry time of a key, ok is false if the key never
+// expires.
+func (s *MemoryStore) expiry(k string) (time.Time, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	expires, ok := s.expires[k]
+
+	return expires, ok
+}
+
+// expiredLocked checks if a key expired.
+func (s *MemoryStore) expiredLocked(k string, now time.Time) bool {
+	expires, ok := s.expires[k]
+
+	return ok && !now.Before(expires)
+}
+
+// setLocked sets the value of a key, its ETag and its metadata, creating
+// a key in a full store evicts a key, or fails with errStoreFull.
+func (s *MemoryStore) setLocked(k string, v json.RawMessage) error {
+	if _, ok := s.vals[k]; !ok && s.maxKeys > 0 && len(s.vals) >= s.maxKeys {
+		if s.lru == nil {
+			return errStoreFull
+		}
+		for len(s.vals) >= s.maxKeys {
+			s.evictLocked()
+		}
+	}
+
+	// Keys that expired, and were not removed yet, are created again.
+	now := s.now()
+	_, exists := s.vals[k]
+	if !exists {
+		i := sort.SearchStrings(s.keys, k)
+		s.keys = append(s.keys, "")
+		copy(s.keys[i+1:], s.keys[i:])
+		s.keys[i] = k
+	}
+	s.metas[k] = s.metas[k].touched(now, !exists || s.expiredLocked(k, now))
+	s.valueBytes += int64(len(v) - len(s.vals[k]))
+	s.vals[k] = v
+	s.etags[k] = valueETag(v)
+	s.rev++
+	if s.lru != nil {
+		s.touchLocked(k)
+	}
+
+	return nil
+}
+
+// prefixRangeLocked returns the range of the sorted keys with a prefix.
+func (s *MemoryStore) prefixRangeLocked(prefix string) (int, int) {
+	start := sort.SearchStrings(s.keys, prefix)
+	end := start + sort.Search(len(s.keys)-start, func(i int) bool {
+		return !strings.HasPrefix(s.keys[start+i], prefix)
+	})
+
+	return start, end
+}
+
+// touchLocked marks a key as the most recently used key.
+func (s *MemoryStore) touchLocked(k string) {
+	if e, ok := s.elems[k]; ok {
+		s.lru.MoveToFront(e)
+		return
+	}
+	s.elems[k] = s.lru.PushFront(k)
+}
+
+// evictLocked removes the least recently used key.
+func (s *MemoryStore) evictLocked() {
+	k := s.lru.Back().Value.(string)
+	s.deleteLocked(k)
+	atomic.AddUint64(&s.evictions, 1)
+
+	if s.onEvict != nil {
+		s.onEvict(k)
+	}
+}
+
+// removeLocked removes a key, ok is false if the key was missing, or
+// expired.
+func (s *MemoryStore) removeLocked(k string, now time.Time) bool {
+	_, ok := s.vals[k]
+	expired := s.expiredLocked(k, now)
+	s.deleteLocked(k)
+
+	return ok && !expired
+}
+
+// deleteLocked removes a key, its ETag, its expiry time and its metadata.
+func (s *MemoryStore) deleteLocked(k string) {
+	if v, ok := s.vals[k]; ok {
+		s.valueBytes -= int64(len(v))
+		s.rev++
+
+		// Keys of a removed range are no longer in the sorted keys.
+		if i := sort.SearchStrings(s.keys, k); i < len(s.keys) && s.keys[i] == k {
+			s.keys = append(s.keys[:i], s.keys[i+1:]...)
+		}
+	}
+	delete(s.vals, k)
+	delete(s.etags, k)
+	delete(s.expires, k)
+	delete(s.metas, k)
+	if e, ok := s.elems[k]; ok {
+		s.lru.Remove(e)
+		delete(s.elems, k)
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// refLRU is a simple reference LRU cache, keys are ordered from the most
+// recently used.
+type refLRU struct {
+	max       int
+	keys      []string
+	vals      map[string]json.RawMessage
+	evictions uint64
+}
+
+func (c *refLRU) touch(k string) {
+	for i, key := range c.keys {
+		if key == k {
+			c.keys = append(c.keys[:i], c.keys[i+1:]...)
+			break
+		}
+	}
+	c.keys = append([]string{k}, c.keys...)
+}
+
+func (c *refLRU) get(k string) {
+	if _, ok := c.vals[k]; ok {
+		c.touch(k)
+	}
+}
+
+func (c *refLRU) set(k string, v json.RawMessage) {
+	if _, ok := c.vals[k]; !ok && len(c.vals) >= c.max {
+		oldest := c.keys[len(c.keys)-1]
+		c.keys = c.keys[:len(c.keys)-1]
+		delete(c.vals, oldest)
+		c.evictions++
+	}
+	c.vals[k] = v
+	c.touch(k)
+}
+
+func (c *refLRU) delete(k string) {
+	if _, ok := c.vals[k]; !ok {
+		return
+	}
+	delete(c.vals, k)
+	for i, key := range c.keys {
+		if key == k {
+			c.keys = append(c.keys[:i], c.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+func TestMemoryStoreLRU(t *testing.T) {
+	const maxKeys = 8
+	rnd := rand.New(rand.NewSource(1))
+	s := newStoreWithLimit(maxKeys, EvictLRU)
+	ref := &refLRU{max: maxKeys, vals: make(map[string]json.RawMessage)}
+
+	for i := 0; i < 10000; i++ {
+		k := fmt.Sprintf("k%d", rnd.Intn(2*maxKeys))
+		v := json.RawMessage(fmt.Sprintf("%d", rnd.Intn(100)))
+
+		var op string
+		switch rnd.Intn(5) {
+		case 0:
+			op = "get"
+			s.Get(k)
+			ref.get(k)
+		case 1:
+			op = "get many"
+			k2 := fmt.Sprintf("k%d", rnd.Intn(2*maxKeys))
+			s.GetMany([]string{k, k2})
+			ref.get(k)
+			ref.get(k2)
+		case 2:
+			op = "delete"
+			s.Delete(k)
+			ref.delete(k)
+		case 3:
+			op = "incr"
+			if _, err := s.Incr(k, 1); err != nil {
+				t.Fatalf("Incr: %v", err)
+			}
+			n, _ := strconv.Atoi(string(ref.vals[k]))
+			ref.set(k, json.RawMessage(strconv.Itoa(n+1)))
+		default:
+			op = "upsert"
+			if err := s.Upsert(k, v); err != nil {
+				t.Fatalf("Upsert: %v", err)
+			}
+			ref.set(k, v)
+		}
+
+		// Check the store has the values of the reference, in the same order.
+		vals, _ := s.List()
+		if len(vals) != len(ref.vals) {
+			t.Fatalf("step %d, %s %s: got %d keys want %d", i, op, k, len(vals), len(ref.vals))
+		}
+		for k, v := range ref.vals {
+			if string(vals[k]) != string(v) {
+				t.Fatalf("step %d, %s %s: key %s got %s want %s", i, op, k, k, vals[k], v)
+			}
+		}
+		j := 0
+		for e := s.lru.Front(); e != nil; e = e.Next() {
+			if e.Value.(string) != ref.keys[j] {
+				t.Fatalf("step %d, %s %s: recency %d got %s want %s", i, op, k, j, e.Value, ref.keys[j])
+			}
+			j++
+		}
+		if s.Evictions() != ref.evictions {
+			t.Fatalf("step %d, %s %s: got %d evictions want %d", i, op, k, s.Evictions(), ref.evictions)
+		}
+	}
+}
+
+func TestMemoryStoreLRUConcurrent(t *testing.T) {
+	const maxKeys = 16
+	s := newStoreWithLimit(maxKeys, EvictLRU)
+
+	var evicted uint64
+	s.OnEvict(func(k string) { evicted++ })
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+
+			rnd := rand.New(rand.NewSource(seed))
+			for j := 0; j < 2000; j++ {
+				k := fmt.Sprintf("k%d", rnd.Intn(4*maxKeys))
+				switch rnd.Intn(4) {
+				case 0:
+					s.GetWithETag(k)
+				case 1:
+					s.Delete(k)
+				case 2:
+					s.Incr(k, 1)
+				default:
+					s.Upsert(k, json.RawMessage(`1`))
+				}
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+
+	// Check the store is bounded, and the recency list has all the keys.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.vals) > maxKeys || len(s.elems) != len(s.vals) || s.lru.Len() != len(s.vals) {
+		t.Errorf("got %d keys, %d elements and a list of %d want at most %d",
+			len(s.vals), len(s.elems), s.lru.Len(), maxKeys)
+	}
+	for e := s.lru.Front(); e != nil; e = e.Next() {
+		if _, ok := s.vals[e.Value.(string)]; !ok {
+			t.Errorf("recency list has a missing key %s", e.Value)
+		}
+	}
+	if evicted == 0 || evicted != s.Evictions() {
+		t.Errorf("got %d evicted keys want %d", evicted, s.Evictions())
+	}
+}
+
+func TestMemoryStoreRejectNew(t *testing.T) {
+	s := newStoreWithLimit(2, RejectNew)
+	handler := newStoreRouter(s)
+
+	serve(t, handler, "PUT", "/val/a", "1", "")
+	serve(t, handler, "PUT", "/val/b", "2", "")
+
+	// Check creating keys in a full store fails, and modifying keys works.
+	if rr := serve(t, handler, "PUT", "/val/c", "3", ""); rr.Code != http.StatusInsufficientStorage {
+		t.Errorf("PUT of a new key: got %v want %v", rr.Code, http.StatusInsufficientStorage)
+	}
+	if rr := serve(t, handler, "POST", "/val/c/incr", "", ""); rr.Code != http.StatusInsufficientStorage {
+		t.Errorf("incr of a new key: got %v want %v", rr.Code, http.StatusInsufficientStorage)
+	}
+	if rr := serve(t, handler, "PUT", "/val/a", "4", ""); rr.Code != http.StatusOK {
+		t.Errorf("PUT of a key: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	// Check deleting a key makes room.
+	serve(t, handler, "DELETE", "/val/b", "", "")
+	if rr := serve(t, handler, "PUT", "/val/c", "3", ""); rr.Code != http.StatusCreated {
+		t.Errorf("PUT after DELETE: got %v want %v", rr.Code, http.StatusCreated)
+	}
+	if s.Evictions() != 0 {
+		t.Errorf("got %d evictions want 0", s.Evictions())
+	}
+}
+
+func TestWatchEvicted(t *testing.T) {
+	server := httptest.NewServer(newStoreRouter(newStoreWithLimit(1, EvictLRU)))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	all := watchStream(t, ctx, server.URL+"/watch", "")
+
+	send(t, "PUT", server.URL+"/val/kitty", "\"cat\"")
+	send(t, "PUT", server.URL+"/ns/cats/val/tiger", "1")
+	send(t, "PUT", server.URL+"/val/gorilla", "2")
+
+	// Check watchers see evicted keys of their namespace only.
+	expected := []string{
+		"{\"type\":\"created\",\"key\":\"kitty\",\"value\":\"cat\",\"revision\":1}",
+		"{\"type\":\"evicted\",\"key\":\"kitty\",\"revision\":2}",
+		"{\"type\":\"created\",\"key\":\"gorilla\",\"value\":2,\"revision\":5}",
+	}
+	for _, want := range expected {
+		e, _ := json.Marshal(readEvent(t, all))
+		if string(e) != want {
+			t.Errorf("watch returned unexpected event: got %s want %s", e, want)
+		}
+	}
+}
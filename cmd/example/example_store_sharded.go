@@ -0,0 +1,427 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"hash/maphash"
+	"sort"
+	"time"
+)
+
+// defaultMemoryShards is the number of shards of the in-memory store.
+const defaultMemoryShards = 16
+
+// ShardedStore is an in-memory Store that spreads keys over shards, chosen
+// by a hash of the key, each shard is a MemoryStore with its own lock, so
+// operations on keys of different shards don't wait for each other. It is
+// safe for concurrent use.
+//
+// Operations on one key lock only the shard of the key. Operations on many
+// keys, GetMany, Meta, DeleteKeys and Txn, lock the shards of their keys,
+// and operations on all the keys, List, ListPage, DeletePrefix and Clear,
+// lock all the shards. They lock shards in ascending shard order, and hold
+// them until they are done, so two operations never wait for each other's
+// shards, and never deadlock. Shard methods that lock are never called
+// while holding a shard lock.
+//
+// Shards have no bound on the number of keys, bounded stores are not
+// sharded.
+type ShardedStore struct {
+	shards []*MemoryStore
+	seed   maphash.Seed
+
+	// Revision of the new store, the revisions of the shards start at 0,
+	// and the revision of the store is their sum added to it.
+	rev uint64
+}
+
+// newShardedStore returns an in-memory store of n shards.
+func newShardedStore(n int) *ShardedStore {
+	s := ShardedStore{
+		shards: make([]*MemoryStore, n),
+		seed:   maphash.MakeSeed(),
+		rev:    initialRevision(),
+	}
+	for i := range s.shards {
+		s.shards[i] = newMemoryStore()
+		s.shards[i].rev = 0
+	}
+
+	return &s
+}
+
+// shardIndex returns the index of the shard of a key.
+func (s *ShardedStore) shardIndex(k string) int {
+	return int(maphash.String(s.seed, k) % uint64(len(s.shards)))
+}
+
+// shard returns the shard of a key.
+func (s *ShardedStore) shard(k string) *MemoryStore {
+	return s.shards[s.shardIndex(k)]
+}
+
+// shardsOf returns the indexes of the shards of keys, in ascending order.
+func (s *ShardedStore) shardsOf(keys []string) []int {
+	used := make([]bool, len(s.shards))
+	for _, k := range keys {
+		used[s.shardIndex(k)] = true
+	}
+
+	indexes := make([]int, 0, len(s.shards))
+	for i, ok := range used {
+		if ok {
+			indexes = append(indexes, i)
+		}
+	}
+
+	return indexes
+}
+
+// allShards returns the indexes of all the shards.
+func (s *ShardedStore) allShards() []int {
+	indexes := make([]int, len(s.shards))
+	for i := range indexes {
+		indexes[i] = i
+	}
+
+	return indexes
+}
+
+// lock locks the shards of ascending indexes, in order, for writing, or for
+// reading, and returns a function that unlocks them.
+func (s *ShardedStore) lock(indexes []int, write bool) func() {
+	for _, i := range indexes {
+		if write {
+			s.shards[i].mu.Lock()
+		} else {
+			s.shards[i].mu.RLock()
+		}
+	}
+
+	return func() {
+		for j := len(indexes) - 1; j >= 0; j-- {
+			if write {
+				s.shards[indexes[j]].mu.Unlock()
+			} else {
+				s.shards[indexes[j]].mu.RUnlock()
+			}
+		}
+	}
+}
+
+// Get returns the value of a key, and removes it if it expired.
+func (s *ShardedStore) Get(k string) (json.RawMessage, bool, error) {
+	return s.shard(k).Get(k)
+}
+
+// GetWithETag returns the value of a key, and its cached ETag, and removes
+// the key if it expired.
+func (s *ShardedStore) GetWithETag(k string) (json.RawMessage, string, bool, error) {
+	return s.shard(k).GetWithETag(k)
+}
+
+// GetMany returns the values of keys that are not missing, reading the
+// shards of the keys at once.
+func (s *ShardedStore) GetMany(keys []string) (map[string]json.RawMessage, error) {
+	unlock := s.lock(s.shardsOf(keys), false)
+	defer unlock()
+
+	vals := make(map[string]json.RawMessage, len(keys))
+	for _, k := range keys {
+		sh := s.shard(k)
+		if v, ok := sh.vals[k]; ok && !sh.expiredLocked(k, sh.now()) {
+			vals[k] = v
+		}
+	}
+
+	return vals, nil
+}
+
+// Meta returns the metadata of keys that are not missing.
+func (s *ShardedStore) Meta(keys []string) (map[string]KeyMeta, error) {
+	unlock := s.lock(s.shardsOf(keys), false)
+	defer unlock()
+
+	metas := make(map[string]KeyMeta, len(keys))
+	for _, k := range keys {
+		sh := s.shard(k)
+		if _, ok := sh.vals[k]; ok && !sh.expiredLocked(k, sh.now()) {
+			metas[k] = sh.metas[k]
+		}
+	}
+
+	return metas, nil
+}
+
+// Len returns the number of keys of all the shards.
+func (s *ShardedStore) Len() (int, error) {
+	n := 0
+	for _, sh := range s.shards {
+		l, _ := sh.Len()
+		n += l
+	}
+
+	return n, nil
+}
+
+// Stats returns the number of keys, the size of the values, and the number
+// of evicted keys, of all the shards.
+func (s *ShardedStore) Stats() (StoreStats, error) {
+	var stats StoreStats
+	for _, sh := range s.shards {
+		shardStats, _ := sh.Stats()
+		stats.Keys += shardStats.Keys
+		stats.ValueBytes += shardStats.ValueBytes
+		stats.Evictions += shardStats.Evictions
+	}
+
+	return stats, nil
+}
+
+// List returns a copy of the key value pairs of all the shards.
+func (s *ShardedStore) List() (map[string]json.RawMessage, error) {
+	unlock := s.lock(s.allShards(), false)
+	defer unlock()
+
+	vals := make(map[string]json.RawMessage)
+	for _, sh := range s.shards {
+		sh.listLocked(vals, sh.now())
+	}
+
+	return vals, nil
+}
+
+// ListPage returns a page of key value pairs with a prefix, merging the
+// sorted keys of the pages of all the shards.
+func (s *ShardedStore) ListPage(prefix, cursor string, limit int) (map[string]json.RawMessage, string, error) {
+	unlock := s.lock(s.allShards(), false)
+	defer unlock()
+
+	// Every shard has the keys of the page it holds, and one more.
+	keys := make([]string, 0)
+	for _, sh := range s.shards {
+		keys = append(keys, sh.pageKeysLocked(prefix, cursor, limit, sh.now())...)
+	}
+	sort.Strings(keys)
+
+	next := ""
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+		next = keys[limit-1]
+	}
+
+	page := make(map[string]json.RawMessage, len(keys))
+	for _, k := range keys {
+		page[k] = s.shard(k).vals[k]
+	}
+
+	return page, next, nil
+}
+
+// Upsert creates or modifies a key value pair, that never expires.
+func (s *ShardedStore) Upsert(k string, v json.RawMessage) error {
+	return s.shard(k).Upsert(k, v)
+}
+
+// UpsertTTL creates or modifies a key value pair, that expires after ttl.
+func (s *ShardedStore) UpsertTTL(k string, v json.RawMessage, ttl time.Duration) error {
+	return s.shard(k).UpsertTTL(k, v, ttl)
+}
+
+// UpsertRaw creates or modifies a key with a raw value, and its content
+// type, that expires after ttl, if ttl is positive.
+func (s *ShardedStore) UpsertRaw(k string, data []byte, contentType string, ttl time.Duration) error {
+	return s.shard(k).UpsertRaw(k, data, contentType, ttl)
+}
+
+// TTL returns the remaining time to live of a key.
+func (s *ShardedStore) TTL(k string) (time.Duration, bool, error) {
+	return s.shard(k).TTL(k)
+}
+
+// Delete removes a key.
+func (s *ShardedStore) Delete(k string) (bool, error) {
+	return s.shard(k).Delete(k)
+}
+
+// DeleteKeys removes keys atomically, locking the shards of the keys.
+func (s *ShardedStore) DeleteKeys(keys []string) ([]bool, error) {
+	unlock := s.lock(s.shardsOf(keys), true)
+	defer unlock()
+
+	deleted := make([]bool, len(keys))
+	for i, k := range keys {
+		sh := s.shard(k)
+		deleted[i] = sh.removeLocked(k, sh.now())
+	}
+
+	return deleted, nil
+}
+
+// DeletePrefix removes the keys with a prefix atomically, locking all the
+// shards.
+func (s *ShardedStore) DeletePrefix(prefix string) ([]string, error) {
+	unlock := s.lock(s.allShards(), true)
+	defer unlock()
+
+	deleted := make([]string, 0)
+	for _, sh := range s.shards {
+		deleted = append(deleted, sh.deletePrefixLocked(prefix, sh.now())...)
+	}
+	sort.Strings(deleted)
+
+	return deleted, nil
+}
+
+// Clear removes all the keys atomically, locking all the shards.
+func (s *ShardedStore) Clear() (int, error) {
+	unlock := s.lock(s.allShards(), true)
+	defer unlock()
+
+	n := 0
+	for _, sh := range s.shards {
+		n += sh.clearLocked(sh.now())
+	}
+
+	return n, nil
+}
+
+// DeleteExpired removes expired keys, one shard at a time.
+func (s *ShardedStore) DeleteExpired() (int, error) {
+	n := 0
+	for _, sh := range s.shards {
+		deleted, _ := sh.DeleteExpired()
+		n += deleted
+	}
+
+	return n, nil
+}
+
+// Incr adds delta to the integer value of a key atomically.
+func (s *ShardedStore) Incr(k string, delta int64) (int64, error) {
+	return s.shard(k).Incr(k, delta)
+}
+
+// CompareAndSwap replaces the value of a key atomically, if it equals old.
+func (s *ShardedStore) CompareAndSwap(k string, old, replacement json.RawMessage) (json.RawMessage, bool, bool, error) {
+	return s.shard(k).CompareAndSwap(k, old, replacement)
+}
+
+// Push appends an element to the array value of a key atomically.
+func (s *ShardedStore) Push(k string, element json.RawMessage) (json.RawMessage, error) {
+	return s.shard(k).Push(k, element)
+}
+
+// Pop removes the first, or the last, element of the array value of a key
+// atomically.
+func (s *ShardedStore) Pop(k string, front bool) (json.RawMessage, json.RawMessage, bool, error) {
+	return s.shard(k).Pop(k, front)
+}
+
+// Txn evaluates the checks of a transaction, and applies its puts and
+// deletes, locking the shards of its keys.
+func (s *ShardedStore) Txn(ops []TxnOp) (int, json.RawMessage, []bool, error) {
+	keys := make([]string, len(ops))
+	for i, op := range ops {
+		keys[i] = op.Key
+	}
+	unlock := s.lock(s.shardsOf(keys), true)
+	defer unlock()
+
+	for _, op := range ops {
+		if sh := s.shard(op.Key); sh.expiredLocked(op.Key, sh.now()) {
+			sh.deleteLocked(op.Key)
+		}
+	}
+
+	for i, op := range ops {
+		if op.Op != TxnCheck {
+			continue
+		}
+		if cur, ok := s.shard(op.Key).vals[op.Key]; !valueMatches(cur, ok, op.Value) {
+			return i, cur, nil, nil
+		}
+	}
+
+	// Shards are not bounded, transactions always fit.
+	existed := make([]bool, len(ops))
+	for i, op := range ops {
+		sh := s.shard(op.Key)
+		_, existed[i] = sh.vals[op.Key]
+		switch op.Op {
+		case TxnPut:
+			sh.setLocked(op.Key, op.Value)
+			delete(sh.expires, op.Key)
+		case TxnDelete:
+			sh.deleteLocked(op.Key)
+		}
+	}
+
+	return -1, nil, existed, nil
+}
+
+// Trash moves a key to the trash of its shard.
+func (s *ShardedStore) Trash(k string) (bool, error) {
+	return s.shard(k).Trash(k)
+}
+
+// ListTrash returns the trashed keys with a prefix, of all the shards, in
+// key order.
+func (s *ShardedStore) ListTrash(prefix string) ([]TrashedKey, error) {
+	trashed := []TrashedKey{}
+	for _, sh := range s.shards {
+		shardTrashed, _ := sh.ListTrash(prefix)
+		trashed = append(trashed, shardTrashed...)
+	}
+	sort.Slice(trashed, func(i, j int) bool { return trashed[i].Key < trashed[j].Key })
+
+	return trashed, nil
+}
+
+// Restore moves a key from the trash back.
+func (s *ShardedStore) Restore(k string) (json.RawMessage, bool, error) {
+	return s.shard(k).Restore(k)
+}
+
+// DeleteTrashed removes a key from the trash.
+func (s *ShardedStore) DeleteTrashed(k string) (bool, error) {
+	return s.shard(k).DeleteTrashed(k)
+}
+
+// PurgeTrash removes the keys trashed more than retention ago, of all the
+// shards.
+func (s *ShardedStore) PurgeTrash(retention time.Duration) (int, error) {
+	n := 0
+	for _, sh := range s.shards {
+		purged, _ := sh.PurgeTrash(retention)
+		n += purged
+	}
+
+	return n, nil
+}
+
+// Revision returns the revision of the key value pairs, every change of a
+// shard increments the revision of the shard, and so their sum.
+func (s *ShardedStore) Revision() (uint64, error) {
+	rev := s.rev
+	for _, sh := range s.shards {
+		shardRev, _ := sh.Revision()
+		rev += shardRev
+	}
+
+	return rev, nil
+}
@@ -0,0 +1,245 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// newTestShardedStore returns a sharded store with a clock.
+func newTestShardedStore(clock *fakeClock) *ShardedStore {
+	s := newShardedStore(8)
+	if clock != nil {
+		for _, sh := range s.shards {
+			sh.now = clock.Now
+		}
+	}
+
+	return s
+}
+
+func TestShardedStoreListPage(t *testing.T) {
+	testListPage(t, newTestShardedStore(nil))
+}
+
+func TestShardedStoreDeletePrefix(t *testing.T) {
+	testDeletePrefix(t, newTestShardedStore(nil))
+}
+
+func TestShardedStoreConcurrentIncr(t *testing.T) {
+	testConcurrentIncr(t, newTestShardedStore(nil))
+}
+
+func TestShardedStoreConcurrentCAS(t *testing.T) {
+	testConcurrentCAS(t, newTestShardedStore(nil))
+}
+
+func TestShardedStoreConcurrentPushPop(t *testing.T) {
+	testConcurrentPushPop(t, newTestShardedStore(nil))
+}
+
+func TestShardedStoreTxn(t *testing.T) {
+	testStoreTxn(t, newTestShardedStore(nil))
+}
+
+func TestShardedStoreConcurrentTxn(t *testing.T) {
+	testConcurrentTxn(t, newTestShardedStore(nil))
+}
+
+func TestShardedStoreUpsertRaw(t *testing.T) {
+	testUpsertRaw(t, newTestShardedStore(nil))
+}
+
+func TestShardedStoreTrash(t *testing.T) {
+	clock := epochClock()
+	testTrash(t, newTestShardedStore(clock), clock)
+}
+
+func TestShardedStoreStats(t *testing.T) {
+	testStoreStats(t, newTestShardedStore(nil))
+}
+
+func TestShardedStoreSpreadsKeys(t *testing.T) {
+	s := newTestShardedStore(nil)
+	for i := 0; i < 100; i++ {
+		s.Upsert(fmt.Sprintf("kitty%02d", i), json.RawMessage(`1`))
+	}
+
+	// Check the keys are spread over the shards, and listed in order.
+	for i, sh := range s.shards {
+		if n, _ := sh.Len(); n == 0 {
+			t.Errorf("shard %d has no keys", i)
+		}
+	}
+	cursor := ""
+	for i := 0; i < 100; i += 7 {
+		page, next, err := s.ListPage("kitty", cursor, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := i; j < i+7 && j < 100; j++ {
+			if _, ok := page[fmt.Sprintf("kitty%02d", j)]; !ok {
+				t.Errorf("ListPage after %q: missing kitty%02d in %v", cursor, j, page)
+			}
+		}
+		cursor = next
+	}
+	if cursor != "" {
+		t.Errorf("ListPage: got a next page after the last key, %q", cursor)
+	}
+}
+
+func TestShardedStoreRevision(t *testing.T) {
+	s := newTestShardedStore(nil)
+
+	// Check every change, of any shard, changes the revision.
+	changes := []func(){
+		func() { s.Upsert("a", json.RawMessage(`1`)) },
+		func() { s.Upsert("b", json.RawMessage(`2`)) },
+		func() { s.Incr("c", 1) },
+		func() { s.Txn([]TxnOp{{Op: TxnPut, Key: "d", Value: json.RawMessage(`4`)}}) },
+		func() { s.Trash("a") },
+		func() { s.DeleteTrashed("a") },
+		func() { s.DeleteKeys([]string{"b"}) },
+		func() { s.DeletePrefix("c") },
+		func() { s.Clear() },
+	}
+	rev, _ := s.Revision()
+	for i, change := range changes {
+		change()
+		next, _ := s.Revision()
+		if next <= rev {
+			t.Errorf("change %d: revision did not increase, got %d after %d", i, next, rev)
+		}
+		rev = next
+	}
+
+	// Check reading doesn't change the revision.
+	s.List()
+	s.GetMany([]string{"a", "d"})
+	if next, _ := s.Revision(); next != rev {
+		t.Errorf("reads changed the revision, got %d want %d", next, rev)
+	}
+}
+
+func TestShardedStoreCrossShardDeadlock(t *testing.T) {
+	s := newTestShardedStore(nil)
+
+	// Check operations locking many shards, in parallel, don't deadlock,
+	// and transactions are never applied in part.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 200; j++ {
+				switch (i + j) % 5 {
+				case 0:
+					s.Txn([]TxnOp{
+						{Op: TxnPut, Key: "pair/a", Value: json.RawMessage(fmt.Sprint(j))},
+						{Op: TxnPut, Key: "pair/z", Value: json.RawMessage(fmt.Sprint(j))},
+					})
+				case 1:
+					s.DeletePrefix("pair/")
+				case 2:
+					s.Clear()
+				case 3:
+					s.DeleteKeys([]string{"pair/z", "pair/a"})
+				default:
+					vals, _ := s.GetMany([]string{"pair/z", "pair/a"})
+					if string(vals["pair/a"]) != string(vals["pair/z"]) {
+						t.Errorf("GetMany read half a transaction: %s", vals)
+						return
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestOpenStoreShards(t *testing.T) {
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{nil, "*main.ShardedStore"},
+		{[]string{"-memory-shards", "1"}, "*main.MemoryStore"},
+		{[]string{"-memory-max-keys", "10"}, "*main.MemoryStore"},
+		{[]string{"-memory-max-keys", "10", "-memory-shards", "1"}, "*main.MemoryStore"},
+	}
+
+	// Check unbounded stores are sharded, unless there is one shard.
+	for _, tt := range tests {
+		c, err := quietConfig(tt.args, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, _, err := openStore(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprintf("%T", s); got != tt.expected {
+			t.Errorf("%v: got %s want %s", tt.args, got, tt.expected)
+		}
+	}
+}
+
+// benchmarkMixed benchmarks parallel reads and writes of 1000 keys, mostly
+// reads, and lists of pages of keys, on store.
+func benchmarkMixed(b *testing.B, store Store) {
+	const keys = 1000
+	for i := 0; i < keys; i++ {
+		store.Upsert(fmt.Sprintf("kitty%d", i), json.RawMessage(`{"n":0}`))
+	}
+
+	var next uint64
+	var mu sync.Mutex
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		mu.Lock()
+		i := next
+		next += 7919
+		mu.Unlock()
+
+		for pb.Next() {
+			i++
+			k := fmt.Sprintf("kitty%d", i%keys)
+			switch op := i % 100; {
+			case op < 80:
+				store.Get(k)
+			case op < 95:
+				store.Upsert(k, json.RawMessage(fmt.Sprintf(`{"n":%d}`, i)))
+			case op < 99:
+				store.Incr("counter", 1)
+			default:
+				store.ListPage("kitty1", "", 10)
+			}
+		}
+	})
+}
+
+func BenchmarkMixedMemoryStore(b *testing.B) {
+	benchmarkMixed(b, newMemoryStore())
+}
+
+func BenchmarkMixedShardedStore(b *testing.B) {
+	benchmarkMixed(b, newShardedStore(defaultMemoryShards))
+}
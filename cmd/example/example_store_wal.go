@@ -0,0 +1,235 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// Operations of write-ahead log records.
+const (
+	walSet    = "set"
+	walDelete = "delete"
+	walClear  = "clear"
+	walTxn    = "txn"
+	walTrash  = "trash"
+	walPurge  = "purge"
+)
+
+// defaultWALCompactBytes is the size of a write-ahead log that triggers
+// a snapshot.
+const defaultWALCompactBytes = 64 << 20
+
+// walOptions configures the write-ahead log of a FileStore.
+type walOptions struct {
+	// Enabled appends every change to the log, instead of writing the
+	// store file.
+	Enabled bool
+
+	// Sync fsyncs the log after every append, o/w appends are flushed by
+	// the operating system, and a crash may lose the last changes.
+	Sync bool
+
+	// CompactBytes is the size of the log that triggers a snapshot, zero
+	// compacts only every snapshot interval, and on Close.
+	CompactBytes int64
+}
+
+// walRecord is a line of the write-ahead log, revisions increase by one on
+// every record, and survive snapshots. The records of a transaction are
+// nested in one record, their revisions are zero.
+type walRecord struct {
+	Op        string          `json:"op"`
+	Key       string          `json:"key,omitempty"`
+	Keys      []string        `json:"keys,omitempty"`
+	Value     json.RawMessage `json:"value,omitempty"`
+	Expires   *time.Time      `json:"expires,omitempty"`
+	Meta      *KeyMeta        `json:"meta,omitempty"`
+	DeletedAt *time.Time      `json:"deleted_at,omitempty"`
+	Records   []walRecord     `json:"records,omitempty"`
+	Revision  uint64          `json:"revision"`
+}
+
+// walPath returns the path of the write-ahead log of a store file.
+func walPath(path string) string {
+	return path + ".wal"
+}
+
+// setRecord returns a record setting the value of a key, with the expiry
+// time of the key, if it has one, and its metadata.
+func (s *FileStore) setRecord(k string, v json.RawMessage) walRecord {
+	r := walRecord{Op: walSet, Key: k, Value: v}
+	if expires, ok := s.mem.expiry(k); ok {
+		r.Expires = &expires
+	}
+	if m, ok := s.mem.meta(k); ok {
+		r.Meta = &m
+	}
+
+	return r
+}
+
+// replayLocked applies the records of the write-ahead log newer than
+// revision after, and returns their number.
+//
+// A torn record, e.g. the last record of a crash, ends the log, the log is
+// truncated before it with a warning, losing only the torn change.
+func (s *FileStore) replayLocked(after uint64) int {
+	path := walPath(s.path)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		log.Printf("warning: can't read write-ahead log %s, ignoring it: %v", path, err)
+		return 0
+	}
+
+	n := 0
+	offset := 0
+	for offset < len(data) {
+		var r walRecord
+		end := bytes.IndexByte(data[offset:], '\n')
+		if end < 0 || json.Unmarshal(data[offset:offset+end], &r) != nil {
+			log.Printf("warning: write-ahead log %s has a torn record at offset %d, truncating it",
+				path, offset)
+			if err := os.Truncate(path, int64(offset)); err != nil {
+				log.Printf("warning: can't truncate write-ahead log %s: %v", path, err)
+			}
+			break
+		}
+		offset += end + 1
+
+		if r.Revision > s.walRev {
+			s.walRev = r.Revision
+		}
+		if r.Revision <= after {
+			// The record is already in the snapshot.
+			continue
+		}
+		s.applyLocked(r)
+		n++
+	}
+	s.logBytes = int64(offset)
+
+	return n
+}
+
+// applyLocked applies a write-ahead log record to the values.
+func (s *FileStore) applyLocked(r walRecord) {
+	switch r.Op {
+	case walSet:
+		if r.Expires == nil {
+			s.mem.Upsert(r.Key, compactJSON(r.Value))
+		} else if ttl := r.Expires.Sub(s.mem.now()); ttl > 0 {
+			s.mem.UpsertTTL(r.Key, compactJSON(r.Value), ttl)
+		} else {
+			s.mem.Delete(r.Key)
+		}
+		if r.Meta != nil {
+			s.mem.restoreMeta(r.Key, *r.Meta)
+		}
+	case walDelete:
+		if r.Key != "" {
+			s.mem.Delete(r.Key)
+		}
+		s.mem.DeleteKeys(r.Keys)
+	case walClear:
+		s.mem.Clear()
+	case walTrash:
+		if r.DeletedAt != nil {
+			s.mem.trashAt(r.Key, *r.DeletedAt)
+		}
+	case walPurge:
+		if r.Key != "" {
+			s.mem.DeleteTrashed(r.Key)
+		}
+		for _, k := range r.Keys {
+			s.mem.DeleteTrashed(k)
+		}
+	case walTxn:
+		for _, nested := range r.Records {
+			s.applyLocked(nested)
+		}
+	}
+}
+
+// appendLocked appends records to the write-ahead log in one write,
+// creating the log on the first append.
+func (s *FileStore) appendLocked(records []walRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	for _, r := range records {
+		s.walRev++
+		r.Revision = s.walRev
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+
+	if s.log == nil {
+		f, err := os.OpenFile(walPath(s.path), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return fmt.Errorf("can't open write-ahead log: %v", err)
+		}
+		s.log = f
+	}
+
+	n, err := s.log.Write(buf.Bytes())
+	s.logBytes += int64(n)
+	if err != nil {
+		return fmt.Errorf("can't append to write-ahead log: %v", err)
+	}
+	if s.wal.Sync {
+		if err := s.log.Sync(); err != nil {
+			return fmt.Errorf("can't sync write-ahead log: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// truncateLogLocked empties the write-ahead log, after a snapshot.
+func (s *FileStore) truncateLogLocked() error {
+	if s.log == nil {
+		if s.logBytes == 0 {
+			return nil
+		}
+		if err := os.Remove(walPath(s.path)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		s.logBytes = 0
+		return nil
+	}
+
+	if err := s.log.Truncate(0); err != nil {
+		return fmt.Errorf("can't truncate write-ahead log: %v", err)
+	}
+	s.logBytes = 0
+
+	return nil
+}
@@ -0,0 +1,326 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// walStore returns a store with a write-ahead log, syncing every change.
+func walStore(path string, now func() time.Time) *FileStore {
+	return newFileStoreWAL(path, 0, walOptions{Enabled: true, Sync: true}, now)
+}
+
+// listValues returns the values of a store, as strings.
+func listValues(t *testing.T, s Store) map[string]string {
+	vals, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := make(map[string]string, len(vals))
+	for k, v := range vals {
+		m[k] = string(v)
+	}
+
+	return m
+}
+
+// walChanges changes a store using every logged operation, and returns the
+// values after each change.
+func walChanges(t *testing.T, s *FileStore) []map[string]string {
+	changes := []func() error{
+		func() error { return s.Upsert("kitty", json.RawMessage(`"cat"`)) },
+		func() error { return s.UpsertTTL("gorilla", json.RawMessage(`{"bananas":3}`), time.Hour) },
+		func() error { _, err := s.Incr("visits", 5); return err },
+		func() error {
+			_, _, _, err := s.CompareAndSwap("kitty", json.RawMessage(`"cat"`), json.RawMessage(`"tiger"`))
+			return err
+		},
+		func() error { _, err := s.Delete("gorilla"); return err },
+		func() error { return s.Upsert("a", json.RawMessage(`null`)) },
+		func() error {
+			_, _, _, err := s.Txn([]TxnOp{
+				{Op: TxnCheck, Key: "kitty", Value: json.RawMessage(`"tiger"`)},
+				{Op: TxnPut, Key: "b", Value: json.RawMessage(`{"c":1}`)},
+				{Op: TxnDelete, Key: "kitty"},
+			})
+			return err
+		},
+		func() error { _, err := s.DeleteKeys([]string{"a", "missing", "visits"}); return err },
+		func() error { _, err := s.Clear(); return err },
+		func() error { return s.Upsert("last", json.RawMessage(`[1,"two"]`)) },
+		func() error { return s.UpsertRaw("blob", []byte{0, 0xff}, "image/png", 0) },
+	}
+
+	states := []map[string]string{listValues(t, s)}
+	for i, change := range changes {
+		if err := change(); err != nil {
+			t.Fatalf("change %d: %v", i, err)
+		}
+		states = append(states, listValues(t, s))
+	}
+
+	return states
+}
+
+func TestFileStoreWALRestart(t *testing.T) {
+	quietLogs(t)
+
+	path := filepath.Join(t.TempDir(), "store.json")
+	s := walStore(path, time.Now)
+	states := walChanges(t, s)
+
+	// Check changes are logged, without writing the store file.
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("store file was written: %v", err)
+	}
+
+	// Check the values survive a crash, without closing the store.
+	crashed := walStore(path, time.Now)
+	if got, want := listValues(t, crashed), states[len(states)-1]; !reflect.DeepEqual(got, want) {
+		t.Errorf("values after a crash: got %v want %v", got, want)
+	}
+	crashed.Close()
+	s.Close()
+
+	// Check closing compacts the log.
+	data, _ := os.ReadFile(walPath(path))
+	if len(data) != 0 {
+		t.Errorf("log was not compacted: %s", data)
+	}
+	s = walStore(path, time.Now)
+	defer s.Close()
+	if got, want := listValues(t, s), states[len(states)-1]; !reflect.DeepEqual(got, want) {
+		t.Errorf("values after a restart: got %v want %v", got, want)
+	}
+	if metas, _ := s.Meta([]string{"blob"}); metas["blob"].ContentType != "image/png" {
+		t.Errorf("unexpected metadata after a restart: %+v", metas["blob"])
+	}
+}
+
+func TestFileStoreWALTornRecords(t *testing.T) {
+	quietLogs(t)
+
+	path := filepath.Join(t.TempDir(), "store.json")
+	s := walStore(path, time.Now)
+	states := walChanges(t, s)
+	log, err := os.ReadFile(walPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// Simulate crashes cutting the log at every offset, the store recovers
+	// the changes of complete records, and truncates the torn record.
+	for cut := 0; cut <= len(log); cut++ {
+		complete := bytes.LastIndexByte(log[:cut], '\n') + 1
+		changes := bytes.Count(log[:cut], []byte("\n"))
+
+		crashed := filepath.Join(t.TempDir(), "store.json")
+		if err := os.WriteFile(walPath(crashed), log[:cut], 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		s := walStore(crashed, time.Now)
+		if got, want := listValues(t, s), states[changes]; !reflect.DeepEqual(got, want) {
+			t.Errorf("cut at %d: got %v want %v", cut, got, want)
+		}
+		if info, err := os.Stat(walPath(crashed)); err != nil || info.Size() != int64(complete) {
+			t.Errorf("cut at %d: log was not truncated to %d: %v, %v", cut, complete, info.Size(), err)
+		}
+
+		// Check changes after recovery are logged after the complete records.
+		if err := s.Upsert("after", json.RawMessage(`1`)); err != nil {
+			t.Errorf("cut at %d: Upsert: %v", cut, err)
+		}
+		s = walStore(crashed, time.Now)
+		if got := listValues(t, s)["after"]; got != "1" {
+			t.Errorf("cut at %d: change after recovery was lost: got %q", cut, got)
+		}
+		s.Close()
+	}
+}
+
+func TestFileStoreWALCompaction(t *testing.T) {
+	quietLogs(t)
+
+	path := filepath.Join(t.TempDir(), "store.json")
+	s := newFileStoreWAL(path, 0, walOptions{Enabled: true, CompactBytes: 200}, time.Now)
+	for i := 0; i < 20; i++ {
+		s.Upsert(fmt.Sprintf("kitty%d", i%3), json.RawMessage(fmt.Sprint(i)))
+	}
+
+	// Check a large log was compacted into a snapshot of its revision.
+	info, err := os.Stat(walPath(path))
+	if err != nil || info.Size() >= 200 {
+		t.Errorf("log was not compacted: %v, %v", info.Size(), err)
+	}
+	var snap fileSnapshot
+	data, _ := os.ReadFile(path)
+	if err := json.Unmarshal(data, &snap); err != nil || snap.Revision == 0 {
+		t.Errorf("unexpected snapshot: %s, %v", data, err)
+	}
+
+	// Check a crash loads the snapshot, and replays the log tail.
+	want := listValues(t, s)
+	crashed := walStore(path, time.Now)
+	if got := listValues(t, crashed); !reflect.DeepEqual(got, want) {
+		t.Errorf("values after a crash: got %v want %v", got, want)
+	}
+	crashed.Close()
+	s.Close()
+}
+
+func TestFileStoreWALSnapshotRevision(t *testing.T) {
+	quietLogs(t)
+
+	// A crash after writing a snapshot, before emptying the log, leaves
+	// records that are already in the snapshot.
+	path := filepath.Join(t.TempDir(), "store.json")
+	os.WriteFile(path, []byte(`{"values":{"b":2},"revision":2}`), 0600)
+	os.WriteFile(walPath(path), []byte(
+		`{"op":"set","key":"a","value":1,"revision":1}`+"\n"+
+			`{"op":"delete","key":"a","revision":2}`+"\n"+
+			`{"op":"set","key":"c","value":3,"revision":3}`+"\n"), 0600)
+
+	// Check only records newer than the snapshot are replayed.
+	s := walStore(path, epochClock().Now)
+	if got := listValues(t, s); !reflect.DeepEqual(got, map[string]string{"b": "2", "c": "3"}) {
+		t.Errorf("values: got %v want b and c", got)
+	}
+
+	// Check revisions continue after the log.
+	s.Upsert("d", json.RawMessage(`4`))
+	data, _ := os.ReadFile(walPath(path))
+	if !bytes.HasSuffix(data, []byte(`{"op":"set","key":"d","value":4,"meta":`+epochMeta+`,"revision":4}`+"\n")) {
+		t.Errorf("unexpected log: %s", data)
+	}
+	s.Close()
+}
+
+func TestFileStoreWALTTL(t *testing.T) {
+	quietLogs(t)
+
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	path := filepath.Join(t.TempDir(), "store.json")
+	s := walStore(path, clock.Now)
+	s.UpsertTTL("short", json.RawMessage(`1`), time.Second)
+	s.UpsertTTL("long", json.RawMessage(`2`), time.Minute)
+	s.Incr("long", 1)
+	s.UpsertTTL("cleared", json.RawMessage(`3`), time.Second)
+	s.Upsert("cleared", json.RawMessage(`3`))
+
+	// Check expiry times are replayed, incr keeps the ttl, and expired keys
+	// are dropped.
+	clock.Add(2 * time.Second)
+	crashed := walStore(path, clock.Now)
+	defer crashed.Close()
+	if got := listValues(t, crashed); !reflect.DeepEqual(got, map[string]string{"long": "3", "cleared": "3"}) {
+		t.Errorf("values: got %v want long and cleared", got)
+	}
+	if ttl, ok, _ := crashed.TTL("long"); !ok || ttl != 58*time.Second {
+		t.Errorf("TTL: got %v, %v want 58s", ttl, ok)
+	}
+	s.Close()
+}
+
+func TestFileStoreReplaysWALWhenDisabled(t *testing.T) {
+	quietLogs(t)
+
+	path := filepath.Join(t.TempDir(), "store.json")
+	s := walStore(path, epochClock().Now)
+	s.Upsert("kitty", json.RawMessage(`"cat"`))
+
+	// Check a store without a log replays the log of a previous run, and
+	// compacts it.
+	plain := newFileStoreWithClock(path, 0, epochClock().Now)
+	defer plain.Close()
+	if got := listValues(t, plain); got["kitty"] != `"cat"` {
+		t.Errorf("values: got %v want kitty", got)
+	}
+	if _, err := os.Stat(walPath(path)); !os.IsNotExist(err) {
+		t.Errorf("log was not removed: %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	if string(data) != `{"values":{"kitty":"cat"},"meta":{"kitty":`+epochMeta+`}}` {
+		t.Errorf("unexpected file content: %s", data)
+	}
+}
+
+func BenchmarkPUTFileStore(b *testing.B) {
+	s := newFileStore(filepath.Join(b.TempDir(), "kitty.json"), 0)
+	defer s.Close()
+
+	benchmarkPUT(b, s)
+}
+
+func BenchmarkPUTFileStoreWAL(b *testing.B) {
+	s := walStore(filepath.Join(b.TempDir(), "kitty.json"), time.Now)
+	defer s.Close()
+
+	benchmarkPUT(b, s)
+}
+
+func BenchmarkPUTFileStoreWALNoSync(b *testing.B) {
+	s := newFileStoreWAL(filepath.Join(b.TempDir(), "kitty.json"), 0,
+		walOptions{Enabled: true, CompactBytes: defaultWALCompactBytes}, time.Now)
+	defer s.Close()
+
+	benchmarkPUT(b, s)
+}
+
+func TestFileStoreWALTrash(t *testing.T) {
+	quietLogs(t)
+
+	clock := epochClock()
+	path := filepath.Join(t.TempDir(), "store.json")
+	s := walStore(path, clock.Now)
+	for _, k := range []string{"a", "b", "c", "d"} {
+		s.Upsert(k, json.RawMessage(`"`+k+`"`))
+		s.Trash(k)
+		clock.Add(time.Minute)
+	}
+	s.Restore("b")
+	s.DeleteTrashed("c")
+	s.PurgeTrash(3 * time.Minute)
+
+	// Check the trash survives a crash, and a restart.
+	for _, name := range []string{"crash", "restart"} {
+		if name == "restart" {
+			s.Close()
+		}
+		reopened := walStore(path, clock.Now)
+		if got := listTrash(t, reopened); got != `[d="d"]` {
+			t.Errorf("%s: unexpected trash: %s", name, got)
+		}
+		if got := listValues(t, reopened); fmt.Sprint(got) != `map[b:"b"]` {
+			t.Errorf("%s: unexpected values: %v", name, got)
+		}
+		trashed, _ := reopened.ListTrash("")
+		if len(trashed) == 1 && !trashed[0].DeletedAt.Equal(time.Unix(180, 0)) {
+			t.Errorf("%s: wrong deletion time: %v", name, trashed[0].DeletedAt)
+		}
+		reopened.Close()
+	}
+}
@@ -16,10 +16,23 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"os/signal"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestGetAll(t *testing.T) {
@@ -280,8 +293,8 @@ func TestPUT(t *testing.T) {
 			status, http.StatusNotModified)
 	}
 
-	// Check the response body is what we expect.
-	expected = "{\"kitty\":\"cat\"}"
+	// Check the response body is empty, 304 responses have no body.
+	expected = ""
 	if rr.Body.String() != expected {
 		t.Errorf("handler returned unexpected body: got %v want %v",
 			rr.Body.String(), expected)
@@ -308,3 +321,1770 @@ func TestPUT(t *testing.T) {
 			rr.Body.String(), expected)
 	}
 }
+
+func TestHealth(t *testing.T) {
+	handler := newRouter()
+
+	for _, path := range []string{"/livez", "/readyz"} {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the status code is what we expect.
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				path, status, http.StatusOK)
+		}
+	}
+
+	// Check the readiness body lists the store check.
+	req, err := http.NewRequest("GET", "/readyz", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if !strings.Contains(rr.Body.String(), `"store":{"status":"ok"`) {
+		t.Errorf("handler returned unexpected body: %v", rr.Body.String())
+	}
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	handler := newRouter()
+
+	// Fire mixed reads and writes, run with -race to catch data races.
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			key := fmt.Sprintf("kitty%d", i%5)
+			requests := []struct {
+				method string
+				path   string
+				body   string
+			}{
+				{"POST", "/val", fmt.Sprintf("{\"%s\": \"cat\", \"gorilla\": %d}", key, i)},
+				{"PUT", "/val/" + key, fmt.Sprintf("\"cat%d\"", i)},
+				{"GET", "/val", ""},
+				{"GET", "/val/" + key, ""},
+				{"DELETE", "/val/" + key, ""},
+			}
+
+			for _, tt := range requests {
+				req, err := http.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, req)
+
+				// Check the server did not fail.
+				if rr.Code >= http.StatusInternalServerError {
+					t.Errorf("%s %s: handler returned status code %v", tt.method, tt.path, rr.Code)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestJSONValues(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"string", `"cat"`},
+		{"number", `123`},
+		{"float", `1.5e-7`},
+		{"large integer", `12345678901234567890123`},
+		{"boolean", `true`},
+		{"null", `null`},
+		{"array", `[1,"two",[3],{"four":4}]`},
+		{"nested object", `{"kitty":{"age":3,"toys":["ball","mouse"]},"owner":null}`},
+	}
+
+	handler := newRouter()
+
+	for _, tt := range tests {
+		// Store a value.
+		req, err := http.NewRequest("PUT", "/val/key", strings.NewReader(tt.value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Get the value back.
+		req, err = http.NewRequest("GET", "/val/key", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the value kept its JSON type and representation.
+		expected := "{\"key\":" + tt.value + "}"
+		if rr.Body.String() != expected {
+			t.Errorf("%s: handler returned unexpected body: got %v want %v",
+				tt.name, rr.Body.String(), expected)
+		}
+	}
+}
+
+func TestPOSTJSONValues(t *testing.T) {
+	handler := newRouter()
+
+	// Store values of all JSON types, with insignificant white space.
+	req, err := http.NewRequest("POST", "/val", strings.NewReader(
+		"{\"a\": 12345678901234567890, \"b\": [1, 2], \"c\": {\"d\": null}, \"e\": false}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	// Get all values.
+	req, err = http.NewRequest("GET", "/val", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	// Check the response body is what we expect.
+	expected := "{\"a\":12345678901234567890,\"b\":[1,2],\"c\":{\"d\":null},\"e\":false}"
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v",
+			rr.Body.String(), expected)
+	}
+}
+
+// failingStore is a Store whose backend always fails.
+type failingStore struct{}
+
+func (failingStore) Get(key string) (json.RawMessage, bool, error) {
+	return nil, false, errors.New("backend is down")
+}
+
+func (failingStore) GetWithETag(key string) (json.RawMessage, string, bool, error) {
+	return nil, "", false, errors.New("disk on fire")
+}
+
+func (failingStore) GetMany(keys []string) (map[string]json.RawMessage, error) {
+	return nil, errors.New("disk on fire")
+}
+
+func (failingStore) Meta(keys []string) (map[string]KeyMeta, error) {
+	return nil, errors.New("disk on fire")
+}
+
+func (failingStore) Len() (int, error) {
+	return 0, errors.New("disk on fire")
+}
+
+func (failingStore) List() (map[string]json.RawMessage, error) {
+	return nil, errors.New("backend is down")
+}
+
+func (failingStore) ListPage(prefix, cursor string, limit int) (map[string]json.RawMessage, string, error) {
+	return nil, "", errors.New("backend is down")
+}
+
+func (failingStore) Upsert(key string, value json.RawMessage) error {
+	return errors.New("backend is down")
+}
+
+func (failingStore) Delete(key string) (bool, error) {
+	return false, errors.New("backend is down")
+}
+
+func (failingStore) UpsertTTL(key string, value json.RawMessage, ttl time.Duration) error {
+	return errors.New("backend is down")
+}
+
+func (failingStore) UpsertRaw(key string, data []byte, contentType string, ttl time.Duration) error {
+	return errors.New("backend is down")
+}
+
+func (failingStore) TTL(key string) (time.Duration, bool, error) {
+	return 0, false, errors.New("backend is down")
+}
+
+func (failingStore) DeleteKeys(keys []string) ([]bool, error) {
+	return nil, errors.New("backend is down")
+}
+
+func (failingStore) DeletePrefix(prefix string) ([]string, error) {
+	return nil, errors.New("backend is down")
+}
+
+func (failingStore) Clear() (int, error) {
+	return 0, errors.New("backend is down")
+}
+
+func (failingStore) DeleteExpired() (int, error) {
+	return 0, errors.New("backend is down")
+}
+
+func (failingStore) Incr(key string, delta int64) (int64, error) {
+	return 0, errors.New("disk on fire")
+}
+
+func (failingStore) CompareAndSwap(key string, old, replacement json.RawMessage) (json.RawMessage, bool, bool, error) {
+	return nil, false, false, errors.New("disk on fire")
+}
+
+func (failingStore) Push(key string, element json.RawMessage) (json.RawMessage, error) {
+	return nil, errors.New("disk on fire")
+}
+
+func (failingStore) Pop(key string, front bool) (json.RawMessage, json.RawMessage, bool, error) {
+	return nil, nil, false, errors.New("disk on fire")
+}
+
+func (failingStore) Txn(ops []TxnOp) (int, json.RawMessage, []bool, error) {
+	return -1, nil, nil, errors.New("disk on fire")
+}
+
+func (failingStore) Trash(key string) (bool, error) {
+	return false, errors.New("backend is down")
+}
+
+func (failingStore) ListTrash(prefix string) ([]TrashedKey, error) {
+	return nil, errors.New("backend is down")
+}
+
+func (failingStore) Restore(key string) (json.RawMessage, bool, error) {
+	return nil, false, errors.New("backend is down")
+}
+
+func (failingStore) DeleteTrashed(key string) (bool, error) {
+	return false, errors.New("backend is down")
+}
+
+func (failingStore) PurgeTrash(retention time.Duration) (int, error) {
+	return 0, errors.New("backend is down")
+}
+
+func (failingStore) Revision() (uint64, error) {
+	return 0, errors.New("disk on fire")
+}
+
+func (failingStore) Stats() (StoreStats, error) {
+	return StoreStats{}, errors.New("disk on fire")
+}
+
+func TestStoreErrors(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{"GET", "/val", ""},
+		{"GET", "/val/kitty", ""},
+		{"POST", "/val", "{\"kitty\": \"cat\"}"},
+		{"PUT", "/val/kitty", "\"cat\""},
+		{"PATCH", "/val/kitty", "{}"},
+		{"DELETE", "/val/kitty", ""},
+		{"DELETE", "/val?confirm=true", ""},
+		{"POST", "/val/delete", "[\"kitty\"]"},
+	}
+
+	handler := newStoreRouter(failingStore{})
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check backend errors are not reported as missing keys.
+		if status := rr.Code; status != http.StatusInternalServerError {
+			t.Errorf("%s %s: handler returned wrong status code: got %v want %v",
+				tt.method, tt.path, status, http.StatusInternalServerError)
+		}
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	s := newMemoryStore()
+
+	if _, ok, err := s.Get("kitty"); ok || err != nil {
+		t.Errorf("Get of a missing key: got %v, %v", ok, err)
+	}
+	if err := s.Upsert("kitty", json.RawMessage(`"cat"`)); err != nil {
+		t.Fatal(err)
+	}
+	if val, ok, err := s.Get("kitty"); !ok || err != nil || string(val) != `"cat"` {
+		t.Errorf("Get: got %s, %v, %v", val, ok, err)
+	}
+
+	// Check List returns a copy.
+	vals, err := s.List()
+	if err != nil || len(vals) != 1 {
+		t.Fatalf("List: got %v, %v", vals, err)
+	}
+	delete(vals, "kitty")
+	if _, ok, _ := s.Get("kitty"); !ok {
+		t.Errorf("modifying the List result modified the store")
+	}
+
+	if ok, err := s.Delete("kitty"); !ok || err != nil {
+		t.Errorf("Delete: got %v, %v", ok, err)
+	}
+	if ok, err := s.Delete("kitty"); ok || err != nil {
+		t.Errorf("Delete of a missing key: got %v, %v", ok, err)
+	}
+}
+
+// fakeClock is a settable clock.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+func TestTTL(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	store := newMemoryStore()
+	store.now = clock.Now
+	handler := newStoreRouter(store)
+
+	tests := []struct {
+		name     string
+		advance  time.Duration
+		method   string
+		path     string
+		body     string
+		status   int
+		ttl      string
+		expected string
+	}{
+		{"put with ttl", 0, "PUT", "/val/kitty?ttl=30s", "\"cat\"", http.StatusCreated, "30",
+			"{\"kitty\":\"cat\"}"},
+		{"get remaining ttl", 10 * time.Second, "GET", "/val/kitty", "", http.StatusOK, "20",
+			"{\"kitty\":\"cat\"}"},
+		{"get rounds up", 500 * time.Millisecond, "GET", "/val/kitty", "", http.StatusOK, "20",
+			"{\"kitty\":\"cat\"}"},
+		{"list before expiry", 0, "GET", "/val", "", http.StatusOK, "",
+			"{\"kitty\":\"cat\"}"},
+		{"get expired", 20 * time.Second, "GET", "/val/kitty", "", http.StatusNotFound, "",
+			"{\"error\":{\"code\":\"key_not_found\",\"message\":\"can't find key kitty\"}}"},
+		{"list after expiry", 0, "GET", "/val", "", http.StatusOK, "", "{}"},
+		{"post with ttl", 0, "POST", "/val?ttl=1m", "{\"a\": 1, \"b\": 2}", http.StatusCreated, "60",
+			"{\"a\":1,\"b\":2}"},
+		{"put clears ttl", 0, "PUT", "/val/a", "1", http.StatusOK, "", "{\"a\":1}"},
+		{"get without ttl", time.Hour, "GET", "/val/a", "", http.StatusOK, "", "{\"a\":1}"},
+		{"get expired post", 0, "GET", "/val/b", "", http.StatusNotFound, "",
+			"{\"error\":{\"code\":\"key_not_found\",\"message\":\"can't find key b\"}}"},
+		{"invalid ttl", 0, "PUT", "/val/kitty?ttl=soon", "\"cat\"", http.StatusBadRequest, "",
+			"{\"error\":{\"code\":\"bad_request\",\"message\":\"invalid ttl soon\"}}"},
+		{"negative ttl", 0, "PUT", "/val/kitty?ttl=-1s", "\"cat\"", http.StatusBadRequest, "",
+			"{\"error\":{\"code\":\"bad_request\",\"message\":\"invalid ttl -1s\"}}"},
+	}
+
+	for _, tt := range tests {
+		clock.Add(tt.advance)
+
+		req, err := http.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the status code is what we expect.
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				tt.name, status, tt.status)
+		}
+
+		// Check the remaining time to live is what we expect.
+		if got := rr.Header().Get(ttlHeader); got != tt.ttl {
+			t.Errorf("%s: wrong %s header: got %q want %q", tt.name, ttlHeader, got, tt.ttl)
+		}
+
+		// Check the response body is what we expect.
+		if rr.Body.String() != tt.expected {
+			t.Errorf("%s: handler returned unexpected body: got %v want %v",
+				tt.name, rr.Body.String(), tt.expected)
+		}
+	}
+
+	// Check expired keys read by GET were removed.
+	if _, ok := store.vals["kitty"]; ok {
+		t.Errorf("expired key was not removed")
+	}
+}
+
+func TestMemoryStoreDeleteExpired(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	s := newMemoryStore()
+	s.now = clock.Now
+
+	s.UpsertTTL("a", json.RawMessage(`1`), time.Second)
+	s.UpsertTTL("b", json.RawMessage(`2`), time.Minute)
+	s.Upsert("c", json.RawMessage(`3`))
+
+	clock.Add(time.Second)
+	if n, err := s.DeleteExpired(); n != 1 || err != nil {
+		t.Errorf("DeleteExpired: got %v, %v want 1", n, err)
+	}
+	if _, ok := s.vals["a"]; ok {
+		t.Errorf("expired key was not removed")
+	}
+	if ttl, ok, _ := s.TTL("b"); !ok || ttl != 59*time.Second {
+		t.Errorf("TTL: got %v, %v want 59s", ttl, ok)
+	}
+	if _, ok, _ := s.TTL("c"); ok {
+		t.Errorf("TTL of a key without ttl: got ok")
+	}
+	if ok, _ := s.Delete("a"); ok {
+		t.Errorf("Delete of an expired key: got ok")
+	}
+}
+
+func TestPATCH(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		body     string
+		status   int
+		expected string
+	}{
+		{"merge", "/val/kitty", "{\"age\": 4, \"toys\": {\"mouse\": null, \"yarn\": 1}}", http.StatusOK,
+			"{\"kitty\":{\"age\":4,\"name\":\"tom\",\"toys\":{\"ball\":2,\"yarn\":1}}}"},
+		{"replace non object", "/val/count", "{\"n\": 1}", http.StatusOK,
+			"{\"count\":{\"n\":1}}"},
+		{"replace with non object", "/val/kitty", "[1, 2]", http.StatusOK,
+			"{\"kitty\":[1,2]}"},
+		{"missing key", "/val/gorilla", "{\"a\": 1}", http.StatusNotFound,
+			"{\"error\":{\"code\":\"key_not_found\",\"message\":\"can't find key gorilla\"}}"},
+		{"bad patch", "/val/kitty", "{\"a\":", http.StatusBadRequest,
+			"{\"error\":{\"code\":\"bad_json\",\"message\":\"unexpected EOF\"}}"},
+	}
+
+	handler := newRouter()
+
+	// Store values to patch.
+	req, err := http.NewRequest("POST", "/val", strings.NewReader(
+		"{\"kitty\": {\"name\": \"tom\", \"age\": 3, \"toys\": {\"ball\": 2, \"mouse\": 1}}, \"count\": 7}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("PATCH", tt.path, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the status code is what we expect.
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				tt.name, status, tt.status)
+		}
+
+		// Check the response body is what we expect.
+		if rr.Body.String() != tt.expected {
+			t.Errorf("%s: handler returned unexpected body: got %v want %v",
+				tt.name, rr.Body.String(), tt.expected)
+		}
+	}
+}
+
+func TestPATCHKeepsTTL(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	store := newMemoryStore()
+	store.now = clock.Now
+	store.UpsertTTL("kitty", json.RawMessage(`{"a":1}`), time.Minute)
+	handler := newStoreRouter(store)
+
+	clock.Add(10 * time.Second)
+	req, err := http.NewRequest("PATCH", "/val/kitty", strings.NewReader("{\"b\": 2}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	// Check the remaining time to live did not change.
+	if got := rr.Header().Get(ttlHeader); got != "50" {
+		t.Errorf("wrong %s header: got %q want %q", ttlHeader, got, "50")
+	}
+	if ttl, ok, _ := store.TTL("kitty"); !ok || ttl != 50*time.Second {
+		t.Errorf("TTL: got %v, %v want 50s", ttl, ok)
+	}
+}
+
+// racingStore is a Store that runs a function once, after the first Get.
+type racingStore struct {
+	Store
+	once sync.Once
+	race func()
+}
+
+func (s *racingStore) Get(key string) (json.RawMessage, bool, error) {
+	v, ok, err := s.Store.Get(key)
+	s.once.Do(s.race)
+
+	return v, ok, err
+}
+
+func TestPATCHConcurrent(t *testing.T) {
+	store := newMemoryStore()
+	store.UpsertTTL("kitty", json.RawMessage(`{}`), time.Hour)
+
+	// Check a change between reading and writing the value is not lost.
+	handler := newStoreRouter(&racingStore{Store: store, race: func() {
+		store.CompareAndSwap("kitty", json.RawMessage(`{}`), json.RawMessage(`{"tom":1}`))
+	}})
+	if rr := serve(t, handler, "PATCH", "/val/kitty", "{\"jerry\": 2}", ""); rr.Body.String() != "{\"kitty\":{\"jerry\":2,\"tom\":1}}" {
+		t.Errorf("PATCH lost a concurrent change: got %v", rr.Body.String())
+	}
+
+	// Check concurrent patches are not lost.
+	store.UpsertTTL("kitty", json.RawMessage(`{}`), time.Hour)
+	handler = newStoreRouter(store)
+
+	const n = 20
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rr := serve(t, handler, "PATCH", "/val/kitty", fmt.Sprintf("{\"f%d\": %d}", i, i), "")
+			if rr.Code != http.StatusOK {
+				t.Errorf("PATCH %d: got %v want %v", i, rr.Code, http.StatusOK)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Check no concurrent patch was lost, and the key kept its TTL.
+	val, _, _ := store.Get("kitty")
+	var fields map[string]int
+	if err := json.Unmarshal(val, &fields); err != nil || len(fields) != n {
+		t.Errorf("concurrent patches lost updates: got %s", val)
+	}
+	if _, ok, _ := store.TTL("kitty"); !ok {
+		t.Errorf("concurrent patches lost the TTL of the key")
+	}
+
+	// Check a patch of a deleted key does not create it.
+	store.Delete("kitty")
+	if rr := serve(t, handler, "PATCH", "/val/kitty", "{\"a\": 1}", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("PATCH of a deleted key: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestBulkDelete(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		status   int
+		expected string
+	}{
+		{"batch with misses", "POST", "/val/delete", "[\"a\", \"gorilla\", \"b\", \"a\"]", http.StatusOK,
+			"{\"a\":\"deleted\",\"b\":\"deleted\",\"gorilla\":\"not found\"}"},
+		{"batch of deleted keys", "POST", "/val/delete", "[\"a\"]", http.StatusOK,
+			"{\"a\":\"not found\"}"},
+		{"bad batch", "POST", "/val/delete", "{\"a\": 1}", http.StatusBadRequest,
+			"{\"error\":{\"code\":\"bad_json\",\"message\":\"json: cannot unmarshal object into Go value of type []string\"}}"},
+		{"left values", "GET", "/val", "", http.StatusOK, "{\"c\":3,\"d\":4}"},
+		{"clear without confirm", "DELETE", "/val", "", http.StatusBadRequest,
+			"{\"error\":{\"code\":\"bad_request\",\"message\":\"deleting all keys requires confirm=true\"}}"},
+		{"clear", "DELETE", "/val?confirm=true", "", http.StatusOK, "{\"deleted\":2}"},
+		{"cleared values", "GET", "/val", "", http.StatusOK, "{}"},
+	}
+
+	handler := newRouter()
+
+	// Store values to delete.
+	req, err := http.NewRequest("POST", "/val", strings.NewReader("{\"a\": 1, \"b\": 2, \"c\": 3, \"d\": 4}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the status code is what we expect.
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				tt.name, status, tt.status)
+		}
+
+		// Check the response body is what we expect.
+		if rr.Body.String() != tt.expected {
+			t.Errorf("%s: handler returned unexpected body: got %v want %v",
+				tt.name, rr.Body.String(), tt.expected)
+		}
+	}
+}
+
+func TestPagination(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		status   int
+		expected string
+	}{
+		{"first page", "/val?limit=2", http.StatusOK,
+			"{\"items\":{\"a\":1,\"b\":2},\"next_cursor\":\"Yg\"}"},
+		{"next page", "/val?limit=2&cursor=Yg", http.StatusOK,
+			"{\"items\":{\"c\":3,\"kitty:1\":4},\"next_cursor\":\"a2l0dHk6MQ\"}"},
+		{"limit larger than the left keys", "/val?limit=10&cursor=a2l0dHk6MQ", http.StatusOK,
+			"{\"items\":{\"kitty:2\":5}}"},
+		{"cursor at a deleted key", "/val?limit=2&cursor=YWI", http.StatusOK,
+			"{\"items\":{\"b\":2,\"c\":3},\"next_cursor\":\"Yw\"}"},
+		{"prefix", "/val?prefix=kitty:", http.StatusOK,
+			"{\"items\":{\"kitty:1\":4,\"kitty:2\":5}}"},
+		{"no matching keys", "/val?prefix=gorilla", http.StatusOK,
+			"{\"items\":{}}"},
+		{"bad limit", "/val?limit=0", http.StatusBadRequest,
+			"{\"error\":{\"code\":\"bad_request\",\"message\":\"limit must be between 1 and 1000\"}}"},
+		{"bad cursor", "/val?cursor=!", http.StatusBadRequest,
+			"{\"error\":{\"code\":\"bad_request\",\"message\":\"invalid cursor\"}}"},
+		{"no pagination", "/val", http.StatusOK,
+			"{\"a\":1,\"b\":2,\"c\":3,\"kitty:1\":4,\"kitty:2\":5}"},
+	}
+
+	handler := newRouter()
+
+	// Store values to page through.
+	req, err := http.NewRequest("POST", "/val", strings.NewReader("{\"a\": 1, \"b\": 2, \"c\": 3, \"kitty:1\": 4, \"kitty:2\": 5}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the status code is what we expect.
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				tt.name, status, tt.status)
+		}
+
+		// Check the response body is what we expect.
+		if rr.Body.String() != tt.expected {
+			t.Errorf("%s: handler returned unexpected body: got %v want %v",
+				tt.name, rr.Body.String(), tt.expected)
+		}
+	}
+}
+
+// testListPage checks the ListPage method of a store.
+func testListPage(t *testing.T, s Store) {
+	for _, k := range []string{"a", "b", "c", "kitty:1", "kitty:2"} {
+		s.Upsert(k, json.RawMessage(`1`))
+	}
+
+	tests := []struct {
+		prefix string
+		cursor string
+		limit  int
+		keys   string
+		next   string
+	}{
+		{"", "", 2, "a,b", "b"},
+		{"", "b", 2, "c,kitty:1", "kitty:1"},
+		{"", "kitty:1", 2, "kitty:2", ""},
+		{"", "ab", 0, "b,c,kitty:1,kitty:2", ""},
+		{"kitty:", "", 1, "kitty:1", "kitty:1"},
+		{"kitty:", "kitty:1", 1, "kitty:2", ""},
+		{"gorilla", "", 0, "", ""},
+	}
+
+	for _, tt := range tests {
+		page, next, err := s.ListPage(tt.prefix, tt.cursor, tt.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys := make([]string, 0, len(page))
+		for k := range page {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		if got := strings.Join(keys, ","); got != tt.keys || next != tt.next {
+			t.Errorf("ListPage(%q, %q, %d): got %v, %q want %v, %q",
+				tt.prefix, tt.cursor, tt.limit, got, next, tt.keys, tt.next)
+		}
+	}
+}
+
+func TestMemoryStoreListPage(t *testing.T) {
+	testListPage(t, newMemoryStore())
+}
+
+// testDeletePrefix checks a store removes the keys with a prefix, and only
+// them.
+func testDeletePrefix(t *testing.T, s Store) {
+	for _, k := range []string{"app1", "app1/", "app1/db/a", "app1/db/b", "app1/z", "app10", "app2/a"} {
+		s.Upsert(k, json.RawMessage(`1`))
+	}
+
+	tests := []struct {
+		prefix  string
+		deleted string
+		left    string
+	}{
+		{"app1/db/", "app1/db/a,app1/db/b", "app1,app1/,app1/z,app10,app2/a"},
+		{"app1/", "app1/,app1/z", "app1,app10,app2/a"},
+		{"app3/", "", "app1,app10,app2/a"},
+		{"app", "app1,app10,app2/a", ""},
+	}
+
+	for _, tt := range tests {
+		deleted, err := s.DeletePrefix(tt.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(deleted, ","); got != tt.deleted {
+			t.Errorf("DeletePrefix(%q): got %v want %v", tt.prefix, got, tt.deleted)
+		}
+
+		// Check the prefix index lists the keys that are left.
+		page, _, _ := s.ListPage("", "", 0)
+		keys := make([]string, 0, len(page))
+		for k := range page {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		if got := strings.Join(keys, ","); got != tt.left {
+			t.Errorf("DeletePrefix(%q): left %v want %v", tt.prefix, got, tt.left)
+		}
+	}
+}
+
+func TestMemoryStoreDeletePrefix(t *testing.T) {
+	testDeletePrefix(t, newMemoryStore())
+
+	// Check expired keys are removed, and not reported.
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	s := newMemoryStore()
+	s.now = clock.Now
+	s.UpsertTTL("a/1", json.RawMessage(`1`), time.Second)
+	s.Upsert("a/2", json.RawMessage(`2`))
+	clock.Add(time.Second)
+	if deleted, err := s.DeletePrefix("a/"); len(deleted) != 1 || deleted[0] != "a/2" || err != nil {
+		t.Errorf("DeletePrefix: got %v, %v want [a/2]", deleted, err)
+	}
+	if n, _ := s.DeleteExpired(); n != 0 {
+		t.Errorf("DeletePrefix left %d expired keys", n)
+	}
+}
+
+func TestDeletePrefix(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		status   int
+		expected string
+	}{
+		{"without confirm", "DELETE", "/v1/val?prefix=app1/", http.StatusBadRequest,
+			"{\"error\":{\"code\":\"bad_request\",\"message\":\"deleting keys with a prefix requires confirm=true\"}}"},
+		{"prefix", "DELETE", "/v1/val?prefix=app1/&confirm=true", http.StatusOK,
+			"{\"deleted\":2,\"keys\":[\"app1/a\",\"app1/db/b\"]}"},
+		{"missing prefix", "DELETE", "/v1/val?prefix=app1/&confirm=true", http.StatusOK,
+			"{\"deleted\":0,\"keys\":[]}"},
+		{"reserved prefix", "DELETE", "/v1/val?prefix=%00&confirm=true", http.StatusOK,
+			"{\"deleted\":0,\"keys\":[]}"},
+		{"left values", "GET", "/v1/val?prefix=app", http.StatusOK,
+			"{\"items\":{\"app10\":3,\"app2/a\":4}}"},
+		{"namespace values", "GET", "/v1/ns/cats/val", http.StatusOK, "{\"app1\":5}"},
+	}
+
+	h := newHandler(newMemoryStore())
+	handler := newHandlerRouter(h)
+	serve(t, handler, "POST", "/v1/val", "{\"app1/a\": 1, \"app1/db/b\": 2, \"app10\": 3, \"app2/a\": 4}", "")
+	serve(t, handler, "PUT", "/v1/ns/cats/val/app1", "5", "")
+
+	for _, tt := range tests {
+		rr := serve(t, handler, tt.method, tt.path, "", "")
+
+		// Check the status code is what we expect.
+		if rr.Code != tt.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tt.name, rr.Code, tt.status)
+		}
+
+		// Check the response body is what we expect.
+		if rr.Body.String() != tt.expected {
+			t.Errorf("%s: handler returned unexpected body: got %v want %v", tt.name, rr.Body.String(), tt.expected)
+		}
+	}
+
+	// Check watchers get an event of every deleted key.
+	w, events, err := h.hub.subscribe("", "", 5, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.hub.unsubscribe(w)
+	if len(events) != 2 || events[0].Key != "app1/a" || events[1].Key != "app1/db/b" || events[1].Type != eventDeleted {
+		t.Errorf("unexpected events: %+v", events)
+	}
+}
+
+func TestDeletePrefixTruncated(t *testing.T) {
+	store := newMemoryStore()
+	for i := 0; i < maxDeletedKeys+2; i++ {
+		store.Upsert(fmt.Sprintf("k/%04d", i), json.RawMessage(`1`))
+	}
+
+	// Check the deleted keys are capped, with their total.
+	var got prefixDeleteResult
+	rr := serve(t, newStoreRouter(store), "DELETE", "/v1/val?prefix=k/&confirm=true", "", "")
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Deleted != maxDeletedKeys+2 || len(got.Keys) != maxDeletedKeys || !got.Truncated || got.Keys[0] != "k/0000" {
+		t.Errorf("unexpected result: deleted %d, %d keys, truncated %v", got.Deleted, len(got.Keys), got.Truncated)
+	}
+}
+
+// serve sends a request to handler, with an optional If-None-Match header.
+func serve(t *testing.T, handler http.Handler, method, path, body, ifNoneMatch string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", ifNoneMatch)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	return rr
+}
+
+func TestHEAD(t *testing.T) {
+	handler := newRouter()
+	serve(t, handler, "POST", "/val", "{\"kitty\": {\"name\": \"tom\", \"lives\": 9}, "+
+		"\"html\": \"<b>cats & dogs</b>\", \"lines\": \"a\u2028b\u2029\", \"喵\": [\"喵\", null]}", "")
+	serve(t, handler, "PUT", "/val/expiring?ttl=1m", "1", "")
+	serve(t, handler, "PUT", "/ns/cats/val/tom", "1", "")
+
+	// Check HEAD responses of keys have the headers of GET responses.
+	for _, key := range []string{"kitty", "html", "lines", "喵", "expiring", "dog"} {
+		get := serve(t, handler, "GET", "/val/"+key, "", "")
+		head := serve(t, handler, "HEAD", "/val/"+key, "", "")
+
+		if head.Code != get.Code || head.Body.Len() != 0 {
+			t.Errorf("HEAD %s: got %v with a %d bytes body want %v without a body",
+				key, head.Code, head.Body.Len(), get.Code)
+		}
+		length := ""
+		if get.Code == http.StatusOK {
+			length = fmt.Sprint(get.Body.Len())
+		}
+		if got := head.Header().Get("Content-Length"); got != length {
+			t.Errorf("HEAD %s: got Content-Length %q want %q", key, got, length)
+		}
+		for _, header := range []string{"ETag", "Content-Type", ttlHeader} {
+			if got, want := head.Header().Get(header), get.Header().Get(header); got != want {
+				t.Errorf("HEAD %s: got %s %q want %q", key, header, got, want)
+			}
+		}
+	}
+
+	// Check HEAD responses of all the values have the count of keys, and
+	// the ETag of GET responses.
+	get := serve(t, handler, "GET", "/val", "", "")
+	tests := []struct {
+		name        string
+		path        string
+		ifNoneMatch string
+		status      int
+		count       string
+	}{
+		{"all values", "/val", "", http.StatusOK, "5"},
+		{"not modified", "/val", get.Header().Get("ETag"), http.StatusNotModified, "5"},
+		{"namespace", "/ns/cats/val", "", http.StatusOK, "1"},
+		{"namespace key", "/ns/cats/val/tom", "", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		rr := serve(t, handler, "HEAD", tt.path, "", tt.ifNoneMatch)
+		if rr.Code != tt.status || rr.Body.Len() != 0 {
+			t.Errorf("%s: got %v with a %d bytes body want %v without a body",
+				tt.name, rr.Code, rr.Body.Len(), tt.status)
+		}
+		if got := rr.Header().Get(countHeader); got != tt.count {
+			t.Errorf("%s: got %s %q want %q", tt.name, countHeader, got, tt.count)
+		}
+	}
+	if rr := serve(t, handler, "HEAD", "/val", "", ""); rr.Header().Get("ETag") != get.Header().Get("ETag") {
+		t.Errorf("HEAD /val: got ETag %q want %q", rr.Header().Get("ETag"), get.Header().Get("ETag"))
+	}
+
+	// Check servers send the Content-Length of HEAD responses.
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	resp, err := http.Head(server.URL + "/v1/val/kitty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ContentLength != int64(len("{\"kitty\":{\"lives\":9,\"name\":\"tom\"}}")) &&
+		resp.ContentLength != int64(len("{\"kitty\":{\"name\":\"tom\",\"lives\":9}}")) {
+		t.Errorf("HEAD over HTTP: got Content-Length %d", resp.ContentLength)
+	}
+}
+
+func TestETag(t *testing.T) {
+	handler := newRouter()
+
+	// Store a value, and check GET returns the same ETag.
+	rr := serve(t, handler, "PUT", "/val/kitty", "{\"name\": \"cat\"}", "")
+	etag := rr.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("PUT returned no ETag")
+	}
+	rr = serve(t, handler, "GET", "/val/kitty", "", "")
+	if got := rr.Header().Get("ETag"); got != etag {
+		t.Errorf("GET returned wrong ETag: got %v want %v", got, etag)
+	}
+
+	// Check a matching If-None-Match gets a 304 without a body.
+	for _, header := range []string{etag, "W/" + etag, "\"other\", " + etag, "*"} {
+		rr = serve(t, handler, "GET", "/val/kitty", "", header)
+		if rr.Code != http.StatusNotModified || rr.Body.Len() != 0 {
+			t.Errorf("If-None-Match %s: got %v %q want 304 without a body", header, rr.Code, rr.Body.String())
+		}
+	}
+	rr = serve(t, handler, "GET", "/val/kitty", "", "\"other\"")
+	if rr.Code != http.StatusOK || rr.Body.String() != "{\"kitty\":{\"name\":\"cat\"}}" {
+		t.Errorf("stale If-None-Match: got %v %q want 200 with the value", rr.Code, rr.Body.String())
+	}
+
+	// Check PATCH changes the ETag of the value.
+	rr = serve(t, handler, "PATCH", "/val/kitty", "{\"age\": 2}", "")
+	if got := rr.Header().Get("ETag"); got == "" || got == etag {
+		t.Errorf("PATCH returned wrong ETag: got %v want a new ETag", got)
+	}
+	rr = serve(t, handler, "GET", "/val/kitty", "", etag)
+	if rr.Code != http.StatusOK {
+		t.Errorf("GET after PATCH returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+}
+
+func TestCollectionETag(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	store := newMemoryStore()
+	store.now = clock.Now
+	handler := newStoreRouter(store)
+
+	mutations := []struct {
+		name    string
+		advance time.Duration
+		method  string
+		path    string
+		body    string
+	}{
+		{"post", 0, "POST", "/val", "{\"a\": 1, \"b\": 2, \"d\": 4}"},
+		{"put", 0, "PUT", "/val/c?ttl=1m", "3"},
+		{"patch", 0, "PATCH", "/val/a", "{\"x\": 1}"},
+		{"delete", 0, "DELETE", "/val/b", ""},
+		{"expire", time.Hour, "", "", ""},
+		{"bulk delete", 0, "POST", "/val/delete", "[\"a\"]"},
+		{"clear", 0, "DELETE", "/val?confirm=true", ""},
+	}
+
+	etag := serve(t, handler, "GET", "/val", "", "").Header().Get("ETag")
+	for _, m := range mutations {
+		clock.Add(m.advance)
+
+		var rr *httptest.ResponseRecorder
+		if m.method != "" {
+			rr = serve(t, handler, m.method, m.path, m.body, "")
+		}
+
+		// Check the collection ETag changed, and the old one is stale.
+		rr2 := serve(t, handler, "GET", "/val", "", etag)
+		got := rr2.Header().Get("ETag")
+		if got == "" || got == etag || rr2.Code != http.StatusOK {
+			t.Errorf("%s: GET returned %v with ETag %v, want 200 with a new ETag", m.name, rr2.Code, got)
+		}
+		etag = got
+
+		// Check collection mutations return the new collection ETag.
+		if rr != nil && m.method != "PUT" && m.method != "PATCH" && rr.Header().Get("ETag") != etag {
+			t.Errorf("%s: returned wrong ETag: got %v want %v", m.name, rr.Header().Get("ETag"), etag)
+		}
+
+		// Check the new ETag gets a 304 without a body.
+		rr2 = serve(t, handler, "GET", "/val", "", etag)
+		if rr2.Code != http.StatusNotModified || rr2.Body.Len() != 0 {
+			t.Errorf("%s: got %v %q want 304 without a body", m.name, rr2.Code, rr2.Body.String())
+		}
+	}
+
+	// Check pages use the collection ETag.
+	rr := serve(t, handler, "GET", "/val?limit=1", "", etag)
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("page: got %v want 304", rr.Code)
+	}
+}
+
+func TestIncr(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		body     string
+		status   int
+		expected string
+	}{
+		{"create", "/val/count/incr", "", http.StatusOK, "{\"count\":1}"},
+		{"by", "/val/count/incr", "{\"by\": 5}", http.StatusOK, "{\"count\":6}"},
+		{"negative", "/val/count/incr", "{\"by\": -10}", http.StatusOK, "{\"count\":-4}"},
+		{"large", "/val/big/incr", "{\"by\": 9007199254740993}", http.StatusOK,
+			"{\"big\":9007199254740993}"},
+		{"large again", "/val/big/incr", "", http.StatusOK, "{\"big\":9007199254740994}"},
+		{"max", "/val/max/incr", "{\"by\": 9223372036854775807}", http.StatusOK,
+			"{\"max\":9223372036854775807}"},
+		{"overflow", "/val/max/incr", "", http.StatusConflict,
+			"{\"error\":{\"code\":\"conflict\",\"message\":\"can't increment key max: value overflows a 64-bit integer\"}}"},
+		{"not a number", "/val/kitty/incr", "", http.StatusConflict,
+			"{\"error\":{\"code\":\"conflict\",\"message\":\"can't increment key kitty: value is not an integer\"}}"},
+		{"not an integer", "/val/pi/incr", "", http.StatusConflict,
+			"{\"error\":{\"code\":\"conflict\",\"message\":\"can't increment key pi: value is not an integer\"}}"},
+		{"fractional by", "/val/count/incr", "{\"by\": 1.5}", http.StatusBadRequest,
+			"{\"error\":{\"code\":\"bad_request\",\"message\":\"by must be a 64-bit integer, got 1.5\"}}"},
+		{"bad body", "/val/count/incr", "{\"by\": true}", http.StatusBadRequest,
+			"{\"error\":{\"code\":\"bad_json\",\"message\":\"json: cannot unmarshal bool into Go value of type json.Number\"}}"},
+	}
+
+	handler := newRouter()
+
+	// Store values that can't be incremented.
+	req, err := http.NewRequest("POST", "/val", strings.NewReader("{\"kitty\": \"cat\", \"pi\": 3.14}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	for _, tt := range tests {
+		rr := serve(t, handler, "POST", tt.path, tt.body, "")
+
+		// Check the status code is what we expect.
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				tt.name, status, tt.status)
+		}
+
+		// Check the response body is what we expect.
+		if rr.Body.String() != tt.expected {
+			t.Errorf("%s: handler returned unexpected body: got %v want %v",
+				tt.name, rr.Body.String(), tt.expected)
+		}
+	}
+
+	// Check the stored value keeps its precision.
+	rr := serve(t, handler, "GET", "/val/big", "", "")
+	if rr.Body.String() != "{\"big\":9007199254740994}" {
+		t.Errorf("GET returned unexpected body: got %v", rr.Body.String())
+	}
+}
+
+// testConcurrentIncr checks parallel increments of a store are atomic.
+func testConcurrentIncr(t *testing.T, store Store) {
+	handler := newStoreRouter(store)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			// Odd requests add 3, even requests subtract 1.
+			body := "{\"by\": -1}"
+			if i%2 == 1 {
+				body = "{\"by\": 3}"
+			}
+			rr := serve(t, handler, "POST", "/val/count/incr", body, "")
+			if rr.Code != http.StatusOK {
+				t.Errorf("incr returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if val, _, _ := store.Get("count"); string(val) != "100" {
+		t.Errorf("count after 100 parallel increments: got %s want 100", val)
+	}
+}
+
+func TestMemoryStoreConcurrentIncr(t *testing.T) {
+	testConcurrentIncr(t, newMemoryStore())
+}
+
+func TestIncrKeepsTTL(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	store := newMemoryStore()
+	store.now = clock.Now
+
+	store.UpsertTTL("count", json.RawMessage(`1`), time.Minute)
+	if n, err := store.Incr("count", 1); n != 2 || err != nil {
+		t.Errorf("Incr: got %v, %v want 2", n, err)
+	}
+	if ttl, ok, _ := store.TTL("count"); !ok || ttl != time.Minute {
+		t.Errorf("TTL: got %v, %v want 1m", ttl, ok)
+	}
+
+	// Check an expired key is created again at 0.
+	clock.Add(time.Hour)
+	if n, err := store.Incr("count", 1); n != 1 || err != nil {
+		t.Errorf("Incr of an expired key: got %v, %v want 1", n, err)
+	}
+	if _, ok, _ := store.TTL("count"); ok {
+		t.Errorf("TTL of a recreated key: got a ttl, want none")
+	}
+}
+
+func TestCAS(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		body     string
+		status   int
+		expected string
+	}{
+		{"create if absent", "/val/lock/cas", "{\"new\": {\"owner\": \"kitty\"}}", http.StatusOK,
+			"{\"lock\":{\"owner\":\"kitty\"}}"},
+		{"create existing", "/val/lock/cas", "{\"old\": null, \"new\": {\"owner\": \"gorilla\"}}", http.StatusConflict,
+			"{\"error\":{\"code\":\"conflict\",\"message\":\"key lock already exists\",\"details\":{\"current\":{\"owner\":\"kitty\"}}}}"},
+		{"mismatch", "/val/lock/cas", "{\"old\": {\"owner\": \"gorilla\"}, \"new\": null}", http.StatusConflict,
+			"{\"error\":{\"code\":\"conflict\",\"message\":\"value of key lock does not match old\",\"details\":{\"current\":{\"owner\":\"kitty\"}}}}"},
+		{"swap", "/val/lock/cas", "{\"old\": { \"owner\" : \"kitty\" }, \"new\": {\"owner\": \"gorilla\", \"n\": 1}}", http.StatusOK,
+			"{\"lock\":{\"owner\":\"gorilla\",\"n\":1}}"},
+		{"deep equal", "/val/lock/cas", "{\"old\": {\"n\": 1.0, \"owner\": \"gorilla\"}, \"new\": 2}", http.StatusOK,
+			"{\"lock\":2}"},
+		{"missing key", "/val/gorilla/cas", "{\"old\": 1, \"new\": 2}", http.StatusConflict,
+			"{\"error\":{\"code\":\"conflict\",\"message\":\"value of key gorilla does not match old\"}}"},
+		{"missing new", "/val/lock/cas", "{\"old\": 2}", http.StatusBadRequest,
+			"{\"error\":{\"code\":\"bad_request\",\"message\":\"new is required\"}}"},
+	}
+
+	handler := newRouter()
+	for _, tt := range tests {
+		rr := serve(t, handler, "POST", tt.path, tt.body, "")
+
+		// Check the status code is what we expect.
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				tt.name, status, tt.status)
+		}
+
+		// Check the response body is what we expect.
+		if rr.Body.String() != tt.expected {
+			t.Errorf("%s: handler returned unexpected body: got %v want %v",
+				tt.name, rr.Body.String(), tt.expected)
+		}
+	}
+}
+
+func TestJSONEqual(t *testing.T) {
+	tests := []struct {
+		a, b  string
+		equal bool
+	}{
+		{`{"a":1,"b":[1,"x",null]}`, `{"b":[1,"x",null],"a":1}`, true},
+		{`1`, `1.0`, true},
+		{`1e2`, `100`, true},
+		{`9007199254740993`, `9007199254740992`, false},
+		{`[1,2]`, `[2,1]`, false},
+		{`{"a":1}`, `{"a":1,"b":2}`, false},
+		{`"1"`, `1`, false},
+		{`null`, `false`, false},
+	}
+
+	for _, tt := range tests {
+		if got := jsonEqual(json.RawMessage(tt.a), json.RawMessage(tt.b)); got != tt.equal {
+			t.Errorf("jsonEqual(%s, %s): got %v want %v", tt.a, tt.b, got, tt.equal)
+		}
+	}
+}
+
+// testConcurrentCAS checks exactly one of parallel compare and swaps of
+// a store succeeds.
+func testConcurrentCAS(t *testing.T, store Store) {
+	handler := newStoreRouter(store)
+
+	for _, body := range []string{"{\"new\": %d}", "{\"old\": 0, \"new\": %d}"} {
+		store.Delete("lock")
+		if strings.Contains(body, "old") {
+			store.Upsert("lock", json.RawMessage(`0`))
+		}
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		won := 0
+		for i := 1; i <= 50; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				rr := serve(t, handler, "POST", "/val/lock/cas", fmt.Sprintf(body, i), "")
+				if rr.Code == http.StatusOK {
+					mu.Lock()
+					won++
+					mu.Unlock()
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		if won != 1 {
+			t.Errorf("%s: %d parallel swaps succeeded, want 1", body, won)
+		}
+	}
+}
+
+func TestMemoryStoreConcurrentCAS(t *testing.T) {
+	testConcurrentCAS(t, newMemoryStore())
+}
+
+func TestQuery(t *testing.T) {
+	tooMany, _ := json.Marshal(map[string][]string{"keys": make([]string, maxQueryKeys+1)})
+
+	tests := []struct {
+		name     string
+		body     string
+		status   int
+		expected string
+	}{
+		{"found and missing", "{\"keys\": [\"kitty\", \"gorilla\", \"big\"]}", http.StatusOK,
+			"{\"found\":{\"big\":9007199254740993,\"kitty\":{\"name\":\"cat\",\"lives\":9}},\"missing\":[\"gorilla\"]}"},
+		{"empty", "{\"keys\": []}", http.StatusOK, "{\"found\":{},\"missing\":[]}"},
+		{"duplicates", "{\"keys\": [\"gorilla\", \"kitty\", \"gorilla\", \"kitty\"]}", http.StatusOK,
+			"{\"found\":{\"kitty\":{\"name\":\"cat\",\"lives\":9}},\"missing\":[\"gorilla\"]}"},
+		{"escaped keys", "{\"keys\": [\"a/b\", \"kitty cat\", \"100%\", \"?x=1\", \"#\"]}", http.StatusOK,
+			"{\"found\":{\"100%\":3,\"?x=1\":4,\"a/b\":1,\"kitty cat\":2},\"missing\":[\"#\"]}"},
+		{"too many keys", string(tooMany), http.StatusBadRequest,
+			"{\"error\":{\"code\":\"bad_request\",\"message\":\"too many keys, at most 1000 keys can be queried\"}}"},
+		{"bad body", "{\"keys\": \"kitty\"}", http.StatusBadRequest,
+			"{\"error\":{\"code\":\"bad_json\",\"message\":\"json: cannot unmarshal string into Go struct field .keys of type []string\"}}"},
+	}
+
+	handler := newRouter()
+
+	// Store values, keys with special characters are escaped in paths.
+	req, err := http.NewRequest("POST", "/val", strings.NewReader(
+		"{\"kitty\": {\"name\": \"cat\", \"lives\": 9}, \"big\": 9007199254740993}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	for i, path := range []string{"/val/a%2Fb", "/val/kitty%20cat", "/val/100%25", "/val/%3Fx=1"} {
+		serve(t, handler, "PUT", path, fmt.Sprint(i+1), "")
+	}
+
+	for _, tt := range tests {
+		rr := serve(t, handler, "POST", "/val/query", tt.body, "")
+
+		// Check the status code is what we expect.
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				tt.name, status, tt.status)
+		}
+
+		// Check the response body is what we expect.
+		if rr.Body.String() != tt.expected {
+			t.Errorf("%s: handler returned unexpected body: got %v want %v",
+				tt.name, rr.Body.String(), tt.expected)
+		}
+	}
+}
+
+// headerCounter is a response recorder counting WriteHeader calls.
+type headerCounter struct {
+	*httptest.ResponseRecorder
+	writes int
+}
+
+func (c *headerCounter) WriteHeader(code int) {
+	c.writes++
+	c.ResponseRecorder.WriteHeader(code)
+}
+
+// pathPrefixes are the prefixes of the legacy and the versioned paths.
+var pathPrefixes = []string{"", apiVersion}
+
+// apiScenario is a sequence of requests using every API route.
+var apiScenario = []struct {
+	method string
+	path   string
+	body   string
+	status int
+}{
+	{"GET", "/val", "", http.StatusOK},
+	{"PUT", "/val/kitty", "\"cat\"", http.StatusCreated},
+	{"PUT", "/val/kitty?ttl=1h", "\"cat\"", http.StatusOK},
+	{"GET", "/val/kitty", "", http.StatusOK},
+	{"GET", "/val/gorilla", "", http.StatusNotFound},
+	{"POST", "/val", "{\"a\": 1, \"b\": 2}", http.StatusCreated},
+	{"POST", "/val", "[", http.StatusBadRequest},
+	{"GET", "/val?limit=1", "", http.StatusOK},
+	{"GET", "/val?limit=1&cursor=YQ", "", http.StatusOK},
+	{"PATCH", "/val/kitty", "{\"name\": \"tom\"}", http.StatusOK},
+	{"POST", "/val/c/incr", "{\"by\": 5}", http.StatusOK},
+	{"POST", "/val/c/cas", "{\"old\": 5, \"new\": 6}", http.StatusOK},
+	{"POST", "/val/c/cas", "{\"old\": 7, \"new\": 8}", http.StatusConflict},
+	{"POST", "/val/query", "{\"keys\": [\"a\", \"c\"]}", http.StatusOK},
+	{"DELETE", "/val/b", "", http.StatusOK},
+	{"DELETE", "/val/b", "", http.StatusNotFound},
+	{"POST", "/val/delete", "[\"a\", \"b\"]", http.StatusOK},
+	{"PUT", "/ns/cats/val/tom", "1", http.StatusCreated},
+	{"PUT", "/ns/cats/val/felix", "2", http.StatusCreated},
+	{"GET", "/ns/cats/val/tom", "", http.StatusOK},
+	{"GET", "/ns/cats/val", "", http.StatusOK},
+	{"GET", "/ns", "", http.StatusOK},
+	{"DELETE", "/ns/cats/val/tom", "", http.StatusOK},
+	{"DELETE", "/ns/cats", "", http.StatusOK},
+	{"DELETE", "/val", "", http.StatusBadRequest},
+	{"DELETE", "/val?confirm=true", "", http.StatusOK},
+	{"GET", "/val", "", http.StatusOK},
+	{"GET", "/stats", "", http.StatusOK},
+}
+
+func TestAPIVersions(t *testing.T) {
+	var responses [][]*httptest.ResponseRecorder
+	for _, prefix := range pathPrefixes {
+		handler := newRouter()
+
+		var rrs []*httptest.ResponseRecorder
+		for _, tt := range apiScenario {
+			rr := serve(t, handler, tt.method, prefix+tt.path, tt.body, "")
+			rrs = append(rrs, rr)
+
+			// Check the status code is what we expect.
+			if rr.Code != tt.status {
+				t.Errorf("%s %s: handler returned wrong status code: got %v want %v",
+					tt.method, prefix+tt.path, rr.Code, tt.status)
+			}
+
+			// Check only legacy paths are deprecated, linking to /v1.
+			deprecation, link := rr.Header().Get("Deprecation"), rr.Header().Get("Link")
+			successor := "<" + apiVersion + tt.path + ">; rel=\"successor-version\""
+			if prefix == "" && (deprecation != "true" || link != successor) {
+				t.Errorf("%s %s: handler returned Deprecation %q, Link %q want true, %q",
+					tt.method, tt.path, deprecation, link, successor)
+			}
+			if prefix != "" && (deprecation != "" || link != "") {
+				t.Errorf("%s %s: handler returned Deprecation %q, Link %q want none",
+					tt.method, prefix+tt.path, deprecation, link)
+			}
+		}
+		responses = append(responses, rrs)
+	}
+
+	// Check both path families respond the same, stats have the uptime.
+	legacy, v1 := responses[0], responses[1]
+	for i, tt := range apiScenario {
+		if tt.path != "/stats" && legacy[i].Body.String() != v1[i].Body.String() {
+			t.Errorf("%s %s: legacy and v1 responses differ: %s and %s",
+				tt.method, tt.path, legacy[i].Body.String(), v1[i].Body.String())
+		}
+	}
+}
+
+func TestDisableLegacy(t *testing.T) {
+	c, err := quietConfig([]string{"-disable-legacy"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHandler(newMemoryStore())
+	h.disableLegacy = c.DisableLegacy
+	handler := newHandlerRouter(h)
+
+	// Check legacy paths are not found, and versioned paths and health
+	// probes are served.
+	tests := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{"PUT", "/val/kitty", http.StatusNotFound},
+		{"GET", "/val", http.StatusNotFound},
+		{"GET", "/ns", http.StatusNotFound},
+		{"PUT", "/v1/val/kitty", http.StatusCreated},
+		{"GET", "/v1/val/kitty", http.StatusOK},
+		{"GET", "/livez", http.StatusOK},
+		{"GET", "/readyz", http.StatusOK},
+	}
+	for _, tt := range tests {
+		rr := serve(t, handler, tt.method, tt.path, "1", "")
+		if rr.Code != tt.status {
+			t.Errorf("%s %s: handler returned wrong status code: got %v want %v",
+				tt.method, tt.path, rr.Code, tt.status)
+		}
+	}
+}
+
+func TestContentType(t *testing.T) {
+	for _, prefix := range pathPrefixes {
+		testContentType(t, prefix)
+	}
+}
+
+// testContentType checks the content type of the paths under prefix.
+func testContentType(t *testing.T, prefix string) {
+	handler := newRouter()
+	serve(t, handler, "PUT", prefix+"/val/kitty", "\"cat\"", "")
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"GET", "/val", "", http.StatusOK},
+		{"GET", "/val/kitty", "", http.StatusOK},
+		{"GET", "/val/gorilla", "", http.StatusNotFound},
+		{"GET", "/val?limit=1", "", http.StatusOK},
+		{"GET", "/gorilla", "", http.StatusNotFound},
+		{"POST", "/val", "{\"a\": 1}", http.StatusCreated},
+		{"POST", "/val", "{\"a\": 2}", http.StatusOK},
+		{"POST", "/val", "[", http.StatusBadRequest},
+		{"PUT", "/val/b", "1", http.StatusCreated},
+		{"PUT", "/val/b", "2", http.StatusOK},
+		{"PATCH", "/val/kitty", "{\"name\": \"tom\"}", http.StatusOK},
+		{"POST", "/val/c/incr", "", http.StatusOK},
+		{"POST", "/val/c/cas", "{\"old\": 7, \"new\": 8}", http.StatusConflict},
+		{"POST", "/val/query", "{\"keys\": [\"a\"]}", http.StatusOK},
+		{"DELETE", "/val/b", "", http.StatusOK},
+		{"POST", "/val/delete", "[\"a\"]", http.StatusOK},
+		{"GET", "/ns", "", http.StatusOK},
+		{"DELETE", "/val?confirm=true", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		tt.path = prefix + tt.path
+		req, err := http.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := &headerCounter{ResponseRecorder: httptest.NewRecorder()}
+		handler.ServeHTTP(rr, req)
+
+		// Check the status code is what we expect, and written once.
+		if rr.Code != tt.status || rr.writes > 1 {
+			t.Errorf("%s %s: handler returned status code %v, %d times want %v once",
+				tt.method, tt.path, rr.Code, rr.writes, tt.status)
+		}
+
+		// Check the content type is JSON.
+		if got := rr.Header().Get("Content-Type"); got != jsonContentType {
+			t.Errorf("%s %s: handler returned Content-Type %q want %q",
+				tt.method, tt.path, got, jsonContentType)
+		}
+	}
+}
+
+func TestMissingRouteVar(t *testing.T) {
+	h := newHandler(newMemoryStore())
+
+	// Check handlers called without a ":key" route parameter write one error.
+	for _, handle := range []func(http.ResponseWriter, *http.Request){h.putVal, h.deleteVal} {
+		req, err := http.NewRequest("PUT", "/val", strings.NewReader("1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := &headerCounter{ResponseRecorder: httptest.NewRecorder()}
+		handle(rr, req)
+
+		if rr.Code != http.StatusInternalServerError || rr.writes != 1 {
+			t.Errorf("handler returned status code %v, %d times want %v once",
+				rr.Code, rr.writes, http.StatusInternalServerError)
+		}
+		if rr.Body.String() != "{\"error\":{\"code\":\"internal\",\"message\":\"can't get key\"}}" {
+			t.Errorf("handler returned unexpected body: got %v", rr.Body.String())
+		}
+	}
+
+	// Check nothing was stored under an empty key.
+	if vals, _ := h.store.List(); len(vals) != 0 {
+		t.Errorf("List: got %v want no keys", vals)
+	}
+}
+
+func TestErrorEscaping(t *testing.T) {
+	handler := newRouter()
+
+	// The decoder errors have a quote, e.g. invalid character '"' after ...
+	for _, tt := range []struct{ method, path string }{{"POST", "/val"}, {"PUT", "/val/kitty"}} {
+		rr := serve(t, handler, tt.method, tt.path, "{\"a\": 1 \"b\\\\\": 2}", "")
+
+		// Check the status code is what we expect.
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				tt.path, status, http.StatusBadRequest)
+		}
+
+		// Check the error is valid JSON, and keeps the quote.
+		var body apiError
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: handler returned invalid JSON %s: %v", tt.path, rr.Body.String(), err)
+		}
+		if !strings.Contains(body.Error.Message, "'\"'") || body.Error.Code != errCodeBadJSON {
+			t.Errorf("%s: handler returned unexpected error: got %+v", tt.path, body)
+		}
+	}
+}
+
+// startRun runs the server on a random port until ctx is done, returning its
+// URL and the result of run.
+func startRun(t *testing.T, ctx context.Context, args ...string) (string, chan error) {
+	c, err := quietConfig(args, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- run(ctx, c, ln, nil, log.New(io.Discard, "", 0))
+	}()
+
+	return "http://" + ln.Addr().String(), done
+}
+
+// slowPUT starts a PUT request that sends half of its body, and returns
+// the writer of the rest of the body, and the response status code.
+func slowPUT(t *testing.T, url string) (*io.PipeWriter, chan int) {
+	body, w := io.Pipe()
+	status := make(chan int, 1)
+	go func() {
+		req, err := http.NewRequest("PUT", url, body)
+		if err != nil {
+			t.Error(err)
+			status <- 0
+			return
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	w.Write([]byte("\"ca"))
+
+	// Let the request reach the handler.
+	time.Sleep(50 * time.Millisecond)
+
+	return w, status
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM)
+	defer stop()
+	url, done := startRun(t, ctx, "-shutdown-timeout", "5s")
+
+	w, status := slowPUT(t, url+"/val/kitty")
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+
+	// Check the server is not ready once shutdown begins.
+	for i := 0; ; i++ {
+		resp, err := http.Get(url + "/readyz")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusServiceUnavailable {
+				break
+			}
+		}
+		if i == 100 {
+			t.Fatalf("readyz did not fail during shutdown: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Check the in-flight request completes, and run succeeds.
+	w.Write([]byte("t\""))
+	w.Close()
+	if code := <-status; code != http.StatusCreated {
+		t.Errorf("in-flight PUT returned status code %v want %v", code, http.StatusCreated)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("run: %v", err)
+	}
+}
+
+func TestGracefulShutdownTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	url, done := startRun(t, ctx, "-shutdown-timeout", "50ms")
+
+	// Check run fails if the in-flight request does not complete in time.
+	w, status := slowPUT(t, url+"/val/kitty")
+	cancel()
+	if err := <-done; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("run: got %v want %v", err, context.DeadlineExceeded)
+	}
+	w.Close()
+	<-status
+}
+
+func TestErrorCodes(t *testing.T) {
+	quietLogs(t)
+
+	h := newHandler(newMemoryStore())
+	h.writeToken = "s3cret"
+	h.limits = Limits{MaxValueBytes: 10}
+	router := newHandlerRouter(h)
+	router.HandleFunc("GET", "/panic", func(w http.ResponseWriter, r *http.Request) { panic("kitty") })
+	router.HandleFunc("GET", "/nil", nil)
+	serveAuth(t, router, "PUT", "/v1/val/kitty", `"cat"`, "Bearer s3cret")
+	serveAuth(t, router, "PUT", "/v1/raw/blob", "meow", "Bearer s3cret")
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		header string
+		status int
+		code   string
+	}{
+		{"bad json", "PUT", "/v1/val/kitty", `{`, "", http.StatusBadRequest, errCodeBadJSON},
+		{"bad request", "GET", "/v1/val?limit=0", "", "", http.StatusBadRequest, errCodeBadRequest},
+		{"key not found", "GET", "/v1/val/dog", "", "", http.StatusNotFound, errCodeKeyNotFound},
+		{"route not found", "GET", "/v1/kitty", "", "", http.StatusNotFound, errCodeNotFound},
+		{"method not allowed", "POST", "/v1/val/kitty", "", "", http.StatusMethodNotAllowed, errCodeMethodNotAllowed},
+		{"too large", "PUT", "/v1/val/kitty", `"a long long cat"`, "", http.StatusRequestEntityTooLarge, errCodeTooLarge},
+		{"unauthorized", "PUT", "/v1/val/kitty", `"cat"`, "-", http.StatusUnauthorized, errCodeUnauthorized},
+		{"conflict", "POST", "/v1/val/kitty/cas", `{"old": "dog", "new": "cat"}`, "", http.StatusConflict, errCodeConflict},
+		{"not an integer", "POST", "/v1/val/kitty/incr", "", "", http.StatusConflict, errCodeConflict},
+		{"raw value", "GET", "/v1/val/blob", "", "", http.StatusConflict, errCodeRawValue},
+		{"check failed", "POST", "/v1/txn", `{"ops": [{"op": "check", "key": "kitty"}]}`, "", http.StatusConflict, errCodeCheckFailed},
+		{"precondition failed", "GET", "/v1/raw/blob", "", "If-Unmodified-Since: Mon, 01 Jan 1990 00:00:00 GMT",
+			http.StatusPreconditionFailed, errCodePreconditionFailed},
+		{"range not satisfiable", "GET", "/v1/raw/blob", "", "Range: bytes=100-",
+			http.StatusRequestedRangeNotSatisfiable, errCodeRangeNotSatisfiable},
+		{"panic", "GET", "/panic", "", "", http.StatusInternalServerError, errCodeInternal},
+		{"nil handler", "GET", "/nil", "", "", http.StatusInternalServerError, errCodeInternal},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.header != "-" {
+			req.Header.Set("Authorization", "Bearer s3cret")
+		}
+		if name, value, ok := strings.Cut(tt.header, ": "); ok {
+			req.Header.Set(name, value)
+		}
+		rr := serveRequest(router, req)
+
+		// Check the status, and the error code, are what we expect.
+		if rr.Code != tt.status {
+			t.Errorf("%s: wrong status code: got %v want %v, %s", tt.name, rr.Code, tt.status, rr.Body.String())
+		}
+		if ct := rr.Header().Get("Content-Type"); ct != jsonContentType {
+			t.Errorf("%s: wrong Content-Type: got %s want %s", tt.name, ct, jsonContentType)
+		}
+		var body apiError
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Errorf("%s: invalid error %s: %v", tt.name, rr.Body.String(), err)
+			continue
+		}
+		if body.Error.Code != tt.code || body.Error.Message == "" {
+			t.Errorf("%s: unexpected error: got %+v want code %s", tt.name, body.Error, tt.code)
+		}
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	router := newRouter()
+
+	// Check the methods of the route are listed, for the legacy path too.
+	for _, path := range []string{"/v1/val/kitty", "/val/kitty"} {
+		rr := serve(t, router, "POST", path, "", "")
+		if rr.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s: wrong status code: got %v want %v", path, rr.Code, http.StatusMethodNotAllowed)
+		}
+		if allow := rr.Header().Get("Allow"); allow != "DELETE, GET, HEAD, OPTIONS, PATCH, PUT" {
+			t.Errorf("%s: wrong Allow header: got %q", path, allow)
+		}
+		if body := rr.Body.String(); !strings.Contains(body, "allowed methods: DELETE, GET, HEAD, OPTIONS, PATCH, PUT") {
+			t.Errorf("%s: unexpected body: %s", path, body)
+		}
+	}
+
+	// Check HEAD requests are served by GET routes, e.g. health probes.
+	if rr := serve(t, router, "HEAD", "/livez", "", ""); rr.Code != http.StatusOK || rr.Body.Len() != 0 {
+		t.Errorf("HEAD: got %v %q want %v", rr.Code, rr.Body.String(), http.StatusOK)
+	}
+
+	// Check OPTIONS requests are answered with the allowed methods.
+	rr := serve(t, router, "OPTIONS", "/v1/val/kitty", "", "")
+	if rr.Code != http.StatusNoContent || rr.Header().Get("Allow") != "DELETE, GET, HEAD, OPTIONS, PATCH, PUT" {
+		t.Errorf("OPTIONS: got %v %q want %v", rr.Code, rr.Header().Get("Allow"), http.StatusNoContent)
+	}
+}
+
+func TestStatusErrCode(t *testing.T) {
+	tests := []struct {
+		status int
+		code   string
+	}{
+		{http.StatusBadRequest, errCodeBadRequest},
+		{http.StatusMethodNotAllowed, errCodeMethodNotAllowed},
+		{http.StatusTeapot, errCodeBadRequest},
+		{http.StatusServiceUnavailable, errCodeUnavailable},
+		{http.StatusBadGateway, errCodeInternal},
+	}
+
+	for _, tt := range tests {
+		// Check errors without a code have the code of their status.
+		if code := statusErrCode(tt.status); code != tt.code {
+			t.Errorf("%d: got %s want %s", tt.status, code, tt.code)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate, its key, and its PEM files.
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// newTestCert creates a certificate signed by parent, or a self-signed CA
+// certificate if parent is nil, and writes its PEM files to dir.
+func newTestCert(t *testing.T, dir, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, name+".pem"),
+		keyFile:  filepath.Join(dir, name+"-key.pem"),
+	}
+	if err := os.WriteFile(c.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(c.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+// tlsCertificate returns the certificate and key of c for a TLS config.
+func (c *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+func TestHTTP2(t *testing.T) {
+	server := httptest.NewUnstartedServer(newRouter())
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	client := server.Client()
+	handler := newRouter()
+
+	requests := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{"PUT", "/val/kitty", "\"cat\""},
+		{"PUT", "/val/kitty", "\"tiger\""},
+		{"GET", "/val/kitty", ""},
+		{"GET", "/val/gorilla", ""},
+		{"POST", "/val", "{\"a\": 1}"},
+		{"GET", "/val?limit=1", ""},
+		{"DELETE", "/val/kitty", ""},
+	}
+
+	// Check responses over HTTP/2 are the responses of the handlers.
+	for _, tt := range requests {
+		req, err := http.NewRequest(tt.method, server.URL+tt.path, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		rr := serve(t, handler, tt.method, tt.path, tt.body, "")
+		if resp.ProtoMajor != 2 {
+			t.Errorf("%s %s: got protocol %v want HTTP/2", tt.method, tt.path, resp.Proto)
+		}
+		if resp.StatusCode != rr.Code || string(body) != rr.Body.String() ||
+			resp.Header.Get("Content-Type") != rr.Header().Get("Content-Type") {
+			t.Errorf("%s %s: got %v %s want %v %s", tt.method, tt.path,
+				resp.StatusCode, body, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestTLSClientCert(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "kitty-ca", nil)
+	server := newTestCert(t, dir, "kitty-server", ca)
+	client := newTestCert(t, dir, "kitty-client", ca)
+
+	c, err := quietConfig([]string{"-tls-cert", server.certFile, "-tls-key", server.keyFile,
+		"-tls-client-ca", ca.certFile, "-log-format", "json"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- run(ctx, c, ln, tlsLn, log.New(&logs, "", 0))
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	tlsClient := func(certs ...tls.Certificate) *http.Client {
+		transport := &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: certs},
+			ForceAttemptHTTP2: true,
+		}
+		return &http.Client{Transport: transport}
+	}
+
+	// Check clients with a certificate use HTTP/2.
+	resp, err := tlsClient(client.tlsCertificate(t)).Get("https://" + tlsLn.Addr().String() + "/val")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+		t.Errorf("GET with a client certificate: got %v %v", resp.Proto, resp.StatusCode)
+	}
+
+	// Check clients without a certificate fail.
+	if resp, err := tlsClient().Get("https://" + tlsLn.Addr().String() + "/val"); err == nil {
+		resp.Body.Close()
+		t.Errorf("GET without a client certificate: got %v want an error", resp.StatusCode)
+	}
+
+	// Check the plaintext listener serves the same router.
+	resp, err = http.Get("http://" + ln.Addr().String() + "/val")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET over plaintext: got %v", resp.StatusCode)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	// Check the client certificate name is logged.
+	if !strings.Contains(logs.String(), "\"user\":\"kitty-client\"") {
+		t.Errorf("logs have no client certificate name: %s", logs.String())
+	}
+}
+
+func TestTLSConfigInvalid(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "kitty-ca", nil)
+	server := newTestCert(t, dir, "kitty-server", ca)
+
+	tests := []struct {
+		name     string
+		cert     string
+		key      string
+		clientCA string
+	}{
+		{"missing cert", filepath.Join(dir, "missing.pem"), server.keyFile, ""},
+		{"wrong key", server.certFile, ca.keyFile, ""},
+		{"missing client CA", server.certFile, server.keyFile, filepath.Join(dir, "missing.pem")},
+		{"client CA without certificates", server.certFile, server.keyFile, server.keyFile},
+	}
+	for _, tt := range tests {
+		if _, err := newTLSConfig(tt.cert, tt.key, tt.clientCA); err == nil {
+			t.Errorf("%s: newTLSConfig got no error", tt.name)
+		}
+	}
+
+	// Check valid files set a TLS 1.2 minimum, and require client certificates.
+	config, err := newTLSConfig(server.certFile, server.keyFile, ca.certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MinVersion != tls.VersionTLS12 || config.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("newTLSConfig: got min version %v, client auth %v", config.MinVersion, config.ClientAuth)
+	}
+}
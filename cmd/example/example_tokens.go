@@ -0,0 +1,302 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/yaacov/gokitty/pkg/mux"
+)
+
+// Permissions of tokens.
+const (
+	permRead      = "read"
+	permReadWrite = "read-write"
+)
+
+// allNamespaces grants a token access to all the namespaces, including the
+// default namespace, that is granted by the empty name.
+const allNamespaces = "*"
+
+// writeTokenName is the principal name of the write token, when tokens
+// are set.
+const writeTokenName = "write-token"
+
+// TokenGrant grants a token read, or read and write, access to namespaces,
+// as a principal, whose name is recorded in the audit log.
+type TokenGrant struct {
+	Name       string   `json:"name"`
+	Token      string   `json:"token"`
+	Namespaces []string `json:"namespaces"`
+	Permission string   `json:"permission"`
+}
+
+// validate checks a grant is valid.
+func (g TokenGrant) validate() error {
+	switch {
+	case g.Name == "":
+		return errors.New("name can't be empty")
+	case g.Token == "":
+		return errors.New("token can't be empty")
+	case len(g.Namespaces) == 0:
+		return errors.New("namespaces can't be empty")
+	case g.Permission != permRead && g.Permission != permReadWrite:
+		return fmt.Errorf("permission must be %s or %s", permRead, permReadWrite)
+	}
+	return nil
+}
+
+// principal is the holder of a token.
+type principal struct {
+	name       string
+	namespaces map[string]bool
+	write      bool
+}
+
+// allows checks a principal may read, or write, a namespace.
+func (p *principal) allows(namespace string, write bool) bool {
+	return (p.namespaces[allNamespaces] || p.namespaces[namespace]) && (p.write || !write)
+}
+
+// tokenTable maps the SHA-256 digests of tokens to their principals.
+type tokenTable struct {
+	digests    [][sha256.Size]byte
+	principals []*principal
+}
+
+// newTokenTable returns the table of grants, tokens and names must be
+// unique.
+func newTokenTable(grants []TokenGrant) (*tokenTable, error) {
+	t := &tokenTable{}
+	names := make(map[string]bool, len(grants))
+	for i, g := range grants {
+		if err := g.validate(); err != nil {
+			return nil, fmt.Errorf("token %d: %v", i, err)
+		}
+		if names[g.Name] {
+			return nil, fmt.Errorf("token %d: duplicate name %s", i, g.Name)
+		}
+		names[g.Name] = true
+
+		digest := sha256.Sum256([]byte(g.Token))
+		if _, ok := t.resolve(g.Token); ok {
+			return nil, fmt.Errorf("token %d: duplicate token of %s", i, g.Name)
+		}
+		p := &principal{name: g.Name, namespaces: make(map[string]bool), write: g.Permission == permReadWrite}
+		for _, ns := range g.Namespaces {
+			p.namespaces[ns] = true
+		}
+		t.digests = append(t.digests, digest)
+		t.principals = append(t.principals, p)
+	}
+
+	return t, nil
+}
+
+// resolve returns the principal of a token, comparing the digests of all
+// the tokens in constant time.
+func (t *tokenTable) resolve(token string) (*principal, bool) {
+	digest := sha256.Sum256([]byte(token))
+	found := -1
+	for i := range t.digests {
+		if subtle.ConstantTimeCompare(digest[:], t.digests[i][:]) == 1 {
+			found = i
+		}
+	}
+	if found < 0 {
+		return nil, false
+	}
+
+	return t.principals[found], true
+}
+
+// tokenFile is a table of tokens, loaded from a JSON, or YAML, file, e.g.
+//
+//	tokens:
+//	  - name: app1
+//	    token: s3cret
+//	    namespaces: [app1]
+//	    permission: read-write
+//
+// The table is swapped atomically on reload, requests use the table of the
+// time they started.
+type tokenFile struct {
+	path string
+
+	// Optional write token, granted read and write access to all the
+	// namespaces.
+	writeToken string
+
+	table atomic.Pointer[tokenTable]
+}
+
+// loadTokenFile returns the tokens of a file, and of an optional write
+// token.
+func loadTokenFile(path, writeToken string) (*tokenFile, error) {
+	f := &tokenFile{path: path, writeToken: writeToken}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// reload reads the file again, the tokens do not change if it fails.
+func (f *tokenFile) reload() error {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	if ext := filepath.Ext(f.path); ext == ".yaml" || ext == ".yml" {
+		if data, err = yamlToJSON(data); err != nil {
+			return fmt.Errorf("%s: %v", f.path, err)
+		}
+	}
+
+	var doc struct {
+		Tokens []TokenGrant `json:"tokens"`
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&doc); err != nil {
+		return fmt.Errorf("%s: %v", f.path, err)
+	}
+	if f.writeToken != "" {
+		doc.Tokens = append(doc.Tokens, TokenGrant{
+			Name:       writeTokenName,
+			Token:      f.writeToken,
+			Namespaces: []string{allNamespaces},
+			Permission: permReadWrite,
+		})
+	}
+
+	t, err := newTokenTable(doc.Tokens)
+	if err != nil {
+		return fmt.Errorf("%s: %v", f.path, err)
+	}
+	f.table.Store(t)
+
+	return nil
+}
+
+// reloadOn reloads the file on every signal of c, until it is closed,
+// failing to reload is logged, and keeps the tokens.
+func (f *tokenFile) reloadOn(c <-chan os.Signal, logger *log.Logger) {
+	for range c {
+		if err := f.reload(); err != nil {
+			logger.Printf("warning: can't reload tokens: %v", err)
+			continue
+		}
+		logger.Printf("reloaded tokens from %s", f.path)
+	}
+}
+
+// ctxPrincipalKey is the context key of the principal of a request.
+type ctxPrincipalKey struct{}
+
+// principalName returns the name of the principal of a request, empty if
+// the request has none.
+func principalName(r *http.Request) string {
+	if p, ok := r.Context().Value(ctxPrincipalKey{}).(*principal); ok {
+		return p.name
+	}
+	return ""
+}
+
+// errMissingToken is returned when a request has no bearer token.
+var errMissingToken = errors.New("missing bearer token")
+
+// errUnknownToken is returned when a bearer token is not in the tokens.
+var errUnknownToken = errors.New("unknown token")
+
+// authorize returns a handler calling handle for requests with a bearer
+// token granting access to the namespace of the route, the default
+// namespace for routes without a ":namespace" route parameter, and storing
+// the principal of the token in the request context. Tokens of other
+// namespaces get a 403 Forbidden response, so do read tokens of requests
+// that write.
+//
+// If tokens are not set, writes require the write token, if it is set, and
+// reads are open.
+func (h Handler) authorize(write bool, handle func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return h.authorizeNamespace(write, func(r *http.Request) string {
+		namespace, _ := mux.Var(r, "namespace")
+		return namespace
+	}, handle)
+}
+
+// authorizeAll returns a handler calling handle for requests with a bearer
+// token granting access to all the namespaces, e.g. of routes reporting on
+// all the namespaces.
+func (h Handler) authorizeAll(write bool, handle func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return h.authorizeNamespace(write, func(*http.Request) string { return allNamespaces }, handle)
+}
+
+// authorizeNamespace authorizes requests of the namespace returned by
+// namespace.
+func (h Handler) authorizeNamespace(write bool, namespace func(*http.Request) string, handle func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	if h.tokens == nil {
+		if write {
+			return h.requireWriteToken(handle)
+		}
+		return handle
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			writeUnauthorized(w, r, errMissingToken)
+			return
+		}
+		p, ok := h.tokens.table.Load().resolve(token)
+		if !ok {
+			writeUnauthorized(w, r, errUnknownToken)
+			return
+		}
+
+		ns := namespace(r)
+		if !p.allows(ns, write) {
+			access := "read"
+			if write {
+				access = "write"
+			}
+			switch ns {
+			case "":
+				ns = "the default namespace"
+			case allNamespaces:
+				ns = "all the namespaces"
+			default:
+				ns = "namespace " + ns
+			}
+			writeErrCode(w, http.StatusForbidden, errCodeForbidden, fmt.Sprintf("token of %s can't %s %s", p.name, access, ns))
+			return
+		}
+
+		handle(w, r.WithContext(context.WithValue(r.Context(), ctxPrincipalKey{}, p)))
+	}
+}
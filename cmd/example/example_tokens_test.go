@@ -0,0 +1,190 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testTokens is a token file granting access to namespaces.
+const testTokens = `tokens:
+  - name: admin
+    token: adm1n
+    namespaces: ["*"]
+    permission: read-write
+  - name: app1
+    token: app1-s3cret
+    namespaces: [app1]
+    permission: read-write
+  - name: reader
+    token: r3ader
+    namespaces: [app1, ""]
+    permission: read
+`
+
+// writeTokens writes a token file, and returns its path.
+func writeTokens(t *testing.T, dir, name, data string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestTokens(t *testing.T) {
+	tokens, err := loadTokenFile(writeTokens(t, t.TempDir(), "tokens.yaml", testTokens), "w")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHandler(newMemoryStore())
+	h.tokens = tokens
+	h.audit = newAuditLog(10, nil)
+	handler := newHandlerRouter(h)
+
+	tests := []struct {
+		name          string
+		method        string
+		path          string
+		body          string
+		authorization string
+		status        int
+		expected      string
+	}{
+		{"missing token", "GET", "/v1/val", "", "", http.StatusUnauthorized,
+			"{\"error\":{\"code\":\"unauthorized\",\"message\":\"missing bearer token\"}}"},
+		{"unknown token", "GET", "/v1/val", "", "Bearer kitty", http.StatusUnauthorized,
+			"{\"error\":{\"code\":\"unauthorized\",\"message\":\"unknown token\"}}"},
+		{"prefix of a token", "GET", "/v1/val", "", "Bearer app1", http.StatusUnauthorized, ""},
+		{"write own namespace", "PUT", "/v1/ns/app1/val/kitty", "\"cat\"", "Bearer app1-s3cret", http.StatusCreated, ""},
+		{"write other namespace", "PUT", "/v1/ns/app2/val/kitty", "\"cat\"", "Bearer app1-s3cret", http.StatusForbidden,
+			"{\"error\":{\"code\":\"forbidden\",\"message\":\"token of app1 can't write namespace app2\"}}"},
+		{"read other namespace", "GET", "/v1/ns/app2/val", "", "Bearer app1-s3cret", http.StatusForbidden, ""},
+		{"read default namespace", "GET", "/v1/val", "", "Bearer app1-s3cret", http.StatusForbidden,
+			"{\"error\":{\"code\":\"forbidden\",\"message\":\"token of app1 can't read the default namespace\"}}"},
+		{"delete other namespace", "DELETE", "/v1/ns/app2", "", "Bearer app1-s3cret", http.StatusForbidden, ""},
+		{"read only read", "GET", "/v1/ns/app1/val/kitty", "", "Bearer r3ader", http.StatusOK, "{\"kitty\":\"cat\"}"},
+		{"read only write", "PUT", "/v1/ns/app1/val/kitty", "\"tiger\"", "Bearer r3ader", http.StatusForbidden,
+			"{\"error\":{\"code\":\"forbidden\",\"message\":\"token of reader can't write namespace app1\"}}"},
+		{"read only default namespace", "GET", "/v1/val", "", "Bearer r3ader", http.StatusOK, "{}"},
+		{"read only transaction", "POST", "/v1/txn", "{\"ops\": []}", "Bearer r3ader", http.StatusForbidden, ""},
+		{"list namespaces", "GET", "/v1/ns", "", "Bearer r3ader", http.StatusForbidden,
+			"{\"error\":{\"code\":\"forbidden\",\"message\":\"token of reader can't read all the namespaces\"}}"},
+		{"admin list namespaces", "GET", "/v1/ns", "", "Bearer adm1n", http.StatusOK, "{\"namespaces\":[\"app1\"]}"},
+		{"admin write", "PUT", "/v1/val/tom", "1", "Bearer adm1n", http.StatusCreated, ""},
+		{"write token", "PUT", "/v1/ns/app2/val/tom", "2", "Bearer w", http.StatusCreated, ""},
+		{"legacy path", "GET", "/ns/app2/val/tom", "", "Bearer app1-s3cret", http.StatusForbidden, ""},
+		{"audit", "GET", "/v1/audit", "", "Bearer app1-s3cret", http.StatusForbidden, ""},
+		{"health", "GET", "/livez", "", "", http.StatusOK, ""},
+	}
+
+	for _, tt := range tests {
+		rr := serveAuth(t, handler, tt.method, tt.path, tt.body, tt.authorization)
+
+		// Check the status and the body are what we expect.
+		if rr.Code != tt.status {
+			t.Errorf("%s: wrong status code: got %v want %v, %s", tt.name, rr.Code, tt.status, rr.Body.String())
+		}
+		if tt.expected != "" && rr.Body.String() != tt.expected {
+			t.Errorf("%s: unexpected body: got %s want %s", tt.name, rr.Body.String(), tt.expected)
+		}
+	}
+
+	// Check the audit log records the principals of mutations.
+	rr := serveAuth(t, handler, "GET", "/v1/audit", "", "Bearer adm1n")
+	var got struct {
+		Entries []auditEntry `json:"entries"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	var principals []string
+	for _, e := range got.Entries {
+		principals = append(principals, e.Principal+" "+e.Path)
+	}
+	if s := strings.Join(principals, ", "); s != "write-token /v1/ns/app2/val/tom, admin /v1/val/tom, app1 /v1/ns/app1/val/kitty" {
+		t.Errorf("unexpected audit principals: %s", s)
+	}
+}
+
+func TestTokensReload(t *testing.T) {
+	quietLogs(t)
+
+	dir := t.TempDir()
+	path := writeTokens(t, dir, "tokens.json", `{"tokens": [{"name": "a", "token": "t1", "namespaces": ["*"], "permission": "read"}]}`)
+	tokens, err := loadTokenFile(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHandler(newMemoryStore())
+	h.tokens = tokens
+	handler := newHandlerRouter(h)
+
+	// Check a reload replaces the tokens.
+	writeTokens(t, dir, "tokens.json", `{"tokens": [{"name": "a", "token": "t2", "namespaces": ["*"], "permission": "read"}]}`)
+	if err := tokens.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if rr := serveAuth(t, handler, "GET", "/v1/val", "", "Bearer t1"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("old token: wrong status code: got %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+	if rr := serveAuth(t, handler, "GET", "/v1/val", "", "Bearer t2"); rr.Code != http.StatusOK {
+		t.Errorf("new token: wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	// Check a failed reload keeps the tokens.
+	writeTokens(t, dir, "tokens.json", `{"tokens": [{"name": "a", "token": "t3"`)
+	if err := tokens.reload(); err == nil {
+		t.Errorf("expected a reload error")
+	}
+	if rr := serveAuth(t, handler, "GET", "/v1/val", "", "Bearer t2"); rr.Code != http.StatusOK {
+		t.Errorf("token after a failed reload: wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+}
+
+func TestTokenTableInvalid(t *testing.T) {
+	grant := TokenGrant{Name: "a", Token: "t", Namespaces: []string{"*"}, Permission: permRead}
+
+	tests := []struct {
+		name     string
+		grants   []TokenGrant
+		expected string
+	}{
+		{"missing name", []TokenGrant{{Token: "t", Namespaces: []string{"*"}, Permission: permRead}}, "token 0: name can't be empty"},
+		{"missing token", []TokenGrant{{Name: "a", Namespaces: []string{"*"}, Permission: permRead}}, "token 0: token can't be empty"},
+		{"missing namespaces", []TokenGrant{{Name: "a", Token: "t", Permission: permRead}}, "token 0: namespaces can't be empty"},
+		{"bad permission", []TokenGrant{{Name: "a", Token: "t", Namespaces: []string{"*"}, Permission: "write"}},
+			"token 0: permission must be read or read-write"},
+		{"duplicate name", []TokenGrant{grant, {Name: "a", Token: "u", Namespaces: []string{"*"}, Permission: permRead}},
+			"token 1: duplicate name a"},
+		{"duplicate token", []TokenGrant{grant, {Name: "b", Token: "t", Namespaces: []string{"*"}, Permission: permRead}},
+			"token 1: duplicate token of b"},
+	}
+
+	for _, tt := range tests {
+		// Check invalid tables fail.
+		if _, err := newTokenTable(tt.grants); err == nil || err.Error() != tt.expected {
+			t.Errorf("%s: got error %v want %s", tt.name, err, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package main
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Tracer starts spans, StartSpan returns a context carrying the span, and a
+// function finishing it with the response status. Adapt it to a tracing
+// library, e.g. OpenTelemetry, to export spans.
+type Tracer interface {
+	StartSpan(ctx context.Context, name string) (context.Context, func(status int))
+}
+
+// nopTracer is the default tracer, its spans do nothing.
+type nopTracer struct{}
+
+// StartSpan returns ctx, and a finish function doing nothing.
+func (nopTracer) StartSpan(ctx context.Context, name string) (context.Context, func(status int)) {
+	return ctx, func(int) {}
+}
+
+// traceParentHeader is the W3C trace context header.
+const traceParentHeader = "traceparent"
+
+// spanContext identifies a span, as propagated by traceparent headers.
+type spanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+}
+
+// String formats sc as a traceparent header value.
+func (sc spanContext) String() string {
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" +
+		hex.EncodeToString(sc.SpanID[:]) + "-" + hex.EncodeToString([]byte{sc.Flags})
+}
+
+// parseTraceParent parses a traceparent header value, version 00 headers
+// must have exactly four fields, headers of future versions may have more.
+func parseTraceParent(s string) (spanContext, bool) {
+	var sc spanContext
+	if len(s) < 55 || (len(s) > 55 && s[55] != '-') {
+		return sc, false
+	}
+	if s[2] != '-' || s[35] != '-' || s[52] != '-' {
+		return sc, false
+	}
+	version, ok := decodeLowerHex(s[:2])
+	if !ok || version[0] == 0xff || (version[0] == 0 && len(s) != 55) {
+		return sc, false
+	}
+	traceID, ok := decodeLowerHex(s[3:35])
+	if !ok {
+		return sc, false
+	}
+	spanID, ok := decodeLowerHex(s[36:52])
+	if !ok {
+		return sc, false
+	}
+	flags, ok := decodeLowerHex(s[53:55])
+	if !ok {
+		return sc, false
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Flags = flags[0]
+
+	// All zero IDs are invalid.
+	if sc.TraceID == ([16]byte{}) || sc.SpanID == ([8]byte{}) {
+		return spanContext{}, false
+	}
+
+	return sc, true
+}
+
+// decodeLowerHex decodes lower case hex, traceparent headers never use upper
+// case.
+func decodeLowerHex(s string) ([]byte, bool) {
+	for i := 0; i < len(s); i++ {
+		if 'A' <= s[i] && s[i] <= 'F' {
+			return nil, false
+		}
+	}
+	b, err := hex.DecodeString(s)
+	return b, err == nil
+}
+
+type ctxSpanKey struct{}
+
+// contextWithSpan returns a copy of ctx carrying sc, the parent of spans
+// started using it.
+func contextWithSpan(ctx context.Context, sc spanContext) context.Context {
+	return context.WithValue(ctx, ctxSpanKey{}, sc)
+}
+
+// spanFromContext returns the span carried by ctx, if any.
+func spanFromContext(ctx context.Context) (spanContext, bool) {
+	sc, ok := ctx.Value(ctxSpanKey{}).(spanContext)
+	return sc, ok
+}
+
+type ctxTracerKey struct{}
+
+// tracerFromContext returns the tracer of the request of ctx, stores and
+// other code called by handlers use it to start child spans.
+func tracerFromContext(ctx context.Context) Tracer {
+	if tracer, ok := ctx.Value(ctxTracerKey{}).(Tracer); ok {
+		return tracer
+	}
+
+	return nopTracer{}
+}
+
+// traced returns a handler calling handle inside a span, named by the method
+// and the route template, the span is a child of the traceparent header of
+// the request, if it is valid, and is finished with the response status,
+// 500 if handle panics.
+func traced(tracer Tracer, route string, handle func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), ctxTracerKey{}, tracer)
+		if _, ok := spanFromContext(ctx); !ok {
+			if sc, ok := parseTraceParent(r.Header.Get(traceParentHeader)); ok {
+				ctx = contextWithSpan(ctx, sc)
+			}
+		}
+		ctx, finish := tracer.StartSpan(ctx, r.Method+" "+route)
+
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				finish(http.StatusInternalServerError)
+				panic(recovered)
+			}
+			finish(sw.status())
+		}()
+
+		handle(sw, r.WithContext(ctx))
+	}
+}
+
+// statusWriter records the response status, of spans and audit entries.
+type statusWriter struct {
+	http.ResponseWriter
+
+	code int
+}
+
+// WriteHeader records the first status code.
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write records the implicit 200 status of a response written without
+// a status code.
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the wrapped response writer, for http.ResponseController.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// status returns the response status, 200 if nothing was written.
+func (w *statusWriter) status() int {
+	if w.code == 0 {
+		return http.StatusOK
+	}
+	return w.code
+}
+
+// logTracer is a tracer logging finished spans, with their trace, span and
+// parent IDs, status and duration, server errors are logged as errors.
+type logTracer struct {
+	logger *log.Logger
+	now    func() time.Time
+}
+
+// newLogTracer returns a tracer logging spans to logger.
+func newLogTracer(logger *log.Logger, now func() time.Time) *logTracer {
+	return &logTracer{logger: logger, now: now}
+}
+
+// StartSpan starts a span, a child of the span of ctx, if any, o/w the root
+// of a new trace.
+func (t *logTracer) StartSpan(ctx context.Context, name string) (context.Context, func(status int)) {
+	parent, hasParent := spanFromContext(ctx)
+	sc := spanContext{TraceID: parent.TraceID, Flags: parent.Flags}
+	if !hasParent {
+		rand.Read(sc.TraceID[:])
+		sc.Flags = 1
+	}
+	rand.Read(sc.SpanID[:])
+	start := t.now()
+
+	finish := func(status int) {
+		parentID := "-"
+		if hasParent {
+			parentID = hex.EncodeToString(parent.SpanID[:])
+		}
+		level := "span"
+		if status >= http.StatusInternalServerError {
+			level = "span error"
+		}
+		t.logger.Printf("%s %q trace=%x span=%x parent=%s status=%d duration=%v",
+			level, name, sc.TraceID, sc.SpanID, parentID, status, t.now().Sub(start))
+	}
+
+	return contextWithSpan(ctx, sc), finish
+}
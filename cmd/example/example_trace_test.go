@@ -0,0 +1,222 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordedSpan is a span finished by a recordingTracer.
+type recordedSpan struct {
+	name   string
+	parent string
+	status int
+}
+
+// recordingTracer records finished spans.
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []recordedSpan
+}
+
+func (t *recordingTracer) StartSpan(ctx context.Context, name string) (context.Context, func(status int)) {
+	span := recordedSpan{name: name}
+	if sc, ok := spanFromContext(ctx); ok {
+		span.parent = sc.String()
+	}
+
+	return ctx, func(status int) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		span.status = status
+		t.spans = append(t.spans, span)
+	}
+}
+
+const testTraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestTracedRoutes(t *testing.T) {
+	tracer := &recordingTracer{}
+	h := newHandler(newMemoryStore())
+	h.tracer = tracer
+	handler := newHandlerRouter(h)
+
+	tests := []struct {
+		method      string
+		path        string
+		body        string
+		traceParent string
+		expected    recordedSpan
+	}{
+		{"PUT", "/v1/val/kitty", "\"cat\"", "",
+			recordedSpan{"PUT /v1/val/:key", "", http.StatusCreated}},
+		{"GET", "/v1/val/kitty", "", testTraceParent,
+			recordedSpan{"GET /v1/val/:key", testTraceParent, http.StatusOK}},
+		{"GET", "/v1/val/dog", "", "",
+			recordedSpan{"GET /v1/val/:key", "", http.StatusNotFound}},
+		{"GET", "/val/kitty", "", "",
+			recordedSpan{"GET /val/:key", "", http.StatusOK}},
+		{"PUT", "/v1/val/kitty", "{", "",
+			recordedSpan{"PUT /v1/val/:key", "", http.StatusBadRequest}},
+		{"GET", "/v1/cats", "", testTraceParent,
+			recordedSpan{"GET unmatched", testTraceParent, http.StatusNotFound}},
+		{"GET", "/v1/val", "", "00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+			recordedSpan{"GET /v1/val", "", http.StatusOK}},
+		{"GET", "/livez", "", "",
+			recordedSpan{"GET /livez", "", http.StatusOK}},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.traceParent != "" {
+			req.Header.Set(traceParentHeader, tt.traceParent)
+		}
+		tracer.spans = nil
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		// Check one span is finished, with the name and status we expect.
+		if len(tracer.spans) != 1 || tracer.spans[0] != tt.expected {
+			t.Errorf("%s %s: got spans %+v want %+v", tt.method, tt.path, tracer.spans, tt.expected)
+		}
+	}
+}
+
+func TestTracedPanic(t *testing.T) {
+	tracer := &recordingTracer{}
+	handle := traced(tracer, "/panic", func(w http.ResponseWriter, r *http.Request) {
+		panic("prrr")
+	})
+
+	func() {
+		defer func() {
+			// Check the panic is not recovered.
+			if recover() == nil {
+				t.Errorf("traced recovered the panic")
+			}
+		}()
+		handle(httptest.NewRecorder(), httptest.NewRequest("GET", "/panic", nil))
+	}()
+
+	// Check the span is finished as a server error.
+	expected := recordedSpan{"GET /panic", "", http.StatusInternalServerError}
+	if len(tracer.spans) != 1 || tracer.spans[0] != expected {
+		t.Errorf("got spans %+v want %+v", tracer.spans, expected)
+	}
+}
+
+func TestParseTraceParent(t *testing.T) {
+	tests := []struct {
+		header string
+		valid  bool
+	}{
+		{testTraceParent, true},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-future", true},
+		{"", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future", false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736_00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01", false},
+	}
+
+	for _, tt := range tests {
+		sc, ok := parseTraceParent(tt.header)
+		if ok != tt.valid {
+			t.Errorf("parseTraceParent(%q): got valid %v want %v", tt.header, ok, tt.valid)
+		}
+
+		// Check valid version 00 headers are formatted back as is.
+		if ok && strings.HasPrefix(tt.header, "00-") && sc.String() != tt.header {
+			t.Errorf("parseTraceParent(%q): got %q", tt.header, sc.String())
+		}
+	}
+}
+
+func TestLogTracer(t *testing.T) {
+	var out bytes.Buffer
+	clock := &fakeClock{now: time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)}
+	tracer := newLogTracer(log.New(&out, "", 0), clock.Now)
+
+	parent, _ := parseTraceParent(testTraceParent)
+	ctx, finish := tracer.StartSpan(contextWithSpan(context.Background(), parent), "GET /v1/val/:key")
+	sc, ok := spanFromContext(ctx)
+
+	// Check the span is a child of the parent, in the same trace.
+	if !ok || sc.TraceID != parent.TraceID || sc.SpanID == parent.SpanID {
+		t.Fatalf("got span %v want a child of %v", sc, parent)
+	}
+
+	// Check child spans are children of the span.
+	_, finishChild := tracer.StartSpan(ctx, "store get")
+	finishChild(http.StatusServiceUnavailable)
+	clock.Add(1500 * time.Microsecond)
+	finish(http.StatusOK)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	expected := []string{
+		"span error \"store get\" trace=4bf92f3577b34da6a3ce929d0e0e4736 span=",
+		"span \"GET /v1/val/:key\" trace=4bf92f3577b34da6a3ce929d0e0e4736 span=",
+	}
+	suffixes := []string{
+		" parent=" + sc.String()[36:52] + " status=503 duration=0s",
+		" parent=00f067aa0ba902b7 status=200 duration=1.5ms",
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("got log lines %q", lines)
+	}
+	for i, line := range lines {
+		if !strings.HasPrefix(line, expected[i]) || !strings.HasSuffix(line, suffixes[i]) {
+			t.Errorf("got log line %q want %q...%q", line, expected[i], suffixes[i])
+		}
+	}
+
+	// Check spans without a parent start a new trace.
+	ctx, _ = tracer.StartSpan(context.Background(), "GET /livez")
+	if root, ok := spanFromContext(ctx); !ok || root.TraceID == parent.TraceID || root.TraceID == ([16]byte{}) {
+		t.Errorf("got root span %v", root)
+	}
+}
+
+func TestTracerFromContext(t *testing.T) {
+	tracer := &recordingTracer{}
+	var got Tracer
+	handle := traced(tracer, "/val", func(w http.ResponseWriter, r *http.Request) {
+		got = tracerFromContext(r.Context())
+	})
+	handle(httptest.NewRecorder(), httptest.NewRequest("GET", "/val", nil))
+
+	// Check handlers get the tracer of the request.
+	if got != tracer {
+		t.Errorf("got tracer %v want %v", got, tracer)
+	}
+	if _, ok := tracerFromContext(context.Background()).(nopTracer); !ok {
+		t.Errorf("got a tracer without a request")
+	}
+}
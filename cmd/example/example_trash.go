@@ -0,0 +1,103 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/yaacov/gokitty/pkg/mux"
+)
+
+// trashList is the response of a GET "/trash" request.
+type trashList struct {
+	Trash []TrashedKey `json:"trash"`
+}
+
+// getTrash handles GET "/trash" requests, writing the trashed keys, in key
+// order, with their values and the times they were trashed, an optional
+// "prefix" query parameter lists the trashed keys with a prefix.
+func (h Handler) getTrash(w http.ResponseWriter, r *http.Request) {
+	trashed, err := h.store.ListTrash(r.URL.Query().Get("prefix"))
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+
+	writeJSON(w, trashList{Trash: trashed})
+}
+
+// restoreTrashed handles POST "/trash/:key/restore" requests, moving a key
+// from the trash back, and writing its value, if the key has a value, the
+// response is 409 Conflict.
+func (h Handler) restoreTrashed(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the ":key" route parameter.
+	key, ok := mux.Var(r, "key")
+	if !ok {
+		writeErr(w, http.StatusInternalServerError, "can't get key")
+		return
+	}
+	if err := h.checkNewKeys(1); err != nil {
+		writeLimitErr(w, err)
+		return
+	}
+
+	val, ok, err := h.store.Restore(key)
+	if err == errKeyExists {
+		writeErrCode(w, http.StatusConflict, errCodeKeyExists,
+			fmt.Sprintf("key %s exists, delete it before restoring it", key))
+		return
+	}
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+	if !ok {
+		writeErrCode(w, http.StatusNotFound, errCodeKeyNotFound, fmt.Sprintf("can't find key %s in the trash", key))
+		return
+	}
+	h.publish(eventCreated, key, val)
+	if err := h.setRevisionETag(w); err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+
+	writeJSONStatus(w, http.StatusCreated, map[string]json.RawMessage{key: val})
+}
+
+// deleteTrashed handles DELETE "/trash/:key" requests, removing a key from
+// the trash.
+func (h Handler) deleteTrashed(w http.ResponseWriter, r *http.Request) {
+	// Retrieve the ":key" route parameter.
+	key, ok := mux.Var(r, "key")
+	if !ok {
+		writeErr(w, http.StatusInternalServerError, "can't get key")
+		return
+	}
+
+	ok, err := h.store.DeleteTrashed(key)
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+	if !ok {
+		writeErrCode(w, http.StatusNotFound, errCodeKeyNotFound, fmt.Sprintf("can't find key %s in the trash", key))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
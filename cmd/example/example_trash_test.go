@@ -0,0 +1,276 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// testTrash checks a store moves keys to the trash, and back, using clock.
+func testTrash(t *testing.T, s Store, clock *fakeClock) {
+	t.Helper()
+
+	s.Upsert("kitty", json.RawMessage(`"cat"`))
+	s.UpsertRaw("blob", []byte{0, 0xff}, "image/png", 0)
+	s.UpsertTTL("short", json.RawMessage(`1`), time.Second)
+
+	// Check trashed keys are missing.
+	for _, k := range []string{"kitty", "blob"} {
+		if ok, err := s.Trash(k); !ok || err != nil {
+			t.Fatalf("Trash %s: got %v, %v want true", k, ok, err)
+		}
+		if _, ok, _ := s.Get(k); ok {
+			t.Errorf("trashed key %s was found", k)
+		}
+	}
+	if vals, _ := s.List(); len(vals) != 1 {
+		t.Errorf("unexpected values: %v", vals)
+	}
+	if ok, err := s.Trash("missing"); ok || err != nil {
+		t.Errorf("Trash missing: got %v, %v want false", ok, err)
+	}
+
+	// Check expired keys are not trashed.
+	clock.Add(time.Second)
+	if ok, _ := s.Trash("short"); ok {
+		t.Errorf("expired key was trashed")
+	}
+
+	// Check the trash lists keys in key order, with their values.
+	trashed, err := s.ListTrash("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trashed) != 2 || trashed[0].Key != "blob" || string(trashed[0].Value) != `"AP8="` ||
+		trashed[0].ContentType != "image/png" || trashed[1].Key != "kitty" || string(trashed[1].Value) != `"cat"` {
+		t.Errorf("unexpected trash: %+v", trashed)
+	}
+	if !trashed[1].DeletedAt.Equal(time.Unix(0, 0)) {
+		t.Errorf("wrong deletion time: got %v want %v", trashed[1].DeletedAt, time.Unix(0, 0))
+	}
+	if trashed, _ := s.ListTrash("k"); len(trashed) != 1 || trashed[0].Key != "kitty" {
+		t.Errorf("unexpected trash with a prefix: %+v", trashed)
+	}
+
+	// Check keys that have a value are not restored.
+	s.Upsert("kitty", json.RawMessage(`"tiger"`))
+	if _, _, err := s.Restore("kitty"); err != errKeyExists {
+		t.Errorf("Restore: got %v want %v", err, errKeyExists)
+	}
+	s.Delete("kitty")
+
+	// Check restored keys have their value, and their content type.
+	if v, ok, err := s.Restore("kitty"); !ok || err != nil || string(v) != `"cat"` {
+		t.Errorf("Restore: got %s, %v, %v want \"cat\"", v, ok, err)
+	}
+	if v, ok, _ := s.Get("kitty"); !ok || string(v) != `"cat"` {
+		t.Errorf("restored key: got %s, %v want \"cat\"", v, ok)
+	}
+	if _, ok, err := s.Restore("kitty"); ok || err != nil {
+		t.Errorf("Restore twice: got %v, %v want false", ok, err)
+	}
+	s.Trash("kitty")
+	s.Restore("blob")
+	if metas, _ := s.Meta([]string{"blob"}); metas["blob"].ContentType != "image/png" {
+		t.Errorf("unexpected metadata of a restored raw value: %+v", metas["blob"])
+	}
+
+	// Check purging removes keys trashed before the retention, and
+	// deleting removes a trashed key.
+	s.Trash("blob")
+	clock.Add(time.Hour)
+	s.Upsert("tom", json.RawMessage(`"cat"`))
+	s.Trash("tom")
+	if n, err := s.PurgeTrash(30 * time.Minute); n != 2 || err != nil {
+		t.Errorf("PurgeTrash: got %v, %v want 2", n, err)
+	}
+	if ok, err := s.DeleteTrashed("tom"); !ok || err != nil {
+		t.Errorf("DeleteTrashed: got %v, %v want true", ok, err)
+	}
+	if ok, _ := s.DeleteTrashed("tom"); ok {
+		t.Errorf("DeleteTrashed twice: got true want false")
+	}
+	if trashed, _ := s.ListTrash(""); len(trashed) != 0 {
+		t.Errorf("unexpected trash: %+v", trashed)
+	}
+}
+
+// listTrash returns the trashed keys of a store, and their values.
+func listTrash(t *testing.T, s Store) string {
+	trashed, err := s.ListTrash("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for _, k := range trashed {
+		keys = append(keys, k.Key+"="+string(k.Value))
+	}
+
+	return fmt.Sprint(keys)
+}
+
+func TestMemoryStoreTrash(t *testing.T) {
+	clock := epochClock()
+	s := newMemoryStore()
+	s.now = clock.Now
+
+	testTrash(t, s, clock)
+}
+
+// newSoftDeleteRouter returns a router, moving deleted keys to the trash.
+func newSoftDeleteRouter() http.Handler {
+	h := newHandler(newMemoryStore())
+	h.softDelete = true
+
+	return newHandlerRouter(h)
+}
+
+func TestSoftDelete(t *testing.T) {
+	handler := newSoftDeleteRouter()
+	serve(t, handler, "PUT", "/v1/val/kitty", `"cat"`, "")
+	serve(t, handler, "PUT", "/v1/ns/cats/val/kitty", `"tom"`, "")
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		status   int
+		expected string
+	}{
+		{"delete", "DELETE", "/v1/val/kitty", http.StatusOK, `{"kitty":"cat"}`},
+		{"get trashed", "GET", "/v1/val/kitty", http.StatusNotFound, ""},
+		{"list", "GET", "/v1/val", http.StatusOK, `{}`},
+		{"export", "GET", "/v1/export", http.StatusOK, `{}`},
+		{"delete trashed", "DELETE", "/v1/val/kitty", http.StatusNotFound, ""},
+		{"restore", "POST", "/v1/trash/kitty/restore", http.StatusCreated, `{"kitty":"cat"}`},
+		{"get restored", "GET", "/v1/val/kitty", http.StatusOK, `{"kitty":"cat"}`},
+		{"restore missing", "POST", "/v1/trash/kitty/restore", http.StatusNotFound,
+			`{"error":{"code":"key_not_found","message":"can't find key kitty in the trash"}}`},
+		{"delete again", "DELETE", "/v1/val/kitty", http.StatusOK, ""},
+		{"create again", "PUT", "/v1/val/kitty", http.StatusCreated, ""},
+		{"restore existing", "POST", "/v1/trash/kitty/restore", http.StatusConflict,
+			`{"error":{"code":"key_exists","message":"key kitty exists, delete it before restoring it"}}`},
+		{"purge", "DELETE", "/v1/trash/kitty", http.StatusNoContent, ""},
+		{"purge missing", "DELETE", "/v1/trash/kitty", http.StatusNotFound, ""},
+		{"empty trash", "GET", "/v1/trash", http.StatusOK, `{"trash":[]}`},
+		{"delete namespace key", "DELETE", "/v1/ns/cats/val/kitty", http.StatusOK, `{"kitty":"tom"}`},
+		{"namespace trash", "GET", "/v1/ns/cats/trash?prefix=k", http.StatusOK, ""},
+		{"default namespace trash", "GET", "/v1/trash", http.StatusOK, `{"trash":[]}`},
+		{"restore other namespace", "POST", "/v1/ns/dogs/trash/kitty/restore", http.StatusNotFound, ""},
+		{"restore namespace key", "POST", "/v1/ns/cats/trash/kitty/restore", http.StatusCreated, `{"kitty":"tom"}`},
+	}
+
+	for _, tt := range tests {
+		rr := serve(t, handler, tt.method, tt.path, "\"tiger\"", "")
+
+		// Check the status and the body are what we expect.
+		if rr.Code != tt.status {
+			t.Errorf("%s: wrong status code: got %v want %v, %s", tt.name, rr.Code, tt.status, rr.Body.String())
+		}
+		if tt.expected != "" && rr.Body.String() != tt.expected {
+			t.Errorf("%s: unexpected body: got %s want %s", tt.name, rr.Body.String(), tt.expected)
+		}
+	}
+}
+
+func TestTrashList(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)}
+	store := newMemoryStore()
+	store.now = clock.Now
+	h := newHandler(store)
+	h.softDelete = true
+	handler := newHandlerRouter(h)
+
+	serve(t, handler, "PUT", "/v1/val/kitty", `"cat"`, "")
+	clock.Add(time.Minute)
+	serve(t, handler, "DELETE", "/v1/val/kitty", "", "")
+
+	// Check the trash has the value, the metadata, and the deletion time.
+	rr := serve(t, handler, "GET", "/v1/trash", "", "")
+	expected := `{"trash":[{"key":"kitty","value":"cat","created_at":"2019-01-02T03:04:05Z",` +
+		`"updated_at":"2019-01-02T03:04:05Z","deleted_at":"2019-01-02T03:05:05Z"}]}`
+	if rr.Body.String() != expected {
+		t.Errorf("unexpected body: got %s want %s", rr.Body.String(), expected)
+	}
+
+	// Check the restored key keeps its creation time.
+	clock.Add(time.Minute)
+	serve(t, handler, "POST", "/v1/trash/kitty/restore", "", "")
+	rr = serve(t, handler, "GET", "/v1/val/kitty/meta", "", "")
+	if rr.Body.String() != `{"kitty":{"created_at":"2019-01-02T03:04:05Z","updated_at":"2019-01-02T03:06:05Z"}}` {
+		t.Errorf("unexpected metadata: %s", rr.Body.String())
+	}
+}
+
+func TestTrashDisabled(t *testing.T) {
+	handler := newRouter()
+	serve(t, handler, "PUT", "/v1/val/kitty", `"cat"`, "")
+	serve(t, handler, "DELETE", "/v1/val/kitty", "", "")
+
+	// Check deleted keys are removed, and the trash is not served.
+	if rr := serve(t, handler, "GET", "/v1/trash", "", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+	if rr := serve(t, handler, "POST", "/v1/trash/kitty/restore", "", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestExportTrash(t *testing.T) {
+	store := newMemoryStore()
+	store.now = epochClock().Now
+	h := newHandler(store)
+	h.softDelete = true
+	handler := newHandlerRouter(h)
+	serve(t, handler, "PUT", "/v1/val/kitty", `"cat"`, "")
+	serve(t, handler, "PUT", "/v1/val/tom", `"cat"`, "")
+	serve(t, handler, "DELETE", "/v1/val/tom", "", "")
+
+	tests := []struct {
+		query    string
+		status   int
+		expected string
+		etag     string
+	}{
+		{"", http.StatusOK, `{"kitty":"cat"}`, "\"rev-%d\""},
+		{"?include_trash=false", http.StatusOK, `{"kitty":"cat"}`, "\"rev-%d\""},
+		{"?include_trash=true", http.StatusOK, `{"values":{"kitty":"cat"},"trash":[{"key":"tom","value":"cat",` +
+			`"created_at":"1970-01-01T00:00:00Z","updated_at":"1970-01-01T00:00:00Z","deleted_at":"1970-01-01T00:00:00Z"}]}`,
+			"\"rev-%d-trash\""},
+		{"?include_trash=maybe", http.StatusBadRequest, "", ""},
+	}
+
+	rev, _ := store.Revision()
+	for _, tt := range tests {
+		rr := serve(t, handler, "GET", "/v1/export"+tt.query, "", "")
+
+		// Check the export, and its ETag, are what we expect.
+		if rr.Code != tt.status {
+			t.Errorf("%s: wrong status code: got %v want %v", tt.query, rr.Code, tt.status)
+		}
+		if tt.expected != "" && rr.Body.String() != tt.expected {
+			t.Errorf("%s: unexpected body: got %s want %s", tt.query, rr.Body.String(), tt.expected)
+		}
+		if etag := rr.Header().Get("ETag"); tt.etag != "" && etag != fmt.Sprintf(tt.etag, rev) {
+			t.Errorf("%s: wrong ETag: got %s want %s", tt.query, etag, fmt.Sprintf(tt.etag, rev))
+		}
+	}
+}
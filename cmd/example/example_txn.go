@@ -0,0 +1,225 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// maxTxnOps is the maximum number of operations of a POST "/txn" request.
+const maxTxnOps = 100
+
+// Results of the operations of a transaction.
+const (
+	txnCreated  = "created"
+	txnUpdated  = "updated"
+	txnDeleted  = "deleted"
+	txnNotFound = "not found"
+	txnPassed   = "passed"
+)
+
+// txnResult is the result of an operation of a transaction.
+type txnResult struct {
+	Op     string `json:"op"`
+	Key    string `json:"key"`
+	Result string `json:"result"`
+}
+
+// txnResponse is the response of an applied transaction, the revision is
+// the revision of its watch events.
+type txnResponse struct {
+	Revision uint64      `json:"revision"`
+	Results  []txnResult `json:"results"`
+}
+
+// txnConflict is the error details of a transaction with a failed check.
+type txnConflict struct {
+	Index   int             `json:"index"`
+	Key     string          `json:"key"`
+	Current json.RawMessage `json:"current,omitempty"`
+}
+
+// postTxn handles POST "/txn" requests, with a JSON body
+// {"ops": [{"op": "put", "key": "a", "value": 1}, {"op": "delete", "key": "b"},
+// {"op": "check", "key": "c", "value": 3}]}.
+//
+// All the checks are evaluated first, a check without a value passes if
+// the key is missing, and if all of them pass, the puts and deletes are
+// applied atomically, in order, o/w it writes a 409 describing the first
+// failed check, with the current value of its key. A key can be put or
+// deleted once in a transaction.
+func (h Handler) postTxn(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Ops []TxnOp `json:"ops"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	// Read body data as json.
+	err := decoder.Decode(&body)
+	if err != nil {
+		writeErrCode(w, http.StatusBadRequest, errCodeBadJSON, err.Error())
+		return
+	}
+	ops := body.Ops
+	if len(ops) == 0 {
+		writeErr(w, http.StatusBadRequest, "ops is required")
+		return
+	}
+	if len(ops) > maxTxnOps {
+		writeErr(w, http.StatusBadRequest, fmt.Sprintf("too many ops, at most %d ops can be in a transaction", maxTxnOps))
+		return
+	}
+	if err := h.checkTxnOps(ops); err != nil {
+		writeLimitErr(w, err)
+		return
+	}
+	if err := h.checkTxnNewKeys(ops); err != nil {
+		writeLimitErr(w, err)
+		return
+	}
+
+	failed, current, existed, err := h.store.Txn(ops)
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+	if failed >= 0 {
+		key := ops[failed].Key
+		msg := fmt.Sprintf("check of key %s failed, value does not match", key)
+		if ops[failed].Value == nil {
+			msg = fmt.Sprintf("check of key %s failed, key exists", key)
+		}
+		writeErrDetails(w, http.StatusConflict, errCodeCheckFailed, msg,
+			txnConflict{Index: failed, Key: key, Current: current})
+		return
+	}
+
+	results := make([]txnResult, len(ops))
+	var events []event
+	for i, op := range ops {
+		results[i] = txnResult{Op: op.Op, Key: op.Key, Result: txnPassed}
+		switch {
+		case op.Op == TxnPut && existed[i]:
+			results[i].Result = txnUpdated
+			events = append(events, event{Type: eventUpdated, Key: op.Key, Value: op.Value})
+		case op.Op == TxnPut:
+			results[i].Result = txnCreated
+			events = append(events, event{Type: eventCreated, Key: op.Key, Value: op.Value})
+		case op.Op == TxnDelete && existed[i]:
+			results[i].Result = txnDeleted
+			events = append(events, event{Type: eventDeleted, Key: op.Key})
+		case op.Op == TxnDelete:
+			results[i].Result = txnNotFound
+		}
+	}
+
+	// Transactions without changes have no events.
+	rev := h.hub.revision()
+	if len(events) > 0 {
+		rev = h.hub.publishTxn(h.namespace, events)
+	}
+	if err := h.setRevisionETag(w); err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+
+	writeJSON(w, txnResponse{Revision: rev, Results: results})
+}
+
+// checkTxnOps checks the operations of a transaction are valid, and
+// compacts their values.
+func (h Handler) checkTxnOps(ops []TxnOp) error {
+	changed := make(map[string]bool, len(ops))
+	for i := range ops {
+		op := &ops[i]
+		if op.Key == "" {
+			return &limitError{http.StatusBadRequest, fmt.Sprintf("ops[%d]: key is required", i)}
+		}
+		if op.Value != nil {
+			op.Value = compactJSON(op.Value)
+		}
+
+		switch op.Op {
+		case TxnPut:
+			if op.Value == nil {
+				return &limitError{http.StatusBadRequest, fmt.Sprintf("ops[%d]: value is required", i)}
+			}
+			if err := h.limits.checkValue(op.Key, op.Value); err != nil {
+				return err
+			}
+			if err := h.schemas.check(op.Key, op.Value); err != nil {
+				return err
+			}
+		case TxnDelete:
+			if op.Value != nil {
+				return &limitError{http.StatusBadRequest, fmt.Sprintf("ops[%d]: delete has no value", i)}
+			}
+		case TxnCheck:
+			// A null value checks the key is missing, as in compare and swap.
+			if string(op.Value) == "null" {
+				op.Value = nil
+			}
+			continue
+		default:
+			return &limitError{http.StatusBadRequest, fmt.Sprintf(
+				"ops[%d]: invalid op %q, want %s, %s or %s", i, op.Op, TxnPut, TxnDelete, TxnCheck)}
+		}
+
+		if changed[op.Key] {
+			return &limitError{http.StatusBadRequest, fmt.Sprintf("ops[%d]: key %s is changed more than once", i, op.Key)}
+		}
+		changed[op.Key] = true
+	}
+
+	return nil
+}
+
+// checkTxnNewKeys checks the keys created by a transaction, less the keys
+// it deletes, can be created without exceeding the maximum number of keys.
+func (h Handler) checkTxnNewKeys(ops []TxnOp) error {
+	if h.limits.MaxKeys <= 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(ops))
+	for _, op := range ops {
+		keys = append(keys, op.Key)
+	}
+	found, err := h.store.GetMany(keys)
+	if err != nil {
+		return err
+	}
+
+	n := 0
+	for _, op := range ops {
+		_, ok := found[op.Key]
+		switch {
+		case op.Op == TxnPut && !ok:
+			n++
+		case op.Op == TxnDelete && ok:
+			n--
+		}
+	}
+	if n <= 0 {
+		return nil
+	}
+
+	return h.checkNewKeys(n)
+}
@@ -0,0 +1,309 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTxn(t *testing.T) {
+	tooMany := `{"ops": [` + strings.Repeat(`{"op": "check", "key": "a"},`, maxTxnOps) + `{"op": "check", "key": "a"}]}`
+
+	tests := []struct {
+		name     string
+		body     string
+		status   int
+		expected string
+		values   string
+	}{
+		{"mixed", `{"ops": [{"op": "check", "key": "kitty", "value": {"lives": 9.0}}, {"op": "check", "key": "new"},
+			{"op": "put", "key": "new", "value": [1, 2]}, {"op": "put", "key": "kitty", "value": "tiger"},
+			{"op": "delete", "key": "gorilla"}, {"op": "delete", "key": "missing"}]}`, http.StatusOK,
+			`{"revision":3,"results":[{"op":"check","key":"kitty","result":"passed"},` +
+				`{"op":"check","key":"new","result":"passed"},{"op":"put","key":"new","result":"created"},` +
+				`{"op":"put","key":"kitty","result":"updated"},{"op":"delete","key":"gorilla","result":"deleted"},` +
+				`{"op":"delete","key":"missing","result":"not found"}]}`,
+			`{"kitty":"tiger","new":[1,2]}`},
+		{"failed check", `{"ops": [{"op": "put", "key": "new", "value": 1}, {"op": "check", "key": "kitty", "value": {"lives": 9}},
+			{"op": "check", "key": "gorilla", "value": 3}, {"op": "check", "key": "kitty", "value": 1}]}`, http.StatusConflict,
+			`{"error":{"code":"check_failed","message":"check of key gorilla failed, value does not match","details":{"index":2,"key":"gorilla","current":2}}}`,
+			`{"gorilla":2,"kitty":{"lives":9}}`},
+		{"failed check of a missing key", `{"ops": [{"op": "delete", "key": "kitty"}, {"op": "check", "key": "kitty", "value": null}]}`,
+			http.StatusConflict,
+			`{"error":{"code":"check_failed","message":"check of key kitty failed, key exists","details":{"index":1,"key":"kitty","current":{"lives":9}}}}`,
+			`{"gorilla":2,"kitty":{"lives":9}}`},
+		{"failed check of an existing key", `{"ops": [{"op": "check", "key": "missing", "value": 1}]}`, http.StatusConflict,
+			`{"error":{"code":"check_failed","message":"check of key missing failed, value does not match","details":{"index":0,"key":"missing"}}}`,
+			`{"gorilla":2,"kitty":{"lives":9}}`},
+		{"no ops", `{"ops": []}`, http.StatusBadRequest,
+			`{"error":{"code":"bad_request","message":"ops is required"}}`, `{"gorilla":2,"kitty":{"lives":9}}`},
+		{"too many ops", tooMany, http.StatusBadRequest,
+			`{"error":{"code":"bad_request","message":"too many ops, at most 100 ops can be in a transaction"}}`, `{"gorilla":2,"kitty":{"lives":9}}`},
+		{"invalid op", `{"ops": [{"op": "incr", "key": "kitty"}]}`, http.StatusBadRequest,
+			`{"error":{"code":"bad_request","message":"ops[0]: invalid op \"incr\", want put, delete or check"}}`, `{"gorilla":2,"kitty":{"lives":9}}`},
+		{"missing key", `{"ops": [{"op": "check", "key": "kitty"}, {"op": "delete"}]}`, http.StatusBadRequest,
+			`{"error":{"code":"bad_request","message":"ops[1]: key is required"}}`, `{"gorilla":2,"kitty":{"lives":9}}`},
+		{"put without a value", `{"ops": [{"op": "put", "key": "kitty"}]}`, http.StatusBadRequest,
+			`{"error":{"code":"bad_request","message":"ops[0]: value is required"}}`, `{"gorilla":2,"kitty":{"lives":9}}`},
+		{"delete with a value", `{"ops": [{"op": "delete", "key": "kitty", "value": 1}]}`, http.StatusBadRequest,
+			`{"error":{"code":"bad_request","message":"ops[0]: delete has no value"}}`, `{"gorilla":2,"kitty":{"lives":9}}`},
+		{"key changed twice", `{"ops": [{"op": "put", "key": "kitty", "value": 1}, {"op": "delete", "key": "kitty"}]}`,
+			http.StatusBadRequest, `{"error":{"code":"bad_request","message":"ops[1]: key kitty is changed more than once"}}`, `{"gorilla":2,"kitty":{"lives":9}}`},
+		{"bad body", `{"ops": [{"op": "put", "key": "kitty", "ttl": 1}]}`, http.StatusBadRequest,
+			`{"error":{"code":"bad_json","message":"json: unknown field \"ttl\""}}`, `{"gorilla":2,"kitty":{"lives":9}}`},
+	}
+
+	for _, tt := range tests {
+		handler := newRouter()
+		serve(t, handler, "POST", "/val", `{"kitty": {"lives": 9}, "gorilla": 2}`, "")
+
+		rr := serve(t, handler, "POST", "/v1/txn", tt.body, "")
+
+		// Check the status code is what we expect.
+		if rr.Code != tt.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tt.name, rr.Code, tt.status)
+		}
+
+		// Check the response body is what we expect.
+		if rr.Body.String() != tt.expected {
+			t.Errorf("%s: handler returned unexpected body: got %v want %v", tt.name, rr.Body.String(), tt.expected)
+		}
+
+		// Check the values are applied all or nothing.
+		if got := serve(t, handler, "GET", "/v1/val", "", "").Body.String(); got != tt.values {
+			t.Errorf("%s: unexpected values: got %v want %v", tt.name, got, tt.values)
+		}
+	}
+}
+
+func TestTxnNamespace(t *testing.T) {
+	handler := newRouter()
+	serve(t, handler, "PUT", "/v1/val/kitty", "1", "")
+
+	// Check transactions of a namespace use its keys.
+	rr := serve(t, handler, "POST", "/v1/ns/cats/txn", `{"ops": [{"op": "check", "key": "kitty"}, {"op": "put", "key": "kitty", "value": 2}]}`, "")
+	if rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	for path, want := range map[string]string{"/v1/val": `{"kitty":1}`, "/v1/ns/cats/val": `{"kitty":2}`} {
+		if got := serve(t, handler, "GET", path, "", "").Body.String(); got != want {
+			t.Errorf("%s: unexpected values: got %v want %v", path, got, want)
+		}
+	}
+}
+
+func TestTxnLimits(t *testing.T) {
+	h := newHandler(newMemoryStore())
+	h.limits = Limits{MaxKeys: 2}
+	handler := newHandlerRouter(h)
+	serve(t, handler, "POST", "/v1/val", `{"a": 1, "b": 2}`, "")
+
+	// Check keys deleted by a transaction make room for the keys it creates.
+	rr := serve(t, handler, "POST", "/v1/txn", `{"ops": [{"op": "delete", "key": "a"}, {"op": "put", "key": "c", "value": 3}]}`, "")
+	if rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	rr = serve(t, handler, "POST", "/v1/txn", `{"ops": [{"op": "put", "key": "b", "value": 1}, {"op": "put", "key": "d", "value": 4}]}`, "")
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+
+	// Check a full memory store rejects the whole transaction.
+	store := newStoreWithLimit(2, RejectNew)
+	handler = newStoreRouter(store)
+	serve(t, handler, "PUT", "/v1/val/a", "1", "")
+	rr = serve(t, handler, "POST", "/v1/txn", `{"ops": [{"op": "put", "key": "b", "value": 2}, {"op": "put", "key": "c", "value": 3}]}`, "")
+	if rr.Code != http.StatusInsufficientStorage {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusInsufficientStorage)
+	}
+	if got := listValues(t, store); len(got) != 1 {
+		t.Errorf("transaction was applied in part: %v", got)
+	}
+}
+
+func TestTxnEvents(t *testing.T) {
+	h := newHandler(newMemoryStore())
+	handler := newHandlerRouter(h)
+	serve(t, handler, "POST", "/v1/val", `{"kitty": 1, "gorilla": 2}`, "")
+	serve(t, handler, "POST", "/v1/txn", `{"ops": [{"op": "put", "key": "kitty", "value": 3},
+		{"op": "put", "key": "tom", "value": 4}, {"op": "delete", "key": "gorilla"}, {"op": "delete", "key": "missing"}]}`, "")
+
+	// Check the events of a transaction have the same revision.
+	w, events, err := h.hub.subscribe("", "", 2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.hub.unsubscribe(w)
+
+	expected := []event{
+		{Type: eventUpdated, Key: "kitty", Value: json.RawMessage(`3`), Revision: 3},
+		{Type: eventCreated, Key: "tom", Value: json.RawMessage(`4`), Revision: 3},
+		{Type: eventDeleted, Key: "gorilla", Revision: 3},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("got %d events want %d: %+v", len(events), len(expected), events)
+	}
+	for i, e := range events {
+		want := expected[i]
+		if e.Type != want.Type || e.Key != want.Key || string(e.Value) != string(want.Value) || e.Revision != want.Revision {
+			t.Errorf("unexpected event: got %+v want %+v", e, want)
+		}
+	}
+
+	// Check the history of the keys has the revision.
+	rr := serve(t, handler, "GET", "/v1/val/tom?rev=3", "", "")
+	if rr.Code != http.StatusOK || rr.Body.String() != `{"tom":4}` {
+		t.Errorf("get of the revision of a transaction: got %v %v", rr.Code, rr.Body.String())
+	}
+}
+
+func TestHubReplaysWholeTxns(t *testing.T) {
+	h := newHub(2)
+	h.publish("", eventCreated, "a", json.RawMessage(`1`))
+	h.publishTxn("", []event{{Type: eventCreated, Key: "b"}, {Type: eventCreated, Key: "c"}, {Type: eventCreated, Key: "d"}})
+
+	// Check a revision with dropped events is no longer available.
+	if _, _, err := h.subscribe("", "", 1, true); err == nil {
+		t.Errorf("replayed a transaction with dropped events")
+	}
+	w, events, err := h.subscribe("", "", 2, true)
+	if err != nil || len(events) != 0 {
+		t.Errorf("subscribe: got %v, %v want no events", events, err)
+	}
+	h.unsubscribe(w)
+
+	// Check events after a transaction are replayed.
+	h.publish("", eventCreated, "e", nil)
+	w, events, err = h.subscribe("", "", 2, true)
+	if err != nil || len(events) != 1 || events[0].Key != "e" || events[0].Revision != 3 {
+		t.Errorf("subscribe: got %+v, %v want the event of e", events, err)
+	}
+	h.unsubscribe(w)
+}
+
+// testStoreTxn checks a store applies transactions all or nothing.
+func testStoreTxn(t *testing.T, store Store) {
+	store.Upsert("kitty", json.RawMessage(`{"lives":9}`))
+	store.UpsertTTL("gorilla", json.RawMessage(`2`), time.Hour)
+
+	// Check a failed check changes nothing.
+	failed, current, _, err := store.Txn([]TxnOp{
+		{Op: TxnDelete, Key: "kitty"},
+		{Op: TxnCheck, Key: "kitty", Value: json.RawMessage(`{"lives":9}`)},
+		{Op: TxnCheck, Key: "gorilla", Value: json.RawMessage(`3`)},
+	})
+	if failed != 2 || string(current) != `2` || err != nil {
+		t.Errorf("Txn: got %v, %s, %v want 2, 2", failed, current, err)
+	}
+	if got := listValues(t, store); len(got) != 2 {
+		t.Errorf("a failed transaction changed values: %v", got)
+	}
+
+	// Check puts and deletes are applied in order.
+	failed, _, existed, err := store.Txn([]TxnOp{
+		{Op: TxnCheck, Key: "gorilla", Value: json.RawMessage(`2.0`)},
+		{Op: TxnCheck, Key: "tom"},
+		{Op: TxnPut, Key: "gorilla", Value: json.RawMessage(`3`)},
+		{Op: TxnPut, Key: "tom", Value: json.RawMessage(`"cat"`)},
+		{Op: TxnDelete, Key: "kitty"},
+		{Op: TxnDelete, Key: "missing"},
+	})
+	if failed != -1 || err != nil || fmt.Sprint(existed) != "[true false true false true false]" {
+		t.Errorf("Txn: got %v, %v, %v", failed, existed, err)
+	}
+	if got := listValues(t, store); fmt.Sprint(got) != `map[gorilla:3 tom:"cat"]` {
+		t.Errorf("unexpected values: %v", got)
+	}
+
+	// Check puts never expire.
+	if _, ok, _ := store.TTL("gorilla"); ok {
+		t.Errorf("put of a transaction kept the TTL of the key")
+	}
+}
+
+// testConcurrentTxn checks parallel transactions incrementing a counter,
+// and retrying when the check of the counter fails, never lose updates.
+func testConcurrentTxn(t *testing.T, store Store) {
+	handler := newStoreRouter(store)
+	store.Upsert("counter", json.RawMessage(`0`))
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			for {
+				v, _, _ := store.Get("counter")
+				n, _ := strconv.Atoi(string(v))
+				body := fmt.Sprintf(`{"ops": [{"op": "check", "key": "counter", "value": %d},
+					{"op": "put", "key": "counter", "value": %d}, {"op": "put", "key": "last", "value": %d}]}`, n, n+1, i)
+				rr := serve(t, handler, "POST", "/v1/txn", body, "")
+				if rr.Code == http.StatusOK {
+					return
+				}
+				if rr.Code != http.StatusConflict {
+					t.Errorf("handler returned wrong status code: got %v", rr.Code)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if v, _, _ := store.Get("counter"); string(v) != "20" {
+		t.Errorf("parallel transactions lost updates: got %s want 20", v)
+	}
+}
+
+func TestMemoryStoreTxn(t *testing.T) {
+	testStoreTxn(t, newMemoryStore())
+}
+
+func TestMemoryStoreConcurrentTxn(t *testing.T) {
+	testConcurrentTxn(t, newMemoryStore())
+}
+
+func TestMemoryStoreTxnLRU(t *testing.T) {
+	s := newStoreWithLimit(2, EvictLRU)
+	s.Upsert("a", json.RawMessage(`1`))
+	s.Upsert("b", json.RawMessage(`2`))
+
+	var evicted []string
+	s.OnEvict(func(k string) { evicted = append(evicted, k) })
+
+	// Check creating a key evicts a key outside the transaction.
+	failed, _, existed, err := s.Txn([]TxnOp{
+		{Op: TxnPut, Key: "c", Value: json.RawMessage(`3`)},
+		{Op: TxnPut, Key: "a", Value: json.RawMessage(`4`)},
+	})
+	if failed != -1 || err != nil || fmt.Sprint(existed) != "[false true]" {
+		t.Errorf("Txn: got %v, %v, %v", failed, existed, err)
+	}
+	if fmt.Sprint(evicted) != "[b]" {
+		t.Errorf("unexpected evicted keys: %v", evicted)
+	}
+	if got := listValues(t, s); fmt.Sprint(got) != `map[a:4 c:3]` {
+		t.Errorf("unexpected values: %v", got)
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package main
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"github.com/yaacov/gokitty/pkg/mux"
+)
+
+// uiFiles are the static files of the web UI, a page browsing and editing
+// values using the API.
+//
+//go:embed ui
+var uiFiles embed.FS
+
+// uiFS is the ui directory of uiFiles.
+var uiFS, _ = fs.Sub(uiFiles, "ui")
+
+// getUI handles GET "/ui" and "/ui/:file" requests, serving the page of the
+// web UI, or one of its files.
+func getUI(w http.ResponseWriter, r *http.Request) {
+	name, ok := mux.Var(r, "file")
+	if !ok {
+		name = "index.html"
+	}
+
+	// Serve only files, ServeFileFS lists directories.
+	if info, err := fs.Stat(uiFS, name); err != nil || info.IsDir() {
+		notFound(w, r)
+		return
+	}
+
+	http.ServeFileFS(w, r, uiFS, name)
+}
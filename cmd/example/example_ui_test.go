@@ -0,0 +1,74 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestUI(t *testing.T) {
+	handler := newRouter()
+
+	tests := []struct {
+		path        string
+		status      int
+		contentType string
+		contains    string
+	}{
+		{"/ui", http.StatusOK, "text/html; charset=utf-8", "<script src=\"/ui/app.js\""},
+		{"/ui/app.js", http.StatusOK, "text/javascript; charset=utf-8", "async function api("},
+		{"/ui/style.css", http.StatusOK, "text/css; charset=utf-8", "#list"},
+		{"/ui/cats.js", http.StatusNotFound, jsonContentType, "not found"},
+		{"/ui/..", http.StatusNotFound, jsonContentType, "not found"},
+	}
+
+	for _, tt := range tests {
+		rr := serve(t, handler, "GET", tt.path, "", "")
+
+		// Check the status code, content type and body are what we expect.
+		if rr.Code != tt.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				tt.path, rr.Code, tt.status)
+		}
+		if got := rr.Header().Get("Content-Type"); got != tt.contentType {
+			t.Errorf("%s: got Content-Type %q want %q", tt.path, got, tt.contentType)
+		}
+		if !strings.Contains(rr.Body.String(), tt.contains) {
+			t.Errorf("%s: body does not contain %q", tt.path, tt.contains)
+		}
+	}
+}
+
+func TestUIAuth(t *testing.T) {
+	h := newHandler(newMemoryStore())
+	h.writeToken = "s3cret"
+	handler := newHandlerRouter(h)
+
+	// Check the UI is served without the write token.
+	if rr := serve(t, handler, "GET", "/ui", "", ""); rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	// Check the UI sends the token, and prompts for it when unauthorized.
+	rr := serve(t, handler, "GET", "/ui/app.js", "", "")
+	for _, s := range []string{"\"Bearer \" + token", "resp.status === 401", "data.error"} {
+		if !strings.Contains(rr.Body.String(), s) {
+			t.Errorf("app.js does not contain %q", s)
+		}
+	}
+}
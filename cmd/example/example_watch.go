@@ -0,0 +1,353 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package main
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yaacov/gokitty/pkg/mux"
+)
+
+// Watch event types.
+const (
+	eventCreated = "created"
+	eventUpdated = "updated"
+	eventDeleted = "deleted"
+	eventEvicted = "evicted"
+)
+
+// defaultWatchHistory is the number of events kept for replaying.
+const defaultWatchHistory = 1024
+
+// watchBuffer is the number of events buffered for each watcher, watchers
+// that fall further behind are dropped.
+const watchBuffer = 64
+
+// errWatchClosed is returned when subscribing to a closed hub.
+var errWatchClosed = errors.New("server is shutting down")
+
+// event is a change of a key, revisions increase by one on every change,
+// the changes of a transaction have the same revision.
+type event struct {
+	Type      string          `json:"type"`
+	Namespace string          `json:"namespace,omitempty"`
+	Key       string          `json:"key"`
+	Value     json.RawMessage `json:"value,omitempty"`
+	Revision  uint64          `json:"revision"`
+}
+
+// watcher receives the events of one key, or of all the keys, of
+// a namespace.
+type watcher struct {
+	// The watched namespace, empty for the default namespace.
+	namespace string
+
+	// The watched key, empty for all the keys.
+	key string
+
+	// Events sent to the watcher, closed when the watcher is dropped.
+	events chan event
+}
+
+// hub broadcasts key changes to watchers, and keeps a bounded history of
+// events for watchers catching up, it is safe for concurrent use.
+//
+// Publishing never blocks, a watcher whose buffer is full is dropped, and
+// its events channel is closed.
+type hub struct {
+	// Guards all the fields.
+	mu sync.Mutex
+
+	// Revision of the last event.
+	rev uint64
+
+	// Ring buffer of the last events, next is the index of the next event,
+	// and n is the number of events.
+	history []event
+	next    int
+	n       int
+
+	// Revision of the last event dropped from the history.
+	dropped uint64
+
+	watchers map[*watcher]struct{}
+	closed   bool
+
+	// The last revisions of each key, and the clock of their times.
+	keys *keyHistory
+	now  func() time.Time
+
+	// Called with every event, while holding the lock, it must not block,
+	// and must not use the hub.
+	notify func(e event)
+}
+
+func newHub(history int) *hub {
+	h := hub{
+		history:  make([]event, history),
+		watchers: make(map[*watcher]struct{}),
+		keys:     newKeyHistory(defaultHistoryRevisions, defaultHistoryMaxKeys),
+		now:      time.Now,
+	}
+
+	return &h
+}
+
+// publish sends an event to the watchers of its key, and records it in the
+// history of the key.
+func (h *hub) publish(namespace, typ, key string, value json.RawMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.rev++
+	h.publishLocked(event{Type: typ, Namespace: namespace, Key: key, Value: value, Revision: h.rev})
+}
+
+// publishTxn sends the events of a transaction, in a namespace, with the
+// same revision, and returns the revision.
+func (h *hub) publishTxn(namespace string, events []event) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.rev++
+	for _, e := range events {
+		e.Namespace = namespace
+		e.Revision = h.rev
+		h.publishLocked(e)
+	}
+
+	return h.rev
+}
+
+// publishLocked sends an event, and records it in the histories.
+func (h *hub) publishLocked(e event) {
+	h.keys.record(e, h.now())
+	if h.notify != nil {
+		h.notify(e)
+	}
+
+	if len(h.history) == 0 {
+		h.dropped = e.Revision
+	} else {
+		if h.n == len(h.history) {
+			h.dropped = h.history[h.next].Revision
+		}
+		h.history[h.next] = e
+		h.next = (h.next + 1) % len(h.history)
+		if h.n < len(h.history) {
+			h.n++
+		}
+	}
+
+	for w := range h.watchers {
+		if !w.matches(e) {
+			continue
+		}
+
+		select {
+		case w.events <- e:
+		default:
+			// A slow watcher must not block writers.
+			h.dropLocked(w)
+		}
+	}
+}
+
+// onPublish sets a function called with every event, it is called while
+// holding the hub lock, and must not block.
+func (h *hub) onPublish(fn func(e event)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.notify = fn
+}
+
+// revision returns the revision of the last event.
+func (h *hub) revision() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.rev
+}
+
+// subscribe adds a watcher of key, or of all the keys if key is empty, of
+// a namespace, and returns the events after revision since from the
+// history, events that are published later are sent to the watcher.
+//
+// If replay is true, and events after since are no longer in the history,
+// it returns a gone error.
+func (h *hub) subscribe(namespace, key string, since uint64, replay bool) (*watcher, []event, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil, nil, errWatchClosed
+	}
+
+	w := &watcher{namespace: namespace, key: key, events: make(chan event, watchBuffer)}
+
+	var events []event
+	if replay && since < h.rev {
+		// Events of a revision are dropped one by one, a revision with
+		// dropped events is no longer available.
+		if since < h.dropped {
+			return nil, nil, fmt.Errorf("revision %d is no longer available, oldest revision is %d", since, h.dropped+1)
+		}
+
+		for i := 0; i < h.n; i++ {
+			e := h.history[(h.next-h.n+i+len(h.history))%len(h.history)]
+			if e.Revision > since && w.matches(e) {
+				events = append(events, e)
+			}
+		}
+	}
+
+	h.watchers[w] = struct{}{}
+
+	return w, events, nil
+}
+
+// unsubscribe removes a watcher.
+func (h *hub) unsubscribe(w *watcher) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.dropLocked(w)
+}
+
+// Close drops all the watchers, and rejects new ones.
+func (h *hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for w := range h.watchers {
+		h.dropLocked(w)
+	}
+}
+
+// matches checks if an event is of the watched namespace and key.
+func (w *watcher) matches(e event) bool {
+	return e.Namespace == w.namespace && (w.key == "" || w.key == e.Key)
+}
+
+// dropLocked removes a watcher, and closes its events channel.
+func (h *hub) dropLocked(w *watcher) {
+	if _, ok := h.watchers[w]; !ok {
+		return
+	}
+
+	delete(h.watchers, w)
+	close(w.events)
+}
+
+// watch handles GET "/watch" and GET "/val/:key/watch" requests, streaming
+// the changes of all the keys, or of one key, as server-sent events if the
+// request accepts "text/event-stream", o/w as newline delimited JSON.
+//
+// An optional "since" query parameter replays the changes after a revision,
+// e.g. GET "/watch?since=42", if they are still in the history. Keys that
+// expire are not reported.
+func (h Handler) watch(w http.ResponseWriter, r *http.Request) {
+	key, _ := mux.Var(r, "key")
+
+	var since uint64
+	s := r.URL.Query().Get("since")
+	if s != "" {
+		var err error
+		since, err = strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			writeErr(w, http.StatusBadRequest, fmt.Sprintf("invalid since %s", s))
+			return
+		}
+	}
+
+	watcher, replay, err := h.hub.subscribe(h.namespace, key, since, s != "")
+	if err == errWatchClosed {
+		writeErr(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if err != nil {
+		writeErrCode(w, http.StatusGone, errCodeRevisionCompacted, err.Error())
+		return
+	}
+	defer h.hub.unsubscribe(watcher)
+
+	// Streams outlive the server write timeout.
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		mux.SSE(func(ctx context.Context, send func(event, data string) error) {
+			streamEvents(ctx, replay, watcher, func(e event) error {
+				data, err := json.Marshal(e)
+				if err != nil {
+					return err
+				}
+				return send(e.Type, string(data))
+			})
+		})(w, r)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	streamEvents(r.Context(), replay, watcher, func(e event) error {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(append(data, '\n')); err != nil {
+			return err
+		}
+		return rc.Flush()
+	})
+}
+
+// streamEvents sends the replayed events, then the events of a watcher,
+// until ctx is done, the watcher is dropped, or send fails.
+func streamEvents(ctx context.Context, replay []event, w *watcher, send func(event) error) {
+	for _, e := range replay {
+		if send(e) != nil {
+			return
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-w.events:
+			if !ok || send(e) != nil {
+				return
+			}
+		}
+	}
+}
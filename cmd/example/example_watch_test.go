@@ -0,0 +1,258 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// watchStream opens a watch stream on server, and returns a reader of its
+// lines.
+func watchStream(t *testing.T, ctx context.Context, url, accept string) *bufio.Reader {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	// Check the status code is what we expect.
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("watch returned wrong status code: got %v want %v", resp.StatusCode, http.StatusOK)
+	}
+
+	return bufio.NewReader(resp.Body)
+}
+
+// readEvent reads one newline delimited JSON event.
+func readEvent(t *testing.T, r *bufio.Reader) event {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var e event
+	if err := json.Unmarshal([]byte(line), &e); err != nil {
+		t.Fatalf("bad event %q: %v", line, err)
+	}
+
+	return e
+}
+
+// send sends a request to server.
+func send(t *testing.T, method, url, body string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestWatch(t *testing.T) {
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	all := watchStream(t, ctx, server.URL+"/watch", "")
+	kitty := watchStream(t, ctx, server.URL+"/val/kitty/watch", "")
+
+	send(t, "PUT", server.URL+"/val/kitty", "\"cat\"")
+	send(t, "PUT", server.URL+"/val/gorilla", "1")
+	send(t, "PATCH", server.URL+"/val/kitty", "{\"name\": \"tom\"}")
+	send(t, "DELETE", server.URL+"/val/kitty", "")
+
+	// Check the events of all the keys are in order.
+	expected := []string{
+		"{\"type\":\"created\",\"key\":\"kitty\",\"value\":\"cat\",\"revision\":1}",
+		"{\"type\":\"created\",\"key\":\"gorilla\",\"value\":1,\"revision\":2}",
+		"{\"type\":\"updated\",\"key\":\"kitty\",\"value\":{\"name\":\"tom\"},\"revision\":3}",
+		"{\"type\":\"deleted\",\"key\":\"kitty\",\"revision\":4}",
+	}
+	for _, want := range expected {
+		e, _ := json.Marshal(readEvent(t, all))
+		if string(e) != want {
+			t.Errorf("watch returned unexpected event: got %s want %s", e, want)
+		}
+	}
+
+	// Check the key watcher gets only the events of its key.
+	for _, want := range []uint64{1, 3, 4} {
+		if e := readEvent(t, kitty); e.Key != "kitty" || e.Revision != want {
+			t.Errorf("key watch returned unexpected event: got %+v want revision %d", e, want)
+		}
+	}
+}
+
+func TestWatchSince(t *testing.T) {
+	h := newHandler(newMemoryStore())
+	h.hub = newHub(2)
+	server := httptest.NewServer(newHandlerRouter(h))
+	defer server.Close()
+
+	send(t, "POST", server.URL+"/val", "{\"a\": 1}")
+	send(t, "PUT", server.URL+"/val/a", "2")
+	send(t, "PUT", server.URL+"/val/a", "3")
+
+	// Check missed events are replayed before new ones.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := watchStream(t, ctx, server.URL+"/watch?since=2", "")
+	send(t, "DELETE", server.URL+"/val/a", "")
+	for _, want := range []uint64{3, 4} {
+		if e := readEvent(t, stream); e.Revision != want {
+			t.Errorf("watch returned unexpected event: got %+v want revision %d", e, want)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		status   int
+		expected string
+	}{
+		{"since an evicted revision", "/watch?since=1", http.StatusGone,
+			"{\"error\":{\"code\":\"revision_compacted\",\"message\":\"revision 1 is no longer available, oldest revision is 3\"}}"},
+		{"invalid since", "/watch?since=soon", http.StatusBadRequest,
+			"{\"error\":{\"code\":\"bad_request\",\"message\":\"invalid since soon\"}}"},
+	}
+
+	for _, tt := range tests {
+		resp, err := http.Get(server.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := make([]byte, 256)
+		n, _ := resp.Body.Read(body)
+		resp.Body.Close()
+
+		// Check the status code is what we expect.
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				tt.name, resp.StatusCode, tt.status)
+		}
+
+		// Check the response body is what we expect.
+		if string(body[:n]) != tt.expected {
+			t.Errorf("%s: handler returned unexpected body: got %s want %v",
+				tt.name, body[:n], tt.expected)
+		}
+	}
+}
+
+func TestWatchSSE(t *testing.T) {
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := watchStream(t, ctx, server.URL+"/watch", "text/event-stream")
+
+	send(t, "PUT", server.URL+"/val/kitty", "\"cat\"")
+
+	expected := []string{
+		"event: created\n",
+		"data: {\"type\":\"created\",\"key\":\"kitty\",\"value\":\"cat\",\"revision\":1}\n",
+		"\n",
+	}
+	for _, want := range expected {
+		line, err := stream.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != want {
+			t.Errorf("watch returned unexpected line: got %q want %q", line, want)
+		}
+	}
+}
+
+func TestWatchDisconnect(t *testing.T) {
+	h := newHandler(newMemoryStore())
+	server := httptest.NewServer(newHandlerRouter(h))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	watchStream(t, ctx, server.URL+"/watch", "")
+	cancel()
+
+	// Check the watcher is removed once the client disconnects.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		h.hub.mu.Lock()
+		n := len(h.hub.watchers)
+		h.hub.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("watcher was not removed after the client disconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHubDropsSlowWatchers(t *testing.T) {
+	h := newHub(defaultWatchHistory)
+	slow, _, _ := h.subscribe("", "", 0, false)
+	other, _, _ := h.subscribe("", "gorilla", 0, false)
+
+	// Publishing must not block on a watcher that does not read.
+	for i := 0; i <= watchBuffer; i++ {
+		h.publish("", eventUpdated, "kitty", json.RawMessage(`1`))
+	}
+
+	n := 0
+	for range slow.events {
+		n++
+	}
+	if n != watchBuffer {
+		t.Errorf("slow watcher got %d events, want %d before it was dropped", n, watchBuffer)
+	}
+
+	// Check watchers of other keys are not dropped.
+	h.mu.Lock()
+	_, ok := h.watchers[other]
+	h.mu.Unlock()
+	if !ok {
+		t.Errorf("watcher of another key was dropped")
+	}
+
+	// Check closing the hub drops all the watchers, and rejects new ones.
+	h.Close()
+	if _, ok := <-other.events; ok {
+		t.Errorf("watcher was not dropped on Close")
+	}
+	if _, _, err := h.subscribe("", "", 0, false); err != errWatchClosed {
+		t.Errorf("subscribe after Close: got %v want %v", err, errWatchClosed)
+	}
+}
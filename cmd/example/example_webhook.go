@@ -0,0 +1,668 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yaacov/gokitty/pkg/mux"
+)
+
+// Webhooks are stored in the store of the default namespace, as compound
+// keys, webhookKeyPrefix + id. Keys starting with a NUL character are
+// reserved, and the keys of webhooks sort before the keys of namespaces, so
+// lists of the default namespace skip them.
+const webhookKeyPrefix = "\x00hooks/"
+
+// Webhook events, a put is a created, or updated, key, and a delete is
+// a deleted, or evicted, key.
+const (
+	webhookPut    = "put"
+	webhookDelete = "delete"
+)
+
+// Headers of webhook requests, the signature is "sha256=" and the hex
+// HMAC-SHA256 of the body, keyed by the secret of the webhook.
+const (
+	webhookSignatureHeader = "X-Kitty-Signature"
+	webhookEventHeader     = "X-Kitty-Event"
+	webhookDeliveryHeader  = "X-Kitty-Delivery"
+)
+
+// Statuses of deliveries, deliveries are dropped when the queue of their
+// webhook is full.
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+	deliveryDropped   = "dropped"
+)
+
+// Webhook defaults.
+const (
+	defaultWebhookWorkers  = 4
+	defaultWebhookQueue    = 256
+	defaultWebhookAttempts = 5
+	defaultWebhookBackoff  = 500 * time.Millisecond
+	defaultWebhookTimeout  = 10 * time.Second
+
+	// maxWebhookBackoff bounds the wait between attempts.
+	maxWebhookBackoff = time.Minute
+
+	// maxWebhookDeliveries is the number of deliveries kept of each webhook.
+	maxWebhookDeliveries = 100
+)
+
+// webhookOptions configures the delivery of webhooks.
+type webhookOptions struct {
+	// Workers is the number of deliveries sent at once, zero disables
+	// webhooks.
+	Workers int
+
+	// Queue is the number of deliveries waiting for each webhook, changes
+	// while the queue is full are dropped.
+	Queue int
+
+	// Attempts is the number of attempts of a delivery, the wait between
+	// attempts starts at Backoff, and doubles after every attempt.
+	Attempts int
+	Backoff  time.Duration
+
+	// Timeout is the timeout of a webhook request.
+	Timeout time.Duration
+}
+
+// webhook POSTs the changes of keys with a prefix, of a namespace, to
+// a URL.
+type webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Namespace string    `json:"namespace,omitempty"`
+	Prefix    string    `json:"prefix"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// validate checks the URL and the events of a webhook, a webhook without
+// events gets all the events.
+func (hook *webhook) validate() error {
+	u, err := url.Parse(hook.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url %q, want an http or https URL", hook.URL)
+	}
+
+	if len(hook.Events) == 0 {
+		hook.Events = []string{webhookPut, webhookDelete}
+	}
+	for _, e := range hook.Events {
+		if e != webhookPut && e != webhookDelete {
+			return fmt.Errorf("invalid event %q, want put or delete", e)
+		}
+	}
+
+	return nil
+}
+
+// matches returns the webhook event of a change, ok is false if the
+// webhook is not notified of the change.
+func (hook *webhook) matches(e event) (string, bool) {
+	if e.Namespace != hook.Namespace || !strings.HasPrefix(e.Key, hook.Prefix) {
+		return "", false
+	}
+
+	name := webhookPut
+	if e.Type == eventDeleted || e.Type == eventEvicted {
+		name = webhookDelete
+	}
+	for _, ev := range hook.Events {
+		if ev == name {
+			return name, true
+		}
+	}
+
+	return "", false
+}
+
+// redacted returns the webhook without its secret.
+func (hook webhook) redacted() webhook {
+	hook.Secret = ""
+	return hook
+}
+
+// webhookPayload is the body of a webhook request.
+type webhookPayload struct {
+	Webhook  string `json:"webhook"`
+	Delivery uint64 `json:"delivery"`
+	Event    string `json:"event"`
+	Change   event  `json:"change"`
+}
+
+// webhookDelivery is a change sent to a webhook, and the result of its
+// last attempt.
+type webhookDelivery struct {
+	ID         uint64    `json:"id"`
+	Event      string    `json:"event"`
+	Key        string    `json:"key"`
+	Revision   uint64    `json:"revision"`
+	Status     string    `json:"status"`
+	Attempts   int       `json:"attempts"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+
+	// The body of the requests.
+	body []byte
+}
+
+// webhookTarget is a registered webhook, its queue of deliveries, and its
+// last deliveries.
+type webhookTarget struct {
+	hook webhook
+
+	// Deliveries waiting for a worker.
+	queue []*webhookDelivery
+
+	// busy is true while the target is ready, or a worker delivers to it,
+	// one worker at a time delivers to a target, so deliveries are in
+	// order.
+	busy bool
+
+	// removed is true once the webhook is removed.
+	removed bool
+
+	// The last deliveries, oldest first.
+	deliveries []*webhookDelivery
+}
+
+// webhookDispatcher delivers the changes of keys to webhooks, it is safe
+// for concurrent use.
+//
+// Changes are queued for each webhook, without blocking, so writers never
+// wait for webhooks, and a bounded pool of workers POSTs them, retrying
+// failed attempts. Deliveries are kept in memory, deliveries that are
+// queued on Close are not sent.
+type webhookDispatcher struct {
+	store  Store
+	opts   webhookOptions
+	client *http.Client
+	now    func() time.Time
+
+	// Guards targets, ready, next and closed, and the deliveries of the
+	// targets.
+	mu      sync.Mutex
+	cond    *sync.Cond
+	targets map[string]*webhookTarget
+
+	// Targets with queued deliveries, waiting for a worker.
+	ready []*webhookTarget
+
+	// ID of the last delivery.
+	next   uint64
+	closed bool
+
+	// Canceled on Close, interrupting requests, and waits between attempts.
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// newWebhookStore returns the store of webhooks, in the store of the
+// default namespace.
+func newWebhookStore(root Store) Store {
+	return &namespaceStore{parent: root, prefix: webhookKeyPrefix}
+}
+
+// loadWebhooks returns the webhooks of a webhook store.
+func loadWebhooks(store Store) ([]webhook, error) {
+	vals, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	hooks := make([]webhook, 0, len(vals))
+	for id, v := range vals {
+		var hook webhook
+		if err := json.Unmarshal(v, &hook); err != nil {
+			return nil, fmt.Errorf("invalid webhook %s: %v", id, err)
+		}
+		hooks = append(hooks, hook)
+	}
+
+	return hooks, nil
+}
+
+// newWebhookDispatcher returns a dispatcher of webhooks, that are stored in
+// a webhook store.
+func newWebhookDispatcher(store Store, hooks []webhook, opts webhookOptions, now func() time.Time) *webhookDispatcher {
+	d := webhookDispatcher{
+		store:   store,
+		opts:    opts,
+		client:  &http.Client{Timeout: opts.Timeout},
+		now:     now,
+		targets: make(map[string]*webhookTarget, len(hooks)),
+	}
+	d.cond = sync.NewCond(&d.mu)
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	for _, hook := range hooks {
+		d.targets[hook.ID] = &webhookTarget{hook: hook}
+	}
+
+	return &d
+}
+
+// startWebhooks starts delivering the changes published by the hub of h to
+// webhooks, and sets the dispatcher of h.
+func startWebhooks(h *Handler, hooks []webhook, opts webhookOptions) *webhookDispatcher {
+	d := newWebhookDispatcher(newWebhookStore(h.root), hooks, opts, h.hub.now)
+	d.start()
+	h.hub.onPublish(d.publish)
+	h.webhooks = d
+
+	return d
+}
+
+// start starts the workers.
+func (d *webhookDispatcher) start() {
+	for i := 0; i < d.opts.Workers; i++ {
+		d.wg.Add(1)
+		go d.work()
+	}
+}
+
+// Close stops the workers, interrupting requests in flight, and waits for
+// them, changes published later are dropped.
+func (d *webhookDispatcher) Close() {
+	d.mu.Lock()
+	d.closed = true
+	d.cond.Broadcast()
+	d.mu.Unlock()
+
+	d.cancel()
+	d.wg.Wait()
+}
+
+// add stores a webhook, and starts delivering changes to it.
+func (d *webhookDispatcher) add(hook webhook) error {
+	data, err := json.Marshal(hook)
+	if err != nil {
+		return err
+	}
+	if err := d.store.Upsert(hook.ID, data); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.targets[hook.ID] = &webhookTarget{hook: hook}
+
+	return nil
+}
+
+// remove removes a webhook, and drops its queued deliveries, ok is false if
+// the webhook is missing.
+func (d *webhookDispatcher) remove(id string) (bool, error) {
+	ok, err := d.store.Delete(id)
+	if err != nil {
+		return false, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if t, found := d.targets[id]; found {
+		t.removed = true
+		t.queue = nil
+		delete(d.targets, id)
+		ok = true
+	}
+
+	return ok, nil
+}
+
+// get returns a webhook, without its secret.
+func (d *webhookDispatcher) get(id string) (webhook, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t, ok := d.targets[id]
+	if !ok {
+		return webhook{}, false
+	}
+
+	return t.hook.redacted(), true
+}
+
+// list returns the webhooks, without their secrets, oldest first.
+func (d *webhookDispatcher) list() []webhook {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	hooks := make([]webhook, 0, len(d.targets))
+	for _, t := range d.targets {
+		hooks = append(hooks, t.hook.redacted())
+	}
+	sort.Slice(hooks, func(i, j int) bool {
+		if !hooks[i].CreatedAt.Equal(hooks[j].CreatedAt) {
+			return hooks[i].CreatedAt.Before(hooks[j].CreatedAt)
+		}
+		return hooks[i].ID < hooks[j].ID
+	})
+
+	return hooks
+}
+
+// deliveries returns copies of the last deliveries of a webhook, newest
+// first, ok is false if the webhook is missing.
+func (d *webhookDispatcher) deliveries(id string) ([]webhookDelivery, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t, ok := d.targets[id]
+	if !ok {
+		return nil, false
+	}
+
+	deliveries := make([]webhookDelivery, len(t.deliveries))
+	for i, del := range t.deliveries {
+		deliveries[len(deliveries)-1-i] = *del
+	}
+
+	return deliveries, true
+}
+
+// publish queues a change for the webhooks it matches, a change is dropped
+// if the queue of a webhook is full. It never blocks.
+func (d *webhookDispatcher) publish(e event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return
+	}
+
+	now := d.now().UTC()
+	for _, t := range d.targets {
+		name, ok := t.hook.matches(e)
+		if !ok {
+			continue
+		}
+
+		d.next++
+		del := &webhookDelivery{
+			ID:        d.next,
+			Event:     name,
+			Key:       e.Key,
+			Revision:  e.Revision,
+			Status:    deliveryPending,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		t.deliveries = append(t.deliveries, del)
+		if len(t.deliveries) > maxWebhookDeliveries {
+			t.deliveries = append(t.deliveries[:0], t.deliveries[1:]...)
+		}
+
+		// A slow webhook must not block writers.
+		if len(t.queue) >= d.opts.Queue {
+			del.Status = deliveryDropped
+			del.Error = "queue is full"
+			continue
+		}
+		del.body, _ = json.Marshal(webhookPayload{Webhook: t.hook.ID, Delivery: del.ID, Event: name, Change: e})
+		t.queue = append(t.queue, del)
+		if !t.busy {
+			t.busy = true
+			d.ready = append(d.ready, t)
+			d.cond.Signal()
+		}
+	}
+}
+
+// work delivers the queued deliveries of ready targets, one delivery at
+// a time, until Close.
+func (d *webhookDispatcher) work() {
+	defer d.wg.Done()
+
+	for {
+		d.mu.Lock()
+		for len(d.ready) == 0 && !d.closed {
+			d.cond.Wait()
+		}
+		if d.closed {
+			d.mu.Unlock()
+			return
+		}
+		t := d.ready[0]
+		d.ready = d.ready[1:]
+		if t.removed || len(t.queue) == 0 {
+			t.busy = false
+			d.mu.Unlock()
+			continue
+		}
+		del := t.queue[0]
+		t.queue = t.queue[1:]
+		hook := t.hook
+		d.mu.Unlock()
+
+		d.deliver(hook, del)
+
+		// Targets with more deliveries wait behind the other ready
+		// targets, so a busy webhook doesn't hold a worker.
+		d.mu.Lock()
+		if !t.removed && len(t.queue) > 0 {
+			d.ready = append(d.ready, t)
+			d.cond.Signal()
+		} else {
+			t.busy = false
+		}
+		d.mu.Unlock()
+	}
+}
+
+// deliver POSTs a delivery to a webhook, retrying failed attempts with an
+// exponential backoff, and records the result of every attempt.
+func (d *webhookDispatcher) deliver(hook webhook, del *webhookDelivery) {
+	backoff := d.opts.Backoff
+	for attempt := 1; ; attempt++ {
+		code, err := d.post(hook, del)
+
+		d.mu.Lock()
+		del.Attempts = attempt
+		del.StatusCode = code
+		del.Error = ""
+		del.UpdatedAt = d.now().UTC()
+		switch {
+		case err == nil:
+			del.Status = deliveryDelivered
+		case attempt >= d.opts.Attempts:
+			del.Status = deliveryFailed
+		}
+		if err != nil {
+			del.Error = err.Error()
+		}
+		d.mu.Unlock()
+
+		if err == nil || attempt >= d.opts.Attempts {
+			return
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-d.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if backoff *= 2; backoff > maxWebhookBackoff {
+			backoff = maxWebhookBackoff
+		}
+	}
+}
+
+// post sends a delivery to a webhook, it fails if the webhook doesn't
+// respond with a 2xx status code.
+func (d *webhookDispatcher) post(hook webhook, del *webhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodPost, hook.URL, bytes.NewReader(del.body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", jsonContentType)
+	req.Header.Set(webhookEventHeader, del.Event)
+	req.Header.Set(webhookDeliveryHeader, strconv.FormatUint(del.ID, 10))
+	req.Header.Set(webhookSignatureHeader, webhookSignature(hook.Secret, del.body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook responded %s", resp.Status)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// webhookSignature returns the signature header of a body, signed with
+// a secret.
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// randomHex returns n random bytes, hex encoded.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// postWebhook handles POST "/webhooks" requests, registering a webhook, and
+// writing it, e.g. {"url": "https://example.com/hook", "prefix": "app1/",
+// "events": ["put"], "secret": "s3cret"}. A webhook without a secret gets
+// a random secret, the secret is written only once.
+func (h Handler) postWebhook(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		URL       string   `json:"url"`
+		Namespace string   `json:"namespace"`
+		Prefix    string   `json:"prefix"`
+		Events    []string `json:"events"`
+		Secret    string   `json:"secret"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&body); err != nil {
+		writeErrCode(w, http.StatusBadRequest, errCodeBadJSON, err.Error())
+		return
+	}
+
+	hook := webhook{
+		ID:        randomHex(8),
+		URL:       body.URL,
+		Namespace: body.Namespace,
+		Prefix:    body.Prefix,
+		Events:    body.Events,
+		Secret:    body.Secret,
+		CreatedAt: h.hub.now().UTC(),
+	}
+	if err := hook.validate(); err != nil {
+		writeErr(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if hook.Secret == "" {
+		hook.Secret = randomHex(32)
+	}
+	if err := h.webhooks.add(hook); err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+
+	w.Header().Set("Location", apiVersion+"/webhooks/"+hook.ID)
+	writeJSONStatus(w, http.StatusCreated, hook)
+}
+
+// getWebhooks handles GET "/webhooks" requests, writing the webhooks,
+// without their secrets.
+func (h Handler) getWebhooks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string][]webhook{"webhooks": h.webhooks.list()})
+}
+
+// getWebhook handles GET "/webhooks/:id" requests, writing a webhook,
+// without its secret.
+func (h Handler) getWebhook(w http.ResponseWriter, r *http.Request) {
+	id, _ := mux.Var(r, "id")
+	hook, ok := h.webhooks.get(id)
+	if !ok {
+		writeErr(w, http.StatusNotFound, fmt.Sprintf("can't find webhook %s", id))
+		return
+	}
+
+	writeJSON(w, hook)
+}
+
+// deleteWebhook handles DELETE "/webhooks/:id" requests, removing
+// a webhook.
+func (h Handler) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, _ := mux.Var(r, "id")
+	ok, err := h.webhooks.remove(id)
+	if err != nil {
+		writeStoreErr(w, err)
+		return
+	}
+	if !ok {
+		writeErr(w, http.StatusNotFound, fmt.Sprintf("can't find webhook %s", id))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getWebhookDeliveries handles GET "/webhooks/:id/deliveries" requests,
+// writing the last deliveries of a webhook, newest first.
+func (h Handler) getWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	id, _ := mux.Var(r, "id")
+	deliveries, ok := h.webhooks.deliveries(id)
+	if !ok {
+		writeErr(w, http.StatusNotFound, fmt.Sprintf("can't find webhook %s", id))
+		return
+	}
+
+	writeJSON(w, map[string][]webhookDelivery{"deliveries": deliveries})
+}
@@ -0,0 +1,360 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testWebhookOptions are webhook options with short waits between attempts.
+func testWebhookOptions() webhookOptions {
+	return webhookOptions{
+		Workers:  2,
+		Queue:    16,
+		Attempts: 3,
+		Backoff:  time.Millisecond,
+		Timeout:  5 * time.Second,
+	}
+}
+
+// newWebhookRouter returns the handler, and the router, of an in-memory
+// store, delivering changes to webhooks.
+func newWebhookRouter(t *testing.T, opts webhookOptions) (*Handler, http.Handler) {
+	h := newHandler(newMemoryStore())
+	d := startWebhooks(h, nil, opts)
+	t.Cleanup(d.Close)
+
+	return h, newHandlerRouter(h)
+}
+
+// webhookRequest is a request received by a webhook.
+type webhookRequest struct {
+	header  http.Header
+	body    []byte
+	payload webhookPayload
+}
+
+// newWebhookServer returns a server of webhooks, sending the requests it
+// receives to a channel, and responding with the status code of respond.
+func newWebhookServer(t *testing.T, respond func(r *http.Request) int) (*httptest.Server, chan webhookRequest) {
+	received := make(chan webhookRequest, 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req := webhookRequest{header: r.Header, body: body}
+		if err := json.Unmarshal(body, &req.payload); err != nil {
+			t.Errorf("invalid webhook payload %s: %v", body, err)
+		}
+		received <- req
+		w.WriteHeader(respond(r))
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, received
+}
+
+// registerWebhook registers a webhook, and returns it, with its secret.
+func registerWebhook(t *testing.T, handler http.Handler, body string) webhook {
+	rr := serve(t, handler, "POST", "/webhooks", body, "")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("POST /webhooks %s: got %v %s", body, rr.Code, rr.Body.String())
+	}
+
+	var hook webhook
+	if err := json.Unmarshal(rr.Body.Bytes(), &hook); err != nil {
+		t.Fatal(err)
+	}
+
+	return hook
+}
+
+// webhookDeliveries returns the deliveries of a webhook.
+func webhookDeliveries(t *testing.T, handler http.Handler, id string) []webhookDelivery {
+	rr := serve(t, handler, "GET", "/webhooks/"+id+"/deliveries", "", "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("GET deliveries of %s: got %v %s", id, rr.Code, rr.Body.String())
+	}
+
+	var body struct {
+		Deliveries []webhookDelivery `json:"deliveries"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+
+	return body.Deliveries
+}
+
+// waitDeliveries waits until a webhook has n deliveries that are done, and
+// returns them.
+func waitDeliveries(t *testing.T, handler http.Handler, id string, n int) []webhookDelivery {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		deliveries := webhookDeliveries(t, handler, id)
+		done := len(deliveries) == n
+		for _, del := range deliveries {
+			done = done && del.Status != deliveryPending
+		}
+		if done {
+			return deliveries
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("deliveries of %s are not done: %+v", id, deliveries)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	_, handler := newWebhookRouter(t, testWebhookOptions())
+	srv, received := newWebhookServer(t, func(r *http.Request) int { return http.StatusOK })
+
+	puts := registerWebhook(t, handler, `{"url": "`+srv.URL+`", "prefix": "app1/", "events": ["put"], "secret": "s3cret"}`)
+	deletes := registerWebhook(t, handler, `{"url": "`+srv.URL+`", "namespace": "team", "events": ["delete"]}`)
+
+	// Check the secret is written, and generated if it is missing.
+	if puts.Secret != "s3cret" || len(deletes.Secret) != 64 {
+		t.Errorf("unexpected secrets: %q, %q", puts.Secret, deletes.Secret)
+	}
+
+	for _, tt := range []struct{ method, path, body string }{
+		{"PUT", "/val/app1%2Fa", `{"n":1}`},
+		{"PUT", "/val/other", `1`},
+		{"DELETE", "/val/app1%2Fa", ""},
+		{"PUT", "/ns/team/val/x", `2`},
+		{"DELETE", "/ns/team/val/x", ""},
+	} {
+		if rr := serve(t, handler, tt.method, tt.path, tt.body, ""); rr.Code >= 300 {
+			t.Fatalf("%s %s: got %v %s", tt.method, tt.path, rr.Code, rr.Body.String())
+		}
+	}
+
+	// Check each webhook got the changes it matches, signed by its secret.
+	for _, del := range append(waitDeliveries(t, handler, puts.ID, 1), waitDeliveries(t, handler, deletes.ID, 1)...) {
+		if del.Status != deliveryDelivered || del.Attempts != 1 || del.StatusCode != http.StatusOK {
+			t.Errorf("unexpected delivery: %+v", del)
+		}
+	}
+	expected := map[string]struct {
+		secret, event, namespace, key, typ, value string
+	}{
+		puts.ID:    {"s3cret", webhookPut, "", "app1/a", eventCreated, `{"n":1}`},
+		deletes.ID: {deletes.Secret, webhookDelete, "team", "x", eventDeleted, ``},
+	}
+	for i := 0; i < 2; i++ {
+		req := <-received
+		want, ok := expected[req.payload.Webhook]
+		if !ok {
+			t.Errorf("unexpected webhook request: %s", req.body)
+			continue
+		}
+		delete(expected, req.payload.Webhook)
+
+		if got := req.header.Get(webhookSignatureHeader); got != webhookSignature(want.secret, req.body) {
+			t.Errorf("%s: wrong signature %q", req.payload.Webhook, got)
+		}
+		if req.header.Get(webhookEventHeader) != want.event || req.payload.Event != want.event {
+			t.Errorf("%s: wrong event %q, %q want %q",
+				req.payload.Webhook, req.header.Get(webhookEventHeader), req.payload.Event, want.event)
+		}
+		c := req.payload.Change
+		if c.Namespace != want.namespace || c.Key != want.key || c.Type != want.typ || string(c.Value) != want.value {
+			t.Errorf("%s: unexpected change %+v", req.payload.Webhook, c)
+		}
+	}
+	select {
+	case req := <-received:
+		t.Errorf("unexpected webhook request: %s", req.body)
+	default:
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	_, handler := newWebhookRouter(t, testWebhookOptions())
+
+	// The flaky webhook fails twice, the down webhook always fails.
+	var flaky int32
+	srv, _ := newWebhookServer(t, func(r *http.Request) int {
+		if r.URL.Path == "/flaky" && atomic.AddInt32(&flaky, 1) > 2 {
+			return http.StatusOK
+		}
+		return http.StatusServiceUnavailable
+	})
+	flakyHook := registerWebhook(t, handler, `{"url": "`+srv.URL+`/flaky"}`)
+	downHook := registerWebhook(t, handler, `{"url": "`+srv.URL+`/down"}`)
+
+	serve(t, handler, "PUT", "/val/kitty", `"cat"`, "")
+
+	// Check failed attempts are retried, up to the number of attempts.
+	del := waitDeliveries(t, handler, flakyHook.ID, 1)[0]
+	if del.Status != deliveryDelivered || del.Attempts != 3 || del.StatusCode != http.StatusOK || del.Error != "" {
+		t.Errorf("unexpected delivery of the flaky webhook: %+v", del)
+	}
+	del = waitDeliveries(t, handler, downHook.ID, 1)[0]
+	if del.Status != deliveryFailed || del.Attempts != 3 || del.StatusCode != http.StatusServiceUnavailable ||
+		!strings.Contains(del.Error, "503") {
+		t.Errorf("unexpected delivery of the down webhook: %+v", del)
+	}
+	if del.Event != webhookPut || del.Key != "kitty" || del.Revision == 0 {
+		t.Errorf("unexpected delivery change: %+v", del)
+	}
+}
+
+func TestWebhookSlowTarget(t *testing.T) {
+	opts := testWebhookOptions()
+	opts.Queue = 4
+	_, handler := newWebhookRouter(t, opts)
+
+	release := make(chan struct{})
+	defer close(release)
+	slow, _ := newWebhookServer(t, func(r *http.Request) int {
+		<-release
+		return http.StatusOK
+	})
+	fast, _ := newWebhookServer(t, func(r *http.Request) int { return http.StatusOK })
+	slowHook := registerWebhook(t, handler, `{"url": "`+slow.URL+`", "prefix": "slow/"}`)
+	fastHook := registerWebhook(t, handler, `{"url": "`+fast.URL+`", "prefix": "fast/"}`)
+
+	// Check mutations don't wait for a webhook that doesn't respond.
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		if rr := serve(t, handler, "PUT", "/val/slow%2Fkitty", strconv.Itoa(i), ""); rr.Code >= 300 {
+			t.Fatalf("PUT: got %v %s", rr.Code, rr.Body.String())
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("mutations waited for a slow webhook, took %v", elapsed)
+	}
+
+	// Check changes exceeding the queue are dropped.
+	dropped := 0
+	for _, del := range webhookDeliveries(t, handler, slowHook.ID) {
+		if del.Status == deliveryDropped {
+			dropped++
+		}
+	}
+	if dropped < 20-opts.Queue-1 {
+		t.Errorf("expected dropped deliveries, got %d", dropped)
+	}
+
+	// Check other webhooks are delivered while the slow webhook holds
+	// a worker.
+	serve(t, handler, "PUT", "/val/fast%2Fkitty", `1`, "")
+	if del := waitDeliveries(t, handler, fastHook.ID, 1)[0]; del.Status != deliveryDelivered {
+		t.Errorf("unexpected delivery of the fast webhook: %+v", del)
+	}
+}
+
+func TestWebhookClose(t *testing.T) {
+	h, handler := newWebhookRouter(t, testWebhookOptions())
+
+	release := make(chan struct{})
+	defer close(release)
+	srv, received := newWebhookServer(t, func(r *http.Request) int {
+		<-release
+		return http.StatusOK
+	})
+	hook := registerWebhook(t, handler, `{"url": "`+srv.URL+`"}`)
+	serve(t, handler, "PUT", "/val/kitty", `1`, "")
+	<-received
+
+	// Check closing interrupts requests in flight, and drops later changes.
+	done := make(chan struct{})
+	go func() {
+		h.webhooks.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close is waiting for a webhook request")
+	}
+	serve(t, handler, "PUT", "/val/kitty", `2`, "")
+	if deliveries := webhookDeliveries(t, handler, hook.ID); len(deliveries) != 1 {
+		t.Errorf("unexpected deliveries after Close: %+v", deliveries)
+	}
+}
+
+func TestWebhookRegistration(t *testing.T) {
+	h, handler := newWebhookRouter(t, testWebhookOptions())
+
+	// Check invalid webhooks are rejected.
+	for _, body := range []string{
+		`{"url": "ftp://example.com"}`,
+		`{"url": "kitty"}`,
+		`{"url": "http://example.com", "events": ["patch"]}`,
+		`{"url": "http://example.com", "id": "mine"}`,
+		`kitty`,
+	} {
+		if rr := serve(t, handler, "POST", "/webhooks", body, ""); rr.Code != http.StatusBadRequest {
+			t.Errorf("POST /webhooks %s: got %v want %v", body, rr.Code, http.StatusBadRequest)
+		}
+	}
+
+	hook := registerWebhook(t, handler, `{"url": "http://example.com/hook"}`)
+	if len(hook.Events) != 2 || hook.ID == "" {
+		t.Errorf("unexpected webhook: %+v", hook)
+	}
+
+	// Check secrets are not written after the webhook is registered.
+	for _, path := range []string{"/webhooks", "/webhooks/" + hook.ID} {
+		rr := serve(t, handler, "GET", path, "", "")
+		if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), hook.ID) || strings.Contains(rr.Body.String(), "secret") {
+			t.Errorf("GET %s: got %v %s", path, rr.Code, rr.Body.String())
+		}
+	}
+
+	// Check webhooks are stored, and hidden from the keys of the default
+	// namespace.
+	for _, path := range []string{"/val", "/export", "/ns"} {
+		if rr := serve(t, handler, "GET", path, "", ""); strings.Contains(rr.Body.String(), hook.ID) {
+			t.Errorf("GET %s: webhook is not hidden: %s", path, rr.Body.String())
+		}
+	}
+	hooks, err := loadWebhooks(newWebhookStore(h.root))
+	if err != nil || len(hooks) != 1 || hooks[0].ID != hook.ID || hooks[0].Secret != hook.Secret {
+		t.Errorf("loadWebhooks: got %+v, %v", hooks, err)
+	}
+
+	// Check removed webhooks are missing.
+	if rr := serve(t, handler, "DELETE", "/webhooks/"+hook.ID, "", ""); rr.Code != http.StatusNoContent {
+		t.Errorf("DELETE: got %v %s", rr.Code, rr.Body.String())
+	}
+	for _, tt := range []struct{ method, path string }{
+		{"DELETE", "/webhooks/" + hook.ID},
+		{"GET", "/webhooks/" + hook.ID},
+		{"GET", "/webhooks/" + hook.ID + "/deliveries"},
+	} {
+		if rr := serve(t, handler, tt.method, tt.path, "", ""); rr.Code != http.StatusNotFound {
+			t.Errorf("%s %s: got %v want %v", tt.method, tt.path, rr.Code, http.StatusNotFound)
+		}
+	}
+	if hooks, _ := loadWebhooks(newWebhookStore(h.root)); len(hooks) != 0 {
+		t.Errorf("removed webhook is stored: %+v", hooks)
+	}
+
+	// Check webhooks are not served when they are disabled.
+	if rr := serve(t, newRouter(), "POST", "/webhooks", `{"url": "http://example.com"}`, ""); rr.Code != http.StatusNotFound {
+		t.Errorf("POST /webhooks without webhooks: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
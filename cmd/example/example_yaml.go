@@ -0,0 +1,376 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// yamlContentType is the Content-Type of YAML responses.
+const yamlContentType = "application/yaml"
+
+// Bounds of YAML documents converted to JSON, aliases may nest, or expand
+// a small document into a large value.
+const (
+	maxYAMLDepth = 128
+	maxYAMLBytes = 32 << 20
+)
+
+// jsonNumber matches numbers that are valid JSON.
+var jsonNumber = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][-+]?[0-9]+)?$`)
+
+// isYAML checks if a media type is a YAML media type.
+func isYAML(mediaType string) bool {
+	switch mediaType {
+	case yamlContentType, "application/x-yaml", "text/yaml", "text/x-yaml":
+		return true
+	}
+
+	return false
+}
+
+// acceptsYAML checks if the Accept header of a request prefers YAML to
+// JSON, JSON is preferred if both have the same quality.
+func acceptsYAML(r *http.Request) bool {
+	yamlQ, jsonQ := 0.0, 0.0
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(mediaRange)
+			if err != nil {
+				continue
+			}
+			q := 1.0
+			if s, ok := params["q"]; ok {
+				if q, err = strconv.ParseFloat(s, 64); err != nil {
+					continue
+				}
+			}
+
+			if isYAML(mediaType) {
+				yamlQ = math.Max(yamlQ, q)
+			} else if mediaType == jsonContentType {
+				jsonQ = math.Max(jsonQ, q)
+			}
+		}
+	}
+
+	return yamlQ > jsonQ
+}
+
+// negotiate returns a handler calling handle, that reads YAML request
+// bodies, and writes JSON responses as YAML if the request accepts YAML,
+// handlers read and write JSON.
+//
+// Request bodies with a YAML Content-Type are converted to JSON, YAML
+// numbers, and nested maps, keep their JSON types. Responses that are not
+// JSON, e.g. watch streams, are written as is, and HEAD responses describe
+// the JSON response.
+func negotiate(handle func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+		if r.Method != http.MethodHead && acceptsYAML(r) {
+			yw := &yamlWriter{ResponseWriter: w}
+			defer yw.finish()
+			w = yw
+		}
+
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); isYAML(mediaType) {
+			data, err := io.ReadAll(r.Body)
+			if err == nil {
+				data, err = yamlToJSON(data)
+			}
+			if err != nil {
+				writeErrCode(w, http.StatusBadRequest, errCodeBadYAML, err.Error())
+				return
+			}
+
+			r.Body = io.NopCloser(bytes.NewReader(data))
+			r.ContentLength = int64(len(data))
+			r.Header.Set("Content-Type", jsonContentType)
+		}
+
+		handle(w, r)
+	}
+}
+
+// yamlWriter is a response writer, that buffers JSON responses, and writes
+// them as YAML on finish, other responses are written through.
+type yamlWriter struct {
+	http.ResponseWriter
+
+	// The status code, and the buffered body, nil if the response is
+	// written through.
+	code        int
+	buf         *bytes.Buffer
+	wroteHeader bool
+}
+
+// WriteHeader buffers JSON responses, and writes other responses through.
+func (w *yamlWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	mediaType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if mediaType == jsonContentType && code != http.StatusNotModified {
+		w.code = code
+		w.buf = &bytes.Buffer{}
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write buffers JSON responses, and writes other responses through.
+func (w *yamlWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.buf != nil {
+		return w.buf.Write(b)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush flushes responses that are written through.
+func (w *yamlWriter) Flush() {
+	if w.buf == nil {
+		http.NewResponseController(w.ResponseWriter).Flush()
+	}
+}
+
+// Unwrap returns the wrapped response writer, for http.ResponseController.
+func (w *yamlWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// finish writes a buffered JSON response as YAML, or as JSON if it can't
+// be converted.
+func (w *yamlWriter) finish() {
+	if w.buf == nil {
+		return
+	}
+
+	body := w.buf.Bytes()
+	if data, err := jsonToYAML(body); err == nil {
+		body = data
+		w.Header().Set("Content-Type", yamlContentType)
+	}
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(w.code)
+	w.ResponseWriter.Write(body)
+}
+
+// yamlToJSON converts the first document of a YAML stream to compact JSON.
+func yamlToJSON(data []byte) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		return nil, fmt.Errorf("empty YAML document")
+	}
+
+	var buf bytes.Buffer
+	if err := writeNodeJSON(&buf, doc.Content[0], 0); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// writeNodeJSON writes a YAML node as JSON, numbers are written as is, if
+// they are valid JSON numbers, so large integers keep their precision.
+func writeNodeJSON(buf *bytes.Buffer, n *yaml.Node, depth int) error {
+	if depth > maxYAMLDepth {
+		return fmt.Errorf("YAML document is nested deeper than %d levels", maxYAMLDepth)
+	}
+	if buf.Len() > maxYAMLBytes {
+		return fmt.Errorf("YAML document expands to more than %d bytes", maxYAMLBytes)
+	}
+
+	switch n.Kind {
+	case yaml.AliasNode:
+		return writeNodeJSON(buf, n.Alias, depth+1)
+	case yaml.MappingNode:
+		buf.WriteByte('{')
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i]
+			if key.Kind != yaml.ScalarNode || key.ShortTag() == "!!merge" {
+				return fmt.Errorf("line %d: YAML keys must be scalars", key.Line)
+			}
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			k, _ := json.Marshal(key.Value)
+			buf.Write(k)
+			buf.WriteByte(':')
+			if err := writeNodeJSON(buf, n.Content[i+1], depth+1); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case yaml.SequenceNode:
+		buf.WriteByte('[')
+		for i, c := range n.Content {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeNodeJSON(buf, c, depth+1); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case yaml.ScalarNode:
+		return writeScalarJSON(buf, n)
+	default:
+		return fmt.Errorf("line %d: unexpected YAML node", n.Line)
+	}
+
+	return nil
+}
+
+// writeScalarJSON writes a YAML scalar as JSON, by its resolved tag.
+func writeScalarJSON(buf *bytes.Buffer, n *yaml.Node) error {
+	switch n.ShortTag() {
+	case "!!null":
+		buf.WriteString("null")
+	case "!!bool":
+		var b bool
+		if err := n.Decode(&b); err != nil {
+			return err
+		}
+		buf.WriteString(strconv.FormatBool(b))
+	case "!!int":
+		if jsonNumber.MatchString(n.Value) {
+			buf.WriteString(n.Value)
+			break
+		}
+
+		// Hexadecimal, octal and binary integers, or integers with
+		// a sign or underscores.
+		i, ok := new(big.Int).SetString(strings.ReplaceAll(n.Value, "_", ""), 0)
+		if !ok {
+			return fmt.Errorf("line %d: invalid YAML integer %s", n.Line, n.Value)
+		}
+		buf.WriteString(i.String())
+	case "!!float":
+		if jsonNumber.MatchString(n.Value) {
+			buf.WriteString(n.Value)
+			break
+		}
+
+		var f float64
+		if err := n.Decode(&f); err != nil {
+			return err
+		}
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return fmt.Errorf("line %d: JSON has no %s number", n.Line, n.Value)
+		}
+		buf.WriteString(strconv.FormatFloat(f, 'g', -1, 64))
+	default:
+		// Strings, and timestamps and binary values, as strings.
+		s, _ := json.Marshal(n.Value)
+		buf.Write(s)
+	}
+
+	return nil
+}
+
+// jsonToYAML converts a JSON value to YAML, objects keep the order of their
+// members, and numbers are written as is.
+func jsonToYAML(data []byte) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+
+	n, err := jsonNode(d)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	e := yaml.NewEncoder(&buf)
+	e.SetIndent(2)
+	if err := e.Encode(n); err != nil {
+		return nil, err
+	}
+	if err := e.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// jsonNode reads the next JSON value of a decoder as a YAML node.
+func jsonNode(d *json.Decoder) (*yaml.Node, error) {
+	tok, err := d.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t := tok.(type) {
+	case json.Delim:
+		n := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		if t == '{' {
+			n = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		}
+		for d.More() {
+			if n.Kind == yaml.MappingNode {
+				key, err := d.Token()
+				if err != nil {
+					return nil, err
+				}
+				n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key.(string)})
+			}
+			c, err := jsonNode(d)
+			if err != nil {
+				return nil, err
+			}
+			n.Content = append(n.Content, c)
+		}
+
+		// Read the closing delimiter.
+		if _, err := d.Token(); err != nil {
+			return nil, err
+		}
+		return n, nil
+	case json.Number:
+		tag := "!!float"
+		if _, ok := new(big.Int).SetString(t.String(), 10); ok {
+			tag = "!!int"
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: t.String()}, nil
+	case string:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: t}, nil
+	case bool:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: strconv.FormatBool(t)}, nil
+	}
+
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}, nil
+}
@@ -0,0 +1,147 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// serveYAML sends a request to handler, with optional Content-Type and
+// Accept headers.
+func serveYAML(t *testing.T, handler http.Handler, method, path, body, contentType, accept string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	return rr
+}
+
+func TestYAML(t *testing.T) {
+	handler := newRouter()
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		body        string
+		contentType string
+		accept      string
+		status      int
+		expected    string
+	}{
+		{"put yaml", "PUT", "/v1/val/kitty",
+			"name: tom\nlives: 9\nweight: 4.50\nbig: 12345678901234567890\nhex: 0x1F\n" +
+				"tags: [grey, \"123\"]\nowner: {name: jerry, age: null}\nindoor: true\n",
+			"application/yaml", "", http.StatusCreated,
+			"{\"kitty\":{\"name\":\"tom\",\"lives\":9,\"weight\":4.50,\"big\":12345678901234567890,\"hex\":31," +
+				"\"tags\":[\"grey\",\"123\"],\"owner\":{\"name\":\"jerry\",\"age\":null},\"indoor\":true}}"},
+		{"get json", "GET", "/v1/val/kitty", "", "", "", http.StatusOK,
+			"{\"kitty\":{\"name\":\"tom\",\"lives\":9,\"weight\":4.50,\"big\":12345678901234567890,\"hex\":31," +
+				"\"tags\":[\"grey\",\"123\"],\"owner\":{\"name\":\"jerry\",\"age\":null},\"indoor\":true}}"},
+		{"get yaml", "GET", "/v1/val/kitty", "", "", "application/yaml", http.StatusOK,
+			"kitty:\n  name: tom\n  lives: 9\n  weight: 4.50\n  big: 12345678901234567890\n  hex: 31\n" +
+				"  tags:\n    - grey\n    - \"123\"\n  owner:\n    name: jerry\n    age: null\n  indoor: true\n"},
+		{"post yaml", "POST", "/v1/val", "a: 1\nb: [1.5e3, -2]\n", "text/yaml; charset=utf-8", "",
+			http.StatusCreated, "{\"a\":1,\"b\":[1.5e3,-2]}"},
+		{"get all yaml", "GET", "/v1/val?prefix=a", "", "", "application/json;q=0.5, application/yaml",
+			http.StatusOK, "items:\n  a: 1\n"},
+		{"json is preferred", "GET", "/v1/val/a", "", "", "application/yaml, application/json",
+			http.StatusOK, "{\"a\":1}"},
+		{"missing yaml", "GET", "/v1/val/dog", "", "", "application/yaml", http.StatusNotFound,
+			"error:\n  code: key_not_found\n  message: can't find key dog\n"},
+		{"bad yaml", "PUT", "/v1/val/kitty", "a: [1", "application/yaml", "", http.StatusBadRequest,
+			"{\"error\":{\"code\":\"bad_yaml\",\"message\":\"yaml: line 1: did not find expected ',' or ']'\"}}"},
+		{"infinity", "PUT", "/v1/val/kitty", ".inf", "application/yaml", "", http.StatusBadRequest,
+			"{\"error\":{\"code\":\"bad_yaml\",\"message\":\"line 1: JSON has no .inf number\"}}"},
+		{"complex key", "PUT", "/v1/val/kitty", "? [a]\n: 1\n", "application/yaml", "", http.StatusBadRequest,
+			"{\"error\":{\"code\":\"bad_yaml\",\"message\":\"line 1: YAML keys must be scalars\"}}"},
+		{"empty", "PUT", "/v1/val/kitty", "", "application/yaml", "", http.StatusBadRequest,
+			"{\"error\":{\"code\":\"bad_yaml\",\"message\":\"empty YAML document\"}}"},
+	}
+	for _, tt := range tests {
+		rr := serveYAML(t, handler, tt.method, tt.path, tt.body, tt.contentType, tt.accept)
+
+		// Check the status code is what we expect.
+		if rr.Code != tt.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				tt.name, rr.Code, tt.status)
+		}
+
+		// Check the response body is what we expect.
+		if rr.Body.String() != tt.expected {
+			t.Errorf("%s: handler returned unexpected body: got %q want %q",
+				tt.name, rr.Body.String(), tt.expected)
+		}
+
+		// Check the content type is what we expect.
+		contentType := jsonContentType
+		if strings.HasSuffix(tt.expected, "\n") {
+			contentType = yamlContentType
+		}
+		if got := rr.Header().Get("Content-Type"); got != contentType {
+			t.Errorf("%s: handler returned Content-Type %q want %q", tt.name, got, contentType)
+		}
+		if got := rr.Header().Get("Vary"); got != "Accept" {
+			t.Errorf("%s: handler returned Vary %q want Accept", tt.name, got)
+		}
+	}
+}
+
+func TestYAMLRoundTrip(t *testing.T) {
+	for _, v := range []string{
+		`{"a":{"b":{"c":[1,2.5,-3e-7,{"d":null}]}},"e":"true","f":"1.0","g":""}`,
+		`[123456789012345678901234567890,0.1000,"multi\nline","- dash",": colon"]`,
+		`"string"`,
+		`{}`,
+		`[]`,
+		`null`,
+	} {
+		y, err := jsonToYAML([]byte(v))
+		if err != nil {
+			t.Errorf("jsonToYAML %s: %v", v, err)
+			continue
+		}
+
+		// Check JSON converted to YAML and back keeps the types and order.
+		j, err := yamlToJSON(y)
+		if err != nil || string(j) != v {
+			t.Errorf("round trip of %s: got %s, %v, yaml was %q", v, j, err, y)
+		}
+	}
+}
+
+func TestYAMLAliases(t *testing.T) {
+	// Check aliases are expanded, and recursive aliases fail.
+	j, err := yamlToJSON([]byte("a: &cat {name: tom}\nb: *cat\n"))
+	if err != nil || string(j) != `{"a":{"name":"tom"},"b":{"name":"tom"}}` {
+		t.Errorf("yamlToJSON with an alias: got %s, %v", j, err)
+	}
+	if j, err := yamlToJSON([]byte("a: &a [*a]\n")); err == nil {
+		t.Errorf("yamlToJSON with a recursive alias: got %s want an error", j)
+	}
+}
@@ -0,0 +1,152 @@
+// Kitty web UI, browses and edits values using the /v1 API.
+"use strict";
+
+const pageLimit = 50;
+
+const $ = (id) => document.getElementById(id);
+
+let token = sessionStorage.getItem("kitty-token") || "";
+let cursor = "";
+
+// showError shows an error, or hides it if err is null.
+function showError(err) {
+  $("error").textContent = err ? err.message : "";
+  $("error").hidden = !err;
+}
+
+// askToken prompts for the write token, it's kept for the browser session.
+function askToken() {
+  const t = prompt("Write token", token);
+  if (t === null) {
+    return false;
+  }
+  token = t;
+  sessionStorage.setItem("kitty-token", token);
+  return true;
+}
+
+// api sends a request, and returns its JSON body, failing with the error of
+// the API error body. Unauthorized requests prompt for the token and retry.
+async function api(method, path, body) {
+  const headers = {};
+  if (token) {
+    headers["Authorization"] = "Bearer " + token;
+  }
+  if (body !== undefined) {
+    headers["Content-Type"] = "application/json";
+  }
+
+  const resp = await fetch("/v1" + path, { method, headers, body, cache: "no-store" });
+  if (resp.status === 401 && askToken()) {
+    return api(method, path, body);
+  }
+
+  const text = await resp.text();
+  const data = text ? JSON.parse(text) : null;
+  if (!resp.ok) {
+    const error = data && data.error && data.error.message ? data.error : null;
+    const message = error ? error.message : resp.statusText;
+    const code = error && error.code ? " (" + error.code + ")" : "";
+    throw new Error(resp.status + ": " + message + code);
+  }
+  return data;
+}
+
+// valPath returns the path of a key.
+function valPath(key) {
+  return "/val/" + encodeURIComponent(key);
+}
+
+// listKeys lists a page of keys, starting a new list unless more is set.
+async function listKeys(more) {
+  if (!more) {
+    cursor = "";
+    $("list").replaceChildren();
+  }
+
+  const q = new URLSearchParams({ limit: pageLimit, prefix: $("prefix").value });
+  if (cursor) {
+    q.set("cursor", cursor);
+  }
+  const page = await api("GET", "/val?" + q);
+
+  for (const key of Object.keys(page.items).sort()) {
+    const li = document.createElement("li");
+    li.textContent = key;
+    li.title = key;
+    li.addEventListener("click", () => run(() => openKey(key)));
+    $("list").append(li);
+  }
+  cursor = page.next_cursor || "";
+  $("more").hidden = !cursor;
+}
+
+// openKey shows the value of a key, pretty-printed.
+async function openKey(key) {
+  const data = await api("GET", valPath(key));
+
+  $("key").value = key;
+  $("value").value = JSON.stringify(data[key], null, 2);
+  for (const li of $("list").children) {
+    li.classList.toggle("selected", li.textContent === key);
+  }
+}
+
+// saveKey creates or replaces the value of the edited key.
+async function saveKey() {
+  const key = $("key").value;
+  let value;
+  try {
+    value = JSON.stringify(JSON.parse($("value").value));
+  } catch (err) {
+    throw new Error("invalid JSON value: " + err.message);
+  }
+
+  await api("PUT", valPath(key), value);
+  await listKeys(false);
+  await openKey(key);
+}
+
+// deleteKey deletes the edited key.
+async function deleteKey() {
+  const key = $("key").value;
+  if (!key || !confirm("Delete " + key + "?")) {
+    return;
+  }
+
+  await api("DELETE", valPath(key));
+  newKey();
+  await listKeys(false);
+}
+
+// newKey clears the editor.
+function newKey() {
+  $("key").value = "";
+  $("value").value = "";
+  $("key").focus();
+}
+
+// run calls an action, showing its error.
+async function run(action) {
+  try {
+    showError(null);
+    await action();
+  } catch (err) {
+    showError(err);
+  }
+}
+
+$("search").addEventListener("submit", (e) => {
+  e.preventDefault();
+  run(() => listKeys(false));
+});
+$("more").addEventListener("click", () => run(() => listKeys(true)));
+$("edit").addEventListener("submit", (e) => {
+  e.preventDefault();
+  run(saveKey);
+});
+$("delete").addEventListener("click", () => run(deleteKey));
+$("new").addEventListener("click", newKey);
+$("token").addEventListener("click", askToken);
+
+run(() => listKeys(false));
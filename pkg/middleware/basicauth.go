@@ -0,0 +1,88 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The context key for the authenticated user name.
+const ctxUserKey = ctxKey("User")
+
+// dummyHash is compared when a user is not found, so unknown users take
+// as long to reject as wrong passwords.
+var dummyHash = []byte("$2a$10$HV32oeXrrXag/Z7B0QRBzuCq2Qhr4Z.0giZmKx/U7dixoFlwY8vWa")
+
+// BasicAuth authenticates requests using HTTP basic authentication.
+//
+// Requests with missing or invalid credentials are rejected with
+// 401 Unauthorized and a WWW-Authenticate header for realm. The authenticated
+// user name can be retrieved by handlers calling middleware.AuthUser(request),
+// and is logged by the Logger middleware.
+func BasicAuth(realm string, validate func(user, pass string) bool) func(http.Handler) http.Handler {
+	challenge := fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", realm)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, pass, ok := r.BasicAuth()
+			if !ok || user == "" || !validate(user, pass) {
+				w.Header().Set("WWW-Authenticate", challenge)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			setLogUser(r, user)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxUserKey, user)))
+		})
+	}
+}
+
+// BasicAuthUsers authenticates requests using HTTP basic authentication,
+// against a static map of user names to bcrypt password hashes.
+//
+// User names are compared in constant time, and unknown users are checked
+// against a dummy hash, to avoid timing side channels.
+func BasicAuthUsers(realm string, users map[string]string) func(http.Handler) http.Handler {
+	return BasicAuth(realm, func(user, pass string) bool {
+		hash := dummyHash
+		found := 0
+
+		// Visit all users, so the lookup time does not depend on the user.
+		for u, h := range users {
+			if subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1 {
+				hash = []byte(h)
+				found = 1
+			}
+		}
+
+		err := bcrypt.CompareHashAndPassword(hash, []byte(pass))
+
+		return err == nil && found == 1
+	})
+}
+
+// AuthUser returns the authenticated user name of the current request, or an
+// empty string if the request is not authenticated.
+func AuthUser(r *http.Request) string {
+	user, _ := r.Context().Value(ctxUserKey).(string)
+
+	return user
+}
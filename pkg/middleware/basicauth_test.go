@@ -0,0 +1,111 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// The bcrypt hash of "meow".
+const meowHash = "$2a$04$oLNrG6WLWBfOqyZYrzwu2.v1EsYicV6DutRvvwRr/FsaTKZlPKYIq"
+
+// userHandler writes the authenticated user name.
+func userHandler(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, AuthUser(r))
+}
+
+func TestBasicAuth(t *testing.T) {
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+		expected      string
+	}{
+		{"happy path", "Basic a2l0dHk6bWVvdw==", http.StatusOK, "kitty"},
+		{"wrong password", "Basic a2l0dHk6d29vZg==", http.StatusUnauthorized, ""},
+		{"unknown user", "Basic ZG9nOm1lb3c=", http.StatusUnauthorized, ""},
+		{"malformed base64", "Basic a2l0dHk6b!!!", http.StatusUnauthorized, ""},
+		{"no colon", "Basic a2l0dHk=", http.StatusUnauthorized, ""},
+		{"empty credentials", "Basic Og==", http.StatusUnauthorized, ""},
+		{"wrong scheme", "Bearer a2l0dHk6bWVvdw==", http.StatusUnauthorized, ""},
+		{"missing", "", http.StatusUnauthorized, ""},
+	}
+
+	handler := BasicAuthUsers("kitty", map[string]string{
+		"kitty": meowHash,
+	})(http.HandlerFunc(userHandler))
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/val", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.authorization != "" {
+			req.Header.Set("Authorization", tt.authorization)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the status code is what we expect.
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				tt.name, status, tt.status)
+		}
+
+		// Check the response body is what we expect.
+		if rr.Body.String() != tt.expected {
+			t.Errorf("%s: handler returned unexpected body: got %v want %v",
+				tt.name, rr.Body.String(), tt.expected)
+		}
+
+		// Check the challenge is sent on failure.
+		challenge := rr.Header().Get("WWW-Authenticate")
+		if tt.status == http.StatusUnauthorized && challenge != `Basic realm="kitty", charset="UTF-8"` {
+			t.Errorf("%s: handler returned unexpected challenge: %v", tt.name, challenge)
+		}
+	}
+}
+
+func TestBasicAuthLogged(t *testing.T) {
+	req, err := http.NewRequest("GET", "/val", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("kitty", "meow")
+
+	var out bytes.Buffer
+	logger := Logger(LoggerOptions{Logger: log.New(&out, "", 0), Format: JSONFormat})
+	auth := BasicAuth("kitty", func(user, pass string) bool {
+		return user == "kitty" && pass == "meow"
+	})
+	logger(auth(http.HandlerFunc(userHandler))).ServeHTTP(httptest.NewRecorder(), req)
+
+	// Check the user name is logged.
+	var entry map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("logger wrote invalid JSON: %v: %v", out.String(), err)
+	}
+	if entry["user"] != "kitty" {
+		t.Errorf("logger wrote wrong user: got %v want %v", entry["user"], "kitty")
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// The context key for the bearer token claims.
+const ctxClaimsKey = ctxKey("Claims")
+
+// Bearer token errors.
+var (
+	errNoToken        = errors.New("missing bearer token")
+	errMultipleTokens = errors.New("multiple authorization headers")
+	errNotBearer      = errors.New("authorization scheme is not bearer")
+)
+
+// BearerAuthOptions configures the BearerAuth middleware.
+type BearerAuthOptions struct {
+	// Optional cookie name, the token is read from the cookie when the
+	// request has no Authorization header.
+	Cookie string
+
+	// Optional predicate for requests that skip authentication, e.g. public
+	// paths.
+	Skip func(r *http.Request) bool
+
+	// Optional custom handler for rejected requests, it receives the
+	// extraction or verification error. If not defined, a 401 with
+	// a JSON error body is written.
+	Unauthorized func(w http.ResponseWriter, r *http.Request, err error)
+}
+
+// BearerAuth authenticates requests carrying a bearer token.
+//
+// The token is read from the Authorization header, or from a cookie, and
+// passed to verify, the middleware does not implement any cryptography.
+// The claims returned by verify can be retrieved by handlers calling
+// middleware.Claims(request). Requests without a token, with more than one
+// Authorization header, or failing verification are rejected.
+func BearerAuth(verify func(token string) (map[string]interface{}, error), opts BearerAuthOptions) func(http.Handler) http.Handler {
+	unauthorized := opts.Unauthorized
+	if unauthorized == nil {
+		unauthorized = bearerUnauthorized
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if opts.Skip != nil && opts.Skip(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			token, err := bearerToken(r, opts.Cookie)
+			if err != nil {
+				unauthorized(w, r, err)
+				return
+			}
+
+			claims, err := verify(token)
+			if err != nil {
+				unauthorized(w, r, err)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxClaimsKey, claims)))
+		})
+	}
+}
+
+// Claims returns the verified bearer token claims of the current request, or
+// nil if the request is not authenticated.
+func Claims(r *http.Request) map[string]interface{} {
+	claims, _ := r.Context().Value(ctxClaimsKey).(map[string]interface{})
+
+	return claims
+}
+
+// bearerToken extracts the bearer token from the request.
+func bearerToken(r *http.Request, cookie string) (string, error) {
+	headers := r.Header.Values("Authorization")
+	if len(headers) > 1 {
+		return "", errMultipleTokens
+	}
+
+	// Fallback to the cookie when there is no Authorization header.
+	if len(headers) == 0 {
+		if cookie != "" {
+			if c, err := r.Cookie(cookie); err == nil && c.Value != "" {
+				return c.Value, nil
+			}
+		}
+		return "", errNoToken
+	}
+
+	fields := strings.Fields(headers[0])
+	if len(fields) == 0 {
+		return "", errNoToken
+	}
+	if !strings.EqualFold(fields[0], "Bearer") {
+		return "", errNotBearer
+	}
+	if len(fields) != 2 {
+		return "", errNoToken
+	}
+
+	return fields[1], nil
+}
+
+// bearerUnauthorized writes a 401 with a JSON error body.
+func bearerUnauthorized(w http.ResponseWriter, r *http.Request, err error) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	io.WriteString(w, `{"error":"unauthorized"}`)
+}
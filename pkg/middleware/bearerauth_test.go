@@ -0,0 +1,135 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// verifyKitty accepts the token "kitty".
+func verifyKitty(token string) (map[string]interface{}, error) {
+	if token != "kitty" {
+		return nil, errors.New("invalid token")
+	}
+
+	return map[string]interface{}{"sub": "layla"}, nil
+}
+
+// claimsHandler writes the claims subject.
+func claimsHandler(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, fmt.Sprint(Claims(r)["sub"]))
+}
+
+func TestBearerAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		headers  []string
+		cookie   string
+		status   int
+		expected string
+	}{
+		{"happy path", []string{"Bearer kitty"}, "", http.StatusOK, "layla"},
+		{"extra whitespace", []string{"  bearer   kitty  "}, "", http.StatusOK, "layla"},
+		{"cookie", nil, "kitty", http.StatusOK, "layla"},
+		{"header wins over cookie", []string{"Bearer dog"}, "kitty", http.StatusUnauthorized, `{"error":"unauthorized"}`},
+		{"wrong token", []string{"Bearer dog"}, "", http.StatusUnauthorized, `{"error":"unauthorized"}`},
+		{"missing prefix", []string{"kitty"}, "", http.StatusUnauthorized, `{"error":"unauthorized"}`},
+		{"missing token", []string{"Bearer"}, "", http.StatusUnauthorized, `{"error":"unauthorized"}`},
+		{"extra fields", []string{"Bearer kitty cat"}, "", http.StatusUnauthorized, `{"error":"unauthorized"}`},
+		{"multiple headers", []string{"Bearer kitty", "Bearer kitty"}, "", http.StatusUnauthorized, `{"error":"unauthorized"}`},
+		{"missing", nil, "", http.StatusUnauthorized, `{"error":"unauthorized"}`},
+	}
+
+	handler := BearerAuth(verifyKitty, BearerAuthOptions{
+		Cookie: "token",
+	})(http.HandlerFunc(claimsHandler))
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/val", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, h := range tt.headers {
+			req.Header.Add("Authorization", h)
+		}
+		if tt.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "token", Value: tt.cookie})
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the status code is what we expect.
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				tt.name, status, tt.status)
+		}
+
+		// Check the response body is what we expect.
+		if rr.Body.String() != tt.expected {
+			t.Errorf("%s: handler returned unexpected body: got %v want %v",
+				tt.name, rr.Body.String(), tt.expected)
+		}
+	}
+}
+
+func TestBearerAuthSkip(t *testing.T) {
+	req, err := http.NewRequest("GET", "/public", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := BearerAuth(verifyKitty, BearerAuthOptions{
+		Skip: func(r *http.Request) bool { return r.URL.Path == "/public" },
+	})(http.HandlerFunc(okHandler))
+	handler.ServeHTTP(rr, req)
+
+	// Check the status code is what we expect.
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+}
+
+func TestBearerAuthCustomUnauthorized(t *testing.T) {
+	req, err := http.NewRequest("GET", "/val", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer dog")
+
+	rr := httptest.NewRecorder()
+	handler := BearerAuth(verifyKitty, BearerAuthOptions{
+		Unauthorized: func(w http.ResponseWriter, r *http.Request, err error) {
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, fmt.Sprintf(`{"error":%q}`, err))
+		},
+	})(http.HandlerFunc(okHandler))
+	handler.ServeHTTP(rr, req)
+
+	// Check the response body is what we expect.
+	expected := `{"error":"invalid token"}`
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v",
+			rr.Body.String(), expected)
+	}
+}
@@ -0,0 +1,299 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCacheMaxEntries is the default size bound of a Cache.
+const DefaultCacheMaxEntries = 1024
+
+// Cache memoizes complete GET responses, in memory, for a TTL.
+//
+// Only 2xx responses are stored, hits are served without calling the
+// handler, and every response has an X-Cache: HIT or MISS header. Concurrent
+// misses of the same key call the handler once, and share its response.
+//
+// Responses are shared by all the requests with the same key, requests with
+// an Authorization header are not cached, and responses with a Vary header,
+// or a Cache-Control header with private or no-store, are neither stored
+// nor shared. The key must include any other input the response depends on,
+// e.g. a cookie, or the client of the request.
+type Cache struct {
+	// Maximum number of stored responses, defaults to DefaultCacheMaxEntries.
+	MaxEntries int
+
+	ttl   time.Duration
+	keyFn func(*http.Request) string
+	now   func() time.Time
+
+	mu       sync.Mutex
+	entries  map[string]*cacheEntry
+	inFlight map[string]*cacheCall
+
+	// Generation of the stored responses, incremented by invalidations, a
+	// response started before an invalidation is not stored.
+	gen uint64
+}
+
+// cacheEntry is a stored response.
+type cacheEntry struct {
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// cacheCall is an in-flight handler call, shared by concurrent misses.
+type cacheCall struct {
+	wg     sync.WaitGroup
+	entry  *cacheEntry
+	shared bool
+}
+
+// NewCache returns a response cache, with a TTL and a function computing
+// the cache key of a request, if keyFn is nil the request URI is the key.
+func NewCache(ttl time.Duration, keyFn func(*http.Request) string) *Cache {
+	if keyFn == nil {
+		keyFn = func(r *http.Request) string { return r.URL.RequestURI() }
+	}
+
+	return &Cache{
+		MaxEntries: DefaultCacheMaxEntries,
+		ttl:        ttl,
+		keyFn:      keyFn,
+		now:        time.Now,
+		entries:    make(map[string]*cacheEntry),
+		inFlight:   make(map[string]*cacheCall),
+	}
+}
+
+// Middleware returns the caching middleware.
+func (c *Cache) Middleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet || r.Header.Get("Authorization") != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			key := c.keyFn(r)
+			entry, hit := c.lookup(key, next, r)
+			if hit {
+				writeCacheEntry(w, entry, "HIT")
+			} else {
+				writeCacheEntry(w, entry, "MISS")
+			}
+		})
+	}
+}
+
+// Invalidate removes the stored response of a key, a response of the key
+// that is in flight is not stored, and is not shared with later requests.
+func (c *Cache) Invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	delete(c.entries, key)
+	delete(c.inFlight, key)
+}
+
+// InvalidatePrefix removes the stored responses of all keys with a prefix,
+// like Invalidate.
+func (c *Cache) InvalidatePrefix(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	for key := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			delete(c.entries, key)
+		}
+	}
+	for key := range c.inFlight {
+		if strings.HasPrefix(key, prefix) {
+			delete(c.inFlight, key)
+		}
+	}
+}
+
+// lookup returns a stored response, or calls the handler once for all
+// concurrent misses of a key, hit is true if the response was stored.
+func (c *Cache) lookup(key string, next http.Handler, r *http.Request) (*cacheEntry, bool) {
+	c.mu.Lock()
+	if entry, ok := c.entries[key]; ok && c.now().Before(entry.expires) {
+		c.mu.Unlock()
+		return entry, true
+	}
+
+	// Wait for an in-flight call of the same key, if its handler panicked
+	// there is no response, and the lookup is retried, if its response can't
+	// be shared, the handler is called again.
+	if call, ok := c.inFlight[key]; ok {
+		c.mu.Unlock()
+		call.wg.Wait()
+		if call.entry == nil {
+			return c.lookup(key, next, r)
+		}
+		if !call.shared {
+			return record(next, r), false
+		}
+		return call.entry, false
+	}
+
+	call := &cacheCall{}
+	call.wg.Add(1)
+	c.inFlight[key] = call
+	gen := c.gen
+	c.mu.Unlock()
+
+	// Release waiting calls even if the handler panics, an invalidation may
+	// have replaced the call already.
+	defer func() {
+		c.mu.Lock()
+		if c.inFlight[key] == call {
+			delete(c.inFlight, key)
+		}
+		c.mu.Unlock()
+		call.wg.Done()
+	}()
+
+	call.entry = record(next, r)
+	call.shared = shareable(call.entry.header)
+	if call.shared && call.entry.status >= 200 && call.entry.status < 300 {
+		c.store(key, call.entry, gen)
+	}
+
+	return call.entry, false
+}
+
+// record calls the handler, and returns its response.
+func record(next http.Handler, r *http.Request) *cacheEntry {
+	rec := &cacheRecorder{header: make(http.Header), status: http.StatusOK}
+	next.ServeHTTP(rec, r)
+
+	return &cacheEntry{
+		status: rec.status,
+		header: rec.header,
+		body:   rec.body.Bytes(),
+	}
+}
+
+// shareable returns true if a response can be shared by the requests of
+// a key, it has no Vary header, and is not private or no-store.
+func shareable(header http.Header) bool {
+	if len(header.Values("Vary")) > 0 {
+		return false
+	}
+	for _, v := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(v, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			if directive == "private" || directive == "no-store" ||
+				strings.HasPrefix(directive, "private=") {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// store stores a response, evicting entries to keep the size bound, unless
+// the responses were invalidated since generation gen.
+func (c *Cache) store(key string, entry *cacheEntry, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.gen != gen {
+		return
+	}
+
+	now := c.now()
+	entry.expires = now.Add(c.ttl)
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.MaxEntries {
+		c.evictLocked(now)
+	}
+	if len(c.entries) < c.MaxEntries {
+		c.entries[key] = entry
+	}
+}
+
+// evictLocked removes expired entries, and if none expired, the entry
+// closest to expiring.
+func (c *Cache) evictLocked(now time.Time) {
+	var oldestKey string
+	var oldest *cacheEntry
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+			continue
+		}
+		if oldest == nil || entry.expires.Before(oldest.expires) {
+			oldestKey, oldest = key, entry
+		}
+	}
+
+	if len(c.entries) >= c.MaxEntries && oldest != nil {
+		delete(c.entries, oldestKey)
+	}
+}
+
+// writeCacheEntry writes a stored response.
+func writeCacheEntry(w http.ResponseWriter, entry *cacheEntry, cache string) {
+	h := w.Header()
+	for k, v := range entry.header {
+		h[k] = v
+	}
+	h.Set("X-Cache", cache)
+	w.WriteHeader(entry.status)
+	w.Write(entry.body)
+}
+
+// cacheRecorder records a complete response.
+type cacheRecorder struct {
+	header      http.Header
+	body        bytes.Buffer
+	status      int
+	wroteHeader bool
+}
+
+// Header returns the recorded header map.
+func (rec *cacheRecorder) Header() http.Header {
+	return rec.header
+}
+
+// WriteHeader records the status code.
+func (rec *cacheRecorder) WriteHeader(code int) {
+	if !rec.wroteHeader {
+		rec.status = code
+		rec.wroteHeader = true
+		rec.header = rec.header.Clone()
+	}
+}
+
+// Write records b.
+func (rec *cacheRecorder) Write(b []byte) (int, error) {
+	rec.WriteHeader(http.StatusOK)
+
+	return rec.body.Write(b)
+}
@@ -0,0 +1,457 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingHandler returns a handler counting its calls, and writing the
+// request path and the call number.
+func countingHandler(calls *int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(calls, 1)
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, fmt.Sprintf("%s:%d", r.URL.Path, n))
+	})
+}
+
+// cacheGet serves a GET request, and returns the recorded response.
+func cacheGet(t *testing.T, handler http.Handler, path string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	return rr
+}
+
+func TestCache(t *testing.T) {
+	var calls int32
+	cache := NewCache(time.Minute, nil)
+	handler := cache.Middleware()(countingHandler(&calls))
+
+	tests := []struct {
+		path     string
+		xCache   string
+		expected string
+	}{
+		{"/val/a", "MISS", "/val/a:1"},
+		{"/val/a", "HIT", "/val/a:1"},
+		{"/val/b", "MISS", "/val/b:2"},
+		{"/val/b", "HIT", "/val/b:2"},
+	}
+
+	for _, tt := range tests {
+		rr := cacheGet(t, handler, tt.path)
+
+		// Check the X-Cache header is what we expect.
+		if got := rr.Header().Get("X-Cache"); got != tt.xCache {
+			t.Errorf("%s: wrong X-Cache header: got %q want %q", tt.path, got, tt.xCache)
+		}
+
+		// Check the response body is what we expect.
+		if rr.Body.String() != tt.expected {
+			t.Errorf("%s: handler returned unexpected body: got %v want %v",
+				tt.path, rr.Body.String(), tt.expected)
+		}
+
+		// Check stored headers are replayed.
+		if got := rr.Header().Get("Content-Type"); got != "text/plain" {
+			t.Errorf("%s: wrong Content-Type: got %q", tt.path, got)
+		}
+	}
+}
+
+func TestCacheSkipsNonGet(t *testing.T) {
+	var calls int32
+	handler := NewCache(time.Minute, nil).Middleware()(countingHandler(&calls))
+
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("POST", "/val/a", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if got := rr.Header().Get("X-Cache"); got != "" {
+			t.Errorf("unexpected X-Cache header on POST: %q", got)
+		}
+	}
+
+	if calls != 2 {
+		t.Errorf("wrong number of handler calls: got %d want 2", calls)
+	}
+}
+
+func TestCacheSkipsErrors(t *testing.T) {
+	var calls int32
+	handler := NewCache(time.Minute, nil).Middleware()(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.WriteHeader(http.StatusNotFound)
+		}))
+
+	for i := 0; i < 2; i++ {
+		rr := cacheGet(t, handler, "/val/a")
+
+		// Check the status code is what we expect.
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("handler returned wrong status code: got %v want %v",
+				rr.Code, http.StatusNotFound)
+		}
+		if got := rr.Header().Get("X-Cache"); got != "MISS" {
+			t.Errorf("wrong X-Cache header: got %q want MISS", got)
+		}
+	}
+
+	if calls != 2 {
+		t.Errorf("wrong number of handler calls: got %d want 2", calls)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	var calls int32
+	now := time.Unix(0, 0)
+	cache := NewCache(time.Minute, nil)
+	cache.now = func() time.Time { return now }
+	handler := cache.Middleware()(countingHandler(&calls))
+
+	cacheGet(t, handler, "/val/a")
+
+	now = now.Add(59 * time.Second)
+	if rr := cacheGet(t, handler, "/val/a"); rr.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("expected a hit before the TTL expired")
+	}
+
+	now = now.Add(time.Second)
+	rr := cacheGet(t, handler, "/val/a")
+	if rr.Header().Get("X-Cache") != "MISS" || rr.Body.String() != "/val/a:2" {
+		t.Errorf("expected a fresh miss after the TTL expired: got %q %q",
+			rr.Header().Get("X-Cache"), rr.Body.String())
+	}
+}
+
+func TestCacheMaxEntries(t *testing.T) {
+	var calls int32
+	now := time.Unix(0, 0)
+	cache := NewCache(time.Minute, nil)
+	cache.MaxEntries = 2
+	cache.now = func() time.Time { return now }
+	handler := cache.Middleware()(countingHandler(&calls))
+
+	for _, path := range []string{"/a", "/b", "/c"} {
+		cacheGet(t, handler, path)
+		now = now.Add(time.Second)
+	}
+
+	// The oldest entry is evicted.
+	if len(cache.entries) != 2 {
+		t.Errorf("wrong number of entries: got %d want 2", len(cache.entries))
+	}
+	if rr := cacheGet(t, handler, "/a"); rr.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("expected /a to be evicted")
+	}
+	if rr := cacheGet(t, handler, "/c"); rr.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("expected /c to be stored")
+	}
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	var calls int32
+	cache := NewCache(time.Minute, nil)
+	handler := cache.Middleware()(countingHandler(&calls))
+
+	for _, path := range []string{"/val/a", "/val/b", "/other"} {
+		cacheGet(t, handler, path)
+	}
+
+	cache.Invalidate("/val/a")
+	if rr := cacheGet(t, handler, "/val/a"); rr.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("expected a miss after Invalidate")
+	}
+	if rr := cacheGet(t, handler, "/val/b"); rr.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("expected Invalidate to keep other keys")
+	}
+
+	cache.InvalidatePrefix("/val/")
+	for _, path := range []string{"/val/a", "/val/b"} {
+		if rr := cacheGet(t, handler, path); rr.Header().Get("X-Cache") != "MISS" {
+			t.Errorf("%s: expected a miss after InvalidatePrefix", path)
+		}
+	}
+	if rr := cacheGet(t, handler, "/other"); rr.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("expected InvalidatePrefix to keep other keys")
+	}
+}
+
+func TestCacheKeyFn(t *testing.T) {
+	var calls int32
+	keyFn := func(r *http.Request) string { return r.Header.Get("X-Tenant") + r.URL.Path }
+	handler := NewCache(time.Minute, keyFn).Middleware()(countingHandler(&calls))
+
+	for _, tenant := range []string{"a", "b", "a"} {
+		req, err := http.NewRequest("GET", "/val", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Tenant", tenant)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if calls != 2 {
+		t.Errorf("wrong number of handler calls: got %d want 2", calls)
+	}
+}
+
+func TestCacheConcurrentMisses(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	handler := NewCache(time.Minute, nil).Middleware()(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			<-release
+			io.WriteString(w, "kitty")
+		}))
+
+	const n = 50
+	var wg sync.WaitGroup
+	bodies := make([]string, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rr := cacheGet(t, handler, "/val/a")
+			bodies[i] = rr.Body.String()
+		}(i)
+	}
+
+	// Let the requests pile up on the in-flight call.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("wrong number of handler calls: got %d want 1", calls)
+	}
+	for i, body := range bodies {
+		if body != "kitty" {
+			t.Errorf("request %d: unexpected body: %q", i, body)
+		}
+	}
+}
+
+func TestCacheConcurrentInvalidate(t *testing.T) {
+	var calls int32
+	cache := NewCache(time.Minute, nil)
+	handler := cache.Middleware()(countingHandler(&calls))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			cacheGet(t, handler, fmt.Sprintf("/val/%d", i%4))
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				cache.Invalidate(fmt.Sprintf("/val/%d", i%4))
+			} else {
+				cache.InvalidatePrefix("/val/")
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestCachePanicReleasesWaiters(t *testing.T) {
+	handler := NewCache(time.Minute, nil).Middleware()(http.HandlerFunc(panicHandler))
+
+	for i := 0; i < 2; i++ {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected the handler panic to propagate")
+				}
+			}()
+			cacheGet(t, handler, "/val/a")
+		}()
+	}
+}
+
+func TestCachePanicConcurrentWaiters(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	handler := NewCache(time.Minute, nil).Middleware()(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			// The first call panics, after the other requests wait for it.
+			if atomic.AddInt32(&calls, 1) == 1 {
+				<-release
+				panic("kitty")
+			}
+			io.WriteString(w, "kitty")
+		}))
+
+	const n = 20
+	var wg sync.WaitGroup
+	var panics int32
+	bodies := make([]string, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() {
+				if recover() != nil {
+					atomic.AddInt32(&panics, 1)
+				}
+			}()
+			rr := cacheGet(t, handler, "/val/a")
+			bodies[i] = rr.Body.String()
+		}(i)
+	}
+
+	// Let the requests pile up on the in-flight call.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	// Check only the leader request panicked, and the others got a response.
+	if panics != 1 {
+		t.Errorf("wrong number of panics: got %d want 1", panics)
+	}
+	if calls != 2 {
+		t.Errorf("wrong number of handler calls: got %d want 2", calls)
+	}
+	empty := 0
+	for _, body := range bodies {
+		if body == "" {
+			empty++
+		} else if body != "kitty" {
+			t.Errorf("unexpected body: %q", body)
+		}
+	}
+	if empty != 1 {
+		t.Errorf("wrong number of requests without a response: got %d want 1", empty)
+	}
+}
+
+func TestCacheInvalidateInFlight(t *testing.T) {
+	var calls int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	cache := NewCache(time.Minute, nil)
+	handler := cache.Middleware()(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			// The first call blocks, until the key is invalidated.
+			n := atomic.AddInt32(&calls, 1)
+			if n == 1 {
+				close(started)
+				<-release
+			}
+			io.WriteString(w, fmt.Sprintf("kitty:%d", n))
+		}))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cacheGet(t, handler, "/val/a")
+	}()
+
+	<-started
+	cache.Invalidate("/val/a")
+
+	// Check a request after the invalidation does not share the stale call.
+	fresh := make(chan string, 1)
+	go func() {
+		fresh <- cacheGet(t, handler, "/val/a").Body.String()
+	}()
+	select {
+	case body := <-fresh:
+		if body != "kitty:2" {
+			t.Errorf("unexpected body after invalidate: %q", body)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("request after invalidate waits for the stale call")
+	}
+
+	close(release)
+	<-done
+
+	// Check the stale response was not stored.
+	rr := cacheGet(t, handler, "/val/a")
+	if rr.Header().Get("X-Cache") == "HIT" && rr.Body.String() == "kitty:1" {
+		t.Errorf("stale response stored after invalidate")
+	}
+}
+
+func TestCachePrivate(t *testing.T) {
+	tests := []struct {
+		name     string
+		auth     string
+		header   string
+		value    string
+		expected string
+	}{
+		{"authorization", "Bearer kitty", "", "", ""},
+		{"vary", "", "Vary", "Accept", "MISS"},
+		{"private", "", "Cache-Control", "private, max-age=60", "MISS"},
+		{"no-store", "", "Cache-Control", "No-Store", "MISS"},
+		{"public", "", "Cache-Control", "max-age=60", "HIT"},
+	}
+
+	for _, tt := range tests {
+		var calls int32
+		handler := NewCache(time.Minute, nil).Middleware()(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&calls, 1)
+				if tt.header != "" {
+					w.Header().Set(tt.header, tt.value)
+				}
+				io.WriteString(w, "kitty")
+			}))
+
+		var rr *httptest.ResponseRecorder
+		for i := 0; i < 2; i++ {
+			req, err := http.NewRequest("GET", "/val/a", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+
+			rr = httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+		}
+
+		// Check the X-Cache header of the second request is what we expect.
+		if got := rr.Header().Get("X-Cache"); got != tt.expected {
+			t.Errorf("%s: wrong X-Cache header: got %q want %q", tt.name, got, tt.expected)
+		}
+	}
+}
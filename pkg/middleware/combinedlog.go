@@ -0,0 +1,128 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessLogTimeFormat is the Apache access log timestamp format.
+const accessLogTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// accessLogNow returns the current time, replaced in tests.
+var accessLogNow = time.Now
+
+// CombinedLogOptions configures the CombinedLog middleware.
+type CombinedLogOptions struct {
+	// Common writes Common Log Format lines, without the referer and user
+	// agent fields.
+	Common bool
+
+	// Duration appends the request duration in microseconds to every line,
+	// like the Apache %D directive.
+	Duration bool
+}
+
+// CombinedLog logs one line for each request to out, in the Apache combined
+// log format:
+//
+//	host ident authuser [date] "request" status bytes "referer" "user-agent"
+//
+// The host is the client IP, resolved by RealIP when it wraps this
+// middleware, and authuser is the user authenticated by BasicAuth.
+func CombinedLog(out io.Writer) func(http.Handler) http.Handler {
+	return CombinedLogWithOptions(out, CombinedLogOptions{})
+}
+
+// CombinedLogWithOptions logs one line for each request to out, in the
+// Apache combined or common log format.
+func CombinedLogWithOptions(out io.Writer, opts CombinedLogOptions) func(http.Handler) http.Handler {
+	var mu sync.Mutex
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := accessLogNow()
+			sw := newStatusWriter(w)
+			info := &logInfo{}
+			r = r.WithContext(context.WithValue(r.Context(), ctxLogInfoKey, info))
+
+			next.ServeHTTP(sw.flushable(sw), r)
+
+			line := accessLogLine(r, sw, info, start, opts)
+			if opts.Duration {
+				line += " " + strconv.FormatInt(accessLogNow().Sub(start).Microseconds(), 10)
+			}
+
+			mu.Lock()
+			io.WriteString(out, line+"\n")
+			mu.Unlock()
+		})
+	}
+}
+
+// accessLogLine returns the common or combined log line of a request.
+func accessLogLine(r *http.Request, sw *statusWriter, info *logInfo, start time.Time, opts CombinedLogOptions) string {
+	uri := r.RequestURI
+	if uri == "" {
+		uri = r.URL.RequestURI()
+	}
+	size := "-"
+	if sw.bytes > 0 {
+		size = strconv.FormatInt(sw.bytes, 10)
+	}
+
+	line := fmt.Sprintf(`%s - %s [%s] "%s %s %s" %d %s`,
+		orDash(ClientIP(r)),
+		orDash(escapeLogValue(info.user)),
+		start.Format(accessLogTimeFormat),
+		escapeLogValue(r.Method), escapeLogValue(uri), escapeLogValue(r.Proto),
+		sw.status,
+		size)
+	if opts.Common {
+		return line
+	}
+
+	return fmt.Sprintf(`%s "%s" "%s"`, line,
+		orDash(escapeLogValue(r.Referer())),
+		orDash(escapeLogValue(r.UserAgent())))
+}
+
+// escapeLogValue escapes quotes, backslashes and non printable bytes, the
+// way Apache does, so values can't break the log line format.
+func escapeLogValue(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCombinedLog(t *testing.T) {
+	start := time.Date(2000, 10, 10, 13, 55, 36, 0, time.FixedZone("", -7*60*60))
+	defer func() { accessLogNow = time.Now }()
+
+	tests := []struct {
+		name     string
+		opts     CombinedLogOptions
+		path     string
+		user     string
+		referer  string
+		agent    string
+		expected string
+	}{
+		{"combined", CombinedLogOptions{}, "/val/a?x=1", "", "http://example.com/", "kitty/1.0",
+			`192.0.2.1 - - [10/Oct/2000:13:55:36 -0700] "GET /val/a?x=1 HTTP/1.1" 201 5 "http://example.com/" "kitty/1.0"` + "\n"},
+		{"combined no referer", CombinedLogOptions{}, "/val/a", "", "", "",
+			`192.0.2.1 - - [10/Oct/2000:13:55:36 -0700] "GET /val/a HTTP/1.1" 201 5 "-" "-"` + "\n"},
+		{"not found", CombinedLogOptions{}, "/nope", "", "", "kitty/1.0",
+			`192.0.2.1 - - [10/Oct/2000:13:55:36 -0700] "GET /nope HTTP/1.1" 404 32 "-" "kitty/1.0"` + "\n"},
+		{"escaped", CombinedLogOptions{}, "/val/a", "", "", "evil\" \\agent\n",
+			`192.0.2.1 - - [10/Oct/2000:13:55:36 -0700] "GET /val/a HTTP/1.1" 201 5 "-" "evil\" \\agent\x0a"` + "\n"},
+		{"auth user", CombinedLogOptions{}, "/val/a", "frank", "", "kitty/1.0",
+			`192.0.2.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /val/a HTTP/1.1" 201 5 "-" "kitty/1.0"` + "\n"},
+		{"common", CombinedLogOptions{Common: true}, "/val/a", "", "http://example.com/", "kitty/1.0",
+			`192.0.2.1 - - [10/Oct/2000:13:55:36 -0700] "GET /val/a HTTP/1.1" 201 5` + "\n"},
+		{"duration", CombinedLogOptions{Duration: true}, "/val/a", "", "", "kitty/1.0",
+			`192.0.2.1 - - [10/Oct/2000:13:55:36 -0700] "GET /val/a HTTP/1.1" 201 5 "-" "kitty/1.0" 1500` + "\n"},
+		{"common duration", CombinedLogOptions{Common: true, Duration: true}, "/val/a", "", "", "",
+			`192.0.2.1 - - [10/Oct/2000:13:55:36 -0700] "GET /val/a HTTP/1.1" 201 5 1500` + "\n"},
+	}
+
+	for _, tt := range tests {
+		// The clock advances 1.5ms between the start and the end of a request.
+		now := start
+		accessLogNow = func() time.Time {
+			t := now
+			now = now.Add(1500 * time.Microsecond)
+			return t
+		}
+
+		req, err := http.NewRequest("GET", tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = "192.0.2.1:1234"
+		if tt.referer != "" {
+			req.Header.Set("Referer", tt.referer)
+		}
+		if tt.agent != "" {
+			req.Header.Set("User-Agent", tt.agent)
+		}
+
+		var handler http.Handler = newTestRouter()
+		if tt.user != "" {
+			handler = BasicAuth("kitty", func(user, pass string) bool { return true })(handler)
+			req.SetBasicAuth(tt.user, "secret")
+		}
+
+		var out bytes.Buffer
+		CombinedLogWithOptions(&out, tt.opts)(handler).ServeHTTP(httptest.NewRecorder(), req)
+
+		// Check the log line is what we expect.
+		if out.String() != tt.expected {
+			t.Errorf("%s: wrong log line:\ngot  %q\nwant %q", tt.name, out.String(), tt.expected)
+		}
+	}
+}
+
+func TestCombinedLogRealIP(t *testing.T) {
+	req, err := http.NewRequest("GET", "/val/a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+
+	var out bytes.Buffer
+	handler := RealIP([]string{"10.0.0.0/8"})(CombinedLog(&out)(newTestRouter()))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Check the log line starts with the resolved client IP.
+	if !bytes.HasPrefix(out.Bytes(), []byte("203.0.113.7 - - [")) {
+		t.Errorf("wrong log line host: %q", out.String())
+	}
+}
+
+func TestCombinedLogEmptyBody(t *testing.T) {
+	req, err := http.NewRequest("DELETE", "/val/a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	handler := CombinedLogWithOptions(&out, CombinedLogOptions{Common: true})(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Check an empty body is logged as "-".
+	if !bytes.HasSuffix(out.Bytes(), []byte(`"DELETE /val/a HTTP/1.1" 204 -`+"\n")) {
+		t.Errorf("wrong log line: %q", out.String())
+	}
+}
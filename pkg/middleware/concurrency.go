@@ -0,0 +1,124 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// ConcurrencyLimiter limits the number of requests served concurrently.
+type ConcurrencyLimiter struct {
+	slots   chan struct{}
+	queue   int64
+	timeout time.Duration
+
+	inFlight int64
+	queued   int64
+}
+
+// NewConcurrencyLimiter returns a limiter serving up to max requests
+// concurrently, and queuing up to queue requests for up to timeout.
+func NewConcurrencyLimiter(max int, queue int, timeout time.Duration) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		slots:   make(chan struct{}, max),
+		queue:   int64(queue),
+		timeout: timeout,
+	}
+}
+
+// ConcurrencyLimit limits the number of requests served concurrently.
+//
+// Up to max requests are served concurrently, up to queue requests wait for
+// a free slot for up to timeout, other requests are answered with a JSON 503
+// and a Retry-After header. Slots are released when the next handler
+// returns or panics. Use NewConcurrencyLimiter to expose the in-flight and
+// queued counts.
+func ConcurrencyLimit(max int, queue int, timeout time.Duration) func(http.Handler) http.Handler {
+	return NewConcurrencyLimiter(max, queue, timeout).Middleware()
+}
+
+// Middleware returns the concurrency limiting middleware.
+func (l *ConcurrencyLimiter) Middleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !l.acquire(r) {
+				writeOverloaded(w, l.timeout)
+				return
+			}
+			defer l.release()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// InFlight returns the number of requests being served.
+func (l *ConcurrencyLimiter) InFlight() int {
+	return int(atomic.LoadInt64(&l.inFlight))
+}
+
+// Queued returns the number of requests waiting for a slot.
+func (l *ConcurrencyLimiter) Queued() int {
+	return int(atomic.LoadInt64(&l.queued))
+}
+
+// acquire takes a slot, waiting in the queue if there is room,
+// it returns false if no slot was taken.
+func (l *ConcurrencyLimiter) acquire(r *http.Request) bool {
+	select {
+	case l.slots <- struct{}{}:
+		atomic.AddInt64(&l.inFlight, 1)
+		return true
+	default:
+	}
+
+	if atomic.AddInt64(&l.queued, 1) > l.queue {
+		atomic.AddInt64(&l.queued, -1)
+		return false
+	}
+	defer atomic.AddInt64(&l.queued, -1)
+
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		atomic.AddInt64(&l.inFlight, 1)
+		return true
+	case <-timer.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// release frees a slot.
+func (l *ConcurrencyLimiter) release() {
+	atomic.AddInt64(&l.inFlight, -1)
+	<-l.slots
+}
+
+// writeOverloaded writes a JSON 503 response, with a Retry-After header.
+func writeOverloaded(w http.ResponseWriter, timeout time.Duration) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.FormatInt(retryAfterSeconds(timeout), 10))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	io.WriteString(w, `{"error":"server overloaded"}`)
+}
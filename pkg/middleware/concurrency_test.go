@@ -0,0 +1,189 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it's true, or fails the test after a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// limitGet serves a GET request, and returns the recorded response.
+func limitGet(handler http.Handler) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/val/a", nil))
+
+	return rr
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	release := make(chan struct{})
+	limiter := NewConcurrencyLimiter(2, 1, time.Second)
+	handler := limiter.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		io.WriteString(w, "ok")
+	}))
+
+	// Fill the slots and the queue.
+	var wg sync.WaitGroup
+	codes := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- limitGet(handler).Code
+		}()
+	}
+	waitFor(t, "full slots and queue", func() bool {
+		return limiter.InFlight() == 2 && limiter.Queued() == 1
+	})
+
+	// Check a request is shed when the queue is full.
+	rr := limitGet(handler)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			rr.Code, http.StatusServiceUnavailable)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("wrong Retry-After header: got %q want %q", got, "1")
+	}
+	if rr.Body.String() != `{"error":"server overloaded"}` {
+		t.Errorf("handler returned unexpected body: %v", rr.Body.String())
+	}
+
+	// Check the queued request is served when slots are released.
+	close(release)
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("handler returned wrong status code: got %v want %v", code, http.StatusOK)
+		}
+	}
+	if limiter.InFlight() != 0 || limiter.Queued() != 0 {
+		t.Errorf("limiter leaked: in flight %d, queued %d", limiter.InFlight(), limiter.Queued())
+	}
+}
+
+func TestConcurrencyLimitQueueTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	limiter := NewConcurrencyLimiter(1, 1, 10*time.Millisecond)
+	handler := limiter.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+
+	go limitGet(handler)
+	waitFor(t, "a full slot", func() bool { return limiter.InFlight() == 1 })
+
+	// Check a queued request is shed after the timeout.
+	if rr := limitGet(handler); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			rr.Code, http.StatusServiceUnavailable)
+	}
+	if limiter.Queued() != 0 {
+		t.Errorf("limiter leaked a queued request: %d", limiter.Queued())
+	}
+}
+
+func TestConcurrencyLimitPanic(t *testing.T) {
+	recoverer := RecoverWithLogger(log.New(io.Discard, "", 0), nil)
+
+	tests := []struct {
+		name  string
+		order func(limit, recover func(http.Handler) http.Handler, h http.Handler) http.Handler
+	}{
+		{"recover outside", func(limit, recover func(http.Handler) http.Handler, h http.Handler) http.Handler {
+			return recover(limit(h))
+		}},
+		{"recover inside", func(limit, recover func(http.Handler) http.Handler, h http.Handler) http.Handler {
+			return limit(recover(h))
+		}},
+	}
+
+	for _, tt := range tests {
+		limiter := NewConcurrencyLimiter(1, 0, time.Millisecond)
+		handler := tt.order(limiter.Middleware(), recoverer, http.HandlerFunc(panicHandler))
+
+		// Check panicking requests never leak the only slot.
+		for i := 0; i < 3; i++ {
+			if rr := limitGet(handler); rr.Code != http.StatusInternalServerError {
+				t.Errorf("%s: handler returned wrong status code: got %v want %v",
+					tt.name, rr.Code, http.StatusInternalServerError)
+			}
+		}
+		if limiter.InFlight() != 0 {
+			t.Errorf("%s: limiter leaked %d slots", tt.name, limiter.InFlight())
+		}
+	}
+}
+
+func TestConcurrencyLimitConcurrent(t *testing.T) {
+	limiter := NewConcurrencyLimiter(4, 4, 5*time.Millisecond)
+
+	var mu sync.Mutex
+	running, peak := 0, 0
+	handler := limiter.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+	}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			limitGet(handler)
+		}()
+	}
+	wg.Wait()
+
+	// Check the limit was never exceeded, and all slots were released.
+	if peak > 4 {
+		t.Errorf("limit exceeded: %d requests ran concurrently", peak)
+	}
+	if limiter.InFlight() != 0 || limiter.Queued() != 0 {
+		t.Errorf("limiter leaked: in flight %d, queued %d", limiter.InFlight(), limiter.Queued())
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// ContentTypeOptions configures the RequireContentType middleware.
+type ContentTypeOptions struct {
+	// Allowed media types, e.g. "application/json", a "type/*" entry allows
+	// all subtypes of a type.
+	Types []string
+
+	// Exempt returns true for requests that are not checked, e.g. file
+	// upload paths.
+	Exempt func(r *http.Request) bool
+}
+
+// RequireContentType rejects requests with a body, whose Content-Type is not
+// one of types, with a JSON 415 Unsupported Media Type.
+//
+// See RequireContentTypeWithOptions.
+func RequireContentType(types ...string) func(http.Handler) http.Handler {
+	return RequireContentTypeWithOptions(ContentTypeOptions{Types: types})
+}
+
+// RequireContentTypeWithOptions rejects requests with a body, whose
+// Content-Type is not one of the allowed types, with a JSON 415.
+//
+// POST, PUT, PATCH and DELETE requests are checked, the media type is
+// compared ignoring case and parameters such as charset. A missing
+// Content-Type is rejected, unless the body is empty (Content-Length: 0).
+func RequireContentTypeWithOptions(opts ContentTypeOptions) func(http.Handler) http.Handler {
+	allowed := make([]string, len(opts.Types))
+	for i, t := range opts.Types {
+		allowed[i] = strings.ToLower(strings.TrimSpace(t))
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !hasBodyMethod(r.Method) || r.ContentLength == 0 ||
+				(opts.Exempt != nil && opts.Exempt(r)) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || !allowedMediaType(mediaType, allowed) {
+				writeUnsupportedMediaType(w)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// hasBodyMethod checks if requests of a method are expected to carry a body.
+func hasBodyMethod(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+
+	return false
+}
+
+// allowedMediaType checks if a media type matches one of the allowed types.
+func allowedMediaType(mediaType string, allowed []string) bool {
+	for _, t := range allowed {
+		if t == mediaType {
+			return true
+		}
+		if prefix := strings.TrimSuffix(t, "*"); prefix != t && strings.HasPrefix(mediaType, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writeUnsupportedMediaType writes a JSON 415 response.
+func writeUnsupportedMediaType(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnsupportedMediaType)
+	io.WriteString(w, `{"error":"unsupported media type"}`)
+}
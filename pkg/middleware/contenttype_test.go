@@ -0,0 +1,113 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequireContentType(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		body        string
+		chunked     bool
+		status      int
+	}{
+		{"json", "POST", "application/json", `{}`, false, http.StatusOK},
+		{"json with charset", "PUT", "application/json; charset=utf-8", `{}`, false, http.StatusOK},
+		{"json upper case", "PATCH", "Application/JSON", `{}`, false, http.StatusOK},
+		{"form", "POST", "application/x-www-form-urlencoded", "a=1", false, http.StatusUnsupportedMediaType},
+		{"missing", "POST", "", `{}`, false, http.StatusUnsupportedMediaType},
+		{"missing chunked", "POST", "", `{}`, true, http.StatusUnsupportedMediaType},
+		{"malformed", "POST", "application/", `{}`, false, http.StatusUnsupportedMediaType},
+		{"empty delete", "DELETE", "", "", false, http.StatusOK},
+		{"delete with body", "DELETE", "text/plain", "x", false, http.StatusUnsupportedMediaType},
+		{"get", "GET", "text/plain", "x", false, http.StatusOK},
+	}
+
+	handler := RequireContentType("application/json")(http.HandlerFunc(okHandler))
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, "/val/a", strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		if tt.chunked {
+			// Hide the body length, as in chunked transfer encoding.
+			req.ContentLength = -1
+			req.Body = io.NopCloser(strings.NewReader(tt.body))
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the status code is what we expect.
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				tt.name, status, tt.status)
+		}
+
+		// Check the response body is what we expect.
+		if tt.status == http.StatusUnsupportedMediaType &&
+			rr.Body.String() != `{"error":"unsupported media type"}` {
+			t.Errorf("%s: handler returned unexpected body: %v", tt.name, rr.Body.String())
+		}
+	}
+}
+
+func TestRequireContentTypeOptions(t *testing.T) {
+	handler := RequireContentTypeWithOptions(ContentTypeOptions{
+		Types:  []string{"application/json", "text/*"},
+		Exempt: func(r *http.Request) bool { return strings.HasPrefix(r.URL.Path, "/upload/") },
+	})(http.HandlerFunc(okHandler))
+
+	tests := []struct {
+		path        string
+		contentType string
+		status      int
+	}{
+		{"/val/a", "text/plain", http.StatusOK},
+		{"/val/a", "text/csv", http.StatusOK},
+		{"/val/a", "image/png", http.StatusUnsupportedMediaType},
+		{"/upload/a", "image/png", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("POST", tt.path, strings.NewReader("kitty"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", tt.contentType)
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the status code is what we expect.
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%s %s: handler returned wrong status code: got %v want %v",
+				tt.path, tt.contentType, status, tt.status)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CORSConfig configures the CORS middleware.
+type CORSConfig struct {
+	// Allowed origins, an origin can be an exact origin, "*" for any origin,
+	// or a pattern with one wildcard, e.g. "https://*.example.com".
+	AllowedOrigins []string
+
+	// Optional predicate for allowed origins, an origin is allowed if it
+	// matches AllowedOrigins or the predicate returns true.
+	AllowOriginFunc func(origin string) bool
+
+	// Allowed methods, defaults to GET, HEAD and POST.
+	AllowedMethods []string
+
+	// Optional function computing the allowed methods per request, e.g. from
+	// the routes registered for the request path, it takes precedence over
+	// AllowedMethods.
+	AllowedMethodsFunc func(r *http.Request) []string
+
+	// Allowed request headers, "*" allows any header.
+	AllowedHeaders []string
+
+	// Response headers exposed to the client.
+	ExposedHeaders []string
+
+	// Allow requests with credentials, when set the request origin is sent
+	// back instead of "*".
+	AllowCredentials bool
+
+	// Number of seconds a preflight response can be cached, zero means
+	// the header is not sent.
+	MaxAge int
+}
+
+// CORS adds cross-origin resource sharing headers to responses, and answers
+// preflight requests with 204 No Content.
+func CORS(cfg CORSConfig) func(http.Handler) http.Handler {
+	if len(cfg.AllowedMethods) == 0 {
+		cfg.AllowedMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			preflight := r.Method == http.MethodOptions &&
+				r.Header.Get("Access-Control-Request-Method") != ""
+
+			// Not a cross-origin request.
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if preflight {
+				cfg.preflight(w, r, origin)
+				return
+			}
+
+			w.Header().Add("Vary", "Origin")
+			if cfg.allowOrigin(origin) {
+				cfg.setAllowOrigin(w, origin)
+				if len(cfg.ExposedHeaders) > 0 {
+					w.Header().Set("Access-Control-Expose-Headers", strings.Join(cfg.ExposedHeaders, ", "))
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// preflight answers a preflight request.
+func (cfg CORSConfig) preflight(w http.ResponseWriter, r *http.Request, origin string) {
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+
+	methods := cfg.AllowedMethods
+	if cfg.AllowedMethodsFunc != nil {
+		methods = cfg.AllowedMethodsFunc(r)
+	}
+	method := r.Header.Get("Access-Control-Request-Method")
+	headers := parseHeaderList(r.Header.Get("Access-Control-Request-Headers"))
+
+	// A disallowed preflight gets no CORS headers, and the browser fails it.
+	if !cfg.allowOrigin(origin) || !contains(methods, method) || !cfg.allowHeaders(headers) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	cfg.setAllowOrigin(w, origin)
+	h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if len(headers) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	}
+	if cfg.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(cfg.MaxAge))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setAllowOrigin sets the allowed origin, and the credentials headers.
+func (cfg CORSConfig) setAllowOrigin(w http.ResponseWriter, origin string) {
+	// Credentialed requests are never allowed for "*".
+	if contains(cfg.AllowedOrigins, "*") && !cfg.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if cfg.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// allowOrigin checks if an origin is allowed.
+func (cfg CORSConfig) allowOrigin(origin string) bool {
+	for _, allowed := range cfg.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+
+		// Match a pattern with one wildcard.
+		if i := strings.IndexByte(allowed, '*'); i >= 0 {
+			prefix, suffix := strings.ToLower(allowed[:i]), strings.ToLower(allowed[i+1:])
+			o := strings.ToLower(origin)
+			if len(o) > len(prefix)+len(suffix) && strings.HasPrefix(o, prefix) && strings.HasSuffix(o, suffix) {
+				return true
+			}
+		}
+	}
+
+	return cfg.AllowOriginFunc != nil && cfg.AllowOriginFunc(origin)
+}
+
+// allowHeaders checks if all request headers are allowed.
+func (cfg CORSConfig) allowHeaders(headers []string) bool {
+	if contains(cfg.AllowedHeaders, "*") {
+		return true
+	}
+
+	for _, header := range headers {
+		allowed := false
+		for _, h := range cfg.AllowedHeaders {
+			if http.CanonicalHeaderKey(h) == header {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parseHeaderList parses a comma separated list of header names.
+func parseHeaderList(list string) []string {
+	var headers []string
+	for _, h := range strings.Split(list, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			headers = append(headers, http.CanonicalHeaderKey(h))
+		}
+	}
+
+	return headers
+}
+
+// contains checks if a list contains a string.
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,166 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// okHandler writes "ok".
+func okHandler(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, "ok")
+}
+
+func TestCORSSimpleRequest(t *testing.T) {
+	tests := []struct {
+		name        string
+		cfg         CORSConfig
+		origin      string
+		allowOrigin string
+		credentials string
+	}{
+		{"exact", CORSConfig{AllowedOrigins: []string{"https://kitty.io"}},
+			"https://kitty.io", "https://kitty.io", ""},
+		{"wildcard", CORSConfig{AllowedOrigins: []string{"*"}},
+			"https://kitty.io", "*", ""},
+		{"pattern", CORSConfig{AllowedOrigins: []string{"https://*.kitty.io"}},
+			"https://api.kitty.io", "https://api.kitty.io", ""},
+		{"pattern mismatch", CORSConfig{AllowedOrigins: []string{"https://*.kitty.io"}},
+			"https://kitty.io.evil", "", ""},
+		{"predicate", CORSConfig{AllowOriginFunc: func(o string) bool { return o == "https://cat.io" }},
+			"https://cat.io", "https://cat.io", ""},
+		{"disallowed", CORSConfig{AllowedOrigins: []string{"https://kitty.io"}},
+			"https://evil.io", "", ""},
+		{"credentials with wildcard", CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true},
+			"https://kitty.io", "https://kitty.io", "true"},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/val", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Origin", tt.origin)
+
+		rr := httptest.NewRecorder()
+		CORS(tt.cfg)(http.HandlerFunc(okHandler)).ServeHTTP(rr, req)
+
+		// Check the request reached the handler.
+		if rr.Body.String() != "ok" {
+			t.Errorf("%s: handler returned unexpected body: got %v want %v",
+				tt.name, rr.Body.String(), "ok")
+		}
+
+		// Check the CORS headers are what we expect.
+		if h := rr.Header().Get("Access-Control-Allow-Origin"); h != tt.allowOrigin {
+			t.Errorf("%s: wrong allow origin: got %q want %q", tt.name, h, tt.allowOrigin)
+		}
+		if h := rr.Header().Get("Access-Control-Allow-Credentials"); h != tt.credentials {
+			t.Errorf("%s: wrong allow credentials: got %q want %q", tt.name, h, tt.credentials)
+		}
+		if h := rr.Header().Get("Vary"); h != "Origin" {
+			t.Errorf("%s: wrong vary: got %q want %q", tt.name, h, "Origin")
+		}
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	req, err := http.NewRequest("OPTIONS", "/val/kitty", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Origin", "https://kitty.io")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	req.Header.Set("Access-Control-Request-Headers", "content-type, x-kitty")
+
+	rr := httptest.NewRecorder()
+	handler := CORS(CORSConfig{
+		AllowedOrigins: []string{"https://kitty.io"},
+		AllowedMethods: []string{"GET", "PUT"},
+		AllowedHeaders: []string{"Content-Type", "X-Kitty"},
+		ExposedHeaders: []string{"X-Request-Id"},
+		MaxAge:         600,
+	})(http.HandlerFunc(okHandler))
+	handler.ServeHTTP(rr, req)
+
+	// Check the preflight was answered by the middleware.
+	if status := rr.Code; status != http.StatusNoContent {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusNoContent)
+	}
+	if rr.Body.Len() != 0 {
+		t.Errorf("handler returned unexpected body: %v", rr.Body.String())
+	}
+
+	// Check the CORS headers are what we expect.
+	expected := map[string]string{
+		"Access-Control-Allow-Origin":  "https://kitty.io",
+		"Access-Control-Allow-Methods": "GET, PUT",
+		"Access-Control-Allow-Headers": "Content-Type, X-Kitty",
+		"Access-Control-Max-Age":       "600",
+	}
+	for k, v := range expected {
+		if h := rr.Header().Get(k); h != v {
+			t.Errorf("wrong %s: got %q want %q", k, h, v)
+		}
+	}
+}
+
+func TestCORSPreflightDisallowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		origin  string
+		method  string
+		headers string
+	}{
+		{"origin", "https://evil.io", "PUT", ""},
+		{"method", "https://kitty.io", "DELETE", ""},
+		{"header", "https://kitty.io", "PUT", "X-Evil"},
+	}
+
+	handler := CORS(CORSConfig{
+		AllowedOrigins: []string{"https://kitty.io"},
+		AllowedMethodsFunc: func(r *http.Request) []string {
+			return []string{"GET", "PUT"}
+		},
+		AllowedHeaders: []string{"Content-Type"},
+	})(http.HandlerFunc(okHandler))
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("OPTIONS", "/val/kitty", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Origin", tt.origin)
+		req.Header.Set("Access-Control-Request-Method", tt.method)
+		req.Header.Set("Access-Control-Request-Headers", tt.headers)
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the preflight was answered without CORS headers.
+		if status := rr.Code; status != http.StatusNoContent {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				tt.name, status, http.StatusNoContent)
+		}
+		if h := rr.Header().Get("Access-Control-Allow-Origin"); h != "" {
+			t.Errorf("%s: unexpected allow origin: %q", tt.name, h)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// Drainer tracks in-flight requests, and drains them on shutdown.
+type Drainer struct {
+	mu       sync.Mutex
+	draining bool
+	wg       sync.WaitGroup
+}
+
+// Drain returns a drainer, install its Middleware outermost, and call
+// Shutdown before shutting down the server.
+//
+// Example:
+//
+//	drain := middleware.Drain()
+//	s := &http.Server{Handler: drain.Middleware()(&router)}
+//	...
+//	drain.Shutdown(ctx)
+//	s.Shutdown(ctx)
+func Drain() *Drainer {
+	return &Drainer{}
+}
+
+// Middleware returns the draining middleware, it tracks in-flight requests,
+// and once draining starts, rejects new requests with a JSON 503 and a
+// Connection: close header.
+func (d *Drainer) Middleware() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			d.mu.Lock()
+			if d.draining {
+				d.mu.Unlock()
+				writeDraining(w)
+				return
+			}
+			d.wg.Add(1)
+			d.mu.Unlock()
+			defer d.wg.Done()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Shutdown starts draining, and waits for in-flight requests to complete,
+// or for ctx to be done, in which case it returns the context error.
+func (d *Drainer) Shutdown(ctx context.Context) error {
+	d.mu.Lock()
+	d.draining = true
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Draining returns true once Shutdown was called, it can be used by
+// readiness checks to report not ready while draining.
+func (d *Drainer) Draining() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.draining
+}
+
+// writeDraining writes a JSON 503 response, closing the connection.
+func writeDraining(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Connection", "close")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	io.WriteString(w, `{"error":"server is shutting down"}`)
+}
@@ -0,0 +1,109 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDrain(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	drain := Drain()
+	handler := drain.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		okHandler(w, r)
+	}))
+
+	// Start an in-flight request.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	inFlight := httptest.NewRecorder()
+	go func() {
+		defer wg.Done()
+		handler.ServeHTTP(inFlight, httptest.NewRequest("GET", "/val/a", nil))
+	}()
+	<-started
+
+	if drain.Draining() {
+		t.Errorf("draining before Shutdown")
+	}
+
+	// Start draining.
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- drain.Shutdown(context.Background())
+	}()
+	waitFor(t, "draining", drain.Draining)
+
+	// Check new requests are rejected.
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/val/b", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			rr.Code, http.StatusServiceUnavailable)
+	}
+	if got := rr.Header().Get("Connection"); got != "close" {
+		t.Errorf("wrong Connection header: got %q want close", got)
+	}
+	if rr.Body.String() != `{"error":"server is shutting down"}` {
+		t.Errorf("handler returned unexpected body: %v", rr.Body.String())
+	}
+
+	// Check Shutdown waits for the in-flight request.
+	select {
+	case <-shutdown:
+		t.Fatalf("Shutdown returned before the in-flight request completed")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	wg.Wait()
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown returned an error: %v", err)
+	}
+	if inFlight.Code != http.StatusOK || inFlight.Body.String() != "ok" {
+		t.Errorf("in-flight request was cut off: %v %v", inFlight.Code, inFlight.Body.String())
+	}
+}
+
+func TestDrainShutdownTimeout(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+
+	drain := Drain()
+	handler := drain.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	go handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/val/a", nil))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	// Check Shutdown gives up when the context expires.
+	if err := drain.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown returned wrong error: got %v want %v", err, context.DeadlineExceeded)
+	}
+}
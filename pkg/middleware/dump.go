@@ -0,0 +1,197 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// DefaultDumpRedactedHeaders are the headers redacted by Dump.
+var DefaultDumpRedactedHeaders = []string{"Authorization", "Cookie", "Set-Cookie"}
+
+// DumpOptions configures the Dump middleware.
+type DumpOptions struct {
+	// Maximum number of body bytes dumped, for requests and responses.
+	MaxBody int
+
+	// Headers whose values are redacted, defaults to
+	// DefaultDumpRedactedHeaders.
+	RedactHeaders []string
+}
+
+// Dump logs complete requests and responses, for debugging.
+//
+// See DumpWithOptions.
+func Dump(logger *log.Logger, maxBody int) func(http.Handler) http.Handler {
+	return DumpWithOptions(logger, DumpOptions{MaxBody: maxBody})
+}
+
+// DumpWithOptions logs requests and responses, headers and bodies, using
+// logger, after each request completes. Dumps are correlated by request ID.
+//
+// Dump is meant for development, it is NOT safe for production: dumps may
+// contain credentials and personal data in bodies and unredacted headers,
+// and they are large.
+//
+// Bodies are captured up to MaxBody bytes while they are read and written,
+// so handlers still receive the request body, and streaming responses are
+// passed through and truncated in the dump, not buffered. Bodies that are
+// not UTF-8 text are dumped as their size. If logger is nil the standard
+// logger is used.
+func DumpWithOptions(logger *log.Logger, opts DumpOptions) func(http.Handler) http.Handler {
+	if logger == nil {
+		logger = log.New(log.Writer(), log.Prefix(), log.Flags())
+	}
+	redact := opts.RedactHeaders
+	if redact == nil {
+		redact = DefaultDumpRedactedHeaders
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			reqBody := &dumpCapture{max: opts.MaxBody}
+			if r.Body != nil && r.Body != http.NoBody {
+				r.Body = readCloser{io.TeeReader(r.Body, reqBody), r.Body}
+			}
+			dw := &dumpWriter{statusWriter: newStatusWriter(w), body: dumpCapture{max: opts.MaxBody}}
+
+			next.ServeHTTP(dw.flushable(dw), r)
+
+			id := RequestID(r)
+			if id == "" {
+				id = w.Header().Get(DefaultRequestIDHeader)
+			}
+
+			var b strings.Builder
+			fmt.Fprintf(&b, "dump %s request:\n%s %s %s\nHost: %s\n",
+				orDash(id), r.Method, r.URL.RequestURI(), r.Proto, r.Host)
+			writeDumpHeader(&b, r.Header, redact)
+			b.WriteString(reqBody.String())
+			fmt.Fprintf(&b, "\ndump %s response:\n%s %d %s\n",
+				orDash(id), r.Proto, dw.status, http.StatusText(dw.status))
+			writeDumpHeader(&b, w.Header(), redact)
+			b.WriteString(dw.body.String())
+
+			logger.Print(b.String())
+		})
+	}
+}
+
+// writeDumpHeader writes sorted header lines, redacting values, and an
+// empty line.
+func writeDumpHeader(b *strings.Builder, header http.Header, redact []string) {
+	h := header.Clone()
+	for _, name := range redact {
+		if _, ok := h[http.CanonicalHeaderKey(name)]; ok {
+			h.Set(name, "[REDACTED]")
+		}
+	}
+
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range h[name] {
+			fmt.Fprintf(b, "%s: %s\n", name, v)
+		}
+	}
+	b.WriteString("\n")
+}
+
+// dumpCapture captures up to max bytes of a body, and counts all of them.
+type dumpCapture struct {
+	buf   bytes.Buffer
+	max   int
+	total int64
+}
+
+// Write captures b up to the cap, it never fails.
+func (c *dumpCapture) Write(b []byte) (int, error) {
+	c.total += int64(len(b))
+	if room := c.max - c.buf.Len(); room > 0 {
+		if len(b) > room {
+			c.buf.Write(b[:room])
+		} else {
+			c.buf.Write(b)
+		}
+	}
+
+	return len(b), nil
+}
+
+// String returns the captured body, a binary body placeholder, or a
+// truncation note.
+func (c *dumpCapture) String() string {
+	if c.total == 0 {
+		return ""
+	}
+
+	body := c.buf.Bytes()
+	truncated := c.total > int64(len(body))
+	if truncated {
+		// Don't split a multi byte rune at the cap.
+		for i := 0; i < utf8.UTFMax && len(body) > 0 && !utf8.Valid(body); i++ {
+			body = body[:len(body)-1]
+		}
+	}
+	if !isText(body) {
+		return fmt.Sprintf("[binary body, %d bytes]\n", c.total)
+	}
+	if truncated {
+		return fmt.Sprintf("%s\n[truncated, %d bytes]\n", body, c.total)
+	}
+
+	return string(body) + "\n"
+}
+
+// isText checks if b is UTF-8 text, without control characters other than
+// white space.
+func isText(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, c := range b {
+		if c < 0x20 && c != '\t' && c != '\n' && c != '\r' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// dumpWriter captures the response body while writing it.
+type dumpWriter struct {
+	*statusWriter
+
+	body dumpCapture
+}
+
+// Write captures b, and writes it.
+func (w *dumpWriter) Write(b []byte) (int, error) {
+	n, err := w.statusWriter.Write(b)
+	w.body.Write(b[:n])
+
+	return n, err
+}
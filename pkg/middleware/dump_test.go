@@ -0,0 +1,128 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDump(t *testing.T) {
+	req, err := http.NewRequest("POST", "http://example.com/val/a?x=1", strings.NewReader("kitty"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Content-Type", "text/plain")
+
+	var out bytes.Buffer
+	rr := httptest.NewRecorder()
+	handler := AssignRequestID(RequestIDOptions{Generator: func() string { return "id-1" }})(
+		Dump(log.New(&out, "", 0), 1024)(http.HandlerFunc(echoHandler)))
+	handler.ServeHTTP(rr, req)
+
+	// Check the handler received the body.
+	if rr.Body.String() != "0:kitty" {
+		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), "0:kitty")
+	}
+
+	// Check the dump is what we expect.
+	expected := "dump id-1 request:\n" +
+		"POST /val/a?x=1 HTTP/1.1\n" +
+		"Host: example.com\n" +
+		"Authorization: [REDACTED]\n" +
+		"Content-Type: text/plain\n" +
+		"\n" +
+		"kitty\n" +
+		"\n" +
+		"dump id-1 response:\n" +
+		"HTTP/1.1 200 OK\n" +
+		"Content-Type: text/plain; charset=utf-8\n" +
+		"X-Request-Id: id-1\n" +
+		"\n" +
+		"0:kitty\n"
+	if out.String() != expected {
+		t.Errorf("wrong dump:\ngot  %q\nwant %q", out.String(), expected)
+	}
+}
+
+func TestDumpBodies(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{"truncated", "kitty!", "kitt\n[truncated, 6 bytes]\n"},
+		{"truncated rune", "kitτy", "kit\n[truncated, 6 bytes]\n"},
+		{"binary", "\x00\x01\x02", "[binary body, 3 bytes]\n"},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("PUT", "/val/a", strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var out bytes.Buffer
+		handler := Dump(log.New(&out, "", 0), 4)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(w, r.Body)
+		}))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the bodies passed through untouched.
+		if rr.Body.String() != tt.body {
+			t.Errorf("%s: handler returned unexpected body: got %q want %q",
+				tt.name, rr.Body.String(), tt.body)
+		}
+
+		// Check both bodies are dumped as we expect.
+		if n := strings.Count(out.String(), "\n\n"+tt.expected); n != 2 {
+			t.Errorf("%s: expected %q dumped twice, got:\n%s", tt.name, tt.expected, out.String())
+		}
+	}
+}
+
+func TestDumpStreaming(t *testing.T) {
+	var out bytes.Buffer
+	handler := Dump(log.New(&out, "", 0), 8)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 3; i++ {
+			io.WriteString(w, "data: kitty\n\n")
+			w.(http.Flusher).Flush()
+		}
+	}))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/events", nil))
+
+	// Check the stream was flushed and passed through.
+	if !rr.Flushed {
+		t.Errorf("expected the response to be flushed")
+	}
+	if rr.Body.String() != strings.Repeat("data: kitty\n\n", 3) {
+		t.Errorf("handler returned unexpected body: %q", rr.Body.String())
+	}
+
+	// Check the dump is truncated at the cap.
+	if !strings.HasSuffix(out.String(), "\ndata: ki\n[truncated, 39 bytes]\n") {
+		t.Errorf("wrong dump:\n%s", out.String())
+	}
+}
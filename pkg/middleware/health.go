@@ -0,0 +1,193 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultHealthCheckTimeout is the default timeout of one readiness check.
+const DefaultHealthCheckTimeout = 2 * time.Second
+
+// DefaultHealthTimeout is the default deadline of all readiness checks.
+const DefaultHealthTimeout = 5 * time.Second
+
+// HealthChecker serves liveness and readiness probes.
+type HealthChecker struct {
+	// Timeout of each readiness check, defaults to DefaultHealthCheckTimeout.
+	CheckTimeout time.Duration
+
+	// Deadline of all readiness checks, defaults to DefaultHealthTimeout.
+	Timeout time.Duration
+
+	mu     sync.Mutex
+	checks []healthCheck
+}
+
+// healthCheck is a named readiness check.
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// healthCheckResult is the JSON result of a readiness check.
+type healthCheckResult struct {
+	Status    string  `json:"status"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMS float64 `json:"latency_ms"`
+}
+
+// healthResponse is the JSON body of a probe.
+type healthResponse struct {
+	Status string                       `json:"status"`
+	Checks map[string]healthCheckResult `json:"checks,omitempty"`
+}
+
+// Health returns a health checker, serving liveness and readiness probes.
+//
+// Example:
+//
+//	health := middleware.Health()
+//	health.AddReadinessCheck("db", db.PingContext)
+//
+//	router.HandleFunc("GET", "/livez", health.Live().ServeHTTP)
+//	router.HandleFunc("GET", "/readyz", health.Ready().ServeHTTP)
+func Health() *HealthChecker {
+	return &HealthChecker{
+		CheckTimeout: DefaultHealthCheckTimeout,
+		Timeout:      DefaultHealthTimeout,
+	}
+}
+
+// AddReadinessCheck registers a readiness check, check must return when
+// ctx is done.
+func (h *HealthChecker) AddReadinessCheck(name string, check func(ctx context.Context) error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.checks = append(h.checks, healthCheck{name: name, check: check})
+}
+
+// Live returns the liveness probe handler, it always writes a 200.
+func (h *HealthChecker) Live() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, http.StatusOK, healthResponse{Status: "ok"})
+	})
+}
+
+// Ready returns the readiness probe handler.
+//
+// The readiness checks run concurrently, each with CheckTimeout, and all
+// within Timeout, a check that did not return in time fails. If all checks
+// pass, the handler writes a 200, o/w a 503. The JSON body lists the status
+// and latency of each check, and the error of failed checks.
+func (h *HealthChecker) Ready() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.mu.Lock()
+		checks := append([]healthCheck(nil), h.checks...)
+		h.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(r.Context(), orDefault(h.Timeout, DefaultHealthTimeout))
+		defer cancel()
+
+		results := make([]healthCheckResult, len(checks))
+		var wg sync.WaitGroup
+		for i, c := range checks {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				results[i] = h.runCheck(ctx, c)
+			}()
+		}
+		wg.Wait()
+
+		resp := healthResponse{Status: "ok", Checks: make(map[string]healthCheckResult)}
+		code := http.StatusOK
+		for i, c := range checks {
+			if results[i].Status != "ok" {
+				resp.Status = "fail"
+				code = http.StatusServiceUnavailable
+			}
+			resp.Checks[c.name] = results[i]
+		}
+
+		writeHealth(w, code, resp)
+	})
+}
+
+// runCheck runs a check, and returns its result when it returns, or when
+// its deadline expires.
+func (h *HealthChecker) runCheck(ctx context.Context, c healthCheck) healthCheckResult {
+	ctx, cancel := context.WithTimeout(ctx, orDefault(h.CheckTimeout, DefaultHealthCheckTimeout))
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				done <- fmt.Errorf("panic: %v", recovered)
+			}
+		}()
+		done <- c.check(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("timeout: %v", ctx.Err())
+	}
+
+	result := healthCheckResult{
+		Status:    "ok",
+		LatencyMS: float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	if err != nil {
+		result.Status = "fail"
+		result.Error = err.Error()
+	}
+
+	return result
+}
+
+// orDefault returns d, or def if d is not positive.
+func orDefault(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+
+	return d
+}
+
+// writeHealth writes a JSON probe response.
+func writeHealth(w http.ResponseWriter, code int, resp healthResponse) {
+	body, err := json.Marshal(resp)
+	if err != nil {
+		code = http.StatusInternalServerError
+		body = []byte(`{"status":"fail"}`)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	w.Write(body)
+}
@@ -0,0 +1,158 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// probe serves a probe request, and returns the status and decoded body.
+func probe(t *testing.T, handler http.Handler) (int, map[string]interface{}) {
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/readyz", nil))
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("handler returned invalid JSON: %v: %v", rr.Body.String(), err)
+	}
+
+	return rr.Code, body
+}
+
+// checkResult returns the result of a named check in a probe body.
+func checkResult(body map[string]interface{}, name string) map[string]interface{} {
+	checks, _ := body["checks"].(map[string]interface{})
+	result, _ := checks[name].(map[string]interface{})
+
+	return result
+}
+
+func TestHealthLive(t *testing.T) {
+	health := Health()
+	health.AddReadinessCheck("broken", func(ctx context.Context) error {
+		return errors.New("broken")
+	})
+
+	// Check liveness ignores readiness checks.
+	code, body := probe(t, health.Live())
+	if code != http.StatusOK || body["status"] != "ok" {
+		t.Errorf("unexpected liveness response: %v %v", code, body)
+	}
+}
+
+func TestHealthReady(t *testing.T) {
+	health := Health()
+
+	// Check a service without checks is ready.
+	if code, _ := probe(t, health.Ready()); code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", code, http.StatusOK)
+	}
+
+	health.AddReadinessCheck("store", func(ctx context.Context) error { return nil })
+	code, body := probe(t, health.Ready())
+	if code != http.StatusOK || body["status"] != "ok" {
+		t.Errorf("unexpected readiness response: %v %v", code, body)
+	}
+	if result := checkResult(body, "store"); result["status"] != "ok" {
+		t.Errorf("unexpected store check result: %v", result)
+	}
+
+	health.AddReadinessCheck("db", func(ctx context.Context) error {
+		return errors.New("connection refused")
+	})
+	code, body = probe(t, health.Ready())
+	if code != http.StatusServiceUnavailable || body["status"] != "fail" {
+		t.Errorf("unexpected readiness response: %v %v", code, body)
+	}
+
+	// Check the body shows which check failed.
+	if result := checkResult(body, "db"); result["status"] != "fail" || result["error"] != "connection refused" {
+		t.Errorf("unexpected db check result: %v", result)
+	}
+	if result := checkResult(body, "store"); result["status"] != "ok" {
+		t.Errorf("unexpected store check result: %v", result)
+	}
+	if _, ok := checkResult(body, "store")["latency_ms"]; !ok {
+		t.Errorf("missing check latency: %v", body)
+	}
+}
+
+func TestHealthReadyHungCheck(t *testing.T) {
+	hang := make(chan struct{})
+	defer close(hang)
+
+	health := Health()
+	health.CheckTimeout = 20 * time.Millisecond
+	health.AddReadinessCheck("hung", func(ctx context.Context) error {
+		// Ignore the context, as a misbehaving check would.
+		<-hang
+		return nil
+	})
+	health.AddReadinessCheck("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	health.AddReadinessCheck("panics", func(ctx context.Context) error {
+		panic("kitty is not here")
+	})
+
+	start := time.Now()
+	code, body := probe(t, health.Ready())
+
+	// Check the checks ran concurrently, within their timeout.
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("readiness probe took too long: %v", elapsed)
+	}
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			code, http.StatusServiceUnavailable)
+	}
+	for _, name := range []string{"hung", "slow", "panics"} {
+		if result := checkResult(body, name); result["status"] != "fail" {
+			t.Errorf("unexpected %s check result: %v", name, result)
+		}
+	}
+}
+
+func TestHealthReadyOverallTimeout(t *testing.T) {
+	health := Health()
+	health.CheckTimeout = time.Minute
+	health.Timeout = 20 * time.Millisecond
+	for _, name := range []string{"a", "b", "c"} {
+		health.AddReadinessCheck(name, func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		})
+	}
+
+	start := time.Now()
+	code, _ := probe(t, health.Ready())
+
+	// Check the overall deadline bounds the probe.
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("readiness probe took too long: %v", elapsed)
+	}
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			code, http.StatusServiceUnavailable)
+	}
+}
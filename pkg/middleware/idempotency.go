@@ -0,0 +1,281 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IdempotencyKeyHeader is the header holding a request idempotency key.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotentReplayedHeader is set on replayed responses.
+const IdempotentReplayedHeader = "Idempotent-Replayed"
+
+// IdempotencyRecord is a recorded response, and the hash of the request
+// body that produced it.
+type IdempotencyRecord struct {
+	BodyHash string
+	Status   int
+	Header   http.Header
+	Body     []byte
+}
+
+// IdempotencyStore stores recorded responses.
+type IdempotencyStore interface {
+	// Get returns the record of a key, ok is false if there is no record,
+	// or if it expired.
+	Get(key string) (record *IdempotencyRecord, ok bool, err error)
+
+	// Set stores the record of a key for ttl.
+	Set(key string, record *IdempotencyRecord, ttl time.Duration) error
+}
+
+// Idempotency replays responses of retried POST and PATCH requests, carrying
+// the same Idempotency-Key header.
+//
+// Responses are recorded by key, method and path, for ttl, and replayed with
+// an Idempotent-Replayed header. Only the headers set by the handler are
+// recorded, headers set by outer middleware, e.g. X-Request-Id, are set
+// again by them for the retry. A retry with the same key and a different
+// body is answered with a JSON 409 Conflict. Server errors (5xx) are not
+// recorded, so the request can be retried. Concurrent requests with the same
+// key are served one at a time. The request body is read into memory, use
+// MaxBytes to limit its size.
+func Idempotency(store IdempotencyStore, ttl time.Duration) func(http.Handler) http.Handler {
+	var mu sync.Mutex
+	inFlight := make(map[string]chan struct{})
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(IdempotencyKeyHeader)
+			if key == "" || (r.Method != http.MethodPost && r.Method != http.MethodPatch) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			key = key + "\x00" + r.Method + "\x00" + r.URL.Path
+
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "can't read request body")
+				return
+			}
+			r.Body = readCloser{bytes.NewReader(body), r.Body}
+			sum := sha256.Sum256(body)
+			hash := hex.EncodeToString(sum[:])
+
+			var done chan struct{}
+			for {
+				record, ok, err := store.Get(key)
+				if err != nil {
+					writeJSONError(w, http.StatusInternalServerError, "idempotency store unavailable")
+					return
+				}
+				if ok {
+					replayIdempotent(w, record, hash)
+					return
+				}
+
+				// Wait for an in-flight request with the same key, and look
+				// for its record again.
+				mu.Lock()
+				if wait, busy := inFlight[key]; busy {
+					mu.Unlock()
+					select {
+					case <-wait:
+						continue
+					case <-r.Context().Done():
+						return
+					}
+				}
+				done = make(chan struct{})
+				inFlight[key] = done
+				mu.Unlock()
+				break
+			}
+
+			defer func() {
+				mu.Lock()
+				delete(inFlight, key)
+				mu.Unlock()
+				close(done)
+			}()
+
+			// Headers set before the handler, e.g. X-Request-Id, belong to
+			// this request, and are not recorded.
+			before := w.Header().Clone()
+			iw := &idempotencyWriter{statusWriter: newStatusWriter(w)}
+			next.ServeHTTP(iw.flushable(iw), r)
+
+			if iw.status < 500 && !iw.hijacked {
+				store.Set(key, &IdempotencyRecord{
+					BodyHash: hash,
+					Status:   iw.status,
+					Header:   handlerHeader(before, w.Header()),
+					Body:     iw.body.Bytes(),
+				}, ttl)
+			}
+		})
+	}
+}
+
+// replayIdempotent writes a recorded response, or a 409 if it was recorded
+// for a different request body.
+func replayIdempotent(w http.ResponseWriter, record *IdempotencyRecord, hash string) {
+	if record.BodyHash != hash {
+		writeJSONError(w, http.StatusConflict, "idempotency key reused with a different request body")
+		return
+	}
+
+	h := w.Header()
+	for k, v := range record.Header {
+		h[k] = v
+	}
+	h.Set(IdempotentReplayedHeader, "true")
+	w.WriteHeader(record.Status)
+	w.Write(record.Body)
+}
+
+// handlerHeader returns a copy of the headers in after that are not in
+// before, or have other values.
+func handlerHeader(before http.Header, after http.Header) http.Header {
+	h := make(http.Header)
+	for k, v := range after {
+		if !equalValues(before[k], v) {
+			h[k] = append([]string(nil), v...)
+		}
+	}
+
+	return h
+}
+
+// equalValues returns true if two header values lists are equal.
+func equalValues(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// writeJSONError writes a JSON error response.
+func writeJSONError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	io.WriteString(w, `{"error":"`+msg+`"}`)
+}
+
+// idempotencyWriter records the response body while writing it.
+type idempotencyWriter struct {
+	*statusWriter
+
+	body bytes.Buffer
+}
+
+// Write records b, and writes it.
+func (w *idempotencyWriter) Write(b []byte) (int, error) {
+	n, err := w.statusWriter.Write(b)
+	w.body.Write(b[:n])
+
+	return n, err
+}
+
+// MemoryIdempotencyStore is an in-memory IdempotencyStore, safe for
+// concurrent use.
+type MemoryIdempotencyStore struct {
+	maxEntries int
+	now        func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]memoryIdempotencyEntry
+}
+
+// memoryIdempotencyEntry is a stored record.
+type memoryIdempotencyEntry struct {
+	record  *IdempotencyRecord
+	expires time.Time
+}
+
+// NewMemoryIdempotencyStore returns an in-memory store, holding up to
+// maxEntries records, when full, expired records are evicted first, and
+// then the records closest to expiring.
+func NewMemoryIdempotencyStore(maxEntries int) *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		maxEntries: maxEntries,
+		now:        time.Now,
+		entries:    make(map[string]memoryIdempotencyEntry),
+	}
+}
+
+// Get returns the record of a key.
+func (s *MemoryIdempotencyStore) Get(key string) (*IdempotencyRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok || !s.now().Before(entry.expires) {
+		return nil, false, nil
+	}
+
+	return entry.record, true, nil
+}
+
+// Set stores the record of a key for ttl.
+func (s *MemoryIdempotencyStore) Set(key string, record *IdempotencyRecord, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if _, ok := s.entries[key]; !ok && len(s.entries) >= s.maxEntries {
+		s.evictLocked(now)
+	}
+	if len(s.entries) < s.maxEntries {
+		s.entries[key] = memoryIdempotencyEntry{record: record, expires: now.Add(ttl)}
+	}
+
+	return nil
+}
+
+// evictLocked removes expired records, and if none expired, the record
+// closest to expiring.
+func (s *MemoryIdempotencyStore) evictLocked(now time.Time) {
+	var oldestKey string
+	var oldest time.Time
+	for key, entry := range s.entries {
+		if !now.Before(entry.expires) {
+			delete(s.entries, key)
+			continue
+		}
+		if oldestKey == "" || entry.expires.Before(oldest) {
+			oldestKey, oldest = key, entry.expires
+		}
+	}
+
+	if len(s.entries) >= s.maxEntries && oldestKey != "" {
+		delete(s.entries, oldestKey)
+	}
+}
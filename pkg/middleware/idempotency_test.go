@@ -0,0 +1,237 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// createHandler returns a handler counting its calls, and writing a 201 with
+// the request body and the call number.
+func createHandler(calls *int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(calls, 1)
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Location", "/val/a")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, fmt.Sprintf("%s:%d", body, n))
+	})
+}
+
+// idempotentRequest serves a request with an idempotency key, and returns
+// the recorded response.
+func idempotentRequest(t *testing.T, handler http.Handler, method, path, key, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "" {
+		req.Header.Set(IdempotencyKeyHeader, key)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	return rr
+}
+
+func TestIdempotency(t *testing.T) {
+	var calls int32
+	handler := Idempotency(NewMemoryIdempotencyStore(100), time.Minute)(createHandler(&calls))
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		key      string
+		body     string
+		status   int
+		expected string
+		replayed bool
+	}{
+		{"first", "POST", "/val", "k1", "kitty", http.StatusCreated, "kitty:1", false},
+		{"retry", "POST", "/val", "k1", "kitty", http.StatusCreated, "kitty:1", true},
+		{"retry different body", "POST", "/val", "k1", "tom", http.StatusConflict,
+			`{"error":"idempotency key reused with a different request body"}`, false},
+		{"same key other path", "POST", "/other", "k1", "kitty", http.StatusCreated, "kitty:2", false},
+		{"same key patch", "PATCH", "/val", "k1", "kitty", http.StatusCreated, "kitty:3", false},
+		{"patch retry", "PATCH", "/val", "k1", "kitty", http.StatusCreated, "kitty:3", true},
+		{"no key", "POST", "/val", "", "kitty", http.StatusCreated, "kitty:4", false},
+		{"no key again", "POST", "/val", "", "kitty", http.StatusCreated, "kitty:5", false},
+		{"put ignored", "PUT", "/val", "k2", "kitty", http.StatusCreated, "kitty:6", false},
+		{"put ignored again", "PUT", "/val", "k2", "kitty", http.StatusCreated, "kitty:7", false},
+	}
+
+	for _, tt := range tests {
+		rr := idempotentRequest(t, handler, tt.method, tt.path, tt.key, tt.body)
+
+		// Check the status code is what we expect.
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				tt.name, status, tt.status)
+		}
+
+		// Check the response body is what we expect.
+		if rr.Body.String() != tt.expected {
+			t.Errorf("%s: handler returned unexpected body: got %v want %v",
+				tt.name, rr.Body.String(), tt.expected)
+		}
+
+		// Check replayed responses are marked, and keep their headers.
+		replayed := rr.Header().Get(IdempotentReplayedHeader) == "true"
+		if replayed != tt.replayed {
+			t.Errorf("%s: wrong replayed header: got %v want %v", tt.name, replayed, tt.replayed)
+		}
+		if tt.status == http.StatusCreated && rr.Header().Get("Location") != "/val/a" {
+			t.Errorf("%s: missing Location header", tt.name)
+		}
+	}
+}
+
+func TestIdempotencyServerError(t *testing.T) {
+	var calls int32
+	handler := Idempotency(NewMemoryIdempotencyStore(100), time.Minute)(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+
+	for i := 0; i < 2; i++ {
+		idempotentRequest(t, handler, "POST", "/val", "k1", "kitty")
+	}
+
+	// Check server errors are not replayed.
+	if calls != 2 {
+		t.Errorf("wrong number of handler calls: got %d want 2", calls)
+	}
+}
+
+func TestIdempotencyTTL(t *testing.T) {
+	var calls int32
+	now := time.Unix(0, 0)
+	store := NewMemoryIdempotencyStore(100)
+	store.now = func() time.Time { return now }
+	handler := Idempotency(store, time.Minute)(createHandler(&calls))
+
+	idempotentRequest(t, handler, "POST", "/val", "k1", "kitty")
+
+	now = now.Add(59 * time.Second)
+	if rr := idempotentRequest(t, handler, "POST", "/val", "k1", "kitty"); rr.Body.String() != "kitty:1" {
+		t.Errorf("expected a replay before the TTL expired, got %v", rr.Body.String())
+	}
+
+	now = now.Add(time.Second)
+	if rr := idempotentRequest(t, handler, "POST", "/val", "k1", "kitty"); rr.Body.String() != "kitty:2" {
+		t.Errorf("expected a new response after the TTL expired, got %v", rr.Body.String())
+	}
+}
+
+func TestIdempotencyConcurrent(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	handler := Idempotency(NewMemoryIdempotencyStore(100), time.Minute)(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			<-release
+			w.WriteHeader(http.StatusCreated)
+			io.WriteString(w, "kitty")
+		}))
+
+	const n = 20
+	var wg sync.WaitGroup
+	var replayed int32
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rr := idempotentRequest(t, handler, "POST", "/val", "k1", "kitty")
+			if rr.Code != http.StatusCreated || rr.Body.String() != "kitty" {
+				t.Errorf("unexpected response: %v %q", rr.Code, rr.Body.String())
+			}
+			if rr.Header().Get(IdempotentReplayedHeader) == "true" {
+				atomic.AddInt32(&replayed, 1)
+			}
+		}()
+	}
+
+	// Let the requests pile up on the in-flight request.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("wrong number of handler calls: got %d want 1", calls)
+	}
+	if replayed != n-1 {
+		t.Errorf("wrong number of replayed responses: got %d want %d", replayed, n-1)
+	}
+}
+
+func TestMemoryIdempotencyStoreEviction(t *testing.T) {
+	now := time.Unix(0, 0)
+	store := NewMemoryIdempotencyStore(2)
+	store.now = func() time.Time { return now }
+
+	for _, key := range []string{"a", "b", "c"} {
+		store.Set(key, &IdempotencyRecord{Status: http.StatusCreated}, time.Minute)
+		now = now.Add(time.Second)
+	}
+
+	// Check the record closest to expiring was evicted.
+	if _, ok, _ := store.Get("a"); ok {
+		t.Errorf("expected a to be evicted")
+	}
+	for _, key := range []string{"b", "c"} {
+		if _, ok, _ := store.Get(key); !ok {
+			t.Errorf("expected %s to be stored", key)
+		}
+	}
+}
+
+func TestIdempotencyRequestID(t *testing.T) {
+	var calls int32
+	var ids int32
+	handler := AssignRequestID(RequestIDOptions{
+		Generator: func() string { return fmt.Sprintf("id-%d", atomic.AddInt32(&ids, 1)) },
+	})(Idempotency(NewMemoryIdempotencyStore(100), time.Minute)(createHandler(&calls)))
+
+	first := idempotentRequest(t, handler, "POST", "/val", "k1", "kitty")
+	retry := idempotentRequest(t, handler, "POST", "/val", "k1", "kitty")
+
+	// Check the retry is replayed with its own request ID.
+	if retry.Header().Get(IdempotentReplayedHeader) != "true" || retry.Body.String() != "kitty:1" {
+		t.Errorf("retry was not replayed: %v %q", retry.Header(), retry.Body.String())
+	}
+	if id := first.Header().Get(DefaultRequestIDHeader); id != "id-1" {
+		t.Errorf("wrong request ID of the first response: got %q want %q", id, "id-1")
+	}
+	if id := retry.Header().Values(DefaultRequestIDHeader); len(id) != 1 || id[0] != "id-2" {
+		t.Errorf("wrong request ID of the replayed response: got %q want %q", id, "id-2")
+	}
+
+	// Check headers set by the handler are replayed.
+	if retry.Header().Get("Location") != "/val/a" {
+		t.Errorf("missing Location header")
+	}
+}
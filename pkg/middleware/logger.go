@@ -0,0 +1,204 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/yaacov/gokitty/pkg/mux"
+)
+
+// Format is a log line format.
+type Format int
+
+const (
+	// TextFormat logs space separated values.
+	TextFormat Format = iota
+	// JSONFormat logs one JSON object per line.
+	JSONFormat
+)
+
+// LoggerOptions configures the Logger middleware.
+type LoggerOptions struct {
+	// Logger used to write log lines, if nil the standard logger is used.
+	// When using JSONFormat, the logger should have no prefix or flags.
+	Logger *log.Logger
+
+	// Format of the log lines, defaults to TextFormat.
+	Format Format
+
+	// Now returns the current time, if nil time.Now is used.
+	Now func() time.Time
+}
+
+// logEntry is the log line of one request.
+type logEntry struct {
+	Time       string  `json:"ts"`
+	Level      string  `json:"level"`
+	Method     string  `json:"method"`
+	OrigMethod string  `json:"original_method,omitempty"`
+	Path       string  `json:"path"`
+	Route      string  `json:"route,omitempty"`
+	RequestID  string  `json:"request_id,omitempty"`
+	User       string  `json:"user,omitempty"`
+	Status     int     `json:"status"`
+	Bytes      int64   `json:"bytes"`
+	DurationMS float64 `json:"duration_ms"`
+	Remote     string  `json:"remote"`
+	UserAgent  string  `json:"user_agent"`
+
+	duration time.Duration
+}
+
+// Logger logs requests, with the response status, size and latency.
+//
+// When wrapping a mux.Router, the matched route template is logged, and when
+// wrapped by AssignRequestID, or wrapping it with the default header,
+// the request ID is logged. The authenticated user name, o/w the subject
+// common name of a verified TLS client certificate, and the original method
+// of requests rewritten by MethodOverride, are logged.
+func Logger(opts LoggerOptions) func(http.Handler) http.Handler {
+	logger := opts.Logger
+	if logger == nil {
+		logger = log.New(log.Writer(), log.Prefix(), log.Flags())
+	}
+	now := opts.Now
+	if now == nil {
+		now = time.Now
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := now()
+			sw := newStatusWriter(w)
+			info := &logInfo{}
+			r = mux.TrackRoute(r.WithContext(context.WithValue(r.Context(), ctxLogInfoKey, info)))
+
+			next.ServeHTTP(sw.flushable(sw), r)
+
+			duration := now().Sub(start)
+			route, _ := mux.CurrentRoute(r)
+			method, original := r.Method, OriginalMethod(r)
+			if info.method != "" {
+				method, original = info.method, info.originalMethod
+			}
+			user := info.user
+			if user == "" {
+				user = clientCertName(r)
+			}
+			id := RequestID(r)
+			if id == "" {
+				id = w.Header().Get(DefaultRequestIDHeader)
+			}
+			entry := logEntry{
+				Time:       start.UTC().Format(time.RFC3339Nano),
+				Level:      logLevel(sw.status),
+				Method:     method,
+				OrigMethod: original,
+				Path:       r.URL.Path,
+				Route:      route,
+				RequestID:  id,
+				User:       user,
+				Status:     sw.status,
+				Bytes:      sw.bytes,
+				DurationMS: float64(duration) / float64(time.Millisecond),
+				Remote:     r.RemoteAddr,
+				UserAgent:  r.UserAgent(),
+				duration:   duration,
+			}
+			writeLogEntry(logger, opts.Format, entry)
+		})
+	}
+}
+
+// The context key for the log info.
+const ctxLogInfoKey = ctxKey("LogInfo")
+
+// logInfo holds values set by middleware further down the handler chain.
+type logInfo struct {
+	user           string
+	method         string
+	originalMethod string
+}
+
+// setLogUser sets the user name logged for a request, if it's logged.
+func setLogUser(r *http.Request, user string) {
+	if info, ok := r.Context().Value(ctxLogInfoKey).(*logInfo); ok {
+		info.user = user
+	}
+}
+
+// setLogMethod sets the overridden method logged for a request, if it's
+// logged.
+func setLogMethod(r *http.Request, original, method string) {
+	if info, ok := r.Context().Value(ctxLogInfoKey).(*logInfo); ok {
+		info.method = method
+		info.originalMethod = original
+	}
+}
+
+// clientCertName returns the subject common name of a verified TLS client
+// certificate, or an empty string if the request has none.
+func clientCertName(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// writeLogEntry writes a log entry using a log format.
+func writeLogEntry(logger *log.Logger, format Format, entry logEntry) {
+	if format == JSONFormat {
+		j, err := json.Marshal(entry)
+		if err != nil {
+			logger.Println(err)
+			return
+		}
+		logger.Println(string(j))
+		return
+	}
+
+	logger.Println(entry.Method, entry.Path, entry.Status, entry.Bytes,
+		entry.duration, orDash(entry.Route), orDash(entry.RequestID),
+		entry.Remote, entry.UserAgent)
+}
+
+// logLevel returns the log level of a response status, "error" for server
+// errors, "warn" for client errors, o/w "info".
+func logLevel(status int) string {
+	switch {
+	case status >= http.StatusInternalServerError:
+		return "error"
+	case status >= http.StatusBadRequest:
+		return "warn"
+	}
+
+	return "info"
+}
+
+// orDash returns "-" for a missing value.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
@@ -0,0 +1,214 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/yaacov/gokitty/pkg/mux"
+)
+
+func newTestRouter() *mux.Router {
+	router := mux.Router{}
+	router.HandleFunc("GET", "/val/:key", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "kitty")
+	})
+
+	return &router
+}
+
+func TestLoggerText(t *testing.T) {
+	req, err := http.NewRequest("GET", "/val/hello", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("User-Agent", "kitty-test")
+
+	var out bytes.Buffer
+	rr := httptest.NewRecorder()
+	handler := Logger(LoggerOptions{Logger: log.New(&out, "", 0)})(newTestRouter())
+	handler.ServeHTTP(rr, req)
+
+	// Check the log line is what we expect, the duration varies.
+	fields := strings.Fields(out.String())
+	if len(fields) != 9 {
+		t.Fatalf("logger wrote unexpected line: %v", out.String())
+	}
+	fields[4] = "-"
+	expected := "GET /val/hello 201 5 - /val/:key - 127.0.0.1:1234 kitty-test"
+	if strings.Join(fields, " ") != expected {
+		t.Errorf("logger wrote unexpected line: got %v want %v",
+			strings.Join(fields, " "), expected)
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	req, err := http.NewRequest("GET", "/not-found", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	rr := httptest.NewRecorder()
+	handler := Logger(LoggerOptions{
+		Logger: log.New(&out, "", 0),
+		Format: JSONFormat,
+	})(newTestRouter())
+	handler.ServeHTTP(rr, req)
+
+	// Check the log line is a JSON object.
+	var entry map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("logger wrote invalid JSON: %v: %v", out.String(), err)
+	}
+
+	// Check the log fields are what we expect.
+	if entry["status"] != float64(http.StatusNotFound) {
+		t.Errorf("logger wrote wrong status: got %v want %v",
+			entry["status"], http.StatusNotFound)
+	}
+	if entry["level"] != "warn" {
+		t.Errorf("logger wrote wrong level: got %v want %v", entry["level"], "warn")
+	}
+	if entry["path"] != "/not-found" {
+		t.Errorf("logger wrote wrong path: got %v want %v",
+			entry["path"], "/not-found")
+	}
+	if _, ok := entry["route"]; ok {
+		t.Errorf("logger wrote unexpected route: %v", entry["route"])
+	}
+}
+
+func TestLoggerFlush(t *testing.T) {
+	req, err := http.NewRequest("GET", "/stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := Logger(LoggerOptions{Logger: log.New(io.Discard, "", 0)})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "data")
+			w.(http.Flusher).Flush()
+		}))
+	handler.ServeHTTP(rr, req)
+
+	// Check the flush reached the wrapped writer.
+	if !rr.Flushed {
+		t.Errorf("logger did not pass flush to the wrapped writer")
+	}
+}
+
+// plainWriter is a response writer that can't flush.
+type plainWriter struct {
+	http.ResponseWriter
+}
+
+func TestLoggerNoFlush(t *testing.T) {
+	req, err := http.NewRequest("GET", "/stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var isFlusher bool
+	var flushErr error
+	handler := Logger(LoggerOptions{Logger: log.New(io.Discard, "", 0)})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, isFlusher = w.(http.Flusher)
+			flushErr = http.NewResponseController(w).Flush()
+		}))
+	handler.ServeHTTP(plainWriter{httptest.NewRecorder()}, req)
+
+	// Check the handler learns the wrapped writer can't flush.
+	if isFlusher {
+		t.Errorf("logger writer implements http.Flusher over a writer that can't flush")
+	}
+	if !errors.Is(flushErr, http.ErrNotSupported) {
+		t.Errorf("wrong flush error: got %v want %v", flushErr, http.ErrNotSupported)
+	}
+}
+
+func TestLoggerHijack(t *testing.T) {
+	handler := Logger(LoggerOptions{Logger: log.New(io.Discard, "", 0)})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+
+			buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 6\r\n\r\nkitten")
+			buf.Flush()
+		}))
+
+	// Start the http server.
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	// Query server.
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Check the response body is what we expect.
+	if string(body) != "kitten" {
+		t.Errorf("handler returned unexpected body: got %v want %v",
+			string(body), "kitten")
+	}
+}
+
+func TestLoggerClientCert(t *testing.T) {
+	req, err := http.NewRequest("GET", "/val/hello", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.TLS = &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "kitty-client"}}}},
+	}
+
+	var out bytes.Buffer
+	handler := Logger(LoggerOptions{Logger: log.New(&out, "", 0), Format: JSONFormat})(newTestRouter())
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Check the client certificate name is logged as the user.
+	var entry map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("logger wrote invalid JSON: %v: %v", out.String(), err)
+	}
+	if entry["user"] != "kitty-client" {
+		t.Errorf("logger wrote wrong user: got %v want %v", entry["user"], "kitty-client")
+	}
+}
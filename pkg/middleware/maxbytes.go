@@ -0,0 +1,142 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// The context key for the body size limit.
+const ctxMaxBytesKey = ctxKey("MaxBytes")
+
+// MaxBytes limits the size of request bodies to n bytes.
+//
+// The limit is set for methods that can carry a body, GET and HEAD requests
+// are not changed. Requests with a larger Content-Length are rejected before
+// calling the next handler, and when a handler reads past the limit, its
+// response is replaced by a JSON 413 Request Entity Too Large. Handlers can
+// retrieve the limit calling middleware.MaxBytesLimit(request).
+func MaxBytes(n int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if r.ContentLength > n {
+				writeTooLarge(w, n)
+				return
+			}
+
+			body := &limitedBody{ReadCloser: http.MaxBytesReader(w, r.Body, n)}
+			lw := &limitedWriter{ResponseWriter: w, body: body, limit: n}
+			r.Body = body
+			r = r.WithContext(context.WithValue(r.Context(), ctxMaxBytesKey, n))
+
+			next.ServeHTTP(lw, r)
+
+			// The handler read past the limit, and wrote nothing.
+			if body.exceeded && !lw.replaced {
+				lw.replace()
+			}
+		})
+	}
+}
+
+// MaxBytesLimit returns the request body size limit of the current request,
+// ok is false if the request has no limit.
+func MaxBytesLimit(r *http.Request) (int64, bool) {
+	n, ok := r.Context().Value(ctxMaxBytesKey).(int64)
+
+	return n, ok
+}
+
+// writeTooLarge writes a JSON 413 response.
+func writeTooLarge(w http.ResponseWriter, n int64) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	io.WriteString(w, fmt.Sprintf(`{"error":"request body too large","limit":%d}`, n))
+}
+
+// limitedBody records reading past the body size limit.
+type limitedBody struct {
+	io.ReadCloser
+
+	exceeded bool
+}
+
+// Read reads from the limited body.
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		b.exceeded = true
+	}
+
+	return n, err
+}
+
+// limitedWriter replaces the response of a handler that read past the body
+// size limit.
+type limitedWriter struct {
+	http.ResponseWriter
+
+	body     *limitedBody
+	limit    int64
+	wrote    bool
+	replaced bool
+}
+
+// WriteHeader sends the status code, or the 413 response.
+func (w *limitedWriter) WriteHeader(code int) {
+	if w.checkReplace() {
+		return
+	}
+	w.wrote = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write writes b, or discards it after sending the 413 response.
+func (w *limitedWriter) Write(b []byte) (int, error) {
+	if w.checkReplace() {
+		return len(b), nil
+	}
+	w.wrote = true
+
+	return w.ResponseWriter.Write(b)
+}
+
+// checkReplace replaces the response if the body size limit was exceeded
+// before anything was written, and reports if the response is replaced.
+func (w *limitedWriter) checkReplace() bool {
+	if w.body.exceeded && !w.wrote && !w.replaced {
+		w.replace()
+	}
+
+	return w.replaced
+}
+
+// replace sends the 413 response.
+func (w *limitedWriter) replace() {
+	w.replaced = true
+	writeTooLarge(w.ResponseWriter, w.limit)
+}
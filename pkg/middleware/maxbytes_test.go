@@ -0,0 +1,106 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// echoHandler writes the request body, or a 400 if it can't be read.
+func echoHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	limit, _ := MaxBytesLimit(r)
+	io.WriteString(w, fmt.Sprintf("%d:%s", limit, body))
+}
+
+func TestMaxBytes(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		body     string
+		chunked  bool
+		status   int
+		expected string
+	}{
+		{"at limit", "POST", "kitty", false, http.StatusOK, "5:kitty"},
+		{"one byte over", "POST", "kitty!", false, http.StatusRequestEntityTooLarge,
+			`{"error":"request body too large","limit":5}`},
+		{"chunked at limit", "PUT", "kitty", true, http.StatusOK, "5:kitty"},
+		{"chunked one byte over", "PUT", "kitty!", true, http.StatusRequestEntityTooLarge,
+			`{"error":"request body too large","limit":5}`},
+		{"get untouched", "GET", "kitty!", false, http.StatusOK, "0:kitty!"},
+	}
+
+	handler := MaxBytes(5)(http.HandlerFunc(echoHandler))
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, "/val", strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.chunked {
+			// Hide the body length, as in chunked transfer encoding.
+			req.ContentLength = -1
+			req.Body = io.NopCloser(strings.NewReader(tt.body))
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the status code is what we expect.
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				tt.name, status, tt.status)
+		}
+
+		// Check the response body is what we expect.
+		if rr.Body.String() != tt.expected {
+			t.Errorf("%s: handler returned unexpected body: got %v want %v",
+				tt.name, rr.Body.String(), tt.expected)
+		}
+	}
+}
+
+func TestMaxBytesSilentHandler(t *testing.T) {
+	req, err := http.NewRequest("POST", "/val", strings.NewReader("kitty!"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ContentLength = -1
+
+	rr := httptest.NewRecorder()
+	handler := MaxBytes(5)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+	}))
+	handler.ServeHTTP(rr, req)
+
+	// Check the status code is what we expect.
+	if status := rr.Code; status != http.StatusRequestEntityTooLarge {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusRequestEntityTooLarge)
+	}
+}
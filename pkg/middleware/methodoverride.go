@@ -0,0 +1,113 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// MethodOverrideHeader is the header holding an overriding method.
+const MethodOverrideHeader = "X-HTTP-Method-Override"
+
+// MethodOverrideField is the form field holding an overriding method.
+const MethodOverrideField = "_method"
+
+// maxOverrideFormSize is the largest form body searched for an override.
+const maxOverrideFormSize = 10 << 20
+
+// The context key for the original request method.
+const ctxOriginalMethodKey = ctxKey("OriginalMethod")
+
+// MethodOverride rewrites the method of POST requests, to the method in the
+// X-HTTP-Method-Override header, or in the _method field of a url encoded
+// form, letting HTML forms use PUT, PATCH and DELETE routes.
+//
+// Only PUT, PATCH and DELETE overrides are honored, and the header takes
+// precedence over the form field. The form body is restored after reading,
+// so later handlers can read it again. The original method can be retrieved
+// calling middleware.OriginalMethod(request).
+func MethodOverride() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			method := r.Header.Get(MethodOverrideHeader)
+			if method == "" && isURLEncodedForm(r) {
+				method = formMethod(r)
+			}
+
+			method = strings.ToUpper(method)
+			if method == http.MethodPut || method == http.MethodPatch || method == http.MethodDelete {
+				r = r.WithContext(context.WithValue(r.Context(), ctxOriginalMethodKey, r.Method))
+				setLogMethod(r, r.Method, method)
+				r.Method = method
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// OriginalMethod returns the method of the current request before it was
+// overridden, or an empty string if it was not overridden.
+func OriginalMethod(r *http.Request) string {
+	method, _ := r.Context().Value(ctxOriginalMethodKey).(string)
+
+	return method
+}
+
+// isURLEncodedForm returns true if the request body is a url encoded form.
+func isURLEncodedForm(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	return err == nil && mediaType == "application/x-www-form-urlencoded"
+}
+
+// formMethod returns the override field of a url encoded form body, and
+// restores the body for later handlers.
+func formMethod(r *http.Request) string {
+	if r.Body == nil || r.Body == http.NoBody {
+		return ""
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(r.Body, maxOverrideFormSize))
+	r.Body = readCloser{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+	if err != nil || len(buf) == maxOverrideFormSize {
+		return ""
+	}
+
+	values, err := url.ParseQuery(string(buf))
+	if err != nil {
+		return ""
+	}
+
+	return values.Get(MethodOverrideField)
+}
+
+// readCloser reads from a reader, and closes the original body.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
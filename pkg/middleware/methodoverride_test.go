@@ -0,0 +1,127 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// methodHandler writes the request method, the original method and the body.
+func methodHandler(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	io.WriteString(w, r.Method+":"+OriginalMethod(r)+":"+string(body))
+}
+
+func TestMethodOverride(t *testing.T) {
+	form := "application/x-www-form-urlencoded"
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		header      string
+		body        string
+		expected    string
+	}{
+		{"header", "POST", "", "DELETE", "", "DELETE:POST:"},
+		{"header lower case", "POST", "", "patch", "", "PATCH:POST:"},
+		{"form field", "POST", form, "", "_method=PUT&v=1", "PUT:POST:_method=PUT&v=1"},
+		{"form field with charset", "POST", form + "; charset=utf-8", "", "_method=DELETE",
+			"DELETE:POST:_method=DELETE"},
+		{"header wins", "POST", form, "PATCH", "_method=PUT", "PATCH:POST:_method=PUT"},
+		{"json body", "POST", "application/json", "", `{"_method":"PUT"}`,
+			`POST::{"_method":"PUT"}`},
+		{"disallowed method", "POST", "", "GET", "", "POST::"},
+		{"disallowed form method", "POST", form, "", "_method=CONNECT", "POST::_method=CONNECT"},
+		{"not a post", "GET", "", "DELETE", "", "GET::"},
+	}
+
+	handler := MethodOverride()(http.HandlerFunc(methodHandler))
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, "/val/a", strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		if tt.header != "" {
+			req.Header.Set(MethodOverrideHeader, tt.header)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the response body is what we expect.
+		if rr.Body.String() != tt.expected {
+			t.Errorf("%s: handler returned unexpected body: got %v want %v",
+				tt.name, rr.Body.String(), tt.expected)
+		}
+	}
+}
+
+func TestMethodOverrideJSONBodyNotConsumed(t *testing.T) {
+	body := `{"key":"kitty"}`
+	req, err := http.NewRequest("POST", "/val/a", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(MethodOverrideHeader, "PUT")
+
+	var got map[string]string
+	handler := MethodOverride()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("handler could not decode body: %v", err)
+		}
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Check the body reached the handler.
+	if got["key"] != "kitty" {
+		t.Errorf("handler got unexpected body: %v", got)
+	}
+}
+
+func TestMethodOverrideRouter(t *testing.T) {
+	req, err := http.NewRequest("POST", "/val/a", strings.NewReader("_method=DELETE"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var out bytes.Buffer
+	rr := httptest.NewRecorder()
+	logger := Logger(LoggerOptions{Logger: log.New(&out, "", 0), Format: JSONFormat})
+	logger(MethodOverride()(newTestRouter())).ServeHTTP(rr, req)
+
+	// Check the log line records both methods.
+	var entry map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("logger wrote invalid JSON: %v: %v", out.String(), err)
+	}
+	if entry["method"] != "DELETE" || entry["original_method"] != "POST" {
+		t.Errorf("logger wrote wrong methods: got %v, %v want DELETE, POST",
+			entry["method"], entry["original_method"])
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/yaacov/gokitty/pkg/mux"
+)
+
+// UnmatchedRoute is the route template observed for requests that did not
+// match any route.
+const UnmatchedRoute = "unmatched"
+
+// MetricsObserver observes completed requests.
+type MetricsObserver interface {
+	// Observe is called after each request, with the request method,
+	// the matched route template, the response status and the latency.
+	Observe(method, template string, status int, duration time.Duration)
+}
+
+// InFlightObserver is optionally implemented by a MetricsObserver that tracks
+// the number of in-flight requests, InFlight is called with +1 when
+// a request starts and with -1 when it ends.
+type InFlightObserver interface {
+	InFlight(delta int)
+}
+
+// ObserverFunc is an adapter to use a function as a MetricsObserver.
+type ObserverFunc func(method, template string, status int, duration time.Duration)
+
+// Observe calls f(method, template, status, duration).
+func (f ObserverFunc) Observe(method, template string, status int, duration time.Duration) {
+	f(method, template, status, duration)
+}
+
+// Metrics observes requests, labeled by method, route template and status.
+//
+// The route template is retrieved from a wrapped mux.Router, so the number of
+// label values stays bounded, requests that did not match a route are
+// observed as UnmatchedRoute.
+func Metrics(observer MetricsObserver) func(http.Handler) http.Handler {
+	inFlight, _ := observer.(InFlightObserver)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if inFlight != nil {
+				inFlight.InFlight(1)
+				defer inFlight.InFlight(-1)
+			}
+
+			start := time.Now()
+			sw := newStatusWriter(w)
+			r = mux.TrackRoute(r)
+
+			next.ServeHTTP(sw.flushable(sw), r)
+
+			template, ok := mux.CurrentRoute(r)
+			if !ok {
+				template = UnmatchedRoute
+			}
+			observer.Observe(r.Method, template, sw.status, time.Since(start))
+		})
+	}
+}
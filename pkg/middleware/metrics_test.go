@@ -0,0 +1,122 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yaacov/gokitty/pkg/mux"
+)
+
+// observation is one observed request.
+type observation struct {
+	method   string
+	template string
+	status   int
+}
+
+// testObserver records observations and in-flight requests.
+type testObserver struct {
+	mu           sync.Mutex
+	observations []observation
+	inFlight     int
+	maxInFlight  int
+}
+
+func (o *testObserver) Observe(method, template string, status int, duration time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.observations = append(o.observations, observation{method, template, status})
+}
+
+func (o *testObserver) InFlight(delta int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.inFlight += delta
+	if o.inFlight > o.maxInFlight {
+		o.maxInFlight = o.inFlight
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	observer := &testObserver{}
+	handler := Metrics(observer)(newTestRouter())
+
+	for _, path := range []string{"/val/a", "/val/b", "/not-found"} {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// Check the observations are labeled by route template.
+	expected := []observation{
+		{"GET", "/val/:key", http.StatusCreated},
+		{"GET", "/val/:key", http.StatusCreated},
+		{"GET", UnmatchedRoute, http.StatusNotFound},
+	}
+	if fmt.Sprint(observer.observations) != fmt.Sprint(expected) {
+		t.Errorf("unexpected observations: got %v want %v",
+			observer.observations, expected)
+	}
+
+	// Check the in-flight gauge is back to zero.
+	if observer.inFlight != 0 || observer.maxInFlight != 1 {
+		t.Errorf("unexpected in-flight requests: got %v (max %v) want 0 (max 1)",
+			observer.inFlight, observer.maxInFlight)
+	}
+}
+
+// ExampleMetrics publishes request metrics using expvar.
+func ExampleMetrics() {
+	requests := new(expvar.Map).Init()
+	errors := new(expvar.Map).Init()
+	latency := new(expvar.Map).Init()
+	buckets := []time.Duration{10 * time.Millisecond, 100 * time.Millisecond, time.Second}
+
+	// Count requests, errors, and latency histogram buckets.
+	observer := ObserverFunc(func(method, template string, status int, duration time.Duration) {
+		requests.Add(fmt.Sprintf("%s %s %d", method, template, status), 1)
+		if status >= http.StatusInternalServerError {
+			errors.Add(fmt.Sprintf("%s %s", method, template), 1)
+		}
+		for _, b := range buckets {
+			if duration <= b {
+				latency.Add(fmt.Sprintf("%s %s le=%s", method, template, b), 1)
+			}
+		}
+		latency.Add(fmt.Sprintf("%s %s le=+Inf", method, template), 1)
+	})
+
+	router := mux.Router{}
+	router.HandleFunc("GET", "/val/:key", okHandler)
+	handler := Metrics(observer)(&router)
+
+	// In a real server, publish the maps with expvar.Publish and serve
+	// them with expvar.Handler().
+	req, _ := http.NewRequest("GET", "/val/kitty", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	fmt.Println(requests.String())
+	// Output: {"GET /val/:key 200": 1}
+}
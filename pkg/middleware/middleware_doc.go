@@ -0,0 +1,92 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package middleware is a collection of small http middleware for kitty.
+//
+// Each middleware is a function returning a func(http.Handler) http.Handler,
+// so it can wrap a mux.Router or any other http.Handler.
+//
+// Logger logs one line for each request, with the response status, size and
+// latency, and the matched route template when wrapping a mux.Router.
+//
+// CombinedLog logs one line for each request in the Apache combined or common
+// log format.
+//
+// Dump logs complete requests and responses for debugging, it is meant for
+// development only.
+//
+// Recover recovers panics, logs them with the stack, and writes a 500.
+//
+// AssignRequestID assigns an ID to every request, the ID is retrieved calling
+// middleware.RequestID(request).
+//
+// CORS adds cross-origin resource sharing headers, and answers preflights.
+//
+// BasicAuth authenticates requests using HTTP basic authentication, the user
+// name is retrieved calling middleware.AuthUser(request).
+//
+// BearerAuth authenticates requests carrying a bearer token, using an injected
+// verifier, the claims are retrieved calling middleware.Claims(request).
+//
+// Metrics observes requests labeled by method, route template and status.
+//
+// Timeout cancels the request context after a deadline, and writes a JSON 503.
+//
+// ConcurrencyLimit limits the number of requests served concurrently, queues
+// some of the rest, and sheds the others with a JSON 503.
+//
+// RateLimit limits the rate of requests of each client IP, or of another key,
+// using token buckets, and rejects the others with a JSON 429.
+//
+// Drain tracks in-flight requests, and on shutdown rejects new requests and
+// waits for the in-flight ones to complete.
+//
+// Health serves liveness and readiness probes, readiness aggregates registered
+// checks, run concurrently with a deadline.
+//
+// Idempotency replays the recorded response of retried POST and PATCH requests
+// carrying the same Idempotency-Key header, using a pluggable IdempotencyStore.
+//
+// MaxBytes limits the size of request bodies, and writes a JSON 413.
+//
+// RequireContentType rejects request bodies of unexpected media types with a
+// JSON 415.
+//
+// SecureHeaders sets security related response headers.
+//
+// RealIP resolves the client IP of requests sent through trusted proxies, the
+// IP is retrieved calling middleware.ClientIP(request).
+//
+// Cache memoizes GET responses for a TTL, stored responses are removed calling
+// Invalidate or InvalidatePrefix when the underlying data changes. Responses
+// are shared by all requests with the same key, requests with an
+// Authorization header and private or Vary responses are not cached.
+//
+// MethodOverride lets HTML forms send PUT, PATCH and DELETE requests, using a
+// _method form field or an X-HTTP-Method-Override header.
+//
+// Example:
+//
+//	logger := middleware.Logger(middleware.LoggerOptions{
+//	    Logger: log.New(os.Stdout, "", 0),
+//	    Format: middleware.JSONFormat,
+//	})
+//
+//	s := &http.Server{
+//	    Addr:           ":8080",
+//	    Handler:        logger(&router),
+//	}
+//	log.Fatal(s.ListenAndServe())
+package middleware
@@ -0,0 +1,182 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultRateLimitMaxKeys is the default number of keys tracked by the
+// RateLimit middleware.
+const DefaultRateLimitMaxKeys = 10000
+
+// RateLimitOptions configures the RateLimit middleware.
+type RateLimitOptions struct {
+	// Rate is the number of requests per second allowed for each key.
+	Rate float64
+
+	// Burst is the number of requests allowed at once for each key,
+	// defaults to 1.
+	Burst int
+
+	// Optional function returning the key of a request, defaults to the
+	// client IP, as returned by ClientIP.
+	Key func(r *http.Request) string
+
+	// Maximum number of tracked keys, defaults to DefaultRateLimitMaxKeys,
+	// idle keys are dropped first when it is reached.
+	MaxKeys int
+
+	// Optional custom handler for limited requests, it receives the
+	// duration until the next request is allowed. If not defined, a 429
+	// with a JSON error body and a Retry-After header is written.
+	Limited func(w http.ResponseWriter, r *http.Request, retry time.Duration)
+
+	// Optional clock, defaults to time.Now.
+	Now func() time.Time
+}
+
+// bucket is the token bucket of a key.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter holds the token buckets of the keys.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+
+	rate    float64
+	burst   float64
+	maxKeys int
+	now     func() time.Time
+}
+
+// RateLimit limits the rate of requests of each key, by default of each
+// client IP, using token buckets.
+//
+// Each key may send Burst requests at once, and Rate requests per second
+// after that, other requests are rejected. Wrap only the routes that should
+// be limited, e.g. the routes changing data. It panics if Rate is not
+// positive.
+func RateLimit(opts RateLimitOptions) func(http.Handler) http.Handler {
+	if opts.Rate <= 0 {
+		panic("middleware: rate limit rate must be positive")
+	}
+
+	l := rateLimiter{
+		buckets: make(map[string]*bucket),
+		rate:    opts.Rate,
+		burst:   float64(opts.Burst),
+		maxKeys: opts.MaxKeys,
+		now:     opts.Now,
+	}
+	if l.burst < 1 {
+		l.burst = 1
+	}
+	if l.maxKeys <= 0 {
+		l.maxKeys = DefaultRateLimitMaxKeys
+	}
+	if l.now == nil {
+		l.now = time.Now
+	}
+	key := opts.Key
+	if key == nil {
+		key = ClientIP
+	}
+	limited := opts.Limited
+	if limited == nil {
+		limited = writeRateLimited
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if retry, ok := l.allow(key(r)); !ok {
+				limited(w, r, retry)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// allow takes a token of a key, it returns false, and the duration until
+// a token is available, if the bucket of the key is empty.
+func (l *rateLimiter) allow(key string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= l.maxKeys {
+			l.pruneLocked(now)
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / l.rate * float64(time.Second)), false
+	}
+	b.tokens--
+
+	return 0, true
+}
+
+// pruneLocked drops the keys whose buckets refilled, they are limited as new
+// keys, and if none did, drops a key, so the number of keys stays bounded.
+func (l *rateLimiter) pruneLocked(now time.Time) {
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, k)
+		}
+	}
+	for k := range l.buckets {
+		if len(l.buckets) < l.maxKeys {
+			break
+		}
+		delete(l.buckets, k)
+	}
+}
+
+// writeRateLimited writes a JSON 429 response, with a Retry-After header.
+func writeRateLimited(w http.ResponseWriter, r *http.Request, retry time.Duration) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.FormatInt(retryAfterSeconds(retry), 10))
+	w.WriteHeader(http.StatusTooManyRequests)
+	io.WriteString(w, `{"error":"too many requests"}`)
+}
+
+// retryAfterSeconds returns a Retry-After header value for a duration, in
+// whole seconds, rounded up, at least one.
+func retryAfterSeconds(d time.Duration) int64 {
+	retry := int64((d + time.Second - 1) / time.Second)
+	if retry < 1 {
+		retry = 1
+	}
+
+	return retry
+}
@@ -0,0 +1,150 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rateClock is a settable clock.
+type rateClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *rateClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *rateClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+// rateGet serves a GET request from a remote address, and returns the status
+// code.
+func rateGet(handler http.Handler, remoteAddr string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/val/a", nil)
+	req.RemoteAddr = remoteAddr
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	return rr
+}
+
+func TestRateLimit(t *testing.T) {
+	clock := &rateClock{now: time.Unix(0, 0)}
+	handler := RateLimit(RateLimitOptions{Rate: 0.5, Burst: 2, Now: clock.Now})(http.HandlerFunc(okHandler))
+
+	// Check a burst is allowed, and the next request is limited.
+	for i := 0; i < 2; i++ {
+		if rr := rateGet(handler, "192.0.2.1:1234"); rr.Code != http.StatusOK {
+			t.Fatalf("request %d: got %v want %v", i, rr.Code, http.StatusOK)
+		}
+	}
+	rr := rateGet(handler, "192.0.2.1:4321")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("got %v want %v", rr.Code, http.StatusTooManyRequests)
+	}
+	if rr.Header().Get("Retry-After") != "2" || rr.Body.String() != `{"error":"too many requests"}` {
+		t.Errorf("unexpected response: %v %s", rr.Header(), rr.Body.String())
+	}
+
+	// Check other clients have their own bucket.
+	if rr := rateGet(handler, "192.0.2.2:1234"); rr.Code != http.StatusOK {
+		t.Errorf("other client: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	// Check tokens are refilled at the rate.
+	clock.Add(time.Second)
+	if rr := rateGet(handler, "192.0.2.1:1234"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("after a second: got %v want %v", rr.Code, http.StatusTooManyRequests)
+	}
+	clock.Add(time.Second)
+	if rr := rateGet(handler, "192.0.2.1:1234"); rr.Code != http.StatusOK {
+		t.Errorf("after two seconds: got %v want %v", rr.Code, http.StatusOK)
+	}
+}
+
+func TestRateLimitOptions(t *testing.T) {
+	clock := &rateClock{now: time.Unix(0, 0)}
+	var retries []time.Duration
+	handler := RateLimit(RateLimitOptions{
+		Rate:    10,
+		MaxKeys: 2,
+		Key:     func(r *http.Request) string { return r.Header.Get("X-Client") },
+		Limited: func(w http.ResponseWriter, r *http.Request, retry time.Duration) {
+			retries = append(retries, retry)
+			w.WriteHeader(http.StatusTeapot)
+		},
+		Now: clock.Now,
+	})(http.HandlerFunc(okHandler))
+
+	get := func(client string) int {
+		req := httptest.NewRequest("GET", "/val/a", nil)
+		req.Header.Set("X-Client", client)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// Check the key function and the limited handler are used.
+	if get("kitty") != http.StatusOK || get("kitty") != http.StatusTeapot {
+		t.Errorf("kitty was not limited")
+	}
+	if len(retries) != 1 || retries[0] != 100*time.Millisecond {
+		t.Errorf("got retries %v want [100ms]", retries)
+	}
+
+}
+
+func TestRateLimitMaxKeys(t *testing.T) {
+	clock := &rateClock{now: time.Unix(0, 0)}
+	l := rateLimiter{buckets: make(map[string]*bucket), rate: 1, burst: 1, maxKeys: 2, now: clock.Now}
+
+	// Check idle keys are dropped first.
+	l.allow("kitty")
+	clock.Add(time.Second)
+	l.allow("tom")
+	l.allow("felix")
+	if _, ok := l.buckets["kitty"]; ok || len(l.buckets) != 2 {
+		t.Errorf("got keys %v want tom and felix", l.buckets)
+	}
+
+	// Check a key is dropped when no key is idle.
+	l.allow("garfield")
+	if len(l.buckets) != 2 || l.buckets["garfield"] == nil {
+		t.Errorf("got keys %v want garfield and one more", l.buckets)
+	}
+}
+
+func TestRateLimitInvalidRate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("RateLimit accepted a zero rate")
+		}
+	}()
+	RateLimit(RateLimitOptions{})
+}
@@ -0,0 +1,202 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// The context key for the client IP.
+const ctxClientIPKey = ctxKey("ClientIP")
+
+// RealIP resolves the client IP of requests sent through trusted proxies.
+//
+// Trusted proxies are IP addresses or CIDR ranges, it panics if one of them
+// is invalid. When the direct peer is a trusted proxy, the Forwarded,
+// X-Forwarded-For and X-Real-IP headers are checked, in that order, and the
+// forwarded chain is walked from the right, skipping trusted proxies, the
+// first untrusted address is the client IP. Headers sent by untrusted peers
+// are ignored, so clients can't spoof their IP. The client IP is retrieved
+// calling middleware.ClientIP(request).
+func RealIP(trustedProxies []string) func(http.Handler) http.Handler {
+	return realIP(trustedProxies, false)
+}
+
+// RealIPRemoteAddr resolves the client IP like RealIP, and also replaces the
+// request RemoteAddr with it.
+func RealIPRemoteAddr(trustedProxies []string) func(http.Handler) http.Handler {
+	return realIP(trustedProxies, true)
+}
+
+// ClientIP returns the client IP of the current request, resolved by RealIP,
+// or the IP of the direct peer if RealIP is not installed.
+func ClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(ctxClientIPKey).(string); ok {
+		return ip
+	}
+
+	return hostIP(r.RemoteAddr)
+}
+
+// realIP returns the RealIP middleware.
+func realIP(trustedProxies []string, rewrite bool) func(http.Handler) http.Handler {
+	trusted := parseTrustedProxies(trustedProxies)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := resolveClientIP(r, trusted)
+
+			r = r.WithContext(context.WithValue(r.Context(), ctxClientIPKey, ip))
+			if rewrite && ip != "" {
+				r.RemoteAddr = net.JoinHostPort(ip, "0")
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// parseTrustedProxies parses a list of IP addresses and CIDR ranges.
+func parseTrustedProxies(proxies []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			if strings.Contains(p, ":") {
+				p += "/128"
+			} else {
+				p += "/32"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			panic(fmt.Sprintf("middleware: invalid trusted proxy %q: %v", p, err))
+		}
+		nets = append(nets, n)
+	}
+
+	return nets
+}
+
+// resolveClientIP walks the forwarded chain of a request from the right,
+// and returns the first untrusted address.
+func resolveClientIP(r *http.Request, trusted []*net.IPNet) string {
+	ip := hostIP(r.RemoteAddr)
+	if !isTrusted(ip, trusted) {
+		return ip
+	}
+
+	chain := forwardedChain(r)
+	for i := len(chain) - 1; i >= 0; i-- {
+		hop := parseHop(chain[i])
+
+		// A malformed hop can't be trusted, use the proxy that sent it.
+		if hop == "" {
+			return ip
+		}
+
+		ip = hop
+		if !isTrusted(ip, trusted) {
+			return ip
+		}
+	}
+
+	return ip
+}
+
+// forwardedChain returns the forwarded addresses of a request, from the
+// first forwarded header found.
+func forwardedChain(r *http.Request) []string {
+	var chain []string
+
+	// The standard Forwarded header, e.g. `for=192.0.2.60;proto=http, for="[2001:db8::1]"`.
+	for _, header := range r.Header.Values("Forwarded") {
+		for _, element := range strings.Split(header, ",") {
+			hop := "malformed"
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					hop = strings.Trim(kv[1], `"`)
+				}
+			}
+			chain = append(chain, hop)
+		}
+	}
+	if len(chain) > 0 {
+		return chain
+	}
+
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		chain = append(chain, strings.Split(header, ",")...)
+	}
+	if len(chain) > 0 {
+		return chain
+	}
+
+	if header := r.Header.Get("X-Real-IP"); header != "" {
+		return []string{header}
+	}
+
+	return nil
+}
+
+// parseHop parses one forwarded address, with an optional port, and returns
+// the IP, or an empty string if the address is malformed.
+func parseHop(hop string) string {
+	hop = strings.TrimSpace(hop)
+	if ip := net.ParseIP(hop); ip != nil {
+		return ip.String()
+	}
+
+	// An address with a port, or a bracketed IPv6 address.
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	if ip := net.ParseIP(strings.Trim(hop, "[]")); ip != nil {
+		return ip.String()
+	}
+
+	return ""
+}
+
+// hostIP returns the IP part of a host:port address.
+func hostIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+
+	return addr
+}
+
+// isTrusted checks if an IP is in one of the trusted ranges.
+func isTrusted(ip string, trusted []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	for _, n := range trusted {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRealIP(t *testing.T) {
+	tests := []struct {
+		name     string
+		remote   string
+		headers  map[string][]string
+		expected string
+	}{
+		{"direct", "203.0.113.7:1234", nil, "203.0.113.7"},
+		{"untrusted spoof", "203.0.113.7:1234",
+			map[string][]string{"X-Forwarded-For": {"1.2.3.4"}}, "203.0.113.7"},
+		{"one hop", "10.0.0.1:1234",
+			map[string][]string{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"multiple hops", "10.0.0.1:1234",
+			map[string][]string{"X-Forwarded-For": {"1.2.3.4, 198.51.100.1, 10.0.0.2"}}, "198.51.100.1"},
+		{"multiple headers", "10.0.0.1:1234",
+			map[string][]string{"X-Forwarded-For": {"1.2.3.4", "198.51.100.1, 10.0.0.2"}}, "198.51.100.1"},
+		{"all trusted", "10.0.0.1:1234",
+			map[string][]string{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3"},
+		{"ipv6", "[fd00::1]:1234",
+			map[string][]string{"X-Forwarded-For": {"2001:db8::1"}}, "2001:db8::1"},
+		{"forwarded", "10.0.0.1:1234",
+			map[string][]string{"Forwarded": {`for=1.2.3.4, for="[2001:db8::2]:443";proto=https`}}, "2001:db8::2"},
+		{"forwarded wins", "10.0.0.1:1234",
+			map[string][]string{"Forwarded": {"for=198.51.100.9"}, "X-Forwarded-For": {"1.2.3.4"}}, "198.51.100.9"},
+		{"real ip", "10.0.0.1:1234",
+			map[string][]string{"X-Real-IP": {"198.51.100.1"}}, "198.51.100.1"},
+		{"malformed", "10.0.0.1:1234",
+			map[string][]string{"X-Forwarded-For": {"1.2.3.4, kitty"}}, "10.0.0.1"},
+		{"malformed forwarded", "10.0.0.1:1234",
+			map[string][]string{"Forwarded": {"by=1.2.3.4"}}, "10.0.0.1"},
+		{"empty", "10.0.0.1:1234",
+			map[string][]string{"X-Forwarded-For": {""}}, "10.0.0.1"},
+	}
+
+	handler := RealIP([]string{"10.0.0.0/8", "fd00::1"})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, ClientIP(r))
+		}))
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/val", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = tt.remote
+		for k, values := range tt.headers {
+			for _, v := range values {
+				req.Header.Add(k, v)
+			}
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the client IP is what we expect.
+		if rr.Body.String() != tt.expected {
+			t.Errorf("%s: unexpected client IP: got %v want %v",
+				tt.name, rr.Body.String(), tt.expected)
+		}
+	}
+}
+
+func TestRealIPRemoteAddr(t *testing.T) {
+	req, err := http.NewRequest("GET", "/val", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "2001:db8::1")
+
+	rr := httptest.NewRecorder()
+	handler := RealIPRemoteAddr([]string{"10.0.0.0/8"})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.RemoteAddr)
+		}))
+	handler.ServeHTTP(rr, req)
+
+	// Check the remote address was replaced.
+	expected := "[2001:db8::1]:0"
+	if rr.Body.String() != expected {
+		t.Errorf("unexpected remote address: got %v want %v", rr.Body.String(), expected)
+	}
+}
+
+func TestClientIPNotInstalled(t *testing.T) {
+	req, err := http.NewRequest("GET", "/val", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "203.0.113.7:1234"
+
+	// Check the accessor falls back to the direct peer.
+	if ip := ClientIP(req); ip != "203.0.113.7" {
+		t.Errorf("unexpected client IP: got %v want %v", ip, "203.0.113.7")
+	}
+}
+
+func TestRealIPInvalidProxy(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("invalid trusted proxy did not panic")
+		}
+	}()
+	RealIP([]string{"kitty"})
+}
@@ -0,0 +1,84 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"runtime/debug"
+)
+
+// Recover recovers panics in the next handler, logs them with the stack
+// using the standard logger, and calls handler to write the response.
+//
+// See RecoverWithLogger.
+func Recover(handler func(w http.ResponseWriter, r *http.Request, recovered interface{})) func(http.Handler) http.Handler {
+	return RecoverWithLogger(nil, handler)
+}
+
+// RecoverWithLogger recovers panics in the next handler, logs them with the
+// stack using logger, and calls handler to write the response.
+//
+// If logger is nil the standard logger is used, if handler is nil a plain
+// text 500 response is written. When the response headers were already sent
+// the response can't be fixed, and it is aborted. The http.ErrAbortHandler
+// panic, and panics after the connection was hijacked, are not recovered.
+func RecoverWithLogger(logger *log.Logger, handler func(w http.ResponseWriter, r *http.Request, recovered interface{})) func(http.Handler) http.Handler {
+	if logger == nil {
+		logger = log.New(log.Writer(), log.Prefix(), log.Flags())
+	}
+	if handler == nil {
+		handler = internalServerError
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sw := newStatusWriter(w)
+
+			defer func() {
+				recovered := recover()
+				if recovered == nil {
+					return
+				}
+
+				// The abort panic is used to abort a response, and the
+				// connection of a hijacked response is no longer ours.
+				if recovered == http.ErrAbortHandler || sw.hijacked {
+					panic(recovered)
+				}
+
+				logger.Printf("panic: %s %s: %v\n%s", r.Method, r.URL.Path, recovered, debug.Stack())
+
+				// It's too late to send an error, abort the response.
+				if sw.wroteHeader {
+					panic(http.ErrAbortHandler)
+				}
+
+				handler(w, r, recovered)
+			}()
+
+			next.ServeHTTP(sw.flushable(sw), r)
+		})
+	}
+}
+
+// internalServerError writes a plain text 500 response.
+func internalServerError(w http.ResponseWriter, r *http.Request, recovered interface{}) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusInternalServerError)
+	io.WriteString(w, "500 – Internal Server Error.")
+}
@@ -0,0 +1,176 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func panicHandler(w http.ResponseWriter, r *http.Request) {
+	panic("kitty is not here")
+}
+
+func TestRecoverBeforeWrite(t *testing.T) {
+	req, err := http.NewRequest("GET", "/panic", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	rr := httptest.NewRecorder()
+	handler := RecoverWithLogger(log.New(&out, "", 0),
+		func(w http.ResponseWriter, r *http.Request, recovered interface{}) {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, fmt.Sprint(recovered))
+		})(http.HandlerFunc(panicHandler))
+	handler.ServeHTTP(rr, req)
+
+	// Check the status code is what we expect.
+	if status := rr.Code; status != http.StatusInternalServerError {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusInternalServerError)
+	}
+
+	// Check the response body is what we expect.
+	expected := "kitty is not here"
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v",
+			rr.Body.String(), expected)
+	}
+
+	// Check the stack was logged.
+	if !strings.Contains(out.String(), "panicHandler") {
+		t.Errorf("recover did not log the stack: %v", out.String())
+	}
+}
+
+func TestRecoverDefaultHandler(t *testing.T) {
+	req, err := http.NewRequest("GET", "/panic", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := RecoverWithLogger(log.New(io.Discard, "", 0), nil)(http.HandlerFunc(panicHandler))
+	handler.ServeHTTP(rr, req)
+
+	// Check the status code is what we expect.
+	if status := rr.Code; status != http.StatusInternalServerError {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusInternalServerError)
+	}
+
+	// Check the response body is what we expect.
+	expected := "500 – Internal Server Error."
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v",
+			rr.Body.String(), expected)
+	}
+}
+
+func TestRecoverAfterPartialWrite(t *testing.T) {
+	called := false
+	handler := RecoverWithLogger(log.New(io.Discard, "", 0),
+		func(w http.ResponseWriter, r *http.Request, recovered interface{}) {
+			called = true
+		})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "partial")
+		w.(http.Flusher).Flush()
+		panic("kitty is not here")
+	}))
+
+	// Start the http server.
+	ts := httptest.NewServer(handler)
+	ts.Config.ErrorLog = log.New(io.Discard, "", 0)
+	defer ts.Close()
+
+	// Query server.
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(res.Body)
+	res.Body.Close()
+
+	// Check the response was aborted, and not completed by the handler.
+	if err == nil {
+		t.Errorf("response was not aborted")
+	}
+	if called {
+		t.Errorf("recover handler called after headers were sent")
+	}
+}
+
+func TestRecoverAbortHandler(t *testing.T) {
+	req, err := http.NewRequest("GET", "/panic", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := Recover(nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+
+	// Check the abort panic is not recovered.
+	defer func() {
+		if recovered := recover(); recovered != http.ErrAbortHandler {
+			t.Errorf("recover recovered unexpected value: got %v want %v",
+				recovered, http.ErrAbortHandler)
+		}
+	}()
+	handler.ServeHTTP(rr, req)
+}
+
+// hijackRecorder is a response recorder that can be hijacked.
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (w hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return nil, nil, nil
+}
+
+func TestRecoverAfterHijack(t *testing.T) {
+	req, err := http.NewRequest("GET", "/panic", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := hijackRecorder{httptest.NewRecorder()}
+	handler := Recover(nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Hijacker).Hijack()
+		panic("kitty is not here")
+	}))
+
+	// Check the panic is not recovered.
+	defer func() {
+		if recovered := recover(); recovered != "kitty is not here" {
+			t.Errorf("recover recovered unexpected value: got %v want %v",
+				recovered, "kitty is not here")
+		}
+	}()
+	handler.ServeHTTP(rr, req)
+}
@@ -0,0 +1,111 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// DefaultRequestIDHeader is the default request ID header name.
+const DefaultRequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength is the longest incoming request ID honored.
+const maxRequestIDLength = 128
+
+// RequestIDOptions configures the AssignRequestID middleware.
+type RequestIDOptions struct {
+	// Header holding the request ID, in requests and responses,
+	// defaults to DefaultRequestIDHeader.
+	Header string
+
+	// Generator returns new request IDs, defaults to 16 random bytes,
+	// hex encoded.
+	Generator func() string
+}
+
+// Internal context key type.
+type ctxKey string
+
+// The context key for the request ID.
+const ctxRequestIDKey = ctxKey("RequestID")
+
+// AssignRequestID assigns an ID to every request.
+//
+// A valid incoming request ID header is honored, o/w a new ID is generated.
+// The ID is set on the response header, and can be retrieved by handlers
+// calling middleware.RequestID(request).
+func AssignRequestID(opts RequestIDOptions) func(http.Handler) http.Handler {
+	header := opts.Header
+	if header == "" {
+		header = DefaultRequestIDHeader
+	}
+	generator := opts.Generator
+	if generator == nil {
+		generator = newRequestID
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(header)
+			if !validRequestID(id) {
+				id = generator()
+			}
+
+			w.Header().Set(header, id)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxRequestIDKey, id)))
+		})
+	}
+}
+
+// RequestID returns the ID of the current request, or an empty string if
+// the request has no ID.
+func RequestID(r *http.Request) string {
+	id, _ := r.Context().Value(ctxRequestIDKey).(string)
+
+	return id
+}
+
+// newRequestID returns 16 random bytes, hex encoded.
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// validRequestID checks that a request ID is not empty, not too long, and
+// made of letters, digits and "-", "_", ".", ":".
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
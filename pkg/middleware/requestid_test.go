@@ -0,0 +1,137 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// requestIDHandler writes the request ID.
+func requestIDHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(RequestID(r)))
+}
+
+func TestRequestIDGenerated(t *testing.T) {
+	req, err := http.NewRequest("GET", "/val", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := AssignRequestID(RequestIDOptions{})(http.HandlerFunc(requestIDHandler))
+	handler.ServeHTTP(rr, req)
+
+	// Check the generated ID is 16 hex encoded bytes.
+	id := rr.Header().Get("X-Request-Id")
+	if len(id) != 32 || !validRequestID(id) {
+		t.Errorf("handler returned unexpected request ID: %v", id)
+	}
+
+	// Check the handler got the same ID.
+	if rr.Body.String() != id {
+		t.Errorf("handler got unexpected request ID: got %v want %v",
+			rr.Body.String(), id)
+	}
+}
+
+func TestRequestIDIncoming(t *testing.T) {
+	tests := []struct {
+		incoming string
+		expected string
+	}{
+		{"kitty-123", "kitty-123"},
+		{"bad id", "generated"},
+		{"<script>", "generated"},
+		{strings.Repeat("a", 129), "generated"},
+		{"", "generated"},
+	}
+
+	handler := AssignRequestID(RequestIDOptions{
+		Header:    "X-Trace",
+		Generator: func() string { return "generated" },
+	})(http.HandlerFunc(requestIDHandler))
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/val", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Trace", tt.incoming)
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the request ID is what we expect.
+		if id := rr.Header().Get("X-Trace"); id != tt.expected {
+			t.Errorf("%q: handler returned unexpected request ID: got %v want %v",
+				tt.incoming, id, tt.expected)
+		}
+		if rr.Body.String() != tt.expected {
+			t.Errorf("%q: handler got unexpected request ID: got %v want %v",
+				tt.incoming, rr.Body.String(), tt.expected)
+		}
+	}
+}
+
+func TestRequestIDNotInstalled(t *testing.T) {
+	req, err := http.NewRequest("GET", "/val", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Check the accessor is safe without the middleware.
+	if id := RequestID(req); id != "" {
+		t.Errorf("unexpected request ID: %v", id)
+	}
+}
+
+func TestRequestIDLogged(t *testing.T) {
+	req, err := http.NewRequest("GET", "/val/hello", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Request-Id", "kitty-123")
+
+	// Check the ID is logged, both inside and outside the logger.
+	for _, order := range []string{"outside", "inside"} {
+		var out bytes.Buffer
+		logger := Logger(LoggerOptions{Logger: log.New(&out, "", 0), Format: JSONFormat})
+		requestID := AssignRequestID(RequestIDOptions{})
+
+		var handler http.Handler
+		if order == "outside" {
+			handler = requestID(logger(newTestRouter()))
+		} else {
+			handler = logger(requestID(newTestRouter()))
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		var entry map[string]interface{}
+		if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+			t.Fatalf("logger wrote invalid JSON: %v: %v", out.String(), err)
+		}
+		if entry["request_id"] != "kitty-123" {
+			t.Errorf("%s: logger wrote wrong request ID: got %v want %v",
+				order, entry["request_id"], "kitty-123")
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"net/http"
+	"strings"
+)
+
+// SecureHeadersConfig configures the SecureHeaders middleware, each field is
+// the value of one header, an empty value disables the header.
+type SecureHeadersConfig struct {
+	// X-Content-Type-Options header value.
+	ContentTypeOptions string
+
+	// X-Frame-Options header value.
+	FrameOptions string
+
+	// Referrer-Policy header value.
+	ReferrerPolicy string
+
+	// Content-Security-Policy header value.
+	ContentSecurityPolicy string
+
+	// Strict-Transport-Security header value, sent only for TLS requests,
+	// or requests with an "X-Forwarded-Proto: https" header.
+	StrictTransportSecurity string
+}
+
+// DefaultSecureHeadersConfig returns a config with safe default values.
+func DefaultSecureHeadersConfig() SecureHeadersConfig {
+	return SecureHeadersConfig{
+		ContentTypeOptions:      "nosniff",
+		FrameOptions:            "DENY",
+		ReferrerPolicy:          "strict-origin-when-cross-origin",
+		ContentSecurityPolicy:   "default-src 'self'",
+		StrictTransportSecurity: "max-age=63072000; includeSubDomains",
+	}
+}
+
+// SecureHeaders sets security related response headers.
+//
+// The headers are set before calling the next handler, so values set by
+// handlers using Header().Set replace them.
+func SecureHeaders(cfg SecureHeadersConfig) func(http.Handler) http.Handler {
+	headers := map[string]string{
+		"X-Content-Type-Options":  cfg.ContentTypeOptions,
+		"X-Frame-Options":         cfg.FrameOptions,
+		"Referrer-Policy":         cfg.ReferrerPolicy,
+		"Content-Security-Policy": cfg.ContentSecurityPolicy,
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h := w.Header()
+			for k, v := range headers {
+				if v != "" {
+					h.Set(k, v)
+				}
+			}
+
+			https := r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+			if https && cfg.StrictTransportSecurity != "" {
+				h.Set("Strict-Transport-Security", cfg.StrictTransportSecurity)
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSecureHeadersDefaults(t *testing.T) {
+	req, err := http.NewRequest("GET", "/val", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	SecureHeaders(DefaultSecureHeadersConfig())(http.HandlerFunc(okHandler)).ServeHTTP(rr, req)
+
+	// Check the headers are what we expect.
+	expected := map[string]string{
+		"X-Content-Type-Options":    "nosniff",
+		"X-Frame-Options":           "DENY",
+		"Referrer-Policy":           "strict-origin-when-cross-origin",
+		"Content-Security-Policy":   "default-src 'self'",
+		"Strict-Transport-Security": "",
+	}
+	for k, v := range expected {
+		if h := rr.Header().Get(k); h != v {
+			t.Errorf("wrong %s: got %q want %q", k, h, v)
+		}
+	}
+}
+
+func TestSecureHeadersHSTS(t *testing.T) {
+	tests := []struct {
+		name     string
+		tls      bool
+		proto    string
+		expected string
+	}{
+		{"plain", false, "", ""},
+		{"tls", true, "", "max-age=63072000; includeSubDomains"},
+		{"forwarded https", false, "https", "max-age=63072000; includeSubDomains"},
+		{"forwarded http", false, "http", ""},
+	}
+
+	handler := SecureHeaders(DefaultSecureHeadersConfig())(http.HandlerFunc(okHandler))
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/val", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+		if tt.proto != "" {
+			req.Header.Set("X-Forwarded-Proto", tt.proto)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the HSTS header is what we expect.
+		if h := rr.Header().Get("Strict-Transport-Security"); h != tt.expected {
+			t.Errorf("%s: wrong HSTS header: got %q want %q", tt.name, h, tt.expected)
+		}
+	}
+}
+
+func TestSecureHeadersOverrides(t *testing.T) {
+	req, err := http.NewRequest("GET", "/val", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.TLS = &tls.ConnectionState{}
+
+	cfg := DefaultSecureHeadersConfig()
+	cfg.ContentSecurityPolicy = ""
+	cfg.StrictTransportSecurity = ""
+	cfg.ReferrerPolicy = "no-referrer"
+
+	rr := httptest.NewRecorder()
+	handler := SecureHeaders(cfg)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+	}))
+	handler.ServeHTTP(rr, req)
+
+	// Check disabled headers are not sent, and overrides win.
+	expected := map[string]string{
+		"X-Content-Type-Options":    "nosniff",
+		"X-Frame-Options":           "SAMEORIGIN",
+		"Referrer-Policy":           "no-referrer",
+		"Content-Security-Policy":   "",
+		"Strict-Transport-Security": "",
+	}
+	for k, v := range expected {
+		if h := rr.Header().Get(k); h != v {
+			t.Errorf("wrong %s: got %q want %q", k, h, v)
+		}
+	}
+}
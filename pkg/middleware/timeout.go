@@ -0,0 +1,176 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Timeout runs the next handler with a request context that is canceled
+// after d, if the handler does not complete in time, body is called to write
+// the response, with a default status of 503 Service Unavailable.
+//
+// If body is nil, a JSON {"error":"timeout"} body is written. The handler
+// writes to a buffer, so writes after the deadline are discarded, and
+// return http.ErrHandlerTimeout. The handler writer does not support
+// flushing or hijacking.
+func Timeout(d time.Duration, body func(w http.ResponseWriter, r *http.Request)) func(http.Handler) http.Handler {
+	if body == nil {
+		body = timeoutBody
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			r = r.WithContext(ctx)
+
+			done := make(chan struct{})
+			panicked := make(chan interface{}, 1)
+			tw := &timeoutWriter{header: make(http.Header)}
+
+			// Run the handler, and pass its panics to this goroutine.
+			go func() {
+				defer func() {
+					if p := recover(); p != nil {
+						panicked <- p
+					}
+				}()
+				next.ServeHTTP(tw, r)
+				close(done)
+			}()
+
+			select {
+			case p := <-panicked:
+				panic(p)
+			case <-done:
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+
+				// Copy the buffered response.
+				if !tw.wroteHeader {
+					tw.writeHeaderLocked(http.StatusOK)
+				}
+				dst := w.Header()
+				for k, v := range tw.sent {
+					dst[k] = v
+				}
+				w.WriteHeader(tw.code)
+				w.Write(tw.buf.Bytes())
+			case <-ctx.Done():
+				tw.mu.Lock()
+				tw.timedOut = true
+				tw.mu.Unlock()
+
+				dw := &defaultStatusWriter{ResponseWriter: w, code: http.StatusServiceUnavailable}
+				body(dw, r)
+				dw.ensureHeader()
+			}
+		})
+	}
+}
+
+// timeoutBody writes a JSON timeout error.
+func timeoutBody(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	io.WriteString(w, `{"error":"timeout"}`)
+}
+
+// timeoutWriter buffers the response of a handler, and discards writes
+// after the deadline.
+type timeoutWriter struct {
+	mu          sync.Mutex
+	header      http.Header
+	sent        http.Header
+	buf         bytes.Buffer
+	code        int
+	wroteHeader bool
+	timedOut    bool
+}
+
+// Header returns the buffered header map.
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+// Write buffers b, unless the deadline passed.
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if !tw.wroteHeader {
+		tw.writeHeaderLocked(http.StatusOK)
+	}
+
+	return tw.buf.Write(b)
+}
+
+// WriteHeader buffers the status code, unless the deadline passed.
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut || tw.wroteHeader {
+		return
+	}
+	tw.writeHeaderLocked(code)
+}
+
+// writeHeaderLocked buffers the status code, and snapshots the header map,
+// so handler changes after this point are ignored.
+func (tw *timeoutWriter) writeHeaderLocked(code int) {
+	tw.code = code
+	tw.wroteHeader = true
+	tw.sent = tw.header.Clone()
+}
+
+// defaultStatusWriter writes a default status code, if no status code is
+// written before the body.
+type defaultStatusWriter struct {
+	http.ResponseWriter
+
+	code        int
+	wroteHeader bool
+}
+
+// WriteHeader sends a status code.
+func (w *defaultStatusWriter) WriteHeader(code int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write sends the default status code if needed, and writes b.
+func (w *defaultStatusWriter) Write(b []byte) (int, error) {
+	w.ensureHeader()
+
+	return w.ResponseWriter.Write(b)
+}
+
+// ensureHeader sends the default status code, if no status code was sent.
+func (w *defaultStatusWriter) ensureHeader() {
+	if !w.wroteHeader {
+		w.WriteHeader(w.code)
+	}
+}
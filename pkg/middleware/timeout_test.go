@@ -0,0 +1,180 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTimeoutCompleted(t *testing.T) {
+	req, err := http.NewRequest("GET", "/val", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := Timeout(time.Second, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Kitty", "cat")
+		w.WriteHeader(http.StatusCreated)
+		w.Header().Set("X-Late", "ignored")
+		io.WriteString(w, "kitty")
+	}))
+	handler.ServeHTTP(rr, req)
+
+	// Check the buffered response was sent.
+	if status := rr.Code; status != http.StatusCreated {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusCreated)
+	}
+	if rr.Body.String() != "kitty" {
+		t.Errorf("handler returned unexpected body: got %v want %v",
+			rr.Body.String(), "kitty")
+	}
+	if rr.Header().Get("X-Kitty") != "cat" || rr.Header().Get("X-Late") != "" {
+		t.Errorf("handler returned unexpected headers: %v", rr.Header())
+	}
+}
+
+func TestTimeoutExpired(t *testing.T) {
+	req, err := http.NewRequest("GET", "/val", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lateErr := make(chan error, 1)
+	rr := httptest.NewRecorder()
+	handler := Timeout(10*time.Millisecond, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Wait for the context to be canceled, then try to write.
+		<-r.Context().Done()
+		time.Sleep(5 * time.Millisecond)
+		_, err := io.WriteString(w, "late")
+		lateErr <- err
+	}))
+	handler.ServeHTTP(rr, req)
+
+	// Check the timeout response was sent.
+	if status := rr.Code; status != http.StatusServiceUnavailable {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusServiceUnavailable)
+	}
+	expected := `{"error":"timeout"}`
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v",
+			rr.Body.String(), expected)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("handler returned unexpected content type: %v", ct)
+	}
+
+	// Check the late write was discarded.
+	if err := <-lateErr; err != http.ErrHandlerTimeout {
+		t.Errorf("late write returned unexpected error: got %v want %v",
+			err, http.ErrHandlerTimeout)
+	}
+}
+
+func TestTimeoutCustomBody(t *testing.T) {
+	req, err := http.NewRequest("GET", "/val", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := Timeout(time.Millisecond, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "too slow")
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	handler.ServeHTTP(rr, req)
+
+	// Check the default status is used.
+	if status := rr.Code; status != http.StatusServiceUnavailable {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusServiceUnavailable)
+	}
+	if rr.Body.String() != "too slow" {
+		t.Errorf("handler returned unexpected body: got %v want %v",
+			rr.Body.String(), "too slow")
+	}
+}
+
+func TestTimeoutPanic(t *testing.T) {
+	req, err := http.NewRequest("GET", "/val", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := Timeout(time.Second, nil)(http.HandlerFunc(panicHandler))
+
+	// Check the panic is passed to the serving goroutine.
+	defer func() {
+		if recovered := recover(); recovered != "kitty is not here" {
+			t.Errorf("unexpected panic: got %v want %v", recovered, "kitty is not here")
+		}
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+}
+
+func TestTimeoutStress(t *testing.T) {
+	const d = 200 * time.Microsecond
+
+	handler := Timeout(d, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Race the deadline by a few microseconds.
+		time.Sleep(d + time.Duration(rand.Intn(40)-20)*time.Microsecond)
+		w.Header().Set("X-Kitty", "cat")
+		for i := 0; i < 10; i++ {
+			io.WriteString(w, "kitty")
+		}
+	}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req, err := http.NewRequest("GET", "/val", nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			// Check the response is either complete or a timeout, never mixed.
+			switch rr.Code {
+			case http.StatusOK:
+				if rr.Body.String() != strings.Repeat("kitty", 10) || rr.Header().Get("X-Kitty") != "cat" {
+					t.Errorf("corrupted response: %v %v", rr.Header(), rr.Body.String())
+				}
+			case http.StatusServiceUnavailable:
+				if rr.Body.String() != `{"error":"timeout"}` || rr.Header().Get("X-Kitty") != "" {
+					t.Errorf("corrupted timeout response: %v %v", rr.Header(), rr.Body.String())
+				}
+			default:
+				t.Errorf("unexpected status code: %v", rr.Code)
+			}
+		}()
+	}
+	wg.Wait()
+}
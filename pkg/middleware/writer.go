@@ -0,0 +1,117 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middleware
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// statusWriter wraps a ResponseWriter, and captures the response status
+// and number of body bytes written.
+type statusWriter struct {
+	http.ResponseWriter
+
+	status      int
+	bytes       int64
+	wroteHeader bool
+	hijacked    bool
+}
+
+// newStatusWriter returns a capturing writer wrapping w.
+func newStatusWriter(w http.ResponseWriter) *statusWriter {
+	return &statusWriter{
+		ResponseWriter: w,
+		status:         http.StatusOK,
+	}
+}
+
+// WriteHeader captures the status code and sends it.
+func (w *statusWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.status = code
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write captures the number of bytes written, and writes them.
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+
+	return n, err
+}
+
+// flushable returns w, a writer wrapping sw, implementing http.Flusher only
+// if the writer sw wraps does, so handlers checking for http.Flusher, or
+// using http.ResponseController, learn if streaming works.
+func (w *statusWriter) flushable(rw http.ResponseWriter) http.ResponseWriter {
+	if _, ok := w.ResponseWriter.(http.Flusher); !ok {
+		return rw
+	}
+
+	return &flushWriter{ResponseWriter: rw, sw: w}
+}
+
+// flushWriter adds http.Flusher to a capturing writer, whose wrapped writer
+// can flush.
+type flushWriter struct {
+	http.ResponseWriter
+
+	sw *statusWriter
+}
+
+// Flush sends buffered data to the client.
+func (w *flushWriter) Flush() {
+	w.sw.wroteHeader = true
+	w.sw.ResponseWriter.(http.Flusher).Flush()
+}
+
+// Hijack lets the caller take over the connection, like the capturing
+// writer.
+func (w *flushWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.sw.Hijack()
+}
+
+// Unwrap returns the capturing writer, used by http.ResponseController.
+func (w *flushWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Hijack lets the caller take over the connection, if the wrapped writer
+// supports it.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("middleware: response writer does not support hijacking")
+	}
+
+	conn, buf, err := h.Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+
+	return conn, buf, err
+}
+
+// Unwrap returns the wrapped writer, used by http.ResponseController.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,79 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mux
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// headWriter wraps a ResponseWriter, for a GET handler serving a HEAD
+// request, it discards the body, and counts its bytes.
+//
+// The header is sent when the handler flushes, or returns, if the handler
+// did not set Content-Length and did not flush, the number of body bytes
+// written is sent as Content-Length, like a GET response would have it.
+type headWriter struct {
+	http.ResponseWriter
+
+	code    int
+	written int64
+	sent    bool
+}
+
+// WriteHeader captures the status code, the first one wins.
+func (w *headWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+// Write discards the body, and counts its bytes.
+func (w *headWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	w.written += int64(len(b))
+
+	return len(b), nil
+}
+
+// Flush sends the header, if the wrapped writer supports flushing.
+func (w *headWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.sendHeader(false)
+		f.Flush()
+	}
+}
+
+// Unwrap returns the wrapped writer, used by http.ResponseController.
+func (w *headWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// sendHeader sends the status code once, when the handler is done the
+// Content-Length is set from the body bytes written, unless already set.
+func (w *headWriter) sendHeader(done bool) {
+	if w.sent {
+		return
+	}
+	w.sent = true
+
+	w.WriteHeader(http.StatusOK)
+	header := w.Header()
+	if done && w.written > 0 && header.Get("Content-Length") == "" && header.Get("Transfer-Encoding") == "" {
+		header.Set("Content-Length", strconv.FormatInt(w.written, 10))
+	}
+	w.ResponseWriter.WriteHeader(w.code)
+}
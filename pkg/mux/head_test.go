@@ -0,0 +1,167 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mux
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHeadWriter(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(w http.ResponseWriter, r *http.Request)
+		code    int
+		length  string
+		flushed bool
+	}{
+		{"write", func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "kitty")
+			io.WriteString(w, " cat")
+		}, http.StatusOK, "9", false},
+		{"write header", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+			w.WriteHeader(http.StatusTeapot)
+			io.WriteString(w, "kitty")
+		}, http.StatusAccepted, "5", false},
+		{"content length", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "100")
+			io.WriteString(w, "kitty")
+		}, http.StatusOK, "100", false},
+		{"no body", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}, http.StatusNoContent, "", false},
+		{"flush", func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "kitty")
+			w.(http.Flusher).Flush()
+			io.WriteString(w, " cat")
+			w.WriteHeader(http.StatusTeapot)
+		}, http.StatusOK, "", true},
+	}
+
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		hw := &headWriter{ResponseWriter: rr}
+		tt.handler(hw, httptest.NewRequest("HEAD", "/", nil))
+		hw.sendHeader(true)
+
+		// Check the status code and the headers are kept, and the body is discarded.
+		if rr.Code != tt.code {
+			t.Errorf("%s: wrong status code: got %v want %v", tt.name, rr.Code, tt.code)
+		}
+		if length := rr.Header().Get("Content-Length"); length != tt.length {
+			t.Errorf("%s: wrong Content-Length: got %q want %q", tt.name, length, tt.length)
+		}
+		if rr.Body.Len() != 0 {
+			t.Errorf("%s: body was not discarded: %q", tt.name, rr.Body.String())
+		}
+		if rr.Flushed != tt.flushed {
+			t.Errorf("%s: wrong flushed: got %v want %v", tt.name, rr.Flushed, tt.flushed)
+		}
+	}
+}
+
+func TestHeadWriterNoFlusher(t *testing.T) {
+	w := &plainWriter{header: http.Header{}}
+	hw := &headWriter{ResponseWriter: w}
+	io.WriteString(hw, "kitty")
+
+	// Check flushing a writer that can't flush does not send the header.
+	hw.Flush()
+	if w.code != 0 {
+		t.Errorf("header sent on flush: %v", w.code)
+	}
+	hw.sendHeader(true)
+	if w.code != http.StatusOK || w.header.Get("Content-Length") != "5" || w.body.Len() != 0 {
+		t.Errorf("unexpected response: %v %v %q", w.code, w.header, w.body.String())
+	}
+}
+
+func TestAutoHead(t *testing.T) {
+	// A handler writing the method.
+	method := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Method", r.Method)
+		io.WriteString(w, r.Method)
+	}
+
+	tests := []struct {
+		name    string
+		enabled bool
+		path    string
+		code    int
+		method  string
+		length  string
+	}{
+		{"disabled", false, "/val/kitty", http.StatusNotFound, "", ""},
+		{"get route", true, "/val/kitty", http.StatusOK, "HEAD", "4"},
+		{"explicit route", true, "/head", http.StatusOK, "explicit", ""},
+		{"unknown path", true, "/kitty", http.StatusNotFound, "", ""},
+	}
+
+	for _, tt := range tests {
+		handler := Router{
+			NotFoundHandler: notFound,
+			AutoHead:        tt.enabled,
+		}
+		handler.HandleFunc("GET", "/val/:key", method)
+		handler.HandleFunc("GET", "/head", method)
+		handler.HandleFunc("HEAD", "/head", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Method", "explicit")
+		})
+
+		server := httptest.NewServer(&handler)
+		resp, err := http.Head(server.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		server.Close()
+
+		// Check the status code and the headers are what we expect.
+		if resp.StatusCode != tt.code {
+			t.Errorf("%s: wrong status code: got %v want %v", tt.name, resp.StatusCode, tt.code)
+		}
+		if m := resp.Header.Get("X-Method"); m != tt.method {
+			t.Errorf("%s: wrong handler: got %q want %q", tt.name, m, tt.method)
+		}
+		if tt.length != "" && resp.Header.Get("Content-Length") != tt.length {
+			t.Errorf("%s: wrong Content-Length: got %q want %q", tt.name, resp.Header.Get("Content-Length"), tt.length)
+		}
+	}
+}
+
+func TestAutoHeadAllow(t *testing.T) {
+	handler := Router{
+		HandleMethodNotAllowed: true,
+		AutoHead:               true,
+	}
+	handler.HandleFunc("GET", "/val/:key", found)
+
+	req, err := http.NewRequest("POST", "/val/kitty", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	// Check HEAD is allowed with GET.
+	if allow := rr.Header().Get("Allow"); rr.Code != http.StatusMethodNotAllowed || allow != "GET, HEAD" {
+		t.Errorf("got %v %q want %v %q", rr.Code, allow, http.StatusMethodNotAllowed, "GET, HEAD")
+	}
+}
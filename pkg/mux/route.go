@@ -0,0 +1,166 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mux
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Route is a handle of a registered route, returned by HandleFunc, Handle
+// and the other registration methods, its chainable setters configure the
+// route:
+//
+//	router.HandleFunc("GET", "/val/:id", getValHandler).
+//	    Name("get-val").
+//	    Where("id", "[0-9]+").
+//	    Use(withAuth).
+//	    Meta("auth", "admin")
+//
+// A Route stays valid after more routes are registered, like the routes
+// themselves, it must not be configured while the router is serving
+// requests.
+type Route struct {
+	route *route
+}
+
+// Name sets the name of the route, listed by Routes and Walk.
+func (rt *Route) Name(name string) *Route {
+	rt.route.name = name
+
+	return rt
+}
+
+// Where constrains the route parameter name by a regular expression, that
+// must match the whole decoded segment, replacing a constraint given in the
+// route path.
+//
+// Where panics if the route has no parameter name, or if the expression is
+// not a valid regular expression.
+func (rt *Route) Where(name string, expr string) *Route {
+	for i, segment := range rt.route.segments {
+		if segment != ":"+name {
+			continue
+		}
+
+		re, err := compileConstraint(expr)
+		if err != nil {
+			panic(fmt.Sprintf("mux: invalid constraint of parameter %s of route %s: %v", name, rt.route.pattern, err))
+		}
+		if rt.route.constraints == nil {
+			rt.route.constraints = make([]*regexp.Regexp, len(rt.route.segments))
+		}
+		rt.route.constraints[i] = re
+
+		return rt
+	}
+
+	panic(fmt.Sprintf("mux: route %s has no parameter %s", rt.route.pattern, name))
+}
+
+// Use appends middleware to the route middleware, inside the middleware
+// given when registering the route.
+func (rt *Route) Use(middleware ...func(http.Handler) http.Handler) *Route {
+	rt.route.middleware = append(rt.route.middleware, middleware...)
+	rt.route.wrap()
+
+	return rt
+}
+
+// Header adds a matcher of the request header name, the route matches only
+// requests with a header value equal to value, that can be a simple glob,
+// where "*" matches any sequence of characters, e.g. "application/*".
+//
+// Header names are canonicalized, and a route with more than one header
+// matcher matches only requests matching all of them. A request that does
+// not match is matched with the next routes.
+func (rt *Route) Header(name string, value string) *Route {
+	name = http.CanonicalHeaderKey(name)
+	rt.route.matchers = append(rt.route.matchers, func(req *http.Request) bool {
+		for _, v := range req.Header.Values(name) {
+			if matchGlob(value, v) {
+				return true
+			}
+		}
+
+		return false
+	})
+
+	return rt
+}
+
+// MatcherFunc adds a custom matcher of the request, the route matches only
+// requests for which match returns true, e.g. requests with a client
+// certificate of some organization unit. A request that does not match is
+// matched with the next routes.
+//
+// Matchers are called only if the method, the path and the schemes of the
+// route match, in the order they were added, mixed with the header
+// matchers, and the first matcher returning false stops the matching of the
+// route. The request passed to match has no route variables, these are set
+// only for the handler of the matched route, match must not modify the
+// request.
+//
+// MatcherFunc panics if match is nil.
+func (rt *Route) MatcherFunc(match func(*http.Request) bool) *Route {
+	if match == nil {
+		panic(fmt.Sprintf("mux: nil matcher of route %s", rt.route.pattern))
+	}
+	rt.route.matchers = append(rt.route.matchers, match)
+
+	return rt
+}
+
+// Meta sets the metadata value of key, listed by Routes and Walk, e.g. for
+// documentation tooling.
+func (rt *Route) Meta(key string, value string) *Route {
+	if rt.route.meta == nil {
+		rt.route.meta = make(map[string]string)
+	}
+	rt.route.meta[key] = value
+
+	return rt
+}
+
+// matchGlob returns true if value matches pattern, where "*" matches any
+// sequence of characters, including an empty one.
+func matchGlob(pattern string, value string) bool {
+	if !strings.Contains(pattern, "*") {
+		return pattern == value
+	}
+
+	parts := strings.Split(pattern, "*")
+
+	// The first part is a prefix, and the last part is a suffix.
+	if !strings.HasPrefix(value, parts[0]) {
+		return false
+	}
+	value = value[len(parts[0]):]
+	last := parts[len(parts)-1]
+
+	// The middle parts are matched in order, as early as possible.
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(value, part)
+		if i < 0 {
+			return false
+		}
+		value = value[i+len(part):]
+	}
+
+	return strings.HasSuffix(value, last)
+}
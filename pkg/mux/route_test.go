@@ -0,0 +1,319 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mux
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRouteHandle(t *testing.T) {
+	handler := Router{
+		NotFoundHandler: notFound,
+	}
+	route := handler.HandleFunc("GET", "/val/:key", found, tag("first"))
+
+	// Register more routes, so the routes storage grows.
+	for i := 0; i < 100; i++ {
+		handler.HandleFunc("GET", "/other/"+strconv.Itoa(i), found)
+	}
+
+	// Check the handle is still valid, and its configuration is served.
+	route.Name("get-val").Where("key", "[0-9]+").Use(tag("second")).Meta("auth", "admin").Meta("doc", "get a value")
+
+	tests := []struct {
+		path  string
+		code  int
+		chain string
+	}{
+		{"/val/42", http.StatusOK, "first second"},
+		{"/val/kitty", http.StatusNotFound, ""},
+		{"/other/7", http.StatusOK, ""},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the status code and the route middleware are what we expect.
+		if rr.Code != tt.code {
+			t.Errorf("%s: wrong status code: got %v want %v", tt.path, rr.Code, tt.code)
+		}
+		if chain := strings.Join(rr.Header()["X-Chain"], " "); chain != tt.chain {
+			t.Errorf("%s: wrong chain: got %q want %q", tt.path, chain, tt.chain)
+		}
+	}
+
+	// Check the name and the metadata are listed.
+	info := handler.Routes()[0]
+	expected := map[string]string{"auth": "admin", "doc": "get a value"}
+	if info.Name != "get-val" || !reflect.DeepEqual(info.Meta, expected) {
+		t.Errorf("unexpected route info: %+v", info)
+	}
+
+	// Check modifying the listed metadata does not modify the route.
+	info.Meta["auth"] = "kitty"
+	if got := handler.Routes()[0].Meta["auth"]; got != "admin" {
+		t.Errorf("route metadata was modified: got %s", got)
+	}
+}
+
+func TestRouteHandleShortcuts(t *testing.T) {
+	handler := Router{}
+
+	// Check every registration method returns the handle of its route.
+	routes := []*Route{
+		handler.Handle("GET", "/a", http.HandlerFunc(found)),
+		handler.Get("/b", found),
+		handler.Post("/c", found),
+		handler.PathPrefix("/sub").Put("/d", found),
+		handler.MustHandleFunc("DELETE", "/e", found),
+		handler.Any("/f", found),
+		handler.PathPrefix("/sub").Any("/g", found),
+	}
+	for i, route := range routes {
+		route.Name(strconv.Itoa(i))
+	}
+	for i, info := range handler.Routes() {
+		if info.Name != strconv.Itoa(i) {
+			t.Errorf("%s %s: wrong name: got %q want %q", info.Method, info.Pattern, info.Name, strconv.Itoa(i))
+		}
+	}
+
+	// Check the handle of a route with an empty path can be configured.
+	handler.HandleFunc("GET", "", found).Name("empty").Use(tag("empty"))
+	if n := len(handler.Routes()); n != len(routes) {
+		t.Errorf("route with an empty path was registered")
+	}
+}
+
+func TestRouteWhereInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		expr string
+	}{
+		{"unknown parameter", "id", "[0-9]+"},
+		{"literal segment", "val", "[0-9]+"},
+		{"invalid expression", "key", "+"},
+	}
+
+	for _, tt := range tests {
+		func() {
+			defer func() {
+				// Check an invalid constraint panics.
+				if recovered := recover(); recovered == nil {
+					t.Errorf("%s: Where did not panic", tt.name)
+				}
+			}()
+
+			handler := Router{}
+			handler.HandleFunc("GET", "/val/:key", found).Where(tt.key, tt.expr)
+		}()
+	}
+}
+
+func TestRouteHeader(t *testing.T) {
+	// A handler writing the route name.
+	named := func(name string) func(http.ResponseWriter, *http.Request) {
+		return func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}
+	}
+
+	handler := Router{
+		NotFoundHandler:        notFound,
+		HandleMethodNotAllowed: true,
+	}
+	handler.Get("/val/:key", named("v2")).Header("x-api-version", "2").Header("Accept", "application/*")
+	handler.Get("/val/:key", named("yaml")).Header("ACCEPT", "*yaml*")
+	handler.Get("/val/:key", named("default"))
+	handler.Get("/strict", named("strict")).Header("X-Api-Version", "1")
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		headers  map[string]string
+		code     int
+		expected string
+	}{
+		{"all headers", "GET", "/val/kitty", map[string]string{"X-Api-Version": "2", "Accept": "application/json"}, http.StatusOK, "v2"},
+		{"one header", "GET", "/val/kitty", map[string]string{"X-Api-Version": "2"}, http.StatusOK, "default"},
+		{"glob", "GET", "/val/kitty", map[string]string{"Accept": "application/yaml; q=0.9"}, http.StatusOK, "yaml"},
+		{"wrong value", "GET", "/val/kitty", map[string]string{"X-Api-Version": "3", "Accept": "application/json"}, http.StatusOK, "default"},
+		{"no fallback", "GET", "/strict", map[string]string{"X-Api-Version": "2"}, http.StatusNotFound, "404 – Page not found."},
+		{"match", "GET", "/strict", map[string]string{"x-api-version": "1"}, http.StatusOK, "strict"},
+		{"method not allowed", "POST", "/strict", map[string]string{"X-Api-Version": "2"}, http.StatusMethodNotAllowed, "405 – Method Not Allowed."},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range tt.headers {
+			req.Header.Set(k, v)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the status code and the body are what we expect.
+		if rr.Code != tt.code || rr.Body.String() != tt.expected {
+			t.Errorf("%s: got %v %q want %v %q", tt.name, rr.Code, rr.Body.String(), tt.code, tt.expected)
+		}
+	}
+}
+
+func TestRouteHeaderDuplicate(t *testing.T) {
+	handler := Router{}
+	handler.MustHandleFunc("GET", "/val/:key", found).Header("X-Api-Version", "2")
+
+	// Check a route following a route with matchers is not a duplicate.
+	if _, err := handler.HandleFuncE("GET", "/val/:key", found); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := handler.HandleFuncE("GET", "/val/:key", found); !errors.Is(err, ErrDuplicateRoute) {
+		t.Errorf("got %v want %v", err, ErrDuplicateRoute)
+	}
+}
+
+func TestRouteMatcherFunc(t *testing.T) {
+	var calls []string
+
+	// A matcher logging its calls, and matching requests with a query arg.
+	matcher := func(name string, arg string) func(*http.Request) bool {
+		return func(r *http.Request) bool {
+			calls = append(calls, name)
+
+			// Route variables are not set when matching.
+			if _, ok := Var(r, "key"); ok {
+				t.Errorf("%s: route variables set when matching", name)
+			}
+
+			return r.URL.Query().Get(arg) != ""
+		}
+	}
+
+	// A handler writing the route variables.
+	vars := func(w http.ResponseWriter, r *http.Request) {
+		key, _ := Var(r, "key")
+		name, _ := Var(r, "name")
+		io.WriteString(w, "key="+key+" name="+name)
+	}
+
+	handler := Router{
+		NotFoundHandler: notFound,
+	}
+	handler.Get("/val/:key", vars).
+		Schemes("https").
+		MatcherFunc(matcher("first", "a")).
+		Header("X-Api-Version", "2").
+		MatcherFunc(matcher("second", "b"))
+	handler.Get("/val/:name", vars)
+
+	tests := []struct {
+		name     string
+		method   string
+		url      string
+		header   string
+		calls    string
+		expected string
+	}{
+		{"all match", "GET", "https://kitty/val/tom?a=1&b=1", "2", "first,second", "key=tom name="},
+		{"wrong method", "POST", "https://kitty/val/tom?a=1&b=1", "2", "", "404 – Page not found."},
+		{"wrong scheme", "GET", "http://kitty/val/tom?a=1&b=1", "2", "", "key= name=tom"},
+		{"first fails", "GET", "https://kitty/val/tom?b=1", "2", "first", "key= name=tom"},
+		{"header fails", "GET", "https://kitty/val/tom?a=1&b=1", "3", "first", "key= name=tom"},
+		{"second fails", "GET", "https://kitty/val/tom?a=1", "2", "first,second", "key= name=tom"},
+	}
+
+	for _, tt := range tests {
+		calls = nil
+
+		req := httptest.NewRequest(tt.method, tt.url, nil)
+		req.Header.Set("X-Api-Version", tt.header)
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the matchers are called in order, after the method, the path
+		// and the scheme match.
+		if got := strings.Join(calls, ","); got != tt.calls {
+			t.Errorf("%s: wrong matcher calls: got %q want %q", tt.name, got, tt.calls)
+		}
+
+		// Check the vars of a route are not set by the matchers of another.
+		if rr.Body.String() != tt.expected {
+			t.Errorf("%s: wrong body: got %q want %q", tt.name, rr.Body.String(), tt.expected)
+		}
+	}
+}
+
+func TestRouteMatcherFuncNil(t *testing.T) {
+	defer func() {
+		// Check a nil matcher panics.
+		if recover() == nil {
+			t.Errorf("expected a panic")
+		}
+	}()
+
+	handler := Router{}
+	handler.Get("/val/:key", found).MatcherFunc(nil)
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		value    string
+		expected bool
+	}{
+		{"2", "2", true},
+		{"2", "20", false},
+		{"", "", true},
+		{"*", "", true},
+		{"*", "kitty", true},
+		{"application/*", "application/json", true},
+		{"application/*", "text/json", false},
+		{"*json", "application/json", true},
+		{"*json", "application/json; q=1", false},
+		{"*yaml*", "application/yaml; q=0.9", true},
+		{"a*b*c", "abc", true},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "acb", false},
+		{"a*a", "a", false},
+		{"a**a", "aa", true},
+	}
+
+	for _, tt := range tests {
+		// Check the match is what we expect.
+		if got := matchGlob(tt.pattern, tt.value); got != tt.expected {
+			t.Errorf("%q %q: got %v want %v", tt.pattern, tt.value, got, tt.expected)
+		}
+	}
+}
@@ -17,10 +17,16 @@ package mux
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"net/url"
+	"regexp"
+	"sort"
 	"strings"
+	"sync/atomic"
 )
 
 // Router registers routes to be matched and dispatches a handler.
@@ -36,36 +42,446 @@ import (
 //     func main() {
 //         http.Handle("/", router)
 //     }
+//
+// The exported handler fields must not be modified once the router starts
+// serving requests, use the SetNotFoundHandler, SetNotFound,
+// SetMethodNotAllowedHandler, SetErrorEncoder and SetRecoverHandler methods
+// to replace them while serving.
 type Router struct {
 	// Configurable custom Handler to be used when no route matches.
 	NotFoundHandler func(http.ResponseWriter, *http.Request)
 
+	// Configurable custom http.Handler to be used when no route matches, and
+	// NotFoundHandler is not defined, e.g. an http.Handler writing the error
+	// pages of an application.
+	NotFound http.Handler
+
+	// Configurable handler for requests no route matches. If defined,
+	// such requests are passed to it untouched, instead of being answered
+	// with 405, AutoOptions or the not found handler, e.g. to fall back to a
+	// legacy http.ServeMux while migrating its routes. It is called directly,
+	// without the router middleware and panic recovery.
+	FallbackHandler http.Handler
+
+	// Configurable custom Handler to be used when routes match the path,
+	// but not the method, the allowed methods are retrieved calling
+	// mux.AllowedMethods(request). If not defined, HandleMethodNotAllowed
+	// decides how such requests are handled.
+	MethodNotAllowedHandler func(http.ResponseWriter, *http.Request)
+
+	// Configurable custom error encoder, used when the router itself fails
+	// a request, e.g. when a route has a nil handler. If not defined,
+	// the status text is written and server errors are logged.
+	ErrorEncoder func(w http.ResponseWriter, r *http.Request, code int, err error)
+
+	// Configurable custom handler for panics in dispatched handlers,
+	// including the NotFoundHandler. If defined, panics are recovered and
+	// the recovered value is passed to it, o/w panics are not recovered.
+	// The http.ErrAbortHandler panic is never recovered.
+	RecoverHandler func(w http.ResponseWriter, r *http.Request, recovered interface{})
+
+	// Maximum length of the escaped request path in bytes, requests with
+	// longer paths are answered with 414 URI Too Long without matching.
+	// Zero means unlimited, DefaultMaxPathLength is a generous limit.
+	MaxPathLength int
+
+	// Maximum number of segments in the request path, requests with more
+	// segments are answered with 414 URI Too Long without matching.
+	// Zero means unlimited, DefaultMaxSegments is a generous limit.
+	MaxSegments int
+
+	// If true, a request whose path matches a route, but whose method
+	// matches none, is answered with 405 Method Not Allowed, and an Allow
+	// header listing the methods of the routes matching the path,
+	// o/w it is handled as not found.
+	HandleMethodNotAllowed bool
+
+	// If true, an OPTIONS request whose path matches a route, but no
+	// OPTIONS route, is answered with 204 No Content, and an Allow header
+	// listing the methods of the routes matching the path, and OPTIONS.
+	AutoOptions bool
+
+	// If true, a HEAD request whose path matches no HEAD route, is
+	// dispatched to the matching GET route, the response body is discarded,
+	// and its length is sent as Content-Length, unless the handler sets it.
+	AutoHead bool
+
+	// If true, the scheme of a request is the scheme in its
+	// X-Forwarded-Proto header, if it has one, o/w the scheme is "https" for
+	// TLS requests and "http" for others. Set it only if the router is served
+	// behind a trusted proxy setting the header.
+	TrustForwardedProto bool
+
+	// If true, a request matching a route, except for the schemes of the
+	// route, is redirected with 308 Permanent Redirect to the same URL with
+	// the first scheme of the route, o/w it is matched with the next routes.
+	RedirectSchemes bool
+
 	// List of http routes.
-	routes []route
+	routes []*route
+
+	// Middleware added by Use, and the chain built from it, calling the
+	// dispatched handler.
+	middleware []func(http.Handler) http.Handler
+	chain      http.Handler
+
+	// Handlers replaced while serving, they take precedence over the
+	// exported handler fields. They are kept behind a pointer, shared by
+	// the copies of the router ServeHTTP gets, and allocated when the first
+	// route is registered, or by the first setter call.
+	replaced *replacedHandlers
 }
 
-// HandleFunc registers a new route with a matcher for the URL path.
-func (r *Router) HandleFunc(method string, path string, handler func(http.ResponseWriter, *http.Request)) {
-	// Sanity check.
+// replacedHandlers holds the handlers replaced while serving.
+type replacedHandlers struct {
+	notFoundHandler         atomic.Value
+	methodNotAllowedHandler atomic.Value
+	errorEncoder            atomic.Value
+	recoverHandler          atomic.Value
+}
+
+// Generous request path limits, for use as Router.MaxPathLength and
+// Router.MaxSegments.
+const (
+	DefaultMaxPathLength = 8 * 1024
+	DefaultMaxSegments   = 256
+)
+
+// MethodAny is the method of routes matching requests of any method,
+// registered by Any, or by HandleFunc and Handle with the method "*".
+const MethodAny = "*"
+
+// HandleFunc registers a new route with a matcher for the URL path, the
+// handler is wrapped with the route middleware, if any, like Handle, and
+// returns the Route handle configuring it.
+func (r *Router) HandleFunc(method string, path string, handler func(http.ResponseWriter, *http.Request), middleware ...func(http.Handler) http.Handler) *Route {
+	// Keep a nil handler nil, so the route reports it when it is matched.
+	var h http.Handler
+	if handler != nil {
+		h = http.HandlerFunc(handler)
+	}
+
+	return r.Handle(method, path, h, middleware...)
+}
+
+// Handle registers a new route with a matcher for the URL path, dispatching
+// an http.Handler, e.g. a struct implementing http.Handler, or the handler
+// returned by http.StripPrefix. Routes registered by Handle and HandleFunc
+// are matched the same way, in registration order, routes ending with a
+// wildcard or an optional parameter are matched after the other routes.
+//
+// The handler is wrapped with the route middleware, if any, in the order
+// given, the first is the outermost. The middleware added by Use wraps the
+// route middleware.
+//
+// The returned Route configures the route, e.g. its name, constraints and
+// middleware, a route with an empty path is not registered, and its Route
+// configures nothing.
+//
+// Handle panics if a wildcard or an optional parameter is not the last
+// segment of the path, or if the constraint of a route parameter is not
+// a valid regular expression, with an error wrapping ErrInvalidRoute, like
+// MustHandle, HandleE returns these errors instead.
+func (r *Router) Handle(method string, path string, handler http.Handler, middleware ...func(http.Handler) http.Handler) *Route {
+	// Sanity check, a route with an empty path is not registered.
 	if len(path) == 0 {
-		return
+		return &Route{route: &route{method: method}}
 	}
 
-	// Get the path, add `/` at the beginning and remove `/` at the end.
-	if path[len(path)-1] == '/' {
-		path = path[:len(path)-1]
+	route, err := newRoute(method, path)
+	if err != nil {
+		panic(err)
 	}
+	route.setHandler(handler, middleware)
+
+	// Append a new route, and allocate the replaced handlers before serving.
+	r.routes = append(r.routes, route)
+	r.handlers()
+
+	return &Route{route: route}
+}
+
+// HandleFuncE registers a new route like HandleFunc, and returns an error if
+// the route is not valid, see HandleE.
+func (r *Router) HandleFuncE(method string, path string, handler func(http.ResponseWriter, *http.Request), middleware ...func(http.Handler) http.Handler) (*Route, error) {
+	var h http.Handler
+	if handler != nil {
+		h = http.HandlerFunc(handler)
+	}
+
+	return r.HandleE(method, path, h, middleware...)
+}
+
+// HandleE registers a new route like Handle, and returns an error if the
+// route is not valid, the route is not registered if an error is returned.
+//
+// The error wraps ErrEmptyPath if the path is empty, ErrNilHandler if the
+// handler is nil, ErrInvalidRoute if the path has an empty segment, e.g.
+// "/val//key", a wildcard or an optional parameter that is not the last
+// segment, or an invalid constraint, and ErrDuplicateRoute if a route with
+// the same method and pattern, and no schemes or matchers, is registered.
+func (r *Router) HandleE(method string, path string, handler http.Handler, middleware ...func(http.Handler) http.Handler) (*Route, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrEmptyPath, method)
+	}
+	if handler == nil {
+		return nil, fmt.Errorf("%w: %s %s", ErrNilHandler, method, path)
+	}
+
+	route, err := newRoute(method, path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the segments, one trailing `/` is already removed.
+	for _, segment := range route.segments {
+		if segment == "" {
+			return nil, fmt.Errorf("%w: empty segment in route %s", ErrInvalidRoute, path)
+		}
+	}
+
+	// Check for a route registered twice, a route with schemes or matchers,
+	// e.g. header matchers, does not match every request, and can be followed
+	// by a route with the same method and pattern.
+	for _, registered := range r.routes {
+		if registered.method == route.method && registered.pattern == route.pattern &&
+			len(registered.schemes) == 0 && len(registered.matchers) == 0 {
+			return nil, fmt.Errorf("%w: %s %s", ErrDuplicateRoute, route.method, route.pattern)
+		}
+	}
+
+	// Append a new route, and allocate the replaced handlers before serving.
+	route.setHandler(handler, middleware)
+	r.routes = append(r.routes, route)
+	r.handlers()
+
+	return &Route{route: route}, nil
+}
+
+// MustHandleFunc registers a new route like HandleFuncE, and panics if the
+// route is not valid, it is meant for registering routes on init.
+func (r *Router) MustHandleFunc(method string, path string, handler func(http.ResponseWriter, *http.Request), middleware ...func(http.Handler) http.Handler) *Route {
+	route, err := r.HandleFuncE(method, path, handler, middleware...)
+	if err != nil {
+		panic(err)
+	}
+
+	return route
+}
+
+// MustHandle registers a new route like HandleE, and panics if the route is
+// not valid, it is meant for registering routes on init.
+func (r *Router) MustHandle(method string, path string, handler http.Handler, middleware ...func(http.Handler) http.Handler) *Route {
+	route, err := r.HandleE(method, path, handler, middleware...)
+	if err != nil {
+		panic(err)
+	}
+
+	return route
+}
+
+// Errors of route registration, returned wrapped by HandleE and HandleFuncE.
+var (
+	ErrEmptyPath      = errors.New("mux: empty route path")
+	ErrNilHandler     = errors.New("mux: nil route handler")
+	ErrInvalidRoute   = errors.New("mux: invalid route")
+	ErrDuplicateRoute = errors.New("mux: duplicate route")
+)
+
+// newRoute returns a new route with no handler, for a path that is not empty.
+func newRoute(method string, path string) (*route, error) {
+	// Get the path, add `/` at the beginning, the trailing `/` is removed
+	// the same way it is removed from request paths.
 	if path[0] != '/' {
 		path = "/" + path
 	}
+	segments := splitPath(path)
+
+	// A wildcard captures the rest of the path, and an optional parameter,
+	// e.g. ":key?", may be absent, they must be the last segment.
+	wildcard, optional := false, false
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, "*") {
+			if i != len(segments)-1 {
+				return nil, fmt.Errorf("%w: wildcard %s is not the last segment of route %s", ErrInvalidRoute, segment, path)
+			}
+			wildcard = true
+		}
+		if strings.HasPrefix(segment, ":") && strings.HasSuffix(segment, "?") {
+			if i != len(segments)-1 {
+				return nil, fmt.Errorf("%w: optional parameter %s is not the last segment of route %s", ErrInvalidRoute, segment, path)
+			}
+			optional = true
+		}
+	}
+
+	pattern := "/" + strings.Join(segments, "/")
+
+	// The optional parameter segment is kept without its marker.
+	if optional {
+		last := len(segments) - 1
+		segments[last] = strings.TrimSuffix(segments[last], "?")
+	}
+
+	// Compile the constraints of route parameters, e.g. ":id([0-9]+)", once,
+	// the parameter segment is kept without its constraint.
+	var constraints []*regexp.Regexp
+	for i, segment := range segments {
+		name, expr, ok := splitConstraint(segment)
+		if !ok {
+			continue
+		}
+
+		re, err := compileConstraint(expr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid constraint of parameter %s of route %s: %v", ErrInvalidRoute, name, path, err)
+		}
+		if constraints == nil {
+			constraints = make([]*regexp.Regexp, len(segments))
+		}
+		constraints[i] = re
+		segments[i] = ":" + name
+	}
+
+	return &route{
+		method:      method,
+		pattern:     pattern,
+		segments:    segments,
+		constraints: constraints,
+		wildcard:    wildcard,
+		optional:    optional,
+	}, nil
+}
+
+// setHandler sets the handler of a route, and its route middleware.
+func (route *route) setHandler(handler http.Handler, middleware []func(http.Handler) http.Handler) {
+	route.handlerName = handlerName(handler)
+	route.base = handler
+	route.middleware = append([]func(http.Handler) http.Handler(nil), middleware...)
+	route.wrap()
+}
+
+// wrap sets the dispatched handler of a route, the handler wrapped with the
+// route middleware, the first is the outermost, a nil handler is kept nil.
+func (route *route) wrap() {
+	handler := route.base
+	if handler != nil {
+		for i := len(route.middleware) - 1; i >= 0; i-- {
+			handler = route.middleware[i](handler)
+		}
+	}
+	route.handler = handler
+}
+
+// compileConstraint compiles the constraint of a route parameter, that must
+// match the whole segment.
+func compileConstraint(expr string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
+// Use appends middleware to the middleware chain of the router, the chain
+// wraps every handler the router dispatches, the handlers of the matched
+// routes, the NotFoundHandler and the MethodNotAllowedHandler, in the order
+// added, the first middleware added is the outermost.
+//
+// The chain is applied after matching, so middleware can retrieve the route
+// variables calling mux.Var(request, key), and the route template calling
+// mux.CurrentRoute(request). Responses written by the router itself, using
+// the ErrorEncoder, or answering OPTIONS requests, are not wrapped.
+//
+// Middleware must pass a request derived from the request they get, e.g.
+// using r.WithContext(ctx) with a ctx derived from r.Context(). The chain is
+// built by Use, not for each request, Use must not be called while the router
+// is serving requests.
+func (r *Router) Use(middleware ...func(http.Handler) http.Handler) {
+	r.middleware = append(r.middleware, middleware...)
 
-	// Append a new route.
-	segments := strings.Split(path, "/")[1:]
-	r.routes = append(r.routes, route{
-		method:   method,
-		segments: segments,
-		handler:  handler,
-	})
+	// Build the chain once, around the dispatched handler.
+	var chain http.Handler = http.HandlerFunc(r.serveDispatched)
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		chain = r.middleware[i](chain)
+	}
+	r.chain = chain
+}
+
+// Get registers a new route for GET requests, like HandleFunc.
+func (r *Router) Get(path string, handler func(http.ResponseWriter, *http.Request), middleware ...func(http.Handler) http.Handler) *Route {
+	return r.HandleFunc(http.MethodGet, path, handler, middleware...)
+}
+
+// Post registers a new route for POST requests, like HandleFunc.
+func (r *Router) Post(path string, handler func(http.ResponseWriter, *http.Request), middleware ...func(http.Handler) http.Handler) *Route {
+	return r.HandleFunc(http.MethodPost, path, handler, middleware...)
+}
+
+// Put registers a new route for PUT requests, like HandleFunc.
+func (r *Router) Put(path string, handler func(http.ResponseWriter, *http.Request), middleware ...func(http.Handler) http.Handler) *Route {
+	return r.HandleFunc(http.MethodPut, path, handler, middleware...)
+}
+
+// Delete registers a new route for DELETE requests, like HandleFunc.
+func (r *Router) Delete(path string, handler func(http.ResponseWriter, *http.Request), middleware ...func(http.Handler) http.Handler) *Route {
+	return r.HandleFunc(http.MethodDelete, path, handler, middleware...)
+}
+
+// Patch registers a new route for PATCH requests, like HandleFunc.
+func (r *Router) Patch(path string, handler func(http.ResponseWriter, *http.Request), middleware ...func(http.Handler) http.Handler) *Route {
+	return r.HandleFunc(http.MethodPatch, path, handler, middleware...)
+}
+
+// Options registers a new route for OPTIONS requests, like HandleFunc.
+func (r *Router) Options(path string, handler func(http.ResponseWriter, *http.Request), middleware ...func(http.Handler) http.Handler) *Route {
+	return r.HandleFunc(http.MethodOptions, path, handler, middleware...)
+}
+
+// Head registers a new route for HEAD requests, like HandleFunc.
+func (r *Router) Head(path string, handler func(http.ResponseWriter, *http.Request), middleware ...func(http.Handler) http.Handler) *Route {
+	return r.HandleFunc(http.MethodHead, path, handler, middleware...)
+}
+
+// Any registers a new route for requests of any method, like HandleFunc.
+// Routes registered for the method of a request are matched before the
+// routes of any method, e.g. a HEAD request matches a route registered by
+// Head, then a route registered by Any, and only then a GET route when
+// AutoHead is set.
+func (r *Router) Any(path string, handler func(http.ResponseWriter, *http.Request), middleware ...func(http.Handler) http.Handler) *Route {
+	return r.HandleFunc(MethodAny, path, handler, middleware...)
+}
+
+// SetNotFound replaces the not found handler with an http.Handler, like
+// SetNotFoundHandler. Setting nil restores the default handler.
+func (r *Router) SetNotFound(handler http.Handler) {
+	if handler == nil {
+		r.SetNotFoundHandler(nil)
+		return
+	}
+
+	r.SetNotFoundHandler(handler.ServeHTTP)
+}
+
+// SetNotFoundHandler replaces the NotFoundHandler, it is safe to call while
+// the router is serving requests. Setting nil restores the default handler.
+func (r *Router) SetNotFoundHandler(handler func(http.ResponseWriter, *http.Request)) {
+	r.handlers().notFoundHandler.Store(handler)
+}
+
+// SetMethodNotAllowedHandler replaces the MethodNotAllowedHandler, it is safe
+// to call while the router is serving requests. Setting nil restores the
+// default behavior.
+func (r *Router) SetMethodNotAllowedHandler(handler func(http.ResponseWriter, *http.Request)) {
+	r.handlers().methodNotAllowedHandler.Store(handler)
+}
+
+// SetErrorEncoder replaces the ErrorEncoder, it is safe to call while
+// the router is serving requests. Setting nil restores the default encoder.
+func (r *Router) SetErrorEncoder(encoder func(w http.ResponseWriter, r *http.Request, code int, err error)) {
+	r.handlers().errorEncoder.Store(encoder)
+}
+
+// SetRecoverHandler replaces the RecoverHandler, it is safe to call while
+// the router is serving requests. Setting nil disables panic recovery.
+func (r *Router) SetRecoverHandler(handler func(w http.ResponseWriter, r *http.Request, recovered interface{})) {
+	r.handlers().recoverHandler.Store(handler)
 }
 
 // Var returns route variables for the current request using the route
@@ -89,44 +505,310 @@ func Var(r *http.Request, key string) (string, bool) {
 	return v, ok
 }
 
+// AllowedMethods returns the sorted methods of the routes matching the path
+// of the current request, ok is true if called from a MethodNotAllowedHandler,
+// o/w ok is false.
+func AllowedMethods(r *http.Request) ([]string, bool) {
+	methods, ok := r.Context().Value(ctxAllowKey).([]string)
+
+	return methods, ok
+}
+
+// CurrentRoute returns the template of the route matched for the current
+// request, e.g. "/val/:key", ok is true if a route matched, o/w ok is false.
+//
+// Handlers dispatched by the router can always retrieve the route template,
+// middleware wrapping the router must first call TrackRoute, and retrieve the
+// route template after the router returns.
+func CurrentRoute(r *http.Request) (string, bool) {
+	// Try to get the context route.
+	match, ok := r.Context().Value(ctxRouteKey).(*routeMatch)
+	if !ok || !match.matched {
+		return "", false
+	}
+
+	return match.pattern, true
+}
+
+// TrackRoute returns a shallow copy of the request, that a router further down
+// the handler chain updates with the matched route. Middleware wrapping
+// a router use it to retrieve the route template calling
+// mux.CurrentRoute(request) after the router returns.
+func TrackRoute(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), ctxRouteKey, &routeMatch{}))
+}
+
 // ServeHTTP dispatches the handler registered in the matched route.
 //
 // When there is a match, route variables can be retrieved calling
 // mux.Var(request, key).
+//
+// Routes are matched against the escaped form of the request path, as
+// returned by req.URL.EscapedPath(), so an encoded "/" ("%2F") never splits
+// a segment. Each path segment is decoded exactly once using
+// url.PathUnescape. The request URL is never modified.
 func (r Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	// Get the path, and clean it.
-	path := req.URL.EscapedPath()
-	if len(path) > 0 && path[len(path)-1] == '/' {
-		path = path[:len(path)-1]
+	// Check the path limits before doing any work on the path.
+	path := requestPath(req)
+	if err := r.checkLimits(path); err != nil {
+		r.encodeError(w, req, http.StatusRequestURITooLong, err)
+		return
 	}
 
-	// Split path into it's segments.
-	segments := strings.Split(path, "/")[1:]
-
-	// Try to match the segments with one of the registered routs.
-	for _, route := range r.routes {
-		found, vars := r.match(route, req.Method, segments)
+	// Split the escaped path into it's segments, and decode them.
+	segments, ok := decodeSegments(splitPath(path))
 
+	// Try to match the segments with one of the registered routs,
+	// a path that can't be decoded does not match any route.
+	if ok {
 		// If found a match, run the handler for this route.
-		if found {
-			// Add path argv to the context.
-			if len(vars) > 0 {
-				req = req.WithContext(context.WithValue(req.Context(), ctxValsKey, vars))
+		if route, vars, found := r.find(req, req.Method, segments); found {
+			r.serveRoute(w, req, route, vars)
+			return
+		}
+
+		// Try the routes of any method, after the routes of the method.
+		if route, vars, found := r.find(req, MethodAny, segments); found {
+			r.serveRoute(w, req, route, vars)
+			return
+		}
+
+		// Dispatch a HEAD request with no HEAD route to the matching GET
+		// route, discarding the body.
+		if r.AutoHead && req.Method == http.MethodHead {
+			if route, vars, found := r.find(req, http.MethodGet, segments); found {
+				hw := &headWriter{ResponseWriter: w}
+				r.serveRoute(hw, req, route, vars)
+				hw.sendHeader(true)
+				return
 			}
+		}
 
-			route.handler(w, req)
+		// Redirect a request to a route with another scheme.
+		if r.RedirectSchemes && r.redirectScheme(w, req, segments) {
+			return
+		}
+	}
+
+	// Delegate a request no route matches to the fallback handler, as is.
+	if r.FallbackHandler != nil {
+		r.FallbackHandler.ServeHTTP(w, req)
+		return
+	}
+
+	// Handle a path registered for other methods.
+	methodNotAllowed := r.methodNotAllowed()
+	autoOptions := r.AutoOptions && req.Method == http.MethodOptions
+	if ok && (methodNotAllowed != nil || r.HandleMethodNotAllowed || autoOptions) {
+		// If routes of the method, or of any method, match the path, they did
+		// not match the request for another reason, e.g. its headers, and it
+		// is not found.
+		if allowed, registered := r.allowedMethods(segments, req.Method); len(allowed) > 0 && !registered {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+
+			// Answer an OPTIONS request with no OPTIONS route.
+			if autoOptions {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			if methodNotAllowed != nil {
+				req = req.WithContext(context.WithValue(req.Context(), ctxAllowKey, allowed))
+				r.dispatch(w, req, http.HandlerFunc(methodNotAllowed))
+				return
+			}
+
+			err := fmt.Errorf("mux: method %s not allowed for %s", req.Method, req.URL.Path)
+			r.encodeError(w, req, http.StatusMethodNotAllowed, err)
 			return
 		}
 	}
 
 	// Handle page not found.
-	if r.NotFoundHandler != nil {
-		r.NotFoundHandler(w, req)
+	if notFound := r.notFound(); notFound != nil {
+		r.dispatch(w, req, http.HandlerFunc(notFound))
 	} else {
 		// If no custom "page not found" handler defined,
 		// fallback to default 404.4 response.
-		pageNotFound(w, req)
+		r.dispatch(w, req, http.HandlerFunc(pageNotFound))
+	}
+}
+
+// find returns the first route matching the method, the decoded request
+// segments and the request, routes without a wildcard or an optional
+// parameter are matched before the routes with one.
+//
+// The schemes of a route are checked only if the method and the segments
+// match, and the matchers of a route, e.g. header matchers, are called only if
+// the schemes match too.
+func (r *Router) find(req *http.Request, method string, segments []string) (*route, map[string]string, bool) {
+	var loose *route
+	var looseVars map[string]string
+	looseFound := false
+
+	for _, route := range r.routes {
+		found, vars := r.match(route, method, segments)
+		if !found || !r.matchScheme(route, req) || !route.matchRequest(req) {
+			continue
+		}
+		if !route.wildcard && !route.optional {
+			return route, vars, true
+		}
+
+		// Keep the first loose match, in case no precise route matches.
+		if !looseFound {
+			loose, looseVars, looseFound = route, vars, true
+		}
 	}
+
+	return loose, looseVars, looseFound
+}
+
+// serveRoute runs the handler of a matched route, with the route variables.
+func (r *Router) serveRoute(w http.ResponseWriter, req *http.Request, route *route, vars map[string]string) {
+	// Add path argv to the context.
+	if len(vars) > 0 {
+		req = req.WithContext(context.WithValue(req.Context(), ctxValsKey, vars))
+	}
+
+	// Add the route to the context, or update a tracked route.
+	if match, ok := req.Context().Value(ctxRouteKey).(*routeMatch); ok {
+		match.pattern, match.matched = route.pattern, true
+	} else {
+		match := &routeMatch{pattern: route.pattern, matched: true}
+		req = req.WithContext(context.WithValue(req.Context(), ctxRouteKey, match))
+	}
+
+	// Sanity check, a route with a nil handler is a registration bug.
+	if route.handler == nil {
+		err := fmt.Errorf("mux: nil handler for route %s %s", route.method, route.pattern)
+		r.encodeError(w, req, http.StatusInternalServerError, err)
+		return
+	}
+
+	r.dispatch(w, req, route.handler)
+}
+
+// allowedMethods returns the sorted methods of the routes matching the
+// decoded request segments, regardless of the request method, including
+// HEAD if the router serves HEAD requests using GET routes, and OPTIONS if
+// the router answers OPTIONS requests, routes of any method are not listed.
+//
+// registered is true if a route of method, a route of any method, or a GET
+// route serving a HEAD request, matches the segments, the route did not
+// match the request for another reason, e.g. its headers.
+func (r *Router) allowedMethods(segments []string, method string) (methods []string, registered bool) {
+	seen := make(map[string]bool)
+	for _, route := range r.routes {
+		if seen[route.method] {
+			continue
+		}
+		if found, _ := r.matchPath(route, segments); found {
+			seen[route.method] = true
+			if route.method != MethodAny {
+				methods = append(methods, route.method)
+			}
+		}
+	}
+	if r.AutoHead && seen[http.MethodGet] && !seen[http.MethodHead] {
+		methods = append(methods, http.MethodHead)
+	}
+	if r.AutoOptions && len(methods) > 0 && !seen[http.MethodOptions] {
+		methods = append(methods, http.MethodOptions)
+	}
+	sort.Strings(methods)
+	registered = seen[method] || seen[MethodAny] || (r.AutoHead && method == http.MethodHead && seen[http.MethodGet])
+
+	return methods, registered
+}
+
+// dispatch calls a handler, recovering panics if a RecoverHandler is defined.
+//
+// If the router has middleware, the handler is called by the middleware
+// chain, the request passed to the chain has the route variables and the
+// matched route in its context.
+func (r *Router) dispatch(w http.ResponseWriter, req *http.Request, handler http.Handler) {
+	if r.chain != nil {
+		req = req.WithContext(context.WithValue(req.Context(), ctxHandlerKey, handler))
+		handler = r.chain
+	}
+
+	if recoverHandler := r.recoverer(); recoverHandler != nil {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+
+			// The abort panic is used to abort a response, let the server handle it.
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			recoverHandler(w, req, recovered)
+		}()
+	}
+
+	handler.ServeHTTP(w, req)
+}
+
+// serveDispatched calls the dispatched handler, at the end of the middleware
+// chain.
+func (r *Router) serveDispatched(w http.ResponseWriter, req *http.Request) {
+	handler, ok := req.Context().Value(ctxHandlerKey).(http.Handler)
+	if !ok {
+		// A middleware replaced the request context, instead of deriving it.
+		err := errors.New("mux: dispatched handler not found in the request context")
+		r.encodeError(w, req, http.StatusInternalServerError, err)
+		return
+	}
+
+	handler.ServeHTTP(w, req)
+}
+
+// handlers returns the replaced handlers, allocating them if needed.
+func (r *Router) handlers() *replacedHandlers {
+	if r.replaced == nil {
+		r.replaced = &replacedHandlers{}
+	}
+
+	return r.replaced
+}
+
+// notFound returns the current not found handler.
+func (r *Router) notFound() func(http.ResponseWriter, *http.Request) {
+	if r.replaced != nil {
+		if handler, ok := r.replaced.notFoundHandler.Load().(func(http.ResponseWriter, *http.Request)); ok {
+			return handler
+		}
+	}
+	if r.NotFoundHandler == nil && r.NotFound != nil {
+		return r.NotFound.ServeHTTP
+	}
+
+	return r.NotFoundHandler
+}
+
+// methodNotAllowed returns the current method not allowed handler.
+func (r *Router) methodNotAllowed() func(http.ResponseWriter, *http.Request) {
+	if r.replaced != nil {
+		if handler, ok := r.replaced.methodNotAllowedHandler.Load().(func(http.ResponseWriter, *http.Request)); ok {
+			return handler
+		}
+	}
+
+	return r.MethodNotAllowedHandler
+}
+
+// recoverer returns the current recover handler.
+func (r *Router) recoverer() func(http.ResponseWriter, *http.Request, interface{}) {
+	if r.replaced != nil {
+		if handler, ok := r.replaced.recoverHandler.Load().(func(http.ResponseWriter, *http.Request, interface{})); ok {
+			return handler
+		}
+	}
+
+	return r.RecoverHandler
 }
 
 // Internal context key type.
@@ -135,11 +817,48 @@ type ctxKey string
 // The context key for the route parameters.
 const ctxValsKey = ctxKey("Vals")
 
+// The context key for the matched route.
+const ctxRouteKey = ctxKey("Route")
+
+// The context key for the allowed methods.
+const ctxAllowKey = ctxKey("Allow")
+
+// The context key for the handler called by the middleware chain.
+const ctxHandlerKey = ctxKey("Handler")
+
+// Internal representation of a matched route.
+type routeMatch struct {
+	pattern string
+	matched bool
+}
+
 // Internal representation of a route.
 type route struct {
 	method   string
+	pattern  string
 	segments []string
-	handler  func(http.ResponseWriter, *http.Request)
+	wildcard bool
+	optional bool
+	handler  http.Handler
+
+	// Registered handler, its name, and the route middleware wrapping it.
+	base        http.Handler
+	handlerName string
+	middleware  []func(http.Handler) http.Handler
+
+	// Name and metadata of the route, set using its Route.
+	name string
+	meta map[string]string
+
+	// Matchers of the request, set using its Route, a request matches the
+	// route if its scheme is one of the schemes, if any, and all the
+	// matchers match.
+	schemes  []string
+	matchers []func(*http.Request) bool
+
+	// Constraints of the route parameters by segment index, nil if the
+	// route has no constraints.
+	constraints []*regexp.Regexp
 }
 
 // pageNotFound no handler configured.
@@ -148,10 +867,155 @@ func pageNotFound(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, "404.4 – No handler configured.")
 }
 
+// requestPath returns the escaped path used for matching a request.
+//
+// Absolute-form requests ("GET http://host/val") are matched by path.
+// Authority-form requests ("CONNECT host:443") have an empty path, and since
+// routes match by method, they only match routes registered for "CONNECT".
+// Fragments should never be sent, but some tools do, and the server leaves
+// them in the path, they are ignored.
+func requestPath(req *http.Request) string {
+	if strings.Contains(req.RequestURI, "#") {
+		if u, err := url.Parse(req.RequestURI); err == nil {
+			return u.EscapedPath()
+		}
+	}
+
+	return req.URL.EscapedPath()
+}
+
+// checkLimits checks an escaped request path against the router limits.
+func (r *Router) checkLimits(path string) error {
+	if r.MaxPathLength > 0 && len(path) > r.MaxPathLength {
+		return fmt.Errorf("mux: path length exceeds %d bytes", r.MaxPathLength)
+	}
+	if r.MaxSegments > 0 && strings.Count(path, "/") > r.MaxSegments {
+		return fmt.Errorf("mux: path exceeds %d segments", r.MaxSegments)
+	}
+
+	return nil
+}
+
+// splitPath splits an escaped request path into it's segments.
+//
+// An empty path is treated as "/", and one trailing "/" is removed before
+// splitting, so both "" and "/" have no segments.
+func splitPath(path string) []string {
+	// Normalize the empty path, some clients send "" instead of "/".
+	if path == "" {
+		path = "/"
+	}
+
+	// Remove the trailing `/`.
+	if path[len(path)-1] == '/' {
+		path = path[:len(path)-1]
+	}
+	if path == "" {
+		return []string{}
+	}
+
+	return strings.Split(path, "/")[1:]
+}
+
+// splitConstraint splits a route parameter segment with a constraint, e.g.
+// ":id([0-9]+)", into the parameter name and the regular expression, ok is
+// false if the segment is not a constrained route parameter.
+func splitConstraint(segment string) (name string, expr string, ok bool) {
+	if !strings.HasPrefix(segment, ":") || !strings.HasSuffix(segment, ")") {
+		return "", "", false
+	}
+
+	open := strings.IndexByte(segment, '(')
+	if open < 0 {
+		return "", "", false
+	}
+
+	return segment[1:open], segment[open+1 : len(segment)-1], true
+}
+
+// decodeSegments decodes escaped path segments, ok is false if one of
+// the segments is not a valid escaped string.
+func decodeSegments(segments []string) ([]string, bool) {
+	decoded := make([]string, len(segments))
+	for i, segment := range segments {
+		value, err := url.PathUnescape(segment)
+		if err != nil {
+			return nil, false
+		}
+		decoded[i] = value
+	}
+
+	return decoded, true
+}
+
+// encodeError writes an error response using the configured ErrorEncoder.
+func (r *Router) encodeError(w http.ResponseWriter, req *http.Request, code int, err error) {
+	encoder := r.ErrorEncoder
+	if r.replaced != nil {
+		if e, ok := r.replaced.errorEncoder.Load().(func(http.ResponseWriter, *http.Request, int, error)); ok {
+			encoder = e
+		}
+	}
+
+	if encoder != nil {
+		encoder(w, req, code, err)
+		return
+	}
+
+	// If no custom error encoder defined, fallback to the default one.
+	defaultErrorEncoder(w, req, code, err)
+}
+
+// defaultErrorEncoder writes the status text, and logs server errors.
+func defaultErrorEncoder(w http.ResponseWriter, r *http.Request, code int, err error) {
+	if code >= http.StatusInternalServerError {
+		log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+	}
+
+	w.WriteHeader(code)
+	io.WriteString(w, fmt.Sprintf("%d – %s.", code, http.StatusText(code)))
+}
+
+// matchRequest returns true if all the matchers of the route match
+// the request.
+func (route *route) matchRequest(req *http.Request) bool {
+	for _, matcher := range route.matchers {
+		if !matcher(req) {
+			return false
+		}
+	}
+
+	return true
+}
+
 // match matches a request to a route, and parse the arguments embedded in the route path.
-func (r Router) match(route route, method string, segments []string) (bool, map[string]string) {
-	// Check request for method and segments length matching.
-	if method != route.method || len(segments) != len(route.segments) {
+//
+// The request segments are already decoded, literal route segments are
+// compared with the decoded segments.
+func (r *Router) match(route *route, method string, segments []string) (bool, map[string]string) {
+	// Check request for method matching.
+	if method != route.method {
+		return false, nil
+	}
+
+	return r.matchPath(route, segments)
+}
+
+// matchPath matches the decoded request segments to a route path, ignoring
+// the route method, and parse the arguments embedded in the route path.
+func (r *Router) matchPath(route *route, segments []string) (bool, map[string]string) {
+	// Check request for segments length matching, a wildcard matches one
+	// or more segments, and an optional parameter matches zero or one.
+	switch n := len(route.segments); {
+	case route.wildcard:
+		if len(segments) < n {
+			return false, nil
+		}
+	case route.optional:
+		if len(segments) != n && len(segments) != n-1 {
+			return false, nil
+		}
+	case len(segments) != n:
 		return false, nil
 	}
 
@@ -160,11 +1024,36 @@ func (r Router) match(route route, method string, segments []string) (bool, map[
 
 	// Check each segment for a match.
 	for i, segment := range route.segments {
+		// An absent optional parameter is not set.
+		if i == len(segments) {
+			break
+		}
+
+		// Check for a wildcard, capturing the rest of the path.
+		if strings.HasPrefix(segment, "*") {
+			rest := strings.Join(segments[i:], "/")
+			if rest == "" {
+				return false, nil
+			}
+			vals[segment[1:]] = rest
+
+			break
+		}
+
 		// Check for path argument.
-		if segment[0] == ':' {
+		if strings.HasPrefix(segment, ":") {
+			// A route parameter never matches an empty segment.
+			if segments[i] == "" {
+				return false, nil
+			}
+
+			// A constrained route parameter matches only valid segments.
+			if route.constraints != nil && route.constraints[i] != nil && !route.constraints[i].MatchString(segments[i]) {
+				return false, nil
+			}
+
 			// If this is an argument segments, parse it.
-			value, _ := url.QueryUnescape(segments[i])
-			vals[segment[1:]] = value
+			vals[segment[1:]] = segments[i]
 
 			continue
 		}
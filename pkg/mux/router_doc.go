@@ -17,18 +17,159 @@
 //
 // mux.Router supports precise routes, route parameters, and not found handler.
 //
+// Routes are registered with HandleFunc, for handler functions, or with
+// Handle, for http.Handler values, e.g. http.FileServer or a struct
+// implementing http.Handler. Get, Post, Put, Delete, Patch, Options and
+// Head register handler functions for one method, e.g.
+// router.Get("/val/:key", getValHandler).
+//
+// Any, or the method "*", registers a route for requests of any method, e.g.
+// router.Any("/proxy/*rest", proxyHandler). Routes of the request method are
+// matched before the routes of any method, and a path with a route of any
+// method is never answered with "405 Method Not Allowed".
+//
+// PathPrefix returns a Subrouter registering routes under a path prefix, e.g.
+// router.PathPrefix("/api/v1").Get("/val/:key", getValHandler) registers
+// "/api/v1/val/:key", the prefix can have route parameters, and can be
+// nested calling PathPrefix of the Subrouter.
+//
+// HandleFunc and Handle ignore empty paths, and accept nil handlers and
+// duplicate routes, HandleFuncE and HandleE return an error for them, and for
+// paths with empty segments, e.g. "/val//key", and MustHandleFunc and
+// MustHandle panic, e.g. for registering routes on init:
+//
+//  router.MustHandleFunc("GET", "/val/:key", getValHandler)
+//
 // Precise routes, unlike http mux, kitty routes are precise,
 // request to path "/hello/world" will not match the route "/hello/".
 //
+// One trailing slash is insignificant, both in registered routes and in
+// request paths, the route "/hello/" is the same as the route "/hello", and
+// both match requests to "/hello" and "/hello/". The route "/" matches only
+// requests to the root path, "" or "/". Route parameters never match empty
+// segments.
+//
 // NotFoundHandler is a custom handler function called when all routes does not match,
 // users should define a not found handler when using kitty mux router.
 // If NotFoundHandler is not defined a default "404" handler is used.
+// NotFound is an http.Handler used like NotFoundHandler, if NotFoundHandler is
+// not defined, and SetNotFound replaces it at run time.
+//
+// FallbackHandler is an http.Handler called with requests no route matches,
+// untouched, before the method not allowed and the not found handlers, e.g.
+// to fall back to a legacy http.ServeMux while migrating its routes to the
+// router. The router middleware and RecoverHandler do not wrap it.
+//
+// HandleMethodNotAllowed answers requests whose path matches a route, but
+// whose method does not, with "405 Method Not Allowed" and an Allow header
+// listing the methods registered for the path, using the ErrorEncoder. If it
+// is not set such requests are handled by the NotFoundHandler.
+//
+// MethodNotAllowedHandler is a custom handler function called for such
+// requests, whether HandleMethodNotAllowed is set or not, the Allow header is
+// already set, and the allowed methods are retrieved calling
+// mux.AllowedMethods(request).
+//
+// AutoOptions answers OPTIONS requests whose path matches a route, but no
+// OPTIONS route, with "204 No Content" and an Allow header listing the
+// methods registered for the path, and OPTIONS. Registered OPTIONS routes
+// are dispatched as usual, and paths with no routes are not found.
+//
+// AutoHead dispatches HEAD requests whose path matches no HEAD route to the
+// matching GET route, the router discards the response body, keeping the
+// status code and the headers, and sets Content-Length to the length of the
+// discarded body, unless the handler set it or flushed the response.
+//
+// ErrorEncoder is a custom function called when the router itself fails a
+// request, for example when a matched route has a nil handler, it receives
+// the status code and an error describing the failure.
+//
+// RecoverHandler is a custom function called with the recovered value when a
+// dispatched handler panics, if not defined panics are not recovered.
+//
+// The handler fields must not be modified while the router is serving
+// requests, use SetNotFoundHandler, SetMethodNotAllowedHandler,
+// SetErrorEncoder and SetRecoverHandler, which are safe for concurrent use,
+// to replace them at run time.
+//
+// MaxPathLength and MaxSegments limit the size of request paths, requests
+// exceeding them are answered with "414 URI Too Long" before any matching
+// is done. Zero means unlimited.
 //
 // Route parameters are named URL segments that are used to capture the values
 // specified at their position in the URL. The captured values
 // retrieved calling mux.Var(request, key), with the name of the route parameter
 // as key.
 //
+// A wildcard, a last segment starting with "*", e.g. "/static/*filepath",
+// matches one or more remaining segments, the captured value is the decoded
+// rest of the path, joined by "/", e.g. "css/site.css". Routes without a
+// wildcard are matched first, so "/static/:file" is dispatched for
+// "/static/site.css" even if registered after "/static/*filepath".
+// Registering a wildcard that is not the last segment panics.
+//
+// A last route parameter marked with "?", e.g. "/val/:key?", is optional,
+// the route matches both "/val" and "/val/kitty", and when the segment is
+// absent mux.Var(request, "key") returns ok false. Like wildcard routes,
+// routes with an optional parameter are matched after the other routes.
+// Registering an optional parameter that is not the last segment panics.
+//
+// A route parameter can be constrained by a regular expression in
+// parentheses, e.g. "/val/:id([0-9]+)", the expression must match the whole
+// decoded segment, or the route does not match and the next routes are
+// tried. Expressions are compiled once, when the route is registered, they
+// can't contain "/", and registering an invalid expression panics.
+//
+// Routes are matched against the escaped request path
+// (see url.URL.EscapedPath), each segment is decoded exactly once using
+// url.PathUnescape, an encoded slash ("%2F") is part of the segment and does
+// not split the path into two segments. Literal route segments are registered
+// in their decoded form, e.g. "/città/:id" matches both "/città/5" and
+// "/citt%C3%A0/5". The router never modifies the request URL.
+//
+// Use adds middleware wrapping every handler the router dispatches,
+// including the NotFoundHandler, in the order added, the first is the
+// outermost. Middleware is applied after matching, so it can retrieve the
+// route variables calling mux.Var(request, key).
+//
+// Route middleware is given when registering a route, e.g.
+// router.HandleFunc("POST", "/val", postValHandler, withAuth, withMaxBody),
+// it wraps only the handler of the route, in the order given, and is wrapped
+// by the middleware added by Use.
+//
+// HandleFunc, Handle and the other registration methods return a Route, with
+// chainable setters configuring the route after it is registered, and before
+// the router serves requests, e.g.
+// router.Get("/val/:id", getValHandler).Name("get-val").Where("id", "[0-9]+").
+//
+// Route.Header adds a matcher of a request header, e.g.
+// router.Get("/val/:key", getValV2Handler).Header("X-Api-Version", "2"), the
+// value can be a glob, e.g. "application/*", a request that does not match
+// all the header matchers of a route is matched with the next routes.
+//
+// Route.Schemes restricts a route to request schemes, e.g.
+// router.Post("/token", tokenHandler).Schemes("https"), a request is "https"
+// when it came over TLS, or, when TrustForwardedProto is set, when its
+// X-Forwarded-Proto header says so. When RedirectSchemes is set, a request
+// that matches a route but not its schemes is redirected with "308 Permanent
+// Redirect" to the first scheme of the route.
+//
+// Route.MatcherFunc adds a custom matcher, e.g. of the client certificate of
+// a request. The schemes of a route are checked after its method and path
+// match, then its header and custom matchers are called in the order they
+// were added, a request that does not match is matched with the next routes.
+// Matchers are called before route variables are set, and must not modify the
+// request.
+//
+// Routes returns a copy of the registered routes, as RouteInfo values with
+// the method, the pattern, the handler name, the name and the metadata of
+// each route, and Walk visits them in registration order.
+// HasNotFoundHandler reports whether a not found handler is defined.
+//
+// SSE and SSEWithHeartbeat return handlers streaming server-sent events, they
+// set the event stream headers, flush after every event, send heartbeat
+// comments, and stop sending when the client disconnects.
+//
 // To define routes with route parameters, simply specify the route parameters
 // in the path of the route as shown below.
 //
@@ -0,0 +1,64 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mux
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// FuzzServeHTTP feeds arbitrary methods and paths to a router with tricky
+// routes, the router must never panic, and must either dispatch or 404.
+//
+// The seed corpus is in testdata/fuzz/FuzzServeHTTP, run the fuzzer with:
+//
+//	go test ./pkg/mux -run=^$ -fuzz=FuzzServeHTTP
+func FuzzServeHTTP(f *testing.F) {
+	router := Router{}
+	router.HandleFunc("GET", "/", found)
+	router.HandleFunc("GET", "/found", found)
+	router.HandleFunc("GET", "/found/:key", found)
+	router.HandleFunc("POST", "/found/:key/info", found)
+	router.HandleFunc("GET", "/a//b", found)
+	router.HandleFunc("GET", "/:a/:b/:c/:d/:e", found)
+	router.HandleFunc("PUT", ":", found)
+	router.HandleFunc("GET", "/found/:key/*rest", found)
+	router.HandleFunc("GET", "/:a/:b?", found)
+
+	f.Add("GET", "/found/hello", "")
+	f.Add("GET", "/found/a/b", "/found/a%2Fb")
+	f.Add("GET", "/found/%zz", "/found/%zz")
+	f.Add("POST", "//", "")
+	f.Add("", "", "")
+
+	f.Fuzz(func(t *testing.T, method string, path string, rawPath string) {
+		req := &http.Request{
+			Method: method,
+			URL:    &url.URL{Path: path, RawPath: rawPath},
+			Header: make(http.Header),
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		// Check the status code is one we expect.
+		if status := rr.Code; status != http.StatusOK && status != http.StatusNotFound {
+			t.Errorf("handler returned unexpected status code: got %v", status)
+		}
+	})
+}
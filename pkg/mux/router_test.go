@@ -16,12 +16,16 @@
 package mux
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -124,6 +128,30 @@ func BenchmarkRouter(b *testing.B) {
 	}
 }
 
+// BenchmarkRouterConstraint benchmarks routing to a constrained route.
+func BenchmarkRouterConstraint(b *testing.B) {
+	// Create a router with a constrained route, after an unmatched one.
+	router := Router{}
+	router.HandleFunc("GET", "/found/:key([a-z]+)/info", benchmarkHandler)
+	router.HandleFunc("GET", "/found/:key([a-z]+)", benchmarkHandler)
+
+	for n := 0; n < b.N; n++ {
+		req, err := http.NewRequest("GET", "/found/hello", nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		// Check the status code is what we expect.
+		if status := rr.Code; status != http.StatusOK {
+			b.Errorf("handler returned wrong status code: got %v want %v",
+				status, http.StatusOK)
+		}
+	}
+}
+
 func TestDefaultNotFound(t *testing.T) {
 	req, err := http.NewRequest("GET", "/not-found", nil)
 	if err != nil {
@@ -174,6 +202,112 @@ func TestCustomNotFound(t *testing.T) {
 	}
 }
 
+func TestNotFoundHTTPHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		handler  Router
+		set      http.Handler
+		expected string
+	}{
+		{"field", Router{NotFound: catHandler{"tom"}}, nil, "tom"},
+		{"func field first", Router{NotFound: catHandler{"tom"}, NotFoundHandler: notFound}, nil, "404 – Page not found."},
+		{"setter", Router{NotFoundHandler: notFound}, catHandler{"felix"}, "felix"},
+	}
+
+	for _, tt := range tests {
+		if tt.set != nil {
+			tt.handler.SetNotFound(tt.set)
+		}
+
+		req, err := http.NewRequest("GET", "/not-found", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		tt.handler.ServeHTTP(rr, req)
+
+		// Check the response body is what we expect.
+		if !strings.Contains(rr.Body.String(), tt.expected) {
+			t.Errorf("%s: unexpected body: got %q want %q", tt.name, rr.Body.String(), tt.expected)
+		}
+		if !tt.handler.HasNotFoundHandler() {
+			t.Errorf("%s: not found handler is not defined", tt.name)
+		}
+	}
+
+	// Check setting nil restores the default handler.
+	handler := Router{NotFound: catHandler{"tom"}}
+	handler.SetNotFound(nil)
+	if handler.HasNotFoundHandler() {
+		t.Errorf("not found handler is still defined")
+	}
+}
+
+func TestFallbackHandler(t *testing.T) {
+	var fallbackReq *http.Request
+
+	// A legacy mux, recording the requests it gets.
+	legacy := http.NewServeMux()
+	legacy.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fallbackReq = r
+		if r.URL.Path != "/legacy" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "legacy")
+	})
+
+	handler := Router{
+		NotFoundHandler:        notFound,
+		FallbackHandler:        legacy,
+		HandleMethodNotAllowed: true,
+		AutoOptions:            true,
+	}
+	handler.Use(tag("router"))
+	handler.Get("/val/:key", found)
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		code     int
+		chain    string
+		fallback bool
+	}{
+		{"route", "GET", "/val/kitty", http.StatusOK, "router", false},
+		{"legacy route", "GET", "/legacy", http.StatusOK, "", true},
+		{"method not allowed", "POST", "/val/kitty", http.StatusNotFound, "", true},
+		{"auto options", "OPTIONS", "/val/kitty", http.StatusNotFound, "", true},
+		{"not found", "GET", "/kitty", http.StatusNotFound, "", true},
+	}
+
+	for _, tt := range tests {
+		fallbackReq = nil
+
+		req, err := http.NewRequest(tt.method, tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the status code and the middleware chain are what we expect.
+		if rr.Code != tt.code || rr.Header().Get("X-Chain") != tt.chain {
+			t.Errorf("%s: got %v %q want %v %q", tt.name, rr.Code, rr.Header().Get("X-Chain"), tt.code, tt.chain)
+		}
+
+		// Check unmatched requests are passed to the fallback untouched.
+		if tt.fallback && fallbackReq != req {
+			t.Errorf("%s: request was not passed untouched to the fallback handler", tt.name)
+		}
+		if !tt.fallback && fallbackReq != nil {
+			t.Errorf("%s: unexpected call of the fallback handler", tt.name)
+		}
+	}
+}
+
 func TestFound(t *testing.T) {
 	req, err := http.NewRequest("GET", "/found", nil)
 	if err != nil {
@@ -220,3 +354,1401 @@ func TestRouteVars(t *testing.T) {
 			rr.Body.String(), expected)
 	}
 }
+
+func TestEscapedPathVars(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		rawPath  string
+		expected string
+	}{
+		// RawPath is not set, the path is escaped from URL.Path.
+		{"unset", "/found/hello world", "", `{"key": "hello world"}`},
+		// RawPath is a valid encoding of Path, the encoded slash stays in the segment.
+		{"set", "/found/a/b", "/found/a%2Fb", `{"key": "a/b"}`},
+		// RawPath is not consistent with Path, the path is escaped from URL.Path.
+		{"inconsistent", "/found/hello", "/found/world", `{"key": "hello"}`},
+		// Parameters are decoded exactly once.
+		{"decoded once", "/found/%41", "/found/%2541", `{"key": "%41"}`},
+		// A plus sign in a path is not a space.
+		{"plus", "/found/a+b", "", `{"key": "a+b"}`},
+	}
+
+	handler := Router{
+		NotFoundHandler: notFound,
+	}
+	handler.HandleFunc("GET", "/found/:key", found)
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.URL.Path = tt.path
+		req.URL.RawPath = tt.rawPath
+		original := *req.URL
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the status code is what we expect.
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				tt.name, status, http.StatusOK)
+		}
+
+		// Check the response body is what we expect.
+		if rr.Body.String() != tt.expected {
+			t.Errorf("%s: handler returned unexpected body: got %v want %v",
+				tt.name, rr.Body.String(), tt.expected)
+		}
+
+		// Check the request URL was not modified.
+		if *req.URL != original {
+			t.Errorf("%s: request URL was modified: got %+v want %+v",
+				tt.name, *req.URL, original)
+		}
+	}
+}
+
+func TestNilHandler(t *testing.T) {
+	req, err := http.NewRequest("GET", "/found/hello", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Capture the error passed to the error encoder.
+	var encoded error
+	rr := httptest.NewRecorder()
+	handler := Router{
+		NotFoundHandler: notFound,
+		ErrorEncoder: func(w http.ResponseWriter, r *http.Request, code int, err error) {
+			encoded = err
+			w.WriteHeader(code)
+		},
+	}
+	handler.HandleFunc("GET", "/found/:key", nil)
+	handler.ServeHTTP(rr, req)
+
+	// Check the status code is what we expect.
+	if status := rr.Code; status != http.StatusInternalServerError {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusInternalServerError)
+	}
+
+	// Check the error names the route template.
+	expected := "mux: nil handler for route GET /found/:key"
+	if encoded == nil || encoded.Error() != expected {
+		t.Errorf("router encoded unexpected error: got %v want %v",
+			encoded, expected)
+	}
+}
+
+func TestEdgePaths(t *testing.T) {
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"", http.StatusNotFound},
+		{"/", http.StatusNotFound},
+		{"//", http.StatusNotFound},
+		{"/?q=1", http.StatusNotFound},
+		{"/found?q=1", http.StatusOK},
+		{"/found/?q=1", http.StatusOK},
+	}
+
+	handler := Router{
+		NotFoundHandler: notFound,
+	}
+	handler.HandleFunc("GET", "/found", found)
+	handler.HandleFunc("GET", "/found/hello", found)
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "http://localhost"+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the status code is what we expect.
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%q: handler returned wrong status code: got %v want %v",
+				tt.path, status, tt.status)
+		}
+	}
+}
+
+func TestSplitPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected []string
+	}{
+		{"", []string{}},
+		{"/", []string{}},
+		{"//", []string{""}},
+		{"/found", []string{"found"}},
+		{"/found/", []string{"found"}},
+		{"/found/hello", []string{"found", "hello"}},
+	}
+
+	for _, tt := range tests {
+		segments := splitPath(tt.path)
+		if fmt.Sprintf("%q", segments) != fmt.Sprintf("%q", tt.expected) {
+			t.Errorf("%q: unexpected segments: got %q want %q",
+				tt.path, segments, tt.expected)
+		}
+	}
+}
+
+func TestUnicodeLiterals(t *testing.T) {
+	tests := []struct {
+		path     string
+		rawPath  string
+		status   int
+		expected string
+	}{
+		// Raw UTF-8 request.
+		{"/città/5", "", http.StatusOK, `{"key": "5"}`},
+		// Percent-encoded request.
+		{"/città/5", "/citt%C3%A0/5", http.StatusOK, `{"key": "5"}`},
+		// Mixed forms, encoded literal and UTF-8 parameter.
+		{"/città/über", "/citt%C3%A0/über", http.StatusOK, `{"key": "über"}`},
+		// Encoded percent sign in a literal.
+		{"/100%/5", "/100%25/5", http.StatusOK, `{"key": "5"}`},
+		// Encoded slash is not a path separator.
+		{"/città/a/b", "/città%2Fa/b", http.StatusNotFound, "404 – Page not found."},
+	}
+
+	handler := Router{
+		NotFoundHandler: notFound,
+	}
+	handler.HandleFunc("GET", "/città/:key", found)
+	handler.HandleFunc("GET", "/100%/:key", found)
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.URL.Path = tt.path
+		req.URL.RawPath = tt.rawPath
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the status code is what we expect.
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%q: handler returned wrong status code: got %v want %v",
+				tt.path, status, tt.status)
+		}
+
+		// Check the response body is what we expect.
+		if rr.Body.String() != tt.expected {
+			t.Errorf("%q: handler returned unexpected body: got %v want %v",
+				tt.path, rr.Body.String(), tt.expected)
+		}
+	}
+}
+
+func TestPathLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		status int
+	}{
+		{"short", "/found/hello", http.StatusOK},
+		{"long", "/found/" + strings.Repeat("a", 4*1024*1024), http.StatusRequestURITooLong},
+		{"deep", strings.Repeat("/a", 300), http.StatusRequestURITooLong},
+	}
+
+	handler := Router{
+		NotFoundHandler: notFound,
+		MaxPathLength:   DefaultMaxPathLength,
+		MaxSegments:     DefaultMaxSegments,
+	}
+	handler.HandleFunc("GET", "/found/:key", found)
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the status code is what we expect.
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				tt.name, status, tt.status)
+		}
+	}
+}
+
+func TestPathUnlimited(t *testing.T) {
+	value := strings.Repeat("a", 64*1024)
+	req, err := http.NewRequest("GET", "/found/"+value, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := Router{}
+	handler.HandleFunc("GET", "/found/:key", found)
+	handler.ServeHTTP(rr, req)
+
+	// Check the status code is what we expect.
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusOK)
+	}
+}
+
+func TestRequestTargetForms(t *testing.T) {
+	tests := []struct {
+		name     string
+		request  string
+		status   int
+		expected string
+	}{
+		{"origin-form", "GET /found/hello HTTP/1.1\r\nHost: localhost\r\n\r\n",
+			http.StatusOK, `{"key": "hello"}`},
+		{"absolute-form", "GET http://evil/found/hello HTTP/1.1\r\nHost: localhost\r\n\r\n",
+			http.StatusOK, `{"key": "hello"}`},
+		{"fragment", "GET /found/hello#frag HTTP/1.1\r\nHost: localhost\r\n\r\n",
+			http.StatusOK, `{"key": "hello"}`},
+		{"encoded hash", "GET /found/hello%23frag HTTP/1.1\r\nHost: localhost\r\n\r\n",
+			http.StatusOK, `{"key": "hello#frag"}`},
+		{"authority-form", "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n",
+			http.StatusNotFound, "404 – Page not found."},
+		{"connect registered", "CONNECT /tunnel/hello HTTP/1.1\r\nHost: localhost\r\n\r\n",
+			http.StatusOK, `{"key": "hello"}`},
+	}
+
+	handler := Router{
+		NotFoundHandler: notFound,
+	}
+	handler.HandleFunc("GET", "/found/:key", found)
+	handler.HandleFunc("GET", "/:key", found)
+	handler.HandleFunc("CONNECT", "/tunnel/:key", found)
+
+	for _, tt := range tests {
+		req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(tt.request)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the status code is what we expect.
+		if status := rr.Code; status != tt.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v",
+				tt.name, status, tt.status)
+		}
+
+		// Check the response body is what we expect.
+		if rr.Body.String() != tt.expected {
+			t.Errorf("%s: handler returned unexpected body: got %v want %v",
+				tt.name, rr.Body.String(), tt.expected)
+		}
+	}
+}
+
+func TestSetNotFoundHandlerConcurrent(t *testing.T) {
+	handler := Router{}
+	handler.HandleFunc("GET", "/found/:key", found)
+
+	// Replace the not found handler while serving requests.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			if i%2 == 0 {
+				handler.SetNotFoundHandler(notFound)
+			} else {
+				handler.SetNotFoundHandler(nil)
+			}
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		req, err := http.NewRequest("GET", "/not-found", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the status code is what we expect.
+		if status := rr.Code; status != http.StatusNotFound {
+			t.Errorf("handler returned wrong status code: got %v want %v",
+				status, http.StatusNotFound)
+		}
+	}
+	<-done
+
+	// Check the last handler set is used.
+	req, err := http.NewRequest("GET", "/not-found", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler.SetNotFoundHandler(notFound)
+	handler.ServeHTTP(rr, req)
+
+	// Check the response body is what we expect.
+	expected := "404 – Page not found."
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v",
+			rr.Body.String(), expected)
+	}
+}
+
+func TestSetNotFoundHandlerRouterValue(t *testing.T) {
+	router := Router{}
+	router.HandleFunc("GET", "/found/:key", found)
+
+	// A Router value is an http.Handler, the server gets a copy of it.
+	var handler http.Handler = router
+	router.SetNotFoundHandler(notFound)
+
+	req, err := http.NewRequest("GET", "/not-found", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	// Check the copy uses the handler set after it was made.
+	expected := "404 – Page not found."
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v",
+			rr.Body.String(), expected)
+	}
+}
+
+func TestRecoverNotFoundPanic(t *testing.T) {
+	req, err := http.NewRequest("GET", "/not-found", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := Router{
+		NotFoundHandler: func(w http.ResponseWriter, r *http.Request) {
+			panic("kitty is not here")
+		},
+		RecoverHandler: func(w http.ResponseWriter, r *http.Request, recovered interface{}) {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, fmt.Sprint(recovered))
+		},
+	}
+	handler.ServeHTTP(rr, req)
+
+	// Check the status code is what we expect.
+	if status := rr.Code; status != http.StatusInternalServerError {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusInternalServerError)
+	}
+
+	// Check the response body is what we expect.
+	expected := "kitty is not here"
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v",
+			rr.Body.String(), expected)
+	}
+}
+
+func TestRecoverAbortHandler(t *testing.T) {
+	req, err := http.NewRequest("GET", "/found", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := Router{
+		RecoverHandler: func(w http.ResponseWriter, r *http.Request, recovered interface{}) {
+			t.Errorf("recover handler called for %v", recovered)
+		},
+	}
+	handler.HandleFunc("GET", "/found", func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	})
+
+	// Check the abort panic is not recovered.
+	defer func() {
+		if recovered := recover(); recovered != http.ErrAbortHandler {
+			t.Errorf("router recovered unexpected value: got %v want %v",
+				recovered, http.ErrAbortHandler)
+		}
+	}()
+	handler.ServeHTTP(rr, req)
+}
+
+func TestTrailingSlashTable(t *testing.T) {
+	templates := []string{"/", "/x", "/x/", "/:p", "/:p/"}
+	paths := []string{"/", "", "/x", "/x/", "/y"}
+
+	// Expected status for each template (rows) and request path (columns).
+	expected := map[string][]int{
+		"/":    {200, 200, 404, 404, 404},
+		"/x":   {404, 404, 200, 200, 404},
+		"/x/":  {404, 404, 200, 200, 404},
+		"/:p":  {404, 404, 200, 200, 200},
+		"/:p/": {404, 404, 200, 200, 200},
+	}
+
+	for _, template := range templates {
+		handler := Router{
+			NotFoundHandler: notFound,
+		}
+		handler.HandleFunc("GET", template, found)
+
+		for i, path := range paths {
+			req, err := http.NewRequest("GET", "http://localhost"+path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			// Check the status code is what we expect.
+			if status := rr.Code; status != expected[template][i] {
+				t.Errorf("%q %q: handler returned wrong status code: got %v want %v",
+					template, path, status, expected[template][i])
+			}
+		}
+	}
+}
+
+func TestTrailingSlashOrder(t *testing.T) {
+	paths := []string{"/", "", "/x", "/x/", "/y", "//"}
+	expected := []string{"root", "root", "x", "x", "param", "not found"}
+
+	// Register the same routes in two opposite orders.
+	orders := [][]string{
+		{"/", "/x/", "/:p"},
+		{"/x", "/", "/:p/"},
+	}
+
+	for _, order := range orders {
+		handler := Router{
+			NotFoundHandler: func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "not found")
+			},
+		}
+		for _, template := range order {
+			name := "x"
+			switch template {
+			case "/":
+				name = "root"
+			case "/:p", "/:p/":
+				name = "param"
+			}
+			handler.HandleFunc("GET", template, func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, name)
+			})
+		}
+
+		for i, path := range paths {
+			req, err := http.NewRequest("GET", "http://localhost"+path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			// Check the response body is what we expect.
+			if rr.Body.String() != expected[i] {
+				t.Errorf("%q %q: handler returned unexpected body: got %v want %v",
+					order, path, rr.Body.String(), expected[i])
+			}
+		}
+	}
+}
+
+func TestCurrentRoute(t *testing.T) {
+	req, err := http.NewRequest("GET", "/found/hello", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Retrieve the route template inside the handler.
+	var inside string
+	rr := httptest.NewRecorder()
+	handler := Router{}
+	handler.HandleFunc("GET", "/found/:key/", func(w http.ResponseWriter, r *http.Request) {
+		inside, _ = CurrentRoute(r)
+	})
+
+	// Retrieve the route template in a wrapping middleware.
+	req = TrackRoute(req)
+	if _, ok := CurrentRoute(req); ok {
+		t.Errorf("route found before dispatch")
+	}
+	handler.ServeHTTP(rr, req)
+	outside, ok := CurrentRoute(req)
+
+	// Check the route template is what we expect.
+	expected := "/found/:key"
+	if inside != expected {
+		t.Errorf("handler got unexpected route: got %v want %v", inside, expected)
+	}
+	if !ok || outside != expected {
+		t.Errorf("middleware got unexpected route: got %v want %v", outside, expected)
+	}
+}
+
+func TestCurrentRouteNotFound(t *testing.T) {
+	req, err := http.NewRequest("GET", "/not-found", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := Router{
+		NotFoundHandler: func(w http.ResponseWriter, r *http.Request) {
+			if route, ok := CurrentRoute(r); ok {
+				t.Errorf("not found handler got unexpected route: %v", route)
+			}
+		},
+	}
+	handler.HandleFunc("GET", "/found", found)
+	handler.ServeHTTP(rr, TrackRoute(req))
+}
+
+// catHandler is a struct handler, writing its name and the "key" route
+// parameter.
+type catHandler struct {
+	name string
+}
+
+func (h catHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key, _ := Var(r, "key")
+
+	io.WriteString(w, fmt.Sprintf("%s: %s", h.name, key))
+}
+
+func TestHandle(t *testing.T) {
+	handler := Router{
+		NotFoundHandler: notFound,
+	}
+	handler.Handle("GET", "/cats/:key", catHandler{name: "Layla"})
+	handler.HandleFunc("GET", "/found/:key", found)
+	handler.Handle("GET", "/static/:key", http.StripPrefix("/static", catHandler{name: "static"}))
+
+	tests := []struct {
+		path     string
+		code     int
+		expected string
+	}{
+		{"/cats/hello", http.StatusOK, "Layla: hello"},
+		{"/cats/hello%2Fworld", http.StatusOK, "Layla: hello/world"},
+		{"/found/hello", http.StatusOK, `{"key": "hello"}`},
+		{"/static/hello", http.StatusOK, "static: hello"},
+		{"/cats", http.StatusNotFound, "404 – Page not found."},
+		{"/cats/hello/world", http.StatusNotFound, "404 – Page not found."},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the status code and the body are what we expect.
+		if rr.Code != tt.code || rr.Body.String() != tt.expected {
+			t.Errorf("%s: got %v %q want %v %q",
+				tt.path, rr.Code, rr.Body.String(), tt.code, tt.expected)
+		}
+	}
+}
+
+func TestHandleNilHandler(t *testing.T) {
+	req, err := http.NewRequest("GET", "/found/hello", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := Router{
+		NotFoundHandler: notFound,
+	}
+	handler.Handle("GET", "/found/:key", nil)
+	handler.ServeHTTP(rr, req)
+
+	// Check a nil handler is reported like a nil handler function.
+	if status := rr.Code; status != http.StatusInternalServerError {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			status, http.StatusInternalServerError)
+	}
+}
+
+func TestMethodShortcuts(t *testing.T) {
+	// A handler writing the method and the "key" route parameter.
+	method := func(w http.ResponseWriter, r *http.Request) {
+		key, _ := Var(r, "key")
+
+		io.WriteString(w, r.Method+" "+key)
+	}
+
+	handler := Router{
+		NotFoundHandler: notFound,
+	}
+	handler.Get("/val/:key", method)
+	handler.Post("/val/:key", method)
+	handler.Put("/val/:key", method)
+	handler.Delete("/val/:key", method)
+	handler.Patch("/val/:key", method)
+	handler.Options("/val/:key", method)
+	handler.Head("/val/:key", method)
+	handler.Get("val/", method)
+
+	tests := []struct {
+		method   string
+		path     string
+		code     int
+		expected string
+	}{
+		{"GET", "/val/kitty", http.StatusOK, "GET kitty"},
+		{"POST", "/val/kitty", http.StatusOK, "POST kitty"},
+		{"PUT", "/val/kitty", http.StatusOK, "PUT kitty"},
+		{"DELETE", "/val/kitty", http.StatusOK, "DELETE kitty"},
+		{"PATCH", "/val/kitty", http.StatusOK, "PATCH kitty"},
+		{"OPTIONS", "/val/kitty", http.StatusOK, "OPTIONS kitty"},
+		{"HEAD", "/val/kitty", http.StatusOK, "HEAD kitty"},
+		{"GET", "/val", http.StatusOK, "GET "},
+		{"GETT", "/val/kitty", http.StatusNotFound, "404 – Page not found."},
+		{"POST", "/val", http.StatusNotFound, "404 – Page not found."},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the status code and the body are what we expect.
+		if rr.Code != tt.code || rr.Body.String() != tt.expected {
+			t.Errorf("%s %s: got %v %q want %v %q",
+				tt.method, tt.path, rr.Code, rr.Body.String(), tt.code, tt.expected)
+		}
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		method  string
+		path    string
+		code    int
+		allow   string
+	}{
+		{"disabled", false, "POST", "/val/kitty", http.StatusNotFound, ""},
+		{"one method", true, "POST", "/val/kitty", http.StatusMethodNotAllowed, "GET, PUT"},
+		{"literal route", true, "POST", "/val/keys", http.StatusMethodNotAllowed, "DELETE, GET, PUT"},
+		{"escaped segment", true, "POST", "/val/a%2Fb", http.StatusMethodNotAllowed, "GET, PUT"},
+		{"matched", true, "PUT", "/val/kitty", http.StatusOK, ""},
+		{"unknown path", true, "POST", "/kitty", http.StatusNotFound, ""},
+		{"empty parameter", true, "POST", "/val/", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		handler := Router{
+			NotFoundHandler:        notFound,
+			HandleMethodNotAllowed: tt.enabled,
+		}
+		handler.HandleFunc("GET", "/val/:key", found)
+		handler.HandleFunc("PUT", "/val/:key", found)
+		handler.HandleFunc("GET", "/val/keys", found)
+		handler.HandleFunc("DELETE", "/val/keys", found)
+
+		req, err := http.NewRequest(tt.method, tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the status code and the Allow header are what we expect.
+		if rr.Code != tt.code || rr.Header().Get("Allow") != tt.allow {
+			t.Errorf("%s: got %v %q want %v %q",
+				tt.name, rr.Code, rr.Header().Get("Allow"), tt.code, tt.allow)
+		}
+	}
+}
+
+func TestMethodNotAllowedErrorEncoder(t *testing.T) {
+	req, err := http.NewRequest("DELETE", "/found/hello", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gotCode int
+	rr := httptest.NewRecorder()
+	handler := Router{
+		HandleMethodNotAllowed: true,
+		ErrorEncoder: func(w http.ResponseWriter, r *http.Request, code int, err error) {
+			gotCode = code
+			w.WriteHeader(code)
+			io.WriteString(w, err.Error())
+		},
+	}
+	handler.HandleFunc("GET", "/found/:key", found)
+	handler.ServeHTTP(rr, req)
+
+	// Check the error encoder reports the method.
+	if gotCode != http.StatusMethodNotAllowed {
+		t.Errorf("error encoder got wrong status code: got %v want %v",
+			gotCode, http.StatusMethodNotAllowed)
+	}
+	expected := "mux: method DELETE not allowed for /found/hello"
+	if rr.Body.String() != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v",
+			rr.Body.String(), expected)
+	}
+}
+
+func TestMethodNotAllowedHandler(t *testing.T) {
+	// A handler writing the allowed methods.
+	methodNotAllowed := func(w http.ResponseWriter, r *http.Request) {
+		allowed, ok := AllowedMethods(r)
+		if !ok {
+			t.Errorf("allowed methods not found")
+		}
+
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, strings.Join(allowed, " "))
+	}
+
+	tests := []struct {
+		name     string
+		enabled  bool
+		method   string
+		path     string
+		code     int
+		expected string
+	}{
+		{"disabled", false, "POST", "/val/kitty", http.StatusMethodNotAllowed, "GET PUT"},
+		{"enabled", true, "POST", "/val/kitty", http.StatusMethodNotAllowed, "GET PUT"},
+		{"matched", false, "PUT", "/val/kitty", http.StatusOK, `{"key": "kitty"}`},
+		{"unknown path", false, "POST", "/kitty", http.StatusNotFound, "404 – Page not found."},
+	}
+
+	for _, tt := range tests {
+		handler := Router{
+			NotFoundHandler:         notFound,
+			MethodNotAllowedHandler: methodNotAllowed,
+			HandleMethodNotAllowed:  tt.enabled,
+		}
+		handler.HandleFunc("GET", "/val/:key", found)
+		handler.HandleFunc("PUT", "/val/:key", found)
+
+		req, err := http.NewRequest(tt.method, tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the status code and the body are what we expect.
+		if rr.Code != tt.code || rr.Body.String() != tt.expected {
+			t.Errorf("%s: got %v %q want %v %q",
+				tt.name, rr.Code, rr.Body.String(), tt.code, tt.expected)
+		}
+	}
+}
+
+func TestSetMethodNotAllowedHandler(t *testing.T) {
+	handler := Router{}
+	handler.HandleFunc("GET", "/found", found)
+
+	// Check setting a handler enables it, and setting nil restores the default.
+	handler.SetMethodNotAllowedHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	for _, code := range []int{http.StatusTeapot, http.StatusNotFound} {
+		req, err := http.NewRequest("POST", "/found", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != code {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, code)
+		}
+		if allow := rr.Header().Get("Allow"); code == http.StatusTeapot && allow != "GET" {
+			t.Errorf("handler returned wrong Allow header: got %q want GET", allow)
+		}
+
+		handler.SetMethodNotAllowedHandler(nil)
+	}
+
+	// Check the allowed methods are not set outside the handler.
+	req, _ := http.NewRequest("GET", "/found", nil)
+	if _, ok := AllowedMethods(req); ok {
+		t.Errorf("allowed methods found in a request that was not dispatched")
+	}
+}
+
+func TestAutoOptions(t *testing.T) {
+	// A handler for the explicit OPTIONS route.
+	options := func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "explicit")
+	}
+
+	tests := []struct {
+		name     string
+		enabled  bool
+		method   string
+		path     string
+		code     int
+		allow    string
+		expected string
+	}{
+		{"disabled", false, "OPTIONS", "/val/kitty", http.StatusNotFound, "", "404 – Page not found."},
+		{"enabled", true, "OPTIONS", "/val/kitty", http.StatusNoContent, "DELETE, GET, OPTIONS, PUT", ""},
+		{"explicit route", true, "OPTIONS", "/opts", http.StatusOK, "", "explicit"},
+		{"unknown path", true, "OPTIONS", "/kitty", http.StatusNotFound, "", "404 – Page not found."},
+		{"method not allowed", true, "POST", "/val/kitty", http.StatusMethodNotAllowed, "DELETE, GET, OPTIONS, PUT", "405 – Method Not Allowed."},
+	}
+
+	for _, tt := range tests {
+		handler := Router{
+			NotFoundHandler:        notFound,
+			HandleMethodNotAllowed: tt.enabled,
+			AutoOptions:            tt.enabled,
+		}
+		handler.HandleFunc("GET", "/val/:key", found)
+		handler.HandleFunc("PUT", "/val/:key", found)
+		handler.HandleFunc("DELETE", "/val/:key", found)
+		handler.HandleFunc("GET", "/opts", found)
+		handler.HandleFunc("OPTIONS", "/opts", options)
+
+		req, err := http.NewRequest(tt.method, tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the status code, the Allow header and the body are what we expect.
+		if rr.Code != tt.code || rr.Header().Get("Allow") != tt.allow || rr.Body.String() != tt.expected {
+			t.Errorf("%s: got %v %q %q want %v %q %q", tt.name,
+				rr.Code, rr.Header().Get("Allow"), rr.Body.String(), tt.code, tt.allow, tt.expected)
+		}
+	}
+}
+
+func TestAny(t *testing.T) {
+	// A handler writing the route name.
+	named := func(name string) func(http.ResponseWriter, *http.Request) {
+		return func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}
+	}
+
+	handler := Router{
+		NotFoundHandler:        notFound,
+		HandleMethodNotAllowed: true,
+		AutoOptions:            true,
+		AutoHead:               true,
+	}
+	handler.Get("/val/:key", named("get"))
+	handler.Any("/val/:key", named("any"))
+	handler.Put("/val/:key", named("put"))
+	handler.Get("/proxy/status", named("status"))
+	handler.HandleFunc("*", "/proxy/*rest", named("proxy"))
+	handler.Get("/page", named("page"))
+	handler.Any("/page", named("maintenance")).Header("X-Maintenance", "1")
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		header   string
+		code     int
+		expected string
+	}{
+		{"explicit get", "GET", "/val/kitty", "", http.StatusOK, "get"},
+		{"explicit put after any", "PUT", "/val/kitty", "", http.StatusOK, "put"},
+		{"post", "POST", "/val/kitty", "", http.StatusOK, "any"},
+		{"patch", "PATCH", "/val/kitty", "", http.StatusOK, "any"},
+		{"delete", "DELETE", "/val/kitty", "", http.StatusOK, "any"},
+		{"head before auto head", "HEAD", "/val/kitty", "", http.StatusOK, "any"},
+		{"options before auto options", "OPTIONS", "/val/kitty", "", http.StatusOK, "any"},
+		{"explicit precise route", "GET", "/proxy/status", "", http.StatusOK, "status"},
+		{"wildcard", "POST", "/proxy/status", "", http.StatusOK, "proxy"},
+		{"wildcard deep", "GET", "/proxy/a/b", "", http.StatusOK, "proxy"},
+		{"matcher", "POST", "/page", "1", http.StatusOK, "maintenance"},
+		{"matcher fails", "POST", "/page", "", http.StatusNotFound, "404 – Page not found."},
+		{"explicit route with matcher", "GET", "/page", "1", http.StatusOK, "page"},
+		{"unknown path", "GET", "/kitty", "", http.StatusNotFound, "404 – Page not found."},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.header != "" {
+			req.Header.Set("X-Maintenance", tt.header)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the status code and the body are what we expect, a path of
+		// a route of any method is never answered with 405.
+		if rr.Code != tt.code || rr.Body.String() != tt.expected {
+			t.Errorf("%s: got %v %q want %v %q", tt.name, rr.Code, rr.Body.String(), tt.code, tt.expected)
+		}
+	}
+}
+
+func TestWildcard(t *testing.T) {
+	// A handler writing the route and the "filepath" route parameter.
+	wildcard := func(w http.ResponseWriter, r *http.Request) {
+		route, _ := CurrentRoute(r)
+		filepath, _ := Var(r, "filepath")
+
+		io.WriteString(w, route+" "+filepath)
+	}
+
+	handler := Router{
+		NotFoundHandler: notFound,
+	}
+	handler.HandleFunc("GET", "/static/*filepath", wildcard)
+	handler.HandleFunc("GET", "/static/:filepath", wildcard)
+	handler.HandleFunc("GET", "/static/css/site.css", wildcard)
+
+	tests := []struct {
+		path     string
+		code     int
+		expected string
+	}{
+		{"/static/css/site.css", http.StatusOK, "/static/css/site.css "},
+		{"/static/css/main.css", http.StatusOK, "/static/*filepath css/main.css"},
+		{"/static/site.css", http.StatusOK, "/static/:filepath site.css"},
+		{"/static/a/b/c/", http.StatusOK, "/static/*filepath a/b/c"},
+		{"/static/a%2Fb/c%20d", http.StatusOK, "/static/*filepath a/b/c d"},
+		{"/static/a//b", http.StatusOK, "/static/*filepath a//b"},
+		{"/static", http.StatusNotFound, "404 – Page not found."},
+		{"/static/", http.StatusNotFound, "404 – Page not found."},
+		{"/static//", http.StatusNotFound, "404 – Page not found."},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the status code and the body are what we expect.
+		if rr.Code != tt.code || rr.Body.String() != tt.expected {
+			t.Errorf("%s: got %v %q want %v %q", tt.path, rr.Code, rr.Body.String(), tt.code, tt.expected)
+		}
+	}
+}
+
+func TestWildcardNotLast(t *testing.T) {
+	defer func() {
+		// Check registering a wildcard that is not the last segment panics,
+		// with an invalid route error.
+		err, _ := recover().(error)
+		if !errors.Is(err, ErrInvalidRoute) {
+			t.Errorf("registering a wildcard that is not the last segment did not panic with %v: %v", ErrInvalidRoute, err)
+		}
+	}()
+
+	handler := Router{}
+	handler.HandleFunc("GET", "/static/*filepath/info", found)
+}
+
+func TestConstraints(t *testing.T) {
+	// A handler writing the route and the "id" route parameter.
+	constrained := func(w http.ResponseWriter, r *http.Request) {
+		route, _ := CurrentRoute(r)
+		id, _ := Var(r, "id")
+
+		io.WriteString(w, route+" "+id)
+	}
+
+	handler := Router{
+		NotFoundHandler:        notFound,
+		HandleMethodNotAllowed: true,
+	}
+	handler.HandleFunc("GET", "/val/:id([0-9]+)", constrained)
+	handler.HandleFunc("GET", "/val/:id", constrained)
+	handler.HandleFunc("PUT", "/num/:id([0-9]+|x)/info", constrained)
+
+	tests := []struct {
+		method   string
+		path     string
+		code     int
+		expected string
+	}{
+		{"GET", "/val/42", http.StatusOK, "/val/:id([0-9]+) 42"},
+		{"GET", "/val/kitty", http.StatusOK, "/val/:id kitty"},
+		{"GET", "/val/42a", http.StatusOK, "/val/:id 42a"},
+		{"PUT", "/num/7/info", http.StatusOK, "/num/:id([0-9]+|x)/info 7"},
+		{"PUT", "/num/x/info", http.StatusOK, "/num/:id([0-9]+|x)/info x"},
+		{"PUT", "/num/7x/info", http.StatusNotFound, "404 – Page not found."},
+		{"GET", "/num/7/info", http.StatusMethodNotAllowed, "405 – Method Not Allowed."},
+		{"GET", "/num/kitty/info", http.StatusNotFound, "404 – Page not found."},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the status code and the body are what we expect.
+		if rr.Code != tt.code || rr.Body.String() != tt.expected {
+			t.Errorf("%s %s: got %v %q want %v %q",
+				tt.method, tt.path, rr.Code, rr.Body.String(), tt.code, tt.expected)
+		}
+	}
+}
+
+func TestInvalidConstraint(t *testing.T) {
+	defer func() {
+		// Check registering an invalid constraint panics.
+		if recovered := recover(); recovered == nil {
+			t.Errorf("registering an invalid constraint did not panic")
+		}
+	}()
+
+	handler := Router{}
+	handler.HandleFunc("GET", "/val/:id(+)", found)
+}
+
+func TestSplitConstraint(t *testing.T) {
+	tests := []struct {
+		segment string
+		name    string
+		expr    string
+		ok      bool
+	}{
+		{":id([0-9]+)", "id", "[0-9]+", true},
+		{":id(a(b)c)", "id", "a(b)c", true},
+		{":id()", "id", "", true},
+		{":id", "", "", false},
+		{":id([0-9]+", "", "", false},
+		{"id([0-9]+)", "", "", false},
+		{":id)", "", "", false},
+	}
+
+	for _, tt := range tests {
+		// Check the name and the expression are what we expect.
+		name, expr, ok := splitConstraint(tt.segment)
+		if name != tt.name || expr != tt.expr || ok != tt.ok {
+			t.Errorf("%s: got %q %q %v want %q %q %v", tt.segment, name, expr, ok, tt.name, tt.expr, tt.ok)
+		}
+	}
+}
+
+func TestOptionalParameter(t *testing.T) {
+	// A handler writing the route and the "key" route parameter, if found.
+	optional := func(w http.ResponseWriter, r *http.Request) {
+		route, _ := CurrentRoute(r)
+		key, ok := Var(r, "key")
+
+		io.WriteString(w, fmt.Sprintf("%s %s %v", route, key, ok))
+	}
+
+	handler := Router{
+		NotFoundHandler: notFound,
+	}
+	handler.HandleFunc("GET", "/val/:key?", optional)
+	handler.HandleFunc("GET", "/val/keys", optional)
+	handler.HandleFunc("GET", "/num/:key([0-9]+)?", optional)
+	handler.HandleFunc("GET", "/:key?", optional)
+
+	tests := []struct {
+		path     string
+		code     int
+		expected string
+	}{
+		{"/val/kitty", http.StatusOK, "/val/:key? kitty true"},
+		{"/val", http.StatusOK, "/val/:key?  false"},
+		{"/val/", http.StatusOK, "/val/:key?  false"},
+		{"/val/keys", http.StatusOK, "/val/keys  false"},
+		{"/val/a%2Fb", http.StatusOK, "/val/:key? a/b true"},
+		{"/val//", http.StatusNotFound, "404 – Page not found."},
+		{"/val/kitty/info", http.StatusNotFound, "404 – Page not found."},
+		{"/num/42", http.StatusOK, "/num/:key([0-9]+)? 42 true"},
+		{"/num", http.StatusOK, "/num/:key([0-9]+)?  false"},
+		{"/num/kitty", http.StatusNotFound, "404 – Page not found."},
+		{"/", http.StatusOK, "/:key?  false"},
+		{"/kitty", http.StatusOK, "/:key? kitty true"},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the status code and the body are what we expect.
+		if rr.Code != tt.code || rr.Body.String() != tt.expected {
+			t.Errorf("%s: got %v %q want %v %q", tt.path, rr.Code, rr.Body.String(), tt.code, tt.expected)
+		}
+	}
+}
+
+func TestOptionalParameterNotLast(t *testing.T) {
+	defer func() {
+		// Check registering an optional parameter that is not the last segment panics.
+		if recovered := recover(); recovered == nil {
+			t.Errorf("registering an optional parameter that is not the last segment did not panic")
+		}
+	}()
+
+	handler := Router{}
+	handler.HandleFunc("GET", "/val/:key?/info", found)
+}
+
+// tag returns a middleware appending name to the X-Chain header, and
+// the "key" route parameter to the X-Key header.
+func tag(name string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key, _ := Var(r, "key")
+			w.Header().Add("X-Chain", name)
+			w.Header().Add("X-Key", key)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func TestUse(t *testing.T) {
+	handler := Router{
+		NotFoundHandler:         notFound,
+		MethodNotAllowedHandler: notFound,
+	}
+	handler.Use(tag("first"), tag("second"))
+	handler.HandleFunc("GET", "/found/:key", found)
+	handler.Use(tag("third"))
+
+	tests := []struct {
+		method string
+		path   string
+		code   int
+		key    string
+	}{
+		{"GET", "/found/hello", http.StatusOK, "hello"},
+		{"GET", "/kitty", http.StatusNotFound, ""},
+		{"POST", "/found/hello", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check the middleware ran in the order added, and saw the route variables.
+		if rr.Code != tt.code {
+			t.Errorf("%s %s: wrong status code: got %v want %v", tt.method, tt.path, rr.Code, tt.code)
+		}
+		if chain := strings.Join(rr.Header()["X-Chain"], " "); chain != "first second third" {
+			t.Errorf("%s %s: wrong chain: got %q", tt.method, tt.path, chain)
+		}
+		if keys := rr.Header()["X-Key"]; len(keys) != 3 || keys[0] != tt.key {
+			t.Errorf("%s %s: wrong keys: got %q want %q", tt.method, tt.path, keys, tt.key)
+		}
+	}
+}
+
+func TestUseDefaultNotFound(t *testing.T) {
+	req, err := http.NewRequest("GET", "/not-found", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	rr := httptest.NewRecorder()
+	handler := Router{}
+	handler.Use(func(next http.Handler) http.Handler {
+		calls++
+		return next
+	})
+	handler.Use(tag("outer"))
+	handler.ServeHTTP(rr, req)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Check the default not found handler is wrapped.
+	if rr.Code != http.StatusNotFound || rr.Header().Get("X-Chain") != "outer" {
+		t.Errorf("got %v %q want %v %q", rr.Code, rr.Header().Get("X-Chain"), http.StatusNotFound, "outer")
+	}
+
+	// Check the middleware is not called for each request.
+	if calls != 2 {
+		t.Errorf("middleware called %d times, want once per Use", calls)
+	}
+}
+
+func TestUseReplacedContext(t *testing.T) {
+	req, err := http.NewRequest("GET", "/found", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := Router{}
+	handler.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.Background()))
+		})
+	})
+	handler.HandleFunc("GET", "/found", found)
+	handler.ServeHTTP(rr, req)
+
+	// Check a middleware dropping the request context is reported.
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			rr.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestRouteMiddleware(t *testing.T) {
+	handler := Router{
+		NotFoundHandler: notFound,
+	}
+	handler.Use(tag("global"))
+	handler.HandleFunc("GET", "/found/:key", found, tag("first"), tag("second"))
+	handler.Handle("PUT", "/found/:key", http.HandlerFunc(found), tag("put"))
+	handler.Get("/other/:key", found)
+	handler.PathPrefix("/sub").Post("/:key", found, tag("sub"))
+
+	tests := []struct {
+		method string
+		path   string
+		code   int
+		chain  string
+	}{
+		{"GET", "/found/hello", http.StatusOK, "global first second"},
+		{"PUT", "/found/hello", http.StatusOK, "global put"},
+		{"GET", "/other/hello", http.StatusOK, "global"},
+		{"POST", "/sub/hello", http.StatusOK, "global sub"},
+		{"GET", "/kitty", http.StatusNotFound, "global"},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		// Check only the route middleware ran, inside the global middleware.
+		if rr.Code != tt.code {
+			t.Errorf("%s %s: wrong status code: got %v want %v", tt.method, tt.path, rr.Code, tt.code)
+		}
+		if chain := strings.Join(rr.Header()["X-Chain"], " "); chain != tt.chain {
+			t.Errorf("%s %s: wrong chain: got %q want %q", tt.method, tt.path, chain, tt.chain)
+		}
+	}
+}
+
+func TestRouteMiddlewareNilHandler(t *testing.T) {
+	req, err := http.NewRequest("GET", "/found/hello", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := Router{}
+	handler.HandleFunc("GET", "/found/:key", nil, tag("first"))
+	handler.ServeHTTP(rr, req)
+
+	// Check a nil handler is reported, and not wrapped.
+	if rr.Code != http.StatusInternalServerError || rr.Header().Get("X-Chain") != "" {
+		t.Errorf("got %v %q want %v", rr.Code, rr.Header().Get("X-Chain"), http.StatusInternalServerError)
+	}
+}
+
+func TestHandleFuncE(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		handler func(http.ResponseWriter, *http.Request)
+		err     error
+	}{
+		{"valid", "GET", "/val/:key", found, nil},
+		{"same path other method", "PUT", "/val/:key", found, nil},
+		{"empty path", "GET", "", found, ErrEmptyPath},
+		{"nil handler", "GET", "/nil", nil, ErrNilHandler},
+		{"empty segment", "GET", "/val//key", found, ErrInvalidRoute},
+		{"empty first segment", "GET", "//val", found, ErrInvalidRoute},
+		{"wildcard not last", "GET", "/static/*filepath/info", found, ErrInvalidRoute},
+		{"optional not last", "GET", "/val/:key?/info", found, ErrInvalidRoute},
+		{"invalid constraint", "GET", "/val/:id(+)", found, ErrInvalidRoute},
+		{"duplicate", "GET", "/val/:key", found, ErrDuplicateRoute},
+		{"duplicate trailing slash", "GET", "val/:key/", found, ErrDuplicateRoute},
+	}
+
+	handler := Router{}
+	for _, tt := range tests {
+		// Check the error is what we expect.
+		_, err := handler.HandleFuncE(tt.method, tt.path, tt.handler)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: got %v want %v", tt.name, err, tt.err)
+		}
+	}
+
+	// Check only the valid routes are registered.
+	if routes := handler.Routes(); len(routes) != 2 {
+		t.Errorf("wrong routes: got %v", routes)
+	}
+}
+
+func TestMustHandleFunc(t *testing.T) {
+	handler := Router{}
+	handler.MustHandleFunc("GET", "/val/:key", found)
+	handler.PathPrefix("/api").MustHandle("GET", "/val/:key", http.HandlerFunc(found))
+
+	defer func() {
+		// Check registering a duplicate route panics with the error.
+		recovered := recover()
+		if err, ok := recovered.(error); !ok || !errors.Is(err, ErrDuplicateRoute) {
+			t.Errorf("unexpected panic: %v", recovered)
+		}
+	}()
+
+	handler.MustHandleFunc("GET", "/api/val/:key", found)
+}
@@ -0,0 +1,112 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mux
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"runtime"
+)
+
+// RouteInfo describes a registered route.
+type RouteInfo struct {
+	// Method of the route, e.g. "GET".
+	Method string
+
+	// Pattern of the route, as registered, with its route parameters,
+	// constraints and wildcard, e.g. "/val/:key" or "/static/*filepath",
+	// without a trailing "/".
+	Pattern string
+
+	// Handler is the name of the registered handler, the function name of
+	// handler functions, e.g. "main.getVal", o/w the type of the handler,
+	// e.g. "*http.fileHandler", empty if the handler is nil.
+	Handler string
+
+	// Name and metadata of the route, set using its Route, Meta is a copy,
+	// nil if the route has no metadata.
+	Name string
+	Meta map[string]string
+}
+
+// Routes returns the registered routes, in registration order.
+//
+// The returned slice is a copy, modifying it does not modify the routes of
+// the router.
+func (r *Router) Routes() []RouteInfo {
+	routes := make([]RouteInfo, 0, len(r.routes))
+	for _, route := range r.routes {
+		routes = append(routes, route.info())
+	}
+
+	return routes
+}
+
+// Walk calls fn for each registered route, in registration order, if fn
+// returns an error, Walk stops and returns it.
+func (r *Router) Walk(fn func(RouteInfo) error) error {
+	for _, route := range r.routes {
+		if err := fn(route.info()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// HasNotFoundHandler returns true if a not found handler is defined, using
+// the NotFoundHandler or NotFound fields, or SetNotFoundHandler, o/w the default "404"
+// handler is used.
+func (r *Router) HasNotFoundHandler() bool {
+	return r.notFound() != nil
+}
+
+// info returns the description of a route.
+func (route *route) info() RouteInfo {
+	var meta map[string]string
+	if route.meta != nil {
+		meta = make(map[string]string, len(route.meta))
+		for k, v := range route.meta {
+			meta[k] = v
+		}
+	}
+
+	return RouteInfo{
+		Method:  route.method,
+		Pattern: route.pattern,
+		Handler: route.handlerName,
+		Name:    route.name,
+		Meta:    meta,
+	}
+}
+
+// handlerName returns the name of a handler, for handler functions it is the
+// function name, o/w it is the handler type.
+func handlerName(handler http.Handler) string {
+	if handler == nil {
+		return ""
+	}
+
+	v := reflect.ValueOf(handler)
+	if v.Kind() == reflect.Func {
+		if fn := runtime.FuncForPC(v.Pointer()); fn != nil {
+			return fn.Name()
+		}
+	}
+
+	return fmt.Sprintf("%T", handler)
+}
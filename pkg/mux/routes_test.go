@@ -0,0 +1,102 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mux
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestRoutes(t *testing.T) {
+	router := Router{}
+	router.HandleFunc("GET", "/val/:key/", found, tag("first"))
+	router.Handle("GET", "static/*filepath", catHandler{name: "static"})
+	router.PathPrefix("/num").Put("/:id([0-9]+)", func(w http.ResponseWriter, r *http.Request) {})
+	router.HandleFunc("DELETE", "/nil", nil)
+
+	expected := []RouteInfo{
+		{Method: "GET", Pattern: "/val/:key", Handler: "github.com/yaacov/gokitty/pkg/mux.found"},
+		{Method: "GET", Pattern: "/static/*filepath", Handler: "mux.catHandler"},
+		{Method: "PUT", Pattern: "/num/:id([0-9]+)", Handler: "github.com/yaacov/gokitty/pkg/mux.TestRoutes.func1"},
+		{Method: "DELETE", Pattern: "/nil"},
+	}
+
+	// Check the routes are what we expect.
+	routes := router.Routes()
+	if len(routes) != len(expected) {
+		t.Fatalf("wrong number of routes: got %v want %v", routes, expected)
+	}
+	for i, route := range routes {
+		if !reflect.DeepEqual(route, expected[i]) {
+			t.Errorf("route %d: got %+v want %+v", i, route, expected[i])
+		}
+	}
+
+	// Check modifying the routes does not modify the router.
+	routes[0].Pattern = "/kitty"
+	if got := router.Routes()[0].Pattern; got != "/val/:key" {
+		t.Errorf("routes of the router were modified: got %s", got)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	router := Router{}
+	router.HandleFunc("GET", "/a", found)
+	router.HandleFunc("GET", "/b", found)
+	router.HandleFunc("GET", "/c", found)
+
+	// Check routes are visited in registration order, until an error.
+	var visited []string
+	errStop := errors.New("stop")
+	err := router.Walk(func(route RouteInfo) error {
+		visited = append(visited, route.Pattern)
+		if route.Pattern == "/b" {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop || len(visited) != 2 || visited[0] != "/a" || visited[1] != "/b" {
+		t.Errorf("got %v, %v want [/a /b], %v", visited, err, errStop)
+	}
+
+	// Check all routes are visited.
+	visited = nil
+	if err := router.Walk(func(route RouteInfo) error {
+		visited = append(visited, route.Pattern)
+		return nil
+	}); err != nil || len(visited) != 3 {
+		t.Errorf("got %v, %v want 3 routes", visited, err)
+	}
+}
+
+func TestHasNotFoundHandler(t *testing.T) {
+	router := Router{}
+	if router.HasNotFoundHandler() {
+		t.Errorf("default router has a not found handler")
+	}
+
+	// Check the field and the setter are reported.
+	router.NotFoundHandler = notFound
+	if !router.HasNotFoundHandler() {
+		t.Errorf("not found handler field is not reported")
+	}
+	router.SetNotFoundHandler(nil)
+	if router.HasNotFoundHandler() {
+		t.Errorf("not found handler set to nil is reported")
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mux
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Schemes adds a matcher of the request scheme, the route matches only
+// requests with one of the schemes, e.g. "https".
+//
+// The scheme of a request is "https" for TLS requests, and "http" for
+// others, if the router TrustForwardedProto is set, the X-Forwarded-Proto
+// header of a request overrides it. A request that does not match is matched
+// with the next routes, or redirected if the router RedirectSchemes is set.
+func (rt *Route) Schemes(schemes ...string) *Route {
+	for _, scheme := range schemes {
+		rt.route.schemes = append(rt.route.schemes, strings.ToLower(scheme))
+	}
+
+	return rt
+}
+
+// scheme returns the scheme of a request, "https" or "http", or the scheme
+// in its X-Forwarded-Proto header if the router trusts it.
+func (r *Router) scheme(req *http.Request) string {
+	if r.TrustForwardedProto {
+		// A proxy chain can append schemes, the first is of the client.
+		proto, _, _ := strings.Cut(req.Header.Get("X-Forwarded-Proto"), ",")
+		if proto = strings.TrimSpace(proto); proto != "" {
+			return strings.ToLower(proto)
+		}
+	}
+
+	if req.TLS != nil {
+		return "https"
+	}
+
+	return "http"
+}
+
+// matchScheme returns true if the route has no schemes, or if the scheme of
+// the request is one of them.
+func (r *Router) matchScheme(route *route, req *http.Request) bool {
+	if len(route.schemes) == 0 {
+		return true
+	}
+
+	scheme := r.scheme(req)
+	for _, s := range route.schemes {
+		if s == scheme {
+			return true
+		}
+	}
+
+	return false
+}
+
+// redirectScheme redirects a request matching a route except for its
+// schemes to the first scheme of the route, it returns false if no route
+// matches.
+func (r *Router) redirectScheme(w http.ResponseWriter, req *http.Request, segments []string) bool {
+	for _, route := range r.routes {
+		if len(route.schemes) == 0 {
+			continue
+		}
+		found, _ := r.match(route, req.Method, segments)
+		if !found {
+			found, _ = r.match(route, MethodAny, segments)
+		}
+		if !found || !route.matchRequest(req) {
+			continue
+		}
+
+		url := route.schemes[0] + "://" + req.Host + req.URL.RequestURI()
+		http.Redirect(w, req, url, http.StatusPermanentRedirect)
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,131 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mux
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// schemeRouter returns a router with an https only token route, and
+// a route for both schemes.
+func schemeRouter(redirect bool) *Router {
+	router := &Router{
+		NotFoundHandler: notFound,
+		RedirectSchemes: redirect,
+	}
+	router.Post("/token", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "token")
+	}).Schemes("HTTPS")
+	router.Get("/val/:key", found).Schemes("http", "https")
+
+	return router
+}
+
+func TestSchemes(t *testing.T) {
+	tests := []struct {
+		name     string
+		tls      bool
+		redirect bool
+		method   string
+		path     string
+		code     int
+		moved    bool
+	}{
+		{"https", true, false, "POST", "/token", http.StatusOK, false},
+		{"http", false, false, "POST", "/token", http.StatusNotFound, false},
+		{"http redirect", false, true, "POST", "/token?a=1", http.StatusPermanentRedirect, true},
+		{"both schemes", false, true, "GET", "/val/kitty", http.StatusOK, false},
+		{"both schemes tls", true, true, "GET", "/val/kitty", http.StatusOK, false},
+		{"no route", false, true, "GET", "/token", http.StatusNotFound, false},
+	}
+
+	for _, tt := range tests {
+		var server *httptest.Server
+		if tt.tls {
+			server = httptest.NewTLSServer(schemeRouter(tt.redirect))
+		} else {
+			server = httptest.NewServer(schemeRouter(tt.redirect))
+		}
+
+		// Use the server client, that trusts its certificate, without
+		// following redirects.
+		client := server.Client()
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+
+		req, err := http.NewRequest(tt.method, server.URL+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		server.Close()
+
+		// Check the status code and the redirect location are what we expect.
+		if resp.StatusCode != tt.code {
+			t.Errorf("%s: wrong status code: got %v want %v", tt.name, resp.StatusCode, tt.code)
+		}
+		if tt.moved {
+			expected := "https://" + req.URL.Host + tt.path
+			if location := resp.Header.Get("Location"); location != expected {
+				t.Errorf("%s: wrong location: got %q want %q", tt.name, location, expected)
+			}
+		}
+	}
+}
+
+func TestSchemesForwardedProto(t *testing.T) {
+	tests := []struct {
+		name  string
+		trust bool
+		proto string
+		code  int
+	}{
+		{"trusted https", true, "https", http.StatusOK},
+		{"trusted proxy chain", true, "HTTPS, http", http.StatusOK},
+		{"trusted http", true, "http", http.StatusNotFound},
+		{"trusted no header", true, "", http.StatusNotFound},
+		{"untrusted https", false, "https", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		router := schemeRouter(false)
+		router.TrustForwardedProto = tt.trust
+
+		req, err := http.NewRequest("POST", "/token", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.proto != "" {
+			req.Header.Set("X-Forwarded-Proto", tt.proto)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		// Check the status code is what we expect.
+		if rr.Code != tt.code {
+			t.Errorf("%s: wrong status code: got %v want %v", tt.name, rr.Code, tt.code)
+		}
+	}
+}
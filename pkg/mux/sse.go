@@ -0,0 +1,185 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mux
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSSEHeartbeat is the default interval of server-sent events
+// heartbeat comments.
+const DefaultSSEHeartbeat = 15 * time.Second
+
+// ErrStreamingUnsupported is written when a response writer can't flush.
+var ErrStreamingUnsupported = errors.New("mux: response writer does not implement http.Flusher")
+
+// errStreamClosed is returned by send after the handler returns.
+var errStreamClosed = errors.New("mux: event stream closed")
+
+// SSEFunc streams events calling send, until ctx is done or it returns.
+//
+// After the client disconnects, ctx is done and send returns an error,
+// an SSEFunc must return when ctx is done.
+type SSEFunc func(ctx context.Context, send func(event, data string) error)
+
+// SSE returns a handler streaming server-sent events, sending heartbeat
+// comments every DefaultSSEHeartbeat.
+//
+// Example:
+//
+//	router.HandleFunc("GET", "/events", mux.SSE(func(ctx context.Context, send func(event, data string) error) {
+//	    for {
+//	        select {
+//	        case <-ctx.Done():
+//	            return
+//	        case v := <-changes:
+//	            if err := send("change", v); err != nil {
+//	                return
+//	            }
+//	        }
+//	    }
+//	}))
+func SSE(stream SSEFunc) func(http.ResponseWriter, *http.Request) {
+	return SSEWithHeartbeat(DefaultSSEHeartbeat, stream)
+}
+
+// SSEWithHeartbeat returns a handler streaming server-sent events, sending
+// heartbeat comments every interval, a zero interval disables heartbeats.
+//
+// The handler sets the event stream headers, flushes after every event, and
+// returns when stream returns. If the response writer can't flush, the
+// handler writes a 500 without calling stream.
+func SSEWithHeartbeat(interval time.Duration, stream SSEFunc) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !canFlush(w) {
+			http.Error(w, ErrStreamingUnsupported.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rc := http.NewResponseController(w)
+		h := w.Header()
+		h.Set("Content-Type", "text/event-stream")
+		h.Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		rc.Flush()
+
+		ctx, cancel := context.WithCancel(r.Context())
+		s := &sseWriter{w: w, rc: rc, ctx: ctx}
+		defer s.close()
+		defer cancel()
+
+		if interval > 0 {
+			go s.heartbeat(interval)
+		}
+
+		stream(ctx, s.send)
+	}
+}
+
+// sseWriter serializes events and heartbeats written to a response.
+type sseWriter struct {
+	w   http.ResponseWriter
+	rc  *http.ResponseController
+	ctx context.Context
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// send writes one event, and flushes it.
+func (s *sseWriter) send(event, data string) error {
+	if strings.ContainsAny(event, "\r\n") {
+		return fmt.Errorf("mux: invalid event name %q", event)
+	}
+
+	var b strings.Builder
+	if event != "" {
+		b.WriteString("event: " + event + "\n")
+	}
+	for _, line := range strings.Split(data, "\n") {
+		b.WriteString("data: " + strings.TrimSuffix(line, "\r") + "\n")
+	}
+	b.WriteString("\n")
+
+	return s.write(b.String())
+}
+
+// heartbeat writes a comment every interval, until the stream is closed.
+func (s *sseWriter) heartbeat(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			if s.write(":\n\n") != nil {
+				return
+			}
+		}
+	}
+}
+
+// write writes and flushes a message, failing after the client disconnects
+// or the handler returns.
+func (s *sseWriter) write(msg string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return errStreamClosed
+	}
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+
+	if _, err := s.w.Write([]byte(msg)); err != nil {
+		return err
+	}
+
+	return s.rc.Flush()
+}
+
+// close stops writes, the response writer must not be used after the
+// handler returns.
+func (s *sseWriter) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+}
+
+// canFlush checks if a response writer, or a writer it wraps, implements
+// http.Flusher.
+func canFlush(w http.ResponseWriter) bool {
+	for {
+		switch t := w.(type) {
+		case http.Flusher:
+			return true
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = t.Unwrap()
+		default:
+			return false
+		}
+	}
+}
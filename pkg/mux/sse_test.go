@@ -0,0 +1,174 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mux
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// plainWriter is a response writer that can't flush.
+type plainWriter struct {
+	header http.Header
+	code   int
+	body   strings.Builder
+}
+
+func (w *plainWriter) Header() http.Header         { return w.header }
+func (w *plainWriter) WriteHeader(code int)        { w.code = code }
+func (w *plainWriter) Write(b []byte) (int, error) { return w.body.Write(b) }
+
+func TestSSE(t *testing.T) {
+	router := Router{}
+	router.HandleFunc("GET", "/events", SSE(func(ctx context.Context, send func(event, data string) error) {
+		send("change", "kitty")
+		send("", "line 1\nline 2")
+	}))
+
+	server := httptest.NewServer(&router)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// Check the event stream headers are what we expect.
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("wrong Content-Type: got %q want text/event-stream", ct)
+	}
+	if cc := resp.Header.Get("Cache-Control"); cc != "no-cache" {
+		t.Errorf("wrong Cache-Control: got %q want no-cache", cc)
+	}
+
+	// Check the response body is what we expect.
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "event: change\ndata: kitty\n\ndata: line 1\ndata: line 2\n\n"
+	if string(body) != expected {
+		t.Errorf("handler returned unexpected body: got %q want %q", body, expected)
+	}
+}
+
+func TestSSEInvalidEvent(t *testing.T) {
+	var sendErr error
+	handler := SSE(func(ctx context.Context, send func(event, data string) error) {
+		sendErr = send("bad\nevent", "kitty")
+	})
+	handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/events", nil))
+
+	if sendErr == nil {
+		t.Errorf("expected an error sending an event name with a newline")
+	}
+}
+
+func TestSSEFlushUnsupported(t *testing.T) {
+	called := false
+	handler := SSE(func(ctx context.Context, send func(event, data string) error) {
+		called = true
+	})
+
+	w := &plainWriter{header: make(http.Header)}
+	handler(w, httptest.NewRequest("GET", "/events", nil))
+
+	// Check the handler failed without streaming.
+	if w.code != http.StatusInternalServerError {
+		t.Errorf("handler returned wrong status code: got %v want %v",
+			w.code, http.StatusInternalServerError)
+	}
+	if !strings.Contains(w.body.String(), ErrStreamingUnsupported.Error()) {
+		t.Errorf("handler returned unexpected body: %q", w.body.String())
+	}
+	if called {
+		t.Errorf("stream called for a writer that can't flush")
+	}
+}
+
+func TestSSEHeartbeat(t *testing.T) {
+	handler := SSEWithHeartbeat(5*time.Millisecond, func(ctx context.Context, send func(event, data string) error) {
+		select {
+		case <-ctx.Done():
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// Check heartbeat comments were sent.
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(body), ":\n\n") {
+		t.Errorf("expected heartbeat comments, got %q", body)
+	}
+}
+
+func TestSSEClientDisconnect(t *testing.T) {
+	sendErr := make(chan error, 1)
+	handler := SSE(func(ctx context.Context, send func(event, data string) error) {
+		send("ready", "")
+		<-ctx.Done()
+		sendErr <- send("late", "kitty")
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the first event, then disconnect.
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || line != "event: ready\n" {
+		t.Fatalf("unexpected first line: %q, %v", line, err)
+	}
+	cancel()
+	resp.Body.Close()
+
+	// Check the stream returned, and send failed after the disconnect.
+	select {
+	case err := <-sendErr:
+		if err == nil {
+			t.Errorf("expected send to fail after the client disconnected")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("stream did not return after the client disconnected")
+	}
+}
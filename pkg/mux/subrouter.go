@@ -0,0 +1,153 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mux
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Subrouter registers routes under a path prefix on a Router.
+//
+// A Subrouter has no routes or handlers of its own, its routes are
+// registered on the parent router with the prefix joined to their path,
+// so they are matched, and not found, like any other route of the router.
+// The route path "/" is the prefix itself, and an empty path is rejected
+// like an empty path of the router:
+//
+//	api := router.PathPrefix("/api/v1")
+//	api.HandleFunc("GET", "/val/:key", getValHandler)
+//
+//	tenant := api.PathPrefix("/tenants/:tenant")
+//	tenant.HandleFunc("GET", "/val/:key", getTenantValHandler)
+type Subrouter struct {
+	router *Router
+	prefix string
+}
+
+// PathPrefix returns a Subrouter registering routes under prefix, that can
+// have route parameters, retrieved calling mux.Var(request, key) like the
+// parameters of the route path.
+func (r *Router) PathPrefix(prefix string) *Subrouter {
+	return &Subrouter{router: r, prefix: joinPath("", prefix)}
+}
+
+// PathPrefix returns a Subrouter registering routes under prefix, joined to
+// the prefix of s.
+func (s *Subrouter) PathPrefix(prefix string) *Subrouter {
+	return &Subrouter{router: s.router, prefix: joinPath(s.prefix, prefix)}
+}
+
+// HandleFunc registers a new route on the router, with the path joined to
+// the prefix, like Router.HandleFunc.
+func (s *Subrouter) HandleFunc(method string, path string, handler func(http.ResponseWriter, *http.Request), middleware ...func(http.Handler) http.Handler) *Route {
+	return s.router.HandleFunc(method, s.join(path), handler, middleware...)
+}
+
+// Handle registers a new route on the router, with the path joined to
+// the prefix, like Router.Handle.
+func (s *Subrouter) Handle(method string, path string, handler http.Handler, middleware ...func(http.Handler) http.Handler) *Route {
+	return s.router.Handle(method, s.join(path), handler, middleware...)
+}
+
+// HandleFuncE registers a new route on the router, with the path joined to
+// the prefix, like Router.HandleFuncE.
+func (s *Subrouter) HandleFuncE(method string, path string, handler func(http.ResponseWriter, *http.Request), middleware ...func(http.Handler) http.Handler) (*Route, error) {
+	return s.router.HandleFuncE(method, s.join(path), handler, middleware...)
+}
+
+// HandleE registers a new route on the router, with the path joined to
+// the prefix, like Router.HandleE.
+func (s *Subrouter) HandleE(method string, path string, handler http.Handler, middleware ...func(http.Handler) http.Handler) (*Route, error) {
+	return s.router.HandleE(method, s.join(path), handler, middleware...)
+}
+
+// MustHandleFunc registers a new route on the router, with the path joined
+// to the prefix, like Router.MustHandleFunc.
+func (s *Subrouter) MustHandleFunc(method string, path string, handler func(http.ResponseWriter, *http.Request), middleware ...func(http.Handler) http.Handler) *Route {
+	return s.router.MustHandleFunc(method, s.join(path), handler, middleware...)
+}
+
+// MustHandle registers a new route on the router, with the path joined to
+// the prefix, like Router.MustHandle.
+func (s *Subrouter) MustHandle(method string, path string, handler http.Handler, middleware ...func(http.Handler) http.Handler) *Route {
+	return s.router.MustHandle(method, s.join(path), handler, middleware...)
+}
+
+// Get registers a new route for GET requests, like HandleFunc.
+func (s *Subrouter) Get(path string, handler func(http.ResponseWriter, *http.Request), middleware ...func(http.Handler) http.Handler) *Route {
+	return s.HandleFunc(http.MethodGet, path, handler, middleware...)
+}
+
+// Post registers a new route for POST requests, like HandleFunc.
+func (s *Subrouter) Post(path string, handler func(http.ResponseWriter, *http.Request), middleware ...func(http.Handler) http.Handler) *Route {
+	return s.HandleFunc(http.MethodPost, path, handler, middleware...)
+}
+
+// Put registers a new route for PUT requests, like HandleFunc.
+func (s *Subrouter) Put(path string, handler func(http.ResponseWriter, *http.Request), middleware ...func(http.Handler) http.Handler) *Route {
+	return s.HandleFunc(http.MethodPut, path, handler, middleware...)
+}
+
+// Delete registers a new route for DELETE requests, like HandleFunc.
+func (s *Subrouter) Delete(path string, handler func(http.ResponseWriter, *http.Request), middleware ...func(http.Handler) http.Handler) *Route {
+	return s.HandleFunc(http.MethodDelete, path, handler, middleware...)
+}
+
+// Patch registers a new route for PATCH requests, like HandleFunc.
+func (s *Subrouter) Patch(path string, handler func(http.ResponseWriter, *http.Request), middleware ...func(http.Handler) http.Handler) *Route {
+	return s.HandleFunc(http.MethodPatch, path, handler, middleware...)
+}
+
+// Options registers a new route for OPTIONS requests, like HandleFunc.
+func (s *Subrouter) Options(path string, handler func(http.ResponseWriter, *http.Request), middleware ...func(http.Handler) http.Handler) *Route {
+	return s.HandleFunc(http.MethodOptions, path, handler, middleware...)
+}
+
+// Head registers a new route for HEAD requests, like HandleFunc.
+func (s *Subrouter) Head(path string, handler func(http.ResponseWriter, *http.Request), middleware ...func(http.Handler) http.Handler) *Route {
+	return s.HandleFunc(http.MethodHead, path, handler, middleware...)
+}
+
+// Any registers a new route for requests of any method, like HandleFunc.
+func (s *Subrouter) Any(path string, handler func(http.ResponseWriter, *http.Request), middleware ...func(http.Handler) http.Handler) *Route {
+	return s.HandleFunc(MethodAny, path, handler, middleware...)
+}
+
+// join joins a route path to the prefix, an empty path stays empty, so the
+// router rejects it like a route path of its own.
+func (s *Subrouter) join(path string) string {
+	if path == "" {
+		return ""
+	}
+
+	return joinPath(s.prefix, path)
+}
+
+// joinPath joins a route path to a prefix, one trailing "/" of both is
+// removed, so the route path "/" is the prefix itself.
+func joinPath(prefix string, path string) string {
+	prefix = strings.TrimSuffix(prefix, "/")
+	path = strings.TrimSuffix(path, "/")
+	if path != "" && path[0] != '/' {
+		path = "/" + path
+	}
+	if prefix+path == "" {
+		return "/"
+	}
+
+	return prefix + path
+}
@@ -0,0 +1,120 @@
+// Copyright 2019 Yaacov Zamir <kobi.zamir@gmail.com>
+// and other contributors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mux
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSubrouter(t *testing.T) {
+	// A handler writing the route and the route parameters.
+	vars := func(w http.ResponseWriter, r *http.Request) {
+		route, _ := CurrentRoute(r)
+		tenant, _ := Var(r, "tenant")
+		key, _ := Var(r, "key")
+
+		io.WriteString(w, strings.Join([]string{route, tenant, key}, " "))
+	}
+
+	router := Router{
+		NotFoundHandler: notFound,
+	}
+	api := router.PathPrefix("/api/v1/")
+	api.HandleFunc("GET", "/val/:key", vars)
+	api.Get("/", vars)
+
+	tenant := api.PathPrefix("tenants/:tenant")
+	tenant.HandleFunc("GET", "/val/:key", vars)
+	tenant.Handle("PUT", "val/:key", http.HandlerFunc(vars))
+	tenant.Get("/", vars)
+
+	tests := []struct {
+		method   string
+		path     string
+		code     int
+		expected string
+	}{
+		{"GET", "/api/v1/val/kitty", http.StatusOK, "/api/v1/val/:key  kitty"},
+		{"GET", "/api/v1", http.StatusOK, "/api/v1  "},
+		{"GET", "/api/v1/", http.StatusOK, "/api/v1  "},
+		{"GET", "/api/v1/tenants/cats/val/kitty", http.StatusOK, "/api/v1/tenants/:tenant/val/:key cats kitty"},
+		{"PUT", "/api/v1/tenants/cats/val/kitty", http.StatusOK, "/api/v1/tenants/:tenant/val/:key cats kitty"},
+		{"GET", "/api/v1/tenants/a%2Fb", http.StatusOK, "/api/v1/tenants/:tenant a/b "},
+		{"GET", "/val/kitty", http.StatusNotFound, "404 – Page not found."},
+		{"GET", "/api/v1/tenants", http.StatusNotFound, "404 – Page not found."},
+		{"POST", "/api/v1/val/kitty", http.StatusNotFound, "404 – Page not found."},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		// Check the status code and the body are what we expect.
+		if rr.Code != tt.code || rr.Body.String() != tt.expected {
+			t.Errorf("%s %s: got %v %q want %v %q",
+				tt.method, tt.path, rr.Code, rr.Body.String(), tt.code, tt.expected)
+		}
+	}
+}
+
+func TestSubrouterEmptyPath(t *testing.T) {
+	router := Router{}
+	api := router.PathPrefix("/api")
+
+	// Check an empty path is rejected like a route path of the router.
+	if _, err := api.HandleFuncE("GET", "", found); !errors.Is(err, ErrEmptyPath) {
+		t.Errorf("wrong error: got %v want %v", err, ErrEmptyPath)
+	}
+	api.HandleFunc("GET", "", found)
+	if routes := router.Routes(); len(routes) != 0 {
+		t.Errorf("route with an empty path was registered: %v", routes)
+	}
+}
+
+func TestJoinPath(t *testing.T) {
+	tests := []struct {
+		prefix   string
+		path     string
+		expected string
+	}{
+		{"", "", "/"},
+		{"", "/", "/"},
+		{"/", "/", "/"},
+		{"", "api", "/api"},
+		{"/api", "/val", "/api/val"},
+		{"/api/", "val/", "/api/val"},
+		{"/api", "", "/api"},
+		{"/api", "/", "/api"},
+		{"/api", "//val", "/api//val"},
+	}
+
+	for _, tt := range tests {
+		// Check the joined path is what we expect.
+		if got := joinPath(tt.prefix, tt.path); got != tt.expected {
+			t.Errorf("%q %q: got %q want %q", tt.prefix, tt.path, got, tt.expected)
+		}
+	}
+}